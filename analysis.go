@@ -0,0 +1,152 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/registry"
+
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The dropdowns of the index mapping UI list the analysis components
+// (analyzers, tokenizers, etc) that are registered in the cbft binary,
+// along with the custom components of the mapping being edited.
+//
+// Some analysis components are only registered when cbft is built
+// with their build tags, like the Japanese "ja" analyzer (kagome) and
+// the "icu" tokenizer (icu, which needs the ICU C libraries), while
+// the "cjk" bigram analyzer is always registered.
+
+// AnalysisBuildTags holds the build tags that register analysis
+// components, keyed by component name.
+var AnalysisBuildTags = map[string]string{
+	"ja":  "kagome",
+	"icu": "icu",
+	"th":  "icu",
+}
+
+// The kinds of analysis components, keyed by the name of their JSON
+// response field, with the func that returns the registered names and
+// the custom names of a mapping.
+var analysisKinds = map[string]func(m *bleve.IndexMapping) ([]string, []string){
+	"analyzers": func(m *bleve.IndexMapping) ([]string, []string) {
+		_, names := registry.AnalyzerTypesAndInstances()
+		return names, analysisCustomNames(m.CustomAnalysis.Analyzers)
+	},
+	"char_filters": func(m *bleve.IndexMapping) ([]string, []string) {
+		_, names := registry.CharFilterTypesAndInstances()
+		return names, analysisCustomNames(m.CustomAnalysis.CharFilters)
+	},
+	"tokenizers": func(m *bleve.IndexMapping) ([]string, []string) {
+		_, names := registry.TokenizerTypesAndInstances()
+		return names, analysisCustomNames(m.CustomAnalysis.Tokenizers)
+	},
+	"token_filters": func(m *bleve.IndexMapping) ([]string, []string) {
+		_, names := registry.TokenFilterTypesAndInstances()
+		return names, analysisCustomNames(m.CustomAnalysis.TokenFilters)
+	},
+	"token_maps": func(m *bleve.IndexMapping) ([]string, []string) {
+		_, names := registry.TokenMapTypesAndInstances()
+		return names, analysisCustomNames(m.CustomAnalysis.TokenMaps)
+	},
+	"datetime_parsers": func(m *bleve.IndexMapping) ([]string, []string) {
+		_, names := registry.DateTimeParserTypesAndInstances()
+		return names, analysisCustomNames(m.CustomAnalysis.DateTimeParsers)
+	},
+}
+
+func analysisCustomNames(custom map[string]map[string]interface{}) []string {
+	rv := make([]string, 0, len(custom))
+	for name := range custom {
+		rv = append(rv, name)
+	}
+	return rv
+}
+
+// AnalysisNames returns the sorted names of the registered analysis
+// components of a kind, such as "analyzers", along with the custom
+// components of an index mapping.
+func AnalysisNames(kind string, m *bleve.IndexMapping) ([]string, error) {
+	f := analysisKinds[kind]
+	if f == nil {
+		return nil, fmt.Errorf("analysis: unknown kind: %s", kind)
+	}
+
+	if m.CustomAnalysis == nil {
+		m = bleve.NewIndexMapping()
+	}
+
+	registered, custom := f(m)
+
+	seen := map[string]bool{}
+	rv := make([]string, 0, len(registered)+len(custom))
+	for _, names := range [][]string{registered, custom} {
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				rv = append(rv, name)
+			}
+		}
+	}
+	sort.Strings(rv)
+
+	return rv, nil
+}
+
+// AnalysisUnavailable returns the analysis components that aren't
+// registered in this binary, keyed by name, with the build tag that
+// registers them.
+func AnalysisUnavailable() map[string]string {
+	var registered []string
+	for _, f := range analysisKinds {
+		names, _ := f(bleve.NewIndexMapping())
+		registered = append(registered, names...)
+	}
+
+	rv := map[string]string{}
+	for name, tag := range AnalysisBuildTags {
+		rv[name] = tag
+	}
+	for _, name := range registered {
+		delete(rv, name)
+	}
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// AnalysisHandler is a REST handler that returns the registered
+// analysis components, and the ones that aren't available in this
+// binary, along with their build tags.
+type AnalysisHandler struct{}
+
+func NewAnalysisHandler() *AnalysisHandler {
+	return &AnalysisHandler{}
+}
+
+func (h *AnalysisHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	rv := map[string]interface{}{
+		"status":      "ok",
+		"unavailable": AnalysisUnavailable(),
+	}
+	for kind := range analysisKinds {
+		rv[kind], _ = AnalysisNames(kind, bleve.NewIndexMapping())
+	}
+
+	rest.MustEncode(w, rv)
+}
@@ -0,0 +1,83 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+func analysisTestContains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAnalysisNames(t *testing.T) {
+	m := bleve.NewIndexMapping()
+	err := json.Unmarshal([]byte(`{"analysis":{"analyzers":{
+		"myAnalyzer":{"type":"custom","tokenizer":"unicode"}}}}`), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := AnalysisNames("analyzers", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"standard", "keyword", "myAnalyzer"} {
+		if !analysisTestContains(names, name) {
+			t.Errorf("expected analyzer: %s, got: %v", name, names)
+		}
+	}
+
+	names, err = AnalysisNames("tokenizers", m)
+	if err != nil || !analysisTestContains(names, "unicode") ||
+		analysisTestContains(names, "myAnalyzer") {
+		t.Errorf("unexpected tokenizers: %v, err: %v", names, err)
+	}
+
+	_, err = AnalysisNames("nope", m)
+	if err == nil {
+		t.Errorf("expected err on an unknown kind")
+	}
+
+	analyzers, _ := AnalysisNames("analyzers", bleve.NewIndexMapping())
+	tokenizers, _ := AnalysisNames("tokenizers", bleve.NewIndexMapping())
+	for name, tag := range AnalysisUnavailable() {
+		if AnalysisBuildTags[name] != tag ||
+			analysisTestContains(analyzers, name) ||
+			analysisTestContains(tokenizers, name) {
+			t.Errorf("unexpected unavailable: %s, tag: %s", name, tag)
+		}
+	}
+}
+
+func TestAnalysisHandler(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/api/analysis", nil)
+	rr := httptest.NewRecorder()
+	NewAnalysisHandler().ServeHTTP(rr, req)
+
+	var all map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &all)
+	if rr.Code != 200 || all["analyzers"] == nil ||
+		all["tokenizers"] == nil || all["unavailable"] == nil {
+		t.Errorf("unexpected response: %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,690 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// An index may extract the text of attachments, like PDFs and Office
+// documents that are stored as base64 strings in document fields,
+// before the documents are analyzed, with "attachments" in its bleve
+// index params...
+//
+//   "attachments": {
+//     "fields": ["contract.file"],         // Optional.
+//     "tikaURL": "http://tika:9998/tika",  // Optional.
+//     "maxBytes": 20971520,                // Optional.
+//     "timeoutMs": 10000}                  // Optional.
+//
+// The value of each attachment field, which may also be a data URI,
+// is replaced by its extracted text, so the field is mapped as a text
+// field.  Without fields, the string fields whose base64 content
+// starts like a PDF, Office or OpenDocument file are detected as
+// attachments.  With a tikaURL, the attachments are PUT to an Apache
+// Tika server for extraction; otherwise, they're extracted by cbft,
+// which handles the text of PDFs with simple font encodings and of
+// Office Open XML (docx, xlsx, pptx) and OpenDocument files, but not
+// scanned PDFs or legacy Office (doc, xls, ppt) files.  Attachments
+// that can't be extracted are removed from their documents, with an
+// ingest error.
+
+const ATTACHMENTS_DEFAULT_MAX_BYTES = 20 * 1024 * 1024
+const ATTACHMENTS_DEFAULT_TIMEOUT_MS = 10000
+
+// The content types of the detected attachments.
+const (
+	ATTACHMENT_PDF      = "application/pdf"
+	ATTACHMENT_DOCX     = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	ATTACHMENT_XLSX     = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	ATTACHMENT_PPTX     = "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+	ATTACHMENT_ODF      = "application/vnd.oasis.opendocument"
+	ATTACHMENT_MSOFFICE = "application/x-tika-msoffice"
+	ATTACHMENT_ZIP      = "application/zip"
+)
+
+// The base64 prefixes of the magic numbers of PDF ("%PDF-"), zip
+// ("PK\x03\x04") and legacy Office (OLE2) files.
+var attachmentBase64Prefixes = []string{"JVBERi0", "UEsDB", "0M8R4KGx"}
+
+// BleveAttachments is the attachment extraction of an index.
+type BleveAttachments struct {
+	Fields    []string `json:"fields,omitempty"`
+	TikaURL   string   `json:"tikaURL,omitempty"`
+	MaxBytes  int      `json:"maxBytes,omitempty"`
+	TimeoutMs int      `json:"timeoutMs,omitempty"`
+}
+
+func (a *BleveAttachments) maxBytes() int {
+	if a.MaxBytes > 0 {
+		return a.MaxBytes
+	}
+	return ATTACHMENTS_DEFAULT_MAX_BYTES
+}
+
+func (a *BleveAttachments) timeout() time.Duration {
+	if a.TimeoutMs > 0 {
+		return time.Duration(a.TimeoutMs) * time.Millisecond
+	}
+	return ATTACHMENTS_DEFAULT_TIMEOUT_MS * time.Millisecond
+}
+
+// validateBleveAttachments checks the attachment extraction of the
+// index params.
+func validateBleveAttachments(a *BleveAttachments) error {
+	if a == nil {
+		return nil
+	}
+	for _, f := range a.Fields {
+		if f == "" || strings.HasPrefix(f, ".") || strings.HasSuffix(f, ".") {
+			return fmt.Errorf("attachments: bad field: %q", f)
+		}
+	}
+	if a.TikaURL != "" {
+		u, err := url.Parse(a.TikaURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+			u.Host == "" {
+			return fmt.Errorf("attachments: tikaURL must be an http or"+
+				" https URL, tikaURL: %q", a.TikaURL)
+		}
+	}
+	if a.MaxBytes < 0 || a.TimeoutMs < 0 {
+		return fmt.Errorf("attachments: maxBytes and timeoutMs must be >= 0")
+	}
+	return nil
+}
+
+// extract replaces the attachments of a parsed JSON document with
+// their text, returning the errors of the attachments that couldn't
+// be extracted, which are removed from the document.
+func (a *BleveAttachments) extract(m map[string]interface{}) []error {
+	var errs []error
+
+	if len(a.Fields) > 0 {
+		for _, field := range a.Fields {
+			s, ok := nestedGet(m, field).(string)
+			if !ok || s == "" {
+				continue
+			}
+			data, err := a.decode(s)
+			if err == nil {
+				var text string
+				text, err = a.extractData(data)
+				if err == nil {
+					nestedSet(m, field, text)
+					continue
+				}
+			}
+			errs = append(errs, fmt.Errorf("attachments: field: %s,"+
+				" err: %v", field, err))
+			nestedSet(m, field, nil)
+		}
+		return errs
+	}
+
+	var walk func(v interface{}, path string) interface{}
+	walk = func(v interface{}, path string) interface{} {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			for k, child := range x {
+				p := k
+				if path != "" {
+					p = path + "." + k
+				}
+				x[k] = walk(child, p)
+			}
+		case []interface{}:
+			for i, child := range x {
+				x[i] = walk(child, path)
+			}
+		case string:
+			if !attachmentDetectBase64(x) {
+				return x
+			}
+			data, err := a.decode(x)
+			if err == nil {
+				var text string
+				text, err = a.extractData(data)
+				if err == nil {
+					return text
+				}
+			} else if _, ok := err.(base64.CorruptInputError); ok {
+				return x // Not base64, so not an attachment.
+			}
+			errs = append(errs, fmt.Errorf("attachments: field: %s,"+
+				" err: %v", path, err))
+			return nil
+		}
+		return v
+	}
+	walk(m, "")
+
+	return errs
+}
+
+// attachmentDetectBase64 returns whether a string looks like a base64
+// attachment, or a data URI of one.
+func attachmentDetectBase64(s string) bool {
+	if strings.HasPrefix(s, "data:") {
+		i := strings.Index(s, ";base64,")
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(";base64,"):]
+	}
+	for _, prefix := range attachmentBase64Prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// decode decodes a base64 attachment, or a data URI of one.
+func (a *BleveAttachments) decode(s string) ([]byte, error) {
+	if strings.HasPrefix(s, "data:") {
+		i := strings.Index(s, ";base64,")
+		if i < 0 {
+			return nil, fmt.Errorf("data URI is not base64")
+		}
+		s = s[i+len(";base64,"):]
+	}
+	if base64.StdEncoding.DecodedLen(len(s)) > a.maxBytes() {
+		return nil, fmt.Errorf("attachment is larger than maxBytes: %d",
+			a.maxBytes())
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// extractData extracts the text of a decoded attachment.
+func (a *BleveAttachments) extractData(data []byte) (string, error) {
+	contentType := attachmentContentType(data)
+
+	var text string
+	var err error
+	if a.TikaURL != "" {
+		text, err = attachmentTikaPut(a.TikaURL, contentType, data,
+			a.maxBytes(), a.timeout())
+	} else {
+		text, err = attachmentExtract(contentType, data, a.maxBytes())
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(text), nil
+}
+
+// attachmentContentType returns the content type of an attachment,
+// or "" when unknown.
+func attachmentContentType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("%PDF-")):
+		return ATTACHMENT_PDF
+	case bytes.HasPrefix(data, []byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1")):
+		return ATTACHMENT_MSOFFICE
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return ""
+		}
+		for _, f := range r.File {
+			switch {
+			case f.Name == "word/document.xml":
+				return ATTACHMENT_DOCX
+			case f.Name == "xl/workbook.xml":
+				return ATTACHMENT_XLSX
+			case f.Name == "ppt/presentation.xml":
+				return ATTACHMENT_PPTX
+			case f.Name == "mimetype":
+				b, _ := attachmentReadZipFile(f, 256)
+				if strings.HasPrefix(string(b), ATTACHMENT_ODF) {
+					return string(b)
+				}
+			}
+		}
+		return ATTACHMENT_ZIP
+	}
+	return ""
+}
+
+// attachmentTikaPut extracts the text of an attachment with a Tika
+// server, and may be overridden for testing.
+var attachmentTikaPut = func(u, contentType string, data []byte,
+	maxBytes int, timeout time.Duration) (string, error) {
+	req, err := http.NewRequest("PUT", u, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "text/plain")
+	if contentType != "" && contentType != ATTACHMENT_MSOFFICE {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body,
+		int64(maxBytes)))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("tika status: %d, body: %s",
+			resp.StatusCode, respBody)
+	}
+	return string(respBody), nil
+}
+
+// attachmentExtract extracts the text of an attachment without Tika.
+func attachmentExtract(contentType string, data []byte,
+	maxBytes int) (string, error) {
+	var text string
+	var err error
+
+	switch {
+	case contentType == ATTACHMENT_PDF:
+		text, err = attachmentPDFText(data, maxBytes)
+	case contentType == ATTACHMENT_DOCX:
+		text, err = attachmentZipText(data, maxBytes,
+			[]string{"word/document.xml"}, map[string]bool{"t": true})
+	case contentType == ATTACHMENT_XLSX:
+		text, err = attachmentZipText(data, maxBytes,
+			[]string{"xl/sharedStrings.xml"}, map[string]bool{"t": true})
+	case contentType == ATTACHMENT_PPTX:
+		text, err = attachmentZipText(data, maxBytes,
+			attachmentPPTXSlides(data), map[string]bool{"t": true})
+	case strings.HasPrefix(contentType, ATTACHMENT_ODF):
+		text, err = attachmentZipText(data, maxBytes,
+			[]string{"content.xml"}, nil)
+	case contentType == "":
+		return "", fmt.Errorf("unknown attachment content type")
+	default:
+		return "", fmt.Errorf("attachment content type: %s needs a"+
+			" tikaURL", contentType)
+	}
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(text) == "" {
+		return "", fmt.Errorf("no text in attachment, content type: %s",
+			contentType)
+	}
+	return text, nil
+}
+
+// ---------------------------------------------------------
+
+func attachmentReadZipFile(f *zip.File, maxBytes int) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(io.LimitReader(rc, int64(maxBytes)))
+}
+
+var attachmentSlideRE = regexp.MustCompile(`^ppt/slides/slide([0-9]+)\.xml$`)
+
+type attachmentSlides []string
+
+func (s attachmentSlides) Len() int      { return len(s) }
+func (s attachmentSlides) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s attachmentSlides) Less(i, j int) bool {
+	a, _ := strconv.Atoi(attachmentSlideRE.FindStringSubmatch(s[i])[1])
+	b, _ := strconv.Atoi(attachmentSlideRE.FindStringSubmatch(s[j])[1])
+	return a < b
+}
+
+// attachmentPPTXSlides returns the names of the slides of a pptx, in
+// slide order.
+func attachmentPPTXSlides(data []byte) []string {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil
+	}
+	var rv attachmentSlides
+	for _, f := range r.File {
+		if attachmentSlideRE.MatchString(f.Name) {
+			rv = append(rv, f.Name)
+		}
+	}
+	sort.Sort(rv)
+	return rv
+}
+
+// The XML elements, by local name, that end lines of text.
+var attachmentXMLBreaks = map[string]bool{
+	"p": true, "h": true, "si": true, "br": true, "tab": true,
+}
+
+// attachmentZipText returns the text of XML files of a zip, which is
+// the character data of the elements with the given local names, or
+// of all elements when nil.
+func attachmentZipText(data []byte, maxBytes int, names []string,
+	textElems map[string]bool) (string, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	files := map[string]*zip.File{}
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		f := files[name]
+		if f == nil {
+			continue
+		}
+		b, err := attachmentReadZipFile(f, maxBytes-buf.Len())
+		if err != nil {
+			return "", err
+		}
+
+		d := xml.NewDecoder(bytes.NewReader(b))
+		depth := 0 // Depth within text elements.
+		for {
+			tok, err := d.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", fmt.Errorf("could not parse: %s, err: %v",
+					name, err)
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				if textElems[t.Name.Local] {
+					depth++
+				}
+			case xml.EndElement:
+				if textElems[t.Name.Local] {
+					depth--
+				}
+				if attachmentXMLBreaks[t.Name.Local] {
+					buf.WriteByte('\n')
+				}
+			case xml.CharData:
+				if textElems == nil || depth > 0 {
+					buf.Write(t)
+				}
+			}
+		}
+		buf.WriteByte('\n')
+	}
+
+	return buf.String(), nil
+}
+
+// ---------------------------------------------------------
+
+var attachmentPDFStreamRE = regexp.MustCompile(`stream\r?\n`)
+
+// attachmentPDFText returns the text of the content streams of a PDF,
+// which are uncompressed or FlateDecode'd, from the strings of their
+// text showing operators.  Strings are decoded as UTF-16BE when they
+// start with a byte order mark, or else as Latin-1, so the text of
+// fonts with custom encodings, like most CID fonts, is lost.
+func attachmentPDFText(data []byte, maxBytes int) (string, error) {
+	var buf bytes.Buffer
+
+	for _, loc := range attachmentPDFStreamRE.FindAllIndex(data, -1) {
+		dictStart := bytes.LastIndex(data[:loc[0]], []byte("obj"))
+		if dictStart < 0 {
+			continue
+		}
+		dict := data[dictStart:loc[0]]
+		if bytes.Contains(dict, []byte("/Subtype")) ||
+			bytes.Contains(dict, []byte("/Length1")) ||
+			bytes.Contains(dict, []byte("/Type/XRef")) ||
+			bytes.Contains(dict, []byte("/Type /XRef")) {
+			continue // Images, fonts and xref streams.
+		}
+
+		end := bytes.Index(data[loc[1]:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		content := data[loc[1] : loc[1]+end]
+
+		if bytes.Contains(dict, []byte("/Filter")) {
+			if !bytes.Contains(dict, []byte("/FlateDecode")) ||
+				bytes.Contains(dict, []byte("/DecodeParms")) {
+				continue
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(content))
+			if err != nil {
+				continue
+			}
+			content, err = ioutil.ReadAll(io.LimitReader(zr,
+				int64(maxBytes)))
+			zr.Close()
+			if err != nil && len(content) <= 0 {
+				continue
+			}
+		}
+
+		attachmentPDFContentText(content, &buf)
+		if buf.Len() >= maxBytes {
+			break
+		}
+	}
+
+	text := buf.String()
+	if len(text) > maxBytes {
+		text = text[:maxBytes]
+	}
+	return text, nil
+}
+
+// attachmentPDFContentText appends the text of the text showing
+// operators (Tj, TJ, ' and ") of a content stream to buf.
+func attachmentPDFContentText(content []byte, buf *bytes.Buffer) {
+	var operands []interface{} // Strings and numbers.
+	inText := false
+
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '(':
+			s, n := attachmentPDFLiteral(content[i:])
+			operands = append(operands, s)
+			i += n
+		case c == '<' && i+1 < len(content) && content[i+1] != '<':
+			end := bytes.IndexByte(content[i:], '>')
+			if end < 0 {
+				return
+			}
+			operands = append(operands, attachmentPDFHex(content[i+1:i+end]))
+			i += end + 1
+		case c == '%':
+			end := bytes.IndexAny(content[i:], "\r\n")
+			if end < 0 {
+				return
+			}
+			i += end
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(content) && (content[j] == '.' ||
+				(content[j] >= '0' && content[j] <= '9')) {
+				j++
+			}
+			f, err := strconv.ParseFloat(string(content[i:j]), 64)
+			if err == nil {
+				operands = append(operands, f)
+			}
+			i = j
+		case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			c == '\'' || c == '"' || c == '*':
+			j := i + 1
+			for j < len(content) && ((content[j] >= 'a' && content[j] <= 'z') ||
+				(content[j] >= 'A' && content[j] <= 'Z') || content[j] == '*') {
+				j++
+			}
+			op := string(content[i:j])
+			switch op {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				buf.WriteByte('\n')
+			case "Td", "TD", "T*", "Tm":
+				if inText {
+					buf.WriteByte(' ')
+				}
+			case "Tj", "'", "\"", "TJ":
+				if !inText {
+					break
+				}
+				if op == "'" || op == "\"" {
+					buf.WriteByte('\n')
+				}
+				for _, operand := range operands {
+					switch x := operand.(type) {
+					case string:
+						buf.WriteString(x)
+					case float64:
+						if op == "TJ" && x < -200 {
+							buf.WriteByte(' ') // A wide kerning gap.
+						}
+					}
+				}
+			}
+			operands = operands[:0]
+			i = j
+		case c == '[' || c == ']':
+			i++
+		default:
+			if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+				operands = operands[:0] // Names, dicts, etc.
+			}
+			i++
+		}
+	}
+}
+
+// attachmentPDFLiteral returns the decoded text of a PDF literal
+// string, which starts with '(', and its length.
+func attachmentPDFLiteral(b []byte) (string, int) {
+	var s []byte
+	depth := 0
+	i := 0
+	for ; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c == '\\' && i+1 < len(b):
+			i++
+			switch e := b[i]; e {
+			case 'n':
+				s = append(s, '\n')
+			case 'r':
+				s = append(s, '\r')
+			case 't':
+				s = append(s, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+			default:
+				if e >= '0' && e <= '7' {
+					j := i
+					for j < i+3 && j < len(b) && b[j] >= '0' && b[j] <= '7' {
+						j++
+					}
+					o, _ := strconv.ParseUint(string(b[i:j]), 8, 8)
+					s = append(s, byte(o))
+					i = j - 1
+				} else {
+					s = append(s, e)
+				}
+			}
+		case c == '(':
+			if depth > 0 {
+				s = append(s, c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return attachmentPDFDecode(s), i + 1
+			}
+			s = append(s, c)
+		default:
+			s = append(s, c)
+		}
+	}
+	return attachmentPDFDecode(s), i
+}
+
+// attachmentPDFHex returns the decoded text of the digits of a PDF
+// hex string.
+func attachmentPDFHex(b []byte) string {
+	var s []byte
+	var digits []byte
+	for _, c := range b {
+		if (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') ||
+			(c >= 'A' && c <= 'F') {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 != 0 {
+		digits = append(digits, '0')
+	}
+	for i := 0; i < len(digits); i += 2 {
+		v, _ := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+		s = append(s, byte(v))
+	}
+	return attachmentPDFDecode(s)
+}
+
+// attachmentPDFDecode decodes the bytes of a PDF string as UTF-16BE
+// with a byte order mark, or else as Latin-1, dropping control chars.
+func attachmentPDFDecode(s []byte) string {
+	var rv []rune
+	if len(s) >= 2 && s[0] == 0xFE && s[1] == 0xFF {
+		for i := 2; i+1 < len(s); i += 2 {
+			rv = append(rv, rune(s[i])<<8|rune(s[i+1]))
+		}
+	} else {
+		for _, c := range s {
+			rv = append(rv, rune(c))
+		}
+	}
+	out := make([]rune, 0, len(rv))
+	for _, r := range rv {
+		if r >= ' ' || r == '\n' || r == '\t' {
+			if utf8.ValidRune(r) {
+				out = append(out, r)
+			}
+		}
+	}
+	return string(out)
+}
@@ -0,0 +1,210 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func attachmentTestPDF(content string, compress bool) string {
+	stream := []byte(content)
+	filter := ""
+	if compress {
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		w.Write(stream)
+		w.Close()
+		stream = buf.Bytes()
+		filter = " /Filter /FlateDecode"
+	}
+	pdf := fmt.Sprintf("%%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\n"+
+		"2 0 obj\n<< /Length %d%s >>\nstream\n%s\nendstream\nendobj\n"+
+		"trailer\n<< /Root 1 0 R >>\n%%%%EOF\n", len(stream), filter, stream)
+	return base64.StdEncoding.EncodeToString([]byte(pdf))
+}
+
+func attachmentTestZip(files map[string]string) string {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, _ := w.Create(name)
+		f.Write([]byte(content))
+	}
+	w.Close()
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestValidateBleveAttachments(t *testing.T) {
+	err := ValidateBlevePIndexImpl("bleve", "idx",
+		`{"attachments":{"fields":["file"],"tikaURL":"http://tika:9998/tika"}}`)
+	if err != nil {
+		t.Errorf("expected valid params, got: %v", err)
+	}
+
+	for _, a := range []*BleveAttachments{
+		{Fields: []string{""}},
+		{Fields: []string{"file."}},
+		{TikaURL: "tika:9998"},
+		{MaxBytes: -1},
+	} {
+		if validateBleveAttachments(a) == nil {
+			t.Errorf("expected err, attachments: %#v", a)
+		}
+	}
+}
+
+func TestAttachmentsExtract(t *testing.T) {
+	docx := attachmentTestZip(map[string]string{
+		"word/document.xml": `<w:document xmlns:w="w"><w:body>` +
+			`<w:p><w:r><w:t>Master</w:t></w:r><w:r><w:t xml:space="preserve">` +
+			` services</w:t></w:r></w:p><w:p><w:r><w:instrText>PAGE` +
+			`</w:instrText><w:t>agreement</w:t></w:r></w:p></w:body></w:document>`,
+	})
+	pptx := attachmentTestZip(map[string]string{
+		"ppt/presentation.xml":   `<p:presentation xmlns:p="p"/>`,
+		"ppt/slides/slide10.xml": `<p:sld xmlns:a="a"><a:t>last</a:t></p:sld>`,
+		"ppt/slides/slide2.xml":  `<p:sld xmlns:a="a"><a:t>first</a:t></p:sld>`,
+	})
+
+	a := &BleveAttachments{}
+	m := map[string]interface{}{
+		"title": "JVBERi0 is not long enough to matter",
+		"contract": map[string]interface{}{
+			"file": attachmentTestPDF(`BT /F1 12 Tf 72 712 Td `+
+				`(Contract \(signed\)) Tj ET`, false),
+		},
+		"scans": []interface{}{
+			attachmentTestPDF(`BT [(Ter)-20(mi)-400(nation)] TJ ET`, true),
+			"data:application/pdf;base64," +
+				attachmentTestPDF(`BT <FEFF0063006C0061007500730065> Tj ET`, true),
+		},
+		"docx":   docx,
+		"pptx":   pptx,
+		"legacy": base64.StdEncoding.EncodeToString([]byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1junk")),
+	}
+
+	errs := a.extract(m)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "legacy") {
+		t.Errorf("expected an err for the legacy attachment, got: %v", errs)
+	}
+	if m["legacy"] != nil {
+		t.Errorf("expected the legacy attachment to be removed")
+	}
+	if m["title"] != "JVBERi0 is not long enough to matter" {
+		t.Errorf("expected plain strings to be kept, got: %v", m["title"])
+	}
+	if nestedGet(m, "contract.file") != "Contract (signed)" {
+		t.Errorf("unexpected pdf text: %q", nestedGet(m, "contract.file"))
+	}
+	scans := m["scans"].([]interface{})
+	if scans[0] != "Termi nation" || scans[1] != "clause" {
+		t.Errorf("unexpected pdf texts: %q", scans)
+	}
+	if m["docx"] != "Master services\nagreement" {
+		t.Errorf("unexpected docx text: %q", m["docx"])
+	}
+	if m["pptx"] != "first\nlast" {
+		t.Errorf("unexpected pptx text: %q", m["pptx"])
+	}
+
+	// Explicit fields are extracted even when not detected.
+	a = &BleveAttachments{Fields: []string{"file", "missing"}}
+	m = map[string]interface{}{
+		"file":  base64.StdEncoding.EncodeToString([]byte("plain text")),
+		"other": docx,
+	}
+	errs = a.extract(m)
+	if len(errs) != 1 || m["file"] != nil || m["other"] != docx {
+		t.Errorf("expected an err for the unknown type, got: %v, m: %v",
+			errs, m)
+	}
+
+	a = &BleveAttachments{MaxBytes: 10}
+	m = map[string]interface{}{"file": docx}
+	errs = a.extract(m)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "maxBytes") {
+		t.Errorf("expected a maxBytes err, got: %v", errs)
+	}
+}
+
+func TestAttachmentsTika(t *testing.T) {
+	var contentType string
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			if r.Method != "PUT" || !bytes.HasPrefix(body, []byte("\xD0\xCF")) {
+				http.Error(w, "bad request", 400)
+				return
+			}
+			contentType = r.Header.Get("Content-Type")
+			w.Write([]byte("  Legacy contract \n"))
+		}))
+	defer ts.Close()
+
+	a := &BleveAttachments{TikaURL: ts.URL}
+	m := map[string]interface{}{
+		"file": base64.StdEncoding.EncodeToString(
+			[]byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1junk")),
+	}
+	errs := a.extract(m)
+	if len(errs) != 0 || m["file"] != "Legacy contract" || contentType != "" {
+		t.Errorf("expected tika text, got: %v, errs: %v, contentType: %s",
+			m, errs, contentType)
+	}
+
+	ts.Close()
+	m["file"] = attachmentTestPDF(`BT (x) Tj ET`, false)
+	errs = a.extract(m)
+	if len(errs) != 1 || m["file"] != nil {
+		t.Errorf("expected an err when tika is down, got: %v", errs)
+	}
+}
+
+func TestAttachmentsDataUpdate(t *testing.T) {
+	bindex, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bdest := NewBleveDest("/tmp/idx_1234_5678.pindex", bindex, func() {})
+	bdest.attachments = &BleveAttachments{Fields: []string{"file"}}
+	dest := &cbgt.DestForwarder{DestProvider: bdest}
+	defer dest.Close()
+
+	dest.SnapshotStart("0", 1, 1)
+	err = dest.DataUpdate("0", []byte("c1"), 1,
+		[]byte(`{"file":"`+attachmentTestPDF(`BT (indemnification) Tj ET`,
+			true)+`"}`), 0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := bindex.Search(bleve.NewSearchRequest(
+		bleve.NewMatchQuery("indemnification")))
+	if err != nil || len(res.Hits) != 1 {
+		t.Errorf("expected the attachment text to be indexed, got: %v,"+
+			" err: %v", res, err)
+	}
+}
@@ -0,0 +1,249 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The REST API of a node can require that requests are authenticated,
+// where each authenticated request has the roles of its identity, and
+// each request needs a permission that one of the roles grants.  The
+// identity of a request comes from the first of the node's
+// Authenticators that recognizes the request's credentials, such as
+// a client certificate (see rest_tls.go), basic auth credentials
+// (see basic_auth.go) or a bearer token (see jwt_auth.go).  Without
+// authenticators, a node's REST API is open, as before.
+
+// The permissions of REST requests.
+const (
+	PERMISSION_SEARCH = "search" // Queries and counts of indexes.
+	PERMISSION_READ   = "read"   // Other GET requests.
+	PERMISSION_MANAGE = "manage" // Everything else.
+)
+
+// AuthRoles are the permissions of each role.
+var AuthRoles = map[string][]string{
+	"admin":   {PERMISSION_SEARCH, PERMISSION_READ, PERMISSION_MANAGE},
+	"monitor": {PERMISSION_READ},
+	"search":  {PERMISSION_SEARCH},
+}
+
+// The requests that only need the search permission.
+var authSearchPathRE = regexp.MustCompile(`^/api/(v1/)?(` +
+	`index/[^/]+/(query|count|facetSuggestions|percolate)|` +
+	`pindex/[^/]+/(query|count)|` +
+	`ns/[^/]+/index/[^/]+/(query|count)|` +
+	`pindex-bleve/[^/]+/doc/.*)$`)
+
+// The GET requests that need the manage permission, as they export
+// the documents or files of indexes, or the node's configuration, or
+// start profiles.
+var authManagePathRE = regexp.MustCompile(`^/api/(v1/)?(` +
+	`index/[^/]+/archive|` +
+	`pindex/[^/]+/(files|file/.*|filesBulk|docs)|` +
+	`cfgSnapshot|diag/bundle|runtime/profile)$`)
+
+// The tenant routes, which check the auth keys of their namespaces.
+var authNamespacePathRE = regexp.MustCompile(`^/api/(v1/)?ns/([^/]+)/`)
+
+// AuthPathPrefixes are the path prefixes of the requests that are
+// checked, where the other requests, such as the static resources of
+// the web UI, are open.
+var AuthPathPrefixes = []string{"/api/", "/debug/"}
+
+// AuthExemptPathPrefixes are the path prefixes of the requests that
+// aren't checked by the node's authenticators, such as the health
+// routes of probes.  The tenant routes of a namespace that has an
+// auth key are exempt too, as they check the namespace's auth key,
+// while the tenant routes of a namespace without an auth key are
+// checked by the node's authenticators.
+var AuthExemptPathPrefixes = []string{
+	"/api/health/", "/api/v1/health/",
+}
+
+// An AuthIdentity is the authenticated identity of a request.
+type AuthIdentity struct {
+	User   string
+	Roles  []string
+	Source string // The kind of credentials, like "cert".
+}
+
+// An Authenticator returns the identity of a request, or nil when the
+// request doesn't have its kind of credentials, or an error when the
+// request has bad credentials.
+type Authenticator func(req *http.Request) (*AuthIdentity, error)
+
+// RESTAuth checks the REST requests of a node.
+type RESTAuth struct {
+	Authenticators []Authenticator
+
+	// The challenges of the WWW-Authenticate header of 401 responses.
+	Challenges []string
+
+	// The Cfg of the namespaces, whose tenant routes are exempt when
+	// the namespace has an auth key.
+	Cfg cbgt.Cfg
+}
+
+// NewRESTAuth returns the REST auth of a node from its node options,
+// where a RESTAuth without authenticators lets every request through.
+func NewRESTAuth(options map[string]string) (*RESTAuth, error) {
+	a := &RESTAuth{}
+
+	certAuth, err := NewCertAuthenticator(options)
+	if err != nil {
+		return nil, err
+	}
+	if certAuth != nil {
+		a.Authenticators = append(a.Authenticators, certAuth)
+	}
+
+	basicAuth, err := NewBasicAuthenticator(options)
+	if err != nil {
+		return nil, err
+	}
+	if basicAuth != nil {
+		a.Authenticators = append(a.Authenticators, basicAuth)
+		a.Challenges = append(a.Challenges,
+			`Basic realm="`+BASIC_AUTH_REALM+`"`)
+	}
+
+	jwtAuth, err := NewJWTAuthenticator(options)
+	if err != nil {
+		return nil, err
+	}
+	if jwtAuth != nil {
+		a.Authenticators = append(a.Authenticators, jwtAuth)
+		a.Challenges = append(a.Challenges,
+			`Bearer realm="`+BASIC_AUTH_REALM+`"`)
+	}
+
+	return a, nil
+}
+
+// Enabled returns true when requests need to be authenticated.
+func (a *RESTAuth) Enabled() bool {
+	return a != nil && len(a.Authenticators) > 0
+}
+
+// RESTPermission returns the permission that a request needs.
+func RESTPermission(req *http.Request) string {
+	path := req.URL.Path
+	if strings.HasPrefix(path, "/debug/") {
+		return PERMISSION_MANAGE
+	}
+	if authSearchPathRE.MatchString(path) {
+		return PERMISSION_SEARCH
+	}
+	if authManagePathRE.MatchString(path) {
+		return PERMISSION_MANAGE
+	}
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return PERMISSION_READ
+	}
+	return PERMISSION_MANAGE
+}
+
+// AuthAllowed returns true if one of the roles grants the permission.
+func AuthAllowed(roles []string, permission string) bool {
+	for _, role := range roles {
+		for _, p := range AuthRoles[role] {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authenticate returns the identity of a request, or nil if none of
+// the authenticators recognize the request's credentials.
+func (a *RESTAuth) Authenticate(req *http.Request) (*AuthIdentity, error) {
+	for _, authenticator := range a.Authenticators {
+		identity, err := authenticator(req)
+		if err != nil || identity != nil {
+			return identity, err
+		}
+	}
+	return nil, nil
+}
+
+// Handler returns a handler that checks the requests before they're
+// handled by the next handler.
+func (a *RESTAuth) Handler(next http.Handler) http.Handler {
+	if !a.Enabled() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !a.checked(req.URL.Path) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		identity, err := a.Authenticate(req)
+		if err != nil || identity == nil {
+			msg := "auth: not authenticated"
+			if err != nil {
+				msg = fmt.Sprintf("auth: not authenticated, err: %v", err)
+			}
+			for _, challenge := range a.Challenges {
+				w.Header().Add("WWW-Authenticate", challenge)
+			}
+			rest.ShowError(w, req, msg, 401)
+			return
+		}
+
+		permission := RESTPermission(req)
+		if !AuthAllowed(identity.Roles, permission) {
+			LogDebugf(LOG_CATEGORY_REST, "auth: forbidden, user: %s,"+
+				" source: %s, %s %s", identity.User, identity.Source,
+				req.Method, req.URL.Path)
+			rest.ShowError(w, req, fmt.Sprintf("auth: forbidden,"+
+				" user: %s needs the %s permission",
+				identity.User, permission), 403)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// checked returns true if the request of a path is checked by the
+// node's authenticators.
+func (a *RESTAuth) checked(path string) bool {
+	if m := authNamespacePathRE.FindStringSubmatch(path); m != nil &&
+		a.Cfg != nil {
+		ns, err := GetNamespace(a.Cfg, m[2])
+		if err == nil && ns != nil && ns.AuthKeyHash != "" {
+			return false
+		}
+	}
+	for _, prefix := range AuthExemptPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+	for _, prefix := range AuthPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
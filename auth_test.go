@@ -0,0 +1,176 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestRESTPermission(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		exp    string
+	}{
+		{"GET", "/api/index", PERMISSION_READ},
+		{"GET", "/api/index/x", PERMISSION_READ},
+		{"HEAD", "/api/stats", PERMISSION_READ},
+		{"PUT", "/api/index/x", PERMISSION_MANAGE},
+		{"DELETE", "/api/index/x", PERMISSION_MANAGE},
+		{"POST", "/api/index/x/query", PERMISSION_SEARCH},
+		{"POST", "/api/v1/index/x/query", PERMISSION_SEARCH},
+		{"GET", "/api/index/x/count", PERMISSION_SEARCH},
+		{"POST", "/api/pindex/x_123/query", PERMISSION_SEARCH},
+		{"GET", "/api/pindex-bleve/x_123/doc/a", PERMISSION_SEARCH},
+		{"POST", "/api/index/x/ingestControl/pause", PERMISSION_MANAGE},
+		{"GET", "/debug/vars", PERMISSION_MANAGE},
+		{"GET", "/debug/pprof/heap", PERMISSION_MANAGE},
+		{"POST", "/api/index/x/sample", PERMISSION_MANAGE},
+		{"GET", "/api/index/x/archive", PERMISSION_MANAGE},
+		{"GET", "/api/v1/index/x/archive", PERMISSION_MANAGE},
+		{"GET", "/api/pindex/x_123/files", PERMISSION_MANAGE},
+		{"GET", "/api/pindex/x_123/file/store/00000001.zap", PERMISSION_MANAGE},
+		{"GET", "/api/pindex/x_123/filesBulk", PERMISSION_MANAGE},
+		{"GET", "/api/pindex/x_123/docs", PERMISSION_MANAGE},
+		{"GET", "/api/v1/pindex/x_123/docs", PERMISSION_MANAGE},
+		{"GET", "/api/cfgSnapshot", PERMISSION_MANAGE},
+		{"GET", "/api/diag/bundle", PERMISSION_MANAGE},
+		{"GET", "/api/runtime/profile", PERMISSION_MANAGE},
+		{"GET", "/api/runtime", PERMISSION_READ},
+		{"POST", "/api/ns/tenant/index/x/query", PERMISSION_SEARCH},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "http://x"+test.path, nil)
+		got := RESTPermission(req)
+		if got != test.exp {
+			t.Errorf("%s %s, expected: %s, got: %s",
+				test.method, test.path, test.exp, got)
+		}
+	}
+}
+
+func TestAuthAllowed(t *testing.T) {
+	if !AuthAllowed([]string{"admin"}, PERMISSION_MANAGE) {
+		t.Errorf("expected admin to manage")
+	}
+	if !AuthAllowed([]string{"monitor", "search"}, PERMISSION_SEARCH) {
+		t.Errorf("expected search role to search")
+	}
+	if AuthAllowed([]string{"search"}, PERMISSION_READ) {
+		t.Errorf("expected search role to not read")
+	}
+	if AuthAllowed([]string{"unknown"}, PERMISSION_READ) {
+		t.Errorf("expected unknown role to not read")
+	}
+	if AuthAllowed(nil, PERMISSION_SEARCH) {
+		t.Errorf("expected no roles to not search")
+	}
+}
+
+func TestRESTAuthHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	a := &RESTAuth{}
+	if a.Handler(next) == nil || a.Enabled() {
+		t.Errorf("expected a RESTAuth without authenticators to be open")
+	}
+
+	a = &RESTAuth{
+		Authenticators: []Authenticator{
+			func(req *http.Request) (*AuthIdentity, error) {
+				switch req.Header.Get("X-Test-User") {
+				case "":
+					return nil, nil
+				case "bad":
+					return nil, fmt.Errorf("bad credentials")
+				case "searcher":
+					return &AuthIdentity{User: "searcher",
+						Roles: []string{"search"}, Source: "test"}, nil
+				case "monitor":
+					return &AuthIdentity{User: "monitor",
+						Roles: []string{"monitor"}, Source: "test"}, nil
+				}
+				return &AuthIdentity{User: "admin",
+					Roles: []string{"admin"}, Source: "test"}, nil
+			},
+		},
+		Challenges: []string{`Test realm="cbft"`},
+		Cfg:        cbgt.NewCfgMem(),
+	}
+
+	for name, authKeyHash := range map[string]string{
+		"keyed": namespaceAuthKeyHash("secret"),
+		"open":  "",
+	} {
+		err := SetNamespace(a.Cfg, &Namespace{Name: name,
+			AuthKeyHash: authKeyHash})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := a.Handler(next)
+
+	tests := []struct {
+		user   string
+		method string
+		path   string
+		exp    int
+	}{
+		{"", "GET", "/api/index", 401},
+		{"bad", "GET", "/api/index", 401},
+		{"", "GET", "/api/ns/keyed/index", 200},
+		{"", "PUT", "/api/v1/ns/keyed/index/x", 200},
+		{"", "GET", "/api/ns/open/index", 401},
+		{"", "PUT", "/api/ns/open/index/x", 401},
+		{"", "GET", "/api/ns/missing/index", 401},
+		{"searcher", "POST", "/api/ns/open/index/x/query", 200},
+		{"searcher", "PUT", "/api/ns/open/index/x", 403},
+		{"searcher", "POST", "/api/index/x/sample", 403},
+		{"", "GET", "/api/health/ready", 200},
+		{"searcher", "POST", "/api/index/x/query", 200},
+		{"searcher", "GET", "/api/index", 403},
+		{"searcher", "DELETE", "/api/index/x", 403},
+		{"admin", "DELETE", "/api/index/x", 200},
+		{"admin", "GET", "/debug/vars", 200},
+		{"monitor", "GET", "/api/index", 200},
+		{"monitor", "GET", "/api/pindex/x_123/docs", 403},
+		{"admin", "GET", "/api/pindex/x_123/docs", 200},
+		{"", "GET", "/static/index.html", 200},
+		{"", "GET", "/debug/vars", 401},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "http://x"+test.path, nil)
+		if test.user != "" {
+			req.Header.Set("X-Test-User", test.user)
+		}
+		record := httptest.NewRecorder()
+		h.ServeHTTP(record, req)
+		if record.Code != test.exp {
+			t.Errorf("user: %q, %s %s, expected: %d, got: %d",
+				test.user, test.method, test.path, test.exp, record.Code)
+		}
+		if record.Code == 401 &&
+			record.Header().Get("WWW-Authenticate") != `Test realm="cbft"` {
+			t.Errorf("expected a challenge, got: %v", record.Header())
+		}
+	}
+}
@@ -0,0 +1,203 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// A standalone node, which has no cluster manager to authenticate its
+// requests, can require HTTP basic auth credentials, which are the
+// "authUser" and "authPassword" node options, an admin, and/or the
+// users of the htpasswd file of the "authFile" node option.  The
+// lines of the htpasswd file are "USER:{SHA}HASH", as written by
+// "htpasswd -s", with an optional third field of comma-separated
+// roles (see auth.go), where the default role is "admin"...
+//
+//   ops:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+//   app:{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=:search
+//
+// The nodes of a cluster call each other with the authUser and
+// authPassword credentials, so every node needs the same ones.
+
+// BASIC_AUTH_REALM is the realm of the basic auth challenge.
+const BASIC_AUTH_REALM = "cbft"
+
+type basicAuthUser struct {
+	hash  []byte // The sha1 of the password.
+	roles []string
+}
+
+// NewBasicAuthenticator returns the Authenticator of the basic auth
+// credentials of requests, or nil when the node has no basic auth
+// users.
+func NewBasicAuthenticator(options map[string]string) (
+	Authenticator, error) {
+	users := map[string]*basicAuthUser{}
+
+	authUser, authPassword := options["authUser"], options["authPassword"]
+	if authUser != "" || authPassword != "" {
+		if authUser == "" || authPassword == "" {
+			return nil, fmt.Errorf("basic_auth: authUser and authPassword" +
+				" are both needed")
+		}
+		hash := sha1.Sum([]byte(authPassword))
+		users[authUser] = &basicAuthUser{
+			hash:  hash[:],
+			roles: []string{"admin"},
+		}
+	}
+
+	if authFile := options["authFile"]; authFile != "" {
+		buf, err := ioutil.ReadFile(authFile)
+		if err != nil {
+			return nil, fmt.Errorf("basic_auth: authFile, err: %v", err)
+		}
+
+		fileUsers, err := parseHtpasswd(buf)
+		if err != nil {
+			return nil, fmt.Errorf("basic_auth: authFile: %s, err: %v",
+				authFile, err)
+		}
+
+		for name, user := range fileUsers {
+			if _, exists := users[name]; exists {
+				return nil, fmt.Errorf("basic_auth: authFile: %s,"+
+					" user: %s is also the authUser", authFile, name)
+			}
+			users[name] = user
+		}
+	}
+
+	if len(users) <= 0 {
+		return nil, nil
+	}
+
+	return func(req *http.Request) (*AuthIdentity, error) {
+		name, password, ok := req.BasicAuth()
+		if !ok {
+			return nil, nil
+		}
+
+		hash := sha1.Sum([]byte(password))
+
+		user := users[name]
+		if user == nil ||
+			subtle.ConstantTimeCompare(hash[:], user.hash) != 1 {
+			return nil, fmt.Errorf("wrong user or password, user: %q", name)
+		}
+
+		return &AuthIdentity{User: name, Roles: user.roles, Source: "basic"},
+			nil
+	}, nil
+}
+
+// parseHtpasswd parses the users of an htpasswd file.
+func parseHtpasswd(buf []byte) (map[string]*basicAuthUser, error) {
+	users := map[string]*basicAuthUser{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("line: %d, not USER:HASH[:ROLES]",
+				lineNum)
+		}
+
+		if !strings.HasPrefix(fields[1], "{SHA}") {
+			return nil, fmt.Errorf("line: %d, user: %s, unsupported hash,"+
+				" only {SHA} hashes (htpasswd -s) are supported",
+				lineNum, fields[0])
+		}
+		hash, err := base64.StdEncoding.DecodeString(fields[1][len("{SHA}"):])
+		if err != nil || len(hash) != sha1.Size {
+			return nil, fmt.Errorf("line: %d, user: %s, bad {SHA} hash",
+				lineNum, fields[0])
+		}
+
+		roles := []string{"admin"}
+		if len(fields) > 2 {
+			roles = strings.Split(fields[2], ",")
+			for _, role := range roles {
+				if _, exists := AuthRoles[role]; !exists {
+					return nil, fmt.Errorf("line: %d, user: %s,"+
+						" unknown role: %s", lineNum, fields[0], role)
+				}
+			}
+		}
+
+		if _, exists := users[fields[0]]; exists {
+			return nil, fmt.Errorf("line: %d, duplicate user: %s",
+				lineNum, fields[0])
+		}
+
+		users[fields[0]] = &basicAuthUser{hash: hash, roles: roles}
+	}
+
+	return users, scanner.Err()
+}
+
+// NodeBasicAuthStart configures the NodeHTTPClient to send the
+// authUser and authPassword credentials to the other nodes.
+func NodeBasicAuthStart(options map[string]string) {
+	authUser, authPassword := options["authUser"], options["authPassword"]
+	if authUser == "" || authPassword == "" {
+		return
+	}
+
+	transport := NodeHTTPClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	NodeHTTPClient = &http.Client{
+		Transport: &basicAuthTransport{
+			user:      authUser,
+			password:  authPassword,
+			transport: transport,
+		},
+	}
+}
+
+// basicAuthTransport adds basic auth credentials to requests that
+// don't have credentials.
+type basicAuthTransport struct {
+	user, password string
+	transport      http.RoundTripper
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (
+	*http.Response, error) {
+	if req.Header.Get("Authorization") == "" {
+		r := *req // A RoundTripper mustn't modify the request.
+		r.Header = http.Header{}
+		for k, v := range req.Header {
+			r.Header[k] = v
+		}
+		r.SetBasicAuth(t.user, t.password)
+		req = &r
+	}
+	return t.transport.RoundTrip(req)
+}
@@ -0,0 +1,134 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBasicAuth(t *testing.T) {
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	authFile := filepath.Join(dir, "htpasswd")
+	ioutil.WriteFile(authFile, []byte(
+		"# sha1 of 'password' and 'test'\n"+
+			"ops:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"+
+			"\n"+
+			"app:{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=:search\n"), 0600)
+
+	restAuth, err := NewRESTAuth(map[string]string{
+		"authUser":     "admin",
+		"authPassword": "secret",
+		"authFile":     authFile,
+	})
+	if err != nil || !restAuth.Enabled() {
+		t.Fatalf("expected an enabled rest auth, err: %v", err)
+	}
+
+	h := restAuth.Handler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+
+	tests := []struct {
+		user, password string
+		method, path   string
+		exp            int
+	}{
+		{"", "", "GET", "/api/index", 401},
+		{"", "", "GET", "/index.html", 200},
+		{"admin", "secret", "DELETE", "/api/index/x", 200},
+		{"admin", "wrong", "GET", "/api/index", 401},
+		{"nobody", "secret", "GET", "/api/index", 401},
+		{"ops", "password", "PUT", "/api/index/x", 200},
+		{"app", "test", "POST", "/api/index/x/query", 200},
+		{"app", "test", "GET", "/api/index", 403},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "http://x"+test.path, nil)
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		record := httptest.NewRecorder()
+		h.ServeHTTP(record, req)
+		if record.Code != test.exp {
+			t.Errorf("user: %q, %s %s, expected: %d, got: %d",
+				test.user, test.method, test.path, test.exp, record.Code)
+		}
+		if record.Code == 401 &&
+			record.Header().Get("WWW-Authenticate") != `Basic realm="cbft"` {
+			t.Errorf("expected a basic challenge, got: %v", record.Header())
+		}
+	}
+
+	for _, options := range []map[string]string{
+		{"authUser": "admin"},
+		{"authFile": filepath.Join(dir, "missing")},
+	} {
+		_, err = NewBasicAuthenticator(options)
+		if err == nil {
+			t.Errorf("expected err, options: %v", options)
+		}
+	}
+
+	for _, htpasswd := range []string{
+		"ops",
+		"ops:$apr1$salt$hash",
+		"ops:{SHA}not-base64",
+		"ops:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=:superuser",
+		"ops:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n" +
+			"ops:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+	} {
+		_, err = parseHtpasswd([]byte(htpasswd))
+		if err == nil {
+			t.Errorf("expected err, htpasswd: %q", htpasswd)
+		}
+	}
+
+	a, err := NewBasicAuthenticator(map[string]string{})
+	if err != nil || a != nil {
+		t.Errorf("expected no authenticator, got: %v, %v", a, err)
+	}
+}
+
+func TestNodeBasicAuthStart(t *testing.T) {
+	defer func(client *http.Client) { NodeHTTPClient = client }(
+		NodeHTTPClient)
+
+	var user, password string
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			user, password, _ = r.BasicAuth()
+		}))
+	defer s.Close()
+
+	NodeBasicAuthStart(map[string]string{
+		"authUser":     "admin",
+		"authPassword": "secret",
+	})
+
+	resp, err := NodeHTTPClient.Get(s.URL)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	resp.Body.Close()
+	if user != "admin" || password != "secret" {
+		t.Errorf("expected node credentials, got: %q, %q", user, password)
+	}
+}
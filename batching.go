@@ -0,0 +1,122 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// By default, the mutations of a partition are batched until the end
+// of each DCP snapshot, so a trickle of mutations makes many tiny
+// batches, and a backfill makes giant batches.  The "batching" of the
+// bleve index params tunes that...
+//
+//   {"batching": {
+//      "maxDocs": 1000,        // Optional, applies a batch at 1000 ops.
+//      "maxBytes": 10000000,   // Optional, applies a batch at 10MB.
+//      "flushIntervalMs": 200}} // Optional, see below.
+//
+// The maxDocs and maxBytes apply a batch before the end of its
+// snapshot, as soon as the batch is that big.  With a flushIntervalMs,
+// a batch isn't applied at the end of a snapshot until it has been
+// collecting mutations for that long, so mutations from several
+// snapshots are applied together, but a batch is applied right away
+// when there's a query waiting for its consistency.
+
+type BleveBatching struct {
+	MaxDocs         int `json:"maxDocs,omitempty"`
+	MaxBytes        int `json:"maxBytes,omitempty"`
+	FlushIntervalMs int `json:"flushIntervalMs,omitempty"`
+}
+
+// validateBleveBatching checks the batching of the index params.
+func validateBleveBatching(b *BleveBatching) error {
+	if b == nil {
+		return nil
+	}
+	if b.MaxDocs < 0 || b.MaxBytes < 0 || b.FlushIntervalMs < 0 {
+		return fmt.Errorf("batching: maxDocs, maxBytes and" +
+			" flushIntervalMs must be >= 0")
+	}
+	return nil
+}
+
+// batchOpUnlocked tracks a mutation that was added to the batch.
+func (t *BleveDestPartition) batchOpUnlocked(bytes int) {
+	if t.batchStart.IsZero() {
+		t.batchStart = time.Now()
+	}
+	t.batchBytes += bytes
+}
+
+// batchFullUnlocked returns true when the batch should be applied
+// before the end of its snapshot.
+func (t *BleveDestPartition) batchFullUnlocked() bool {
+	b := t.bdest.batching
+	if b == nil {
+		return false
+	}
+	return (b.MaxDocs > 0 && t.batch.Size() >= b.MaxDocs) ||
+		(b.MaxBytes > 0 && t.batchBytes >= b.MaxBytes)
+}
+
+// flushUnlocked applies the batch at the end of a snapshot, unless
+// the batch should wait for more mutations, in which case a timer
+// applies the batch later.
+func (t *BleveDestPartition) flushUnlocked() error {
+	b := t.bdest.batching
+	if b == nil || b.FlushIntervalMs <= 0 || t.cwrQueue.Len() > 0 ||
+		t.batchStart.IsZero() {
+		return t.applyBatchUnlocked()
+	}
+
+	wait := time.Duration(b.FlushIntervalMs)*time.Millisecond -
+		time.Since(t.batchStart)
+	if wait <= 0 {
+		return t.applyBatchUnlocked()
+	}
+
+	if t.flushTimer == nil {
+		var timer *time.Timer
+		timer = time.AfterFunc(wait, func() {
+			t.m.Lock()
+			if t.flushTimer != timer {
+				t.m.Unlock()
+				return // The batch was already applied.
+			}
+			t.flushTimer = nil
+			err := t.applyBatchUnlocked()
+			t.m.Unlock()
+
+			if err != nil {
+				log.Printf("batching: flush, path: %s, partition: %s,"+
+					" err: %v", t.bdest.path, t.partition, err)
+			}
+		})
+		t.flushTimer = timer
+	}
+
+	return nil
+}
+
+// resetBatchUnlocked clears the batching state of an applied batch.
+func (t *BleveDestPartition) resetBatchUnlocked() {
+	t.batchBytes = 0
+	t.batchStart = time.Time{}
+	if t.flushTimer != nil {
+		t.flushTimer.Stop()
+		t.flushTimer = nil
+	}
+}
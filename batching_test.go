@@ -0,0 +1,106 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func newBatchingTestDest(t *testing.T, b *BleveBatching) (
+	bleve.Index, cbgt.Dest) {
+	bindex, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	dest := NewBleveDest("/tmp/idx_1234_5678.pindex", bindex, func() {})
+	dest.batching = b
+	return bindex, &cbgt.DestForwarder{DestProvider: dest}
+}
+
+func batchingTestUpdate(dest cbgt.Dest, i int) {
+	dest.DataUpdate("0", []byte(fmt.Sprintf("doc-%d", i)), uint64(i),
+		[]byte(`{"a":"x"}`), 0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+}
+
+func TestValidateBleveBatching(t *testing.T) {
+	err := ValidateBlevePIndexImpl("bleve", "idx",
+		`{"batching":{"maxDocs":100,"flushIntervalMs":50}}`)
+	if err != nil {
+		t.Errorf("expected valid params, got: %v", err)
+	}
+
+	err = ValidateBlevePIndexImpl("bleve", "idx",
+		`{"batching":{"maxBytes":-1}}`)
+	if err == nil {
+		t.Errorf("expected err on a negative maxBytes")
+	}
+}
+
+func TestBatchingMaxDocs(t *testing.T) {
+	bindex, dest := newBatchingTestDest(t, &BleveBatching{MaxDocs: 3})
+	defer dest.Close()
+
+	dest.SnapshotStart("0", 1, 10)
+	for i := 1; i <= 7; i++ {
+		batchingTestUpdate(dest, i)
+	}
+
+	count, _ := bindex.DocCount()
+	if count != 6 {
+		t.Errorf("expected 2 full batches applied mid-snapshot, got: %d",
+			count)
+	}
+}
+
+func TestBatchingFlushInterval(t *testing.T) {
+	bindex, dest := newBatchingTestDest(t,
+		&BleveBatching{FlushIntervalMs: 50})
+	defer dest.Close()
+
+	dest.SnapshotStart("0", 1, 1)
+	batchingTestUpdate(dest, 1)
+	dest.SnapshotStart("0", 2, 2)
+	batchingTestUpdate(dest, 2)
+
+	count, _ := bindex.DocCount()
+	if count != 0 {
+		t.Errorf("expected the flush to be deferred, got: %d", count)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	count, _ = bindex.DocCount()
+	if count != 2 {
+		t.Errorf("expected the deferred flush to apply both snapshots,"+
+			" got: %d", count)
+	}
+
+	// A consistency waiter doesn't wait for a deferred flush.
+	dest.SnapshotStart("0", 3, 3)
+	batchingTestUpdate(dest, 3)
+
+	err := dest.ConsistencyWait("0", "", "at_plus", 3, nil)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+
+	count, _ = bindex.DocCount()
+	if count != 3 {
+		t.Errorf("expected the waiter to flush the batch, got: %d", count)
+	}
+}
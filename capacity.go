@@ -0,0 +1,215 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The capacity guardrail checks each index create/update request
+// against the cluster's capacity, as configured by the
+// capacity*PerNode cluster settings, so that an index definition
+// that's too large for the cluster is caught up front instead of
+// tipping the cluster over later during the index build.  The
+// resources that a new index needs are estimated from the sizes of
+// the existing indexes as a baseline.
+
+const CAPACITY_GUARDRAIL_REJECT = "reject"
+const CAPACITY_GUARDRAIL_WARN = "warn"
+
+// CapacityEstimate represents the projected resource usage of the
+// cluster after an index create/update request.
+type CapacityEstimate struct {
+	Nodes int `json:"nodes"`
+
+	// The current usage, excluding the index that's being updated,
+	// counting all replicas.
+	PIndexes  int   `json:"pindexes"`
+	DiskBytes int64 `json:"diskBytes"`
+	MemBytes  int64 `json:"memBytes"`
+
+	// The estimated usage of the requested index definition.
+	NewPIndexes  int   `json:"newPIndexes"`
+	NewDiskBytes int64 `json:"newDiskBytes"`
+	NewMemBytes  int64 `json:"newMemBytes"`
+
+	// The per-pindex baselines, from the existing indexes, where 0
+	// means that there's no baseline yet.
+	BaselineDiskBytes int64 `json:"baselineDiskBytes"`
+	BaselineMemBytes  int64 `json:"baselineMemBytes"`
+
+	// The cluster's capacity, where 0 means unlimited.
+	CapacityPIndexes  int   `json:"capacityPIndexes"`
+	CapacityDiskBytes int64 `json:"capacityDiskBytes"`
+	CapacityMemBytes  int64 `json:"capacityMemBytes"`
+}
+
+// Exceeded returns descriptions, with the numbers, of the capacities
+// that would be exceeded.
+func (e *CapacityEstimate) Exceeded() []string {
+	var rv []string
+
+	if e.CapacityPIndexes > 0 &&
+		e.PIndexes+e.NewPIndexes > e.CapacityPIndexes {
+		rv = append(rv, fmt.Sprintf("pindexes: %d current + %d new"+
+			" > %d capacity", e.PIndexes, e.NewPIndexes, e.CapacityPIndexes))
+	}
+	if e.CapacityDiskBytes > 0 &&
+		e.DiskBytes+e.NewDiskBytes > e.CapacityDiskBytes {
+		rv = append(rv, fmt.Sprintf("diskBytes: %d current + %d new"+
+			" > %d capacity", e.DiskBytes, e.NewDiskBytes, e.CapacityDiskBytes))
+	}
+	if e.CapacityMemBytes > 0 &&
+		e.MemBytes+e.NewMemBytes > e.CapacityMemBytes {
+		rv = append(rv, fmt.Sprintf("memBytes: %d current + %d new"+
+			" > %d capacity", e.MemBytes, e.NewMemBytes, e.CapacityMemBytes))
+	}
+
+	return rv
+}
+
+// CalcCapacityEstimate estimates the cluster's resource usage after
+// an index create/update request.  The disk baseline is the average
+// size of the plan pindexes whose size is known, and the memory
+// baseline is this node's in-use heap divided by its pindexes.
+func CalcCapacityEstimate(mgr *cbgt.Manager, r *IndexQuotaRequest,
+	settings *ClusterSettings) (*CapacityEstimate, error) {
+	cfg := mgr.Cfg()
+
+	nodeDefs, _, err := cbgt.CfgGetNodeDefs(cfg, cbgt.NODE_DEFS_WANTED)
+	if err != nil {
+		return nil, fmt.Errorf("capacity: could not retrieve node defs,"+
+			" err: %v", err)
+	}
+
+	planPIndexes, _, err := cbgt.CfgGetPlanPIndexes(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("capacity: could not retrieve plan pindexes,"+
+			" err: %v", err)
+	}
+
+	e := &CapacityEstimate{}
+	if nodeDefs != nil {
+		e.Nodes = len(nodeDefs.NodeDefs)
+	}
+
+	_, localPIndexes := mgr.CurrentMaps()
+	if len(localPIndexes) > 0 {
+		var memStats runtime.MemStats
+		runtime.ReadMemStats(&memStats)
+
+		e.BaselineMemBytes = int64(memStats.HeapInuse) /
+			int64(len(localPIndexes))
+	}
+
+	unknownCopies := 0
+
+	if planPIndexes != nil {
+		pindexBytes := LocalPIndexBytesEstimator(mgr, planPIndexes)
+
+		knownCopies := 0
+
+		for _, planPIndex := range planPIndexes.PlanPIndexes {
+			if planPIndex.IndexName == r.IndexName {
+				continue
+			}
+
+			copies := len(planPIndex.Nodes)
+			e.PIndexes += copies
+
+			bytes, ok := pindexBytes(planPIndex)
+			if ok {
+				e.DiskBytes += bytes * int64(copies)
+				knownCopies += copies
+			} else {
+				unknownCopies += copies
+			}
+		}
+
+		if knownCopies > 0 {
+			e.BaselineDiskBytes = e.DiskBytes / int64(knownCopies)
+		}
+	}
+
+	e.DiskBytes += e.BaselineDiskBytes * int64(unknownCopies)
+	e.MemBytes = e.BaselineMemBytes * int64(e.PIndexes)
+
+	partitions, err := IndexQuotaPartitions(mgr, r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The planner places the replicas of a partition on different
+	// nodes, so there can't be more copies than nodes.
+	copies := 1 + r.PlanParams.NumReplicas
+	if e.Nodes > 0 && copies > e.Nodes {
+		copies = e.Nodes
+	}
+
+	e.NewPIndexes = partitions * copies
+	e.NewDiskBytes = e.BaselineDiskBytes * int64(e.NewPIndexes)
+	e.NewMemBytes = e.BaselineMemBytes * int64(e.NewPIndexes)
+
+	e.CapacityPIndexes = settings.CapacityPIndexesPerNode * e.Nodes
+	e.CapacityDiskBytes = settings.CapacityDiskBytesPerNode * int64(e.Nodes)
+	e.CapacityMemBytes = settings.CapacityMemBytesPerNode * int64(e.Nodes)
+
+	return e, nil
+}
+
+// ---------------------------------------------------------
+
+// checkCapacity returns an error when an index create/update request
+// would exceed the cluster's capacity.  Under the "warn"
+// capacityGuardrail setting, such a request is still allowed, but
+// with a warning.
+func checkCapacity(mgr *cbgt.Manager, r *IndexQuotaRequest) (
+	warning string, err error) {
+	settings := CurrentClusterSettings()
+	if settings.CapacityPIndexesPerNode <= 0 &&
+		settings.CapacityDiskBytesPerNode <= 0 &&
+		settings.CapacityMemBytesPerNode <= 0 {
+		return "", nil
+	}
+
+	e, err := CalcCapacityEstimate(mgr, r, settings)
+	if err != nil {
+		return "", err
+	}
+
+	LogDebugf(LOG_CATEGORY_PLANNER, "capacity: index: %s, estimate: %+v",
+		r.IndexName, e)
+
+	exceeded := e.Exceeded()
+	if len(exceeded) <= 0 {
+		return "", nil
+	}
+
+	msg := fmt.Sprintf("capacity: index: %s would exceed the"+
+		" cluster capacity of %d nodes, %s", r.IndexName, e.Nodes,
+		strings.Join(exceeded, "; "))
+
+	if settings.CapacityGuardrail != CAPACITY_GUARDRAIL_WARN {
+		return "", &IndexCreateError{Status: 400, Msg: msg}
+	}
+
+	return msg, nil
+}
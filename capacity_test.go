@@ -0,0 +1,75 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestCapacityEstimateExceeded(t *testing.T) {
+	e := &CapacityEstimate{
+		PIndexes:     10,
+		DiskBytes:    1000,
+		MemBytes:     100,
+		NewPIndexes:  4,
+		NewDiskBytes: 400,
+		NewMemBytes:  40,
+	}
+	if len(e.Exceeded()) != 0 {
+		t.Errorf("expected unlimited capacity, got: %v", e.Exceeded())
+	}
+
+	e.CapacityPIndexes = 14
+	e.CapacityDiskBytes = 1399
+	e.CapacityMemBytes = 1000
+	exceeded := e.Exceeded()
+	if len(exceeded) != 1 ||
+		exceeded[0] != "diskBytes: 1000 current + 400 new > 1399 capacity" {
+		t.Errorf("expected diskBytes to be exceeded, got: %v", exceeded)
+	}
+}
+
+func TestCalcCapacityEstimate(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	r := &IndexQuotaRequest{
+		IndexName:  "a",
+		IndexType:  "blackhole",
+		SourceType: "nil",
+		PlanParams: cbgt.PlanParams{NumReplicas: 2},
+	}
+
+	e, err := CalcCapacityEstimate(mgr, r, &ClusterSettings{
+		CapacityPIndexesPerNode: 1,
+	})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	// A single node can't hold any replicas.
+	if e.Nodes != 1 || e.NewPIndexes != 1 || e.CapacityPIndexes != 1 {
+		t.Errorf("unexpected estimate: %#v", e)
+	}
+	if len(e.Exceeded()) != 0 {
+		t.Errorf("expected room for the index, got: %v", e.Exceeded())
+	}
+}
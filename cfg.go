@@ -0,0 +1,127 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// CfgGetJSON retrieves a cbft-specific JSON entry from the Cfg and
+// parses it into v.  The returned bool is false when the entry
+// doesn't exist yet, in which case v is left untouched.
+func CfgGetJSON(cfg cbgt.Cfg, key string, v interface{}) (
+	uint64, bool, error) {
+	buf, cas, err := cfg.Get(key, 0)
+	if err != nil {
+		return 0, false, err
+	}
+	if buf == nil {
+		return cas, false, nil
+	}
+	err = json.Unmarshal(buf, v)
+	if err != nil {
+		return 0, false, fmt.Errorf("cfg: could not parse, key: %s,"+
+			" err: %v", key, err)
+	}
+	return cas, true, nil
+}
+
+// CfgSetJSON stores a cbft-specific JSON entry into the Cfg, using
+// the cas for optimistic concurrency control.
+func CfgSetJSON(cfg cbgt.Cfg, key string, v interface{}, cas uint64) (
+	uint64, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(key, buf, cas)
+}
+
+// The max number of read-modify-write attempts of CfgUpdateJSON.
+var CfgUpdateMaxRetries = 100
+
+// CfgUpdateJSON does a read-modify-write of a cbft-specific JSON
+// entry in the Cfg, where newV returns a fresh value to parse the
+// entry into and f modifies that value before it's stored, retrying
+// on CAS mismatches.
+func CfgUpdateJSON(cfg cbgt.Cfg, key string,
+	newV func() interface{}, f func(v interface{}) error) error {
+	for i := 0; i < CfgUpdateMaxRetries; i++ {
+		v := newV()
+
+		cas, _, err := CfgGetJSON(cfg, key, v)
+		if err != nil {
+			return err
+		}
+
+		err = f(v)
+		if err != nil {
+			return err
+		}
+
+		_, err = CfgSetJSON(cfg, key, v, cas)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*cbgt.CfgCASError); !ok {
+			return err
+		}
+	}
+
+	return fmt.Errorf("cfg: too many update retries, key: %s", key)
+}
+
+// ---------------------------------------------------------
+
+// cfgSubscriptions tracks the subscribers of the keys of a Cfg
+// provider, for the Cfg providers that are implemented by cbft.
+type cfgSubscriptions struct {
+	m    sync.Mutex
+	subs map[string][]chan cbgt.CfgEvent // Keyed by Cfg key.
+}
+
+func (s *cfgSubscriptions) subscribe(key string, ch chan cbgt.CfgEvent) {
+	s.m.Lock()
+	if s.subs == nil {
+		s.subs = map[string][]chan cbgt.CfgEvent{}
+	}
+	s.subs[key] = append(s.subs[key], ch)
+	s.m.Unlock()
+}
+
+// keys returns the subscribed keys.
+func (s *cfgSubscriptions) keys() []string {
+	s.m.Lock()
+	rv := make([]string, 0, len(s.subs))
+	for key := range s.subs {
+		rv = append(rv, key)
+	}
+	s.m.Unlock()
+	return rv
+}
+
+// fire asynchronously notifies the subscribers of a key.
+func (s *cfgSubscriptions) fire(key string, cas uint64, err error) {
+	s.m.Lock()
+	chs := append([]chan cbgt.CfgEvent(nil), s.subs[key]...)
+	s.m.Unlock()
+
+	for _, ch := range chs {
+		go func(ch chan cbgt.CfgEvent) {
+			ch <- cbgt.CfgEvent{Key: key, CAS: cas, Error: err}
+		}(ch)
+	}
+}
@@ -0,0 +1,435 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// CfgConsul is a Cfg provider that keeps the Cfg entries in the
+// Consul KV store, as the keys under a prefix, where the ModifyIndex
+// of a Consul key is the CAS of its Cfg entry.  The CfgConsul holds a
+// Consul session, which it keeps renewing, and every write is done
+// with a check-and-set while holding a lock (the prefix's ".lock"
+// key) that's acquired with the session, so that a node whose
+// session was invalidated, such as when it was partitioned from the
+// Consul servers, can't write.  The prefix is watched with blocking
+// queries so that subscribers are notified of the changes made by
+// any node.  The connect string of the -cfg command-line flag is
+// like...
+//
+//	consul:http://HOST:PORT[/PREFIX]
+//
+// where the default PREFIX is "cbft".
+type CfgConsul struct {
+	url    string
+	prefix string
+
+	client      *http.Client
+	watchClient *http.Client // Without a timeout, for blocking queries.
+
+	subs cfgSubscriptions
+
+	m       sync.Mutex // Protects the fields that follow.
+	session string
+}
+
+// The default Consul key prefix of the Cfg entries.
+var CfgConsulDefaultPrefix = "cbft"
+
+// The timeout of the non-watch Consul requests.
+var CfgConsulTimeout = 10 * time.Second
+
+// The TTL of the Consul session of a CfgConsul, which is renewed
+// every half TTL.
+var CfgConsulSessionTTL = 15 * time.Second
+
+// The max duration of waiting for the write lock.
+var CfgConsulLockTimeout = 10 * time.Second
+
+// The max duration of a blocking query of the watch.
+var CfgConsulWatchWait = "5m"
+
+const cfgConsulLockKey = ".lock"
+
+type consulKV struct {
+	Key         string `json:"Key"`
+	Value       []byte `json:"Value"` // Base64 encoded by Consul.
+	ModifyIndex uint64 `json:"ModifyIndex"`
+}
+
+// NewCfgConsul returns a CfgConsul for the part of a Consul connect
+// string after the "consul:".
+func NewCfgConsul(connect string) (*CfgConsul, error) {
+	u, err := url.Parse(connect)
+	if err != nil || u.Host == "" ||
+		(u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("cfg_consul: bad consul url: %q,"+
+			" must be like http://HOST:PORT", connect)
+	}
+
+	prefix := strings.Trim(u.Path, "/")
+	if prefix == "" {
+		prefix = CfgConsulDefaultPrefix
+	}
+
+	c := &CfgConsul{
+		url:         u.Scheme + "://" + u.Host,
+		prefix:      prefix,
+		client:      &http.Client{Timeout: CfgConsulTimeout},
+		watchClient: &http.Client{},
+	}
+
+	_, err = c.newSession()
+	if err != nil {
+		return nil, err
+	}
+
+	kvs, index, err := c.list(c.client, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	go c.renewSession()
+	go c.watch(kvs, index)
+
+	return c, nil
+}
+
+func (c *CfgConsul) keyPath(key string) string {
+	return "/v1/kv/" + c.prefix + "/" + key
+}
+
+// do sends a request to the Consul HTTP API, returning the status
+// code, the body and the X-Consul-Index header of the response.
+func (c *CfgConsul) do(client *http.Client, method, path string,
+	params url.Values, body []byte) (int, []byte, uint64, error) {
+	reqURL := c.url + path
+	if len(params) > 0 {
+		reqURL = reqURL + "?" + params.Encode()
+	}
+
+	req, err := http.NewRequest(method, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, 0, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("cfg_consul: could not reach consul,"+
+			" url: %s, err: %v", c.url, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	return resp.StatusCode, respBody, index, nil
+}
+
+// doBool sends a request whose response body is true or false, such
+// as a check-and-set or a lock acquire.
+func (c *CfgConsul) doBool(method, path string,
+	params url.Values, body []byte) (bool, error) {
+	status, respBody, _, err := c.do(c.client, method, path, params, body)
+	if err != nil {
+		return false, err
+	}
+	if status != 200 {
+		return false, fmt.Errorf("cfg_consul: %s %s, status: %d, body: %s",
+			method, path, status, respBody)
+	}
+	return strings.TrimSpace(string(respBody)) == "true", nil
+}
+
+func (c *CfgConsul) Get(key string, cas uint64) ([]byte, uint64, error) {
+	status, body, _, err := c.do(c.client, "GET", c.keyPath(key), nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if status == 404 {
+		return nil, 0, nil
+	}
+	if status != 200 {
+		return nil, 0, fmt.Errorf("cfg_consul: get, key: %s, status: %d,"+
+			" body: %s", key, status, body)
+	}
+
+	var kvs []*consulKV
+	err = json.Unmarshal(body, &kvs)
+	if err != nil || len(kvs) != 1 {
+		return nil, 0, fmt.Errorf("cfg_consul: get, key: %s, could not"+
+			" parse response, err: %v", key, err)
+	}
+
+	if cas != 0 && cas != kvs[0].ModifyIndex {
+		return nil, 0, &cbgt.CfgCASError{}
+	}
+	return kvs[0].Value, kvs[0].ModifyIndex, nil
+}
+
+func (c *CfgConsul) Set(key string, val []byte, cas uint64) (uint64, error) {
+	err := c.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer c.unlock()
+
+	// A cas of 0 means that the entry must not exist, like for Consul.
+	ok, err := c.doBool("PUT", c.keyPath(key), url.Values{
+		"cas": []string{strconv.FormatUint(cas, 10)},
+	}, val)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, &cbgt.CfgCASError{}
+	}
+
+	_, casSuccess, err := c.Get(key, 0)
+	return casSuccess, err
+}
+
+func (c *CfgConsul) Del(key string, cas uint64) error {
+	err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer c.unlock()
+
+	params := url.Values{}
+	if cas != 0 {
+		params.Set("cas", strconv.FormatUint(cas, 10))
+	}
+
+	ok, err := c.doBool("DELETE", c.keyPath(key), params, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &cbgt.CfgCASError{}
+	}
+	return nil
+}
+
+func (c *CfgConsul) Subscribe(key string, ch chan cbgt.CfgEvent) error {
+	c.subs.subscribe(key, ch)
+	return nil
+}
+
+// Refresh notifies the subscribers of every subscribed key, with the
+// key's current CAS.
+func (c *CfgConsul) Refresh() error {
+	for _, key := range c.subs.keys() {
+		_, cas, err := c.Get(key, 0)
+		c.subs.fire(key, cas, err)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------
+
+// newSession creates a new Consul session, whose locks are released
+// when the session is invalidated.
+func (c *CfgConsul) newSession() (string, error) {
+	body, _ := json.Marshal(map[string]string{
+		"Name":     "cbft-cfg",
+		"TTL":      CfgConsulSessionTTL.String(),
+		"Behavior": "release",
+	})
+
+	status, respBody, _, err :=
+		c.do(c.client, "PUT", "/v1/session/create", nil, body)
+	if err != nil {
+		return "", err
+	}
+
+	var r struct {
+		ID string `json:"ID"`
+	}
+	if status != 200 || json.Unmarshal(respBody, &r) != nil || r.ID == "" {
+		return "", fmt.Errorf("cfg_consul: could not create session,"+
+			" status: %d, body: %s", status, respBody)
+	}
+
+	c.m.Lock()
+	c.session = r.ID
+	c.m.Unlock()
+
+	return r.ID, nil
+}
+
+// renewSession keeps renewing the session, replacing the session if
+// it was invalidated.
+func (c *CfgConsul) renewSession() {
+	for {
+		time.Sleep(CfgConsulSessionTTL / 2)
+
+		c.m.Lock()
+		session := c.session
+		c.m.Unlock()
+
+		status, _, _, err := c.do(c.client, "PUT",
+			"/v1/session/renew/"+session, nil, nil)
+		if err != nil {
+			log.Printf("cfg_consul: renew session, err: %v", err)
+			continue
+		}
+		if status == 404 {
+			log.Printf("cfg_consul: session was invalidated, session: %s",
+				session)
+			_, err = c.newSession()
+			if err != nil {
+				log.Printf("cfg_consul: %v", err)
+			}
+		}
+	}
+}
+
+// lock acquires the write lock with the session.
+func (c *CfgConsul) lock() error {
+	c.m.Lock()
+	session := c.session
+	c.m.Unlock()
+
+	backoff := 10 * time.Millisecond
+	deadline := time.Now().Add(CfgConsulLockTimeout)
+
+	for {
+		ok, err := c.doBool("PUT", c.keyPath(cfgConsulLockKey),
+			url.Values{"acquire": []string{session}}, nil)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("cfg_consul: could not acquire lock,"+
+				" session: %s", session)
+		}
+
+		time.Sleep(backoff)
+		if backoff < time.Second {
+			backoff = backoff * 2
+		}
+	}
+}
+
+func (c *CfgConsul) unlock() {
+	c.m.Lock()
+	session := c.session
+	c.m.Unlock()
+
+	_, err := c.doBool("PUT", c.keyPath(cfgConsulLockKey),
+		url.Values{"release": []string{session}}, nil)
+	if err != nil {
+		log.Printf("cfg_consul: unlock, err: %v", err)
+	}
+}
+
+// ---------------------------------------------------------
+
+// list returns the Cfg entries under the prefix, blocking until the
+// index is exceeded when the index is > 0.
+func (c *CfgConsul) list(client *http.Client, index uint64) (
+	[]*consulKV, uint64, error) {
+	params := url.Values{"recurse": []string{"true"}}
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", CfgConsulWatchWait)
+	}
+
+	status, body, index, err :=
+		c.do(client, "GET", "/v1/kv/"+c.prefix+"/", params, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if status == 404 {
+		return nil, index, nil
+	}
+	if status != 200 {
+		return nil, 0, fmt.Errorf("cfg_consul: list, status: %d,"+
+			" body: %s", status, body)
+	}
+
+	var kvs []*consulKV
+	err = json.Unmarshal(body, &kvs)
+	if err != nil {
+		return nil, 0, err
+	}
+	return kvs, index, nil
+}
+
+// watch does blocking queries of the prefix, notifying the
+// subscribers of the changed or deleted keys.
+func (c *CfgConsul) watch(kvs []*consulKV, index uint64) {
+	prev := c.modifyIndexes(kvs)
+
+	for {
+		kvs, nextIndex, err := c.list(c.watchClient, index)
+		if err != nil {
+			log.Printf("cfg_consul: watch, err: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		curr := c.modifyIndexes(kvs)
+		for key, cas := range curr {
+			if prev[key] != cas {
+				c.subs.fire(key, cas, nil)
+			}
+		}
+		for key := range prev {
+			if _, exists := curr[key]; !exists {
+				c.subs.fire(key, 0, nil)
+			}
+		}
+
+		prev = curr
+
+		if nextIndex < index {
+			nextIndex = 0 // The Consul index was reset.
+		}
+		index = nextIndex
+	}
+}
+
+// modifyIndexes returns the ModifyIndex of the Cfg entries, keyed by
+// Cfg key.
+func (c *CfgConsul) modifyIndexes(kvs []*consulKV) map[string]uint64 {
+	rv := map[string]uint64{}
+	for _, kv := range kvs {
+		key := strings.TrimPrefix(kv.Key, c.prefix+"/")
+		if key != cfgConsulLockKey {
+			rv[key] = kv.ModifyIndex
+		}
+	}
+	return rv
+}
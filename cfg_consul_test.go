@@ -0,0 +1,194 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// fakeConsul is an in-memory Consul KV store and session API, for
+// testing.
+type fakeConsul struct {
+	m       sync.Mutex
+	index   uint64
+	entries map[string]*consulKV
+	locks   map[string]string // Keyed by key, value is session.
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	body, _ := ioutil.ReadAll(req.Body)
+
+	if strings.HasPrefix(req.URL.Path, "/v1/session/") {
+		w.Write([]byte(`{"ID":"s0"}`))
+		return
+	}
+
+	key := strings.TrimPrefix(req.URL.Path, "/v1/kv/")
+
+	if req.Method == "GET" && req.Form.Get("recurse") == "true" {
+		waitIndex, _ := strconv.ParseUint(req.Form.Get("index"), 10, 64)
+		f.m.Lock()
+		for i := 0; i < 200 && f.index <= waitIndex; i++ {
+			f.m.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			f.m.Lock()
+		}
+		defer f.m.Unlock()
+
+		kvs := []*consulKV{}
+		for k, kv := range f.entries {
+			if strings.HasPrefix(k, key) {
+				kvs = append(kvs, kv)
+			}
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		if len(kvs) <= 0 {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(kvs)
+		return
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	prev := f.entries[key]
+
+	switch req.Method {
+	case "GET":
+		if prev == nil {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode([]*consulKV{prev})
+
+	case "PUT":
+		if s := req.Form.Get("acquire"); s != "" {
+			if f.locks[key] != "" && f.locks[key] != s {
+				w.Write([]byte("false"))
+				return
+			}
+			f.locks[key] = s
+			w.Write([]byte("true"))
+			return
+		}
+		if s := req.Form.Get("release"); s != "" {
+			delete(f.locks, key)
+			w.Write([]byte("true"))
+			return
+		}
+		if v := req.Form.Get("cas"); v != "" {
+			cas, _ := strconv.ParseUint(v, 10, 64)
+			if (cas == 0 && prev != nil) ||
+				(cas != 0 && (prev == nil || prev.ModifyIndex != cas)) {
+				w.Write([]byte("false"))
+				return
+			}
+		}
+		f.index++
+		f.entries[key] = &consulKV{Key: key, Value: body,
+			ModifyIndex: f.index}
+		w.Write([]byte("true"))
+
+	case "DELETE":
+		if v := req.Form.Get("cas"); v != "" {
+			cas, _ := strconv.ParseUint(v, 10, 64)
+			if prev == nil || prev.ModifyIndex != cas {
+				w.Write([]byte("false"))
+				return
+			}
+		}
+		f.index++
+		delete(f.entries, key)
+		w.Write([]byte("true"))
+	}
+}
+
+func TestCfgConsul(t *testing.T) {
+	s := httptest.NewServer(&fakeConsul{
+		entries: map[string]*consulKV{},
+		locks:   map[string]string{},
+	})
+	defer s.Close()
+
+	_, err := NewCfgConsul("not-a-url")
+	if err == nil {
+		t.Errorf("expected err on a bad url")
+	}
+
+	c, err := NewCfgConsul(s.URL + "/my-cluster")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if c.prefix != "my-cluster" {
+		t.Errorf("expected the prefix of the url, got: %s", c.prefix)
+	}
+
+	ch := make(chan cbgt.CfgEvent, 10)
+	c.Subscribe("k", ch)
+
+	val, cas, err := c.Get("k", 0)
+	if err != nil || val != nil || cas != 0 {
+		t.Errorf("expected a missing entry, got: %s, %d, %v", val, cas, err)
+	}
+
+	cas1, err := c.Set("k", []byte(`{"a":1}`), 0)
+	if err != nil || cas1 == 0 {
+		t.Fatalf("expected set to work, got: %d, %v", cas1, err)
+	}
+
+	_, err = c.Set("k", []byte(`{"a":2}`), 0)
+	if _, ok := err.(*cbgt.CfgCASError); !ok {
+		t.Errorf("expected a CAS error on creating an existing entry,"+
+			" got: %v", err)
+	}
+
+	cas2, err := c.Set("k", []byte(`{"a":2}`), cas1)
+	if err != nil || cas2 <= cas1 {
+		t.Errorf("expected CAS set to work, got: %d, %v", cas2, err)
+	}
+
+	val, cas, err = c.Get("k", 0)
+	if err != nil || string(val) != `{"a":2}` || cas != cas2 {
+		t.Errorf("expected the entry, got: %s, %d, %v", val, cas, err)
+	}
+
+	select {
+	case ev := <-ch:
+		if ev.Key != "k" {
+			t.Errorf("expected an event for k, got: %#v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected a watch event")
+	}
+
+	err = c.Del("k", cas1)
+	if _, ok := err.(*cbgt.CfgCASError); !ok {
+		t.Errorf("expected a CAS error on a stale del, got: %v", err)
+	}
+	err = c.Del("k", cas2)
+	if err != nil {
+		t.Errorf("expected del to work, got: %v", err)
+	}
+}
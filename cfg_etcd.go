@@ -0,0 +1,306 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// CfgEtcd is a Cfg provider that keeps the Cfg entries in etcd,
+// using the etcd v2 keys API, where the modifiedIndex of an etcd key
+// is the CAS of its Cfg entry.  The Cfg entries are the keys under a
+// prefix dir, which is watched so that subscribers are notified of
+// the changes made by any node.  The connect string of the -cfg
+// command-line flag is like...
+//
+//	etcd:http://HOST:PORT[,http://HOST2:PORT2...][/PREFIX]
+//
+// where the default PREFIX is "/cbft".
+type CfgEtcd struct {
+	urls   []string
+	prefix string
+
+	client      *http.Client
+	watchClient *http.Client // Without a timeout, for long polls.
+
+	subs cfgSubscriptions
+}
+
+// The default etcd dir of the Cfg entries.
+var CfgEtcdDefaultPrefix = "/cbft"
+
+// The timeout of the non-watch etcd requests.
+var CfgEtcdTimeout = 10 * time.Second
+
+// The error codes of the etcd keys API.
+const (
+	etcdErrorKeyNotFound   = 100
+	etcdErrorTestFailed    = 101
+	etcdErrorNodeExist     = 105
+	etcdErrorEventsCleared = 401
+)
+
+type etcdResponse struct {
+	Action    string    `json:"action"`
+	Node      *etcdNode `json:"node"`
+	ErrorCode int       `json:"errorCode"`
+	Message   string    `json:"message"`
+
+	index uint64 // From the X-Etcd-Index header.
+}
+
+type etcdNode struct {
+	Key           string `json:"key"`
+	Value         string `json:"value"`
+	ModifiedIndex uint64 `json:"modifiedIndex"`
+}
+
+// NewCfgEtcd returns a CfgEtcd for the part of an etcd connect
+// string after the "etcd:".
+func NewCfgEtcd(connect string) (*CfgEtcd, error) {
+	urls, prefix, err := parseCfgEtcdConnect(connect)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &CfgEtcd{
+		urls:        urls,
+		prefix:      prefix,
+		client:      &http.Client{Timeout: CfgEtcdTimeout},
+		watchClient: &http.Client{},
+	}
+
+	resp, err := c.do(c.client, "GET", c.prefix, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	go c.watch(resp.index + 1)
+
+	return c, nil
+}
+
+// parseCfgEtcdConnect returns the etcd URLs and the prefix dir of an
+// etcd connect string.
+func parseCfgEtcdConnect(connect string) ([]string, string, error) {
+	var urls []string
+	prefix := CfgEtcdDefaultPrefix
+
+	for _, s := range strings.Split(connect, ",") {
+		u, err := url.Parse(strings.TrimSpace(s))
+		if err != nil || u.Host == "" ||
+			(u.Scheme != "http" && u.Scheme != "https") {
+			return nil, "", fmt.Errorf("cfg_etcd: bad etcd url: %q,"+
+				" must be like http://HOST:PORT", s)
+		}
+		if len(urls) <= 0 && strings.Trim(u.Path, "/") != "" {
+			prefix = "/" + strings.Trim(u.Path, "/")
+		}
+		urls = append(urls, u.Scheme+"://"+u.Host)
+	}
+
+	return urls, prefix, nil
+}
+
+func (c *CfgEtcd) keyPath(key string) string {
+	return c.prefix + "/" + key
+}
+
+// do sends a request to the etcd keys API, trying the etcd URLs in
+// order until one is reachable.
+func (c *CfgEtcd) do(client *http.Client, method, path string,
+	params url.Values, form url.Values) (*etcdResponse, error) {
+	var err error
+	for _, u := range c.urls {
+		var req *http.Request
+
+		reqURL := u + "/v2/keys" + path
+		if len(params) > 0 {
+			reqURL = reqURL + "?" + params.Encode()
+		}
+
+		if form != nil {
+			req, err = http.NewRequest(method, reqURL,
+				strings.NewReader(form.Encode()))
+			if err == nil {
+				req.Header.Set("Content-Type",
+					"application/x-www-form-urlencoded")
+			}
+		} else {
+			req, err = http.NewRequest(method, reqURL, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err != nil {
+			continue // Try the next etcd URL.
+		}
+
+		rv := &etcdResponse{}
+		err = json.NewDecoder(resp.Body).Decode(rv)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cfg_etcd: could not parse response,"+
+				" path: %s, status: %d, err: %v", path, resp.StatusCode, err)
+		}
+
+		rv.index, _ = strconv.ParseUint(resp.Header.Get("X-Etcd-Index"), 10, 64)
+
+		return rv, nil
+	}
+
+	return nil, fmt.Errorf("cfg_etcd: could not reach etcd, urls: %v,"+
+		" err: %v", c.urls, err)
+}
+
+func (c *CfgEtcd) Get(key string, cas uint64) ([]byte, uint64, error) {
+	resp, err := c.do(c.client, "GET", c.keyPath(key), nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.ErrorCode == etcdErrorKeyNotFound {
+		return nil, 0, nil
+	}
+	if resp.ErrorCode != 0 || resp.Node == nil {
+		return nil, 0, fmt.Errorf("cfg_etcd: get, key: %s, errorCode: %d,"+
+			" message: %s", key, resp.ErrorCode, resp.Message)
+	}
+	if cas != 0 && cas != resp.Node.ModifiedIndex {
+		return nil, 0, &cbgt.CfgCASError{}
+	}
+	return []byte(resp.Node.Value), resp.Node.ModifiedIndex, nil
+}
+
+func (c *CfgEtcd) Set(key string, val []byte, cas uint64) (uint64, error) {
+	params := url.Values{}
+	if cas == 0 {
+		params.Set("prevExist", "false")
+	} else {
+		params.Set("prevIndex", strconv.FormatUint(cas, 10))
+	}
+
+	resp, err := c.do(c.client, "PUT", c.keyPath(key), params,
+		url.Values{"value": []string{string(val)}})
+	if err != nil {
+		return 0, err
+	}
+	if isEtcdCASError(resp.ErrorCode) {
+		return 0, &cbgt.CfgCASError{}
+	}
+	if resp.ErrorCode != 0 || resp.Node == nil {
+		return 0, fmt.Errorf("cfg_etcd: set, key: %s, errorCode: %d,"+
+			" message: %s", key, resp.ErrorCode, resp.Message)
+	}
+	return resp.Node.ModifiedIndex, nil
+}
+
+func (c *CfgEtcd) Del(key string, cas uint64) error {
+	params := url.Values{}
+	if cas != 0 {
+		params.Set("prevIndex", strconv.FormatUint(cas, 10))
+	}
+
+	resp, err := c.do(c.client, "DELETE", c.keyPath(key), params, nil)
+	if err != nil {
+		return err
+	}
+	if resp.ErrorCode == etcdErrorKeyNotFound && cas == 0 {
+		return nil
+	}
+	if isEtcdCASError(resp.ErrorCode) {
+		return &cbgt.CfgCASError{}
+	}
+	if resp.ErrorCode != 0 {
+		return fmt.Errorf("cfg_etcd: del, key: %s, errorCode: %d,"+
+			" message: %s", key, resp.ErrorCode, resp.Message)
+	}
+	return nil
+}
+
+func (c *CfgEtcd) Subscribe(key string, ch chan cbgt.CfgEvent) error {
+	c.subs.subscribe(key, ch)
+	return nil
+}
+
+// Refresh notifies the subscribers of every subscribed key, with the
+// key's current CAS.
+func (c *CfgEtcd) Refresh() error {
+	for _, key := range c.subs.keys() {
+		_, cas, err := c.Get(key, 0)
+		c.subs.fire(key, cas, err)
+	}
+	return nil
+}
+
+func isEtcdCASError(errorCode int) bool {
+	return errorCode == etcdErrorKeyNotFound ||
+		errorCode == etcdErrorTestFailed ||
+		errorCode == etcdErrorNodeExist
+}
+
+// watch long polls for the changes of the Cfg entries under the
+// prefix dir, notifying the subscribers of the changed keys.
+func (c *CfgEtcd) watch(waitIndex uint64) {
+	for {
+		params := url.Values{
+			"wait":      []string{"true"},
+			"recursive": []string{"true"},
+			"waitIndex": []string{strconv.FormatUint(waitIndex, 10)},
+		}
+
+		resp, err := c.do(c.watchClient, "GET", c.prefix, params, nil)
+		if err != nil {
+			log.Printf("cfg_etcd: watch, err: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if resp.ErrorCode == etcdErrorEventsCleared {
+			// Missed some changes, so notify every subscriber.
+			c.Refresh()
+			waitIndex = resp.index + 1
+			continue
+		}
+
+		if resp.ErrorCode != 0 || resp.Node == nil {
+			log.Printf("cfg_etcd: watch, errorCode: %d, message: %s",
+				resp.ErrorCode, resp.Message)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		key := strings.TrimPrefix(resp.Node.Key, c.prefix+"/")
+
+		cas := resp.Node.ModifiedIndex
+		if resp.Action == "delete" || resp.Action == "compareAndDelete" ||
+			resp.Action == "expire" {
+			cas = 0
+		}
+
+		c.subs.fire(key, cas, nil)
+
+		waitIndex = resp.Node.ModifiedIndex + 1
+	}
+}
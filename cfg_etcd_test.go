@@ -0,0 +1,207 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// fakeEtcd is an in-memory etcd keys API, for testing.
+type fakeEtcd struct {
+	m       sync.Mutex
+	index   uint64
+	entries map[string]*etcdNode
+	events  []*etcdResponse
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/keys")
+
+	reply := func(resp *etcdResponse) {
+		w.Header().Set("X-Etcd-Index", strconv.FormatUint(f.index, 10))
+		json.NewEncoder(w).Encode(resp)
+	}
+
+	if req.Method == "GET" && req.Form.Get("wait") == "true" {
+		waitIndex, _ := strconv.ParseUint(req.Form.Get("waitIndex"), 10, 64)
+		for i := 0; i < 500; i++ {
+			f.m.Lock()
+			for _, ev := range f.events {
+				if ev.Node.ModifiedIndex >= waitIndex &&
+					strings.HasPrefix(ev.Node.Key, path+"/") {
+					reply(ev)
+					f.m.Unlock()
+					return
+				}
+			}
+			f.m.Unlock()
+			time.Sleep(10 * time.Millisecond)
+		}
+		w.WriteHeader(400)
+		return
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	prev := f.entries[path]
+
+	prevIndex, _ := strconv.ParseUint(req.Form.Get("prevIndex"), 10, 64)
+	if prevIndex != 0 && (prev == nil || prev.ModifiedIndex != prevIndex) {
+		if prev == nil {
+			reply(&etcdResponse{ErrorCode: etcdErrorKeyNotFound})
+		} else {
+			reply(&etcdResponse{ErrorCode: etcdErrorTestFailed})
+		}
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		if prev == nil {
+			reply(&etcdResponse{ErrorCode: etcdErrorKeyNotFound})
+			return
+		}
+		reply(&etcdResponse{Action: "get", Node: prev})
+
+	case "PUT":
+		if req.Form.Get("prevExist") == "false" && prev != nil {
+			reply(&etcdResponse{ErrorCode: etcdErrorNodeExist})
+			return
+		}
+		f.index++
+		node := &etcdNode{Key: path, Value: req.PostForm.Get("value"),
+			ModifiedIndex: f.index}
+		f.entries[path] = node
+		resp := &etcdResponse{Action: "set", Node: node}
+		f.events = append(f.events, resp)
+		reply(resp)
+
+	case "DELETE":
+		if prev == nil {
+			reply(&etcdResponse{ErrorCode: etcdErrorKeyNotFound})
+			return
+		}
+		f.index++
+		delete(f.entries, path)
+		resp := &etcdResponse{Action: "delete",
+			Node: &etcdNode{Key: path, ModifiedIndex: f.index}}
+		f.events = append(f.events, resp)
+		reply(resp)
+	}
+}
+
+func TestParseCfgEtcdConnect(t *testing.T) {
+	tests := []struct {
+		connect   string
+		expURLs   []string
+		expPrefix string
+		expErr    bool
+	}{
+		{"http://a:2379", []string{"http://a:2379"}, "/cbft", false},
+		{"http://a:2379/my-cluster/", []string{"http://a:2379"},
+			"/my-cluster", false},
+		{"http://a:2379/x,https://b:2379", []string{"http://a:2379",
+			"https://b:2379"}, "/x", false},
+		{"a:2379", nil, "", true},
+		{"", nil, "", true},
+	}
+	for _, test := range tests {
+		urls, prefix, err := parseCfgEtcdConnect(test.connect)
+		if (err != nil) != test.expErr {
+			t.Errorf("connect: %q, expErr: %v, got: %v",
+				test.connect, test.expErr, err)
+		}
+		if !test.expErr &&
+			(!reflect.DeepEqual(urls, test.expURLs) || prefix != test.expPrefix) {
+			t.Errorf("connect: %q, got: %v, %q", test.connect, urls, prefix)
+		}
+	}
+}
+
+func TestCfgEtcd(t *testing.T) {
+	s := httptest.NewServer(&fakeEtcd{entries: map[string]*etcdNode{}})
+	defer s.Close()
+
+	c, err := NewCfgEtcd(s.URL)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	ch := make(chan cbgt.CfgEvent, 10)
+	c.Subscribe("k", ch)
+
+	val, cas, err := c.Get("k", 0)
+	if err != nil || val != nil || cas != 0 {
+		t.Errorf("expected a missing entry, got: %s, %d, %v", val, cas, err)
+	}
+
+	cas1, err := c.Set("k", []byte(`{"a":1}`), 0)
+	if err != nil || cas1 == 0 {
+		t.Fatalf("expected set to work, got: %d, %v", cas1, err)
+	}
+
+	_, err = c.Set("k", []byte(`{"a":2}`), 0)
+	if _, ok := err.(*cbgt.CfgCASError); !ok {
+		t.Errorf("expected a CAS error on creating an existing entry,"+
+			" got: %v", err)
+	}
+
+	cas2, err := c.Set("k", []byte(`{"a":2}`), cas1)
+	if err != nil || cas2 <= cas1 {
+		t.Errorf("expected CAS set to work, got: %d, %v", cas2, err)
+	}
+
+	_, err = c.Set("k", []byte(`{"a":3}`), cas1)
+	if _, ok := err.(*cbgt.CfgCASError); !ok {
+		t.Errorf("expected a CAS error on a stale cas, got: %v", err)
+	}
+
+	val, cas, err = c.Get("k", 0)
+	if err != nil || string(val) != `{"a":2}` || cas != cas2 {
+		t.Errorf("expected the entry, got: %s, %d, %v", val, cas, err)
+	}
+
+	select {
+	case ev := <-ch:
+		if ev.Key != "k" {
+			t.Errorf("expected an event for k, got: %#v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected a watch event")
+	}
+
+	err = c.Del("k", cas1)
+	if _, ok := err.(*cbgt.CfgCASError); !ok {
+		t.Errorf("expected a CAS error on a stale del, got: %v", err)
+	}
+	err = c.Del("k", cas2)
+	if err != nil {
+		t.Errorf("expected del to work, got: %v", err)
+	}
+	err = c.Del("k", 0)
+	if err != nil {
+		t.Errorf("expected del of a missing entry to work, got: %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// CfgSnapshotKeys are the Cfg entries captured by a CfgSnapshot, in
+// the order that they're restored, so that the plan is restored
+// after the node and index definitions that it refers to.  A Cfg
+// provider can't list its keys, so cbft-specific Cfg entries need to
+// be added here.
+var CfgSnapshotKeys = []string{
+	cbgt.VERSION_KEY,
+	cbgt.CfgNodeDefsKey(cbgt.NODE_DEFS_KNOWN),
+	cbgt.CfgNodeDefsKey(cbgt.NODE_DEFS_WANTED),
+	cbgt.INDEX_DEFS_KEY,
+	CLUSTER_SETTINGS_KEY,
+	WEBHOOKS_KEY,
+	PERCOLATOR_QUERIES_KEY,
+	MATERIALIZE_TASKS_KEY,
+	QUARANTINE_KEY,
+	NAMESPACES_KEY,
+	RESHARD_TASKS_KEY,
+	INDEX_TRASH_KEY,
+	INDEX_TTLS_KEY,
+	COMPOSITE_INDEXES_KEY,
+	INDEX_TEMPLATES_KEY,
+	INDEX_HISTORY_KEY,
+	RELEVANCE_SETS_KEY,
+	cbgt.PLAN_PINDEXES_KEY,
+}
+
+// A CfgSnapshot is a copy of the Cfg entries of a cluster, for
+// disaster recovery when the Cfg provider itself is lost.
+type CfgSnapshot struct {
+	ImplVersion  string                     `json:"implVersion"`
+	SnapshotTime time.Time                  `json:"snapshotTime"`
+	Entries      map[string]json.RawMessage `json:"entries"`
+}
+
+// SnapshotCfg returns a CfgSnapshot of the CfgSnapshotKeys entries
+// that exist in the cfg.
+func SnapshotCfg(cfg cbgt.Cfg) (*CfgSnapshot, error) {
+	rv := &CfgSnapshot{
+		ImplVersion:  cbgt.VERSION,
+		SnapshotTime: time.Now(),
+		Entries:      map[string]json.RawMessage{},
+	}
+
+	for _, key := range CfgSnapshotKeys {
+		buf, _, err := cfg.Get(key, 0)
+		if err != nil {
+			return nil, fmt.Errorf("cfg_snapshot: could not get,"+
+				" key: %s, err: %v", key, err)
+		}
+		if buf == nil {
+			continue
+		}
+		var entry json.RawMessage
+		err = json.Unmarshal(buf, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("cfg_snapshot: entry is not JSON,"+
+				" key: %s, err: %v", key, err)
+		}
+		rv.Entries[key] = entry
+	}
+
+	return rv, nil
+}
+
+// RestoreCfg writes the entries of a CfgSnapshot into the cfg.  When
+// the cfg already has index definitions, the restore is refused
+// unless force is true, in which case the snapshot's entries replace
+// the existing entries and any CfgSnapshotKeys entries that aren't
+// in the snapshot are deleted.  The returned keys are the restored
+// entries.
+func RestoreCfg(cfg cbgt.Cfg, snapshot *CfgSnapshot, force bool) (
+	[]string, error) {
+	if snapshot == nil || len(snapshot.Entries) <= 0 {
+		return nil, fmt.Errorf("cfg_snapshot: snapshot has no entries")
+	}
+
+	if !cbgt.VersionGTE(cbgt.VERSION, snapshot.ImplVersion) {
+		return nil, fmt.Errorf("cfg_snapshot: snapshot implVersion: %s"+
+			" is newer than this node's version: %s",
+			snapshot.ImplVersion, cbgt.VERSION)
+	}
+
+	if !force {
+		buf, _, err := cfg.Get(cbgt.INDEX_DEFS_KEY, 0)
+		if err != nil {
+			return nil, err
+		}
+		if buf != nil {
+			return nil, fmt.Errorf("cfg_snapshot: cfg already has index" +
+				" definitions, use force to overwrite")
+		}
+	}
+
+	restored := []string{}
+
+	for _, key := range CfgSnapshotKeys {
+		_, cas, err := cfg.Get(key, 0)
+		if err != nil {
+			return restored, err
+		}
+
+		buf, exists := snapshot.Entries[key]
+		if !exists {
+			if cas != 0 {
+				err = cfg.Del(key, cas)
+				if err != nil {
+					return restored, fmt.Errorf("cfg_snapshot: could not"+
+						" delete, key: %s, err: %v", key, err)
+				}
+			}
+			continue
+		}
+
+		_, err = cfg.Set(key, []byte(buf), cas)
+		if err != nil {
+			return restored, fmt.Errorf("cfg_snapshot: could not set,"+
+				" key: %s, err: %v", key, err)
+		}
+
+		restored = append(restored, key)
+	}
+
+	return restored, nil
+}
+
+// ---------------------------------------------------------------
+
+// CfgSnapshotHandler is a REST handler that returns a CfgSnapshot.
+type CfgSnapshotHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCfgSnapshotHandler(mgr *cbgt.Manager) *CfgSnapshotHandler {
+	return &CfgSnapshotHandler{mgr: mgr}
+}
+
+func (h *CfgSnapshotHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	snapshot, err := SnapshotCfg(h.mgr.Cfg())
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Disposition",
+		"attachment; filename=cbft-cfg-snapshot-"+
+			snapshot.SnapshotTime.UTC().Format("20060102T150405Z")+".json")
+
+	rest.MustEncode(w, snapshot)
+}
+
+// CfgRestoreHandler is a REST handler that restores a CfgSnapshot,
+// which is the request body.
+type CfgRestoreHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCfgRestoreHandler(mgr *cbgt.Manager) *CfgRestoreHandler {
+	return &CfgRestoreHandler{mgr: mgr}
+}
+
+func (h *CfgRestoreHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("cfg_snapshot: could not read"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	snapshot := &CfgSnapshot{}
+	err = json.Unmarshal(requestBody, snapshot)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("cfg_snapshot: could not parse"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	restored, err := RestoreCfg(h.mgr.Cfg(), snapshot,
+		req.FormValue("force") == "true")
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status   string   `json:"status"`
+		Restored []string `json:"restored"`
+	}{
+		Status:   "ok",
+		Restored: restored,
+	})
+}
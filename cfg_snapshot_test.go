@@ -0,0 +1,155 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestSnapshotRestoreCfg(t *testing.T) {
+	cfg := cbgt.NewCfgMem()
+
+	indexDefs := cbgt.NewIndexDefs(cbgt.VERSION)
+	indexDefs.IndexDefs["idx"] = &cbgt.IndexDef{
+		Type:       "bleve",
+		Name:       "idx",
+		UUID:       "u0",
+		SourceType: "nil",
+	}
+	_, err := cbgt.CfgSetIndexDefs(cfg, indexDefs, 0)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	_, err = CfgSetJSON(cfg, WEBHOOKS_KEY, map[string]interface{}{}, 0)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	snapshot, err := SnapshotCfg(cfg)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if len(snapshot.Entries) != 2 ||
+		snapshot.Entries[cbgt.INDEX_DEFS_KEY] == nil ||
+		snapshot.Entries[WEBHOOKS_KEY] == nil {
+		t.Errorf("expected 2 entries, got: %#v", snapshot.Entries)
+	}
+
+	// Round-trip through JSON, like a snapshot file.
+	buf, _ := json.Marshal(snapshot)
+	snapshot = &CfgSnapshot{}
+	err = json.Unmarshal(buf, snapshot)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	cfg2 := cbgt.NewCfgMem()
+	_, err = CfgSetJSON(cfg2, QUARANTINE_KEY, map[string]interface{}{}, 0)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	restored, err := RestoreCfg(cfg2, snapshot, false)
+	if err != nil || len(restored) != 2 {
+		t.Fatalf("expected 2 restored, got: %v, err: %v", restored, err)
+	}
+
+	indexDefs2, _, err := cbgt.CfgGetIndexDefs(cfg2)
+	if err != nil || indexDefs2 == nil ||
+		indexDefs2.IndexDefs["idx"] == nil ||
+		indexDefs2.IndexDefs["idx"].UUID != "u0" {
+		t.Errorf("expected restored index defs, got: %#v, err: %v",
+			indexDefs2, err)
+	}
+
+	buf, _, _ = cfg2.Get(QUARANTINE_KEY, 0)
+	if buf != nil {
+		t.Errorf("expected entries missing from the snapshot to be deleted")
+	}
+
+	_, err = RestoreCfg(cfg2, snapshot, false)
+	if err == nil {
+		t.Errorf("expected err on restore into a cfg with index defs")
+	}
+
+	_, err = RestoreCfg(cfg2, snapshot, true)
+	if err != nil {
+		t.Errorf("expected forced restore to work, err: %v", err)
+	}
+
+	_, err = RestoreCfg(cbgt.NewCfgMem(), &CfgSnapshot{}, false)
+	if err == nil {
+		t.Errorf("expected err on an empty snapshot")
+	}
+
+	snapshot.ImplVersion = "99.0.0"
+	_, err = RestoreCfg(cbgt.NewCfgMem(), snapshot, false)
+	if err == nil {
+		t.Errorf("expected err on a snapshot from a newer version")
+	}
+}
+
+// TestCfgSnapshotKeysComplete checks that every Cfg key constant of
+// the package (a const whose name ends with _KEY) is snapshotted.
+func TestCfgSnapshotKeysComplete(t *testing.T) {
+	snapshotted := map[string]bool{}
+	for _, key := range CfgSnapshotKeys {
+		snapshotted[key] = true
+	}
+
+	pkgs, err := parser.ParseDir(token.NewFileSet(), ".",
+		func(fi os.FileInfo) bool {
+			return !strings.HasSuffix(fi.Name(), "_test.go")
+		}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for _, f := range pkgs["cbft"].Files {
+		ast.Inspect(f, func(node ast.Node) bool {
+			spec, ok := node.(*ast.ValueSpec)
+			if !ok {
+				return true
+			}
+			for i, name := range spec.Names {
+				if !strings.HasSuffix(name.Name, "_KEY") ||
+					i >= len(spec.Values) {
+					continue
+				}
+				lit, ok := spec.Values[i].(*ast.BasicLit)
+				if !ok || lit.Kind != token.STRING {
+					continue
+				}
+				key, _ := strconv.Unquote(lit.Value)
+				if !snapshotted[key] {
+					t.Errorf("expected %s (%q) in CfgSnapshotKeys",
+						name.Name, key)
+				}
+				n++
+			}
+			return true
+		})
+	}
+	if n <= 0 {
+		t.Errorf("expected some Cfg key constants")
+	}
+}
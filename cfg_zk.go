@@ -0,0 +1,488 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// CfgZK is a Cfg provider that keeps the Cfg entries in ZooKeeper, as
+// the znodes under a prefix, where the CAS of a Cfg entry is the zxid
+// of the znode's last change.  The node definitions (the nodeDefs-*
+// Cfg entries) are kept as a parent znode with an ephemeral child
+// znode per node, so that when a node dies uncleanly, its ZooKeeper
+// session expires and its node definitions are removed, and the
+// planner reassigns its pindexes.  The connect string of the -cfg
+// command-line flag is like...
+//
+//	zk:HOST:PORT[,HOST2:PORT2...][/PREFIX]
+//
+// where the default PREFIX is "/cbft".
+type CfgZK struct {
+	conn   *zk.Conn
+	prefix string
+
+	subs cfgSubscriptions
+
+	m       sync.Mutex                   // Protects the fields that follow.
+	watched map[string]bool              // Keyed by Cfg key.
+	owned   map[string]map[string][]byte // Ephemeral node defs written by us.
+}
+
+// The default ZooKeeper prefix of the Cfg entries.
+var CfgZKDefaultPrefix = "/cbft"
+
+// The ZooKeeper session timeout, which is how long after a node's
+// unclean death its node definitions are removed.
+var CfgZKSessionTimeout = 15 * time.Second
+
+var cfgZKACL = zk.WorldACL(zk.PermAll)
+
+// NewCfgZK returns a CfgZK for the part of a ZooKeeper connect string
+// after the "zk:".
+func NewCfgZK(connect string) (*CfgZK, error) {
+	servers, prefix, err := parseCfgZKConnect(connect)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, events, err := zk.Connect(servers, CfgZKSessionTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("cfg_zk: could not connect, servers: %v,"+
+			" err: %v", servers, err)
+	}
+
+	c := &CfgZK{
+		conn:    conn,
+		prefix:  prefix,
+		watched: map[string]bool{},
+		owned:   map[string]map[string][]byte{},
+	}
+
+	err = c.ensurePath(prefix)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go c.handleEvents(events)
+
+	return c, nil
+}
+
+// parseCfgZKConnect returns the ZooKeeper servers and the prefix of a
+// ZooKeeper connect string.
+func parseCfgZKConnect(connect string) ([]string, string, error) {
+	prefix := CfgZKDefaultPrefix
+
+	hosts := connect
+	if i := strings.Index(connect, "/"); i >= 0 {
+		hosts = connect[:i]
+		if p := strings.Trim(connect[i:], "/"); p != "" {
+			prefix = "/" + p
+		}
+	}
+
+	var servers []string
+	for _, s := range strings.Split(hosts, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" || !strings.Contains(s, ":") {
+			return nil, "", fmt.Errorf("cfg_zk: bad zookeeper server: %q,"+
+				" must be like HOST:PORT", s)
+		}
+		servers = append(servers, s)
+	}
+
+	return servers, prefix, nil
+}
+
+// ensurePath creates the persistent znodes of a path, as needed.
+func (c *CfgZK) ensurePath(path string) error {
+	p := ""
+	for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+		p = p + "/" + part
+		_, err := c.conn.Create(p, nil, 0, cfgZKACL)
+		if err != nil && err != zk.ErrNodeExists {
+			return fmt.Errorf("cfg_zk: could not create path: %s,"+
+				" err: %v", p, err)
+		}
+	}
+	return nil
+}
+
+func (c *CfgZK) keyPath(key string) string {
+	return c.prefix + "/" + key
+}
+
+// isNodeDefsKey returns true for the Cfg keys of node definitions.
+func isNodeDefsKey(key string) bool {
+	return key == cbgt.CfgNodeDefsKey(cbgt.NODE_DEFS_KNOWN) ||
+		key == cbgt.CfgNodeDefsKey(cbgt.NODE_DEFS_WANTED)
+}
+
+// zkCAS returns the CAS of a znode, which changes whenever the znode
+// or its set of children changes.
+func zkCAS(stat *zk.Stat) uint64 {
+	if stat.Pzxid > stat.Mzxid {
+		return uint64(stat.Pzxid)
+	}
+	return uint64(stat.Mzxid)
+}
+
+func (c *CfgZK) Get(key string, cas uint64) ([]byte, uint64, error) {
+	val, stat, err := c.conn.Get(c.keyPath(key))
+	if err == zk.ErrNoNode {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if isNodeDefsKey(key) {
+		val, err = c.getNodeDefs(key, val)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if cas != 0 && cas != zkCAS(stat) {
+		return nil, 0, &cbgt.CfgCASError{}
+	}
+	return val, zkCAS(stat), nil
+}
+
+// getNodeDefs assembles the node definitions of a nodeDefs-* Cfg
+// entry from its parent znode and its children.
+func (c *CfgZK) getNodeDefs(key string, header []byte) ([]byte, error) {
+	nodeDefs := &cbgt.NodeDefs{}
+	if len(header) > 0 {
+		err := json.Unmarshal(header, nodeDefs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	nodeDefs.NodeDefs = map[string]*cbgt.NodeDef{}
+
+	children, _, err := c.conn.Children(c.keyPath(key))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, uuid := range children {
+		buf, _, err := c.conn.Get(c.keyPath(key) + "/" + uuid)
+		if err == zk.ErrNoNode {
+			continue // The node's session just expired.
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		nodeDef := &cbgt.NodeDef{}
+		err = json.Unmarshal(buf, nodeDef)
+		if err != nil {
+			return nil, err
+		}
+		nodeDefs.NodeDefs[uuid] = nodeDef
+	}
+
+	return json.Marshal(nodeDefs)
+}
+
+func (c *CfgZK) Set(key string, val []byte, cas uint64) (uint64, error) {
+	path := c.keyPath(key)
+
+	var nodeDefs *cbgt.NodeDefs
+
+	data := val
+	if isNodeDefsKey(key) {
+		nodeDefs = &cbgt.NodeDefs{}
+		err := json.Unmarshal(val, nodeDefs)
+		if err != nil {
+			return 0, err
+		}
+		data, err = json.Marshal(&cbgt.NodeDefs{
+			UUID:        nodeDefs.UUID,
+			ImplVersion: nodeDefs.ImplVersion,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var stat *zk.Stat
+
+	if cas == 0 {
+		_, err := c.conn.Create(path, data, 0, cfgZKACL)
+		if err == zk.ErrNodeExists {
+			return 0, &cbgt.CfgCASError{}
+		}
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		_, curr, err := c.conn.Get(path)
+		if err == zk.ErrNoNode {
+			return 0, &cbgt.CfgCASError{}
+		}
+		if err != nil {
+			return 0, err
+		}
+		if zkCAS(curr) != cas {
+			return 0, &cbgt.CfgCASError{}
+		}
+
+		// The version check guards against a concurrent writer.
+		stat, err = c.conn.Set(path, data, curr.Version)
+		if err == zk.ErrBadVersion || err == zk.ErrNoNode {
+			return 0, &cbgt.CfgCASError{}
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if nodeDefs != nil {
+		err := c.setNodeDefs(key, nodeDefs)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if stat == nil || nodeDefs != nil {
+		_, stat, err := c.conn.Get(path)
+		if err != nil {
+			return 0, err
+		}
+		return zkCAS(stat), nil
+	}
+
+	return zkCAS(stat), nil
+}
+
+// setNodeDefs makes the children of a nodeDefs-* parent znode match
+// the node definitions, where new children are ephemeral znodes of
+// our session.
+func (c *CfgZK) setNodeDefs(key string, nodeDefs *cbgt.NodeDefs) error {
+	path := c.keyPath(key)
+
+	children, _, err := c.conn.Children(path)
+	if err != nil {
+		return err
+	}
+
+	for _, uuid := range children {
+		if nodeDefs.NodeDefs[uuid] == nil {
+			err = c.conn.Delete(path+"/"+uuid, -1)
+			if err != nil && err != zk.ErrNoNode {
+				return err
+			}
+		}
+	}
+
+	c.m.Lock()
+	prevOwned := c.owned[key]
+	owned := map[string][]byte{}
+	c.owned[key] = owned
+	c.m.Unlock()
+
+	for uuid, nodeDef := range nodeDefs.NodeDefs {
+		buf, err := json.Marshal(nodeDef)
+		if err != nil {
+			return err
+		}
+
+		childPath := path + "/" + uuid
+
+		_, isOwned := prevOwned[uuid]
+
+		_, err = c.conn.Set(childPath, buf, -1)
+		if err == zk.ErrNoNode {
+			_, err = c.conn.Create(childPath, buf, zk.FlagEphemeral, cfgZKACL)
+			isOwned = true
+		}
+		if err != nil {
+			return err
+		}
+
+		if isOwned {
+			c.m.Lock()
+			owned[uuid] = buf
+			c.m.Unlock()
+		}
+	}
+
+	return nil
+}
+
+func (c *CfgZK) Del(key string, cas uint64) error {
+	path := c.keyPath(key)
+
+	_, stat, err := c.conn.Get(path)
+	if err == zk.ErrNoNode {
+		if cas != 0 {
+			return &cbgt.CfgCASError{}
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if cas != 0 && cas != zkCAS(stat) {
+		return &cbgt.CfgCASError{}
+	}
+
+	if isNodeDefsKey(key) {
+		children, _, err := c.conn.Children(path)
+		if err != nil {
+			return err
+		}
+		for _, uuid := range children {
+			err = c.conn.Delete(path+"/"+uuid, -1)
+			if err != nil && err != zk.ErrNoNode {
+				return err
+			}
+		}
+
+		c.m.Lock()
+		delete(c.owned, key)
+		c.m.Unlock()
+	}
+
+	err = c.conn.Delete(path, stat.Version)
+	if err == zk.ErrBadVersion || err == zk.ErrNotEmpty {
+		return &cbgt.CfgCASError{}
+	}
+	return err
+}
+
+func (c *CfgZK) Subscribe(key string, ch chan cbgt.CfgEvent) error {
+	c.subs.subscribe(key, ch)
+
+	c.m.Lock()
+	watched := c.watched[key]
+	c.watched[key] = true
+	c.m.Unlock()
+
+	if !watched {
+		go c.watch(key)
+	}
+
+	return nil
+}
+
+// Refresh notifies the subscribers of every subscribed key, with the
+// key's current CAS.
+func (c *CfgZK) Refresh() error {
+	for _, key := range c.subs.keys() {
+		_, cas, err := c.Get(key, 0)
+		c.subs.fire(key, cas, err)
+	}
+	return nil
+}
+
+// watch re-arms the (one-shot) ZooKeeper watches of a Cfg key,
+// notifying the subscribers of the key whenever a watch fires.
+func (c *CfgZK) watch(key string) {
+	path := c.keyPath(key)
+
+	for {
+		exists, _, existsCh, err := c.conn.ExistsW(path)
+		if err != nil {
+			log.Printf("cfg_zk: watch, key: %s, err: %v", key, err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var childrenCh <-chan zk.Event
+		if exists && isNodeDefsKey(key) {
+			_, _, childrenCh, err = c.conn.ChildrenW(path)
+			if err != nil && err != zk.ErrNoNode {
+				log.Printf("cfg_zk: watch children, key: %s, err: %v",
+					key, err)
+			}
+		}
+
+		select {
+		case <-existsCh:
+		case <-childrenCh:
+		}
+
+		_, cas, err := c.Get(key, 0)
+		c.subs.fire(key, cas, err)
+	}
+}
+
+// handleEvents re-creates our ephemeral node definitions when our
+// ZooKeeper session had expired and a new session was established,
+// as ZooKeeper removed them with the expired session.
+func (c *CfgZK) handleEvents(events <-chan zk.Event) {
+	expired := false
+
+	for ev := range events {
+		if ev.Type != zk.EventSession {
+			continue
+		}
+
+		if ev.State == zk.StateExpired {
+			expired = true
+			continue
+		}
+
+		if ev.State != zk.StateHasSession || !expired {
+			continue
+		}
+
+		expired = false
+
+		log.Printf("cfg_zk: new session, re-registering node definitions")
+
+		c.m.Lock()
+		keys := make([]string, 0, len(c.owned))
+		for key := range c.owned {
+			keys = append(keys, key)
+		}
+		c.m.Unlock()
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			c.m.Lock()
+			owned := map[string][]byte{}
+			for uuid, buf := range c.owned[key] {
+				owned[uuid] = buf
+			}
+			c.m.Unlock()
+
+			for uuid, buf := range owned {
+				_, err := c.conn.Create(c.keyPath(key)+"/"+uuid, buf,
+					zk.FlagEphemeral, cfgZKACL)
+				if err != nil && err != zk.ErrNodeExists {
+					log.Printf("cfg_zk: could not re-register, key: %s,"+
+						" uuid: %s, err: %v", key, uuid, err)
+				}
+			}
+		}
+
+		c.Refresh()
+	}
+}
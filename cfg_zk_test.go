@@ -0,0 +1,74 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/samuel/go-zookeeper/zk"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestParseCfgZKConnect(t *testing.T) {
+	tests := []struct {
+		connect string
+		servers []string
+		prefix  string
+		err     bool
+	}{
+		{"127.0.0.1:2181", []string{"127.0.0.1:2181"}, "/cbft", false},
+		{"a:2181,b:2181/cbft-prod", []string{"a:2181", "b:2181"},
+			"/cbft-prod", false},
+		{"a:2181/x/y/", []string{"a:2181"}, "/x/y", false},
+		{"a:2181/", []string{"a:2181"}, "/cbft", false},
+		{"", nil, "", true},
+		{"a", nil, "", true},
+		{"a:2181,,b:2181", nil, "", true},
+	}
+
+	for i, test := range tests {
+		servers, prefix, err := parseCfgZKConnect(test.connect)
+		if (err != nil) != test.err {
+			t.Errorf("test: %d, connect: %q, err: %v", i, test.connect, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		if !reflect.DeepEqual(servers, test.servers) ||
+			prefix != test.prefix {
+			t.Errorf("test: %d, connect: %q, servers: %v, prefix: %s",
+				i, test.connect, servers, prefix)
+		}
+	}
+}
+
+func TestZKCAS(t *testing.T) {
+	if zkCAS(&zk.Stat{Mzxid: 10, Pzxid: 5}) != 10 {
+		t.Errorf("expected data change zxid")
+	}
+	if zkCAS(&zk.Stat{Mzxid: 10, Pzxid: 20}) != 20 {
+		t.Errorf("expected children change zxid")
+	}
+}
+
+func TestIsNodeDefsKey(t *testing.T) {
+	if !isNodeDefsKey(cbgt.CfgNodeDefsKey(cbgt.NODE_DEFS_KNOWN)) ||
+		!isNodeDefsKey(cbgt.CfgNodeDefsKey(cbgt.NODE_DEFS_WANTED)) {
+		t.Errorf("expected node defs keys")
+	}
+	if isNodeDefsKey(cbgt.INDEX_DEFS_KEY) {
+		t.Errorf("expected index defs key to not be a node defs key")
+	}
+}
@@ -0,0 +1,327 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/blevesearch/bleve/analysis"
+	"github.com/blevesearch/bleve/registry"
+)
+
+// The html_strip and markdown_strip char filters remove the markup of
+// HTML and Markdown fields before tokenization, so that the fields
+// are indexed as clean text without pre-processing by applications.
+// They're used in the custom analyzers of an index mapping, like...
+//
+//   "analysis": {
+//     "char_filters": {
+//       "body_html": {"type": "html_strip", "escaped_tags": ["b"]}
+//     },
+//     "analyzers": {
+//       "body": {"type": "custom", "tokenizer": "unicode",
+//                "char_filters": ["body_html"],
+//                "token_filters": ["to_lower"]}
+//     }
+//   }
+//
+// Markup is replaced by spaces of the same length, so the offsets of
+// tokens, as used for highlighting, remain those of the original
+// field.
+
+const CHAR_FILTER_HTML_STRIP = "html_strip"
+
+const CHAR_FILTER_MARKDOWN_STRIP = "markdown_strip"
+
+func init() {
+	registry.RegisterCharFilter(CHAR_FILTER_HTML_STRIP,
+		htmlStripCharFilterConstructor)
+	registry.RegisterCharFilter(CHAR_FILTER_MARKDOWN_STRIP,
+		markdownStripCharFilterConstructor)
+}
+
+// charFilterBlank replaces the bytes of a range with spaces.
+func charFilterBlank(b []byte, start, end int) {
+	for i := start; i < end; i++ {
+		b[i] = ' '
+	}
+}
+
+// ---------------------------------------------------------
+
+// HTMLStripCharFilter is a bleve char filter that removes HTML tags,
+// comments, and the contents of script and style elements, and
+// decodes HTML entities.
+type HTMLStripCharFilter struct {
+	escapedTags map[string]bool // Lowercase tag names that are kept.
+}
+
+func htmlStripCharFilterConstructor(config map[string]interface{},
+	cache *registry.Cache) (analysis.CharFilter, error) {
+	f := &HTMLStripCharFilter{escapedTags: map[string]bool{}}
+	if v, exists := config["escaped_tags"]; exists {
+		tags, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("html_strip: escaped_tags must be" +
+				" an array of tag names")
+		}
+		for _, tag := range tags {
+			s, ok := tag.(string)
+			if !ok || s == "" {
+				return nil, fmt.Errorf("html_strip: bad escaped tag: %v", tag)
+			}
+			f.escapedTags[strings.ToLower(s)] = true
+		}
+	}
+	return f, nil
+}
+
+var htmlStripEntityRE = regexp.MustCompile(
+	`^&(#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[a-zA-Z][a-zA-Z0-9]{1,31});`)
+
+func (f *HTMLStripCharFilter) Filter(input []byte) []byte {
+	rv := make([]byte, len(input))
+	copy(rv, input)
+
+	for i := 0; i < len(rv); {
+		switch rv[i] {
+		case '<':
+			i = f.stripTag(rv, i)
+		case '&':
+			loc := htmlStripEntityRE.FindIndex(rv[i:])
+			if loc == nil {
+				i++
+				continue
+			}
+			end := i + loc[1]
+			decoded := html.UnescapeString(string(rv[i:end]))
+			if decoded != string(rv[i:end]) && len(decoded) <= end-i {
+				n := copy(rv[i:], decoded)
+				charFilterBlank(rv, i+n, end)
+			}
+			i = end
+		default:
+			i++
+		}
+	}
+
+	return rv
+}
+
+// stripTag blanks the tag, comment or declaration that starts at
+// position i, and returns the position after it.  A '<' that doesn't
+// start a tag is kept as text.
+func (f *HTMLStripCharFilter) stripTag(b []byte, i int) int {
+	rest := b[i+1:]
+
+	if bytes.HasPrefix(rest, []byte("!--")) {
+		end := bytes.Index(rest[3:], []byte("-->"))
+		if end < 0 {
+			end = len(b)
+		} else {
+			end = i + 1 + 3 + end + 3
+		}
+		charFilterBlank(b, i, end)
+		return end
+	}
+
+	if len(rest) > 0 && (rest[0] == '!' || rest[0] == '?') {
+		end := bytes.IndexByte(rest, '>')
+		if end < 0 {
+			return i + 1
+		}
+		charFilterBlank(b, i, i+1+end+1)
+		return i + 1 + end + 1
+	}
+
+	closing := len(rest) > 0 && rest[0] == '/'
+	nameStart := i + 1
+	if closing {
+		nameStart++
+	}
+	nameEnd := nameStart
+	for nameEnd < len(b) && (isASCIILetter(b[nameEnd]) ||
+		(nameEnd > nameStart && (isASCIIDigit(b[nameEnd]) ||
+			b[nameEnd] == '-' || b[nameEnd] == ':'))) {
+		nameEnd++
+	}
+	if nameEnd == nameStart {
+		return i + 1
+	}
+
+	end := htmlTagEnd(b, nameEnd)
+	if end < 0 {
+		return i + 1
+	}
+
+	name := strings.ToLower(string(b[nameStart:nameEnd]))
+	if f.escapedTags[name] {
+		return end
+	}
+
+	charFilterBlank(b, i, end)
+
+	if !closing && (name == "script" || name == "style") &&
+		b[end-2] != '/' {
+		// The contents of script and style elements aren't text.
+		closeTag := []byte("</" + name)
+		closeAt := bytes.Index(bytes.ToLower(b[end:]), closeTag)
+		if closeAt < 0 {
+			charFilterBlank(b, end, len(b))
+			return len(b)
+		}
+		charFilterBlank(b, end, end+closeAt)
+		return end + closeAt
+	}
+
+	return end
+}
+
+// htmlTagEnd returns the position after the '>' that ends a tag,
+// skipping quoted attribute values, or -1.
+func htmlTagEnd(b []byte, i int) int {
+	var quote byte
+	for ; i < len(b); i++ {
+		switch {
+		case quote != 0:
+			if b[i] == quote {
+				quote = 0
+			}
+		case b[i] == '"' || b[i] == '\'':
+			quote = b[i]
+		case b[i] == '>':
+			return i + 1
+		case b[i] == '<':
+			return -1
+		}
+	}
+	return -1
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isASCIIDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// ---------------------------------------------------------
+
+// MarkdownStripCharFilter is a bleve char filter that removes the
+// syntax of Markdown, keeping the text of headings, lists, quotes,
+// emphasis, code, links and images.  Inline HTML is left to the
+// html_strip char filter.
+type MarkdownStripCharFilter struct{}
+
+func markdownStripCharFilterConstructor(config map[string]interface{},
+	cache *registry.Cache) (analysis.CharFilter, error) {
+	return &MarkdownStripCharFilter{}, nil
+}
+
+var (
+	// Code fences, with their info strings.
+	markdownFenceRE = regexp.MustCompile("(?m)^[ \t]*(```|~~~)[^\n]*$")
+
+	// Horizontal rules.
+	markdownRuleRE = regexp.MustCompile(`(?m)^[ \t]*([-*_][ \t]*){3,}$`)
+
+	// Link reference definitions, like [id]: http://example.com.
+	markdownRefDefRE = regexp.MustCompile(`(?m)^[ \t]*\[[^\]\n]+\]:[^\n]*$`)
+
+	// Heading, quote and list markers, which can be nested, like "> - ".
+	markdownLineRE = regexp.MustCompile(
+		`(?m)^[ \t]*((#{1,6}|>|[-*+]|[0-9]{1,9}[.)])[ \t]+|>)+`)
+
+	// Setext heading underlines.
+	markdownUnderlineRE = regexp.MustCompile(`(?m)^[ \t]*(=+|-+)[ \t]*$`)
+
+	// Links and images, whose text is group 1, like [text](url),
+	// ![alt](url "title") and [text][id].
+	markdownLinkRE = regexp.MustCompile(
+		`!?\[([^\]\n]*)\](\([^)\n]*\)|\[[^\]\n]*\])`)
+
+	// Autolinks, whose url is group 1, like <http://example.com>.
+	markdownAutolinkRE = regexp.MustCompile(`<([a-zA-Z][a-zA-Z0-9+.-]*:[^>\s]*)>`)
+
+	// Backslash escapes of punctuation.
+	markdownEscapeRE = regexp.MustCompile("\\\\[!-/:-@\\[-`{-~]")
+)
+
+func (f *MarkdownStripCharFilter) Filter(input []byte) []byte {
+	rv := make([]byte, len(input))
+	copy(rv, input)
+
+	for _, re := range []*regexp.Regexp{
+		markdownFenceRE, markdownRuleRE, markdownRefDefRE,
+		markdownLineRE, markdownUnderlineRE,
+	} {
+		for _, loc := range re.FindAllIndex(rv, -1) {
+			charFilterBlank(rv, loc[0], loc[1])
+		}
+	}
+
+	// Keep the submatch of links, images and autolinks.
+	for _, re := range []*regexp.Regexp{markdownLinkRE, markdownAutolinkRE} {
+		for _, loc := range re.FindAllSubmatchIndex(rv, -1) {
+			charFilterBlank(rv, loc[0], loc[2])
+			charFilterBlank(rv, loc[3], loc[1])
+		}
+	}
+
+	for _, loc := range markdownEscapeRE.FindAllIndex(rv, -1) {
+		rv[loc[0]] = ' '
+	}
+
+	// Emphasis and code markers, except for the '_' and '*' within
+	// words, like snake_case.
+	for i := 0; i < len(rv); {
+		c := rv[i]
+		if c != '*' && c != '_' && c != '~' && c != '`' {
+			i++
+			continue
+		}
+		if i > 0 && input[i-1] == '\\' {
+			i++ // Escaped, as with \*.
+			continue
+		}
+		end := i
+		for end < len(rv) && rv[end] == c {
+			end++
+		}
+		if c == '`' || !markdownWordRune(rv[:i], true) ||
+			!markdownWordRune(rv[end:], false) {
+			charFilterBlank(rv, i, end)
+		}
+		i = end
+	}
+
+	return rv
+}
+
+// markdownWordRune returns whether the last rune of b, or the first
+// rune of b, is a letter or digit.
+func markdownWordRune(b []byte, last bool) bool {
+	var r rune
+	if last {
+		r, _ = utf8.DecodeLastRune(b)
+	} else {
+		r, _ = utf8.DecodeRune(b)
+	}
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
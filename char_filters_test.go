@@ -0,0 +1,131 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/registry"
+)
+
+func charFilterTestFields(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func TestHTMLStripCharFilter(t *testing.T) {
+	f, err := registry.NewCache().DefineCharFilter("f", map[string]interface{}{
+		"type":         CHAR_FILTER_HTML_STRIP,
+		"escaped_tags": []interface{}{"B"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		`<p class="a>b">Fish &amp; chips</p>`:                   "Fish & chips",
+		`x<!-- comment <p> -->y`:                                "x y",
+		`<script type="text/javascript">if (a<b) {}</script>ok`: "ok",
+		`<STYLE>p {}</style>ok<br/>too`:                         "ok too",
+		`<b>kept</b> &#x41; &#66; &bogus; a < b <`:              "<b>kept</b> A B &bogus; a < b <",
+		`<!DOCTYPE html><?xml?>text<!-- open`:                   "text",
+	}
+	for in, exp := range tests {
+		out := f.Filter([]byte(in))
+		if len(out) != len(in) {
+			t.Errorf("expected the same length, in: %q, out: %q", in, out)
+		}
+		if charFilterTestFields(string(out)) != exp {
+			t.Errorf("in: %q, expected: %q, got: %q", in, exp, out)
+		}
+	}
+
+	_, err = registry.NewCache().DefineCharFilter("f", map[string]interface{}{
+		"type":         CHAR_FILTER_HTML_STRIP,
+		"escaped_tags": "b",
+	})
+	if err == nil {
+		t.Errorf("expected err on bad escaped_tags")
+	}
+}
+
+func TestMarkdownStripCharFilter(t *testing.T) {
+	f, err := registry.NewCache().DefineCharFilter("f", map[string]interface{}{
+		"type": CHAR_FILTER_MARKDOWN_STRIP,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"# Title\n\nSome *bold* and __strong__ snake_case":  "Title Some bold and strong snake_case",
+		"> - quoted\n1. first\n\n---\nSetext\n======":       "quoted first Setext",
+		"```go\nfunc main() {}\n```":                        "func main() {}",
+		"[link](http://x.com \"t\") ![alt](a.png) [ref][1]": "link alt ref",
+		"<http://x.com> `code` \\*lit\\* ~~gone~~":          "http://x.com code *lit * gone",
+		"[1]: http://x.com\ntext":                           "text",
+	}
+	for in, exp := range tests {
+		out := f.Filter([]byte(in))
+		if len(out) != len(in) {
+			t.Errorf("expected the same length, in: %q, out: %q", in, out)
+		}
+		if charFilterTestFields(string(out)) != exp {
+			t.Errorf("in: %q, expected: %q, got: %q", in, exp, out)
+		}
+	}
+}
+
+func TestHTMLStripCharFilterHighlight(t *testing.T) {
+	m := bleve.NewIndexMapping()
+	err := json.Unmarshal([]byte(`{
+		"default_analyzer": "body",
+		"analysis": {
+			"analyzers": {
+				"body": {"type": "custom", "tokenizer": "unicode",
+					"char_filters": ["html_strip"],
+					"token_filters": ["to_lower"]}
+			}
+		}
+	}`), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bindex, err := bleve.NewMemOnly(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindex.Index("a", map[string]interface{}{
+		"body": `<div class="fish">Fish &amp; <i>chips</i></div>`,
+	})
+
+	for q, exp := range map[string]int{"chips": 1, "fish": 1, "div": 0} {
+		req := bleve.NewSearchRequest(bleve.NewMatchQuery(q))
+		req.IncludeLocations = true
+		res, err := bindex.Search(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Hits) != exp {
+			t.Errorf("query: %s, expected hits: %d, got: %v", q, exp, res)
+		}
+		if q == "chips" && len(res.Hits) == 1 {
+			loc := res.Hits[0].Locations["body"]["chips"][0]
+			if loc.Start != 32 || loc.End != 37 {
+				t.Errorf("expected the offsets of the field, got: %#v", loc)
+			}
+		}
+	}
+}
@@ -0,0 +1,325 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The max-age, in seconds, that clients may cache a client topology.
+var ClientTopologyMaxAge = 5
+
+// How long a node health probe result is reused.
+var ClientTopologyProbeTTL = 5 * time.Second
+
+// The timeout of a node health probe.
+var ClientTopologyProbeTimeout = 2 * time.Second
+
+const CLIENT_TOPOLOGY_HEALTH_OK = "ok"
+const CLIENT_TOPOLOGY_HEALTH_UNREACHABLE = "unreachable"
+const CLIENT_TOPOLOGY_HEALTH_UNKNOWN = "unknown" // Not a known node.
+
+const CLIENT_TOPOLOGY_ROLE_ACTIVE = "active"
+const CLIENT_TOPOLOGY_ROLE_REPLICA = "replica"
+
+// A ClientTopology tells smart clients which nodes can serve the
+// queries of each index, so that they can route queries directly to
+// healthy nodes.  The Hash changes whenever the topology changes.
+type ClientTopology struct {
+	Hash    string                          `json:"hash"`
+	Indexes map[string]*ClientTopologyIndex `json:"indexes"`
+}
+
+// A ClientTopologyIndex lists the nodes of an index in the order that
+// clients should prefer them: healthy nodes first, then nodes with
+// active partitions, then nodes with more partitions.
+type ClientTopologyIndex struct {
+	UUID  string                `json:"uuid"`
+	Nodes []*ClientTopologyNode `json:"nodes"`
+
+	// True when the healthy nodes cover every partition of the index.
+	Complete bool `json:"complete"`
+}
+
+type ClientTopologyNode struct {
+	URL    string `json:"url"`
+	Health string `json:"health"`
+	Role   string `json:"role"` // Active when the node has any active partition.
+
+	NumPIndexes int `json:"numPIndexes"`
+}
+
+// CalcClientTopology computes the ClientTopology of the plan, where
+// the health callback returns the health of a known node.
+func CalcClientTopology(indexDefs *cbgt.IndexDefs,
+	nodeDefsKnown, nodeDefsWanted *cbgt.NodeDefs,
+	planPIndexes *cbgt.PlanPIndexes,
+	health func(nodeDef *cbgt.NodeDef) string) (*ClientTopology, error) {
+	rv := &ClientTopology{
+		Indexes: map[string]*ClientTopologyIndex{},
+	}
+
+	if indexDefs != nil {
+		for name, indexDef := range indexDefs.IndexDefs {
+			rv.Indexes[name] = &ClientTopologyIndex{
+				UUID:     indexDef.UUID,
+				Nodes:    []*ClientTopologyNode{},
+				Complete: true,
+			}
+		}
+	}
+
+	nodeHealths := map[string]string{} // Keyed by node UUID.
+	nodeHealth := func(nodeUUID string) string {
+		h, exists := nodeHealths[nodeUUID]
+		if !exists {
+			h = CLIENT_TOPOLOGY_HEALTH_UNKNOWN
+			if nodeDefsKnown != nil && nodeDefsKnown.NodeDefs[nodeUUID] != nil {
+				h = health(nodeDefsKnown.NodeDefs[nodeUUID])
+			}
+			nodeHealths[nodeUUID] = h
+		}
+		return h
+	}
+
+	// Keyed by index name, then by node UUID.
+	indexNodes := map[string]map[string]*ClientTopologyNode{}
+
+	if planPIndexes != nil {
+		for _, planPIndex := range planPIndexes.PlanPIndexes {
+			cti := rv.Indexes[planPIndex.IndexName]
+			if cti == nil || cti.UUID != planPIndex.IndexUUID {
+				continue
+			}
+
+			nodes := indexNodes[planPIndex.IndexName]
+			if nodes == nil {
+				nodes = map[string]*ClientTopologyNode{}
+				indexNodes[planPIndex.IndexName] = nodes
+			}
+
+			covered := false
+
+			for nodeUUID, planPIndexNode := range planPIndex.Nodes {
+				if !planPIndexNode.CanRead {
+					continue
+				}
+
+				var nodeDef *cbgt.NodeDef
+				if nodeDefsWanted != nil {
+					nodeDef = nodeDefsWanted.NodeDefs[nodeUUID]
+				}
+				if nodeDef == nil {
+					continue
+				}
+
+				n := nodes[nodeUUID]
+				if n == nil {
+					n = &ClientTopologyNode{
+						URL:    NodeURL(nodeDef.HostPort),
+						Health: nodeHealth(nodeUUID),
+						Role:   CLIENT_TOPOLOGY_ROLE_REPLICA,
+					}
+					nodes[nodeUUID] = n
+				}
+				n.NumPIndexes++
+				if planPIndexNode.Priority <= 0 {
+					n.Role = CLIENT_TOPOLOGY_ROLE_ACTIVE
+				}
+
+				if n.Health == CLIENT_TOPOLOGY_HEALTH_OK {
+					covered = true
+				}
+			}
+
+			if !covered {
+				cti.Complete = false
+			}
+		}
+	}
+
+	for indexName, nodes := range indexNodes {
+		cti := rv.Indexes[indexName]
+		for _, n := range nodes {
+			cti.Nodes = append(cti.Nodes, n)
+		}
+		sort.Sort(clientTopologyNodes(cti.Nodes))
+	}
+
+	buf, err := json.Marshal(rv.Indexes) // Map keys are sorted.
+	if err != nil {
+		return nil, err
+	}
+	rv.Hash = fmt.Sprintf("%x", sha1.Sum(buf))
+
+	return rv, nil
+}
+
+type clientTopologyNodes []*ClientTopologyNode
+
+func (a clientTopologyNodes) Len() int      { return len(a) }
+func (a clientTopologyNodes) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a clientTopologyNodes) Less(i, j int) bool {
+	iok := a[i].Health == CLIENT_TOPOLOGY_HEALTH_OK
+	jok := a[j].Health == CLIENT_TOPOLOGY_HEALTH_OK
+	if iok != jok {
+		return iok
+	}
+	if a[i].Role != a[j].Role {
+		return a[i].Role == CLIENT_TOPOLOGY_ROLE_ACTIVE
+	}
+	if a[i].NumPIndexes != a[j].NumPIndexes {
+		return a[i].NumPIndexes > a[j].NumPIndexes
+	}
+	return a[i].URL < a[j].URL
+}
+
+// ---------------------------------------------------------------
+
+type clientTopologyProbe struct {
+	health string
+	when   time.Time
+}
+
+var clientTopologyProbesM sync.Mutex
+var clientTopologyProbes = map[string]*clientTopologyProbe{} // Keyed by hostPort.
+
+// ClientTopologyProbeNode returns the health of a remote node, by
+// requesting its REST API, where recent results are reused.  Any HTTP
+// response means that the node is up, as a node with REST auth may
+// reject the probe, and only transport errors and timeouts mean that
+// the node is unreachable.
+var ClientTopologyProbeNode = func(hostPort string) string {
+	clientTopologyProbesM.Lock()
+	p := clientTopologyProbes[hostPort]
+	clientTopologyProbesM.Unlock()
+
+	if p != nil && time.Since(p.when) < ClientTopologyProbeTTL {
+		return p.health
+	}
+
+	health := CLIENT_TOPOLOGY_HEALTH_UNREACHABLE
+
+	client := &http.Client{
+		Transport: NodeHTTPClient.Transport,
+		Timeout:   ClientTopologyProbeTimeout,
+	}
+	resp, err := client.Get(NodeURL(hostPort) + "/api/health/live")
+	if err == nil {
+		resp.Body.Close()
+		health = CLIENT_TOPOLOGY_HEALTH_OK
+	}
+
+	clientTopologyProbesM.Lock()
+	clientTopologyProbes[hostPort] = &clientTopologyProbe{
+		health: health,
+		when:   time.Now(),
+	}
+	clientTopologyProbesM.Unlock()
+
+	return health
+}
+
+// ClientTopologyHandler is a REST handler that returns the
+// ClientTopology of the cluster.
+type ClientTopologyHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewClientTopologyHandler(mgr *cbgt.Manager) *ClientTopologyHandler {
+	return &ClientTopologyHandler{mgr: mgr}
+}
+
+func (h *ClientTopologyHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	cfg := h.mgr.Cfg()
+
+	indexDefs, _, err := cbgt.CfgGetIndexDefs(cfg)
+	if err != nil {
+		rest.ShowError(w, req, "could not retrieve index defs", 500)
+		return
+	}
+
+	nodeDefsKnown, _, err := cbgt.CfgGetNodeDefs(cfg, cbgt.NODE_DEFS_KNOWN)
+	if err != nil {
+		rest.ShowError(w, req, "could not retrieve node defs (known)", 500)
+		return
+	}
+
+	nodeDefsWanted, _, err := cbgt.CfgGetNodeDefs(cfg, cbgt.NODE_DEFS_WANTED)
+	if err != nil {
+		rest.ShowError(w, req, "could not retrieve node defs (wanted)", 500)
+		return
+	}
+
+	planPIndexes, _, err := cbgt.CfgGetPlanPIndexes(cfg)
+	if err != nil {
+		rest.ShowError(w, req, "could not retrieve plan pIndexes", 500)
+		return
+	}
+
+	// Probe the remote nodes concurrently, ahead of the calculation.
+	if nodeDefsKnown != nil {
+		var wg sync.WaitGroup
+		for uuid, nodeDef := range nodeDefsKnown.NodeDefs {
+			if uuid == h.mgr.UUID() {
+				continue
+			}
+			wg.Add(1)
+			go func(hostPort string) {
+				ClientTopologyProbeNode(hostPort)
+				wg.Done()
+			}(nodeDef.HostPort)
+		}
+		wg.Wait()
+	}
+
+	topology, err := CalcClientTopology(indexDefs,
+		nodeDefsKnown, nodeDefsWanted, planPIndexes,
+		func(nodeDef *cbgt.NodeDef) string {
+			if nodeDef.UUID == h.mgr.UUID() {
+				return CLIENT_TOPOLOGY_HEALTH_OK
+			}
+			return ClientTopologyProbeNode(nodeDef.HostPort)
+		})
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 500)
+		return
+	}
+
+	etag := `"` + topology.Hash + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control",
+		"max-age="+strconv.Itoa(ClientTopologyMaxAge))
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+		*ClientTopology
+	}{
+		Status:         "ok",
+		ClientTopology: topology,
+	})
+}
@@ -0,0 +1,174 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestCalcClientTopology(t *testing.T) {
+	indexDefs := cbgt.NewIndexDefs(cbgt.VERSION)
+	indexDefs.IndexDefs["idx"] = &cbgt.IndexDef{Name: "idx", UUID: "u0"}
+	indexDefs.IndexDefs["empty"] = &cbgt.IndexDef{Name: "empty", UUID: "u1"}
+
+	nodeDefs := &cbgt.NodeDefs{
+		NodeDefs: map[string]*cbgt.NodeDef{
+			"a": {UUID: "a", HostPort: "a:8095"},
+			"b": {UUID: "b", HostPort: "b:8095"},
+			"c": {UUID: "c", HostPort: "c:8095"},
+		},
+	}
+
+	planPIndexes := &cbgt.PlanPIndexes{
+		PlanPIndexes: map[string]*cbgt.PlanPIndex{
+			"p0": {
+				Name: "p0", IndexName: "idx", IndexUUID: "u0",
+				Nodes: map[string]*cbgt.PlanPIndexNode{
+					"a": {CanRead: true, CanWrite: true, Priority: 0},
+					"b": {CanRead: true, CanWrite: true, Priority: 1},
+				},
+			},
+			"p1": {
+				Name: "p1", IndexName: "idx", IndexUUID: "u0",
+				Nodes: map[string]*cbgt.PlanPIndexNode{
+					"b": {CanRead: true, CanWrite: true, Priority: 1},
+					"c": {CanRead: true, CanWrite: true, Priority: 0},
+				},
+			},
+			"stale": {
+				Name: "stale", IndexName: "idx", IndexUUID: "old",
+				Nodes: map[string]*cbgt.PlanPIndexNode{
+					"a": {CanRead: true, CanWrite: true, Priority: 0},
+				},
+			},
+		},
+	}
+
+	health := map[string]string{
+		"a": CLIENT_TOPOLOGY_HEALTH_OK,
+		"b": CLIENT_TOPOLOGY_HEALTH_OK,
+		"c": CLIENT_TOPOLOGY_HEALTH_UNREACHABLE,
+	}
+	healthFunc := func(nodeDef *cbgt.NodeDef) string {
+		return health[nodeDef.UUID]
+	}
+
+	ct, err := CalcClientTopology(indexDefs, nodeDefs, nodeDefs,
+		planPIndexes, healthFunc)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if ct.Hash == "" {
+		t.Errorf("expected a hash")
+	}
+
+	if len(ct.Indexes["empty"].Nodes) != 0 {
+		t.Errorf("expected no nodes for empty, got: %#v",
+			ct.Indexes["empty"])
+	}
+
+	cti := ct.Indexes["idx"]
+	if cti == nil || len(cti.Nodes) != 3 || !cti.Complete {
+		t.Fatalf("expected 3 nodes and complete, got: %#v", cti)
+	}
+	// Healthy first, then active, then by number of pindexes.
+	if cti.Nodes[0].URL != "http://a:8095" ||
+		cti.Nodes[0].Role != CLIENT_TOPOLOGY_ROLE_ACTIVE ||
+		cti.Nodes[0].NumPIndexes != 1 {
+		t.Errorf("expected a first, got: %#v", cti.Nodes[0])
+	}
+	if cti.Nodes[1].URL != "http://b:8095" ||
+		cti.Nodes[1].Role != CLIENT_TOPOLOGY_ROLE_REPLICA ||
+		cti.Nodes[1].NumPIndexes != 2 {
+		t.Errorf("expected b second, got: %#v", cti.Nodes[1])
+	}
+	if cti.Nodes[2].URL != "http://c:8095" ||
+		cti.Nodes[2].Health != CLIENT_TOPOLOGY_HEALTH_UNREACHABLE {
+		t.Errorf("expected c last, got: %#v", cti.Nodes[2])
+	}
+
+	ct2, _ := CalcClientTopology(indexDefs, nodeDefs, nodeDefs,
+		planPIndexes, healthFunc)
+	if ct2.Hash != ct.Hash {
+		t.Errorf("expected a stable hash")
+	}
+
+	health["b"] = CLIENT_TOPOLOGY_HEALTH_UNREACHABLE
+
+	ct3, _ := CalcClientTopology(indexDefs, nodeDefs, nodeDefs,
+		planPIndexes, healthFunc)
+	if ct3.Hash == ct.Hash {
+		t.Errorf("expected the hash to change with health")
+	}
+	if ct3.Indexes["idx"].Complete {
+		t.Errorf("expected p1 to be uncovered")
+	}
+
+	// Nodes that aren't known have an unknown health.
+	ct4, _ := CalcClientTopology(indexDefs, &cbgt.NodeDefs{}, nodeDefs,
+		planPIndexes, healthFunc)
+	for _, n := range ct4.Indexes["idx"].Nodes {
+		if n.Health != CLIENT_TOPOLOGY_HEALTH_UNKNOWN {
+			t.Errorf("expected unknown health, got: %#v", n)
+		}
+	}
+}
+
+func TestClientTopologyProbeNodeWithAuth(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	a := &RESTAuth{
+		Authenticators: []Authenticator{
+			func(req *http.Request) (*AuthIdentity, error) {
+				return nil, nil // No credentials.
+			},
+		},
+		Challenges: []string{`Test realm="cbft"`},
+		Cfg:        cbgt.NewCfgMem(),
+	}
+
+	authed := httptest.NewServer(a.Handler(next))
+	defer authed.Close()
+
+	rejecting := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unauthorized", 401)
+		}))
+	defer rejecting.Close()
+
+	down := httptest.NewServer(next)
+	downHostPort := strings.TrimPrefix(down.URL, "http://")
+	down.Close()
+
+	for hostPort, exp := range map[string]string{
+		strings.TrimPrefix(authed.URL, "http://"):    CLIENT_TOPOLOGY_HEALTH_OK,
+		strings.TrimPrefix(rejecting.URL, "http://"): CLIENT_TOPOLOGY_HEALTH_OK,
+		downHostPort: CLIENT_TOPOLOGY_HEALTH_UNREACHABLE,
+	} {
+		clientTopologyProbesM.Lock()
+		delete(clientTopologyProbes, hostPort)
+		clientTopologyProbesM.Unlock()
+
+		health := ClientTopologyProbeNode(hostPort)
+		if health != exp {
+			t.Errorf("hostPort: %s, expected: %s, got: %s",
+				hostPort, exp, health)
+		}
+	}
+}
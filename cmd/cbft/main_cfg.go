@@ -0,0 +1,40 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/couchbaselabs/cbft"
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/cmd"
+)
+
+// MainCfg connects to the Cfg provider of a cfgConnect string,
+// handling the Cfg providers that are implemented by cbft, and
+// otherwise delegating to cmd.MainCfg.
+func MainCfg(cmdName, cfgConnect, bindHttp,
+	register, dataDir string) (cbgt.Cfg, error) {
+	if strings.HasPrefix(cfgConnect, "etcd:") {
+		return cbft.NewCfgEtcd(cfgConnect[len("etcd:"):])
+	}
+
+	if strings.HasPrefix(cfgConnect, "consul:") {
+		return cbft.NewCfgConsul(cfgConnect[len("consul:"):])
+	}
+
+	if strings.HasPrefix(cfgConnect, "zk:") {
+		return cbft.NewCfgZK(cfgConnect[len("zk:"):])
+	}
+
+	return cmd.MainCfg(cmdName, cfgConnect, bindHttp, register, dataDir)
+}
@@ -0,0 +1,240 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Every flag can also be set by an environment variable, named
+// CBFT_ and the upper-cased main flag name (like CBFT_BINDHTTP or
+// CBFT_DATADIR), or by a config file (the -config flag or the
+// CBFT_CONFIG environment variable), whose keys are the flag names or
+// their aliases, case-insensitively, for container deployments where
+// passing command-line flags is awkward.
+// The precedence, from the highest, is the command-line, then the
+// environment variables, then the config file, then the defaults.
+//
+// A config file is JSON, or a flat YAML subset of "key: value" lines,
+// where the options can also be a nested map of the node options...
+//
+//   bindHttp: 10.0.0.10:8095
+//   dataDir: /var/lib/cbft
+//   options:
+//     pindexLoadWorkers: 4
+//     warmup: true
+
+// The prefix of the environment variables of the flags.
+const CONFIG_ENV_PREFIX = "CBFT_"
+
+// MainConfig sets the flags that weren't set on the command-line from
+// the environment variables and the config file.
+func MainConfig(fs *flag.FlagSet, flagAliases map[string][]string,
+	getenv func(string) string) error {
+	setOnCmdLine := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		for name, aliases := range flagAliases {
+			for _, alias := range aliases {
+				if alias == f.Name {
+					setOnCmdLine[name] = true
+				}
+			}
+		}
+	})
+
+	configPath := getenv(CONFIG_ENV_PREFIX + "CONFIG")
+	if setOnCmdLine["config"] {
+		configPath = fs.Lookup("config").Value.String()
+	}
+
+	configVals := map[string]string{}
+	if configPath != "" {
+		var err error
+		configVals, err = ParseConfigFile(configPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(flagAliases))
+	for name := range flagAliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	used := map[string]bool{}
+
+	for _, name := range names {
+		if name == "config" || name == "help" || name == "version" ||
+			setOnCmdLine[name] {
+			for _, alias := range flagAliases[name] {
+				used[strings.ToLower(alias)] = true
+			}
+			continue
+		}
+
+		source, val, found := "", "", false
+
+		envName := CONFIG_ENV_PREFIX + strings.ToUpper(name)
+		if v := getenv(envName); v != "" {
+			source, val, found = envName, v, true
+		}
+
+		for _, alias := range flagAliases[name] {
+			key := strings.ToLower(alias)
+			used[key] = true
+			if v, exists := configVals[key]; exists && !found {
+				source, val, found = configPath+": "+alias, v, true
+			}
+		}
+
+		if found {
+			err := fs.Set(name, val)
+			if err != nil {
+				return fmt.Errorf("config: %s, flag: %s, err: %v",
+					source, name, err)
+			}
+		}
+	}
+
+	for key := range configVals {
+		if !used[key] {
+			return fmt.Errorf("config: %s, unknown flag: %s",
+				configPath, key)
+		}
+	}
+
+	return nil
+}
+
+// ParseConfigFile returns the flag values of a config file, keyed by
+// the lower-cased flag names.
+func ParseConfigFile(path string) (map[string]string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: could not read config file,"+
+			" err: %v", err)
+	}
+
+	var m map[string]interface{}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		m, err = parseConfigYAML(buf)
+	} else {
+		err = json.Unmarshal(buf, &m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config: could not parse config file: %s,"+
+			" err: %v", path, err)
+	}
+
+	rv := map[string]string{}
+	for key, v := range m {
+		rv[strings.ToLower(key)] = configValString(v)
+	}
+
+	return rv, nil
+}
+
+// configValString returns the flag value of a config value, where a
+// map is joined as "k=v,..." node options and a list is joined as a
+// comma-separated list, like the tags.
+func configValString(v interface{}) string {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		kvs := make([]string, len(keys))
+		for i, k := range keys {
+			kvs[i] = k + "=" + configValString(x[k])
+		}
+		return strings.Join(kvs, ",")
+
+	case []interface{}:
+		vals := make([]string, len(x))
+		for i, item := range x {
+			vals[i] = configValString(item)
+		}
+		return strings.Join(vals, ",")
+
+	case nil:
+		return ""
+
+	case float64:
+		return strings.TrimSuffix(fmt.Sprintf("%f", x), ".000000")
+	}
+
+	return fmt.Sprintf("%v", v)
+}
+
+// parseConfigYAML parses the flat YAML subset of config files, of
+// "key: value" lines and of maps of indented "key: value" lines.
+func parseConfigYAML(buf []byte) (map[string]interface{}, error) {
+	rv := map[string]interface{}{}
+
+	var nested map[string]interface{}
+
+	for i, line := range strings.Split(string(buf), "\n") {
+		if j := strings.Index(line, " #"); j >= 0 {
+			line = line[:j]
+		}
+		line = strings.TrimRight(line, " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") ||
+			trimmed == "---" {
+			continue
+		}
+
+		kv := strings.SplitN(trimmed, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("line: %d, not key: value", i+1)
+		}
+		key := strings.TrimSpace(kv[0])
+		val := configYAMLUnquote(strings.TrimSpace(kv[1]))
+
+		if trimmed != line { // Indented.
+			if nested == nil {
+				return nil, fmt.Errorf("line: %d, unexpected indent", i+1)
+			}
+			nested[key] = val
+			continue
+		}
+
+		nested = nil
+		if val == "" {
+			nested = map[string]interface{}{}
+			rv[key] = nested
+			continue
+		}
+
+		rv[key] = val
+	}
+
+	return rv, nil
+}
+
+func configYAMLUnquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,175 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testConfigFlags struct {
+	BindHttp string
+	Config   string
+	DataDir  string
+	Options  string
+	Weight   int
+}
+
+func testConfigFlagSet(f *testConfigFlags) (
+	*flag.FlagSet, map[string][]string) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.StringVar(&f.BindHttp, "bindHttp", "0.0.0.0:8095", "")
+	fs.StringVar(&f.BindHttp, "b", "0.0.0.0:8095", "")
+	fs.StringVar(&f.Config, "config", "", "")
+	fs.StringVar(&f.DataDir, "dataDir", "data", "")
+	fs.StringVar(&f.DataDir, "data", "data", "")
+	fs.StringVar(&f.Options, "options", "", "")
+	fs.IntVar(&f.Weight, "weight", 1, "")
+	return fs, map[string][]string{
+		"bindHttp": {"bindHttp", "b"},
+		"config":   {"config"},
+		"dataDir":  {"dataDir", "data"},
+		"options":  {"options"},
+		"weight":   {"weight"},
+	}
+}
+
+func testConfigGetenv(env map[string]string) func(string) string {
+	return func(k string) string { return env[k] }
+}
+
+func TestMainConfigPrecedence(t *testing.T) {
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cbft.json")
+	ioutil.WriteFile(path, []byte(`{
+		"bindHttp": "10.0.0.1:9000",
+		"DATA": "/file/data",
+		"weight": 3,
+		"options": {"b": 2, "a": "x"}
+	}`), 0600)
+
+	var f testConfigFlags
+	fs, aliases := testConfigFlagSet(&f)
+	fs.Parse([]string{"-b", "127.0.0.1:8095", "-config", path})
+
+	err := MainConfig(fs, aliases, testConfigGetenv(map[string]string{
+		"CBFT_DATADIR": "/env/data",
+	}))
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if f.BindHttp != "127.0.0.1:8095" {
+		t.Errorf("expected cmd-line bindHttp, got: %s", f.BindHttp)
+	}
+	if f.DataDir != "/env/data" {
+		t.Errorf("expected env dataDir, got: %s", f.DataDir)
+	}
+	if f.Weight != 3 {
+		t.Errorf("expected config file weight, got: %d", f.Weight)
+	}
+	if f.Options != "a=x,b=2" {
+		t.Errorf("expected config file options, got: %s", f.Options)
+	}
+}
+
+func TestMainConfigEnv(t *testing.T) {
+	var f testConfigFlags
+	fs, aliases := testConfigFlagSet(&f)
+	fs.Parse(nil)
+
+	err := MainConfig(fs, aliases, testConfigGetenv(map[string]string{
+		"CBFT_BINDHTTP": ":9999",
+		"CBFT_B":        ":1111", // Not the main flag name.
+	}))
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if f.BindHttp != ":9999" || f.DataDir != "data" || f.Weight != 1 {
+		t.Errorf("unexpected flags: %+v", f)
+	}
+
+	err = MainConfig(fs, aliases, testConfigGetenv(map[string]string{
+		"CBFT_WEIGHT": "not-a-number",
+	}))
+	if err == nil {
+		t.Errorf("expected err on a bad env var")
+	}
+
+	err = MainConfig(fs, aliases, testConfigGetenv(map[string]string{
+		"CBFT_CONFIG": "./not-a-config-file.json",
+	}))
+	if err == nil {
+		t.Errorf("expected err on a missing config file")
+	}
+}
+
+func TestMainConfigYAML(t *testing.T) {
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cbft.yaml")
+	ioutil.WriteFile(path, []byte(`---
+# A comment.
+bindHttp: "10.0.0.1:9000" # A trailing comment.
+dataDir: /yaml/data
+options:
+  warmup: true
+  pindexLoadWorkers: '4'
+`), 0600)
+
+	var f testConfigFlags
+	fs, aliases := testConfigFlagSet(&f)
+	fs.Parse(nil)
+
+	err := MainConfig(fs, aliases, testConfigGetenv(map[string]string{
+		"CBFT_CONFIG": path,
+	}))
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if f.BindHttp != "10.0.0.1:9000" || f.DataDir != "/yaml/data" ||
+		f.Options != "pindexLoadWorkers=4,warmup=true" {
+		t.Errorf("unexpected flags: %+v", f)
+	}
+}
+
+func TestMainConfigBadFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	tests := map[string]string{
+		"unknown.json": `{"notAFlag": 1}`,
+		"bad.json":     `{"bindHttp":`,
+		"bad.yaml":     "bindHttp\n",
+		"indent.yml":   "  bindHttp: :9000\n",
+	}
+
+	for name, content := range tests {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(content), 0600)
+
+		var f testConfigFlags
+		fs, aliases := testConfigFlagSet(&f)
+		fs.Parse([]string{"-config", path})
+
+		err := MainConfig(fs, aliases, testConfigGetenv(nil))
+		if err == nil {
+			t.Errorf("expected err on config file: %s", name)
+		}
+	}
+}
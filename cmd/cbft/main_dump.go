@@ -0,0 +1,91 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/couchbaselabs/cbft"
+)
+
+// MainDump implements the "dump" mode of the command-line, which
+// prints the pindexes of a data directory (or a single pindex
+// directory) for offline inspection, and returns the exit code.
+func MainDump(w io.Writer, args []string) int {
+	base := path.Base(os.Args[0])
+
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+
+	var opts cbft.DumpOptions
+	var termsFields string
+	var encryptionKeyFile string
+
+	fs.BoolVar(&opts.Terms, "terms", false,
+		"dump the term dictionaries of the fields.")
+	fs.IntVar(&opts.TermsLimit, "termsLimit", 100,
+		"max number of terms dumped per field; 0 means no limit.")
+	fs.StringVar(&termsFields, "termsFields", "",
+		"optional comma-separated fields whose term dictionaries"+
+			"\nare dumped; default is all fields.")
+	fs.StringVar(&encryptionKeyFile, "encryptionKeyFile", "",
+		"optional path of the encryption key file of the node,"+
+			"\nfor dumping encrypted pindexes.")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s dump: offline inspection of pindexes\n",
+			base)
+		fmt.Fprintf(os.Stderr, "\nUsage: %s dump [flags] DIR...\n", base)
+		fmt.Fprintf(os.Stderr, "\nWhere DIR is a dataDir or a pindex"+
+			" directory, which must not be in use by a running node.\n")
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
+		fs.VisitAll(func(f *flag.Flag) {
+			fmt.Fprintf(os.Stderr, "  -%s\n      %s\n", f.Name,
+				strings.Replace(f.Usage, "\n", "\n      ", -1))
+		})
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if fs.NArg() <= 0 {
+		fs.Usage()
+		return 2
+	}
+
+	err = cbft.EncryptionStart(map[string]string{
+		"encryptionKeyFile": encryptionKeyFile,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s dump: %v\n", base, err)
+		return 1
+	}
+
+	if termsFields != "" {
+		opts.TermsFields = strings.Split(termsFields, ",")
+	}
+
+	for _, dir := range fs.Args() {
+		err = cbft.DumpPIndexes(w, dir, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s dump: %v\n", base, err)
+			return 1
+		}
+	}
+
+	return 0
+}
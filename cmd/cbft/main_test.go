@@ -12,6 +12,7 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
 	"testing"
 
@@ -39,3 +40,12 @@ func TestMainStart(t *testing.T) {
 func TestMainWelcome(t *testing.T) {
 	MainWelcome(flagAliases) // Don't crash.
 }
+
+func TestMainDump(t *testing.T) {
+	if MainDump(ioutil.Discard, nil) != 2 {
+		t.Errorf("expected usage exit code without a dir")
+	}
+	if MainDump(ioutil.Discard, []string{"./not-a-data-dir"}) != 1 {
+		t.Errorf("expected err exit code on a missing dir")
+	}
+}
@@ -0,0 +1,666 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// cbft_cli is an administrative command-line tool that talks to the
+// REST API of a cbft node, for index management, querying, stats and
+// cfg inspection, with table or JSON output.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type Flags struct {
+	DryRun  bool
+	Help    bool
+	JSON    bool
+	Server  string
+	Timeout time.Duration
+}
+
+var flags Flags
+
+type command struct {
+	usage string
+	about string
+	nargs int // The min number of args.
+	run   func(c *client, args []string) error
+}
+
+var commands = map[string]*command{
+	"index-list": {"", "list the index definitions", 0,
+		runIndexList},
+	"index-get": {"INDEX_NAME", "show an index definition", 1,
+		runIndexGet},
+	"index-create": {"INDEX_NAME DEF_FILE",
+		"create an index from an index definition JSON file,\n" +
+			"such as from '-json index-get', where '-' is stdin", 2,
+		runIndexCreate},
+	"index-update": {"INDEX_NAME DEF_FILE",
+		"update an index from an index definition JSON file", 2,
+		runIndexUpdate},
+	"index-delete": {"INDEX_NAME", "delete an index", 1,
+		runIndexDelete},
+	"index-export": {"", "export all index definitions as a JSON bundle", 0,
+		runIndexExport},
+	"index-import": {"BUNDLE_FILE [fail|skip|overwrite]",
+		"import a bundle of index definitions, where existing\n" +
+			"index definitions that differ are a conflict (the\n" +
+			"default), skipped or overwritten; see -dryRun", 1,
+		runIndexImport},
+	"count": {"INDEX_NAME", "show the document count of an index", 1,
+		runCount},
+	"query": {"INDEX_NAME QUERY",
+		"query an index with a query string, or with a\n" +
+			"search request JSON file when QUERY is @FILE", 2,
+		runQuery},
+	"stats": {"[INDEX_NAME]", "show the stats of the node or of an index", 0,
+		runStats},
+	"cfg": {"", "show the cluster cfg", 0,
+		runCfg},
+	"cfg-snapshot": {"", "snapshot the cluster cfg as JSON, for disaster recovery", 0,
+		runCfgSnapshot},
+	"cfg-restore": {"SNAPSHOT_FILE [force]",
+		"restore a cfg snapshot, where force overwrites a cfg\n" +
+			"that already has index definitions", 1,
+		runCfgRestore},
+}
+
+func main() {
+	flag.BoolVar(&flags.DryRun, "dryRun", false,
+		"for index-import, show the actions without applying them.")
+	flag.BoolVar(&flags.Help, "help", false,
+		"print this usage message and exit.")
+	flag.BoolVar(&flags.JSON, "json", false,
+		"output JSON instead of tables.")
+	flag.StringVar(&flags.Server, "server", "http://localhost:8095",
+		"URL of a cbft node's REST API.")
+	flag.DurationVar(&flags.Timeout, "timeout", 60*time.Second,
+		"timeout of REST API requests.")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if flags.Help || len(args) <= 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd := commands[args[0]]
+	if cmd == nil || len(args)-1 < cmd.nargs {
+		usage()
+		os.Exit(2)
+	}
+
+	c := &client{
+		server: strings.TrimSuffix(flags.Server, "/"),
+		http:   &http.Client{Timeout: flags.Timeout},
+		out:    os.Stdout,
+		json:   flags.JSON,
+		dryRun: flags.DryRun,
+	}
+
+	err := cmd.run(c, args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s, err: %v\n",
+			path.Base(os.Args[0]), args[0], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	base := path.Base(os.Args[0])
+
+	fmt.Fprintf(os.Stderr, "%s: couchbase full-text admin tool\n", base)
+	fmt.Fprintf(os.Stderr, "\nUsage: %s [flags] COMMAND [args]\n", base)
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, cmd.usage)
+		fmt.Fprintf(os.Stderr, "      %s\n",
+			strings.Replace(cmd.about, "\n", "\n      ", -1))
+	}
+
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(os.Stderr, "  -%s\n      %s\n", f.Name, f.Usage)
+	})
+}
+
+// ---------------------------------------------------------
+
+type client struct {
+	server string
+	http   *http.Client
+	out    io.Writer
+	json   bool
+	dryRun bool
+}
+
+// do sends a REST request and returns the response body, which is
+// an error on a non-200 response.
+func (c *client) do(method, urlPath string, form url.Values,
+	body []byte, contentType string) ([]byte, error) {
+	u := c.server + urlPath
+	if len(form) > 0 {
+		u = u + "?" + form.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s %s, status: %d, body: %s",
+			method, urlPath, resp.StatusCode,
+			strings.TrimSpace(string(respBody)))
+	}
+
+	return respBody, nil
+}
+
+func (c *client) getJSON(urlPath string, v interface{}) ([]byte, error) {
+	body, err := c.do("GET", urlPath, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return body, json.Unmarshal(body, v)
+}
+
+// outputJSON writes a response body as indented JSON.
+func (c *client) outputJSON(body []byte) error {
+	var buf bytes.Buffer
+	err := json.Indent(&buf, body, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf.WriteString("\n")
+	_, err = buf.WriteTo(c.out)
+	return err
+}
+
+// outputTable writes rows as aligned columns.
+func (c *client) outputTable(header []string, rows [][]string) error {
+	tw := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// ---------------------------------------------------------
+
+type indexDef struct {
+	Type         string          `json:"type"`
+	Name         string          `json:"name"`
+	UUID         string          `json:"uuid"`
+	Params       json.RawMessage `json:"params"`
+	SourceType   string          `json:"sourceType"`
+	SourceName   string          `json:"sourceName"`
+	SourceUUID   string          `json:"sourceUUID"`
+	SourceParams json.RawMessage `json:"sourceParams"`
+	PlanParams   json.RawMessage `json:"planParams"`
+}
+
+type indexDefsResponse struct {
+	IndexDefs struct {
+		IndexDefs map[string]*indexDef `json:"indexDefs"`
+	} `json:"indexDefs"`
+}
+
+func runIndexList(c *client, args []string) error {
+	var r indexDefsResponse
+	body, err := c.getJSON("/api/index", &r)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.outputJSON(body)
+	}
+
+	names := make([]string, 0, len(r.IndexDefs.IndexDefs))
+	for name := range r.IndexDefs.IndexDefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rows := make([][]string, 0, len(names))
+	for _, name := range names {
+		d := r.IndexDefs.IndexDefs[name]
+		rows = append(rows, []string{
+			d.Name, d.Type, d.SourceType, d.SourceName, d.UUID,
+		})
+	}
+
+	return c.outputTable([]string{
+		"NAME", "TYPE", "SOURCE_TYPE", "SOURCE_NAME", "UUID",
+	}, rows)
+}
+
+func (c *client) getIndexDef(indexName string) (*indexDef, []byte, error) {
+	var r struct {
+		IndexDef *indexDef `json:"indexDef"`
+	}
+	body, err := c.getJSON("/api/index/"+url.QueryEscape(indexName), &r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.IndexDef == nil {
+		return nil, nil, fmt.Errorf("no indexDef, indexName: %s", indexName)
+	}
+	return r.IndexDef, body, nil
+}
+
+func runIndexGet(c *client, args []string) error {
+	d, body, err := c.getIndexDef(args[0])
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.outputJSON(body)
+	}
+
+	return c.outputTable([]string{"PROPERTY", "VALUE"}, [][]string{
+		{"name", d.Name},
+		{"uuid", d.UUID},
+		{"type", d.Type},
+		{"params", rawString(d.Params)},
+		{"sourceType", d.SourceType},
+		{"sourceName", d.SourceName},
+		{"sourceUUID", d.SourceUUID},
+		{"sourceParams", rawString(d.SourceParams)},
+		{"planParams", rawString(d.PlanParams)},
+	})
+}
+
+func runIndexCreate(c *client, args []string) error {
+	return c.putIndex(args[0], args[1], "")
+}
+
+func runIndexUpdate(c *client, args []string) error {
+	prev, _, err := c.getIndexDef(args[0])
+	if err != nil {
+		return err
+	}
+	return c.putIndex(args[0], args[1], prev.UUID)
+}
+
+// putIndex creates or updates an index from an index definition file,
+// which may be either a bare index definition or the response of a
+// GET of an index definition.
+func (c *client) putIndex(indexName, defFile, prevIndexUUID string) error {
+	buf, err := readFile(defFile)
+	if err != nil {
+		return err
+	}
+
+	var r struct {
+		IndexDef *indexDef `json:"indexDef"`
+	}
+	err = json.Unmarshal(buf, &r)
+	if err != nil {
+		return err
+	}
+	d := r.IndexDef
+	if d == nil {
+		d = &indexDef{}
+		err = json.Unmarshal(buf, d)
+		if err != nil {
+			return err
+		}
+	}
+
+	form, err := indexDefForm(d)
+	if err != nil {
+		return err
+	}
+	if prevIndexUUID != "" {
+		form.Set("prevIndexUUID", prevIndexUUID)
+	}
+
+	body, err := c.do("PUT", "/api/index/"+url.QueryEscape(indexName),
+		nil, []byte(form.Encode()), "application/x-www-form-urlencoded")
+	if err != nil {
+		return err
+	}
+	return c.outputStatus(body)
+}
+
+// indexDefForm converts an index definition into the form parameters
+// of the index creation REST API.
+func indexDefForm(d *indexDef) (url.Values, error) {
+	if d.Type == "" || d.SourceType == "" {
+		return nil, fmt.Errorf("index definition needs a type and sourceType")
+	}
+
+	form := url.Values{}
+	form.Set("indexType", d.Type)
+	form.Set("sourceType", d.SourceType)
+
+	set := func(k, v string) {
+		if v != "" {
+			form.Set(k, v)
+		}
+	}
+	set("indexParams", rawString(d.Params))
+	set("sourceName", d.SourceName)
+	set("sourceUUID", d.SourceUUID)
+	set("sourceParams", rawString(d.SourceParams))
+	set("planParams", rawString(d.PlanParams))
+
+	return form, nil
+}
+
+func runIndexExport(c *client, args []string) error {
+	body, err := c.do("GET", "/api/indexDefsExport", nil, nil, "")
+	if err != nil {
+		return err
+	}
+	return c.outputJSON(body) // A bundle is always JSON.
+}
+
+func runIndexImport(c *client, args []string) error {
+	buf, err := readFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{}
+	if len(args) > 1 {
+		form.Set("conflict", args[1])
+	}
+	if c.dryRun {
+		form.Set("dryRun", "true")
+	}
+
+	body, err := c.do("POST", "/api/indexDefsImport", form, buf,
+		"application/json")
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.outputJSON(body)
+	}
+
+	var r struct {
+		Results []struct {
+			Name   string `json:"name"`
+			Action string `json:"action"`
+			Error  string `json:"error"`
+		} `json:"results"`
+	}
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(r.Results))
+	for _, result := range r.Results {
+		rows = append(rows, []string{result.Name, result.Action, result.Error})
+	}
+
+	return c.outputTable([]string{"NAME", "ACTION", "ERROR"}, rows)
+}
+
+func runIndexDelete(c *client, args []string) error {
+	body, err := c.do("DELETE", "/api/index/"+url.QueryEscape(args[0]),
+		nil, nil, "")
+	if err != nil {
+		return err
+	}
+	return c.outputStatus(body)
+}
+
+func (c *client) outputStatus(body []byte) error {
+	if c.json {
+		return c.outputJSON(body)
+	}
+	var r struct {
+		Status string `json:"status"`
+	}
+	err := json.Unmarshal(body, &r)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(c.out, r.Status)
+	return err
+}
+
+func runCount(c *client, args []string) error {
+	var r struct {
+		Count uint64 `json:"count"`
+	}
+	body, err := c.getJSON("/api/index/"+url.QueryEscape(args[0])+"/count", &r)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.outputJSON(body)
+	}
+	_, err = fmt.Fprintln(c.out, r.Count)
+	return err
+}
+
+func runQuery(c *client, args []string) error {
+	var req []byte
+	if strings.HasPrefix(args[1], "@") {
+		buf, err := readFile(args[1][1:])
+		if err != nil {
+			return err
+		}
+		req = buf
+	} else {
+		buf, err := json.Marshal(map[string]interface{}{
+			"query": map[string]interface{}{
+				"query": strings.Join(args[1:], " "),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		req = buf
+	}
+
+	body, err := c.do("POST", "/api/index/"+url.QueryEscape(args[0])+"/query",
+		nil, req, "application/json")
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.outputJSON(body)
+	}
+
+	var r struct {
+		TotalHits uint64 `json:"total_hits"`
+		Took      int64  `json:"took"`
+		Hits      []struct {
+			ID    string  `json:"id"`
+			Score float64 `json:"score"`
+			Index string  `json:"index"`
+		} `json:"hits"`
+	}
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(r.Hits))
+	for _, hit := range r.Hits {
+		rows = append(rows, []string{
+			hit.ID, strconv.FormatFloat(hit.Score, 'f', 6, 64), hit.Index,
+		})
+	}
+
+	err = c.outputTable([]string{"ID", "SCORE", "PINDEX"}, rows)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(c.out, "\ntotal_hits: %d, took: %s\n",
+		r.TotalHits, time.Duration(r.Took))
+	return err
+}
+
+func runStats(c *client, args []string) error {
+	urlPath := "/api/stats"
+	if len(args) > 0 {
+		urlPath = "/api/stats/index/" + url.QueryEscape(args[0])
+	}
+	return c.outputFlattened(urlPath, "STAT")
+}
+
+func runCfg(c *client, args []string) error {
+	return c.outputFlattened("/api/cfg", "KEY")
+}
+
+func runCfgSnapshot(c *client, args []string) error {
+	body, err := c.do("GET", "/api/cfgSnapshot", nil, nil, "")
+	if err != nil {
+		return err
+	}
+	return c.outputJSON(body) // A snapshot is always JSON.
+}
+
+func runCfgRestore(c *client, args []string) error {
+	buf, err := readFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{}
+	if len(args) > 1 && args[1] == "force" {
+		form.Set("force", "true")
+	}
+
+	body, err := c.do("POST", "/api/cfgRestore", form, buf,
+		"application/json")
+	if err != nil {
+		return err
+	}
+	return c.outputStatus(body)
+}
+
+// outputFlattened outputs a JSON response either as JSON or as a
+// table of its flattened leaf values.
+func (c *client) outputFlattened(urlPath, keyHeader string) error {
+	var v interface{}
+	body, err := c.getJSON(urlPath, &v)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.outputJSON(body)
+	}
+
+	m := map[string]string{}
+	flatten("", v, m)
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	rows := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		rows = append(rows, []string{k, m[k]})
+	}
+
+	return c.outputTable([]string{keyHeader, "VALUE"}, rows)
+}
+
+// ---------------------------------------------------------
+
+// flatten collects the leaf values of a parsed JSON value into m,
+// keyed by dotted paths.
+func flatten(prefix string, v interface{}, m map[string]string) {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, xv := range x {
+			flatten(join(k), xv, m)
+		}
+	case []interface{}:
+		for i, xv := range x {
+			flatten(join(strconv.Itoa(i)), xv, m)
+		}
+	case string:
+		m[prefix] = x
+	case nil:
+		m[prefix] = "null"
+	default:
+		buf, _ := json.Marshal(x)
+		m[prefix] = string(buf)
+	}
+}
+
+// rawString returns a JSON value that's either a JSON string or some
+// other JSON value as a string.
+func rawString(raw json.RawMessage) string {
+	if len(raw) <= 0 || string(raw) == "null" {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return string(raw)
+}
+
+func readFile(name string) ([]byte, error) {
+	if name == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(name)
+}
@@ -0,0 +1,128 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFlatten(t *testing.T) {
+	var v interface{}
+	json.Unmarshal([]byte(`{"a":{"b":1,"c":[true,"x"]},"d":null}`), &v)
+
+	m := map[string]string{}
+	flatten("", v, m)
+
+	expected := map[string]string{
+		"a.b":   "1",
+		"a.c.0": "true",
+		"a.c.1": "x",
+		"d":     "null",
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected: %#v, got: %#v", expected, m)
+	}
+}
+
+func TestIndexDefForm(t *testing.T) {
+	d := &indexDef{}
+	json.Unmarshal([]byte(`{"type":"bleve","sourceType":"couchbase",
+		"sourceName":"beer-sample","params":"{\"x\":1}",
+		"planParams":{"maxPartitionsPerPIndex":32}}`), d)
+
+	form, err := indexDefForm(d)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if form.Get("indexType") != "bleve" ||
+		form.Get("sourceName") != "beer-sample" ||
+		form.Get("indexParams") != `{"x":1}` ||
+		form.Get("planParams") != `{"maxPartitionsPerPIndex":32}` ||
+		form.Get("sourceParams") != "" {
+		t.Errorf("unexpected form: %#v", form)
+	}
+
+	_, err = indexDefForm(&indexDef{Type: "bleve"})
+	if err == nil {
+		t.Errorf("expected err on missing sourceType")
+	}
+}
+
+func TestIndexListAndCreate(t *testing.T) {
+	var putForm string
+
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			switch req.Method + " " + req.URL.Path {
+			case "GET /api/index":
+				w.Write([]byte(`{"status":"ok","indexDefs":{"indexDefs":{
+                    "b":{"name":"b","type":"bleve","uuid":"u1",
+                         "sourceType":"nil"},
+                    "a":{"name":"a","type":"alias","uuid":"u0",
+                         "sourceType":"nil"}}}}`))
+			case "PUT /api/index/c":
+				req.ParseForm()
+				putForm = req.Form.Encode()
+				w.Write([]byte(`{"status":"ok"}`))
+			default:
+				http.Error(w, "not found", 404)
+			}
+		}))
+	defer s.Close()
+
+	var out bytes.Buffer
+	c := &client{server: s.URL, http: http.DefaultClient, out: &out}
+
+	err := runIndexList(c, nil)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 ||
+		!strings.HasPrefix(lines[1], "a ") ||
+		!strings.HasPrefix(lines[2], "b ") {
+		t.Errorf("expected sorted table, got: %q", out.String())
+	}
+
+	err = runIndexGet(c, []string{"missing"})
+	if err == nil {
+		t.Errorf("expected err on a 404")
+	}
+
+	err = c.putIndex("c", "testdata-missing.json", "")
+	if err == nil {
+		t.Errorf("expected err on a missing file")
+	}
+
+	f, _ := ioutil.TempFile("", "cbft_cli")
+	defer os.Remove(f.Name())
+	f.Write([]byte(`{"status":"ok","indexDef":{"name":"b",
+		"type":"bleve","sourceType":"nil","uuid":"u1"}}`))
+	f.Close()
+
+	out.Reset()
+	err = c.putIndex("c", f.Name(), "u1")
+	if err != nil || out.String() != "ok\n" {
+		t.Errorf("expected ok, got: %q, err: %v", out.String(), err)
+	}
+	if putForm != "indexType=bleve&prevIndexUUID=u1&sourceType=nil" {
+		t.Errorf("unexpected put form: %s", putForm)
+	}
+}
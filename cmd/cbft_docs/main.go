@@ -66,11 +66,21 @@ func sampleRequest(router *mux.Router,
 var skipSampleResponses = map[string]bool{
 	"/api/managerMeta":      true,
 	"/api/diag":             true,
+	"/api/diag/bundle":      true,
 	"/api/runtime/args":     true,
 	"/api/runtime/stats":    true,
 	"/api/runtime/statsMem": true,
 }
 
+const apiVersioningDoc = "Every documented `/api/...` route is also available as a\n" +
+	"versioned `/api/v1/...` route, such as `/api/v1/index`.  The\n" +
+	"compatibility guarantee of the `/api/v1/...` routes is that their\n" +
+	"request parameters and response fields will not be removed or\n" +
+	"change meaning, although new optional parameters and new response\n" +
+	"fields may be added.  Responses from versioned routes carry an\n" +
+	"`X-Cbft-Api-Version` header.\n" +
+	"\n"
+
 // Emits markdown docs of cbft's REST API.
 func main() {
 	rand.Seed(0)
@@ -153,6 +163,7 @@ func main() {
 	sort.Strings(paths)
 
 	fmt.Printf("# API Reference\n\n")
+	fmt.Print(apiVersioningDoc)
 
 	for _, mainCategory := range mainCategories {
 		mainCategoryFirst := true
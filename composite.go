@@ -0,0 +1,391 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// A composite index is a single logical index over several data
+// sources, like several buckets, so that applications can search
+// everything with a single query instead of federating the queries on
+// the client side.  Each source of a composite index has its own
+// bleve member index, with its own index params (so its own type
+// mappings) and its own plan params (so its own partitioning), named
+// like "{composite}_{sourceName}".  The composite index's name is an
+// alias of its member indexes, so it's queried like any index.  The
+// composite index definitions are kept in the Cfg, so that the member
+// indexes are reconciled when a composite index is updated, and
+// removed when it's deleted.
+
+// The Cfg key where the composite index definitions are kept.
+const COMPOSITE_INDEXES_KEY = "compositeIndexes"
+
+// CompositeIndexes is the Cfg entry of all composite indexes.
+type CompositeIndexes struct {
+	UUID string `json:"uuid"`
+
+	// Keyed by composite index name.
+	Composites map[string]*CompositeIndex `json:"composites"`
+}
+
+// CompositeIndex is the definition of a composite index.
+type CompositeIndex struct {
+	Name    string             `json:"name"`
+	Sources []*CompositeSource `json:"sources"`
+}
+
+// CompositeSource is a data source of a composite index, whose params
+// are like those of an index definition.
+type CompositeSource struct {
+	SourceType   string          `json:"sourceType"` // Defaults to "couchbase".
+	SourceName   string          `json:"sourceName"`
+	SourceUUID   string          `json:"sourceUUID,omitempty"`
+	SourceParams json.RawMessage `json:"sourceParams,omitempty"`
+
+	// The bleve index params of the source's member index, with the
+	// type mappings of the source's documents.
+	Params     json.RawMessage `json:"params,omitempty"`
+	PlanParams cbgt.PlanParams `json:"planParams"`
+
+	// The name of the source's member index, which is assigned.
+	IndexName string `json:"indexName"`
+}
+
+var compositeIndexNameInvalidRE = regexp.MustCompile(`[^0-9A-Za-z_\-]`)
+
+// CompositeMemberName returns the name of the member index of a source
+// of a composite index.
+func CompositeMemberName(compositeName, sourceName string) string {
+	return compositeName + "_" +
+		compositeIndexNameInvalidRE.ReplaceAllString(sourceName, "_")
+}
+
+// compositeParamsString returns params that may either be a JSON
+// string or a JSON object as a string.
+func compositeParamsString(raw json.RawMessage) string {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) <= 0 || bytes.Equal(raw, []byte("null")) {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// compositeSourceSame returns true when two sources would have the
+// same member index definition.
+func compositeSourceSame(a, b *CompositeSource) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	ja, erra := json.Marshal(a)
+	jb, errb := json.Marshal(b)
+	return erra == nil && errb == nil && bytes.Equal(ja, jb)
+}
+
+// SetCompositeIndex creates or updates a composite index, creating,
+// updating or deleting its member indexes and then its alias.
+func SetCompositeIndex(mgr *cbgt.Manager, c *CompositeIndex) error {
+	if c.Name == "" {
+		return fmt.Errorf("composite: name is required")
+	}
+	if len(c.Sources) <= 0 {
+		return fmt.Errorf("composite: sources are required, name: %s",
+			c.Name)
+	}
+
+	members := map[string]*CompositeSource{}
+	for _, source := range c.Sources {
+		if source.SourceName == "" {
+			return fmt.Errorf("composite: sourceName is required,"+
+				" name: %s", c.Name)
+		}
+		if source.SourceType == "" {
+			source.SourceType = "couchbase"
+		}
+		source.IndexName = CompositeMemberName(c.Name, source.SourceName)
+		if members[source.IndexName] != nil {
+			return fmt.Errorf("composite: duplicate source, name: %s,"+
+				" sourceName: %s", c.Name, source.SourceName)
+		}
+		members[source.IndexName] = source
+	}
+
+	prev, err := GetCompositeIndex(mgr.Cfg(), c.Name)
+	if err != nil {
+		return err
+	}
+
+	prevMembers := map[string]*CompositeSource{}
+	if prev != nil {
+		for _, source := range prev.Sources {
+			prevMembers[source.IndexName] = source
+		}
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return err
+	}
+
+	if prev == nil && indexDefsByName[c.Name] != nil {
+		return fmt.Errorf("composite: an index already exists, name: %s",
+			c.Name)
+	}
+
+	for _, source := range c.Sources {
+		prevUUID := ""
+		if indexDef := indexDefsByName[source.IndexName]; indexDef != nil {
+			if prevMembers[source.IndexName] == nil {
+				return fmt.Errorf("composite: an index already exists,"+
+					" name: %s", source.IndexName)
+			}
+			if compositeSourceSame(source, prevMembers[source.IndexName]) {
+				continue
+			}
+			prevUUID = indexDef.UUID
+		}
+
+		err = CreateIndexChecked(mgr, source.SourceType, source.SourceName,
+			source.SourceUUID, compositeParamsString(source.SourceParams),
+			"bleve", source.IndexName, compositeParamsString(source.Params),
+			source.PlanParams, prevUUID)
+		if err != nil {
+			return fmt.Errorf("composite: could not set member index: %s,"+
+				" err: %v", source.IndexName, err)
+		}
+	}
+
+	aliasParams := &AliasParams{Targets: map[string]*AliasParamsTarget{}}
+	for indexName := range members {
+		aliasParams.Targets[indexName] = &AliasParamsTarget{}
+	}
+
+	buf, err := json.Marshal(aliasParams)
+	if err != nil {
+		return err
+	}
+
+	prevAliasUUID := ""
+	if indexDef := indexDefsByName[c.Name]; indexDef != nil {
+		prevAliasUUID = indexDef.UUID
+	}
+
+	err = CreateIndexChecked(mgr, "nil", "", "", "", "alias", c.Name,
+		string(buf), cbgt.PlanParams{}, prevAliasUUID)
+	if err != nil {
+		return fmt.Errorf("composite: could not set alias: %s, err: %v",
+			c.Name, err)
+	}
+
+	for indexName := range prevMembers {
+		if members[indexName] == nil && indexDefsByName[indexName] != nil {
+			err = mgr.DeleteIndex(indexName)
+			if err != nil {
+				return fmt.Errorf("composite: could not delete member"+
+					" index: %s, err: %v", indexName, err)
+			}
+		}
+	}
+
+	err = updateCompositeIndexes(mgr.Cfg(), func(cis *CompositeIndexes) {
+		cis.Composites[c.Name] = c
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("composite: set, name: %s, sources: %d", c.Name,
+		len(c.Sources))
+
+	return nil
+}
+
+// DeleteCompositeIndex deletes a composite index, along with its alias
+// and member indexes.
+func DeleteCompositeIndex(mgr *cbgt.Manager, name string) error {
+	c, err := GetCompositeIndex(mgr.Cfg(), name)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return fmt.Errorf("composite: not a composite index, name: %s",
+			name)
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return err
+	}
+
+	indexNames := []string{name}
+	for _, source := range c.Sources {
+		indexNames = append(indexNames, source.IndexName)
+	}
+
+	for _, indexName := range indexNames {
+		if indexDefsByName[indexName] == nil {
+			continue
+		}
+		err = mgr.DeleteIndex(indexName)
+		if err != nil {
+			return fmt.Errorf("composite: could not delete index: %s,"+
+				" err: %v", indexName, err)
+		}
+	}
+
+	err = updateCompositeIndexes(mgr.Cfg(), func(cis *CompositeIndexes) {
+		delete(cis.Composites, name)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("composite: deleted, name: %s", name)
+
+	return nil
+}
+
+// GetCompositeIndex returns a composite index, or nil.
+func GetCompositeIndex(cfg cbgt.Cfg, name string) (*CompositeIndex, error) {
+	cis := &CompositeIndexes{}
+	_, _, err := CfgGetJSON(cfg, COMPOSITE_INDEXES_KEY, cis)
+	if err != nil {
+		return nil, err
+	}
+	return cis.Composites[name], nil
+}
+
+func updateCompositeIndexes(cfg cbgt.Cfg, f func(cis *CompositeIndexes)) error {
+	return CfgUpdateJSON(cfg, COMPOSITE_INDEXES_KEY,
+		func() interface{} { return &CompositeIndexes{} },
+		func(v interface{}) error {
+			cis := v.(*CompositeIndexes)
+			if cis.Composites == nil {
+				cis.Composites = map[string]*CompositeIndex{}
+			}
+			f(cis)
+			cis.UUID = cbgt.NewUUID()
+			return nil
+		})
+}
+
+// ---------------------------------------------------------
+
+// CompositeListHandler is a REST handler that returns the composite
+// index definitions.
+type CompositeListHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCompositeListHandler(mgr *cbgt.Manager) *CompositeListHandler {
+	return &CompositeListHandler{mgr: mgr}
+}
+
+func (h *CompositeListHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	cis := &CompositeIndexes{}
+	_, _, err := CfgGetJSON(h.mgr.Cfg(), COMPOSITE_INDEXES_KEY, cis)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("composite: could not"+
+			" retrieve composite indexes, err: %v", err), 500)
+		return
+	}
+	if cis.Composites == nil {
+		cis.Composites = map[string]*CompositeIndex{}
+	}
+
+	rest.MustEncode(w, struct {
+		Status     string                     `json:"status"`
+		Composites map[string]*CompositeIndex `json:"composites"`
+	}{
+		Status:     "ok",
+		Composites: cis.Composites,
+	})
+}
+
+// CompositePutHandler is a REST handler that creates or updates a
+// composite index.
+type CompositePutHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCompositePutHandler(mgr *cbgt.Manager) *CompositePutHandler {
+	return &CompositePutHandler{mgr: mgr}
+}
+
+func (h *CompositePutHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("composite: could not read"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	c := &CompositeIndex{}
+	err = json.Unmarshal(requestBody, c)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("composite: could not parse"+
+			" request body, err: %v", err), 400)
+		return
+	}
+	c.Name = mux.Vars(req)["name"]
+
+	err = SetCompositeIndex(h.mgr, c)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), IndexCreateErrorStatus(err, 400))
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// CompositeDeleteHandler is a REST handler that deletes a composite
+// index.
+type CompositeDeleteHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCompositeDeleteHandler(mgr *cbgt.Manager) *CompositeDeleteHandler {
+	return &CompositeDeleteHandler{mgr: mgr}
+}
+
+func (h *CompositeDeleteHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	err := DeleteCompositeIndex(h.mgr, mux.Vars(req)["name"])
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
@@ -0,0 +1,139 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestCompositeMemberName(t *testing.T) {
+	if n := CompositeMemberName("all", "beer-sample"); n != "all_beer-sample" {
+		t.Errorf("unexpected member name: %s", n)
+	}
+	if n := CompositeMemberName("all", "travel.sample%1"); n != "all_travel_sample_1" {
+		t.Errorf("expected invalid chars replaced, got: %s", n)
+	}
+}
+
+func TestCompositeParamsString(t *testing.T) {
+	tests := map[string]string{
+		``:            "",
+		`null`:        "",
+		`"{\"a\":1}"`: `{"a":1}`,
+		` {"a":1} `:   `{"a":1}`,
+	}
+	for raw, exp := range tests {
+		got := compositeParamsString(json.RawMessage(raw))
+		if got != exp {
+			t.Errorf("raw: %s, expected: %s, got: %s", raw, exp, got)
+		}
+	}
+}
+
+func TestCompositeIndex(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	err := SetCompositeIndex(mgr, &CompositeIndex{Name: "all"})
+	if err == nil {
+		t.Errorf("expected err without sources")
+	}
+
+	err = SetCompositeIndex(mgr, &CompositeIndex{Name: "all",
+		Sources: []*CompositeSource{
+			{SourceType: "primary", SourceName: "a"},
+			{SourceType: "primary", SourceName: "a"},
+		}})
+	if err == nil {
+		t.Errorf("expected err on duplicate sources")
+	}
+
+	err = SetCompositeIndex(mgr, &CompositeIndex{Name: "all",
+		Sources: []*CompositeSource{
+			{SourceType: "primary", SourceName: "beers"},
+			{SourceType: "primary", SourceName: "breweries",
+				PlanParams: cbgt.PlanParams{MaxPartitionsPerPIndex: 4}},
+		}})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	_, indexDefsByName, _ := mgr.GetIndexDefs(true)
+	alias := indexDefsByName["all"]
+	if alias == nil || alias.Type != "alias" {
+		t.Fatalf("expected an alias, got: %+v", alias)
+	}
+	var params AliasParams
+	json.Unmarshal([]byte(alias.Params), &params)
+	if len(params.Targets) != 2 ||
+		params.Targets["all_beers"] == nil ||
+		params.Targets["all_breweries"] == nil {
+		t.Errorf("expected the alias to target the members, got: %s",
+			alias.Params)
+	}
+	if indexDefsByName["all_breweries"].PlanParams.MaxPartitionsPerPIndex != 4 {
+		t.Errorf("expected per-source plan params")
+	}
+	beersUUID := indexDefsByName["all_beers"].UUID
+
+	err = SetCompositeIndex(mgr, &CompositeIndex{Name: "all",
+		Sources: []*CompositeSource{
+			{SourceType: "primary", SourceName: "beers"},
+			{SourceType: "primary", SourceName: "wines"},
+		}})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	_, indexDefsByName, _ = mgr.GetIndexDefs(true)
+	if indexDefsByName["all_breweries"] != nil ||
+		indexDefsByName["all_wines"] == nil {
+		t.Errorf("expected the members reconciled")
+	}
+	if indexDefsByName["all_beers"].UUID != beersUUID {
+		t.Errorf("expected an unchanged member left as-is")
+	}
+
+	err = SetCompositeIndex(mgr, &CompositeIndex{Name: "all_beers",
+		Sources: []*CompositeSource{
+			{SourceType: "primary", SourceName: "x"},
+		}})
+	if err == nil {
+		t.Errorf("expected err on a name of an existing index")
+	}
+
+	err = DeleteCompositeIndex(mgr, "all")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	_, indexDefsByName, _ = mgr.GetIndexDefs(true)
+	if len(indexDefsByName) != 0 {
+		t.Errorf("expected all indexes deleted, got: %d",
+			len(indexDefsByName))
+	}
+
+	c, _ := GetCompositeIndex(cfg, "all")
+	if c != nil || DeleteCompositeIndex(mgr, "all") == nil {
+		t.Errorf("expected the composite index deleted")
+	}
+}
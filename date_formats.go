@@ -0,0 +1,164 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// The datetime fields of an index may accept several date layouts,
+// which are declared in the "dateFormats" of the bleve index params,
+// keyed by field path, like...
+//
+//   {"mapping": {...},
+//    "dateFormats": {
+//      "created": ["2006-01-02", "02/01/2006", "unix"],
+//      "order.shipped": ["rfc3339", "Jan 2, 2006 3:04 PM"]}}
+//
+// where the layouts are Go time layouts, or one of the named layouts
+// of dateFormatsNamed.  As documents are ingested, the values of
+// those fields are parsed with the layouts, in order, and replaced by
+// their RFC3339 timestamps, which bleve's default date parser
+// accepts.  A value that no layout parses is removed from its
+// document, instead of being indexed as text, and is reported as an
+// ingest error of the index.
+
+// The named layouts of dateFormats, where "unix" and "unixMillis" are
+// numbers, or strings of numbers, of secs or millisecs since the
+// epoch.
+var dateFormatsNamed = map[string]string{
+	"rfc3339":    time.RFC3339Nano,
+	"rfc1123":    time.RFC1123,
+	"rfc1123z":   time.RFC1123Z,
+	"rfc822":     time.RFC822,
+	"rfc822z":    time.RFC822Z,
+	"rfc850":     time.RFC850,
+	"ansic":      time.ANSIC,
+	"unixDate":   time.UnixDate,
+	"rubyDate":   time.RubyDate,
+	"dateOnly":   "2006-01-02",
+	"dateTime":   "2006-01-02 15:04:05",
+	"unix":       "",
+	"unixMillis": "",
+}
+
+// validateDateFormats checks the dateFormats of the index params.
+func validateDateFormats(dateFormats map[string][]string) error {
+	ref := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	for field, layouts := range dateFormats {
+		if field == "" {
+			return fmt.Errorf("date_formats: empty field name")
+		}
+		if len(layouts) <= 0 {
+			return fmt.Errorf("date_formats: no layouts, field: %s", field)
+		}
+		for _, layout := range layouts {
+			if _, exists := dateFormatsNamed[layout]; exists {
+				continue
+			}
+			s := ref.Format(layout)
+			if s == layout {
+				return fmt.Errorf("date_formats: layout: %q has no date"+
+					" or time elements, field: %s", layout, field)
+			}
+			if _, err := time.Parse(layout, s); err != nil {
+				return fmt.Errorf("date_formats: bad layout: %q, field: %s,"+
+					" err: %v", layout, field, err)
+			}
+		}
+	}
+	return nil
+}
+
+// dateFormatsParse parses a date value with the layouts, in order.
+func dateFormatsParse(v interface{}, layouts []string) (time.Time, bool) {
+	for _, layout := range layouts {
+		if layout == "unix" || layout == "unixMillis" {
+			var f float64
+			switch x := v.(type) {
+			case float64:
+				f = x
+			case string:
+				var err error
+				if f, err = strconv.ParseFloat(x, 64); err != nil {
+					continue
+				}
+			default:
+				continue
+			}
+			if math.IsNaN(f) || math.IsInf(f, 0) {
+				continue
+			}
+			if layout == "unixMillis" {
+				f = f / 1000
+			}
+			secs, frac := math.Modf(f)
+			return time.Unix(int64(secs), int64(frac*1e9)).UTC(), true
+		}
+
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if named, exists := dateFormatsNamed[layout]; exists {
+			layout = named
+		}
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// dateFormatsApply replaces the values of the date fields of a parsed
+// JSON document with their RFC3339 timestamps, returning the errors
+// of the values that couldn't be parsed, which are removed from the
+// document.
+func dateFormatsApply(m map[string]interface{},
+	dateFormats map[string][]string) []error {
+	var errs []error
+
+	parse := func(field string, v interface{}) interface{} {
+		t, ok := dateFormatsParse(v, dateFormats[field])
+		if !ok {
+			errs = append(errs, fmt.Errorf("date_formats: could not parse"+
+				" field: %s, value: %v, layouts: %q",
+				field, v, dateFormats[field]))
+			return nil
+		}
+		return t.Format(time.RFC3339Nano)
+	}
+
+	for field := range dateFormats {
+		v := nestedGet(m, field)
+		switch x := v.(type) {
+		case nil:
+			continue
+		case []interface{}:
+			rv := make([]interface{}, 0, len(x))
+			for _, elem := range x {
+				if elem = parse(field, elem); elem != nil {
+					rv = append(rv, elem)
+				}
+			}
+			nestedSet(m, field, rv)
+		default:
+			nestedSet(m, field, parse(field, x))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,133 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestValidateDateFormats(t *testing.T) {
+	err := ValidateBlevePIndexImpl("bleve", "idx",
+		`{"dateFormats":{"created":["2006-01-02","unix"]}}`)
+	if err != nil {
+		t.Errorf("expected valid params, got: %v", err)
+	}
+
+	for _, dateFormats := range []map[string][]string{
+		{"": {"2006-01-02"}},
+		{"created": {}},
+		{"created": {"yyyy-mm-dd"}},
+	} {
+		if validateDateFormats(dateFormats) == nil {
+			t.Errorf("expected err, dateFormats: %v", dateFormats)
+		}
+	}
+}
+
+func TestDateFormatsApply(t *testing.T) {
+	dateFormats := map[string][]string{
+		"created":       {"02/01/2006", "dateOnly", "unix"},
+		"order.shipped": {"unixMillis"},
+		"tags":          {"dateOnly"},
+	}
+
+	m := map[string]interface{}{
+		"created": "31/12/2015",
+		"order":   map[string]interface{}{"shipped": 1451606400500.0},
+		"tags":    []interface{}{"2015-01-01", "soon", "2015-02-01"},
+	}
+	errs := dateFormatsApply(m, dateFormats)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "soon") {
+		t.Errorf("expected an err for the bad date, got: %v", errs)
+	}
+	if m["created"] != "2015-12-31T00:00:00Z" ||
+		nestedGet(m, "order.shipped") != "2016-01-01T00:00:00.5Z" {
+		t.Errorf("unexpected dates: %v", m)
+	}
+	tags := m["tags"].([]interface{})
+	if len(tags) != 2 || tags[1] != "2015-02-01T00:00:00Z" {
+		t.Errorf("expected the bad date to be dropped, got: %v", tags)
+	}
+
+	m = map[string]interface{}{"created": "1451606400"}
+	errs = dateFormatsApply(m, dateFormats)
+	if len(errs) != 0 || m["created"] != "2016-01-01T00:00:00Z" {
+		t.Errorf("expected a unix date, got: %v, errs: %v", m, errs)
+	}
+
+	m = map[string]interface{}{"created": "last tuesday"}
+	errs = dateFormatsApply(m, dateFormats)
+	if len(errs) != 1 || m["created"] != nil {
+		t.Errorf("expected the bad date to be removed, got: %v", m)
+	}
+}
+
+func TestDateFormatsDataUpdate(t *testing.T) {
+	bindex, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bdest := NewBleveDest("/tmp/dateFormats_1234_5678.pindex", bindex,
+		func() {})
+	bdest.dateFormats = map[string][]string{"created": {"02/01/2006"}}
+	dest := &cbgt.DestForwarder{DestProvider: bdest}
+	defer dest.Close()
+
+	ingestErrors := atomic.LoadUint64(&bdest.metrics.IngestErrors)
+
+	dest.SnapshotStart("0", 1, 2)
+	for i, val := range []string{
+		`{"created":"31/12/2015"}`,
+		`{"created":"not a date"}`,
+	} {
+		err = dest.DataUpdate("0", []byte([]string{"good", "bad"}[i]),
+			uint64(i+1), []byte(val), 0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if atomic.LoadUint64(&bdest.metrics.IngestErrors) != ingestErrors+1 {
+		t.Errorf("expected an ingest error")
+	}
+	var stats bytes.Buffer
+	bdest.Stats(&stats)
+	if !strings.Contains(stats.String(), "not a date") {
+		t.Errorf("expected the bad date in the errors, got: %s", stats.String())
+	}
+
+	q, err := bleve.ParseQuery([]byte(`{"field":"created",` +
+		`"start":"2015-12-01T00:00:00Z","end":"2016-01-01T00:00:00Z"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := bindex.Search(bleve.NewSearchRequest(q))
+	if err != nil || len(res.Hits) != 1 || res.Hits[0].ID != "good" {
+		t.Errorf("expected the parsed date to be indexed, got: %v, err: %v",
+			res, err)
+	}
+
+	qs := bleve.NewMatchQuery("date")
+	res, err = bindex.Search(bleve.NewSearchRequest(qs))
+	if err != nil || len(res.Hits) != 0 {
+		t.Errorf("expected the bad date to not be indexed as text, got: %v",
+			res)
+	}
+}
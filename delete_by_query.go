@@ -0,0 +1,211 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The max number of matching documents that are removed per batch
+// by deleteMatching.
+var DeleteByQueryBatchSize = 1000
+
+var errBleveDestClosed = fmt.Errorf("delete_by_query: BleveDest closed")
+
+// deleteMatching removes the documents of a BleveDest that match a
+// query, returning the number of removed documents, or when dryRun
+// is true, just returns the number of matching documents.  All the
+// partitions are locked and their pending batches are applied first,
+// so that documents that are still in a batch are also removed, and
+// so that concurrent mutations can't race with the removal.
+func (t *BleveDest) deleteMatching(q bleve.Query, dryRun bool) (int, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.bindex == nil {
+		return 0, errBleveDestClosed
+	}
+
+	for _, bdp := range t.partitions {
+		bdp.m.Lock()
+		defer bdp.m.Unlock()
+
+		err := bdp.applyBatchUnlocked()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if dryRun {
+		res, err := t.bindex.Search(bleve.NewSearchRequestOptions(q,
+			0, 0, false))
+		if err != nil {
+			return 0, err
+		}
+		return int(res.Total), nil
+	}
+
+	removed := 0
+
+	for {
+		res, err := t.bindex.Search(bleve.NewSearchRequestOptions(q,
+			DeleteByQueryBatchSize, 0, false))
+		if err != nil {
+			return removed, err
+		}
+		if len(res.Hits) <= 0 {
+			return removed, nil
+		}
+
+		batch := t.bindex.NewBatch()
+		for _, hit := range res.Hits {
+			batch.Delete(hit.ID)
+		}
+
+		err = t.bindex.Batch(batch)
+		if err != nil {
+			return removed, err
+		}
+
+		removed += len(res.Hits)
+
+		if len(res.Hits) < DeleteByQueryBatchSize {
+			return removed, nil
+		}
+	}
+}
+
+// ---------------------------------------------------------
+
+// DeleteByQueryHandler is a REST handler that removes the documents
+// that match a query from the partitions of an index on this node.
+// It's meant for indexes whose data source isn't couchbase, like
+// file-fed indexes, where there's no data source that would later
+// disagree with the index, such as to enforce the retention of a log
+// index.
+type DeleteByQueryHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewDeleteByQueryHandler(mgr *cbgt.Manager) *DeleteByQueryHandler {
+	return &DeleteByQueryHandler{mgr: mgr}
+}
+
+func (h *DeleteByQueryHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	_, indexDefsByName, err := h.mgr.GetIndexDefs(false)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("delete_by_query: could not"+
+			" retrieve index defs, err: %v", err), 500)
+		return
+	}
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil {
+		rest.ShowError(w, req, fmt.Sprintf("delete_by_query: not an index,"+
+			" indexName: %s", indexName), 400)
+		return
+	}
+	if strings.HasPrefix(indexDef.SourceType, "couchbase") {
+		rest.ShowError(w, req, fmt.Sprintf("delete_by_query: index: %s"+
+			" has a couchbase data source, whose documents can only be"+
+			" removed from the data source", indexName), 400)
+		return
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("delete_by_query: could not"+
+			" read request body, err: %v", err), 400)
+		return
+	}
+
+	var r struct {
+		Query  json.RawMessage `json:"query"`
+		DryRun bool            `json:"dryRun"`
+	}
+	err = json.Unmarshal(requestBody, &r)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("delete_by_query: could not"+
+			" parse request body, err: %v", err), 400)
+		return
+	}
+	if len(r.Query) <= 0 {
+		rest.ShowError(w, req, "delete_by_query: query is required", 400)
+		return
+	}
+
+	q, err := bleve.ParseQuery(r.Query)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("delete_by_query: could not"+
+			" parse query, err: %v", err), 400)
+		return
+	}
+
+	count := 0
+	numPIndexes := 0
+
+	_, pindexes := h.mgr.CurrentMaps()
+	for _, pindex := range pindexes {
+		if pindex.IndexName != indexName {
+			continue
+		}
+		df, ok := pindex.Dest.(*cbgt.DestForwarder)
+		if !ok {
+			continue
+		}
+		bdest, ok := df.DestProvider.(*BleveDest)
+		if !ok {
+			continue
+		}
+
+		n, err := bdest.deleteMatching(q, r.DryRun)
+		count += n
+		if err != nil {
+			rest.ShowError(w, req, fmt.Sprintf("delete_by_query: could"+
+				" not delete, pindex: %s, deleted: %d, err: %v",
+				pindex.Name, count, err), 500)
+			return
+		}
+
+		numPIndexes++
+	}
+
+	rv := struct {
+		Status      string `json:"status"`
+		NumPIndexes int    `json:"numPIndexes"`
+		Deleted     int    `json:"deleted"`
+		Matched     int    `json:"matched,omitempty"`
+	}{
+		Status:      "ok",
+		NumPIndexes: numPIndexes,
+	}
+	if r.DryRun {
+		rv.Matched = count
+	} else {
+		rv.Deleted = count
+	}
+
+	rest.MustEncode(w, rv)
+}
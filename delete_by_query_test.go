@@ -0,0 +1,58 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"testing"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestDeleteMatching(t *testing.T) {
+	bindex, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	bindex.Index("a", map[string]interface{}{"level": "debug"})
+	bindex.Index("b", map[string]interface{}{"level": "error"})
+
+	dest := NewBleveDest("/tmp/logs_1234_5678.pindex", bindex, func() {})
+
+	// A doc that's still in a partition's pending batch.
+	d, _ := dest.Dest("0")
+	d.SnapshotStart("0", 1, 10)
+	d.DataUpdate("0", []byte("c"), 1, []byte(`{"level":"debug"}`),
+		0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+
+	q := bleve.NewMatchQuery("debug")
+
+	n, err := dest.deleteMatching(q, true)
+	if err != nil || n != 2 {
+		t.Errorf("expected 2 matches on a dry run, got: %d, err: %v", n, err)
+	}
+	count, _ := bindex.DocCount()
+	if count != 3 {
+		t.Errorf("expected a dry run to keep all docs, got: %d", count)
+	}
+
+	n, err = dest.deleteMatching(q, false)
+	if err != nil || n != 2 {
+		t.Errorf("expected 2 deleted, got: %d, err: %v", n, err)
+	}
+	count, _ = bindex.DocCount()
+	if count != 1 {
+		t.Errorf("expected 1 remaining doc, got: %d", count)
+	}
+}
@@ -0,0 +1,207 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
+	"sort"
+	"time"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// A diagnostics bundle is a single tar.gz file of a node's recent
+// logs, goroutine and heap profiles, Cfg snapshot (node definitions,
+// index definitions and plan) and REST API diagnostics and stats,
+// for attaching to support tickets.  A part that can't be collected
+// is left out of the bundle, with the error recorded in the
+// DIAG_BUNDLE_ERRORS file instead, so that a partly broken node
+// still yields a bundle.
+
+// The file of a diagnostics bundle that lists the parts that
+// couldn't be collected.
+const DIAG_BUNDLE_ERRORS = "errors.txt"
+
+// DiagBundlePaths are the REST API GET paths whose responses are
+// included in a diagnostics bundle, keyed by file name.
+var DiagBundlePaths = map[string]string{
+	"diag.json":  "/api/diag",
+	"stats.json": "/api/stats",
+}
+
+// diagBundlePart is a file of a diagnostics bundle, whose content is
+// retrieved by a func.
+type diagBundlePart struct {
+	name string
+	get  func() ([]byte, error)
+}
+
+// WriteDiagBundle writes a diagnostics bundle as a tar.gz, where the
+// DiagBundlePaths are retrieved from the REST API handler h.
+func WriteDiagBundle(w io.Writer, cfg cbgt.Cfg, mr *cbgt.MsgRing,
+	h http.Handler) error {
+	parts := []diagBundlePart{
+		{"log.txt", func() ([]byte, error) {
+			if mr == nil {
+				return nil, fmt.Errorf("no log messages")
+			}
+			return bytes.Join(mr.Messages(), nil), nil
+		}},
+		{"goroutine.txt", func() ([]byte, error) {
+			return diagBundleProfile("goroutine", 2)
+		}},
+		{"heap.pprof", func() ([]byte, error) {
+			return diagBundleProfile("heap", 0)
+		}},
+		{"cfg.json", func() ([]byte, error) {
+			snapshot, err := SnapshotCfg(cfg)
+			if err != nil {
+				return nil, err
+			}
+			return json.MarshalIndent(snapshot, "", "  ")
+		}},
+	}
+
+	names := make([]string, 0, len(DiagBundlePaths))
+	for name := range DiagBundlePaths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := DiagBundlePaths[name]
+		parts = append(parts, diagBundlePart{name, func() ([]byte, error) {
+			return diagBundleGet(h, path)
+		}})
+	}
+
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+
+	now := time.Now()
+
+	var errs bytes.Buffer
+
+	writeFile := func(name string, buf []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(buf)),
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(buf)
+		return err
+	}
+
+	for _, part := range parts {
+		buf, err := part.get()
+		if err != nil {
+			fmt.Fprintf(&errs, "%s: %v\n", part.name, err)
+			continue
+		}
+
+		err = writeFile(part.name, buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	if errs.Len() > 0 {
+		err := writeFile(DIAG_BUNDLE_ERRORS, errs.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tw.Close()
+	if err != nil {
+		return err
+	}
+
+	return gzw.Close()
+}
+
+// diagBundleProfile returns a runtime/pprof profile, such as
+// "goroutine" or "heap".
+func diagBundleProfile(name string, debug int) ([]byte, error) {
+	p := pprof.Lookup(name)
+	if p == nil {
+		return nil, fmt.Errorf("unknown profile: %s", name)
+	}
+
+	var buf bytes.Buffer
+	err := p.WriteTo(&buf, debug)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// diagBundleGet returns the response body of a REST API GET request
+// that's handled in-process.
+func diagBundleGet(h http.Handler, path string) ([]byte, error) {
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		return nil, fmt.Errorf("GET %s, status: %d, body: %s",
+			path, rr.Code, rr.Body.String())
+	}
+	return rr.Body.Bytes(), nil
+}
+
+// ---------------------------------------------------------
+
+// DiagBundleHandler is a REST handler that returns a diagnostics
+// bundle of the node as a downloadable tar.gz file.
+type DiagBundleHandler struct {
+	mgr *cbgt.Manager
+	mr  *cbgt.MsgRing
+	h   http.Handler
+}
+
+func NewDiagBundleHandler(mgr *cbgt.Manager, mr *cbgt.MsgRing,
+	h http.Handler) *DiagBundleHandler {
+	return &DiagBundleHandler{mgr: mgr, mr: mr, h: h}
+}
+
+func (h *DiagBundleHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/x-gzip")
+	w.Header().Set("Content-Disposition",
+		"attachment; filename=cbft-diag-"+h.mgr.UUID()+"-"+
+			time.Now().UTC().Format("20060102T150405Z")+".tar.gz")
+
+	err := WriteDiagBundle(w, h.mgr.Cfg(), h.mr, h.h)
+	if err != nil {
+		// The response has already started, so the best that can be
+		// done is a truncated bundle.
+		log.Printf("diag_bundle: could not write, err: %v", err)
+	}
+}
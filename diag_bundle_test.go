@@ -0,0 +1,104 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestWriteDiagBundle(t *testing.T) {
+	cfg := cbgt.NewCfgMem()
+
+	indexDefs := cbgt.NewIndexDefs(cbgt.VERSION)
+	indexDefs.IndexDefs["idx"] = &cbgt.IndexDef{
+		Type:       "bleve",
+		Name:       "idx",
+		UUID:       "u0",
+		SourceType: "nil",
+	}
+	_, err := cbgt.CfgSetIndexDefs(cfg, indexDefs, 0)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	mr, err := cbgt.NewMsgRing(ioutil.Discard, 10)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	mr.Write([]byte("hello log\n"))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/stats", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"stats":true}`))
+	})
+	// No /api/diag route, so diag.json is an error.
+
+	var buf bytes.Buffer
+	err = WriteDiagBundle(&buf, cfg, mr, r)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	gzr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	files := map[string]string{}
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected no err, got: %v", err)
+		}
+		b, _ := ioutil.ReadAll(tr)
+		files[hdr.Name] = string(b)
+	}
+
+	if files["log.txt"] != "hello log\n" {
+		t.Errorf("expected log.txt, got: %q", files["log.txt"])
+	}
+	if !strings.Contains(files["goroutine.txt"], "TestWriteDiagBundle") {
+		t.Errorf("expected goroutine.txt with this test's goroutine")
+	}
+	if files["heap.pprof"] == "" {
+		t.Errorf("expected heap.pprof")
+	}
+	if !strings.Contains(files["cfg.json"], `"u0"`) {
+		t.Errorf("expected cfg.json with index defs, got: %s",
+			files["cfg.json"])
+	}
+	if files["stats.json"] != `{"stats":true}` {
+		t.Errorf("expected stats.json, got: %q", files["stats.json"])
+	}
+	if _, exists := files["diag.json"]; exists {
+		t.Errorf("expected no diag.json")
+	}
+	if !strings.HasPrefix(files[DIAG_BUNDLE_ERRORS], "diag.json: ") {
+		t.Errorf("expected errors.txt with diag.json, got: %q",
+			files[DIAG_BUNDLE_ERRORS])
+	}
+}
@@ -0,0 +1,34 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package cbft
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// DiskUsage returns the used bytes and the bytes that are available
+// to unprivileged users of the filesystem of a path, where, like df,
+// the blocks reserved for root are in neither.
+func DiskUsage(path string) (used, avail uint64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, 0, fmt.Errorf("disk_usage: statfs, path: %s, err: %v",
+			path, err)
+	}
+
+	return (uint64(st.Blocks) - uint64(st.Bfree)) * uint64(st.Bsize),
+		uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,25 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+//go:build windows || plan9
+// +build windows plan9
+
+package cbft
+
+import (
+	"fmt"
+)
+
+// DiskUsage returns an error, as disk usage isn't supported on this
+// platform.
+func DiskUsage(path string) (used, avail uint64, err error) {
+	return 0, 0, fmt.Errorf("disk_usage: disk usage is not supported" +
+		" on this platform")
+}
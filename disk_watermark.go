@@ -0,0 +1,271 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// A full disk can corrupt the files of an index, so the disk usage of
+// a node's dataDir is checked periodically against a low and a high
+// watermark, as percents of the filesystem that are used, configured
+// by the diskLowWatermark and diskHighWatermark node options.  Once
+// the usage reaches the high watermark, the node pauses the ingest of
+// all its pindexes, by blocking their feeds (so DCP flow control
+// pauses the producers), and rejects the creation of new indexes.
+// Once space is freed so that the usage drops below the low
+// watermark, the ingest resumes on its own.  A diskHighWatermark
+// option of 0 disables the checks.
+
+// The default watermarks, as percents of the filesystem that are used.
+var DiskLowWatermark = 90.0
+var DiskHighWatermark = 95.0
+
+// How often the disk usage of the dataDir is checked.
+var DiskWatermarkCheckInterval = 10 * time.Second
+
+// How often a paused feed checks whether it may resume.
+var DiskWatermarkWaitInterval = time.Second
+
+// DiskWatermarkStatus is the last checked disk usage of a node.
+type DiskWatermarkStatus struct {
+	DataDir       string  `json:"dataDir"`
+	Time          string  `json:"time"`
+	UsedBytes     uint64  `json:"usedBytes"`
+	AvailBytes    uint64  `json:"availBytes"`
+	UsedPercent   float64 `json:"usedPercent"`
+	LowWatermark  float64 `json:"lowWatermark"`
+	HighWatermark float64 `json:"highWatermark"`
+
+	// True from when the usage reaches the high watermark until it
+	// drops below the low watermark, while ingest is paused.
+	High bool   `json:"high"`
+	Err  string `json:"err,omitempty"`
+}
+
+var diskWatermarkHigh int32 // Non-zero while high, accessed via atomic.
+
+var diskWatermarkM sync.Mutex // Protects the fields that follow.
+var diskWatermarkStatus *DiskWatermarkStatus
+
+// DiskWatermarkStart validates the watermark node options, checks the
+// disk usage of the dataDir and then keeps checking it periodically.
+// It must be invoked before the manager is started, so that ingest
+// doesn't start on a full disk.
+func DiskWatermarkStart(dataDir string, options map[string]string) error {
+	low, high := DiskLowWatermark, DiskHighWatermark
+
+	if v := options["diskHighWatermark"]; v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 100 {
+			return fmt.Errorf("disk_watermark: bad diskHighWatermark: %q", v)
+		}
+		high = f
+	}
+
+	if v := options["diskLowWatermark"]; v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 100 {
+			return fmt.Errorf("disk_watermark: bad diskLowWatermark: %q", v)
+		}
+		low = f
+	} else if low > high {
+		low = high
+	}
+
+	if high <= 0 {
+		log.Printf("disk_watermark: disabled")
+		return nil
+	}
+
+	if low > high {
+		return fmt.Errorf("disk_watermark: diskLowWatermark: %v is more"+
+			" than diskHighWatermark: %v", low, high)
+	}
+
+	status := diskWatermarkCheck(dataDir, low, high)
+	if status.Err != "" {
+		log.Printf("disk_watermark: disabled, err: %s", status.Err)
+		return nil
+	}
+
+	go func() {
+		for range time.Tick(DiskWatermarkCheckInterval) {
+			diskWatermarkCheck(dataDir, low, high)
+		}
+	}()
+
+	return nil
+}
+
+// diskWatermarkCheck checks the disk usage of the dataDir, pausing or
+// resuming ingest when a watermark is crossed.
+func diskWatermarkCheck(dataDir string, low, high float64) *DiskWatermarkStatus {
+	status := &DiskWatermarkStatus{
+		DataDir:       dataDir,
+		Time:          time.Now().Format(time.RFC3339Nano),
+		LowWatermark:  low,
+		HighWatermark: high,
+	}
+
+	used, avail, err := DiskUsage(dataDir)
+	if err != nil {
+		status.Err = err.Error()
+	} else if used+avail > 0 {
+		status.UsedBytes = used
+		status.AvailBytes = avail
+		status.UsedPercent = 100.0 * float64(used) / float64(used+avail)
+	}
+
+	wasHigh := atomic.LoadInt32(&diskWatermarkHigh) != 0
+
+	status.High = wasHigh
+	if status.Err == "" {
+		status.High = diskWatermarkIsHigh(wasHigh, status.UsedPercent,
+			low, high)
+	}
+
+	diskWatermarkM.Lock()
+	diskWatermarkStatus = status
+	diskWatermarkM.Unlock()
+
+	if status.High != wasHigh {
+		event := WEBHOOK_EVENT_DISK_HIGH_WATERMARK
+		if status.High {
+			atomic.StoreInt32(&diskWatermarkHigh, 1)
+
+			log.Printf("disk_watermark: high watermark reached, pausing"+
+				" ingest and index creation, dataDir: %s, usedPercent: %.1f,"+
+				" diskHighWatermark: %v", dataDir, status.UsedPercent, high)
+		} else {
+			atomic.StoreInt32(&diskWatermarkHigh, 0)
+
+			log.Printf("disk_watermark: below low watermark, resuming"+
+				" ingest and index creation, dataDir: %s, usedPercent: %.1f,"+
+				" diskLowWatermark: %v", dataDir, status.UsedPercent, low)
+
+			event = WEBHOOK_EVENT_DISK_LOW_WATERMARK
+		}
+
+		WebhookNotify(&WebhookEvent{Event: event})
+	}
+
+	return status
+}
+
+// diskWatermarkIsHigh returns whether a disk usage is high, where
+// between the watermarks the previous state is kept, so that ingest
+// doesn't flap around a single threshold.
+func diskWatermarkIsHigh(wasHigh bool, usedPercent, low, high float64) bool {
+	if usedPercent >= high {
+		return true
+	}
+	if usedPercent < low {
+		return false
+	}
+	return wasHigh
+}
+
+// DiskWatermarkHigh returns true while the disk usage of the node is
+// over its high watermark.
+func DiskWatermarkHigh() bool {
+	return atomic.LoadInt32(&diskWatermarkHigh) != 0
+}
+
+// CurrentDiskWatermarkStatus returns the last checked disk usage, or
+// nil when the checks are disabled.
+func CurrentDiskWatermarkStatus() *DiskWatermarkStatus {
+	diskWatermarkM.Lock()
+	defer diskWatermarkM.Unlock()
+	return diskWatermarkStatus
+}
+
+// diskWatermarkWait blocks the feed of a BleveDest while the disk
+// usage is high, until it's back below the low watermark or until the
+// BleveDest is closed (like when its index is deleted to free space).
+func diskWatermarkWait(t *BleveDest) {
+	for DiskWatermarkHigh() {
+		t.m.Lock()
+		closed := t.bindex == nil
+		t.m.Unlock()
+
+		if closed {
+			return
+		}
+
+		time.Sleep(DiskWatermarkWaitInterval)
+	}
+}
+
+// ---------------------------------------------------------
+
+// checkDiskWatermark returns an error when an index create request
+// would create a new index while the disk usage of the node is over
+// its high watermark.  Updates of existing indexes are still allowed.
+func checkDiskWatermark(mgr *cbgt.Manager, indexName string) error {
+	if !DiskWatermarkHigh() {
+		return nil
+	}
+
+	indexDefs, _, err := cbgt.CfgGetIndexDefs(mgr.Cfg())
+	if err != nil {
+		return fmt.Errorf("disk_watermark: could not"+
+			" retrieve index defs, err: %v", err)
+	}
+
+	if indexDefs != nil && indexDefs.IndexDefs[indexName] != nil {
+		return nil
+	}
+
+	msg := fmt.Sprintf("disk_watermark: index: %s cannot be created,"+
+		" as the disk of node: %s is over its high watermark;"+
+		" please free disk space, such as by deleting unused indexes",
+		indexName, mgr.UUID())
+	if status := CurrentDiskWatermarkStatus(); status != nil {
+		msg = fmt.Sprintf("%s, dataDir: %s, usedPercent: %.1f,"+
+			" diskHighWatermark: %v", msg, status.DataDir,
+			status.UsedPercent, status.HighWatermark)
+	}
+
+	return &IndexCreateError{Status: http.StatusInsufficientStorage, Msg: msg}
+}
+
+// DiskWatermarkHandler is a REST handler that returns the disk usage
+// of the node and whether it's over its high watermark.
+type DiskWatermarkHandler struct{}
+
+func NewDiskWatermarkHandler() *DiskWatermarkHandler {
+	return &DiskWatermarkHandler{}
+}
+
+func (h *DiskWatermarkHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	rest.MustEncode(w, struct {
+		Status        string               `json:"status"`
+		DiskWatermark *DiskWatermarkStatus `json:"diskWatermark"`
+	}{
+		Status:        "ok",
+		DiskWatermark: CurrentDiskWatermarkStatus(),
+	})
+}
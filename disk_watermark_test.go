@@ -0,0 +1,92 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"testing"
+)
+
+func TestDiskWatermarkIsHigh(t *testing.T) {
+	tests := []struct {
+		wasHigh bool
+		used    float64
+		exp     bool
+	}{
+		{false, 50, false},
+		{false, 92, false},
+		{false, 95, true},
+		{true, 92, true},
+		{true, 89.9, false},
+	}
+	for i, test := range tests {
+		got := diskWatermarkIsHigh(test.wasHigh, test.used, 90, 95)
+		if got != test.exp {
+			t.Errorf("test: %d, expected: %v, got: %v", i, test.exp, got)
+		}
+	}
+}
+
+func TestDiskWatermarkStart(t *testing.T) {
+	bad := []map[string]string{
+		{"diskHighWatermark": "x"},
+		{"diskHighWatermark": "101"},
+		{"diskLowWatermark": "-1"},
+		{"diskLowWatermark": "90", "diskHighWatermark": "80"},
+	}
+	for _, options := range bad {
+		if DiskWatermarkStart("./tmp", options) == nil {
+			t.Errorf("expected err on options: %v", options)
+		}
+	}
+
+	err := DiskWatermarkStart("./tmp", map[string]string{
+		"diskHighWatermark": "0",
+	})
+	if err != nil || CurrentDiskWatermarkStatus() != nil {
+		t.Errorf("expected disabled checks, err: %v", err)
+	}
+}
+
+func TestDiskWatermarkCheck(t *testing.T) {
+	used, avail, err := DiskUsage(".")
+	if err != nil || used+avail <= 0 {
+		t.Fatalf("unexpected disk usage: %d, %d, err: %v", used, avail, err)
+	}
+
+	defer func() {
+		diskWatermarkCheck(".", 100, 100)
+		diskWatermarkM.Lock()
+		diskWatermarkStatus = nil
+		diskWatermarkM.Unlock()
+	}()
+
+	status := diskWatermarkCheck(".", 0, 0.000001)
+	if !status.High || !DiskWatermarkHigh() || status.Err != "" {
+		t.Errorf("expected high, got: %+v", status)
+	}
+	if CurrentDiskWatermarkStatus() != status {
+		t.Errorf("expected the current status")
+	}
+
+	status = diskWatermarkCheck(".", 0, 100)
+	if !status.High {
+		t.Errorf("expected still high above the low watermark")
+	}
+
+	// A closed BleveDest isn't blocked.
+	diskWatermarkWait(&BleveDest{})
+
+	status = diskWatermarkCheck(".", 100, 100)
+	if status.High || DiskWatermarkHigh() {
+		t.Errorf("expected resumed below the low watermark, got: %+v", status)
+	}
+}
@@ -0,0 +1,205 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// A bleve index with docTypeStats records the mapping type that each
+// document was routed to in the DOC_TYPE_FIELD, which is indexed as
+// a single keyword term, so that the current document counts per
+// type are just the term counts of that field, with deletions and
+// updates already accounted for by the index.
+
+// The keyword field where a bleve index with docTypeStats records
+// the mapping type of a document.
+const DOC_TYPE_FIELD = "$docType"
+
+// applyDocTypeMapping adds a keyword DOC_TYPE_FIELD mapping to the
+// default mapping and type mappings of an index mapping.
+func applyDocTypeMapping(m *bleve.IndexMapping) {
+	add := func(dm *bleve.DocumentMapping) {
+		if dm == nil {
+			return
+		}
+		fm := bleve.NewTextFieldMapping()
+		fm.Analyzer = "keyword"
+		fm.Store = false
+		fm.IncludeTermVectors = false
+		fm.IncludeInAll = false
+		dm.AddFieldMappingsAt(DOC_TYPE_FIELD, fm)
+	}
+
+	add(m.DefaultMapping)
+	for _, dm := range m.TypeMapping {
+		add(dm)
+	}
+}
+
+// docMappingType returns the name of the mapping type that a parsed
+// JSON document is routed to, which is the value of the mapping's
+// type field when there's a type mapping by that name, and otherwise
+// the mapping's default type.
+func docMappingType(m *bleve.IndexMapping, v interface{}) string {
+	typeField := m.TypeField
+	if typeField == "" {
+		typeField = "_type"
+	}
+
+	for _, part := range strings.Split(typeField, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			v = nil
+			break
+		}
+		v = obj[part]
+	}
+
+	if s, ok := v.(string); ok && m.TypeMapping[s] != nil {
+		return s
+	}
+
+	if m.DefaultType != "" {
+		return m.DefaultType
+	}
+	return "_default"
+}
+
+// CountDocTypes returns the total document count and the document
+// counts per mapping type of some bleve indexes.
+func CountDocTypes(bindexes []bleve.Index) (
+	uint64, map[string]uint64, error) {
+	var docCount uint64
+	counts := map[string]uint64{}
+
+	for _, bindex := range bindexes {
+		n, err := bindex.DocCount()
+		if err != nil {
+			return 0, nil, err
+		}
+		docCount += n
+
+		fd, err := bindex.FieldDict(DOC_TYPE_FIELD)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		for {
+			de, err := fd.Next()
+			if err != nil {
+				fd.Close()
+				return 0, nil, err
+			}
+			if de == nil {
+				break
+			}
+			counts[de.Term] += de.Count
+		}
+
+		fd.Close()
+	}
+
+	return docCount, counts, nil
+}
+
+// ---------------------------------------------------------
+
+// DocTypeCountsHandler is a REST handler that returns the document
+// counts per mapping type of an index with docTypeStats, based on the
+// index partitions on this node.
+type DocTypeCountsHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewDocTypeCountsHandler(mgr *cbgt.Manager) *DocTypeCountsHandler {
+	return &DocTypeCountsHandler{mgr: mgr}
+}
+
+func (h *DocTypeCountsHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	_, indexDefsByName, err := h.mgr.GetIndexDefs(false)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("doc_type_stats: could not"+
+			" retrieve index defs, err: %v", err), 500)
+		return
+	}
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil || indexDef.Type != "bleve" {
+		rest.ShowError(w, req, fmt.Sprintf("doc_type_stats: not a bleve"+
+			" index, indexName: %s", indexName), 400)
+		return
+	}
+	if !bleveIndexParams(h.mgr, indexName).DocTypeStats {
+		rest.ShowError(w, req, fmt.Sprintf("doc_type_stats: index: %s"+
+			" doesn't have docTypeStats enabled in its index params",
+			indexName), 400)
+		return
+	}
+
+	var bindexes []bleve.Index
+
+	_, pindexes := h.mgr.CurrentMaps()
+	for _, pindex := range pindexes {
+		if pindex.IndexName != indexName {
+			continue
+		}
+		bindex, ok := pindex.Impl.(bleve.Index)
+		if ok && bindex != nil {
+			bindexes = append(bindexes, bindex)
+		}
+	}
+
+	docCount, counts, err := CountDocTypes(bindexes)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("doc_type_stats: could not"+
+			" count doc types, indexName: %s, err: %v", indexName, err), 500)
+		return
+	}
+
+	// Documents of a disabled mapping type don't get a DOC_TYPE_FIELD
+	// term, so they're only visible as the difference from the doc
+	// count.
+	var counted uint64
+	for _, n := range counts {
+		counted += n
+	}
+	var uncounted uint64
+	if docCount > counted {
+		uncounted = docCount - counted
+	}
+
+	rest.MustEncode(w, struct {
+		Status        string            `json:"status"`
+		NumPIndexes   int               `json:"numPIndexes"`
+		DocCount      uint64            `json:"docCount"`
+		DocTypeCounts map[string]uint64 `json:"docTypeCounts"`
+		Uncounted     uint64            `json:"uncounted"`
+	}{
+		Status:        "ok",
+		NumPIndexes:   len(bindexes),
+		DocCount:      docCount,
+		DocTypeCounts: counts,
+		Uncounted:     uncounted,
+	})
+}
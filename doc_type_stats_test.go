@@ -0,0 +1,87 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+func docTypeStatsTestMapping() *bleve.IndexMapping {
+	m := bleve.NewIndexMapping()
+	m.TypeField = "meta.type"
+	m.AddDocumentMapping("beer", bleve.NewDocumentMapping())
+	m.AddDocumentMapping("brewery", bleve.NewDocumentMapping())
+	return m
+}
+
+func TestDocMappingType(t *testing.T) {
+	m := docTypeStatsTestMapping()
+
+	tests := []struct {
+		doc  string
+		want string
+	}{
+		{`{"meta":{"type":"beer"}}`, "beer"},
+		{`{"meta":{"type":"brewery"},"name":"x"}`, "brewery"},
+		{`{"meta":{"type":"wine"}}`, "_default"},
+		{`{"type":"beer"}`, "_default"},
+		{`{"meta":"beer"}`, "_default"},
+		{`[1,2]`, "_default"},
+	}
+
+	for i, test := range tests {
+		var v interface{}
+		json.Unmarshal([]byte(test.doc), &v)
+		got := docMappingType(m, v)
+		if got != test.want {
+			t.Errorf("%d: doc: %s, expected: %s, got: %s",
+				i, test.doc, test.want, got)
+		}
+	}
+}
+
+func TestCountDocTypes(t *testing.T) {
+	m := docTypeStatsTestMapping()
+	applyDocTypeMapping(m)
+
+	bindex, err := bleve.NewMemOnly(m)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	docs := map[string]string{
+		"a": `{"meta":{"type":"beer"}}`,
+		"b": `{"meta":{"type":"beer"}}`,
+		"c": `{"meta":{"type":"brewery"}}`,
+		"d": `{"meta":{"type":"wine"}}`,
+	}
+	for id, doc := range docs {
+		var v map[string]interface{}
+		json.Unmarshal([]byte(doc), &v)
+		v[DOC_TYPE_FIELD] = docMappingType(m, v)
+		bindex.Index(id, v)
+	}
+	bindex.Delete("b")
+
+	docCount, counts, err := CountDocTypes([]bleve.Index{bindex})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if docCount != 3 || len(counts) != 3 ||
+		counts["beer"] != 1 || counts["brewery"] != 1 ||
+		counts["_default"] != 1 {
+		t.Errorf("unexpected counts: %d, %v", docCount, counts)
+	}
+}
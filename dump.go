@@ -0,0 +1,208 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// DumpOptions controls the output of DumpPIndex.
+type DumpOptions struct {
+	// When true, the term dictionaries of the fields are dumped.
+	Terms bool
+
+	// When > 0, the max number of terms dumped per field.
+	TermsLimit int
+
+	// When non-empty, only the term dictionaries of these fields are
+	// dumped.
+	TermsFields []string
+}
+
+// DumpPIndexes writes a description of every pindex of a data
+// directory, or of a single pindex directory, for offline inspection
+// (such as when a node won't start).  The pindexes must not be in
+// use by a running node.
+func DumpPIndexes(w io.Writer, path string, opts DumpOptions) error {
+	if strings.HasSuffix(filepath.Clean(path), ".pindex") {
+		return DumpPIndex(w, path, opts)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(path, "*.pindex"))
+	if err != nil {
+		return err
+	}
+	if len(paths) <= 0 {
+		return fmt.Errorf("dump: no pindexes, path: %s", path)
+	}
+
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		err = DumpPIndex(w, p, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DumpPIndex writes a description of an offline bleve pindex
+// directory, which includes its doc count, fields, stored seq
+// checkpoints and, optionally, its term dictionaries.
+func DumpPIndex(w io.Writer, path string, opts DumpOptions) error {
+	fmt.Fprintf(w, "pindex: %s\n", path)
+
+	pindex := &cbgt.PIndex{}
+
+	buf, err := ioutil.ReadFile(path + string(os.PathSeparator) +
+		cbgt.PINDEX_META_FILENAME)
+	if err != nil {
+		fmt.Fprintf(w, "  meta: could not read, err: %v\n", err)
+	} else {
+		err = json.Unmarshal(buf, pindex)
+		if err != nil {
+			fmt.Fprintf(w, "  meta: could not parse, err: %v\n", err)
+		} else {
+			fmt.Fprintf(w, "  name: %s\n", pindex.Name)
+			fmt.Fprintf(w, "  indexType: %s\n", pindex.IndexType)
+			fmt.Fprintf(w, "  indexName: %s\n", pindex.IndexName)
+			fmt.Fprintf(w, "  indexUUID: %s\n", pindex.IndexUUID)
+			fmt.Fprintf(w, "  sourceType: %s\n", pindex.SourceType)
+			fmt.Fprintf(w, "  sourceName: %s\n", pindex.SourceName)
+		}
+	}
+
+	bindex, err := bleve.Open(path)
+	if err != nil {
+		return fmt.Errorf("dump: could not open bleve index,"+
+			" path: %s, err: %v", path, err)
+	}
+	defer bindex.Close()
+
+	docCount, err := bindex.DocCount()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "  docCount: %d\n", docCount)
+
+	fields, err := bindex.Fields()
+	if err != nil {
+		return err
+	}
+	sort.Strings(fields)
+	fmt.Fprintf(w, "  fields: %s\n", strings.Join(fields, ", "))
+
+	if pindex.SourcePartitions != "" {
+		fmt.Fprintf(w, "  partitions:\n")
+
+		for _, partition := range strings.Split(pindex.SourcePartitions, ",") {
+			seq, uuid, err := dumpCheckpoint(bindex, partition)
+			if err != nil {
+				fmt.Fprintf(w, "    %s: err: %v\n", partition, err)
+				continue
+			}
+			fmt.Fprintf(w, "    %s: seq: %d, uuid: %s\n",
+				partition, seq, uuid)
+		}
+	}
+
+	if opts.Terms {
+		termsFields := fields
+		if len(opts.TermsFields) > 0 {
+			termsFields = opts.TermsFields
+		}
+
+		for _, field := range termsFields {
+			err = dumpTerms(w, bindex, field, opts.TermsLimit)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// dumpCheckpoint returns the seq checkpoint of a partition, as stored
+// by a BleveDestPartition.
+func dumpCheckpoint(bindex bleve.Index,
+	partition string) (uint64, string, error) {
+	var seq uint64
+
+	buf, err := bindex.GetInternal([]byte(partition))
+	if err != nil {
+		return 0, "", err
+	}
+	if len(buf) == 8 {
+		seq = binary.BigEndian.Uint64(buf)
+	} else if len(buf) > 0 {
+		return 0, "", fmt.Errorf("unexpected size for seqMax bytes")
+	}
+
+	opaque, err := bindex.GetInternal([]byte("o:" + partition))
+	if err != nil {
+		return 0, "", err
+	}
+
+	return seq, cbgt.ParseOpaqueToUUID(opaque), nil
+}
+
+func dumpTerms(w io.Writer, bindex bleve.Index,
+	field string, limit int) error {
+	fmt.Fprintf(w, "  terms of field: %s\n", field)
+
+	fd, err := bindex.FieldDict(field)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	n := 0
+	for {
+		entry, err := fd.Next()
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			break
+		}
+
+		if limit > 0 && n >= limit {
+			fmt.Fprintf(w, "    ...\n")
+			break
+		}
+
+		term := entry.Term
+		if ok, _ := prefixCodedShift(term); ok {
+			term = fmt.Sprintf("%x", term) // Numeric terms are binary.
+		}
+
+		fmt.Fprintf(w, "    %q: %d\n", term, entry.Count)
+		n++
+	}
+
+	return nil
+}
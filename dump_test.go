@@ -0,0 +1,95 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestDumpPIndexes(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	var buf bytes.Buffer
+
+	err := DumpPIndexes(&buf, emptyDir, DumpOptions{})
+	if err == nil {
+		t.Errorf("expected err on a dir without pindexes")
+	}
+
+	path := filepath.Join(emptyDir, "idx_1234_5678.pindex")
+
+	_, dest, err := NewBlevePIndexImpl("bleve", "", path, nil)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	dest.SnapshotStart("0", 1, 3)
+	for i, color := range []string{"red", "green", "red"} {
+		dest.DataUpdate("0", []byte(fmt.Sprintf("doc-%d", i)), uint64(i+1),
+			[]byte(`{"color":"`+color+`"}`), 0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+	}
+	dest.Close()
+
+	meta, _ := json.Marshal(&cbgt.PIndex{
+		Name:             "idx_1234_5678",
+		IndexType:        "bleve",
+		IndexName:        "idx",
+		SourcePartitions: "0",
+	})
+	ioutil.WriteFile(filepath.Join(path, cbgt.PINDEX_META_FILENAME),
+		meta, 0600)
+
+	buf.Reset()
+
+	err = DumpPIndexes(&buf, emptyDir, DumpOptions{
+		Terms:       true,
+		TermsFields: []string{"color"},
+	})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	out := buf.String()
+	for _, exp := range []string{
+		"indexName: idx\n",
+		"docCount: 3\n",
+		"fields: color\n",
+		"0: seq: 3,",
+		"terms of field: color\n",
+		`"red": 2`,
+		`"green": 1`,
+	} {
+		if !strings.Contains(out, exp) {
+			t.Errorf("expected %q in output: %s", exp, out)
+		}
+	}
+
+	buf.Reset()
+
+	err = DumpPIndexes(&buf, path, DumpOptions{Terms: true, TermsLimit: 1})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if !strings.Contains(buf.String(), "    ...\n") {
+		t.Errorf("expected truncated terms, got: %s", buf.String())
+	}
+}
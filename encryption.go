@@ -0,0 +1,517 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/blevesearch/bleve/index/store"
+	bleveRegistry "github.com/blevesearch/bleve/registry"
+
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// When a node has an encryption key, the new bleve pindexes of the
+// node are stored through the ENCRYPTED_KVSTORE_NAME wrapper KVStore,
+// which encrypts the values of the KV rows (such as stored fields,
+// term vectors and back index rows) with AES-GCM before they reach
+// the actual KVStore, and decrypts them as they're read.  The keys of
+// the KV rows aren't encrypted, as bleve relies on their order for
+// its range and prefix iterations, so the indexed terms and document
+// ID's of an index are still visible on disk.  That is, the wrapper
+// alone doesn't keep the text of documents off disk, which needs an
+// encrypted filesystem underneath the data directory.
+//
+// The key comes from a provider of EncryptionKeyProviders, chosen by
+// the "encryptionKeyProvider" node option, which defaults to "file",
+// where the "encryptionKeyFile" node option is the path of a file
+// holding a hex encoded 32 byte (AES-256) key.  Other providers, such
+// as a KMIP client, can be registered before the node starts.
+
+const ENCRYPTED_KVSTORE_NAME = "cbft-encrypted"
+
+// An EncryptionKeyProvider returns the encryption key of a node, given
+// the node options, or a nil key when the node doesn't encrypt.
+type EncryptionKeyProvider func(options map[string]string) ([]byte, error)
+
+// EncryptionKeyProviders are the registered providers of encryption
+// keys, keyed by provider name.
+var EncryptionKeyProviders = map[string]EncryptionKeyProvider{
+	"file": EncryptionKeyFromFile,
+}
+
+var encryptionM sync.Mutex // Protects the fields that follow.
+var encryptionAEAD cipher.AEAD
+var encryptionKeyID string
+
+// The number of values that couldn't be decrypted, such as values
+// that were corrupted on disk.
+var encryptionDecryptErrors uint64
+
+func init() {
+	bleveRegistry.RegisterKVStore(ENCRYPTED_KVSTORE_NAME, newEncryptedStore)
+}
+
+// EncryptionStart loads the encryption key of the node, if any, from
+// the provider of the node options.  It must be invoked before any
+// pindexes are opened.
+func EncryptionStart(options map[string]string) error {
+	name := options["encryptionKeyProvider"]
+	if name == "" {
+		name = "file"
+	}
+
+	provider, exists := EncryptionKeyProviders[name]
+	if !exists || provider == nil {
+		return fmt.Errorf("encryption: unknown encryptionKeyProvider: %q",
+			name)
+	}
+
+	key, err := provider(options)
+	if err != nil {
+		return fmt.Errorf("encryption: provider: %s, err: %v", name, err)
+	}
+	if key == nil {
+		return nil
+	}
+
+	err = encryptionSetKey(key)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("encryption: enabled, provider: %s, keyID: %s,"+
+		" the indexed terms and doc ID's aren't encrypted",
+		name, EncryptionKeyID())
+
+	return nil
+}
+
+// EncryptionKeyFromFile is the "file" EncryptionKeyProvider, which
+// reads the hex encoded key at the "encryptionKeyFile" node option.
+func EncryptionKeyFromFile(options map[string]string) ([]byte, error) {
+	path := options["encryptionKeyFile"]
+	if path == "" {
+		return nil, nil
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return nil, fmt.Errorf("key file is not hex encoded,"+
+			" path: %s", path)
+	}
+
+	return key, nil
+}
+
+func encryptionSetKey(key []byte) error {
+	if len(key) != 32 {
+		return fmt.Errorf("encryption: key must be 32 bytes, got: %d",
+			len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(key)
+
+	encryptionM.Lock()
+	encryptionAEAD = aead
+	encryptionKeyID = hex.EncodeToString(sum[:8])
+	encryptionM.Unlock()
+
+	return nil
+}
+
+// EncryptionKeyID returns an identifier of the node's encryption key,
+// which is not secret, or "" when the node doesn't encrypt.
+func EncryptionKeyID() string {
+	encryptionM.Lock()
+	rv := encryptionKeyID
+	encryptionM.Unlock()
+	return rv
+}
+
+// EncryptionDecryptErrors returns the number of values that the node
+// couldn't decrypt.
+func EncryptionDecryptErrors() uint64 {
+	return atomic.LoadUint64(&encryptionDecryptErrors)
+}
+
+// EncryptionStatsHandler is a REST handler that returns the node's
+// encryption stats.
+type EncryptionStatsHandler struct{}
+
+func NewEncryptionStatsHandler() *EncryptionStatsHandler {
+	return &EncryptionStatsHandler{}
+}
+
+func (h *EncryptionStatsHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	rest.MustEncode(w, struct {
+		Status        string `json:"status"`
+		KeyID         string `json:"keyID"`
+		DecryptErrors uint64 `json:"decryptErrors"`
+	}{
+		Status:        "ok",
+		KeyID:         EncryptionKeyID(),
+		DecryptErrors: EncryptionDecryptErrors(),
+	})
+}
+
+// applyEncryptionKVConfig switches the KVStore config of a new bleve
+// pindex to the encrypted wrapper KVStore, when the node encrypts.
+func applyEncryptionKVConfig(kvStoreName string,
+	kvConfig map[string]interface{}) string {
+	keyID := EncryptionKeyID()
+	if keyID == "" || kvStoreName == ENCRYPTED_KVSTORE_NAME {
+		return kvStoreName
+	}
+
+	kvConfig["encrypted_kvStoreName_actual"] = kvStoreName
+	kvConfig["encryptionKeyID"] = keyID
+
+	return ENCRYPTED_KVSTORE_NAME
+}
+
+// ---------------------------------------------------------
+
+type encryptedStore struct {
+	o    store.KVStore
+	aead cipher.AEAD
+}
+
+func newEncryptedStore(mo store.MergeOperator,
+	config map[string]interface{}) (store.KVStore, error) {
+	name, ok := config["encrypted_kvStoreName_actual"].(string)
+	if !ok || name == "" {
+		return nil, fmt.Errorf("encryption: missing"+
+			" encrypted_kvStoreName_actual, config: %#v", config)
+	}
+	if name == ENCRYPTED_KVSTORE_NAME {
+		return nil, fmt.Errorf("encryption: circular" +
+			" encrypted_kvStoreName_actual")
+	}
+
+	ctr := bleveRegistry.KVStoreConstructorByName(name)
+	if ctr == nil {
+		return nil, fmt.Errorf("encryption: no kv store constructor,"+
+			" encrypted_kvStoreName_actual: %s", name)
+	}
+
+	encryptionM.Lock()
+	aead, keyID := encryptionAEAD, encryptionKeyID
+	encryptionM.Unlock()
+
+	if aead == nil {
+		return nil, fmt.Errorf("encryption: the pindex is encrypted," +
+			" but the node has no encryption key")
+	}
+	if config["encryptionKeyID"] != keyID {
+		return nil, fmt.Errorf("encryption: the pindex was encrypted"+
+			" with keyID: %v, but the node's keyID is: %s",
+			config["encryptionKeyID"], keyID)
+	}
+
+	s := &encryptedStore{aead: aead}
+
+	kvs, err := ctr(&encryptedMergeOperator{s: s, mo: mo}, config)
+	if err != nil {
+		return nil, err
+	}
+	s.o = kvs
+
+	return s, nil
+}
+
+// encrypt returns the nonce followed by the sealed value, where the
+// row key is authenticated along with the value, so that values can't
+// be swapped between rows.
+func (s *encryptedStore) encrypt(key, val []byte) []byte {
+	nonceSize := s.aead.NonceSize()
+	buf := make([]byte, nonceSize, nonceSize+len(val)+s.aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		panic(fmt.Sprintf("encryption: rand, err: %v", err))
+	}
+	return s.aead.Seal(buf, buf, val, key)
+}
+
+// decrypt returns the value of a row, where a value that can't be
+// decrypted is logged and counted.
+func (s *encryptedStore) decrypt(key, val []byte) ([]byte, error) {
+	if val == nil {
+		return nil, nil
+	}
+	nonceSize := s.aead.NonceSize()
+	if len(val) < nonceSize {
+		err := fmt.Errorf("encryption: short value, key: %q", key)
+		atomic.AddUint64(&encryptionDecryptErrors, 1)
+		log.Printf("%v", err)
+		return nil, err
+	}
+	rv, err := s.aead.Open(nil, val[:nonceSize], val[nonceSize:], key)
+	if err != nil {
+		err = fmt.Errorf("encryption: could not decrypt,"+
+			" key: %q, err: %v", key, err)
+		atomic.AddUint64(&encryptionDecryptErrors, 1)
+		log.Printf("%v", err)
+		return nil, err
+	}
+	if rv == nil {
+		rv = []byte{}
+	}
+	return rv, nil
+}
+
+func (s *encryptedStore) Close() error {
+	return s.o.Close()
+}
+
+func (s *encryptedStore) Reader() (store.KVReader, error) {
+	r, err := s.o.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedReader{s: s, o: r}, nil
+}
+
+func (s *encryptedStore) Writer() (store.KVWriter, error) {
+	w, err := s.o.Writer()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedWriter{s: s, o: w}, nil
+}
+
+// ---------------------------------------------------------
+
+type encryptedReader struct {
+	s *encryptedStore
+	o store.KVReader
+}
+
+func (r *encryptedReader) Get(key []byte) ([]byte, error) {
+	val, err := r.o.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return r.s.decrypt(key, val)
+}
+
+func (r *encryptedReader) MultiGet(keys [][]byte) ([][]byte, error) {
+	vals := make([][]byte, len(keys))
+	for i, key := range keys {
+		val, err := r.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = val
+	}
+	return vals, nil
+}
+
+func (r *encryptedReader) PrefixIterator(prefix []byte) store.KVIterator {
+	return &encryptedIterator{s: r.s, o: r.o.PrefixIterator(prefix)}
+}
+
+func (r *encryptedReader) RangeIterator(start, end []byte) store.KVIterator {
+	return &encryptedIterator{s: r.s, o: r.o.RangeIterator(start, end)}
+}
+
+func (r *encryptedReader) Close() error {
+	return r.o.Close()
+}
+
+// ---------------------------------------------------------
+
+// An encryptedIterator decrypts the value of its current row.  As the
+// iterator API can't return errors, a value that can't be decrypted
+// ends the iteration, and the error is returned by Close(), so that
+// the reads of incomplete iterations fail.
+type encryptedIterator struct {
+	s   *encryptedStore
+	o   store.KVIterator
+	err error // The first decryption error.
+}
+
+func (i *encryptedIterator) Seek(key []byte) { i.o.Seek(key) }
+func (i *encryptedIterator) Next()           { i.o.Next() }
+func (i *encryptedIterator) Key() []byte     { return i.o.Key() }
+
+func (i *encryptedIterator) Valid() bool {
+	return i.err == nil && i.o.Valid()
+}
+
+func (i *encryptedIterator) Close() error {
+	err := i.o.Close()
+	if i.err != nil {
+		return i.err
+	}
+	return err
+}
+
+func (i *encryptedIterator) Value() []byte {
+	_, val, _ := i.Current()
+	return val
+}
+
+func (i *encryptedIterator) Current() ([]byte, []byte, bool) {
+	if i.err != nil {
+		return nil, nil, false
+	}
+	key, val, valid := i.o.Current()
+	if !valid {
+		return key, val, valid
+	}
+	val, err := i.s.decrypt(key, val)
+	if err != nil {
+		i.err = err
+		return nil, nil, false
+	}
+	return key, val, true
+}
+
+// ---------------------------------------------------------
+
+type encryptedWriter struct {
+	s *encryptedStore
+	o store.KVWriter
+}
+
+func (w *encryptedWriter) NewBatch() store.KVBatch {
+	return &encryptedBatch{s: w.s, o: w.o.NewBatch()}
+}
+
+// NewBatchEx provides its own buffer, as the values grow when they're
+// encrypted, so the actual KVStore's buffer would be too small.
+func (w *encryptedWriter) NewBatchEx(options store.KVBatchOptions) (
+	[]byte, store.KVBatch, error) {
+	return make([]byte, options.TotalBytes), w.NewBatch(), nil
+}
+
+func (w *encryptedWriter) ExecuteBatch(batch store.KVBatch) error {
+	b, ok := batch.(*encryptedBatch)
+	if !ok {
+		return fmt.Errorf("encryption: wrong type of batch")
+	}
+	return w.o.ExecuteBatch(b.o)
+}
+
+func (w *encryptedWriter) Close() error {
+	return w.o.Close()
+}
+
+// ---------------------------------------------------------
+
+type encryptedBatch struct {
+	s *encryptedStore
+	o store.KVBatch
+}
+
+func (b *encryptedBatch) Set(key, val []byte) {
+	b.o.Set(key, b.s.encrypt(key, val))
+}
+
+func (b *encryptedBatch) Delete(key []byte) {
+	b.o.Delete(key)
+}
+
+func (b *encryptedBatch) Merge(key, val []byte) {
+	b.o.Merge(key, b.s.encrypt(key, val))
+}
+
+func (b *encryptedBatch) Reset() {
+	b.o.Reset()
+}
+
+func (b *encryptedBatch) Close() error {
+	return b.o.Close()
+}
+
+// ---------------------------------------------------------
+
+// An encryptedMergeOperator is handed to the actual KVStore, which
+// only sees encrypted values, so it decrypts the values around the
+// MergeOperator of the index.
+type encryptedMergeOperator struct {
+	s  *encryptedStore
+	mo store.MergeOperator
+}
+
+func (m *encryptedMergeOperator) FullMerge(key, existingValue []byte,
+	operands [][]byte) ([]byte, bool) {
+	existing, err := m.s.decrypt(key, existingValue)
+	if err != nil {
+		return nil, false
+	}
+
+	ops := make([][]byte, len(operands))
+	for i, operand := range operands {
+		ops[i], err = m.s.decrypt(key, operand)
+		if err != nil {
+			return nil, false
+		}
+	}
+
+	rv, ok := m.mo.FullMerge(key, existing, ops)
+	if !ok {
+		return nil, false
+	}
+	return m.s.encrypt(key, rv), true
+}
+
+func (m *encryptedMergeOperator) PartialMerge(key, leftOperand,
+	rightOperand []byte) ([]byte, bool) {
+	left, err := m.s.decrypt(key, leftOperand)
+	if err != nil {
+		return nil, false
+	}
+	right, err := m.s.decrypt(key, rightOperand)
+	if err != nil {
+		return nil, false
+	}
+
+	rv, ok := m.mo.PartialMerge(key, left, right)
+	if !ok {
+		return nil, false
+	}
+	return m.s.encrypt(key, rv), true
+}
+
+func (m *encryptedMergeOperator) Name() string {
+	return m.mo.Name()
+}
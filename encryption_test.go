@@ -0,0 +1,294 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bleveRegistry "github.com/blevesearch/bleve/registry"
+)
+
+const testEncryptionKey = "000102030405060708090a0b0c0d0e0f" +
+	"101112131415161718191a1b1c1d1e1f"
+
+func encryptionReset() {
+	encryptionM.Lock()
+	encryptionAEAD = nil
+	encryptionKeyID = ""
+	encryptionM.Unlock()
+}
+
+func TestEncryptionStart(t *testing.T) {
+	defer encryptionReset()
+
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	err := EncryptionStart(map[string]string{})
+	if err != nil || EncryptionKeyID() != "" {
+		t.Errorf("expected no encryption without a key file, err: %v", err)
+	}
+
+	err = EncryptionStart(map[string]string{"encryptionKeyProvider": "x"})
+	if err == nil {
+		t.Errorf("expected err on an unknown provider")
+	}
+
+	for _, key := range []string{"not-hex", "0011"} {
+		path := filepath.Join(dir, "bad.key")
+		ioutil.WriteFile(path, []byte(key), 0600)
+
+		err = EncryptionStart(map[string]string{"encryptionKeyFile": path})
+		if err == nil {
+			t.Errorf("expected err on a bad key: %s", key)
+		}
+	}
+
+	path := filepath.Join(dir, "node.key")
+	ioutil.WriteFile(path, []byte(testEncryptionKey+"\n"), 0600)
+
+	err = EncryptionStart(map[string]string{"encryptionKeyFile": path})
+	if err != nil || len(EncryptionKeyID()) != 16 {
+		t.Errorf("expected a key, got: %q, err: %v", EncryptionKeyID(), err)
+	}
+
+	kvConfig := map[string]interface{}{}
+	name := applyEncryptionKVConfig("boltdb", kvConfig)
+	if name != ENCRYPTED_KVSTORE_NAME ||
+		kvConfig["encrypted_kvStoreName_actual"] != "boltdb" ||
+		kvConfig["encryptionKeyID"] != EncryptionKeyID() {
+		t.Errorf("expected an encrypted kv config, got: %s, %v",
+			name, kvConfig)
+	}
+}
+
+// appendMergeOperator merges by appending the operands.
+type appendMergeOperator struct{}
+
+func (m *appendMergeOperator) FullMerge(key, existingValue []byte,
+	operands [][]byte) ([]byte, bool) {
+	rv := append([]byte(nil), existingValue...)
+	for _, operand := range operands {
+		rv = append(rv, operand...)
+	}
+	return rv, true
+}
+
+func (m *appendMergeOperator) PartialMerge(key, leftOperand,
+	rightOperand []byte) ([]byte, bool) {
+	return append(append([]byte(nil), leftOperand...), rightOperand...), true
+}
+
+func (m *appendMergeOperator) Name() string { return "append" }
+
+func TestEncryptedStore(t *testing.T) {
+	defer encryptionReset()
+
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	config := map[string]interface{}{
+		"encrypted_kvStoreName_actual": "boltdb",
+		"path":                         filepath.Join(dir, "store"),
+	}
+
+	_, err := newEncryptedStore(&appendMergeOperator{}, config)
+	if err == nil {
+		t.Errorf("expected err without a node key")
+	}
+
+	key, _ := hex.DecodeString(testEncryptionKey)
+	err = encryptionSetKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newEncryptedStore(&appendMergeOperator{}, config)
+	if err == nil {
+		t.Errorf("expected err on a mismatched keyID")
+	}
+
+	config["encryptionKeyID"] = EncryptionKeyID()
+
+	kvs, err := newEncryptedStore(&appendMergeOperator{}, config)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	defer kvs.Close()
+
+	w, _ := kvs.Writer()
+	b := w.NewBatch()
+	b.Set([]byte("a"), []byte("secret-a"))
+	b.Set([]byte("b"), []byte("secret-b"))
+	b.Set([]byte("c"), []byte{})
+	err = w.ExecuteBatch(b)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	b = w.NewBatch()
+	b.Merge([]byte("b"), []byte("+more"))
+	err = w.ExecuteBatch(b)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	w.Close()
+
+	r, _ := kvs.Reader()
+	defer r.Close()
+
+	val, err := r.Get([]byte("b"))
+	if err != nil || string(val) != "secret-b+more" {
+		t.Errorf("expected a merged value, got: %q, err: %v", val, err)
+	}
+	val, err = r.Get([]byte("missing"))
+	if err != nil || val != nil {
+		t.Errorf("expected no value, got: %q, err: %v", val, err)
+	}
+
+	vals, err := r.MultiGet([][]byte{[]byte("a"), []byte("c")})
+	if err != nil || string(vals[0]) != "secret-a" ||
+		vals[1] == nil || len(vals[1]) != 0 {
+		t.Errorf("expected values, got: %q, err: %v", vals, err)
+	}
+
+	var got []string
+	i := r.PrefixIterator([]byte(""))
+	for ; i.Valid(); i.Next() {
+		got = append(got, string(i.Key())+"="+string(i.Value()))
+	}
+	i.Close()
+	if strings.Join(got, ",") != "a=secret-a,b=secret-b+more,c=" {
+		t.Errorf("unexpected iteration: %v", got)
+	}
+
+	// The actual store only has ciphertext.
+	ro, _ := kvs.(*encryptedStore).o.Reader()
+	defer ro.Close()
+
+	val, _ = ro.Get([]byte("a"))
+	if val == nil || bytes.Contains(val, []byte("secret")) {
+		t.Errorf("expected an encrypted value, got: %q", val)
+	}
+
+	// A value can't be moved to another row.
+	_, err = kvs.(*encryptedStore).decrypt([]byte("b"), val)
+	if err == nil {
+		t.Errorf("expected err on a value of another row")
+	}
+}
+
+func TestEncryptedIteratorDecryptError(t *testing.T) {
+	defer encryptionReset()
+
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	key, _ := hex.DecodeString(testEncryptionKey)
+	err := encryptionSetKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kvs, err := newEncryptedStore(&appendMergeOperator{},
+		map[string]interface{}{
+			"encrypted_kvStoreName_actual": "boltdb",
+			"encryptionKeyID":              EncryptionKeyID(),
+			"path":                         filepath.Join(dir, "store"),
+		})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	defer kvs.Close()
+
+	w, _ := kvs.Writer()
+	b := w.NewBatch()
+	b.Set([]byte("a"), []byte("secret-a"))
+	b.Set([]byte("c"), []byte("secret-c"))
+	w.ExecuteBatch(b)
+	w.Close()
+
+	// A corrupted value, written directly to the actual store.
+	wo, _ := kvs.(*encryptedStore).o.Writer()
+	bo := wo.NewBatch()
+	bo.Set([]byte("b"), []byte("not-an-encrypted-value"))
+	wo.ExecuteBatch(bo)
+	wo.Close()
+
+	before := EncryptionDecryptErrors()
+
+	r, _ := kvs.Reader()
+	defer r.Close()
+
+	var got []string
+	i := r.PrefixIterator([]byte(""))
+	for ; i.Valid(); i.Next() {
+		k, v, valid := i.Current()
+		if !valid {
+			break
+		}
+		got = append(got, string(k)+"="+string(v))
+	}
+	if strings.Join(got, ",") != "a=secret-a" {
+		t.Errorf("expected the iteration to stop, got: %v", got)
+	}
+	if i.Valid() {
+		t.Errorf("expected an invalid iterator after a decrypt error")
+	}
+	if i.Close() == nil {
+		t.Errorf("expected the decrypt error from Close")
+	}
+	if EncryptionDecryptErrors() != before+1 {
+		t.Errorf("expected a counted decrypt error")
+	}
+}
+
+func TestEncryptedPIndex(t *testing.T) {
+	defer encryptionReset()
+
+	if bleveRegistry.KVStoreConstructorByName(ENCRYPTED_KVSTORE_NAME) == nil {
+		t.Fatalf("expected a registered kv store")
+	}
+
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	key, _ := hex.DecodeString(testEncryptionKey)
+	encryptionSetKey(key)
+
+	path := filepath.Join(dir, "idx_1234_5678.pindex")
+
+	_, dest, err := NewBlevePIndexImpl("bleve", "", path, nil)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	dest.Close()
+
+	_, dest, err = OpenBlevePIndexImpl("bleve", path, nil)
+	if err != nil {
+		t.Fatalf("expected a reopened pindex, got err: %v", err)
+	}
+	dest.Close()
+
+	encryptionReset()
+
+	_, _, err = OpenBlevePIndexImpl("bleve", path, nil)
+	if err == nil {
+		t.Errorf("expected err on opening without the key")
+	}
+}
@@ -0,0 +1,113 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/blevesearch/bleve"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// Expired documents are normally removed from a bleve index when the
+// data source feed delivers their expiration events, which arrive as
+// deletions.  But a data source only expires a document lazily, when
+// the document is next accessed or when the data source's expiry
+// pager runs, so an expiry-aware bleve index also records the expiry
+// time of each document in the EXPIRY_FIELD and periodically sweeps
+// away the documents whose expiry time has passed, so that searches
+// don't return dead documents in the meantime.
+
+// The numeric field where an expiry-aware bleve index records the
+// expiry time of a document, in seconds since the unix epoch.
+const EXPIRY_FIELD = "$expiry"
+
+// How often an expiry-aware bleve index sweeps away expired
+// documents.
+var ExpirySweepInterval = time.Minute
+
+// dcpExtrasExpiry returns the expiry time, in seconds since the unix
+// epoch, of a DCP mutation, where 0 means no expiry.  The DCP
+// mutation extras are the by_seqno (8 bytes), rev_seqno (8 bytes),
+// flags (4 bytes) and expiration (4 bytes), followed by other fields.
+func dcpExtrasExpiry(extrasType cbgt.DestExtrasType, extras []byte) uint32 {
+	if extrasType != cbgt.DEST_EXTRAS_TYPE_DCP || len(extras) < 24 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(extras[20:24])
+}
+
+// applyExpiryMapping adds a numeric EXPIRY_FIELD mapping to the
+// default mapping and type mappings of an index mapping, so that the
+// sweep can search on it even when the mappings aren't dynamic.
+func applyExpiryMapping(m *bleve.IndexMapping) {
+	add := func(dm *bleve.DocumentMapping) {
+		if dm == nil {
+			return
+		}
+		fm := bleve.NewNumericFieldMapping()
+		fm.Store = false
+		fm.IncludeInAll = false
+		dm.AddFieldMappingsAt(EXPIRY_FIELD, fm)
+	}
+
+	add(m.DefaultMapping)
+	for _, dm := range m.TypeMapping {
+		add(dm)
+	}
+}
+
+// expiryQuery returns the JSON of a query for the documents that
+// have expired as of a time.
+func expiryQuery(now time.Time) []byte {
+	return []byte(fmt.Sprintf(`{"min":1,"max":%d,"field":%q}`,
+		now.Unix()+1, EXPIRY_FIELD))
+}
+
+// runExpirySweep periodically sweeps away the expired documents of
+// a BleveDest, until the BleveDest is closed.
+func (t *BleveDest) runExpirySweep() {
+	for {
+		time.Sleep(ExpirySweepInterval)
+
+		if IsFrozen(t.indexName) {
+			continue
+		}
+
+		n, err := t.sweepExpired(time.Now())
+		if err == errBleveDestClosed {
+			return
+		}
+		if err != nil {
+			log.Printf("expiry: sweep, path: %s, err: %v", t.path, err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("expiry: sweep, path: %s, removed: %d", t.path, n)
+		}
+	}
+}
+
+// sweepExpired removes the documents that have expired as of a time,
+// returning the number of removed documents.
+func (t *BleveDest) sweepExpired(now time.Time) (int, error) {
+	q, err := bleve.ParseQuery(expiryQuery(now))
+	if err != nil {
+		return 0, err
+	}
+	return t.deleteMatching(q, false)
+}
@@ -0,0 +1,86 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestDCPExtrasExpiry(t *testing.T) {
+	extras := make([]byte, 31)
+	binary.BigEndian.PutUint32(extras[20:24], 1435708800)
+
+	if dcpExtrasExpiry(cbgt.DEST_EXTRAS_TYPE_DCP, extras) != 1435708800 {
+		t.Errorf("expected the expiry from the extras")
+	}
+	if dcpExtrasExpiry(cbgt.DEST_EXTRAS_TYPE_NIL, extras) != 0 {
+		t.Errorf("expected no expiry without DCP extras")
+	}
+	if dcpExtrasExpiry(cbgt.DEST_EXTRAS_TYPE_DCP, extras[:20]) != 0 {
+		t.Errorf("expected no expiry with short extras")
+	}
+}
+
+func TestSweepExpired(t *testing.T) {
+	m := bleve.NewIndexMapping()
+	applyExpiryMapping(m)
+
+	if m.DefaultMapping.Properties[EXPIRY_FIELD] == nil {
+		t.Fatalf("expected an expiry field mapping")
+	}
+
+	bindex, err := bleve.NewMemOnly(m)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	now := time.Unix(1435708800, 0)
+
+	bindex.Index("dead", map[string]interface{}{
+		"a": "x", EXPIRY_FIELD: float64(now.Unix() - 10)})
+	bindex.Index("dying", map[string]interface{}{
+		"a": "x", EXPIRY_FIELD: float64(now.Unix())})
+	bindex.Index("alive", map[string]interface{}{
+		"a": "x", EXPIRY_FIELD: float64(now.Unix() + 10)})
+	bindex.Index("forever", map[string]interface{}{"a": "x"})
+
+	dest := NewBleveDest("/tmp/idx_1234_5678.pindex", bindex, func() {})
+
+	n, err := dest.sweepExpired(now)
+	if err != nil || n != 2 {
+		t.Errorf("expected 2 removed, got: %d, err: %v", n, err)
+	}
+
+	count, _ := bindex.DocCount()
+	if count != 2 {
+		t.Errorf("expected 2 remaining docs, got: %d", count)
+	}
+	for _, id := range []string{"alive", "forever"} {
+		doc, _ := bindex.Document(id)
+		if doc == nil {
+			t.Errorf("expected doc: %s to remain", id)
+		}
+	}
+
+	dest.Close()
+
+	_, err = dest.sweepExpired(now)
+	if err != errBleveDestClosed {
+		t.Errorf("expected errBleveDestClosed, got: %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/numeric_util"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// Facet suggestions analyze the term dictionaries of an index's
+// fields to suggest which fields are good facet candidates (keyword
+// like fields of low to medium cardinality) and to warn about fields
+// that are poor candidates (high cardinality or free text fields),
+// since faceting on those is slow and rarely useful.
+
+// Fields with more distinct terms than this are high cardinality.
+var FacetSuggestMaxCardinality = 1000
+
+// Fields with more terms per document than this are free text.
+var FacetSuggestMaxTermsPerDoc = 2.0
+
+// The max number of distinct terms counted per field, to bound the
+// memory and time of the analysis.
+var FacetSuggestMaxTerms = 100000
+
+const (
+	FACET_SUGGEST_GOOD    = "good"
+	FACET_SUGGEST_NUMERIC = "numeric"
+	FACET_SUGGEST_WARN    = "warn"
+)
+
+// FacetSuggestion is the analysis of a single field.
+type FacetSuggestion struct {
+	Field string `json:"field"`
+
+	// The number of distinct terms, where CardinalityCapped means
+	// counting stopped at FacetSuggestMaxTerms.
+	Cardinality       int  `json:"cardinality"`
+	CardinalityCapped bool `json:"cardinalityCapped,omitempty"`
+
+	AvgTermsPerDoc float64 `json:"avgTermsPerDoc"`
+	Numeric        bool    `json:"numeric,omitempty"`
+
+	// One of FACET_SUGGEST_GOOD, FACET_SUGGEST_NUMERIC or
+	// FACET_SUGGEST_WARN, along with the reason.
+	Suggestion string `json:"suggestion"`
+	Reason     string `json:"reason"`
+}
+
+// SuggestFacets analyzes the fields of the given bleve indexes, which
+// are usually the partitions of a single logical index, returning the
+// suggestions with the good candidates first.
+func SuggestFacets(bindexes []bleve.Index) (
+	docCount uint64, rv []*FacetSuggestion, err error) {
+	fieldTerms := map[string]map[string]bool{}
+	fieldCapped := map[string]bool{}
+	fieldNumeric := map[string]bool{}
+	fieldTermDocs := map[string]uint64{}
+
+	for _, bindex := range bindexes {
+		n, err := bindex.DocCount()
+		if err != nil {
+			return 0, nil, err
+		}
+		docCount += n
+
+		fields, err := bindex.Fields()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		for _, field := range fields {
+			if strings.HasPrefix(field, "_") {
+				continue // Skip internal fields like _all.
+			}
+
+			terms := fieldTerms[field]
+			if terms == nil {
+				terms = map[string]bool{}
+				fieldTerms[field] = terms
+				fieldNumeric[field] = true
+			}
+
+			fd, err := bindex.FieldDict(field)
+			if err != nil {
+				return 0, nil, err
+			}
+
+			for {
+				de, err := fd.Next()
+				if err != nil {
+					fd.Close()
+					return 0, nil, err
+				}
+				if de == nil {
+					break
+				}
+
+				numericTerm, shift := prefixCodedShift(de.Term)
+				if !numericTerm {
+					fieldNumeric[field] = false
+				} else if shift != 0 {
+					continue // Only count full precision numeric terms.
+				}
+
+				fieldTermDocs[field] += de.Count
+
+				if len(terms) < FacetSuggestMaxTerms {
+					terms[de.Term] = true
+				} else if !terms[de.Term] {
+					fieldCapped[field] = true
+				}
+			}
+
+			fd.Close()
+		}
+	}
+
+	for field, terms := range fieldTerms {
+		if len(terms) <= 0 {
+			continue
+		}
+
+		fs := &FacetSuggestion{
+			Field:             field,
+			Cardinality:       len(terms),
+			CardinalityCapped: fieldCapped[field],
+			Numeric:           fieldNumeric[field],
+		}
+		if docCount > 0 {
+			fs.AvgTermsPerDoc = float64(fieldTermDocs[field]) /
+				float64(docCount)
+		}
+
+		switch {
+		case fs.Numeric:
+			fs.Suggestion = FACET_SUGGEST_NUMERIC
+			fs.Reason = "numeric or date field; use a numeric_ranges" +
+				" or date_ranges facet"
+		case fs.AvgTermsPerDoc > FacetSuggestMaxTermsPerDoc:
+			fs.Suggestion = FACET_SUGGEST_WARN
+			fs.Reason = fmt.Sprintf("free text field, with %.1f terms"+
+				" per doc; facet on a keyword analyzed field instead",
+				fs.AvgTermsPerDoc)
+		case fs.Cardinality > FacetSuggestMaxCardinality:
+			fs.Suggestion = FACET_SUGGEST_WARN
+			fs.Reason = fmt.Sprintf("high cardinality field, with more"+
+				" than %d distinct terms", FacetSuggestMaxCardinality)
+		default:
+			fs.Suggestion = FACET_SUGGEST_GOOD
+			fs.Reason = "keyword like field of low to medium cardinality"
+		}
+
+		rv = append(rv, fs)
+	}
+
+	sort.Sort(facetSuggestions(rv))
+
+	return docCount, rv, nil
+}
+
+// prefixCodedShift returns true, along with the shift, if a term
+// looks like a bleve prefix coded numeric term.
+func prefixCodedShift(term string) (bool, uint) {
+	if len(term) < 2 || term[0] < numeric_util.ShiftStartInt64 {
+		return false, 0
+	}
+	pc := numeric_util.PrefixCoded(term)
+	shift, err := pc.Shift()
+	if err != nil || shift > 63 || len(term) != int((63-shift)/7)+2 {
+		return false, 0
+	}
+	for i := 1; i < len(term); i++ {
+		if term[i] >= 0x80 {
+			return false, 0
+		}
+	}
+	if _, err = pc.Int64(); err != nil {
+		return false, 0
+	}
+	return true, shift
+}
+
+var facetSuggestionRank = map[string]int{
+	FACET_SUGGEST_GOOD:    0,
+	FACET_SUGGEST_NUMERIC: 1,
+	FACET_SUGGEST_WARN:    2,
+}
+
+type facetSuggestions []*FacetSuggestion
+
+func (a facetSuggestions) Len() int {
+	return len(a)
+}
+
+func (a facetSuggestions) Less(i, j int) bool {
+	ri := facetSuggestionRank[a[i].Suggestion]
+	rj := facetSuggestionRank[a[j].Suggestion]
+	if ri != rj {
+		return ri < rj
+	}
+	if a[i].Cardinality != a[j].Cardinality {
+		return a[i].Cardinality < a[j].Cardinality
+	}
+	return a[i].Field < a[j].Field
+}
+
+func (a facetSuggestions) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+// ---------------------------------------------------------
+
+// FacetSuggestHandler is a REST handler that returns the facet
+// suggestions for an index, based on the index's pindexes that are
+// on this node.
+type FacetSuggestHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewFacetSuggestHandler(mgr *cbgt.Manager) *FacetSuggestHandler {
+	return &FacetSuggestHandler{mgr: mgr}
+}
+
+func (h *FacetSuggestHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	_, indexDefsByName, err := h.mgr.GetIndexDefs(false)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("facet_suggest: could not"+
+			" retrieve index defs, err: %v", err), 500)
+		return
+	}
+	if indexDefsByName[indexName] == nil {
+		rest.ShowError(w, req, fmt.Sprintf("facet_suggest: not an index,"+
+			" indexName: %s", indexName), 400)
+		return
+	}
+
+	var bindexes []bleve.Index
+
+	_, pindexes := h.mgr.CurrentMaps()
+	for _, pindex := range pindexes {
+		if pindex.IndexName != indexName {
+			continue
+		}
+		bindex, ok := pindex.Impl.(bleve.Index)
+		if ok && bindex != nil {
+			bindexes = append(bindexes, bindex)
+		}
+	}
+
+	docCount, suggestions, err := SuggestFacets(bindexes)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("facet_suggest: could not"+
+			" analyze fields, indexName: %s, err: %v", indexName, err), 500)
+		return
+	}
+	if suggestions == nil {
+		suggestions = []*FacetSuggestion{}
+	}
+
+	rest.MustEncode(w, struct {
+		Status      string             `json:"status"`
+		NumPIndexes int                `json:"numPIndexes"`
+		DocCount    uint64             `json:"docCount"`
+		Suggestions []*FacetSuggestion `json:"suggestions"`
+	}{
+		Status:      "ok",
+		NumPIndexes: len(bindexes),
+		DocCount:    docCount,
+		Suggestions: suggestions,
+	})
+}
@@ -0,0 +1,85 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/numeric_util"
+)
+
+func TestPrefixCodedShift(t *testing.T) {
+	for _, shift := range []uint{0, 4, 60} {
+		pc, _ := numeric_util.NewPrefixCodedInt64(12345, shift)
+		ok, actual := prefixCodedShift(string(pc))
+		if !ok || actual != shift {
+			t.Errorf("expected numeric term, shift: %d, got: %v, %d",
+				shift, ok, actual)
+		}
+	}
+
+	for _, term := range []string{"", "a", "red", "ABCDEF"} {
+		if ok, _ := prefixCodedShift(term); ok {
+			t.Errorf("expected non-numeric term: %q", term)
+		}
+	}
+}
+
+func TestSuggestFacets(t *testing.T) {
+	bindex, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	defer bindex.Close()
+
+	colors := []string{"red", "green", "blue"}
+
+	for i := 0; i < 30; i++ {
+		err = bindex.Index(fmt.Sprintf("doc%d", i), map[string]interface{}{
+			"color": colors[i%len(colors)],
+			"desc": fmt.Sprintf("the quick brown fox %d jumped over"+
+				" the lazy dog %d", i, i*7),
+			"price": i,
+		})
+		if err != nil {
+			t.Fatalf("expected no err, got: %v", err)
+		}
+	}
+
+	docCount, suggestions, err := SuggestFacets([]bleve.Index{bindex})
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	if docCount != 30 {
+		t.Errorf("expected docCount 30, got: %d", docCount)
+	}
+
+	exp := map[string]string{
+		"color": FACET_SUGGEST_GOOD,
+		"price": FACET_SUGGEST_NUMERIC,
+		"desc":  FACET_SUGGEST_WARN,
+	}
+	if len(suggestions) != len(exp) {
+		t.Fatalf("expected %d suggestions, got: %#v", len(exp), suggestions)
+	}
+	for _, fs := range suggestions {
+		if exp[fs.Field] != fs.Suggestion {
+			t.Errorf("expected %s for field %s, got: %#v",
+				exp[fs.Field], fs.Field, fs)
+		}
+	}
+	if suggestions[0].Field != "color" || suggestions[0].Cardinality != 3 {
+		t.Errorf("expected color first, got: %#v", suggestions[0])
+	}
+}
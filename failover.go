@@ -0,0 +1,349 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// Automatic failover is enabled by starting the nodes with the
+// failoverGracePeriod node option, like "failoverGracePeriod=30s".
+// Every node then health checks the other wanted nodes, and when a
+// node has been unreachable for longer than the grace period, the
+// node is failed over...
+//
+//   1) in the plan, the replica copies of the failed node's primary
+//      pindexes are promoted to primaries, and the failed node is
+//      removed from the pindexes that have other copies, so that
+//      queries are immediately served by the replicas;
+//   2) the failed node is unregistered (removed from the wanted
+//      nodes), so that the planner replaces the lost copies.
+//
+// To avoid racing failovers, only the reachable node with the lowest
+// UUID acts, and only when it can reach a majority of the wanted
+// nodes (itself included), so that a partitioned node doesn't fail
+// over the rest of the cluster.
+
+// How often a node health checks the other wanted nodes.
+var FailoverCheckInterval = 5 * time.Second
+
+// The max number of recent failovers that are kept for /api/failover.
+var FailoverMaxRecent = 20
+
+// FailoverNodeStatus is a node's view of the health of another node.
+type FailoverNodeStatus struct {
+	HostPort  string `json:"hostPort"`
+	Health    string `json:"health"`
+	DownSince string `json:"downSince,omitempty"`
+}
+
+// FailoverEvent records a failover of a node.
+type FailoverEvent struct {
+	NodeUUID string `json:"nodeUUID"`
+	HostPort string `json:"hostPort"`
+	Time     string `json:"time"`
+	Promoted int    `json:"promoted"` // Number of promoted replicas.
+	Lost     int    `json:"lost"`     // Number of pindexes with no copies left.
+	Error    string `json:"error,omitempty"`
+}
+
+var failoverM sync.Mutex // Protects the fields that follow.
+
+var failoverGracePeriod time.Duration
+
+var failoverDownSince = map[string]time.Time{} // Keyed by node UUID.
+
+var failoverNodes = map[string]*FailoverNodeStatus{} // Keyed by node UUID.
+
+var failoverRecent []*FailoverEvent
+
+// FailoverStart starts the health check loop of a node, if the node
+// has a failoverGracePeriod option.
+func FailoverStart(mgr *cbgt.Manager) error {
+	v := mgr.Options()["failoverGracePeriod"]
+	if v == "" {
+		return nil
+	}
+
+	gracePeriod, err := time.ParseDuration(v)
+	if err != nil || gracePeriod <= 0 {
+		return fmt.Errorf("failover: bad failoverGracePeriod: %q", v)
+	}
+
+	failoverM.Lock()
+	failoverGracePeriod = gracePeriod
+	failoverM.Unlock()
+
+	go func() {
+		for {
+			time.Sleep(FailoverCheckInterval)
+
+			err := FailoverCheck(mgr, gracePeriod, time.Now())
+			if err != nil {
+				log.Printf("failover: check, err: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// FailoverCheck health checks the other wanted nodes once, failing
+// over the nodes that have been unreachable for longer than the
+// grace period, when this node is the one that should act.
+func FailoverCheck(mgr *cbgt.Manager, gracePeriod time.Duration,
+	now time.Time) error {
+	cfg := mgr.Cfg()
+
+	nodeDefs, _, err := cbgt.CfgGetNodeDefs(cfg, cbgt.NODE_DEFS_WANTED)
+	if err != nil {
+		return err
+	}
+	if nodeDefs == nil {
+		return nil
+	}
+
+	selfUUID := mgr.UUID()
+
+	healths := map[string]string{}
+	for uuid, nodeDef := range nodeDefs.NodeDefs {
+		if uuid != selfUUID {
+			healths[uuid] = ClientTopologyProbeNode(nodeDef.HostPort)
+		}
+	}
+
+	up := []string{selfUUID}
+
+	failoverM.Lock()
+	failoverNodes = map[string]*FailoverNodeStatus{}
+	for uuid, health := range healths {
+		nodeDef := nodeDefs.NodeDefs[uuid]
+
+		status := &FailoverNodeStatus{
+			HostPort: nodeDef.HostPort,
+			Health:   health,
+		}
+		failoverNodes[uuid] = status
+
+		if health == CLIENT_TOPOLOGY_HEALTH_OK {
+			delete(failoverDownSince, uuid)
+			up = append(up, uuid)
+			continue
+		}
+
+		downSince, exists := failoverDownSince[uuid]
+		if !exists {
+			downSince = now
+			failoverDownSince[uuid] = downSince
+		}
+		status.DownSince = downSince.Format(time.RFC3339Nano)
+	}
+	for uuid := range failoverDownSince {
+		if nodeDefs.NodeDefs[uuid] == nil {
+			delete(failoverDownSince, uuid)
+		}
+	}
+	failoverM.Unlock()
+
+	if !FailoverShouldAct(selfUUID, up, len(nodeDefs.NodeDefs)) {
+		return nil
+	}
+
+	failoverM.Lock()
+	var failed []string
+	for uuid, downSince := range failoverDownSince {
+		if now.Sub(downSince) > gracePeriod {
+			failed = append(failed, uuid)
+		}
+	}
+	failoverM.Unlock()
+
+	sort.Strings(failed)
+
+	for _, uuid := range failed {
+		ev := &FailoverEvent{
+			NodeUUID: uuid,
+			HostPort: nodeDefs.NodeDefs[uuid].HostPort,
+			Time:     now.Format(time.RFC3339Nano),
+		}
+
+		ev.Promoted, ev.Lost, err = FailoverNode(cfg, uuid)
+		if err != nil {
+			ev.Error = err.Error()
+		}
+
+		log.Printf("failover: node: %s, hostPort: %s, promoted: %d,"+
+			" lost: %d, err: %v", uuid, ev.HostPort, ev.Promoted, ev.Lost, err)
+
+		failoverM.Lock()
+		if err == nil {
+			delete(failoverDownSince, uuid)
+		}
+		failoverRecent = append(failoverRecent, ev)
+		if len(failoverRecent) > FailoverMaxRecent {
+			failoverRecent = failoverRecent[len(failoverRecent)-FailoverMaxRecent:]
+		}
+		failoverM.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FailoverShouldAct returns true when a node should fail over the
+// unreachable nodes, which is when the node has the lowest UUID of
+// the reachable nodes, and the reachable nodes are a majority of the
+// wanted nodes.
+func FailoverShouldAct(selfUUID string, up []string, numWanted int) bool {
+	if len(up)*2 <= numWanted {
+		return false
+	}
+	for _, uuid := range up {
+		if uuid < selfUUID {
+			return false
+		}
+	}
+	return true
+}
+
+// FailoverNode promotes the replicas of a failed node's primary
+// pindexes in the plan, and then unregisters the failed node.
+func FailoverNode(cfg cbgt.Cfg, nodeUUID string) (
+	promoted, lost int, err error) {
+	planPIndexes, cas, err := cbgt.CfgGetPlanPIndexes(cfg)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if planPIndexes != nil {
+		promoted, lost = FailoverPlanPIndexes(planPIndexes, nodeUUID)
+
+		planPIndexes.UUID = cbgt.NewUUID()
+
+		_, err = cbgt.CfgSetPlanPIndexes(cfg, planPIndexes, cas)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failover: could not save plan,"+
+				" err: %v", err)
+		}
+	}
+
+	nodeDefs, cas, err := cbgt.CfgGetNodeDefs(cfg, cbgt.NODE_DEFS_WANTED)
+	if err != nil {
+		return promoted, lost, err
+	}
+	if nodeDefs == nil || nodeDefs.NodeDefs[nodeUUID] == nil {
+		return promoted, lost, nil
+	}
+
+	delete(nodeDefs.NodeDefs, nodeUUID)
+	nodeDefs.UUID = cbgt.NewUUID()
+
+	_, err = cbgt.CfgSetNodeDefs(cfg, cbgt.NODE_DEFS_WANTED, nodeDefs, cas)
+	if err != nil {
+		return promoted, lost, fmt.Errorf("failover: could not"+
+			" unregister node, err: %v", err)
+	}
+
+	return promoted, lost, nil
+}
+
+// FailoverPlanPIndexes removes a failed node from the plan pindexes
+// that have other copies, promoting a replica to primary when the
+// failed node held the primary.  The plan pindexes whose only copy
+// was on the failed node are left for the planner, and are counted
+// as lost.
+func FailoverPlanPIndexes(planPIndexes *cbgt.PlanPIndexes,
+	nodeUUID string) (promoted, lost int) {
+	for _, planPIndex := range planPIndexes.PlanPIndexes {
+		failed := planPIndex.Nodes[nodeUUID]
+		if failed == nil {
+			continue
+		}
+
+		if len(planPIndex.Nodes) <= 1 {
+			lost++
+			continue
+		}
+
+		delete(planPIndex.Nodes, nodeUUID)
+
+		if failed.Priority > 0 {
+			continue
+		}
+
+		var best string
+		for uuid, node := range planPIndex.Nodes {
+			if best == "" ||
+				node.Priority < planPIndex.Nodes[best].Priority ||
+				(node.Priority == planPIndex.Nodes[best].Priority &&
+					uuid < best) {
+				best = uuid
+			}
+		}
+
+		if planPIndex.Nodes[best].Priority > 0 {
+			planPIndex.Nodes[best].Priority = 0
+			planPIndex.Nodes[best].CanRead = true
+			planPIndex.Nodes[best].CanWrite = true
+			promoted++
+		}
+	}
+
+	return promoted, lost
+}
+
+// ---------------------------------------------------------
+
+// FailoverStatusHandler is a REST handler that returns the node's
+// view of the health of the other nodes and the recent failovers.
+type FailoverStatusHandler struct{}
+
+func NewFailoverStatusHandler() *FailoverStatusHandler {
+	return &FailoverStatusHandler{}
+}
+
+func (h *FailoverStatusHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	failoverM.Lock()
+	defer failoverM.Unlock()
+
+	gracePeriod := ""
+	if failoverGracePeriod > 0 {
+		gracePeriod = failoverGracePeriod.String()
+	}
+
+	rest.MustEncode(w, struct {
+		Status      string                         `json:"status"`
+		Enabled     bool                           `json:"enabled"`
+		GracePeriod string                         `json:"gracePeriod,omitempty"`
+		Nodes       map[string]*FailoverNodeStatus `json:"nodes"`
+		Failovers   []*FailoverEvent               `json:"failovers"`
+	}{
+		Status:      "ok",
+		Enabled:     failoverGracePeriod > 0,
+		GracePeriod: gracePeriod,
+		Nodes:       failoverNodes,
+		Failovers:   append([]*FailoverEvent{}, failoverRecent...),
+	})
+}
@@ -0,0 +1,137 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestFailoverShouldAct(t *testing.T) {
+	tests := []struct {
+		self      string
+		up        []string
+		numWanted int
+		exp       bool
+	}{
+		{"a", []string{"a", "b"}, 3, true},
+		{"b", []string{"b", "a"}, 3, false}, // Not the lowest UUID.
+		{"a", []string{"a"}, 3, false},      // Not a majority.
+		{"a", []string{"a", "b"}, 4, false}, // Not a majority.
+		{"a", []string{"a"}, 1, true},
+	}
+	for i, test := range tests {
+		got := FailoverShouldAct(test.self, test.up, test.numWanted)
+		if got != test.exp {
+			t.Errorf("test: %d, expected: %v, got: %v", i, test.exp, got)
+		}
+	}
+}
+
+func testFailoverPlanPIndexes() *cbgt.PlanPIndexes {
+	planPIndexes := cbgt.NewPlanPIndexes(cbgt.VERSION)
+	planPIndexes.PlanPIndexes["p0"] = &cbgt.PlanPIndex{
+		Name: "p0",
+		Nodes: map[string]*cbgt.PlanPIndexNode{
+			"a": {CanRead: true, CanWrite: true, Priority: 0},
+			"b": {CanRead: true, CanWrite: true, Priority: 1},
+		},
+	}
+	planPIndexes.PlanPIndexes["p1"] = &cbgt.PlanPIndex{
+		Name: "p1",
+		Nodes: map[string]*cbgt.PlanPIndexNode{
+			"b": {CanRead: true, CanWrite: true, Priority: 0},
+			"a": {CanRead: true, CanWrite: true, Priority: 1},
+		},
+	}
+	planPIndexes.PlanPIndexes["p2"] = &cbgt.PlanPIndex{
+		Name: "p2",
+		Nodes: map[string]*cbgt.PlanPIndexNode{
+			"a": {CanRead: true, CanWrite: true, Priority: 0},
+		},
+	}
+	return planPIndexes
+}
+
+func TestFailoverPlanPIndexes(t *testing.T) {
+	planPIndexes := testFailoverPlanPIndexes()
+
+	promoted, lost := FailoverPlanPIndexes(planPIndexes, "a")
+	if promoted != 1 || lost != 1 {
+		t.Errorf("expected 1 promoted and 1 lost, got: %d, %d",
+			promoted, lost)
+	}
+
+	p0 := planPIndexes.PlanPIndexes["p0"]
+	if p0.Nodes["a"] != nil || p0.Nodes["b"].Priority != 0 {
+		t.Errorf("expected b to be promoted, got: %#v", p0.Nodes)
+	}
+	p1 := planPIndexes.PlanPIndexes["p1"]
+	if p1.Nodes["a"] != nil || p1.Nodes["b"].Priority != 0 {
+		t.Errorf("expected the replica on a to be removed, got: %#v", p1.Nodes)
+	}
+	p2 := planPIndexes.PlanPIndexes["p2"]
+	if p2.Nodes["a"] == nil {
+		t.Errorf("expected the only copy to be left for the planner")
+	}
+}
+
+func TestFailoverNode(t *testing.T) {
+	cfg := cbgt.NewCfgMem()
+
+	_, err := cbgt.CfgSetPlanPIndexes(cfg, testFailoverPlanPIndexes(), 0)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	nodeDefs := cbgt.NewNodeDefs(cbgt.VERSION)
+	for _, uuid := range []string{"a", "b"} {
+		nodeDefs.NodeDefs[uuid] = &cbgt.NodeDef{
+			HostPort: uuid + ":1000", UUID: uuid,
+		}
+	}
+	_, err = cbgt.CfgSetNodeDefs(cfg, cbgt.NODE_DEFS_WANTED, nodeDefs, 0)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	promoted, lost, err := FailoverNode(cfg, "a")
+	if err != nil || promoted != 1 || lost != 1 {
+		t.Errorf("expected 1 promoted and 1 lost, got: %d, %d, err: %v",
+			promoted, lost, err)
+	}
+
+	nodeDefs, _, err = cbgt.CfgGetNodeDefs(cfg, cbgt.NODE_DEFS_WANTED)
+	if err != nil || nodeDefs.NodeDefs["a"] != nil ||
+		nodeDefs.NodeDefs["b"] == nil {
+		t.Errorf("expected a to be unregistered, got: %#v, err: %v",
+			nodeDefs, err)
+	}
+
+	planPIndexes, _, err := cbgt.CfgGetPlanPIndexes(cfg)
+	if err != nil || planPIndexes.PlanPIndexes["p0"].Nodes["a"] != nil {
+		t.Errorf("expected the plan to be updated, err: %v", err)
+	}
+}
+
+func TestFailoverStatusHandler(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/api/failover", nil)
+	w := httptest.NewRecorder()
+	NewFailoverStatusHandler().ServeHTTP(w, req)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"status":"ok"`) {
+		t.Errorf("expected ok, got: %d, %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,199 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// A couchbase data source feed has a DCP connection per data node,
+// where the "feedBufferSizeBytes" of its sourceParams bounds the bytes
+// that the DCP producer sends before the feed acknowledges them, and
+// the "feedBufferAckThreshold" is the fraction of the buffer that the
+// feed processes before it sends an acknowledgement.  Without a
+// buffer size, a producer sends as fast as it can, so a bucket
+// backfill can pile up in cbft's memory.
+//
+// The node options of the same names are defaults for the feeds
+// whose sourceParams don't have them, and the sourceParams are
+// validated when a feed starts.  While an index blocks its feed, such
+// as while applying a large batch, the producer pauses once the
+// buffer is full, so those stalls are tracked in the index metrics.
+
+// The source types whose feeds have DCP flow control.
+var FeedFlowControlSourceTypes = []string{"couchbase", "couchbase-dcp"}
+
+// FeedFlowControlDefaults are node-wide defaults of the flow control
+// sourceParams, where zero values mean no default.
+type FeedFlowControlDefaults struct {
+	FeedBufferSizeBytes    int
+	FeedBufferAckThreshold float64
+}
+
+// feedStallThreshold is the duration, in nanoseconds, of a feed
+// callback that counts as a stall.  Accessed via atomic.
+var feedStallThreshold = int64(100 * time.Millisecond)
+
+var feedFlowControlM sync.Mutex
+
+// The unwrapped feed types, keyed by source type.
+var feedFlowControlOrigs = map[string]*cbgt.FeedType{}
+
+// FeedFlowControlStart parses the flow control node options, which
+// are "feedBufferSizeBytes", "feedBufferAckThreshold" and
+// "feedStallThresholdMs", and wraps the registered couchbase feed
+// types to apply them.  It must be invoked before the manager is
+// started.
+func FeedFlowControlStart(options map[string]string) error {
+	defaults := FeedFlowControlDefaults{}
+
+	if v := options["feedBufferSizeBytes"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("flow control: bad feedBufferSizeBytes: %q", v)
+		}
+		defaults.FeedBufferSizeBytes = n
+	}
+
+	if v := options["feedBufferAckThreshold"]; v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			return fmt.Errorf("flow control: bad feedBufferAckThreshold: %q", v)
+		}
+		defaults.FeedBufferAckThreshold = f
+	}
+
+	if v := options["feedStallThresholdMs"]; v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return fmt.Errorf("flow control: bad feedStallThresholdMs: %q", v)
+		}
+		atomic.StoreInt64(&feedStallThreshold,
+			int64(time.Duration(ms)*time.Millisecond))
+	}
+
+	for _, sourceType := range FeedFlowControlSourceTypes {
+		wrapFeedTypeFlowControl(sourceType, defaults)
+	}
+
+	return nil
+}
+
+// wrapFeedTypeFlowControl replaces a registered feed type with one
+// whose feeds get their flow control sourceParams checked and
+// defaulted.  A feed type that was already wrapped is re-wrapped from
+// its original.
+func wrapFeedTypeFlowControl(sourceType string,
+	defaults FeedFlowControlDefaults) {
+	feedFlowControlM.Lock()
+	defer feedFlowControlM.Unlock()
+
+	orig := feedFlowControlOrigs[sourceType]
+	if orig == nil {
+		orig = cbgt.FeedTypes[sourceType]
+		if orig == nil || orig.Start == nil {
+			return
+		}
+		feedFlowControlOrigs[sourceType] = orig
+	}
+
+	origStart := orig.Start
+
+	wrapped := *orig
+	wrapped.Start = func(mgr *cbgt.Manager, feedName, indexName,
+		indexUUID, sourceType, sourceName, sourceUUID, params string,
+		dests map[string]cbgt.Dest) error {
+		params, err := feedFlowControlParams(params, defaults)
+		if err != nil {
+			return fmt.Errorf("flow control: feed: %s, err: %v",
+				feedName, err)
+		}
+		return origStart(mgr, feedName, indexName, indexUUID,
+			sourceType, sourceName, sourceUUID, params, dests)
+	}
+
+	cbgt.FeedTypes[sourceType] = &wrapped
+}
+
+// feedFlowControlParams validates the flow control fields of a feed's
+// sourceParams, and fills in the defaults for the missing or zero
+// fields.
+func feedFlowControlParams(params string,
+	defaults FeedFlowControlDefaults) (string, error) {
+	m := map[string]interface{}{}
+	if params != "" {
+		v, err := parseJSONUseNumber([]byte(params))
+		if err != nil {
+			return "", fmt.Errorf("could not parse sourceParams: %v", err)
+		}
+		mm, ok := v.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("sourceParams is not a JSON object")
+		}
+		m = mm
+	}
+
+	size := jsonInt(m["feedBufferSizeBytes"], 0)
+	if size < 0 {
+		return "", fmt.Errorf("feedBufferSizeBytes must be >= 0")
+	}
+	ack := jsonFloat(m["feedBufferAckThreshold"], 0)
+	if ack < 0 || ack > 1 {
+		return "", fmt.Errorf("feedBufferAckThreshold must be" +
+			" between 0 and 1")
+	}
+
+	changed := false
+	if size == 0 && defaults.FeedBufferSizeBytes > 0 {
+		m["feedBufferSizeBytes"] = defaults.FeedBufferSizeBytes
+		changed = true
+	}
+	if ack == 0 && defaults.FeedBufferAckThreshold > 0 {
+		m["feedBufferAckThreshold"] = defaults.FeedBufferAckThreshold
+		changed = true
+	}
+	if !changed {
+		return params, nil
+	}
+
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("flow control: defaulted sourceParams,"+
+		" feedBufferSizeBytes: %v, feedBufferAckThreshold: %v",
+		m["feedBufferSizeBytes"], m["feedBufferAckThreshold"])
+
+	return string(buf), nil
+}
+
+// recordFeedCall tracks a feed callback into the index that started
+// at the given time, counting it as a stall if it blocked the feed
+// for too long.
+func (m *IndexMetrics) recordFeedCall(start time.Time) {
+	d := time.Since(start)
+	if int64(d) < atomic.LoadInt64(&feedStallThreshold) {
+		return
+	}
+	atomic.AddUint64(&m.FeedStalls, 1)
+	atomic.AddUint64(&m.FeedStallMs, uint64(d/time.Millisecond))
+}
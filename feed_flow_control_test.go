@@ -0,0 +1,128 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestFeedFlowControlParams(t *testing.T) {
+	defaults := FeedFlowControlDefaults{
+		FeedBufferSizeBytes:    1000,
+		FeedBufferAckThreshold: 0.2,
+	}
+
+	params, err := feedFlowControlParams("", defaults)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	var m map[string]interface{}
+	json.Unmarshal([]byte(params), &m)
+	if m["feedBufferSizeBytes"] != 1000.0 ||
+		m["feedBufferAckThreshold"] != 0.2 {
+		t.Errorf("expected defaults, got: %s", params)
+	}
+
+	params, err = feedFlowControlParams(`{"authUser":"beers",`+
+		`"feedBufferSizeBytes":5000,"feedBufferAckThreshold":0}`, defaults)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	m = nil
+	json.Unmarshal([]byte(params), &m)
+	if m["authUser"] != "beers" || m["feedBufferSizeBytes"] != 5000.0 ||
+		m["feedBufferAckThreshold"] != 0.2 {
+		t.Errorf("expected an explicit size and a default ack,"+
+			" got: %s", params)
+	}
+
+	params, err = feedFlowControlParams(`{"authUser":"beers"}`,
+		FeedFlowControlDefaults{})
+	if err != nil || params != `{"authUser":"beers"}` {
+		t.Errorf("expected unchanged params, got: %s, err: %v", params, err)
+	}
+
+	for _, params := range []string{
+		`{"feedBufferSizeBytes":-1}`,
+		`{"feedBufferAckThreshold":1.5}`,
+		`[]`,
+		`{`,
+	} {
+		_, err = feedFlowControlParams(params, defaults)
+		if err == nil {
+			t.Errorf("expected err, params: %s", params)
+		}
+	}
+}
+
+func TestFeedFlowControlStart(t *testing.T) {
+	for _, options := range []map[string]string{
+		{"feedBufferSizeBytes": "-1"},
+		{"feedBufferAckThreshold": "x"},
+		{"feedStallThresholdMs": "0"},
+	} {
+		if FeedFlowControlStart(options) == nil {
+			t.Errorf("expected err, options: %v", options)
+		}
+	}
+
+	var gotParams string
+	cbgt.FeedTypes["testFlowControl"] = &cbgt.FeedType{
+		Start: func(mgr *cbgt.Manager, feedName, indexName,
+			indexUUID, sourceType, sourceName, sourceUUID, params string,
+			dests map[string]cbgt.Dest) error {
+			gotParams = params
+			return nil
+		},
+	}
+	defer delete(cbgt.FeedTypes, "testFlowControl")
+	defer delete(feedFlowControlOrigs, "testFlowControl")
+
+	wrapFeedTypeFlowControl("testFlowControl",
+		FeedFlowControlDefaults{FeedBufferSizeBytes: 100})
+	wrapFeedTypeFlowControl("testFlowControl",
+		FeedFlowControlDefaults{FeedBufferSizeBytes: 200})
+
+	err := cbgt.FeedTypes["testFlowControl"].Start(nil, "f", "i", "u",
+		"testFlowControl", "s", "", "", nil)
+	if err != nil || gotParams != `{"feedBufferSizeBytes":200}` {
+		t.Errorf("expected the latest defaults, got: %s, err: %v",
+			gotParams, err)
+	}
+
+	err = cbgt.FeedTypes["testFlowControl"].Start(nil, "f", "i", "u",
+		"testFlowControl", "s", "", `{"feedBufferSizeBytes":-5}`, nil)
+	if err == nil {
+		t.Errorf("expected err on bad sourceParams")
+	}
+}
+
+func TestRecordFeedCall(t *testing.T) {
+	m := &IndexMetrics{}
+
+	m.recordFeedCall(time.Now())
+	if atomic.LoadUint64(&m.FeedStalls) != 0 {
+		t.Errorf("expected no stall for a quick call")
+	}
+
+	m.recordFeedCall(time.Now().Add(-250 * time.Millisecond))
+	if atomic.LoadUint64(&m.FeedStalls) != 1 ||
+		atomic.LoadUint64(&m.FeedStallMs) < 250 {
+		t.Errorf("expected a stall, got: %d, %d ms",
+			m.FeedStalls, m.FeedStallMs)
+	}
+}
@@ -0,0 +1,241 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+)
+
+// Keyword fields that are only ever used in exact (equality) filters,
+// like a "status" or "tenantId", can be listed in the
+// "filterOnlyFields" of the bleve index params, like...
+//
+//   {"mapping": {...}, "filterOnlyFields": ["status", "owner.id"]}
+//
+// The field mappings of those fields are then pruned so that they're
+// indexed as single keyword terms without term vectors (positions),
+// without stored copies and without being included in the composite
+// "_all" field, which shrinks the index.  Since such fields can't
+// support scoring or phrase queries, or highlighting, queries that
+// try those on a filter-only field are rejected.
+
+// The analyzer of filter-only fields, so each value is a single term.
+const FILTER_ONLY_ANALYZER = "keyword"
+
+// applyFilterOnlyFields prunes the field mappings of the filter-only
+// fields, which must be explicitly mapped text fields.
+func applyFilterOnlyFields(m *bleve.IndexMapping, fields []string) error {
+	if len(fields) <= 0 {
+		return nil
+	}
+
+	found := map[string]bool{}
+
+	prune := func(path string, fm *bleve.FieldMapping) error {
+		for _, field := range fields {
+			if field != path {
+				continue
+			}
+			if fm.Type != "text" {
+				return fmt.Errorf("filter_fields: filter-only field: %s"+
+					" must be a text field, type: %s", field, fm.Type)
+			}
+			fm.Analyzer = FILTER_ONLY_ANALYZER
+			fm.Index = true
+			fm.Store = false
+			fm.IncludeTermVectors = false
+			fm.IncludeInAll = false
+			found[field] = true
+		}
+		return nil
+	}
+
+	if m.DefaultMapping != nil {
+		err := filterFieldsWalk(m.DefaultMapping, nil, prune)
+		if err != nil {
+			return err
+		}
+	}
+	for _, dm := range m.TypeMapping {
+		err := filterFieldsWalk(dm, nil, prune)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, field := range fields {
+		if !found[field] {
+			return fmt.Errorf("filter_fields: filter-only field: %s"+
+				" is not mapped", field)
+		}
+	}
+
+	return nil
+}
+
+// applyKeywordFieldType converts the field mappings of a field type
+// that cbft implements, like "ip", into keyword text field mappings
+// with the given analyzer, returning the sorted paths of the fields.
+func applyKeywordFieldType(m *bleve.IndexMapping,
+	fieldType, analyzer string) ([]string, error) {
+	found := map[string]bool{}
+
+	convert := func(path string, fm *bleve.FieldMapping) error {
+		if fm.Type != fieldType {
+			return nil
+		}
+		if path == "" {
+			return fmt.Errorf("filter_fields: %s field has no name",
+				fieldType)
+		}
+		fm.Type = "text"
+		fm.Analyzer = analyzer
+		fm.IncludeTermVectors = false
+		fm.IncludeInAll = false
+		found[path] = true
+		return nil
+	}
+
+	if m.DefaultMapping != nil {
+		err := filterFieldsWalk(m.DefaultMapping, nil, convert)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, dm := range m.TypeMapping {
+		err := filterFieldsWalk(dm, nil, convert)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(found) <= 0 {
+		return nil, nil
+	}
+
+	paths := make([]string, 0, len(found))
+	for path := range found {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// filterFieldsWalk invokes f on each field mapping of a document
+// mapping, along with the field's full, dotted path.
+func filterFieldsWalk(dm *bleve.DocumentMapping, path []string,
+	f func(string, *bleve.FieldMapping) error) error {
+	for _, fm := range dm.Fields {
+		name := fm.Name
+		if name == "" && len(path) > 0 {
+			name = path[len(path)-1]
+		}
+		fieldPath := name
+		if len(path) > 1 {
+			fieldPath = strings.Join(path[:len(path)-1], ".") + "." + name
+		}
+		err := f(fieldPath, fm)
+		if err != nil {
+			return err
+		}
+	}
+	for propName, sub := range dm.Properties {
+		err := filterFieldsWalk(sub, append(path, propName), f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFilterOnlyFields returns an error if a JSON search request has
+// a scoring or phrase query, or highlighting, on a filter-only field.
+// Match, phrase and fuzzy queries are rejected, while exact term
+// queries are allowed.
+func checkFilterOnlyFields(req []byte, fields []string) error {
+	if len(fields) <= 0 {
+		return nil
+	}
+
+	filterOnly := map[string]bool{}
+	for _, field := range fields {
+		filterOnly[field] = true
+	}
+
+	v, err := parseJSONUseNumber(req)
+	if err != nil {
+		return nil // Let the search request parsing report the error.
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	if highlight, ok := m["highlight"].(map[string]interface{}); ok {
+		for _, field := range jsonStrings(highlight["fields"]) {
+			if filterOnly[field] {
+				return fmt.Errorf("filter_fields: field: %s is"+
+					" filter-only, so it can't be highlighted", field)
+			}
+		}
+	}
+
+	q, exists := m["query"]
+	if !exists {
+		return nil
+	}
+
+	_, err = rewriteQueryTree(q, func(qm map[string]interface{}) (
+		interface{}, error) {
+		field, _ := qm["field"].(string)
+		if !filterOnly[field] {
+			return nil, nil
+		}
+
+		kind := filterFieldsQueryKind(qm)
+		if kind != "" {
+			return nil, fmt.Errorf("filter_fields: field: %s is"+
+				" filter-only, so it only supports exact term queries,"+
+				" not %s queries", field, kind)
+		}
+
+		return nil, nil
+	})
+
+	return err
+}
+
+// filterFieldsQueryKind returns the kind of a JSON query object that
+// a filter-only field doesn't support, or "" if it's supported.
+func filterFieldsQueryKind(q map[string]interface{}) string {
+	if _, exists := q["match"]; exists {
+		return "match"
+	}
+	if _, exists := q["match_phrase"]; exists {
+		return "match_phrase"
+	}
+	if _, exists := q["terms"]; exists {
+		return "phrase"
+	}
+	if _, exists := q["term"]; exists {
+		if n, ok := q["fuzziness"].(json.Number); ok && n.String() != "0" {
+			return "fuzzy"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,128 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+func filterFieldsTestMapping() *bleve.IndexMapping {
+	status := bleve.NewTextFieldMapping()
+	status.Store = true
+	status.IncludeTermVectors = true
+
+	ownerID := bleve.NewTextFieldMapping()
+	owner := bleve.NewDocumentMapping()
+	owner.AddFieldMappingsAt("id", ownerID)
+
+	count := bleve.NewNumericFieldMapping()
+
+	dm := bleve.NewDocumentMapping()
+	dm.AddFieldMappingsAt("status", status)
+	dm.AddFieldMappingsAt("count", count)
+	dm.AddSubDocumentMapping("owner", owner)
+
+	m := bleve.NewIndexMapping()
+	m.AddDocumentMapping("order", dm)
+	return m
+}
+
+func TestApplyFilterOnlyFields(t *testing.T) {
+	m := filterFieldsTestMapping()
+
+	err := applyFilterOnlyFields(m, []string{"status", "owner.id"})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	dm := m.TypeMapping["order"]
+	fm := dm.Properties["status"].Fields[0]
+	if fm.Store || fm.IncludeTermVectors || fm.IncludeInAll ||
+		!fm.Index || fm.Analyzer != FILTER_ONLY_ANALYZER {
+		t.Errorf("expected pruned status, got: %#v", fm)
+	}
+	fm = dm.Properties["owner"].Properties["id"].Fields[0]
+	if fm.Analyzer != FILTER_ONLY_ANALYZER {
+		t.Errorf("expected pruned owner.id, got: %#v", fm)
+	}
+
+	err = applyFilterOnlyFields(filterFieldsTestMapping(),
+		[]string{"missing"})
+	if err == nil {
+		t.Errorf("expected err on an unmapped field")
+	}
+
+	err = applyFilterOnlyFields(filterFieldsTestMapping(),
+		[]string{"count"})
+	if err == nil {
+		t.Errorf("expected err on a non-text field")
+	}
+}
+
+func TestValidateFilterOnlyFields(t *testing.T) {
+	bleveParams := NewBleveParams()
+	bleveParams.Mapping = *filterFieldsTestMapping()
+	bleveParams.FilterOnlyFields = []string{"status"}
+	buf, _ := json.Marshal(bleveParams)
+
+	err := ValidateBlevePIndexImpl("bleve", "idx", string(buf))
+	if err != nil {
+		t.Errorf("expected valid params, got: %v", err)
+	}
+
+	bleveParams.FilterOnlyFields = []string{"missing"}
+	buf, _ = json.Marshal(bleveParams)
+
+	err = ValidateBlevePIndexImpl("bleve", "idx", string(buf))
+	if err == nil {
+		t.Errorf("expected err on an unmapped field")
+	}
+}
+
+func TestCheckFilterOnlyFields(t *testing.T) {
+	fields := []string{"status"}
+
+	tests := []struct {
+		req    string
+		expErr bool
+	}{
+		{`{"query":{"term":"open","field":"status"}}`, false},
+		{`{"query":{"term":"open","field":"status","fuzziness":0}}`, false},
+		{`{"query":{"match":"open","field":"other"}}`, false},
+		{`{"query":{"conjuncts":[{"match":"x","field":"desc"},` +
+			`{"term":"open","field":"status"}]}}`, false},
+		{`{"query":{"match":"open","field":"status"}}`, true},
+		{`{"query":{"match_phrase":"is open","field":"status"}}`, true},
+		{`{"query":{"terms":["is","open"],"field":"status"}}`, true},
+		{`{"query":{"term":"opne","field":"status","fuzziness":1}}`, true},
+		{`{"query":{"disjuncts":[{"match":"open","field":"status"}]}}`, true},
+		{`{"query":{"term":"open","field":"status"},` +
+			`"highlight":{"fields":["status"]}}`, true},
+	}
+
+	for i, test := range tests {
+		err := checkFilterOnlyFields([]byte(test.req), fields)
+		if (err != nil) != test.expErr {
+			t.Errorf("%d: req: %s, expErr: %v, got err: %v",
+				i, test.req, test.expErr, err)
+		}
+	}
+
+	err := checkFilterOnlyFields(
+		[]byte(`{"query":{"match":"open","field":"status"}}`), nil)
+	if err != nil {
+		t.Errorf("expected no err without filter-only fields, got: %v", err)
+	}
+}
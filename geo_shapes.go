@@ -0,0 +1,625 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+)
+
+// A field of a bleve index mapping can have the "geoshape" type, whose
+// values are GeoJSON geometries (Point, MultiPoint, LineString,
+// MultiLineString, Polygon, MultiPolygon or GeometryCollection), like...
+//
+//   "properties": {
+//     "zone": {"fields": [{"name": "zone", "type": "geoshape"}]}}
+//
+// A geoshape field is indexed as a keyword field whose terms are the
+// geohash cells that cover the shape: the cells that are within the
+// shape, which are as coarse as possible, and the cells down to the
+// index's precision along the shape's edges.  Each covering cell is
+// indexed as a marked term (GEO_SHAPE_CELL_MARK + cell), and all the
+// cells and their ancestors are indexed as plain terms.  Geo shape
+// queries, like...
+//
+//   {"field": "zone", "relation": "intersects",
+//    "geo_shape": {"type": "Polygon", "coordinates": [[[lon, lat], ...]]}}
+//
+// are converted server-side into term queries on the cells that cover
+// the query shape, where...
+//
+// - "intersects" (the default) matches the documents that have a plain
+//   term of a query cell (a document cell inside the query cell) or a
+//   marked term of one of its ancestors (a document cell that
+//   contains the query cell).
+//
+// - "contains" matches the documents that, for every query cell, have
+//   a marked term of that cell or of one of its ancestors, so that
+//   searching for a Point finds the shapes that contain it.
+//
+// Matching is at the precision of the cells, so a shape that's within
+// a cell's size of the query shape may match.  The precision and the
+// max number of cells per shape can be set in the "geoShape" of the
+// bleve index params, like...
+//
+//   {"mapping": {...}, "geoShape": {"precision": 8, "maxCells": 2048}}
+//
+// The coordinates are planar longitudes and latitudes, so shapes that
+// cross the antimeridian aren't supported.
+
+// The field type of geo shape fields in bleve index mappings.
+const GEO_SHAPE_FIELD_TYPE = "geoshape"
+
+// The analyzer of geo shape fields, so each cell is a single term.
+const GEO_SHAPE_FIELD_ANALYZER = "keyword"
+
+// The prefix of the terms of the covering cells of a shape, which
+// isn't in the geohash alphabet.
+const GEO_SHAPE_CELL_MARK = "="
+
+// The default geohash length of the finest cells, which are about
+// 150m by 150m.
+const GEO_SHAPE_DEFAULT_PRECISION = 7
+
+// The default max number of cells that cover a shape, beyond which
+// the edges of the shape are covered by coarser cells.
+const GEO_SHAPE_DEFAULT_MAX_CELLS = 1024
+
+// The max geohash length of the finest cells.
+const GEO_SHAPE_MAX_PRECISION = 12
+
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// BleveGeoShape is the "geoShape" of the bleve index params.
+type BleveGeoShape struct {
+	Precision int `json:"precision,omitempty"`
+	MaxCells  int `json:"maxCells,omitempty"`
+}
+
+// validateBleveGeoShape checks the geoShape of the index params.
+func validateBleveGeoShape(g *BleveGeoShape) error {
+	if g == nil {
+		return nil
+	}
+	if g.Precision < 0 || g.Precision > GEO_SHAPE_MAX_PRECISION {
+		return fmt.Errorf("geo_shapes: precision must be between 1 and %d",
+			GEO_SHAPE_MAX_PRECISION)
+	}
+	if g.MaxCells < 0 || (g.MaxCells > 0 && g.MaxCells < len(geohashBase32)) {
+		return fmt.Errorf("geo_shapes: maxCells must be >= %d",
+			len(geohashBase32))
+	}
+	return nil
+}
+
+// limits returns the precision and max cells of the geoShape, which
+// may be nil.
+func (g *BleveGeoShape) limits() (int, int) {
+	precision, maxCells := GEO_SHAPE_DEFAULT_PRECISION,
+		GEO_SHAPE_DEFAULT_MAX_CELLS
+	if g != nil && g.Precision > 0 {
+		precision = g.Precision
+	}
+	if g != nil && g.MaxCells > 0 {
+		maxCells = g.MaxCells
+	}
+	return precision, maxCells
+}
+
+// applyGeoShapeFields converts the geoshape field mappings of an index
+// mapping into keyword text field mappings, returning the sorted
+// paths of the geoshape fields.
+func applyGeoShapeFields(m *bleve.IndexMapping) ([]string, error) {
+	return applyKeywordFieldType(m,
+		GEO_SHAPE_FIELD_TYPE, GEO_SHAPE_FIELD_ANALYZER)
+}
+
+// ---------------------------------------------------------
+
+type geoPoint [2]float64 // Longitude, latitude.
+
+type geoRect struct {
+	minLon, minLat, maxLon, maxLat float64
+}
+
+func (r geoRect) contains(p geoPoint) bool {
+	return p[0] >= r.minLon && p[0] <= r.maxLon &&
+		p[1] >= r.minLat && p[1] <= r.maxLat
+}
+
+// geoShape is a parsed GeoJSON geometry.
+type geoShape struct {
+	points   []geoPoint
+	lines    [][]geoPoint
+	polygons [][][]geoPoint // Each polygon has an outer ring and holes.
+}
+
+// The relations of a cell to a shape.
+const (
+	geoDisjoint = iota
+	geoIntersects
+	geoWithin // The cell is within the shape.
+)
+
+// parseGeoJSON parses a generic JSON GeoJSON geometry.
+func parseGeoJSON(v interface{}) (*geoShape, error) {
+	s := &geoShape{}
+	err := s.add(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.points) <= 0 && len(s.lines) <= 0 && len(s.polygons) <= 0 {
+		return nil, fmt.Errorf("geo_shapes: empty geometry")
+	}
+	return s, nil
+}
+
+func (s *geoShape) add(v interface{}) error {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("geo_shapes: geometry must be a GeoJSON object")
+	}
+	t, _ := m["type"].(string)
+
+	if t == "GeometryCollection" {
+		geometries, ok := m["geometries"].([]interface{})
+		if !ok {
+			return fmt.Errorf("geo_shapes: GeometryCollection needs" +
+				" geometries")
+		}
+		for _, g := range geometries {
+			if err := s.add(g); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	c := m["coordinates"]
+
+	switch t {
+	case "Point":
+		p, err := parseGeoPoint(c)
+		if err != nil {
+			return err
+		}
+		s.points = append(s.points, p)
+	case "MultiPoint":
+		ps, err := parseGeoPoints(c, 1)
+		if err != nil {
+			return err
+		}
+		s.points = append(s.points, ps...)
+	case "LineString":
+		ps, err := parseGeoPoints(c, 2)
+		if err != nil {
+			return err
+		}
+		s.lines = append(s.lines, ps)
+	case "MultiLineString":
+		arr, ok := c.([]interface{})
+		if !ok {
+			return fmt.Errorf("geo_shapes: bad MultiLineString coordinates")
+		}
+		for _, x := range arr {
+			ps, err := parseGeoPoints(x, 2)
+			if err != nil {
+				return err
+			}
+			s.lines = append(s.lines, ps)
+		}
+	case "Polygon":
+		rings, err := parseGeoRings(c)
+		if err != nil {
+			return err
+		}
+		s.polygons = append(s.polygons, rings)
+	case "MultiPolygon":
+		arr, ok := c.([]interface{})
+		if !ok {
+			return fmt.Errorf("geo_shapes: bad MultiPolygon coordinates")
+		}
+		for _, x := range arr {
+			rings, err := parseGeoRings(x)
+			if err != nil {
+				return err
+			}
+			s.polygons = append(s.polygons, rings)
+		}
+	default:
+		return fmt.Errorf("geo_shapes: unsupported geometry type: %q", t)
+	}
+
+	return nil
+}
+
+func parseGeoPoint(v interface{}) (geoPoint, error) {
+	arr, ok := v.([]interface{})
+	if !ok || len(arr) < 2 {
+		return geoPoint{}, fmt.Errorf("geo_shapes: a position must be" +
+			" an array of [lon, lat]")
+	}
+	var p geoPoint
+	for i := 0; i < 2; i++ {
+		switch x := arr[i].(type) {
+		case float64:
+			p[i] = x
+		case json.Number:
+			f, err := x.Float64()
+			if err != nil {
+				return geoPoint{}, fmt.Errorf("geo_shapes: bad position"+
+					" number: %v", x)
+			}
+			p[i] = f
+		default:
+			return geoPoint{}, fmt.Errorf("geo_shapes: bad position"+
+				" number: %v", arr[i])
+		}
+	}
+	if p[0] < -180 || p[0] > 180 || p[1] < -90 || p[1] > 90 {
+		return geoPoint{}, fmt.Errorf("geo_shapes: position out of"+
+			" range: %v", p)
+	}
+	return p, nil
+}
+
+func parseGeoPoints(v interface{}, min int) ([]geoPoint, error) {
+	arr, ok := v.([]interface{})
+	if !ok || len(arr) < min {
+		return nil, fmt.Errorf("geo_shapes: need an array of at least"+
+			" %d positions", min)
+	}
+	rv := make([]geoPoint, 0, len(arr))
+	for _, x := range arr {
+		p, err := parseGeoPoint(x)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, p)
+	}
+	return rv, nil
+}
+
+func parseGeoRings(v interface{}) ([][]geoPoint, error) {
+	arr, ok := v.([]interface{})
+	if !ok || len(arr) < 1 {
+		return nil, fmt.Errorf("geo_shapes: a polygon needs an outer ring")
+	}
+	rv := make([][]geoPoint, 0, len(arr))
+	for _, x := range arr {
+		ring, err := parseGeoPoints(x, 4)
+		if err != nil {
+			return nil, fmt.Errorf("%v, in a polygon ring", err)
+		}
+		rv = append(rv, ring)
+	}
+	return rv, nil
+}
+
+// relate returns the relation of a cell to the shape.
+func (s *geoShape) relate(r geoRect) int {
+	rv := geoDisjoint
+
+	for _, p := range s.points {
+		if r.contains(p) {
+			return geoIntersects // A cell is never within points.
+		}
+	}
+
+	for _, line := range s.lines {
+		for i := 1; i < len(line); i++ {
+			if geoSegmentIntersectsRect(line[i-1], line[i], r) {
+				return geoIntersects // A cell is never within lines.
+			}
+		}
+	}
+
+	center := geoPoint{(r.minLon + r.maxLon) / 2, (r.minLat + r.maxLat) / 2}
+
+	for _, rings := range s.polygons {
+		crossed := false
+		for _, ring := range rings {
+			for i := range ring {
+				a, b := ring[i], ring[(i+1)%len(ring)]
+				if geoSegmentIntersectsRect(a, b, r) {
+					crossed = true
+					break
+				}
+			}
+			if crossed {
+				break
+			}
+		}
+		if crossed {
+			rv = geoIntersects
+			continue
+		}
+		if geoPointInPolygon(center, rings) {
+			return geoWithin
+		}
+		if r.contains(rings[0][0]) {
+			rv = geoIntersects // The polygon is within the cell.
+		}
+	}
+
+	return rv
+}
+
+// geoPointInPolygon is an even-odd test of a point against the rings
+// of a polygon, so that points in holes are outside.
+func geoPointInPolygon(p geoPoint, rings [][]geoPoint) bool {
+	in := false
+	for _, ring := range rings {
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			a, b := ring[i], ring[j]
+			if (a[1] > p[1]) != (b[1] > p[1]) &&
+				p[0] < (b[0]-a[0])*(p[1]-a[1])/(b[1]-a[1])+a[0] {
+				in = !in
+			}
+		}
+	}
+	return in
+}
+
+func geoSegmentIntersectsRect(a, b geoPoint, r geoRect) bool {
+	if r.contains(a) || r.contains(b) {
+		return true
+	}
+	if (a[0] < r.minLon && b[0] < r.minLon) ||
+		(a[0] > r.maxLon && b[0] > r.maxLon) ||
+		(a[1] < r.minLat && b[1] < r.minLat) ||
+		(a[1] > r.maxLat && b[1] > r.maxLat) {
+		return false
+	}
+	corners := []geoPoint{
+		{r.minLon, r.minLat}, {r.maxLon, r.minLat},
+		{r.maxLon, r.maxLat}, {r.minLon, r.maxLat},
+	}
+	for i := range corners {
+		if geoSegmentsIntersect(a, b, corners[i], corners[(i+1)%4]) {
+			return true
+		}
+	}
+	return false
+}
+
+func geoSegmentsIntersect(p1, p2, p3, p4 geoPoint) bool {
+	d1 := geoOrient(p3, p4, p1)
+	d2 := geoOrient(p3, p4, p2)
+	d3 := geoOrient(p1, p2, p3)
+	d4 := geoOrient(p1, p2, p4)
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) &&
+		((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+	return (d1 == 0 && geoOnSegment(p3, p4, p1)) ||
+		(d2 == 0 && geoOnSegment(p3, p4, p2)) ||
+		(d3 == 0 && geoOnSegment(p1, p2, p3)) ||
+		(d4 == 0 && geoOnSegment(p1, p2, p4))
+}
+
+func geoOrient(a, b, c geoPoint) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+func geoOnSegment(a, b, p geoPoint) bool {
+	return p[0] >= math.Min(a[0], b[0]) && p[0] <= math.Max(a[0], b[0]) &&
+		p[1] >= math.Min(a[1], b[1]) && p[1] <= math.Max(a[1], b[1])
+}
+
+// ---------------------------------------------------------
+
+// geohashRect returns the bounds of a geohash cell.
+func geohashRect(hash string) geoRect {
+	r := geoRect{-180, -90, 180, 90}
+	even := true
+	for i := 0; i < len(hash); i++ {
+		cd := strings.IndexByte(geohashBase32, hash[i])
+		for mask := 16; mask > 0; mask >>= 1 {
+			if even {
+				mid := (r.minLon + r.maxLon) / 2
+				if cd&mask != 0 {
+					r.minLon = mid
+				} else {
+					r.maxLon = mid
+				}
+			} else {
+				mid := (r.minLat + r.maxLat) / 2
+				if cd&mask != 0 {
+					r.minLat = mid
+				} else {
+					r.maxLat = mid
+				}
+			}
+			even = !even
+		}
+	}
+	return r
+}
+
+// geoShapeCells returns the geohash cells that cover a shape, down to
+// the precision, where the edges of the shape are covered by coarser
+// cells when the finer cells would be more than maxCells.  The
+// truncated result is true when the edges are coarser than the
+// precision.
+func geoShapeCells(s *geoShape, precision, maxCells int) (
+	cells []string, truncated bool) {
+	frontier := []string{""}
+
+	for level := 1; level <= precision; level++ {
+		var edges []string
+		for _, parent := range frontier {
+			for i := 0; i < len(geohashBase32); i++ {
+				cell := parent + geohashBase32[i:i+1]
+				switch s.relate(geohashRect(cell)) {
+				case geoWithin:
+					cells = append(cells, cell)
+				case geoIntersects:
+					edges = append(edges, cell)
+				}
+			}
+		}
+
+		if level >= precision {
+			return append(cells, edges...), false
+		}
+		if len(cells)+len(edges)*len(geohashBase32) > maxCells {
+			return append(cells, edges...), true
+		}
+
+		frontier = edges
+	}
+
+	return cells, false
+}
+
+// geoShapeTerms returns the indexed terms of the cells that cover a
+// shape.
+func geoShapeTerms(cells []string) []interface{} {
+	terms := map[string]bool{}
+	for _, cell := range cells {
+		terms[GEO_SHAPE_CELL_MARK+cell] = true
+		for i := 1; i <= len(cell); i++ {
+			terms[cell[:i]] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(terms))
+	for term := range terms {
+		sorted = append(sorted, term)
+	}
+	sort.Strings(sorted)
+
+	rv := make([]interface{}, len(sorted))
+	for i, term := range sorted {
+		rv[i] = term
+	}
+	return rv
+}
+
+// geoShapesApply replaces the values of the geoshape fields of a
+// parsed JSON document with their terms, returning the errors of the
+// values that aren't GeoJSON geometries, which are removed from the
+// document.
+func geoShapesApply(m map[string]interface{}, fields []string,
+	g *BleveGeoShape) []error {
+	var errs []error
+
+	precision, maxCells := g.limits()
+
+	for _, field := range fields {
+		convert := func(v interface{}) interface{} {
+			s, err := parseGeoJSON(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%v, field: %s", err, field))
+				return nil
+			}
+			cells, _ := geoShapeCells(s, precision, maxCells)
+			return geoShapeTerms(cells)
+		}
+
+		walkFieldValues(m, field, convert)
+	}
+
+	return errs
+}
+
+// ---------------------------------------------------------
+
+// rewriteGeoShapeQueries converts the geo shape queries in a JSON
+// search request into term queries on the cells of geoshape fields,
+// where the geoShape of the index params may be nil.
+func rewriteGeoShapeQueries(req []byte, g *BleveGeoShape) ([]byte, error) {
+	precision, maxCells := g.limits()
+
+	return rewriteQueryRequest(req, func(q map[string]interface{}) (
+		interface{}, error) {
+		v, exists := q["geo_shape"]
+		if !exists {
+			return nil, nil
+		}
+		field, _ := q["field"].(string)
+		if field == "" {
+			return nil, fmt.Errorf("geo_shapes: geo_shape query needs" +
+				" a field")
+		}
+
+		s, err := parseGeoJSON(v)
+		if err != nil {
+			return nil, fmt.Errorf("%v, field: %s", err, field)
+		}
+
+		cells, truncated := geoShapeCells(s, precision, maxCells)
+
+		term := func(t string) interface{} {
+			return map[string]interface{}{"term": t, "field": field}
+		}
+
+		var rv map[string]interface{}
+
+		relation, _ := q["relation"].(string)
+		switch relation {
+		case "", "intersects":
+			terms := map[string]bool{}
+			for _, cell := range cells {
+				terms[cell] = true
+				for i := 1; i < len(cell); i++ {
+					terms[GEO_SHAPE_CELL_MARK+cell[:i]] = true
+				}
+			}
+			sorted := make([]string, 0, len(terms))
+			for t := range terms {
+				sorted = append(sorted, t)
+			}
+			sort.Strings(sorted)
+
+			disjuncts := make([]interface{}, 0, len(sorted))
+			for _, t := range sorted {
+				disjuncts = append(disjuncts, term(t))
+			}
+			rv = map[string]interface{}{"disjuncts": disjuncts, "min": 1}
+
+		case "contains":
+			if truncated {
+				return nil, fmt.Errorf("geo_shapes: query shape needs"+
+					" more than maxCells: %d at precision: %d, field: %s",
+					maxCells, precision, field)
+			}
+			conjuncts := make([]interface{}, 0, len(cells))
+			for _, cell := range cells {
+				disjuncts := make([]interface{}, 0, len(cell))
+				for i := 1; i <= len(cell); i++ {
+					disjuncts = append(disjuncts,
+						term(GEO_SHAPE_CELL_MARK+cell[:i]))
+				}
+				conjuncts = append(conjuncts, map[string]interface{}{
+					"disjuncts": disjuncts, "min": 1,
+				})
+			}
+			rv = map[string]interface{}{"conjuncts": conjuncts}
+
+		default:
+			return nil, fmt.Errorf("geo_shapes: unknown relation: %q,"+
+				" field: %s", relation, field)
+		}
+
+		if boost, exists := q["boost"]; exists {
+			rv["boost"] = boost
+		}
+		return rv, nil
+	})
+}
@@ -0,0 +1,333 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func geoShapeTestParse(t *testing.T, geoJSON string) *geoShape {
+	var v interface{}
+	if err := json.Unmarshal([]byte(geoJSON), &v); err != nil {
+		t.Fatal(err)
+	}
+	s, err := parseGeoJSON(v)
+	if err != nil {
+		t.Fatalf("geoJSON: %s, err: %v", geoJSON, err)
+	}
+	return s
+}
+
+func geoShapeTestSquare(minLon, minLat, maxLon, maxLat float64) string {
+	return fmt.Sprintf(`[[%g,%g],[%g,%g],[%g,%g],[%g,%g],[%g,%g]]`,
+		minLon, minLat, maxLon, minLat, maxLon, maxLat, minLon, maxLat,
+		minLon, minLat)
+}
+
+func TestValidateBleveGeoShape(t *testing.T) {
+	err := ValidateBlevePIndexImpl("bleve", "idx", `{"mapping":{
+		"default_mapping":{"properties":{"zone":{"fields":[
+			{"name":"zone","type":"geoshape"}]}}}},
+		"geoShape":{"precision":8,"maxCells":2048}}`)
+	if err != nil {
+		t.Errorf("expected valid params, got: %v", err)
+	}
+
+	for _, g := range []*BleveGeoShape{
+		{Precision: -1},
+		{Precision: GEO_SHAPE_MAX_PRECISION + 1},
+		{MaxCells: 10},
+	} {
+		if validateBleveGeoShape(g) == nil {
+			t.Errorf("expected err, geoShape: %#v", g)
+		}
+	}
+
+	var g *BleveGeoShape
+	precision, maxCells := g.limits()
+	if precision != GEO_SHAPE_DEFAULT_PRECISION ||
+		maxCells != GEO_SHAPE_DEFAULT_MAX_CELLS {
+		t.Errorf("unexpected default limits: %d, %d", precision, maxCells)
+	}
+}
+
+func TestParseGeoJSON(t *testing.T) {
+	s := geoShapeTestParse(t, `{"type":"GeometryCollection","geometries":[
+		{"type":"Point","coordinates":[1,2]},
+		{"type":"MultiLineString","coordinates":[[[0,0],[1,1]],[[2,2],[3,3]]]},
+		{"type":"MultiPolygon","coordinates":[[`+
+		geoShapeTestSquare(0, 0, 1, 1)+`]]}]}`)
+	if len(s.points) != 1 || len(s.lines) != 2 || len(s.polygons) != 1 ||
+		s.points[0] != (geoPoint{1, 2}) {
+		t.Errorf("unexpected shape: %#v", s)
+	}
+
+	for _, geoJSON := range []string{
+		`"POINT (1 2)"`,
+		`{"type":"Circle","coordinates":[1,2]}`,
+		`{"type":"Point","coordinates":[181,0]}`,
+		`{"type":"Point","coordinates":["1","2"]}`,
+		`{"type":"LineString","coordinates":[[0,0]]}`,
+		`{"type":"Polygon","coordinates":[[[0,0],[1,1],[0,0]]]}`,
+		`{"type":"GeometryCollection","geometries":[]}`,
+	} {
+		var v interface{}
+		json.Unmarshal([]byte(geoJSON), &v)
+		if _, err := parseGeoJSON(v); err == nil {
+			t.Errorf("expected err, geoJSON: %s", geoJSON)
+		}
+	}
+}
+
+func TestGeohashRect(t *testing.T) {
+	r := geohashRect("u4pruydqqvj")
+	if !r.contains(geoPoint{10.40744, 57.64911}) ||
+		r.maxLon-r.minLon > 0.00002 || r.maxLat-r.minLat > 0.00002 {
+		t.Errorf("unexpected rect: %#v", r)
+	}
+
+	r = geohashRect("")
+	if r != (geoRect{-180, -90, 180, 90}) {
+		t.Errorf("expected the whole world, got: %#v", r)
+	}
+}
+
+func TestGeoShapeRelate(t *testing.T) {
+	s := geoShapeTestParse(t, `{"type":"Polygon","coordinates":[`+
+		geoShapeTestSquare(0, 0, 10, 10)+`,`+
+		geoShapeTestSquare(4, 4, 6, 6)+`]}`)
+
+	tests := []struct {
+		r   geoRect
+		exp int
+	}{
+		{geoRect{1, 1, 2, 2}, geoWithin},
+		{geoRect{4.5, 4.5, 5.5, 5.5}, geoDisjoint}, // In the hole.
+		{geoRect{3, 3, 5, 5}, geoIntersects},       // Across the hole.
+		{geoRect{9, 9, 11, 11}, geoIntersects},
+		{geoRect{-5, -5, 15, 15}, geoIntersects}, // Around the polygon.
+		{geoRect{11, 11, 12, 12}, geoDisjoint},
+	}
+	for i, test := range tests {
+		if got := s.relate(test.r); got != test.exp {
+			t.Errorf("%d: rect: %v, expected: %d, got: %d",
+				i, test.r, test.exp, got)
+		}
+	}
+
+	line := geoShapeTestParse(t,
+		`{"type":"LineString","coordinates":[[0,0],[10,10]]}`)
+	if line.relate(geoRect{4, 4, 6, 6}) != geoIntersects ||
+		line.relate(geoRect{6, 0, 10, 4}) != geoDisjoint {
+		t.Errorf("unexpected line relations")
+	}
+}
+
+func TestGeoShapeCells(t *testing.T) {
+	point := geoShapeTestParse(t, `{"type":"Point","coordinates":[10.40744,57.64911]}`)
+	cells, truncated := geoShapeCells(point, 7, 1024)
+	if truncated || !reflect.DeepEqual(cells, []string{"u4pruyd"}) {
+		t.Errorf("unexpected point cells: %v, truncated: %v",
+			cells, truncated)
+	}
+
+	square := geoShapeTestParse(t, `{"type":"Polygon","coordinates":[`+
+		geoShapeTestSquare(0, 0, 1, 1)+`]}`)
+	cells, truncated = geoShapeCells(square, 5, 1024)
+	if truncated || len(cells) > 1024 {
+		t.Errorf("expected the cells at precision, got: %d, truncated: %v",
+			len(cells), truncated)
+	}
+	levels := map[int]bool{}
+	for _, cell := range cells {
+		levels[len(cell)] = true
+		if square.relate(geohashRect(cell)) == geoDisjoint {
+			t.Errorf("expected the cells to cover the square, cell: %s",
+				cell)
+		}
+	}
+	if !levels[5] || len(levels) < 2 {
+		t.Errorf("expected coarse interior cells and fine edge cells,"+
+			" got levels: %v", levels)
+	}
+
+	cells, truncated = geoShapeCells(square, 9, 64)
+	if !truncated || len(cells) > 64 {
+		t.Errorf("expected truncated cells, got: %d, truncated: %v",
+			len(cells), truncated)
+	}
+
+	terms := geoShapeTerms([]string{"u4p", "u4q"})
+	exp := []interface{}{"=u4p", "=u4q", "u", "u4", "u4p", "u4q"}
+	if !reflect.DeepEqual(terms, exp) {
+		t.Errorf("unexpected terms: %v", terms)
+	}
+}
+
+func TestRewriteGeoShapeQueries(t *testing.T) {
+	point := `{"type":"Point","coordinates":[10.40744,57.64911]}`
+
+	out, err := rewriteGeoShapeQueries([]byte(`{"query":{"field":"zone",`+
+		`"geo_shape":`+point+`,"relation":"contains","boost":2}}`),
+		&BleveGeoShape{Precision: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `{"query":{"boost":2,"conjuncts":[{"disjuncts":[` +
+		`{"field":"zone","term":"=u"},{"field":"zone","term":"=u4"},` +
+		`{"field":"zone","term":"=u4p"}],"min":1}]}}`
+	if string(out) != exp {
+		t.Errorf("unexpected contains rewrite: %s", out)
+	}
+
+	out, err = rewriteGeoShapeQueries([]byte(`{"query":{"field":"zone",`+
+		`"geo_shape":`+point+`}}`), &BleveGeoShape{Precision: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = `{"query":{"disjuncts":[` +
+		`{"field":"zone","term":"=u"},{"field":"zone","term":"=u4"},` +
+		`{"field":"zone","term":"u4p"}],"min":1}}`
+	if string(out) != exp {
+		t.Errorf("unexpected intersects rewrite: %s", out)
+	}
+
+	big := `{"type":"Polygon","coordinates":[` +
+		geoShapeTestSquare(0, 0, 10, 10) + `]}`
+
+	for _, req := range []string{
+		`{"query":{"geo_shape":` + point + `}}`,
+		`{"query":{"field":"zone","geo_shape":{"type":"Point"}}}`,
+		`{"query":{"field":"zone","geo_shape":` + point +
+			`,"relation":"within"}}`,
+		`{"query":{"field":"zone","geo_shape":` + big +
+			`,"relation":"contains"}}`,
+	} {
+		_, err = rewriteGeoShapeQueries([]byte(req),
+			&BleveGeoShape{Precision: 9, MaxCells: 64})
+		if err == nil {
+			t.Errorf("expected err, req: %s", req)
+		}
+	}
+}
+
+func TestGeoShapesDataUpdate(t *testing.T) {
+	m := bleve.NewIndexMapping()
+	err := json.Unmarshal([]byte(`{"default_mapping": {"properties": {
+		"zone": {"fields": [{"name": "zone", "type": "geoshape",
+			"index": true}]}}}}`), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	geoShapeFields, err := applyGeoShapeFields(m)
+	if err != nil || !reflect.DeepEqual(geoShapeFields, []string{"zone"}) {
+		t.Fatalf("unexpected geoshape fields: %v, err: %v",
+			geoShapeFields, err)
+	}
+
+	bindex, err := bleve.NewMemOnly(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &BleveGeoShape{Precision: 5}
+
+	bdest := NewBleveDest("/tmp/geoShapes_1234_5678.pindex", bindex,
+		func() {})
+	bdest.geoShapeFields = geoShapeFields
+	bdest.geoShape = g
+	dest := &cbgt.DestForwarder{DestProvider: bdest}
+	defer dest.Close()
+
+	polygon := func(rings ...string) string {
+		return `{"zone":{"type":"Polygon","coordinates":[` +
+			strings.Join(rings, ",") + `]}}`
+	}
+
+	docs := []string{
+		polygon(geoShapeTestSquare(0, 0, 1, 1)),
+		polygon(geoShapeTestSquare(2, 0, 3, 1)),
+		polygon(geoShapeTestSquare(0, 2, 1, 3),
+			geoShapeTestSquare(0.25, 2.25, 0.75, 2.75)),
+		`{"zone":{"type":"LineString","coordinates":[[0.5,-1],[0.5,-0.5]]}}`,
+		`{"zone":{"type":"Polygon","coordinates":[[[0,0],[1,1]]]}}`,
+	}
+
+	dest.SnapshotStart("0", 1, uint64(len(docs)))
+	for i, doc := range docs {
+		err = dest.DataUpdate("0", []byte(fmt.Sprintf("%c", 'a'+i)), uint64(i+1),
+			[]byte(doc), 0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		relation string
+		geoJSON  string
+		exp      []string
+	}{
+		{"contains", `{"type":"Point","coordinates":[0.5,0.5]}`, []string{"a"}},
+		{"contains", `{"type":"Point","coordinates":[2.5,0.5]}`, []string{"b"}},
+		{"contains", `{"type":"Point","coordinates":[0.5,2.5]}`, nil}, // Hole.
+		{"contains", `{"type":"Point","coordinates":[0.1,2.1]}`, []string{"c"}},
+		{"contains", `{"type":"Point","coordinates":[5,5]}`, nil},
+		{"contains", `{"type":"Polygon","coordinates":[` +
+			geoShapeTestSquare(0.2, 0.2, 0.8, 0.8) + `]}`, []string{"a"}},
+		{"contains", `{"type":"Polygon","coordinates":[` +
+			geoShapeTestSquare(0.5, 0.5, 2.5, 0.8) + `]}`, nil},
+		{"intersects", `{"type":"Polygon","coordinates":[` +
+			geoShapeTestSquare(0.9, 0.9, 2.1, 1.5) + `]}`, []string{"a", "b"}},
+		{"", `{"type":"LineString","coordinates":[[0.5,-2],[0.5,2.1]]}`,
+			[]string{"a", "c", "d"}},
+		{"intersects", `{"type":"Point","coordinates":[0.5,2.5]}`, nil},
+	}
+	for i, test := range tests {
+		req, err := rewriteGeoShapeQueries([]byte(`{"query":{"field":"zone",`+
+			`"relation":"`+test.relation+`","geo_shape":`+test.geoJSON+
+			`},"size":10}`), g)
+		if err != nil {
+			t.Fatalf("%d: err: %v", i, err)
+		}
+		sr := &bleve.SearchRequest{}
+		if err = json.Unmarshal(req, sr); err != nil {
+			t.Fatal(err)
+		}
+		res, err := bindex.Search(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, hit := range res.Hits {
+			ids = append(ids, hit.ID)
+		}
+		sort.Strings(ids)
+		if !reflect.DeepEqual(ids, test.exp) {
+			t.Errorf("%d: %s %s, expected: %v, got: %v",
+				i, test.relation, test.geoJSON, test.exp, ids)
+		}
+	}
+
+	counts, _ := bdest.ingestErrors.Snapshot()
+	if counts["geoShapes"] != 1 {
+		t.Errorf("expected a geoShapes ingest error, got: %v", counts)
+	}
+}
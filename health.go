@@ -0,0 +1,166 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The health endpoints are for probes, like the liveness and
+// readiness probes of Kubernetes, where /api/health/live is a cheap
+// check that the node's REST API is responsive, and /api/health/ready
+// checks that the node can serve its share of queries: its cfg is
+// reachable, its manager has started and registered the node, and
+// the pindexes that the plan assigns to the node are open.  They
+// respond with a 200 status when healthy, or else a 503 status, and
+// they don't need auth (see auth.go).
+
+var healthStartTime = time.Now()
+
+// A HealthCheck is the result of one of the checks of readiness.
+type HealthCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// HealthPIndexesCheck is the check of the assigned pindexes.
+type HealthPIndexesCheck struct {
+	HealthCheck
+	Assigned int      `json:"assigned"`
+	Opened   int      `json:"opened"`
+	Missing  []string `json:"missing,omitempty"`
+}
+
+// HealthReady is the readiness of a node.
+type HealthReady struct {
+	Status   string               `json:"status"`
+	Cfg      HealthCheck          `json:"cfg"`
+	Manager  HealthCheck          `json:"manager"`
+	PIndexes *HealthPIndexesCheck `json:"pindexes,omitempty"`
+}
+
+// CalcHealthPIndexes checks that the pindexes that the plan assigns
+// to a node are open.
+func CalcHealthPIndexes(nodeUUID string, planPIndexes *cbgt.PlanPIndexes,
+	localPIndexes map[string]*cbgt.PIndex) *HealthPIndexesCheck {
+	rv := &HealthPIndexesCheck{}
+
+	if planPIndexes != nil {
+		for name, planPIndex := range planPIndexes.PlanPIndexes {
+			if planPIndex.Nodes[nodeUUID] == nil {
+				continue
+			}
+			rv.Assigned++
+			if localPIndexes[name] != nil {
+				rv.Opened++
+			} else {
+				rv.Missing = append(rv.Missing, name)
+			}
+		}
+	}
+
+	sort.Strings(rv.Missing)
+
+	rv.OK = len(rv.Missing) <= 0
+	if !rv.OK {
+		rv.Error = "assigned pindexes are not open yet"
+	}
+
+	return rv
+}
+
+// CalcHealthReady returns the readiness of a node.
+func CalcHealthReady(mgr *cbgt.Manager) *HealthReady {
+	rv := &HealthReady{Status: "ok"}
+
+	cfg := mgr.Cfg()
+
+	nodeDefs, _, err := cbgt.CfgGetNodeDefs(cfg, cbgt.NODE_DEFS_KNOWN)
+	if err != nil {
+		rv.Cfg.Error = err.Error()
+	} else {
+		rv.Cfg.OK = true
+	}
+
+	if rv.Cfg.OK {
+		if nodeDefs == nil || nodeDefs.NodeDefs[mgr.UUID()] == nil {
+			rv.Manager.Error = "node is not registered in the cluster"
+		} else {
+			rv.Manager.OK = true
+		}
+	} else {
+		rv.Manager.Error = "cfg is not reachable"
+	}
+
+	if rv.Manager.OK {
+		planPIndexes, _, err := cbgt.CfgGetPlanPIndexes(cfg)
+		if err != nil {
+			rv.Cfg.OK = false
+			rv.Cfg.Error = err.Error()
+		} else {
+			_, localPIndexes := mgr.CurrentMaps()
+			rv.PIndexes = CalcHealthPIndexes(mgr.UUID(),
+				planPIndexes, localPIndexes)
+		}
+	}
+
+	if !rv.Cfg.OK || !rv.Manager.OK ||
+		rv.PIndexes == nil || !rv.PIndexes.OK {
+		rv.Status = "unavailable"
+	}
+
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// HealthLiveHandler is a REST handler of the liveness of a node.
+type HealthLiveHandler struct{}
+
+func NewHealthLiveHandler() *HealthLiveHandler {
+	return &HealthLiveHandler{}
+}
+
+func (h *HealthLiveHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	rest.MustEncode(w, struct {
+		Status    string `json:"status"`
+		UptimeSec int64  `json:"uptimeSec"`
+	}{
+		Status:    "ok",
+		UptimeSec: int64(time.Since(healthStartTime) / time.Second),
+	})
+}
+
+// HealthReadyHandler is a REST handler of the readiness of a node.
+type HealthReadyHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewHealthReadyHandler(mgr *cbgt.Manager) *HealthReadyHandler {
+	return &HealthReadyHandler{mgr: mgr}
+}
+
+func (h *HealthReadyHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	ready := CalcHealthReady(h.mgr)
+	if ready.Status != "ok" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	rest.MustEncode(w, ready)
+}
@@ -0,0 +1,91 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestCalcHealthPIndexes(t *testing.T) {
+	planPIndexes := &cbgt.PlanPIndexes{
+		PlanPIndexes: map[string]*cbgt.PlanPIndex{
+			"p0": {Name: "p0", Nodes: map[string]*cbgt.PlanPIndexNode{
+				"a": {CanRead: true, CanWrite: true},
+			}},
+			"p1": {Name: "p1", Nodes: map[string]*cbgt.PlanPIndexNode{
+				"a": {CanRead: true, CanWrite: true},
+				"b": {CanRead: true, CanWrite: true},
+			}},
+			"p2": {Name: "p2", Nodes: map[string]*cbgt.PlanPIndexNode{
+				"b": {CanRead: true, CanWrite: true},
+			}},
+		},
+	}
+
+	c := CalcHealthPIndexes("a", planPIndexes, map[string]*cbgt.PIndex{
+		"p0": {Name: "p0"},
+	})
+	if c.OK || c.Assigned != 2 || c.Opened != 1 ||
+		!reflect.DeepEqual(c.Missing, []string{"p1"}) {
+		t.Errorf("expected p1 missing, got: %#v", c)
+	}
+
+	c = CalcHealthPIndexes("a", planPIndexes, map[string]*cbgt.PIndex{
+		"p0": {Name: "p0"},
+		"p1": {Name: "p1"},
+	})
+	if !c.OK || c.Assigned != 2 || c.Opened != 2 {
+		t.Errorf("expected ok, got: %#v", c)
+	}
+
+	c = CalcHealthPIndexes("c", nil, nil)
+	if !c.OK || c.Assigned != 0 {
+		t.Errorf("expected ok without a plan, got: %#v", c)
+	}
+}
+
+func TestHealthHandlers(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+
+	get := func(h http.Handler) int {
+		req, _ := http.NewRequest("GET", "http://x/api/health", nil)
+		record := httptest.NewRecorder()
+		h.ServeHTTP(record, req)
+		return record.Code
+	}
+
+	if get(NewHealthLiveHandler()) != 200 {
+		t.Errorf("expected live")
+	}
+
+	if get(NewHealthReadyHandler(mgr)) != 503 {
+		t.Errorf("expected not ready before the manager started")
+	}
+
+	mgr.Start("wanted")
+
+	if get(NewHealthReadyHandler(mgr)) != 200 {
+		t.Errorf("expected ready, got: %#v", CalcHealthReady(mgr))
+	}
+}
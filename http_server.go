@@ -0,0 +1,233 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// HTTPServerLimits are the timeouts and limits of a REST listener, so
+// that slow or oversized requests can't wedge a node.  Zero values
+// mean no limit.  The ReadTimeout and MaxBodyBytes don't apply to
+// the HTTPUploadRoutes.
+type HTTPServerLimits struct {
+	ReadHeaderTimeout time.Duration // Reading the request headers.
+	ReadTimeout       time.Duration // Reading the request body.
+	WriteTimeout      time.Duration // Writing the response.
+	IdleTimeout       time.Duration // Idle keep-alive connections.
+	MaxHeaderBytes    int
+	MaxBodyBytes      int64
+	MaxConns          int // Concurrent connections.
+}
+
+// DefaultHTTPServerLimits are the default limits of REST listeners,
+// where there's no default write timeout, as queries and pindex file
+// transfers can take longer than any fixed timeout.
+var DefaultHTTPServerLimits = HTTPServerLimits{
+	ReadHeaderTimeout: 10 * time.Second,
+	ReadTimeout:       60 * time.Second,
+	IdleTimeout:       120 * time.Second,
+	MaxHeaderBytes:    1 << 20,  // 1MB.
+	MaxBodyBytes:      64 << 20, // 64MB.
+}
+
+// HTTPUploadRoute is a route whose requests upload large bodies.
+type HTTPUploadRoute struct {
+	Method string
+	PathRE *regexp.Regexp
+}
+
+// HTTPUploadRoutes are the routes whose request bodies can be larger
+// than any fixed limit, like index archives, index definition
+// bundles and Cfg snapshots, which are exempt from the ReadTimeout
+// and MaxBodyBytes limits.
+var HTTPUploadRoutes = []HTTPUploadRoute{
+	{"PUT", regexp.MustCompile(`^/api/(v1/)?index/[^/]+/archive$`)},
+	{"POST", regexp.MustCompile(`^/api/(v1/)?indexDefsImport$`)},
+	{"POST", regexp.MustCompile(`^/api/(v1/)?cfgRestore$`)},
+}
+
+// IsHTTPUploadRoute returns true if a request is for one of the
+// HTTPUploadRoutes.
+func IsHTTPUploadRoute(req *http.Request) bool {
+	for _, r := range HTTPUploadRoutes {
+		if req.Method == r.Method && r.PathRE.MatchString(req.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns an error if a limit is negative.
+func (l HTTPServerLimits) Validate() error {
+	if l.ReadHeaderTimeout < 0 || l.ReadTimeout < 0 ||
+		l.WriteTimeout < 0 || l.IdleTimeout < 0 ||
+		l.MaxHeaderBytes < 0 || l.MaxBodyBytes < 0 || l.MaxConns < 0 {
+		return fmt.Errorf("http_server: limits can't be negative: %+v", l)
+	}
+	return nil
+}
+
+// HTTPServe serves a handler on a listener with the limits, over
+// https when there's a tlsConfig.
+func HTTPServe(addr string, handler http.Handler, tlsConfig *tls.Config,
+	limits HTTPServerLimits) error {
+	err := limits.Validate()
+	if err != nil {
+		return err
+	}
+
+	// The server's ReadTimeout would apply to every route, so the
+	// read timeout is instead set per request, on its connection.
+	conns := &httpConns{conns: map[string]net.Conn{}}
+
+	server := &http.Server{
+		Addr: addr,
+		Handler: conns.ReadTimeoutHandler(
+			MaxBodyHandler(handler, limits.MaxBodyBytes),
+			limits.ReadTimeout),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: limits.ReadHeaderTimeout,
+		WriteTimeout:      limits.WriteTimeout,
+		IdleTimeout:       limits.IdleTimeout,
+		MaxHeaderBytes:    limits.MaxHeaderBytes,
+		ConnState:         conns.track,
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	if limits.MaxConns > 0 {
+		listener = &limitListener{
+			Listener: listener,
+			sem:      make(chan struct{}, limits.MaxConns),
+		}
+	}
+
+	if tlsConfig != nil {
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.Serve(listener)
+}
+
+// httpConns tracks the open connections of a server by their remote
+// addresses, so that the handling of a request can reach its
+// connection.
+type httpConns struct {
+	m     sync.Mutex
+	conns map[string]net.Conn
+}
+
+func (c *httpConns) track(conn net.Conn, state http.ConnState) {
+	c.m.Lock()
+	switch state {
+	case http.StateNew:
+		c.conns[conn.RemoteAddr().String()] = conn
+	case http.StateHijacked, http.StateClosed:
+		delete(c.conns, conn.RemoteAddr().String())
+	}
+	c.m.Unlock()
+}
+
+// ReadTimeoutHandler limits the time to read the body of a request,
+// except for the HTTPUploadRoutes, by setting the read deadline of
+// the request's connection after its headers were read.
+func (c *httpConns) ReadTimeoutHandler(next http.Handler,
+	readTimeout time.Duration) http.Handler {
+	if readTimeout <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !IsHTTPUploadRoute(req) {
+			c.m.Lock()
+			conn := c.conns[req.RemoteAddr]
+			c.m.Unlock()
+
+			if conn != nil {
+				conn.SetReadDeadline(time.Now().Add(readTimeout))
+			}
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// MaxBodyHandler limits the size of the bodies of requests, except
+// for the HTTPUploadRoutes, where a request with a larger
+// Content-Length is rejected (413), and reads of a larger chunked
+// body fail.
+func MaxBodyHandler(next http.Handler, maxBodyBytes int64) http.Handler {
+	if maxBodyBytes <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if IsHTTPUploadRoute(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if req.ContentLength > maxBodyBytes {
+			rest.ShowError(w, req, fmt.Sprintf("http_server: request body"+
+				" too large, content length: %d, max: %d",
+				req.ContentLength, maxBodyBytes),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		req.Body = http.MaxBytesReader(w, req.Body, maxBodyBytes)
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// limitListener limits the number of concurrent connections, where
+// Accept waits for a connection to close when at the limit.
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.sem <- struct{}{}
+
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+
+	return &limitListenerConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+type limitListenerConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
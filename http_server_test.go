@@ -0,0 +1,243 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxBodyHandler(t *testing.T) {
+	h := MaxBodyHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			w.Write([]byte("ok"))
+		}), 10)
+
+	tests := []struct {
+		body          string
+		contentLength int64
+		exp           int
+	}{
+		{"small", 5, 200},
+		{"0123456789", 10, 200},
+		{"0123456789-too-large", 20, 413},
+		{"0123456789-chunked", -1, 400},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("PUT", "http://x/api/index/x",
+			io.MultiReader(strings.NewReader(test.body)))
+		req.ContentLength = test.contentLength
+		record := httptest.NewRecorder()
+		h.ServeHTTP(record, req)
+		if record.Code != test.exp {
+			t.Errorf("body: %q, expected: %d, got: %d",
+				test.body, test.exp, record.Code)
+		}
+	}
+
+	// The upload routes aren't limited.
+	for _, path := range []string{
+		"/api/index/x/archive", "/api/indexDefsImport", "/api/cfgRestore",
+		"/api/v1/index/x/archive", "/api/v1/indexDefsImport",
+		"/api/v1/cfgRestore",
+	} {
+		method := "POST"
+		if strings.HasSuffix(path, "/archive") {
+			method = "PUT"
+		}
+		req, _ := http.NewRequest(method, "http://x"+path,
+			strings.NewReader("0123456789-too-large"))
+		record := httptest.NewRecorder()
+		h.ServeHTTP(record, req)
+		if record.Code != 200 {
+			t.Errorf("path: %s, expected no limit, got: %d",
+				path, record.Code)
+		}
+	}
+
+	// Other routes are limited, even when they look like the upload
+	// routes.
+	for _, path := range []string{
+		"/api/v2/cfgRestore", "/api/v1/index/x/archive/x",
+	} {
+		req, _ := http.NewRequest("POST", "http://x"+path,
+			strings.NewReader("0123456789-too-large"))
+		if strings.Contains(path, "/archive") {
+			req.Method = "PUT"
+		}
+		record := httptest.NewRecorder()
+		h.ServeHTTP(record, req)
+		if record.Code != 413 {
+			t.Errorf("path: %s, expected a limit, got: %d",
+				path, record.Code)
+		}
+	}
+
+	mux := http.NewServeMux()
+	if MaxBodyHandler(mux, 0) != mux {
+		t.Errorf("expected no limit handler")
+	}
+}
+
+func TestHTTPServeReadTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	limits := DefaultHTTPServerLimits
+	limits.ReadTimeout = 100 * time.Millisecond
+
+	go HTTPServe(addr, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return
+			}
+			w.Write([]byte("ok"))
+		}), nil, limits)
+
+	// A slow body, sent after the read timeout.
+	send := func(method, path string) []byte {
+		var c net.Conn
+		for i := 0; i < 100; i++ {
+			c, err = net.Dial("tcp", addr)
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		c.Write([]byte(method + " " + path + " HTTP/1.1\r\nHost: x\r\n" +
+			"Content-Length: 4\r\nConnection: close\r\n\r\n"))
+		time.Sleep(300 * time.Millisecond)
+		c.Write([]byte("body"))
+
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf, _ := ioutil.ReadAll(c)
+		return buf
+	}
+
+	if buf := send("PUT", "/api/index/x"); bytes.Contains(buf, []byte("ok")) {
+		t.Errorf("expected the read timeout, got: %s", buf)
+	}
+	if buf := send("PUT", "/api/index/x/archive"); !bytes.Contains(buf, []byte("ok")) {
+		t.Errorf("expected no read timeout for an upload, got: %s", buf)
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &limitListener{Listener: ln, sem: make(chan struct{}, 1)}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	c1, _ := net.Dial("tcp", ln.Addr().String())
+	defer c1.Close()
+	c2, _ := net.Dial("tcp", ln.Addr().String())
+	defer c2.Close()
+
+	s1 := <-accepted
+	select {
+	case <-accepted:
+		t.Fatalf("expected the second conn to wait")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	s1.Close()
+	s1.Close() // Releases only once.
+
+	select {
+	case s2 := <-accepted:
+		s2.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the second conn after the first closed")
+	}
+}
+
+func TestHTTPServeReadHeaderTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	limits := DefaultHTTPServerLimits
+	limits.ReadHeaderTimeout = 100 * time.Millisecond
+
+	go HTTPServe(addr, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}), nil, limits)
+
+	var c net.Conn
+	for i := 0; i < 100; i++ {
+		c, err = net.Dial("tcp", addr)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// A slow client that never finishes its headers is disconnected.
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf, err := ioutil.ReadAll(c)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Errorf("expected a disconnect, got: %v", err)
+	}
+	if bytes.Contains(buf, []byte("ok")) {
+		t.Errorf("expected no response, got: %s", buf)
+	}
+
+	err = HTTPServe(addr, nil, nil, HTTPServerLimits{MaxConns: -1})
+	if err == nil {
+		t.Errorf("expected err on negative limits")
+	}
+}
@@ -0,0 +1,399 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// An index definitions bundle is a single JSON document of index
+// definitions, exported from one cluster and imported into another,
+// such as for promoting index definitions from dev to staging to
+// prod.  The bundle has no index UUIDs, as those are cluster
+// specific, and by default has no source UUIDs, as bucket UUIDs
+// differ between clusters.  Bundle entries may have a "profiles"
+// section (see index_profile.go), whose overlay for the importing
+// cluster's active profile is applied on import.
+
+const (
+	// Import fails without changes if any index definition in the
+	// bundle differs from an existing index definition.
+	INDEX_BUNDLE_CONFLICT_FAIL = "fail"
+
+	// Import skips the index definitions that already exist.
+	INDEX_BUNDLE_CONFLICT_SKIP = "skip"
+
+	// Import updates existing index definitions.
+	INDEX_BUNDLE_CONFLICT_OVERWRITE = "overwrite"
+)
+
+// The import actions of the entries of a bundle.
+const (
+	INDEX_BUNDLE_CREATE    = "create"
+	INDEX_BUNDLE_UPDATE    = "update"
+	INDEX_BUNDLE_SKIP      = "skip"
+	INDEX_BUNDLE_UNCHANGED = "unchanged"
+	INDEX_BUNDLE_CONFLICT  = "conflict"
+	INDEX_BUNDLE_FAILED    = "failed"
+)
+
+// IndexDefsBundle is a bundle of index definitions.
+type IndexDefsBundle struct {
+	ImplVersion string                  `json:"implVersion"`
+	ExportTime  string                  `json:"exportTime"`
+	IndexDefs   []*IndexDefsBundleEntry `json:"indexDefs"`
+}
+
+// IndexDefsBundleEntry is an index definition of a bundle.
+type IndexDefsBundleEntry struct {
+	Type         string          `json:"type"`
+	Name         string          `json:"name"`
+	Params       string          `json:"params"`
+	SourceType   string          `json:"sourceType"`
+	SourceName   string          `json:"sourceName,omitempty"`
+	SourceUUID   string          `json:"sourceUUID,omitempty"`
+	SourceParams string          `json:"sourceParams"`
+	PlanParams   cbgt.PlanParams `json:"planParams"`
+
+	Profiles map[string]interface{} `json:"profiles,omitempty"`
+}
+
+// IndexDefsBundleResult is the import outcome of a bundle entry.
+type IndexDefsBundleResult struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ExportIndexDefs returns a bundle of all the index definitions.
+func ExportIndexDefs(mgr *cbgt.Manager,
+	includeSourceUUIDs bool) (*IndexDefsBundle, error) {
+	indexDefs, _, err := cbgt.CfgGetIndexDefs(mgr.Cfg())
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &IndexDefsBundle{
+		ImplVersion: cbgt.VERSION,
+		ExportTime:  time.Now().Format(time.RFC3339Nano),
+		IndexDefs:   []*IndexDefsBundleEntry{},
+	}
+
+	if indexDefs == nil {
+		return rv, nil
+	}
+
+	names := make([]string, 0, len(indexDefs.IndexDefs))
+	for name := range indexDefs.IndexDefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		indexDef := indexDefs.IndexDefs[name]
+
+		e := &IndexDefsBundleEntry{
+			Type:         indexDef.Type,
+			Name:         indexDef.Name,
+			Params:       indexDef.Params,
+			SourceType:   indexDef.SourceType,
+			SourceName:   indexDef.SourceName,
+			SourceParams: indexDef.SourceParams,
+			PlanParams:   indexDef.PlanParams,
+		}
+		if includeSourceUUIDs {
+			e.SourceUUID = indexDef.SourceUUID
+		}
+
+		rv.IndexDefs = append(rv.IndexDefs, e)
+	}
+
+	return rv, nil
+}
+
+// ImportIndexDefs creates or updates the index definitions of a
+// bundle, based on the conflict policy, and returns the action for
+// each entry.  With dryRun, the actions are returned but not applied.
+func ImportIndexDefs(mgr *cbgt.Manager, bundle *IndexDefsBundle,
+	conflict, profile string, dryRun bool) ([]*IndexDefsBundleResult, error) {
+	switch conflict {
+	case "":
+		conflict = INDEX_BUNDLE_CONFLICT_FAIL
+	case INDEX_BUNDLE_CONFLICT_FAIL, INDEX_BUNDLE_CONFLICT_SKIP,
+		INDEX_BUNDLE_CONFLICT_OVERWRITE:
+	default:
+		return nil, fmt.Errorf("index_bundle: unknown conflict: %s",
+			conflict)
+	}
+
+	profile, err := IndexProfile(mgr, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Aliases are imported last, as they refer to other indexes.
+	entries := append([]*IndexDefsBundleEntry(nil), bundle.IndexDefs...)
+	sort.Stable(indexBundleEntriesAliasesLast(entries))
+
+	seen := map[string]bool{}
+
+	results := make([]*IndexDefsBundleResult, 0, len(entries))
+	conflicts := 0
+
+	for i, e := range entries {
+		if e.Name == "" || seen[e.Name] {
+			return nil, fmt.Errorf("index_bundle: missing or duplicate"+
+				" index name, entry: %d, name: %q", i, e.Name)
+		}
+		seen[e.Name] = true
+
+		if overlay, exists := e.Profiles[profile]; exists && profile != "" {
+			e, err = applyIndexBundleProfile(e, overlay)
+			if err != nil {
+				return nil, err
+			}
+			entries[i] = e
+		}
+
+		r := &IndexDefsBundleResult{Name: e.Name, Action: INDEX_BUNDLE_CREATE}
+
+		if prev := indexDefsByName[e.Name]; prev != nil {
+			switch {
+			case indexBundleEntrySame(e, prev):
+				r.Action = INDEX_BUNDLE_UNCHANGED
+			case conflict == INDEX_BUNDLE_CONFLICT_SKIP:
+				r.Action = INDEX_BUNDLE_SKIP
+			case conflict == INDEX_BUNDLE_CONFLICT_OVERWRITE:
+				r.Action = INDEX_BUNDLE_UPDATE
+			default:
+				r.Action = INDEX_BUNDLE_CONFLICT
+				conflicts++
+			}
+		}
+
+		results = append(results, r)
+	}
+
+	if dryRun || conflicts > 0 {
+		return results, nil
+	}
+
+	for i, e := range entries {
+		r := results[i]
+
+		prevIndexUUID := ""
+		switch r.Action {
+		case INDEX_BUNDLE_CREATE:
+		case INDEX_BUNDLE_UPDATE:
+			prevIndexUUID = indexDefsByName[e.Name].UUID
+		default:
+			continue
+		}
+
+		err = CreateIndexChecked(mgr, e.SourceType, e.SourceName,
+			e.SourceUUID, e.SourceParams, e.Type, e.Name, e.Params,
+			e.PlanParams, prevIndexUUID)
+		if err != nil {
+			r.Action = INDEX_BUNDLE_FAILED
+			r.Error = err.Error()
+		}
+	}
+
+	return results, nil
+}
+
+type indexBundleEntriesAliasesLast []*IndexDefsBundleEntry
+
+func (a indexBundleEntriesAliasesLast) Len() int      { return len(a) }
+func (a indexBundleEntriesAliasesLast) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a indexBundleEntriesAliasesLast) Less(i, j int) bool {
+	return a[i].Type != "alias" && a[j].Type == "alias"
+}
+
+// applyIndexBundleProfile returns a copy of a bundle entry with a
+// profile's overlay applied.
+func applyIndexBundleProfile(e *IndexDefsBundleEntry,
+	overlay interface{}) (*IndexDefsBundleEntry, error) {
+	m, ok := overlay.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("index_bundle: profile overlay is not"+
+			" an object, name: %s", e.Name)
+	}
+
+	rv := *e
+	rv.Profiles = nil
+
+	for field, v := range m {
+		var err error
+		var params interface{}
+
+		switch field {
+		case "params":
+			params, err = ApplyIndexProfile(rv.Params, v)
+			if err == nil {
+				rv.Params = params.(string)
+			}
+		case "sourceParams":
+			params, err = ApplyIndexProfile(rv.SourceParams, v)
+			if err == nil {
+				rv.SourceParams = params.(string)
+			}
+		case "planParams":
+			var buf []byte
+			buf, err = json.Marshal(rv.PlanParams)
+			if err == nil {
+				params, err = ApplyIndexProfile(string(buf), v)
+			}
+			if err == nil {
+				planParams := cbgt.PlanParams{}
+				err = json.Unmarshal([]byte(params.(string)), &planParams)
+				rv.PlanParams = planParams
+			}
+		default:
+			err = fmt.Errorf("index_bundle: unsupported profile overlay"+
+				" field: %s", field)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &rv, nil
+}
+
+// indexBundleEntrySame returns true if a bundle entry is equivalent
+// to an existing index definition.
+func indexBundleEntrySame(e *IndexDefsBundleEntry,
+	indexDef *cbgt.IndexDef) bool {
+	return e.Type == indexDef.Type &&
+		e.SourceType == indexDef.SourceType &&
+		e.SourceName == indexDef.SourceName &&
+		(e.SourceUUID == "" || e.SourceUUID == indexDef.SourceUUID) &&
+		jsonStringsEqual(e.Params, indexDef.Params) &&
+		jsonStringsEqual(e.SourceParams, indexDef.SourceParams) &&
+		reflect.DeepEqual(e.PlanParams, indexDef.PlanParams)
+}
+
+// jsonStringsEqual returns true if two strings are equivalent JSON,
+// ignoring formatting and key order.
+func jsonStringsEqual(a, b string) bool {
+	if a == b {
+		return true
+	}
+	if a == "" {
+		a = "null"
+	}
+	if b == "" {
+		b = "null"
+	}
+	var av, bv interface{}
+	if json.Unmarshal([]byte(a), &av) != nil ||
+		json.Unmarshal([]byte(b), &bv) != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// ---------------------------------------------------------
+
+// IndexDefsExportHandler is a REST handler that exports all index
+// definitions as a bundle.
+type IndexDefsExportHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexDefsExportHandler(mgr *cbgt.Manager) *IndexDefsExportHandler {
+	return &IndexDefsExportHandler{mgr: mgr}
+}
+
+func (h *IndexDefsExportHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	bundle, err := ExportIndexDefs(h.mgr,
+		req.FormValue("includeSourceUUIDs") == "true")
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_bundle: could not"+
+			" export, err: %v", err), 500)
+		return
+	}
+
+	rest.MustEncode(w, bundle)
+}
+
+// IndexDefsImportHandler is a REST handler that imports a bundle of
+// index definitions.
+type IndexDefsImportHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexDefsImportHandler(mgr *cbgt.Manager) *IndexDefsImportHandler {
+	return &IndexDefsImportHandler{mgr: mgr}
+}
+
+func (h *IndexDefsImportHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_bundle: could not read"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	bundle := &IndexDefsBundle{}
+	err = json.Unmarshal(requestBody, bundle)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_bundle: could not parse"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	results, err := ImportIndexDefs(h.mgr, bundle,
+		req.FormValue("conflict"), req.FormValue("profile"),
+		req.FormValue("dryRun") == "true")
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), IndexCreateErrorStatus(err, 400))
+		return
+	}
+
+	status := "ok"
+	for _, r := range results {
+		if r.Action == INDEX_BUNDLE_CONFLICT ||
+			r.Action == INDEX_BUNDLE_FAILED {
+			status = "error"
+		}
+	}
+
+	if status != "ok" {
+		w.WriteHeader(409)
+	}
+
+	rest.MustEncode(w, struct {
+		Status  string                   `json:"status"`
+		Results []*IndexDefsBundleResult `json:"results"`
+	}{
+		Status:  status,
+		Results: results,
+	})
+}
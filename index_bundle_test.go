@@ -0,0 +1,158 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestJSONStringsEqual(t *testing.T) {
+	tests := []struct {
+		a, b string
+		exp  bool
+	}{
+		{"", "", true},
+		{`{"a":1,"b":2}`, `{ "b": 2, "a": 1 }`, true},
+		{`{"a":1}`, `{"a":2}`, false},
+		{"", `{}`, false},
+		{"not json", `{}`, false},
+	}
+	for _, test := range tests {
+		if jsonStringsEqual(test.a, test.b) != test.exp {
+			t.Errorf("expected %v for %q vs %q", test.exp, test.a, test.b)
+		}
+	}
+}
+
+func TestIndexDefsExportImport(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	newMgr := func() *cbgt.Manager {
+		mgr := cbgt.NewManager(cbgt.VERSION, cbgt.NewCfgMem(),
+			cbgt.NewUUID(), nil, "", 1, "", ":1000", emptyDir,
+			"some-datasource", nil)
+		mgr.Start("wanted")
+		return mgr
+	}
+
+	src := newMgr()
+
+	err := src.CreateIndex("primary", "", "", "",
+		"bleve", "a", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	err = src.CreateIndex("nil", "", "", "",
+		"alias", "al", `{"targets":{"a":{}}}`, cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	bundle, err := ExportIndexDefs(src, false)
+	if err != nil || len(bundle.IndexDefs) != 2 {
+		t.Fatalf("expected bundle, got: %#v, err: %v", bundle, err)
+	}
+	if bundle.IndexDefs[0].Name != "a" || bundle.IndexDefs[1].Name != "al" {
+		t.Errorf("expected sorted bundle, got: %#v", bundle.IndexDefs)
+	}
+
+	// Aliases are imported last, even when first in the bundle.
+	bundle.IndexDefs[0], bundle.IndexDefs[1] =
+		bundle.IndexDefs[1], bundle.IndexDefs[0]
+
+	bundle.IndexDefs[1].Profiles = map[string]interface{}{
+		"prod": map[string]interface{}{
+			"planParams": map[string]interface{}{
+				"maxPartitionsPerPIndex": 7,
+			},
+		},
+	}
+
+	dst := newMgr()
+
+	actions := func(results []*IndexDefsBundleResult) map[string]string {
+		m := map[string]string{}
+		for _, r := range results {
+			m[r.Name] = r.Action + r.Error
+		}
+		return m
+	}
+
+	results, err := ImportIndexDefs(dst, bundle, "", "prod", true)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if m := actions(results); m["a"] != INDEX_BUNDLE_CREATE ||
+		m["al"] != INDEX_BUNDLE_CREATE {
+		t.Errorf("expected creates, got: %#v", m)
+	}
+	_, indexDefsByName, _ := dst.GetIndexDefs(true)
+	if len(indexDefsByName) != 0 {
+		t.Errorf("expected no changes on a dry run")
+	}
+
+	results, err = ImportIndexDefs(dst, bundle, "", "prod", false)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if m := actions(results); m["a"] != INDEX_BUNDLE_CREATE ||
+		m["al"] != INDEX_BUNDLE_CREATE {
+		t.Errorf("expected creates, got: %#v", m)
+	}
+	_, indexDefsByName, _ = dst.GetIndexDefs(true)
+	if indexDefsByName["a"] == nil ||
+		indexDefsByName["a"].PlanParams.MaxPartitionsPerPIndex != 7 {
+		t.Errorf("expected profile overlay, got: %#v", indexDefsByName["a"])
+	}
+
+	// Without the profile, the bundle now conflicts with "a".
+	results, err = ImportIndexDefs(dst, bundle, "", "dev", false)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if m := actions(results); m["a"] != INDEX_BUNDLE_CONFLICT ||
+		m["al"] != INDEX_BUNDLE_UNCHANGED {
+		t.Errorf("expected conflict, got: %#v", m)
+	}
+
+	results, _ = ImportIndexDefs(dst, bundle, INDEX_BUNDLE_CONFLICT_SKIP,
+		"dev", false)
+	if m := actions(results); m["a"] != INDEX_BUNDLE_SKIP {
+		t.Errorf("expected skip, got: %#v", m)
+	}
+
+	results, _ = ImportIndexDefs(dst, bundle,
+		INDEX_BUNDLE_CONFLICT_OVERWRITE, "dev", false)
+	if m := actions(results); m["a"] != INDEX_BUNDLE_UPDATE {
+		t.Errorf("expected update, got: %#v", m)
+	}
+	_, indexDefsByName, _ = dst.GetIndexDefs(true)
+	if indexDefsByName["a"].PlanParams.MaxPartitionsPerPIndex != 0 {
+		t.Errorf("expected overwrite, got: %#v", indexDefsByName["a"])
+	}
+
+	_, err = ImportIndexDefs(dst, bundle, "bogus", "", false)
+	if err == nil {
+		t.Errorf("expected err on an unknown conflict policy")
+	}
+
+	bundle.IndexDefs = append(bundle.IndexDefs, bundle.IndexDefs[0])
+	_, err = ImportIndexDefs(dst, bundle, "", "", false)
+	if err == nil {
+		t.Errorf("expected err on a duplicate name")
+	}
+}
@@ -0,0 +1,193 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// Cloning a bleve index creates a new index with the same data source
+// and plan params as the source index, but with a modified mapping
+// (and, optionally, other modified index params), whose build starts
+// right away.  Once the clone has caught up, an index alias can be
+// switched over from the source index to the clone, so that a mapping
+// change doesn't leave applications with a partially built index.
+// Unlike a sample (see sample.go), a clone is fed from the data
+// source, not from the source index.
+
+// IndexCloneRequest is the JSON request body of an index clone.
+type IndexCloneRequest struct {
+	// The name of the new index, which is required.
+	Target string `json:"target"`
+
+	// The mapping of the new index, which replaces the mapping of the
+	// source index, where no mapping means the same mapping.
+	Mapping json.RawMessage `json:"mapping"`
+
+	// Optional index params that are deep-merged over the index
+	// params of the source index, like {"store": {...}}.
+	Params json.RawMessage `json:"params"`
+}
+
+// CloneIndexParams returns the index params of a clone, from the index
+// params of the source index.
+func CloneIndexParams(indexParams string,
+	creq *IndexCloneRequest) (string, error) {
+	if len(creq.Params) > 0 {
+		overlay, err := parseJSONUseNumber(creq.Params)
+		if err != nil {
+			return "", fmt.Errorf("index_clone: could not parse"+
+				" params, err: %v", err)
+		}
+
+		v, err := ApplyIndexProfile(indexParams, overlay)
+		if err != nil {
+			return "", err
+		}
+		indexParams = v.(string)
+	}
+
+	if len(creq.Mapping) <= 0 {
+		return indexParams, nil
+	}
+
+	mapping, err := parseJSONUseNumber(creq.Mapping)
+	if err != nil {
+		return "", fmt.Errorf("index_clone: could not parse"+
+			" mapping, err: %v", err)
+	}
+
+	params := map[string]interface{}{}
+	if indexParams != "" {
+		v, err := parseJSONUseNumber([]byte(indexParams))
+		if err != nil {
+			return "", fmt.Errorf("index_clone: could not parse"+
+				" index params, err: %v", err)
+		}
+		if m, ok := v.(map[string]interface{}); ok {
+			params = m
+		}
+	}
+
+	params["mapping"] = mapping
+
+	buf, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// CloneIndex creates a new index from a bleve index, with the index
+// params of the clone request.  The clone's plan params are the
+// source index's, except that the clone isn't frozen and has its
+// ingest and queries enabled.
+func CloneIndex(mgr *cbgt.Manager, indexName string,
+	creq *IndexCloneRequest) error {
+	if creq.Target == "" {
+		return fmt.Errorf("index_clone: target is required")
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return err
+	}
+
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil || indexDef.Type != "bleve" {
+		return fmt.Errorf("index_clone: not a bleve index, indexName: %s",
+			indexName)
+	}
+
+	if indexDefsByName[creq.Target] != nil {
+		return fmt.Errorf("index_clone: target already exists,"+
+			" target: %s", creq.Target)
+	}
+
+	indexParams, err := CloneIndexParams(indexDef.Params, creq)
+	if err != nil {
+		return err
+	}
+
+	planParams := indexDef.PlanParams
+	planParams.PlanFrozen = false
+	planParams.NodePlanParams = nil
+
+	err = CreateIndexChecked(mgr, indexDef.SourceType,
+		indexDef.SourceName, indexDef.SourceUUID, indexDef.SourceParams,
+		indexDef.Type, creq.Target, indexParams, planParams, "")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("index_clone: cloned, indexName: %s, target: %s",
+		indexName, creq.Target)
+
+	return nil
+}
+
+// ---------------------------------------------------------
+
+// IndexCloneHandler is a REST handler that clones an index with a new
+// mapping.
+type IndexCloneHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexCloneHandler(mgr *cbgt.Manager) *IndexCloneHandler {
+	return &IndexCloneHandler{mgr: mgr}
+}
+
+func (h *IndexCloneHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_clone: could not read"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	creq := &IndexCloneRequest{}
+	err = json.Unmarshal(requestBody, creq)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_clone: could not parse"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	err = CloneIndex(h.mgr, indexName, creq)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), IndexCreateErrorStatus(err, 400))
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+		Target string `json:"target"`
+	}{
+		Status: "ok",
+		Target: creq.Target,
+	})
+}
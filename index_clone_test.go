@@ -0,0 +1,108 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestCloneIndexParams(t *testing.T) {
+	indexParams := `{"mapping":{"default_analyzer":"en"},"store":{"kvStoreName":"boltdb"}}`
+
+	rv, err := CloneIndexParams(indexParams, &IndexCloneRequest{})
+	if err != nil || rv != indexParams {
+		t.Errorf("expected the same params, got: %s, err: %v", rv, err)
+	}
+
+	rv, err = CloneIndexParams(indexParams, &IndexCloneRequest{
+		Mapping: json.RawMessage(`{"default_type":"beer"}`),
+		Params:  json.RawMessage(`{"store":{"mossStoreOptions":{}}}`),
+	})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	exp := `{"mapping":{"default_type":"beer"},"store":{"kvStoreName":"boltdb","mossStoreOptions":{}}}`
+	if rv != exp {
+		t.Errorf("expected: %s, got: %s", exp, rv)
+	}
+
+	rv, err = CloneIndexParams("", &IndexCloneRequest{
+		Mapping: json.RawMessage(`{"default_type":"beer"}`),
+	})
+	if err != nil || rv != `{"mapping":{"default_type":"beer"}}` {
+		t.Errorf("expected a mapping without source params, got: %s,"+
+			" err: %v", rv, err)
+	}
+
+	_, err = CloneIndexParams(indexParams, &IndexCloneRequest{
+		Mapping: json.RawMessage(`{bad`),
+	})
+	if err == nil {
+		t.Errorf("expected err on a bad mapping")
+	}
+}
+
+func TestCloneIndex(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	planParams := cbgt.PlanParams{MaxPartitionsPerPIndex: 10}
+
+	err := mgr.CreateIndex("primary", "default", "123", "",
+		"bleve", "beers", "", planParams, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	err = CloneIndex(mgr, "beers", &IndexCloneRequest{})
+	if err == nil || !strings.Contains(err.Error(), "target") {
+		t.Errorf("expected err without a target, got: %v", err)
+	}
+
+	err = CloneIndex(mgr, "missing", &IndexCloneRequest{Target: "x"})
+	if err == nil {
+		t.Errorf("expected err on a missing index")
+	}
+
+	err = CloneIndex(mgr, "beers", &IndexCloneRequest{Target: "beers"})
+	if err == nil {
+		t.Errorf("expected err on an existing target")
+	}
+
+	err = CloneIndex(mgr, "beers", &IndexCloneRequest{
+		Target:  "beers-v2",
+		Mapping: json.RawMessage(`{"default_analyzer":"standard"}`),
+	})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	_, indexDefsByName, _ := mgr.GetIndexDefs(true)
+	clone := indexDefsByName["beers-v2"]
+	if clone == nil || clone.SourceType != "primary" ||
+		clone.SourceName != "default" ||
+		clone.PlanParams.MaxPartitionsPerPIndex != 10 ||
+		!strings.Contains(clone.Params, "standard") {
+		t.Errorf("unexpected clone: %+v", clone)
+	}
+}
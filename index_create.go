@@ -0,0 +1,138 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// Every index creation, whether by a PUT of an index definition or
+// by another operation that creates indexes (such as sample indexes,
+// clones, bundle imports, history restores, re-shards, composites and
+// templates), is checked against the node's disk high watermark, the
+// quotas of the index's namespace and the cluster's capacity, by
+// CheckIndexCreate.
+
+// IndexCreateError is an error of the checks of an index creation,
+// with its HTTP status.
+type IndexCreateError struct {
+	Status int
+	Msg    string
+}
+
+func (e *IndexCreateError) Error() string {
+	return e.Msg
+}
+
+// CheckIndexCreate returns an error when an index create/update
+// request may not proceed, or else a warning, if any, such as under
+// the "warn" capacityGuardrail setting.
+func CheckIndexCreate(mgr *cbgt.Manager, r *IndexQuotaRequest) (
+	warning string, err error) {
+	err = checkDiskWatermark(mgr, r.IndexName)
+	if err != nil {
+		return "", err
+	}
+
+	err = CheckNamespaceQuota(mgr, r)
+	if err != nil {
+		return "", &IndexCreateError{Status: 400, Msg: err.Error()}
+	}
+
+	return checkCapacity(mgr, r)
+}
+
+// CreateIndexChecked creates an index like mgr.CreateIndex, after
+// the checks of CheckIndexCreate.
+func CreateIndexChecked(mgr *cbgt.Manager,
+	sourceType, sourceName, sourceUUID, sourceParams,
+	indexType, indexName, indexParams string,
+	planParams cbgt.PlanParams, prevIndexUUID string) error {
+	warning, err := CheckIndexCreate(mgr, &IndexQuotaRequest{
+		IndexName:     indexName,
+		IndexType:     indexType,
+		IndexParams:   indexParams,
+		SourceType:    sourceType,
+		SourceName:    sourceName,
+		SourceUUID:    sourceUUID,
+		SourceParams:  sourceParams,
+		PlanParams:    planParams,
+		PrevIndexUUID: prevIndexUUID,
+	})
+	if err != nil {
+		return err
+	}
+	if warning != "" {
+		log.Printf("%s", warning)
+	}
+
+	return mgr.CreateIndex(sourceType, sourceName, sourceUUID, sourceParams,
+		indexType, indexName, indexParams, planParams, prevIndexUUID)
+}
+
+// IndexCreateErrorStatus returns the HTTP status of an error of an
+// index creation, or the default status.
+func IndexCreateErrorStatus(err error, status int) int {
+	if e, ok := err.(*IndexCreateError); ok {
+		return e.Status
+	}
+	return status
+}
+
+// ---------------------------------------------------------
+
+// IndexCreateGuardHandler is a REST handler that checks an index
+// create/update request with CheckIndexCreate, and then delegates to
+// the next (usually the index create) handler.  A warning is returned
+// as a Warning response header.
+type IndexCreateGuardHandler struct {
+	mgr  *cbgt.Manager
+	next http.Handler
+}
+
+func NewIndexCreateGuardHandler(mgr *cbgt.Manager,
+	next http.Handler) *IndexCreateGuardHandler {
+	return &IndexCreateGuardHandler{mgr: mgr, next: next}
+}
+
+func (h *IndexCreateGuardHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	r, err := readIndexQuotaRequest(indexName, req)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	warning, err := CheckIndexCreate(h.mgr, r)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), IndexCreateErrorStatus(err, 500))
+		return
+	}
+
+	if warning != "" {
+		log.Printf("%s", warning)
+
+		w.Header().Add("Warning", "199 cbft "+strconv.Quote(warning))
+	}
+
+	h.next.ServeHTTP(w, req)
+}
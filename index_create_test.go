@@ -0,0 +1,68 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestCreateIndexChecked(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	err := SetNamespace(cfg, &Namespace{Name: "acme", MaxIndexes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = CreateIndexChecked(mgr, "nil", "", "", "",
+		"blackhole", "acme__a", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	err = CreateIndexChecked(mgr, "nil", "", "", "",
+		"blackhole", "acme__b", "", cbgt.PlanParams{}, "")
+	if IndexCreateErrorStatus(err, 500) != 400 {
+		t.Errorf("expected a 400 err on exceeding maxIndexes, got: %v", err)
+	}
+
+	atomic.StoreInt32(&diskWatermarkHigh, 1)
+	defer atomic.StoreInt32(&diskWatermarkHigh, 0)
+
+	err = CreateIndexChecked(mgr, "nil", "", "", "",
+		"blackhole", "other", "", cbgt.PlanParams{}, "")
+	if IndexCreateErrorStatus(err, 500) != http.StatusInsufficientStorage {
+		t.Errorf("expected a 507 err over the high watermark, got: %v", err)
+	}
+
+	_, err = CheckIndexCreate(mgr, &IndexQuotaRequest{IndexName: "acme__a"})
+	if err != nil {
+		t.Errorf("expected updates over the high watermark, got: %v", err)
+	}
+
+	if IndexCreateErrorStatus(fmt.Errorf("x"), 500) != 500 {
+		t.Errorf("expected the default status of other errs")
+	}
+}
@@ -0,0 +1,266 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// An index definition can be sized before it's created, for capacity
+// planning, by building a throwaway bleve index of a sample of the
+// source documents, with the index definition's params, in a temp dir
+// of the node's dataDir.  The disk size, the heap growth and the
+// build time of the sample index are then scaled up to the number of
+// documents of the data source, and to the partitions and replicas
+// of the index definition.  The estimate is rough: the heap growth is
+// measured while the node does its other work, the build time doesn't
+// include fetching the documents from the data source, and the
+// partitions are assumed to be built in parallel.
+
+// The max number of sample documents of an index estimate.
+var IndexEstimateMaxSampleDocs = 10000
+
+// IndexSampleEstimate is the measured footprint of a sample index.
+type IndexSampleEstimate struct {
+	Docs      int   `json:"docs"`
+	DocBytes  int64 `json:"docBytes"`
+	DiskBytes int64 `json:"diskBytes"`
+	MemBytes  int64 `json:"memBytes"`
+	BuildMS   int64 `json:"buildMS"`
+}
+
+// IndexEstimate is the estimated footprint of an index definition.
+type IndexEstimate struct {
+	Sample *IndexSampleEstimate `json:"sample"`
+
+	DocCount   int64 `json:"docCount"`
+	Partitions int   `json:"partitions"`
+	Replicas   int   `json:"replicas"`
+
+	// The totals across all partitions and replicas.
+	DiskBytes int64 `json:"diskBytes"`
+	MemBytes  int64 `json:"memBytes"`
+
+	// The estimated time to build the index, without replicas.
+	BuildSecs float64 `json:"buildSecs"`
+}
+
+// EstimateIndexSample builds a throwaway bleve index of sample
+// documents, keyed by doc ID, in a temp dir of a parent dir, and
+// measures it.
+func EstimateIndexSample(parentDir, indexParams string,
+	docs map[string]json.RawMessage) (*IndexSampleEstimate, error) {
+	if len(docs) <= 0 {
+		return nil, fmt.Errorf("index_estimate: sample docs are required")
+	}
+	if len(docs) > IndexEstimateMaxSampleDocs {
+		return nil, fmt.Errorf("index_estimate: too many sample docs: %d,"+
+			" max: %d", len(docs), IndexEstimateMaxSampleDocs)
+	}
+
+	path, err := ioutil.TempDir(parentDir, "estimate-")
+	if err != nil {
+		return nil, fmt.Errorf("index_estimate: temp dir, err: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	path = path + string(os.PathSeparator) + "sample.pindex"
+
+	var memBefore runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&memBefore)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", indexParams, path,
+		func() {})
+	if err != nil {
+		return nil, err
+	}
+
+	bindex, ok := impl.(bleve.Index)
+	if !ok || bindex == nil {
+		dest.Close()
+		return nil, fmt.Errorf("index_estimate: not a bleve index")
+	}
+
+	rv := &IndexSampleEstimate{Docs: len(docs)}
+
+	startTime := time.Now()
+
+	batch := bindex.NewBatch()
+	for docID, doc := range docs {
+		var v interface{}
+		err = json.Unmarshal(doc, &v)
+		if err != nil {
+			dest.Close()
+			return nil, fmt.Errorf("index_estimate: could not parse"+
+				" sample doc: %s, err: %v", docID, err)
+		}
+		rv.DocBytes += int64(len(docID) + len(doc))
+
+		err = batch.Index(docID, v)
+		if err != nil {
+			dest.Close()
+			return nil, err
+		}
+	}
+
+	err = bindex.Batch(batch)
+	if err != nil {
+		dest.Close()
+		return nil, err
+	}
+
+	rv.BuildMS = int64(time.Since(startTime) / time.Millisecond)
+
+	var memAfter runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&memAfter)
+
+	if memAfter.HeapAlloc > memBefore.HeapAlloc {
+		rv.MemBytes = int64(memAfter.HeapAlloc - memBefore.HeapAlloc)
+	}
+
+	err = dest.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	rv.DiskBytes, err = DirSize(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+// CalcIndexEstimate scales up the footprint of a sample index to the
+// documents, partitions and replicas of an index definition.
+func CalcIndexEstimate(sample *IndexSampleEstimate, docCount int64,
+	partitions, replicas int) *IndexEstimate {
+	rv := &IndexEstimate{
+		Sample:     sample,
+		DocCount:   docCount,
+		Partitions: partitions,
+		Replicas:   replicas,
+	}
+
+	if sample == nil || sample.Docs <= 0 {
+		return rv
+	}
+
+	scale := float64(docCount) / float64(sample.Docs)
+	copies := float64(1 + replicas)
+
+	rv.DiskBytes = int64(float64(sample.DiskBytes) * scale * copies)
+	rv.MemBytes = int64(float64(sample.MemBytes) * scale * copies)
+
+	parallelism := float64(partitions)
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	rv.BuildSecs = float64(sample.BuildMS) / 1000.0 * scale / parallelism
+
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// IndexEstimateHandler is a REST handler that estimates the footprint
+// of an index definition from sample documents.
+type IndexEstimateHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexEstimateHandler(mgr *cbgt.Manager) *IndexEstimateHandler {
+	return &IndexEstimateHandler{mgr: mgr}
+}
+
+func (h *IndexEstimateHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_estimate: could not"+
+			" read request body, err: %v", err), 400)
+		return
+	}
+
+	var p struct {
+		Docs     map[string]json.RawMessage `json:"docs"`
+		DocCount int64                      `json:"docCount"`
+	}
+	err = json.Unmarshal(requestBody, &p)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_estimate: could not"+
+			" parse request body, err: %v", err), 400)
+		return
+	}
+	if p.DocCount <= 0 {
+		p.DocCount = int64(len(p.Docs))
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(requestBody))
+	err = req.ParseForm()
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_estimate: could not"+
+			" parse form, err: %v", err), 400)
+		return
+	}
+
+	r, err := parseIndexQuotaRequest(indexName, req, requestBody)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+	if r.IndexType != "" && r.IndexType != "bleve" {
+		rest.ShowError(w, req, fmt.Sprintf("index_estimate: only bleve"+
+			" indexes can be estimated, indexType: %s", r.IndexType), 400)
+		return
+	}
+
+	partitions, err := IndexQuotaPartitions(h.mgr, r)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	sample, err := EstimateIndexSample(h.mgr.DataDir(), r.IndexParams,
+		p.Docs)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+		*IndexEstimate
+	}{
+		Status: "ok",
+		IndexEstimate: CalcIndexEstimate(sample, p.DocCount,
+			partitions, r.PlanParams.NumReplicas),
+	})
+}
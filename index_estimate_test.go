@@ -0,0 +1,82 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCalcIndexEstimate(t *testing.T) {
+	sample := &IndexSampleEstimate{
+		Docs:      100,
+		DiskBytes: 10000,
+		MemBytes:  2000,
+		BuildMS:   500,
+	}
+
+	e := CalcIndexEstimate(sample, 1000, 4, 1)
+	if e.DiskBytes != 200000 || e.MemBytes != 40000 {
+		t.Errorf("expected sizes scaled by 10x docs and 2 copies, got: %+v", e)
+	}
+	if e.BuildSecs != 1.25 {
+		t.Errorf("expected 5 secs over 4 partitions, got: %f", e.BuildSecs)
+	}
+
+	e = CalcIndexEstimate(sample, 100, 0, 0)
+	if e.DiskBytes != 10000 || e.BuildSecs != 0.5 {
+		t.Errorf("expected the sample itself, got: %+v", e)
+	}
+
+	e = CalcIndexEstimate(nil, 100, 1, 0)
+	if e.DiskBytes != 0 || e.MemBytes != 0 {
+		t.Errorf("expected no estimate without a sample, got: %+v", e)
+	}
+}
+
+func TestEstimateIndexSample(t *testing.T) {
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	_, err := EstimateIndexSample(dir, "", nil)
+	if err == nil {
+		t.Errorf("expected err without sample docs")
+	}
+
+	_, err = EstimateIndexSample(dir, "",
+		map[string]json.RawMessage{"a": json.RawMessage(`not json`)})
+	if err == nil {
+		t.Errorf("expected err on a bad sample doc")
+	}
+
+	docs := map[string]json.RawMessage{}
+	for i := 0; i < 100; i++ {
+		docs[fmt.Sprintf("doc-%d", i)] = json.RawMessage(fmt.Sprintf(
+			`{"name":"beer %d","desc":"a hoppy ale from the west coast"}`, i))
+	}
+
+	sample, err := EstimateIndexSample(dir, "", docs)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if sample.Docs != 100 || sample.DocBytes <= 0 || sample.DiskBytes <= 0 {
+		t.Errorf("unexpected sample estimate: %+v", sample)
+	}
+
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("expected the sample index removed, got: %d", len(entries))
+	}
+}
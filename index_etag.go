@@ -0,0 +1,201 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// Index definition updates support optimistic concurrency through
+// standard HTTP preconditions, so that two admins editing the same
+// index definition can't silently overwrite each other's changes.  A
+// GET of an index definition returns its UUID as an ETag, which an
+// update can then send back as an If-Match header, where the ETag is
+// passed down as the prevIndexUUID, so that the Cfg's CAS also
+// catches a concurrent update that sneaks in after the check.  An
+// If-None-Match: * header means the index must not exist yet.  With
+// the requireIndexPrecondition=true node option, updates of existing
+// indexes are rejected unless they have an If-Match header or a
+// prevIndexUUID.
+
+// IndexETag returns the ETag of an index definition.
+func IndexETag(indexDef *cbgt.IndexDef) string {
+	return `"` + indexDef.UUID + `"`
+}
+
+// indexETagMatch returns true when an If-Match or If-None-Match
+// header value, which is a list of ETags or "*", matches an ETag.
+func indexETagMatch(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// indexETagUUID returns the index UUID of an If-Match header value
+// with a single ETag, or "".
+func indexETagUUID(header string) string {
+	v := strings.TrimPrefix(strings.TrimSpace(header), "W/")
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' ||
+		strings.Contains(v, ",") {
+		return ""
+	}
+	return v[1 : len(v)-1]
+}
+
+// IndexETagGetHandler is a REST handler that adds the ETag header to
+// the responses of a wrapped index definition GET handler.
+type IndexETagGetHandler struct {
+	mgr  *cbgt.Manager
+	next http.Handler
+}
+
+func NewIndexETagGetHandler(mgr *cbgt.Manager,
+	next http.Handler) *IndexETagGetHandler {
+	return &IndexETagGetHandler{mgr: mgr, next: next}
+}
+
+func (h *IndexETagGetHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	_, indexDefsByName, err := h.mgr.GetIndexDefs(false)
+	if err == nil {
+		if indexDef := indexDefsByName[mux.Vars(req)["indexName"]]; indexDef != nil {
+			w.Header().Set("ETag", IndexETag(indexDef))
+		}
+	}
+
+	h.next.ServeHTTP(w, req)
+}
+
+// IndexPreconditionHandler is a REST handler that checks the HTTP
+// preconditions of an index definition update before handing the
+// update to a wrapped handler.
+type IndexPreconditionHandler struct {
+	mgr  *cbgt.Manager
+	next http.Handler
+}
+
+func NewIndexPreconditionHandler(mgr *cbgt.Manager,
+	next http.Handler) *IndexPreconditionHandler {
+	return &IndexPreconditionHandler{mgr: mgr, next: next}
+}
+
+func (h *IndexPreconditionHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	_, indexDefsByName, err := h.mgr.GetIndexDefs(true)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_etag: could not"+
+			" retrieve index defs, err: %v", err), 500)
+		return
+	}
+	indexDef := indexDefsByName[indexName]
+
+	ifMatch := req.Header.Get("If-Match")
+	ifNoneMatch := req.Header.Get("If-None-Match")
+
+	if ifNoneMatch != "" && indexDef != nil &&
+		indexETagMatch(ifNoneMatch, IndexETag(indexDef)) {
+		rest.ShowError(w, req, fmt.Sprintf("index_etag: index: %s"+
+			" already exists", indexName), http.StatusPreconditionFailed)
+		return
+	}
+
+	if ifMatch != "" {
+		if indexDef == nil || !indexETagMatch(ifMatch, IndexETag(indexDef)) {
+			current := "none, as the index doesn't exist"
+			if indexDef != nil {
+				current = IndexETag(indexDef)
+			}
+			rest.ShowError(w, req, fmt.Sprintf("index_etag: index: %s"+
+				" was changed concurrently, If-Match: %s, current ETag: %s;"+
+				" please reload the index definition and retry",
+				indexName, ifMatch, current), http.StatusPreconditionFailed)
+			return
+		}
+
+		// Pass the ETag down as the prevIndexUUID, so the update
+		// fails if the index changes after the check.
+		prevIndexUUID := indexETagUUID(ifMatch)
+		if prevIndexUUID == "" {
+			prevIndexUUID = indexDef.UUID
+		}
+		q := req.URL.Query()
+		q.Set("prevIndexUUID", prevIndexUUID)
+		req.URL.RawQuery = q.Encode()
+		req.Form = nil
+	} else if indexDef != nil &&
+		h.mgr.Options()["requireIndexPrecondition"] == "true" {
+		hasPrev, err := indexPreconditionHasPrevUUID(req)
+		if err != nil {
+			rest.ShowError(w, req, err.Error(), 400)
+			return
+		}
+		if !hasPrev {
+			rest.ShowError(w, req, fmt.Sprintf("index_etag: index: %s"+
+				" exists, so its update needs an If-Match header with"+
+				" the index's ETag, or a prevIndexUUID", indexName), 428)
+			return
+		}
+	}
+
+	h.next.ServeHTTP(w, req)
+}
+
+// indexPreconditionHasPrevUUID returns true when an index definition
+// update has a prevIndexUUID, as a URL query or form parameter or in
+// its JSON body, leaving the request body intact.
+func indexPreconditionHasPrevUUID(req *http.Request) (bool, error) {
+	if req.URL.Query().Get("prevIndexUUID") != "" {
+		return true, nil
+	}
+
+	if req.Body == nil {
+		return false, nil
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return false, fmt.Errorf("index_etag: could not read request"+
+			" body, err: %v", err)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(requestBody))
+	req.ContentLength = int64(len(requestBody))
+
+	if strings.HasPrefix(req.Header.Get("Content-Type"),
+		"application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(string(requestBody))
+		return err == nil && form.Get("prevIndexUUID") != "", nil
+	}
+
+	var body struct {
+		PrevIndexUUID string `json:"prevIndexUUID"`
+	}
+	json.Unmarshal(requestBody, &body)
+
+	return body.PrevIndexUUID != "", nil
+}
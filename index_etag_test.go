@@ -0,0 +1,124 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestIndexETagMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		exp    bool
+	}{
+		{`"u1"`, true},
+		{`W/"u1"`, true},
+		{`"u0", "u1"`, true},
+		{`*`, true},
+		{`"u2"`, false},
+		{`u1`, false},
+	}
+	for _, test := range tests {
+		if indexETagMatch(test.header, `"u1"`) != test.exp {
+			t.Errorf("header: %s, expected: %v", test.header, test.exp)
+		}
+	}
+
+	if indexETagUUID(`"u1"`) != "u1" || indexETagUUID(`W/"u1"`) != "u1" ||
+		indexETagUUID(`*`) != "" || indexETagUUID(`"u0", "u1"`) != "" {
+		t.Errorf("unexpected indexETagUUID")
+	}
+}
+
+func TestIndexPreconditionHandler(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	mgr := cbgt.NewManagerEx(cbgt.VERSION, cbgt.NewCfgMem(),
+		cbgt.NewUUID(), nil, "", 1, "", ":1000", emptyDir,
+		"some-datasource", nil,
+		map[string]string{"requireIndexPrecondition": "true"})
+	mgr.Start("wanted")
+
+	err := mgr.CreateIndex("primary", "src", "", "", "blackhole",
+		"idx", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	_, indexDefsByName, _ := mgr.GetIndexDefs(true)
+	etag := IndexETag(indexDefsByName["idx"])
+
+	var gotPrevIndexUUID string
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotPrevIndexUUID = req.FormValue("prevIndexUUID")
+	})
+
+	r := mux.NewRouter()
+	r.Handle("/api/index/{indexName}",
+		NewIndexETagGetHandler(mgr, next)).Methods("GET")
+	r.Handle("/api/index/{indexName}",
+		NewIndexPreconditionHandler(mgr, next)).Methods("PUT")
+
+	req, _ := http.NewRequest("GET", "/api/index/idx", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Header().Get("ETag") != etag {
+		t.Errorf("expected ETag: %s, got: %s", etag, rr.Header().Get("ETag"))
+	}
+
+	tests := []struct {
+		path        string
+		header      string
+		value       string
+		body        string
+		exp         int
+		expPrevUUID string
+	}{
+		{"/api/index/idx", "If-Match", etag, "", 200,
+			indexDefsByName["idx"].UUID},
+		{"/api/index/idx", "If-Match", `"stale"`, "", 412, ""},
+		{"/api/index/new", "If-Match", `"stale"`, "", 412, ""},
+		{"/api/index/idx", "If-None-Match", "*", "", 412, ""},
+		{"/api/index/new", "If-None-Match", "*", "", 200, ""},
+		{"/api/index/idx", "", "", "", 428, ""},
+		{"/api/index/idx", "", "", `{"prevIndexUUID": "u"}`, 200, ""},
+		{"/api/index/idx?prevIndexUUID=u", "", "", "", 200, "u"},
+		{"/api/index/new", "", "", "", 200, ""},
+	}
+	for i, test := range tests {
+		gotPrevIndexUUID = ""
+		req, _ := http.NewRequest("PUT", test.path,
+			bytes.NewBufferString(test.body))
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != test.exp {
+			t.Errorf("%d - expected: %d, got: %d, body: %s",
+				i, test.exp, rr.Code, rr.Body.String())
+		}
+		if gotPrevIndexUUID != test.expPrevUUID {
+			t.Errorf("%d - expected prevIndexUUID: %s, got: %s",
+				i, test.expPrevUUID, gotPrevIndexUUID)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// A frozen index is a read-only index, such as of an archived
+// dataset, that's still queryable, but whose feeds are stopped to
+// reclaim their DCP connections and ingest CPU.  Freezing an index
+// pauses its ingest (so the janitors close its feeds), allows its
+// queries and freezes its plan (so its pindexes aren't reassigned or
+// rebuilt), all of which is persisted in the index definition's plan
+// params.  While an index is frozen, the requests that would change
+// it, like updating its definition, resuming its ingest, unfreezing
+// its plan or deleting its documents by query, are rejected, and its
+// expired documents aren't swept away, until the index is unfrozen.
+
+var indexFreezeM sync.Mutex // Protects the fields that follow.
+
+// The node's cache of the frozen index names.
+var frozenIndexes = map[string]bool{}
+
+// IndexDefFrozen returns true when an index definition is frozen,
+// meaning that its plan is frozen and its ingest is paused.
+func IndexDefFrozen(indexDef *cbgt.IndexDef) bool {
+	if indexDef == nil || !indexDef.PlanParams.PlanFrozen {
+		return false
+	}
+
+	np := indexDef.PlanParams.NodePlanParams[""][""]
+
+	return np != nil && !np.CanWrite
+}
+
+// IsFrozen returns true when an index is frozen, according to the
+// node's cache of the index definitions.
+func IsFrozen(indexName string) bool {
+	indexFreezeM.Lock()
+	defer indexFreezeM.Unlock()
+	return frozenIndexes[indexName]
+}
+
+// IndexFreezeStart loads and then keeps watching the frozen indexes.
+func IndexFreezeStart(mgr *cbgt.Manager) error {
+	cfg := mgr.Cfg()
+
+	ch := make(chan cbgt.CfgEvent, 1)
+
+	err := cfg.Subscribe(cbgt.INDEX_DEFS_KEY, ch)
+	if err != nil {
+		return err
+	}
+
+	err = indexFreezeRefresh(cfg)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for range ch {
+			err := indexFreezeRefresh(cfg)
+			if err != nil {
+				log.Printf("index_freeze: refresh, err: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func indexFreezeRefresh(cfg cbgt.Cfg) error {
+	indexDefs, _, err := cbgt.CfgGetIndexDefs(cfg)
+	if err != nil {
+		return err
+	}
+
+	m := map[string]bool{}
+	if indexDefs != nil {
+		for indexName, indexDef := range indexDefs.IndexDefs {
+			if IndexDefFrozen(indexDef) {
+				m[indexName] = true
+			}
+		}
+	}
+
+	indexFreezeM.Lock()
+	frozenIndexes = m
+	indexFreezeM.Unlock()
+
+	return nil
+}
+
+// FreezeIndex makes an index read-only, stopping its feeds.
+func FreezeIndex(mgr *cbgt.Manager, indexName string) error {
+	indexDef, err := indexFreezeDef(mgr, indexName)
+	if err != nil {
+		return err
+	}
+	if IndexDefFrozen(indexDef) {
+		return nil
+	}
+
+	pindexImplType := cbgt.PIndexImplTypes[indexDef.Type]
+	if pindexImplType == nil || pindexImplType.New == nil {
+		return fmt.Errorf("index_freeze: index: %s, of type: %s,"+
+			" has no feeds to stop", indexName, indexDef.Type)
+	}
+
+	err = mgr.IndexControl(indexName, indexDef.UUID,
+		"allow", "pause", "freeze")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("index_freeze: frozen, index: %s", indexName)
+
+	return nil
+}
+
+// UnfreezeIndex makes a frozen index writable again, restarting its
+// feeds, unless the index is quarantined, where its ingest stays
+// paused until the index is released from quarantine.
+func UnfreezeIndex(mgr *cbgt.Manager, indexName string) error {
+	indexDef, err := indexFreezeDef(mgr, indexName)
+	if err != nil {
+		return err
+	}
+	if !IndexDefFrozen(indexDef) {
+		return fmt.Errorf("index_freeze: not frozen, index: %s", indexName)
+	}
+
+	writeOp := "resume"
+	if IsQuarantined(indexName) {
+		writeOp = ""
+	}
+
+	err = mgr.IndexControl(indexName, indexDef.UUID, "", writeOp, "unfreeze")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("index_freeze: unfrozen, index: %s", indexName)
+
+	return nil
+}
+
+func indexFreezeDef(mgr *cbgt.Manager, indexName string) (
+	*cbgt.IndexDef, error) {
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return nil, fmt.Errorf("index_freeze: could not retrieve"+
+			" index defs, err: %v", err)
+	}
+
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil {
+		return nil, fmt.Errorf("index_freeze: not an index,"+
+			" indexName: %s", indexName)
+	}
+
+	return indexDef, nil
+}
+
+// ---------------------------------------------------------
+
+// IndexFreezeGuardHandler is a REST handler that rejects a request
+// that would change a frozen index, and then delegates to the next
+// handler.  A request with an {op} URL path parameter, like an
+// ingest control request, is only rejected for the "resume" and
+// "unfreeze" ops.
+type IndexFreezeGuardHandler struct {
+	mgr  *cbgt.Manager
+	next http.Handler
+}
+
+func NewIndexFreezeGuardHandler(mgr *cbgt.Manager,
+	next http.Handler) *IndexFreezeGuardHandler {
+	return &IndexFreezeGuardHandler{mgr: mgr, next: next}
+}
+
+func (h *IndexFreezeGuardHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	op, hasOp := vars["op"]
+	if hasOp && op != "resume" && op != "unfreeze" {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+
+	indexName := vars["indexName"]
+
+	_, indexDefsByName, err := h.mgr.GetIndexDefs(false)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_freeze: could not"+
+			" retrieve index defs, err: %v", err), 500)
+		return
+	}
+
+	if IndexDefFrozen(indexDefsByName[indexName]) {
+		rest.ShowError(w, req, fmt.Sprintf("index_freeze: index: %s is"+
+			" frozen (read-only); please unfreeze it first, with"+
+			" DELETE /api/index/%s/freeze", indexName, indexName), 400)
+		return
+	}
+
+	h.next.ServeHTTP(w, req)
+}
+
+// IndexFreezeHandler is a REST handler that freezes an index.
+type IndexFreezeHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexFreezeHandler(mgr *cbgt.Manager) *IndexFreezeHandler {
+	return &IndexFreezeHandler{mgr: mgr}
+}
+
+func (h *IndexFreezeHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	err := FreezeIndex(h.mgr, mux.Vars(req)["indexName"])
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// IndexUnfreezeHandler is a REST handler that unfreezes an index.
+type IndexUnfreezeHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexUnfreezeHandler(mgr *cbgt.Manager) *IndexUnfreezeHandler {
+	return &IndexUnfreezeHandler{mgr: mgr}
+}
+
+func (h *IndexUnfreezeHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	err := UnfreezeIndex(h.mgr, mux.Vars(req)["indexName"])
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
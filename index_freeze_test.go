@@ -0,0 +1,121 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestIndexDefFrozen(t *testing.T) {
+	if IndexDefFrozen(nil) || IndexDefFrozen(&cbgt.IndexDef{}) {
+		t.Errorf("expected not frozen")
+	}
+
+	indexDef := &cbgt.IndexDef{}
+	indexDef.PlanParams.PlanFrozen = true
+	if IndexDefFrozen(indexDef) {
+		t.Errorf("expected not frozen with its ingest allowed")
+	}
+
+	indexDef.PlanParams.NodePlanParams = map[string]map[string]*cbgt.NodePlanParam{
+		"": {"": &cbgt.NodePlanParam{CanRead: true, CanWrite: false}},
+	}
+	if !IndexDefFrozen(indexDef) {
+		t.Errorf("expected frozen")
+	}
+}
+
+func TestFreezeIndex(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	if FreezeIndex(mgr, "missing") == nil {
+		t.Errorf("expected err on a missing index")
+	}
+
+	err := mgr.CreateIndex("nil", "", "", "",
+		"blackhole", "archive", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	if UnfreezeIndex(mgr, "archive") == nil {
+		t.Errorf("expected err on unfreezing an index that isn't frozen")
+	}
+
+	for i := 0; i < 2; i++ {
+		err = FreezeIndex(mgr, "archive")
+		if err != nil {
+			t.Fatalf("expected no err, got: %v", err)
+		}
+	}
+
+	_, indexDefsByName, _ := mgr.GetIndexDefs(true)
+	if !IndexDefFrozen(indexDefsByName["archive"]) {
+		t.Errorf("expected the index def frozen")
+	}
+
+	indexFreezeRefresh(cfg)
+	if !IsFrozen("archive") {
+		t.Errorf("expected the frozen index cached")
+	}
+
+	r := mux.NewRouter()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	r.Handle("/api/index/{indexName}", NewIndexFreezeGuardHandler(mgr, ok))
+	r.Handle("/api/index/{indexName}/ingestControl/{op}",
+		NewIndexFreezeGuardHandler(mgr, ok))
+
+	tests := map[string]int{
+		"/api/index/archive":                      400,
+		"/api/index/archive/ingestControl/resume": 400,
+		"/api/index/archive/ingestControl/pause":  200,
+		"/api/index/other":                        200,
+	}
+	for path, exp := range tests {
+		req, _ := http.NewRequest("PUT", path, nil)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != exp {
+			t.Errorf("path: %s, expected: %d, got: %d", path, exp, rr.Code)
+		}
+	}
+
+	err = UnfreezeIndex(mgr, "archive")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	_, indexDefsByName, _ = mgr.GetIndexDefs(true)
+	indexDef := indexDefsByName["archive"]
+	if IndexDefFrozen(indexDef) || indexDef.PlanParams.PlanFrozen {
+		t.Errorf("expected the index def unfrozen")
+	}
+
+	indexFreezeRefresh(cfg)
+	if IsFrozen("archive") {
+		t.Errorf("expected the unfrozen index uncached")
+	}
+}
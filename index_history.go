@@ -0,0 +1,338 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The prior versions of each index definition are kept in the Cfg, so
+// that a bad definition, like a bad mapping push, can be rolled back
+// to an earlier version.  Every node watches the index definitions
+// and records each changed definition as a new version, where the
+// recording is idempotent, so the nodes don't record a change twice.
+// Only definition changes are versioned, not the ingest, query and
+// plan freeze controls of an index, which a rollback leaves as-is.
+// The history of a deleted index is kept, so that a deleted index can
+// be restored by a rollback, too.
+
+// The Cfg key where the index definition versions are kept.
+const INDEX_HISTORY_KEY = "indexHistory"
+
+// The max number of versions that are kept for each index.
+var IndexHistoryMaxVersions = 20
+
+// IndexHistory is the Cfg entry of the index definition versions.
+type IndexHistory struct {
+	UUID string `json:"uuid"`
+
+	// Keyed by indexName, ordered from oldest to newest.
+	Indexes map[string][]*IndexVersion `json:"indexes"`
+}
+
+// IndexVersion is a version of an index definition.
+type IndexVersion struct {
+	Version  int            `json:"version"`
+	Time     string         `json:"time"`
+	IndexDef *cbgt.IndexDef `json:"indexDef"`
+}
+
+// indexHistorySame returns true when two index definitions are the
+// same, ignoring their UUIDs and their controls.
+func indexHistorySame(a, b *cbgt.IndexDef) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	ja, erra := json.Marshal(indexHistoryStrip(a))
+	jb, errb := json.Marshal(indexHistoryStrip(b))
+	return erra == nil && errb == nil && bytes.Equal(ja, jb)
+}
+
+func indexHistoryStrip(indexDef *cbgt.IndexDef) *cbgt.IndexDef {
+	rv := *indexDef
+	rv.UUID = ""
+	rv.PlanParams.NodePlanParams = nil
+	rv.PlanParams.PlanFrozen = false
+	return &rv
+}
+
+// indexHistoryChanged returns the index definitions that aren't yet
+// the latest versions in the history.
+func indexHistoryChanged(h *IndexHistory,
+	indexDefs *cbgt.IndexDefs) []*cbgt.IndexDef {
+	var rv []*cbgt.IndexDef
+	if indexDefs == nil {
+		return rv
+	}
+	for indexName, indexDef := range indexDefs.IndexDefs {
+		versions := h.Indexes[indexName]
+		if len(versions) <= 0 ||
+			!indexHistorySame(versions[len(versions)-1].IndexDef, indexDef) {
+			rv = append(rv, indexDef)
+		}
+	}
+	return rv
+}
+
+// IndexHistoryStart records the current index definitions and then
+// keeps recording their changes.
+func IndexHistoryStart(mgr *cbgt.Manager) error {
+	cfg := mgr.Cfg()
+
+	ch := make(chan cbgt.CfgEvent, 1)
+
+	err := cfg.Subscribe(cbgt.INDEX_DEFS_KEY, ch)
+	if err != nil {
+		return err
+	}
+
+	err = indexHistoryRecord(cfg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for range ch {
+			err := indexHistoryRecord(cfg, time.Now())
+			if err != nil {
+				log.Printf("index_history: record, err: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// indexHistoryRecord records the changed index definitions as new
+// versions.
+func indexHistoryRecord(cfg cbgt.Cfg, now time.Time) error {
+	indexDefs, _, err := cbgt.CfgGetIndexDefs(cfg)
+	if err != nil {
+		return err
+	}
+
+	h, err := CfgGetIndexHistory(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Most nodes find that another node already recorded the changes.
+	if len(indexHistoryChanged(h, indexDefs)) <= 0 {
+		return nil
+	}
+
+	return CfgUpdateJSON(cfg, INDEX_HISTORY_KEY,
+		func() interface{} { return &IndexHistory{} },
+		func(v interface{}) error {
+			h := v.(*IndexHistory)
+			if h.Indexes == nil {
+				h.Indexes = map[string][]*IndexVersion{}
+			}
+			for _, indexDef := range indexHistoryChanged(h, indexDefs) {
+				versions := h.Indexes[indexDef.Name]
+				version := 1
+				if len(versions) > 0 {
+					version = versions[len(versions)-1].Version + 1
+				}
+				versions = append(versions, &IndexVersion{
+					Version:  version,
+					Time:     now.Format(time.RFC3339Nano),
+					IndexDef: indexDef,
+				})
+				if len(versions) > IndexHistoryMaxVersions {
+					versions = versions[len(versions)-IndexHistoryMaxVersions:]
+				}
+				h.Indexes[indexDef.Name] = versions
+			}
+			h.UUID = cbgt.NewUUID()
+			return nil
+		})
+}
+
+// CfgGetIndexHistory returns the index definition versions from the
+// Cfg.
+func CfgGetIndexHistory(cfg cbgt.Cfg) (*IndexHistory, error) {
+	h := &IndexHistory{}
+	_, _, err := CfgGetJSON(cfg, INDEX_HISTORY_KEY, h)
+	if err != nil {
+		return nil, err
+	}
+	if h.Indexes == nil {
+		h.Indexes = map[string][]*IndexVersion{}
+	}
+	return h, nil
+}
+
+// RollbackIndex updates, or recreates, an index with the definition of
+// an earlier version, where a version of 0 means the version before
+// the latest one.  The index's current controls are kept.
+func RollbackIndex(mgr *cbgt.Manager, indexName string,
+	version int) (*IndexVersion, error) {
+	h, err := CfgGetIndexHistory(mgr.Cfg())
+	if err != nil {
+		return nil, err
+	}
+
+	versions := h.Indexes[indexName]
+	if len(versions) <= 0 {
+		return nil, fmt.Errorf("index_history: no history, index: %s",
+			indexName)
+	}
+
+	var v *IndexVersion
+	if version == 0 {
+		if len(versions) < 2 {
+			return nil, fmt.Errorf("index_history: no earlier version,"+
+				" index: %s", indexName)
+		}
+		v = versions[len(versions)-2]
+	} else {
+		for _, vx := range versions {
+			if vx.Version == version {
+				v = vx
+			}
+		}
+		if v == nil {
+			return nil, fmt.Errorf("index_history: no version: %d,"+
+				" index: %s", version, indexName)
+		}
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return nil, err
+	}
+
+	def := v.IndexDef
+	planParams := indexHistoryStrip(def).PlanParams
+	prevUUID := ""
+
+	if cur := indexDefsByName[indexName]; cur != nil {
+		if indexHistorySame(cur, def) {
+			return nil, fmt.Errorf("index_history: index: %s is already"+
+				" at the definition of version: %d", indexName, v.Version)
+		}
+		planParams.NodePlanParams = cur.PlanParams.NodePlanParams
+		planParams.PlanFrozen = cur.PlanParams.PlanFrozen
+		prevUUID = cur.UUID
+	}
+
+	err = CreateIndexChecked(mgr, def.SourceType, def.SourceName,
+		def.SourceUUID, def.SourceParams, def.Type, indexName, def.Params,
+		planParams, prevUUID)
+	if err != nil {
+		return nil, fmt.Errorf("index_history: could not roll back"+
+			" index: %s, to version: %d, err: %v", indexName, v.Version, err)
+	}
+
+	log.Printf("index_history: rolled back, index: %s, to version: %d",
+		indexName, v.Version)
+
+	return v, nil
+}
+
+// ---------------------------------------------------------
+
+// IndexHistoryHandler is a REST handler that returns the versions of
+// an index definition.
+type IndexHistoryHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexHistoryHandler(mgr *cbgt.Manager) *IndexHistoryHandler {
+	return &IndexHistoryHandler{mgr: mgr}
+}
+
+func (h *IndexHistoryHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	history, err := CfgGetIndexHistory(h.mgr.Cfg())
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_history: could not"+
+			" retrieve history, err: %v", err), 500)
+		return
+	}
+
+	versions := history.Indexes[indexName]
+	if len(versions) <= 0 {
+		rest.ShowError(w, req, fmt.Sprintf("index_history: no history,"+
+			" index: %s", indexName), 404)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status   string          `json:"status"`
+		Versions []*IndexVersion `json:"versions"`
+	}{
+		Status:   "ok",
+		Versions: versions,
+	})
+}
+
+// IndexRollbackHandler is a REST handler that rolls back an index
+// definition to an earlier version.
+type IndexRollbackHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexRollbackHandler(mgr *cbgt.Manager) *IndexRollbackHandler {
+	return &IndexRollbackHandler{mgr: mgr}
+}
+
+func (h *IndexRollbackHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_history: could not"+
+			" read request body, err: %v", err), 400)
+		return
+	}
+
+	var r struct {
+		Version int `json:"version"`
+	}
+	if len(bytes.TrimSpace(requestBody)) > 0 {
+		err = json.Unmarshal(requestBody, &r)
+		if err != nil {
+			rest.ShowError(w, req, fmt.Sprintf("index_history: could not"+
+				" parse request body, err: %v", err), 400)
+			return
+		}
+	}
+
+	v, err := RollbackIndex(h.mgr, mux.Vars(req)["indexName"], r.Version)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), IndexCreateErrorStatus(err, 400))
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status  string `json:"status"`
+		Version int    `json:"version"`
+	}{
+		Status:  "ok",
+		Version: v.Version,
+	})
+}
@@ -0,0 +1,137 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestIndexHistorySame(t *testing.T) {
+	a := &cbgt.IndexDef{Name: "a", UUID: "1", Type: "blackhole"}
+	b := &cbgt.IndexDef{Name: "a", UUID: "2", Type: "blackhole"}
+	b.PlanParams.PlanFrozen = true
+	if !indexHistorySame(a, b) {
+		t.Errorf("expected the UUIDs and controls ignored")
+	}
+	b.PlanParams.MaxPartitionsPerPIndex = 4
+	if indexHistorySame(a, b) {
+		t.Errorf("expected a plan params change noticed")
+	}
+	if indexHistorySame(a, nil) {
+		t.Errorf("expected nil not the same")
+	}
+}
+
+func TestIndexHistory(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	now := time.Now()
+
+	setIndex := func(maxPartitions int) {
+		prevUUID := ""
+		_, indexDefsByName, _ := mgr.GetIndexDefs(true)
+		if indexDef := indexDefsByName["idx"]; indexDef != nil {
+			prevUUID = indexDef.UUID
+		}
+		err := mgr.CreateIndex("primary", "src", "", "", "blackhole",
+			"idx", "", cbgt.PlanParams{
+				MaxPartitionsPerPIndex: maxPartitions}, prevUUID)
+		if err != nil {
+			t.Fatalf("expected no err, got: %v", err)
+		}
+		err = indexHistoryRecord(cfg, now)
+		if err != nil {
+			t.Fatalf("expected no err, got: %v", err)
+		}
+	}
+
+	setIndex(1)
+
+	if _, err := RollbackIndex(mgr, "idx", 0); err == nil {
+		t.Errorf("expected err without an earlier version")
+	}
+
+	setIndex(2)
+	setIndex(3)
+
+	// Recording again without changes is a no-op.
+	indexHistoryRecord(cfg, now)
+
+	h, _ := CfgGetIndexHistory(cfg)
+	versions := h.Indexes["idx"]
+	if len(versions) != 3 || versions[2].Version != 3 ||
+		versions[2].IndexDef.PlanParams.MaxPartitionsPerPIndex != 3 {
+		t.Fatalf("expected 3 versions, got: %+v", versions)
+	}
+
+	v, err := RollbackIndex(mgr, "idx", 0)
+	if err != nil || v.Version != 2 {
+		t.Fatalf("expected rollback to version 2, got: %+v, err: %v", v, err)
+	}
+	indexHistoryRecord(cfg, now)
+
+	_, indexDefsByName, _ := mgr.GetIndexDefs(true)
+	if indexDefsByName["idx"].PlanParams.MaxPartitionsPerPIndex != 2 {
+		t.Errorf("expected the version 2 definition")
+	}
+
+	h, _ = CfgGetIndexHistory(cfg)
+	if len(h.Indexes["idx"]) != 4 {
+		t.Errorf("expected the rollback recorded as a new version")
+	}
+
+	if _, err = RollbackIndex(mgr, "idx", 4); err == nil {
+		t.Errorf("expected err on a rollback to the current definition")
+	}
+	if _, err = RollbackIndex(mgr, "idx", 99); err == nil {
+		t.Errorf("expected err on a missing version")
+	}
+
+	err = mgr.DeleteIndex("idx")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	_, err = RollbackIndex(mgr, "idx", 1)
+	if err != nil {
+		t.Fatalf("expected a deleted index restored, err: %v", err)
+	}
+	indexHistoryRecord(cfg, now)
+
+	_, indexDefsByName, _ = mgr.GetIndexDefs(true)
+	if indexDefsByName["idx"] == nil ||
+		indexDefsByName["idx"].PlanParams.MaxPartitionsPerPIndex != 1 {
+		t.Errorf("expected the version 1 definition")
+	}
+
+	prevMax := IndexHistoryMaxVersions
+	defer func() { IndexHistoryMaxVersions = prevMax }()
+	IndexHistoryMaxVersions = 2
+
+	setIndex(5)
+
+	h, _ = CfgGetIndexHistory(cfg)
+	if len(h.Indexes["idx"]) != 2 || h.Indexes["idx"][1].Version != 6 {
+		t.Errorf("expected the versions capped, got: %+v", h.Indexes["idx"])
+	}
+}
@@ -0,0 +1,118 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IndexMetrics holds the cumulative per-index counters of a node,
+// since the node started, which are published as expvars (see
+// IndexMetricsSnapshot) so that operators can alert per index.  The
+// counters of an index are summed across its pindexes on the node.
+type IndexMetrics struct {
+	Queries      uint64 // Accessed via atomic.
+	QueryErrors  uint64 // Accessed via atomic.
+	BytesIndexed uint64 // Accessed via atomic.
+	DCPRollbacks uint64 // Accessed via atomic.
+	Batches      uint64 // Accessed via atomic.
+	BatchOps     uint64 // Accessed via atomic.
+	BatchOpsMax  uint64 // Accessed via atomic.
+	FeedStalls   uint64 // Accessed via atomic.
+	FeedStallMs  uint64 // Accessed via atomic.
+	IngestErrors uint64 // Accessed via atomic.
+
+	LastQuery int64 // Unix nanosecs, accessed via atomic.
+}
+
+var indexMetricsM sync.Mutex // Protects the fields that follow.
+
+var indexMetrics = map[string]*IndexMetrics{} // Keyed by index name.
+
+// IndexMetricsFor returns the IndexMetrics of an index, creating them
+// if needed.
+func IndexMetricsFor(indexName string) *IndexMetrics {
+	indexMetricsM.Lock()
+	m := indexMetrics[indexName]
+	if m == nil {
+		m = &IndexMetrics{}
+		indexMetrics[indexName] = m
+	}
+	indexMetricsM.Unlock()
+	return m
+}
+
+func (m *IndexMetrics) recordQuery(err error) {
+	atomic.StoreInt64(&m.LastQuery, time.Now().UnixNano())
+	atomic.AddUint64(&m.Queries, 1)
+	if err != nil {
+		atomic.AddUint64(&m.QueryErrors, 1)
+	}
+}
+
+// IndexMetricsLastQuery returns when this node last queried an index,
+// or the zero time.
+func IndexMetricsLastQuery(indexName string) time.Time {
+	indexMetricsM.Lock()
+	m := indexMetrics[indexName]
+	indexMetricsM.Unlock()
+
+	if m == nil {
+		return time.Time{}
+	}
+
+	lastQuery := atomic.LoadInt64(&m.LastQuery)
+	if lastQuery <= 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, lastQuery)
+}
+
+func (m *IndexMetrics) recordBatch(ops int) {
+	atomic.AddUint64(&m.Batches, 1)
+	atomic.AddUint64(&m.BatchOps, uint64(ops))
+	for {
+		max := atomic.LoadUint64(&m.BatchOpsMax)
+		if uint64(ops) <= max ||
+			atomic.CompareAndSwapUint64(&m.BatchOpsMax, max, uint64(ops)) {
+			return
+		}
+	}
+}
+
+// IndexMetricsSnapshot returns the current per-index counters, keyed
+// by index name and then by metric name.  It has the signature of an
+// expvar.Func.
+func IndexMetricsSnapshot() interface{} {
+	indexMetricsM.Lock()
+	defer indexMetricsM.Unlock()
+
+	rv := map[string]map[string]uint64{}
+	for indexName, m := range indexMetrics {
+		rv[indexName] = map[string]uint64{
+			"queries":      atomic.LoadUint64(&m.Queries),
+			"queryErrors":  atomic.LoadUint64(&m.QueryErrors),
+			"bytesIndexed": atomic.LoadUint64(&m.BytesIndexed),
+			"dcpRollbacks": atomic.LoadUint64(&m.DCPRollbacks),
+			"batches":      atomic.LoadUint64(&m.Batches),
+			"batchOps":     atomic.LoadUint64(&m.BatchOps),
+			"batchOpsMax":  atomic.LoadUint64(&m.BatchOpsMax),
+			"feedStalls":   atomic.LoadUint64(&m.FeedStalls),
+			"feedStallMs":  atomic.LoadUint64(&m.FeedStallMs),
+			"ingestErrors": atomic.LoadUint64(&m.IngestErrors),
+		}
+	}
+	return rv
+}
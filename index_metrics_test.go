@@ -0,0 +1,57 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestIndexMetrics(t *testing.T) {
+	m := IndexMetricsFor("testIndexMetrics")
+	if IndexMetricsFor("testIndexMetrics") != m {
+		t.Errorf("expected the same metrics for the same index")
+	}
+
+	m.recordQuery(nil)
+	m.recordQuery(fmt.Errorf("oops"))
+	m.recordBatch(10)
+	m.recordBatch(30)
+	m.recordBatch(20)
+
+	snapshot := IndexMetricsSnapshot().(map[string]map[string]uint64)
+	exp := map[string]uint64{
+		"queries":      2,
+		"queryErrors":  1,
+		"bytesIndexed": 0,
+		"dcpRollbacks": 0,
+		"batches":      3,
+		"batchOps":     60,
+		"batchOpsMax":  30,
+		"feedStalls":   0,
+		"feedStallMs":  0,
+		"ingestErrors": 0,
+	}
+	if !reflect.DeepEqual(snapshot["testIndexMetrics"], exp) {
+		t.Errorf("expected: %v, got: %v", exp, snapshot["testIndexMetrics"])
+	}
+
+	// The snapshot must be usable as an expvar.
+	var v map[string]map[string]uint64
+	err := json.Unmarshal([]byte(expvar.Func(IndexMetricsSnapshot).String()), &v)
+	if err != nil || v["testIndexMetrics"]["batchOps"] != 60 {
+		t.Errorf("expected expvar JSON, got: %v, err: %v", v, err)
+	}
+}
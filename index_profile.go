@@ -0,0 +1,278 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// An index definition may have a "profiles" section of environment
+// overlays, keyed by profile name, so that the same definition JSON
+// can be used for (say) a 1-node dev setup and a large prod cluster.
+// For example...
+//
+//   {"type": "bleve", "sourceType": "couchbase", ...,
+//    "profiles": {
+//      "dev": {"planParams": {"numReplicas": 0}},
+//      "prod": {"planParams": {"numReplicas": 2,
+//                              "maxPartitionsPerPIndex": 32},
+//               "params": {"store": {"kvStoreName": "forestdb"}}}}}
+//
+// The overlay of the active profile is deep-merged over the
+// definition when the index is created or updated, where the active
+// profile comes from the request's "profile" parameter, or else the
+// node's "profile" option (the -profile cmd-line flag), or else the
+// cluster settings.  As the overlay is applied by the node that
+// receives the request, the resulting index definition is the same
+// for all nodes.
+
+// The parts of an index definition that a profile overlay may
+// change, keyed by the overlay's field name, with the equivalent
+// request parameter names of the index create/update REST API.
+var IndexProfileOverlayFields = map[string][]string{
+	"planParams":   []string{"planParams"},
+	"params":       []string{"indexParams", "params"},
+	"sourceParams": []string{"sourceParams"},
+}
+
+// IndexProfile returns the active profile name for index
+// definition overlays, given an optional, explicitly requested
+// profile name.
+func IndexProfile(mgr *cbgt.Manager, requested string) (string, error) {
+	if requested != "" {
+		return requested, nil
+	}
+
+	if profile := mgr.Options()["profile"]; profile != "" {
+		return profile, nil
+	}
+
+	settings, _, err := CfgGetClusterSettings(mgr.Cfg())
+	if err != nil {
+		return "", err
+	}
+
+	return settings.Profile, nil
+}
+
+// ApplyIndexProfile deep-merges the overlay of a profile over an
+// index definition's JSON params value, which may either be a JSON
+// object or a JSON string that holds a JSON object.  The result has
+// the same representation as the input params value.
+func ApplyIndexProfile(params interface{},
+	overlay interface{}) (interface{}, error) {
+	s, isString := params.(string)
+	if isString {
+		if s == "" {
+			s = "{}"
+		}
+		var err error
+		params, err = parseJSONUseNumber([]byte(s))
+		if err != nil {
+			return nil, fmt.Errorf("index_profile: could not parse"+
+				" params, err: %v", err)
+		}
+	}
+
+	rv := jsonMergeOverlay(params, overlay)
+
+	if isString {
+		buf, err := json.Marshal(rv)
+		if err != nil {
+			return nil, err
+		}
+		return string(buf), nil
+	}
+
+	return rv, nil
+}
+
+// jsonMergeOverlay deep-merges JSON objects, where values from the
+// overlay take precedence over values from the base.
+func jsonMergeOverlay(base, overlay interface{}) interface{} {
+	mo, ok := overlay.(map[string]interface{})
+	if !ok {
+		return overlay
+	}
+	mb, ok := base.(map[string]interface{})
+	if !ok {
+		mb = map[string]interface{}{}
+	}
+
+	rv := map[string]interface{}{}
+	for k, v := range mb {
+		rv[k] = v
+	}
+	for k, v := range mo {
+		rv[k] = jsonMergeOverlay(rv[k], v)
+	}
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// IndexProfileHandler is a REST handler that applies the active
+// profile's overlay to an index create/update request and then
+// delegates to the next (usually the cbgt/rest index create) handler.
+type IndexProfileHandler struct {
+	mgr  *cbgt.Manager
+	next http.Handler
+}
+
+func NewIndexProfileHandler(mgr *cbgt.Manager,
+	next http.Handler) *IndexProfileHandler {
+	return &IndexProfileHandler{mgr: mgr, next: next}
+}
+
+func (h *IndexProfileHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	// Parse any form params first, as that might consume a
+	// form-urlencoded request body.
+	err := req.ParseForm()
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_profile: could not"+
+			" parse form, err: %v", err), 400)
+		return
+	}
+
+	var requestBody []byte
+	if req.Body != nil {
+		requestBody, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			rest.ShowError(w, req, fmt.Sprintf("index_profile: could not"+
+				" read request body, err: %v", err), 400)
+			return
+		}
+	}
+
+	requestBody, err = h.applyProfile(req, requestBody)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(requestBody))
+	req.ContentLength = int64(len(requestBody))
+
+	h.next.ServeHTTP(w, req)
+}
+
+// applyProfile modifies the form params of an index create/update
+// request with the active profile's overlay, returning the request
+// body with the overlay applied.
+func (h *IndexProfileHandler) applyProfile(req *http.Request,
+	requestBody []byte) ([]byte, error) {
+	var body map[string]interface{}
+	if len(bytes.TrimSpace(requestBody)) > 0 {
+		v, err := parseJSONUseNumber(requestBody)
+		if err != nil {
+			// Not JSON, so leave it to the next handler to complain.
+			return requestBody, nil
+		}
+		body, _ = v.(map[string]interface{})
+	}
+
+	var profiles interface{}
+	if s := req.Form.Get("profiles"); s != "" {
+		v, err := parseJSONUseNumber([]byte(s))
+		if err != nil {
+			return nil, fmt.Errorf("index_profile: could not parse"+
+				" profiles, err: %v", err)
+		}
+		profiles = v
+	} else if body != nil {
+		profiles = body["profiles"]
+	}
+	if profiles == nil {
+		return requestBody, nil
+	}
+
+	profilesMap, ok := profiles.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("index_profile: profiles not a JSON object")
+	}
+
+	profile, err := IndexProfile(h.mgr, req.Form.Get("profile"))
+	if err != nil {
+		return nil, fmt.Errorf("index_profile: could not retrieve"+
+			" profile, err: %v", err)
+	}
+	if profile == "" {
+		return requestBody, nil
+	}
+
+	overlay, exists := profilesMap[profile]
+	if !exists {
+		return requestBody, nil
+	}
+
+	overlayMap, ok := overlay.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("index_profile: profile overlay not"+
+			" a JSON object, profile: %s", profile)
+	}
+
+	for field, overlayVal := range overlayMap {
+		names, known := IndexProfileOverlayFields[field]
+		if !known {
+			return nil, fmt.Errorf("index_profile: unsupported profile"+
+				" overlay field, profile: %s, field: %s", profile, field)
+		}
+
+		applied := false
+
+		for _, name := range names {
+			if _, exists := req.Form[name]; exists {
+				v, err := ApplyIndexProfile(req.Form.Get(name), overlayVal)
+				if err != nil {
+					return nil, err
+				}
+				req.Form.Set(name, v.(string))
+				applied = true
+			}
+
+			if body != nil {
+				if bodyVal, exists := body[name]; exists {
+					v, err := ApplyIndexProfile(bodyVal, overlayVal)
+					if err != nil {
+						return nil, err
+					}
+					body[name] = v
+					applied = true
+				}
+			}
+		}
+
+		if !applied {
+			v, err := ApplyIndexProfile("", overlayVal)
+			if err != nil {
+				return nil, err
+			}
+			req.Form.Set(names[0], v.(string))
+		}
+	}
+
+	if body == nil {
+		return requestBody, nil
+	}
+
+	delete(body, "profiles")
+
+	return json.Marshal(body)
+}
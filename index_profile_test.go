@@ -0,0 +1,154 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestApplyIndexProfile(t *testing.T) {
+	tests := []struct {
+		params  interface{}
+		overlay string
+		exp     string
+	}{
+		{"", `{"numReplicas":1}`, `{"numReplicas":1}`},
+		{`{"numReplicas":0,"maxPartitionsPerPIndex":10}`,
+			`{"numReplicas":2}`,
+			`{"maxPartitionsPerPIndex":10,"numReplicas":2}`},
+		{`{"store":{"kvStoreName":"boltdb","x":1}}`,
+			`{"store":{"kvStoreName":"forestdb"}}`,
+			`{"store":{"kvStoreName":"forestdb","x":1}}`},
+	}
+
+	for _, test := range tests {
+		overlay, _ := parseJSONUseNumber([]byte(test.overlay))
+		v, err := ApplyIndexProfile(test.params, overlay)
+		if err != nil {
+			t.Errorf("expected no err, got: %v", err)
+		}
+		if v.(string) != test.exp {
+			t.Errorf("expected: %s, got: %s", test.exp, v)
+		}
+	}
+
+	_, err := ApplyIndexProfile("not json", map[string]interface{}{})
+	if err == nil {
+		t.Errorf("expected err on bad params")
+	}
+}
+
+func TestIndexProfileHandler(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	mr, _ := cbgt.NewMsgRing(os.Stderr, 1000)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", mr)
+	if err != nil || router == nil {
+		t.Errorf("no mux router")
+	}
+
+	profiles := `{"dev":{"planParams":{"maxPartitionsPerPIndex":1024}},
+                  "prod":{"planParams":{"numReplicas":2}}}`
+
+	tests := []*RESTHandlerTest{
+		{
+			Desc:   "create index with a bad profiles overlay",
+			Path:   "/api/index/idx0",
+			Method: "PUT",
+			Params: url.Values{
+				"indexType":  []string{"bleve"},
+				"sourceType": []string{"nil"},
+				"profile":    []string{"dev"},
+				"profiles":   []string{`{"dev":{"bogus":{}}}`},
+			},
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`unsupported profile overlay field`: true,
+			},
+		},
+		{
+			Desc:   "create index with the prod profile",
+			Path:   "/api/index/idx0",
+			Method: "PUT",
+			Params: url.Values{
+				"indexType":  []string{"bleve"},
+				"sourceType": []string{"nil"},
+				"planParams": []string{`{"maxPartitionsPerPIndex":10}`},
+				"profile":    []string{"prod"},
+				"profiles":   []string{profiles},
+			},
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`{"status":"ok"}`: true,
+			},
+		},
+		{
+			Desc:   "set the cluster setting profile",
+			Path:   "/api/settings",
+			Method: "PUT",
+			Body:   []byte(`{"profile":"dev"}`),
+			Status: http.StatusOK,
+		},
+		{
+			Desc:   "get the cluster settings",
+			Path:   "/api/settings",
+			Method: "GET",
+			Status: http.StatusOK,
+			ResponseBody: []byte(
+				`{"status":"ok","settings":{"profile":"dev"}}`),
+		},
+		{
+			Desc:   "create index with the cluster setting profile",
+			Path:   "/api/index/idx1",
+			Method: "PUT",
+			Params: url.Values{
+				"indexType":  []string{"bleve"},
+				"sourceType": []string{"nil"},
+				"profiles":   []string{profiles},
+			},
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`{"status":"ok"}`: true,
+			},
+		},
+	}
+
+	testRESTHandlers(t, tests, router)
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	idx0 := indexDefsByName["idx0"]
+	if idx0 == nil ||
+		idx0.PlanParams.NumReplicas != 2 ||
+		idx0.PlanParams.MaxPartitionsPerPIndex != 10 {
+		t.Errorf("expected prod profile overlay, got: %#v", idx0)
+	}
+	idx1 := indexDefsByName["idx1"]
+	if idx1 == nil || idx1.PlanParams.MaxPartitionsPerPIndex != 1024 {
+		t.Errorf("expected dev profile overlay, got: %#v", idx1)
+	}
+}
@@ -0,0 +1,477 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbase/go-couchbase"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// An index template is a stored index definition pattern, for the
+// many data sources that all need identical indexes, like
+// per-customer buckets.  A template is instantiated for a source with
+// a single call, or automatically, when its sourcePattern, a glob like
+// "customer-*", matches the name of a new bucket.  The notifier node
+// of the webhooks (see webhooks.go) periodically lists the buckets of
+// the server and instantiates the matching templates.  Each template
+// remembers the sources it was instantiated for, so that an index
+// that was deliberately deleted isn't automatically recreated.
+
+// The Cfg key where the index templates are kept.
+const INDEX_TEMPLATES_KEY = "indexTemplates"
+
+// How often the notifier node checks for new buckets that match the
+// sourcePatterns of the index templates.
+var IndexTemplateCheckInterval = 30 * time.Second
+
+// The placeholder in an index template's indexName that's replaced
+// by the source name.
+const INDEX_TEMPLATE_SOURCE_NAME = "{sourceName}"
+
+// IndexTemplates is the Cfg entry of all index templates.
+type IndexTemplates struct {
+	UUID string `json:"uuid"`
+
+	// Keyed by template name.
+	Templates map[string]*IndexTemplate `json:"templates"`
+}
+
+// IndexTemplate is an index definition pattern, whose fields are like
+// those of an index definition.
+type IndexTemplate struct {
+	Name string `json:"name"`
+
+	// An optional glob of the names of the buckets that the template
+	// is automatically instantiated for.
+	SourcePattern string `json:"sourcePattern,omitempty"`
+
+	// The name of the instantiated indexes, where "{sourceName}" is
+	// replaced by the source name.  Defaults to "{name}_{sourceName}".
+	IndexName string `json:"indexName,omitempty"`
+
+	SourceType   string          `json:"sourceType"` // Defaults to "couchbase".
+	SourceParams json.RawMessage `json:"sourceParams,omitempty"`
+	IndexType    string          `json:"indexType"` // Defaults to "bleve".
+	Params       json.RawMessage `json:"params,omitempty"`
+	PlanParams   cbgt.PlanParams `json:"planParams"`
+
+	// The indexes that the template was instantiated as, keyed by
+	// source name.
+	Instances map[string]string `json:"instances,omitempty"`
+}
+
+// IndexTemplateIndexName returns the name of the index of a template
+// that's instantiated for a source.
+func IndexTemplateIndexName(t *IndexTemplate, sourceName string) string {
+	s := compositeIndexNameInvalidRE.ReplaceAllString(sourceName, "_")
+	if t.IndexName == "" {
+		return t.Name + "_" + s
+	}
+	return strings.Replace(t.IndexName, INDEX_TEMPLATE_SOURCE_NAME, s, -1)
+}
+
+// IndexTemplateMatch returns true when a template is automatically
+// instantiated for a source.
+func IndexTemplateMatch(t *IndexTemplate, sourceName string) bool {
+	if t.SourcePattern == "" {
+		return false
+	}
+	matched, err := path.Match(t.SourcePattern, sourceName)
+	return err == nil && matched
+}
+
+// SetIndexTemplate creates or updates an index template, keeping the
+// instances of a previous template of the same name.  The indexes of
+// the previous instances aren't changed.
+func SetIndexTemplate(cfg cbgt.Cfg, t *IndexTemplate) error {
+	if t.Name == "" {
+		return fmt.Errorf("index_template: name is required")
+	}
+	if t.SourcePattern != "" {
+		_, err := path.Match(t.SourcePattern, "")
+		if err != nil {
+			return fmt.Errorf("index_template: bad sourcePattern: %q,"+
+				" name: %s, err: %v", t.SourcePattern, t.Name, err)
+		}
+	}
+	if t.IndexName != "" &&
+		!strings.Contains(t.IndexName, INDEX_TEMPLATE_SOURCE_NAME) {
+		return fmt.Errorf("index_template: indexName must contain %s,"+
+			" name: %s", INDEX_TEMPLATE_SOURCE_NAME, t.Name)
+	}
+	if t.SourceType == "" {
+		t.SourceType = "couchbase"
+	}
+	if t.IndexType == "" {
+		t.IndexType = "bleve"
+	}
+	if cbgt.PIndexImplTypes[t.IndexType] == nil {
+		return fmt.Errorf("index_template: unknown indexType: %s,"+
+			" name: %s", t.IndexType, t.Name)
+	}
+
+	return updateIndexTemplates(cfg, func(its *IndexTemplates) error {
+		t.Instances = nil
+		if prev := its.Templates[t.Name]; prev != nil {
+			t.Instances = prev.Instances
+		}
+		its.Templates[t.Name] = t
+		return nil
+	})
+}
+
+// DeleteIndexTemplate deletes an index template, but not the indexes
+// it was instantiated as.
+func DeleteIndexTemplate(cfg cbgt.Cfg, name string) error {
+	return updateIndexTemplates(cfg, func(its *IndexTemplates) error {
+		if its.Templates[name] == nil {
+			return fmt.Errorf("index_template: no template, name: %s",
+				name)
+		}
+		delete(its.Templates, name)
+		return nil
+	})
+}
+
+// CfgGetIndexTemplates returns the index templates from the Cfg.
+func CfgGetIndexTemplates(cfg cbgt.Cfg) (*IndexTemplates, error) {
+	its := &IndexTemplates{}
+	_, _, err := CfgGetJSON(cfg, INDEX_TEMPLATES_KEY, its)
+	if err != nil {
+		return nil, err
+	}
+	if its.Templates == nil {
+		its.Templates = map[string]*IndexTemplate{}
+	}
+	return its, nil
+}
+
+func updateIndexTemplates(cfg cbgt.Cfg,
+	f func(its *IndexTemplates) error) error {
+	return CfgUpdateJSON(cfg, INDEX_TEMPLATES_KEY,
+		func() interface{} { return &IndexTemplates{} },
+		func(v interface{}) error {
+			its := v.(*IndexTemplates)
+			if its.Templates == nil {
+				its.Templates = map[string]*IndexTemplate{}
+			}
+			err := f(its)
+			if err != nil {
+				return err
+			}
+			its.UUID = cbgt.NewUUID()
+			return nil
+		})
+}
+
+// InstantiateIndexTemplate creates the index of a template for a
+// source, returning the index name.
+func InstantiateIndexTemplate(mgr *cbgt.Manager, name, sourceName,
+	sourceUUID string) (string, error) {
+	if sourceName == "" {
+		return "", fmt.Errorf("index_template: sourceName is required,"+
+			" name: %s", name)
+	}
+
+	its, err := CfgGetIndexTemplates(mgr.Cfg())
+	if err != nil {
+		return "", err
+	}
+	t := its.Templates[name]
+	if t == nil {
+		return "", fmt.Errorf("index_template: no template, name: %s",
+			name)
+	}
+
+	indexName := IndexTemplateIndexName(t, sourceName)
+
+	err = CreateIndexChecked(mgr, t.SourceType, sourceName, sourceUUID,
+		compositeParamsString(t.SourceParams), t.IndexType, indexName,
+		compositeParamsString(t.Params), t.PlanParams, "")
+	if err != nil {
+		return "", fmt.Errorf("index_template: could not create index: %s,"+
+			" name: %s, err: %v", indexName, name, err)
+	}
+
+	err = updateIndexTemplates(mgr.Cfg(), func(its *IndexTemplates) error {
+		if t := its.Templates[name]; t != nil {
+			if t.Instances == nil {
+				t.Instances = map[string]string{}
+			}
+			t.Instances[sourceName] = indexName
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("index_template: instantiated, name: %s, sourceName: %s,"+
+		" indexName: %s", name, sourceName, indexName)
+
+	return indexName, nil
+}
+
+// IndexTemplateSourceNames returns the names of the buckets of a
+// server, and may be overridden for testing.
+var IndexTemplateSourceNames = func(server string) ([]string, error) {
+	client, err := couchbase.Connect(server)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := client.GetPool("default")
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]string, 0, len(pool.BucketMap))
+	for bucketName := range pool.BucketMap {
+		rv = append(rv, bucketName)
+	}
+	sort.Strings(rv)
+	return rv, nil
+}
+
+// IndexTemplateStart starts a goroutine that, on the notifier node,
+// instantiates the index templates for new matching buckets.
+func IndexTemplateStart(mgr *cbgt.Manager) {
+	if mgr.Server() == "" || mgr.Server() == "." {
+		return
+	}
+
+	go func() {
+		for range time.Tick(IndexTemplateCheckInterval) {
+			notifier, err := webhookIsNotifier(mgr.Cfg())
+			if err == nil && notifier {
+				err = indexTemplateCheck(mgr)
+			}
+			if err != nil {
+				log.Printf("index_template: check, err: %v", err)
+			}
+		}
+	}()
+}
+
+// indexTemplateCheck instantiates the index templates whose
+// sourcePatterns match buckets that the templates weren't yet
+// instantiated for.
+func indexTemplateCheck(mgr *cbgt.Manager) error {
+	its, err := CfgGetIndexTemplates(mgr.Cfg())
+	if err != nil {
+		return err
+	}
+
+	var auto []*IndexTemplate
+	for _, t := range its.Templates {
+		if t.SourcePattern != "" {
+			auto = append(auto, t)
+		}
+	}
+	if len(auto) <= 0 {
+		return nil
+	}
+
+	if DiskWatermarkHigh() {
+		return nil
+	}
+
+	sourceNames, err := IndexTemplateSourceNames(mgr.Server())
+	if err != nil {
+		return err
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range auto {
+		for _, sourceName := range sourceNames {
+			if !IndexTemplateMatch(t, sourceName) ||
+				t.Instances[sourceName] != "" ||
+				indexDefsByName[IndexTemplateIndexName(t, sourceName)] != nil {
+				continue
+			}
+
+			_, err = InstantiateIndexTemplate(mgr, t.Name, sourceName, "")
+			if err != nil {
+				log.Printf("index_template: auto-create, err: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------
+
+// IndexTemplateListHandler is a REST handler that returns the index
+// templates.
+type IndexTemplateListHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexTemplateListHandler(
+	mgr *cbgt.Manager) *IndexTemplateListHandler {
+	return &IndexTemplateListHandler{mgr: mgr}
+}
+
+func (h *IndexTemplateListHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	its, err := CfgGetIndexTemplates(h.mgr.Cfg())
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_template: could not"+
+			" retrieve templates, err: %v", err), 500)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status    string                    `json:"status"`
+		Templates map[string]*IndexTemplate `json:"templates"`
+	}{
+		Status:    "ok",
+		Templates: its.Templates,
+	})
+}
+
+// IndexTemplatePutHandler is a REST handler that creates or updates
+// an index template.
+type IndexTemplatePutHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexTemplatePutHandler(
+	mgr *cbgt.Manager) *IndexTemplatePutHandler {
+	return &IndexTemplatePutHandler{mgr: mgr}
+}
+
+func (h *IndexTemplatePutHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_template: could not"+
+			" read request body, err: %v", err), 400)
+		return
+	}
+
+	t := &IndexTemplate{}
+	err = json.Unmarshal(requestBody, t)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_template: could not"+
+			" parse request body, err: %v", err), 400)
+		return
+	}
+	t.Name = mux.Vars(req)["name"]
+
+	err = SetIndexTemplate(h.mgr.Cfg(), t)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// IndexTemplateDeleteHandler is a REST handler that deletes an index
+// template.
+type IndexTemplateDeleteHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexTemplateDeleteHandler(
+	mgr *cbgt.Manager) *IndexTemplateDeleteHandler {
+	return &IndexTemplateDeleteHandler{mgr: mgr}
+}
+
+func (h *IndexTemplateDeleteHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	err := DeleteIndexTemplate(h.mgr.Cfg(), mux.Vars(req)["name"])
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// IndexTemplateInstantiateHandler is a REST handler that creates the
+// index of an index template for a source.
+type IndexTemplateInstantiateHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexTemplateInstantiateHandler(
+	mgr *cbgt.Manager) *IndexTemplateInstantiateHandler {
+	return &IndexTemplateInstantiateHandler{mgr: mgr}
+}
+
+func (h *IndexTemplateInstantiateHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_template: could not"+
+			" read request body, err: %v", err), 400)
+		return
+	}
+
+	var r struct {
+		SourceName string `json:"sourceName"`
+		SourceUUID string `json:"sourceUUID"`
+	}
+	err = json.Unmarshal(requestBody, &r)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_template: could not"+
+			" parse request body, err: %v", err), 400)
+		return
+	}
+
+	if DiskWatermarkHigh() {
+		rest.ShowError(w, req, fmt.Sprintf("index_template: template: %s"+
+			" cannot be instantiated, as the disk of node: %s is over its"+
+			" high watermark", mux.Vars(req)["name"], h.mgr.UUID()),
+			http.StatusInsufficientStorage)
+		return
+	}
+
+	indexName, err := InstantiateIndexTemplate(h.mgr,
+		mux.Vars(req)["name"], r.SourceName, r.SourceUUID)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), IndexCreateErrorStatus(err, 400))
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status    string `json:"status"`
+		IndexName string `json:"indexName"`
+	}{
+		Status:    "ok",
+		IndexName: indexName,
+	})
+}
@@ -0,0 +1,140 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestIndexTemplateIndexName(t *testing.T) {
+	tmpl := &IndexTemplate{Name: "fts"}
+	if n := IndexTemplateIndexName(tmpl, "customer-1"); n != "fts_customer-1" {
+		t.Errorf("unexpected default index name: %s", n)
+	}
+	tmpl.IndexName = "{sourceName}_idx"
+	if n := IndexTemplateIndexName(tmpl, "cust.2"); n != "cust_2_idx" {
+		t.Errorf("unexpected index name: %s", n)
+	}
+}
+
+func TestIndexTemplateMatch(t *testing.T) {
+	tmpl := &IndexTemplate{Name: "fts"}
+	if IndexTemplateMatch(tmpl, "customer-1") {
+		t.Errorf("expected no match without a sourcePattern")
+	}
+	tmpl.SourcePattern = "customer-*"
+	if !IndexTemplateMatch(tmpl, "customer-1") {
+		t.Errorf("expected a match")
+	}
+	if IndexTemplateMatch(tmpl, "orders") {
+		t.Errorf("expected no match")
+	}
+}
+
+func TestIndexTemplate(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	bad := []*IndexTemplate{
+		{},
+		{Name: "fts", SourcePattern: "customer-["},
+		{Name: "fts", IndexName: "idx"},
+		{Name: "fts", IndexType: "not-an-index-type"},
+	}
+	for i, tmpl := range bad {
+		if SetIndexTemplate(cfg, tmpl) == nil {
+			t.Errorf("%d - expected err for template: %+v", i, tmpl)
+		}
+	}
+
+	err := SetIndexTemplate(cfg, &IndexTemplate{Name: "fts",
+		SourcePattern: "customer-*", SourceType: "primary"})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	indexName, err := InstantiateIndexTemplate(mgr, "fts", "manual", "")
+	if err != nil || indexName != "fts_manual" {
+		t.Fatalf("expected instantiated, got: %s, err: %v", indexName, err)
+	}
+
+	if _, err = InstantiateIndexTemplate(mgr, "nope", "x", ""); err == nil {
+		t.Errorf("expected err on a missing template")
+	}
+
+	prevSourceNames := IndexTemplateSourceNames
+	defer func() { IndexTemplateSourceNames = prevSourceNames }()
+
+	IndexTemplateSourceNames = func(server string) ([]string, error) {
+		return []string{"customer-1", "customer-2", "orders"}, nil
+	}
+
+	err = indexTemplateCheck(mgr)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	_, indexDefsByName, _ := mgr.GetIndexDefs(true)
+	if indexDefsByName["fts_customer-1"] == nil ||
+		indexDefsByName["fts_customer-2"] == nil ||
+		indexDefsByName["fts_orders"] != nil {
+		t.Errorf("expected matching buckets instantiated, got: %v",
+			indexDefsByName)
+	}
+
+	err = mgr.DeleteIndex("fts_customer-1")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	// Updating the template keeps its instances.
+	err = SetIndexTemplate(cfg, &IndexTemplate{Name: "fts",
+		SourcePattern: "customer-*", SourceType: "primary"})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	indexTemplateCheck(mgr)
+
+	_, indexDefsByName, _ = mgr.GetIndexDefs(true)
+	if indexDefsByName["fts_customer-1"] != nil {
+		t.Errorf("expected a deleted instance not recreated")
+	}
+
+	its, _ := CfgGetIndexTemplates(cfg)
+	if len(its.Templates["fts"].Instances) != 3 {
+		t.Errorf("expected 3 instances, got: %v",
+			its.Templates["fts"].Instances)
+	}
+
+	err = DeleteIndexTemplate(cfg, "fts")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if DeleteIndexTemplate(cfg, "fts") == nil {
+		t.Errorf("expected err on a missing template")
+	}
+
+	_, indexDefsByName, _ = mgr.GetIndexDefs(true)
+	if indexDefsByName["fts_customer-2"] == nil {
+		t.Errorf("expected the instances kept")
+	}
+}
@@ -0,0 +1,487 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// When the indexTrashGracePeriod node option is set, like "24h" or
+// "7d", deleting an index through the REST API moves the index into
+// the trash for the grace period, so that a fat-fingered delete
+// doesn't instantly destroy hours of build work.  By default, or when
+// the option is "0", there's no trash and a delete is a real delete.
+// A trashed index keeps its definition and its pindex files, but its
+// queries are disallowed, its ingest is paused and its plan is
+// frozen, and it can't be changed, until it's either restored, which
+// brings back its previous controls, or purged.  The notifier node of
+// the webhooks (see webhooks.go) purges the trashed indexes whose
+// grace period is over.  Indexes without pindexes, like aliases, have
+// no build work, so they're deleted right away.
+
+// The Cfg key where the trashed indexes are kept.
+const INDEX_TRASH_KEY = "indexTrash"
+
+// The default grace period of a trashed index, before it's purged,
+// where 0 means the trash is disabled.
+var IndexTrashGracePeriod = time.Duration(0)
+
+// How often the trashed indexes are checked for being purged.
+var IndexTrashCheckInterval = time.Minute
+
+// IndexTrash is the Cfg entry of the trashed indexes.
+type IndexTrash struct {
+	UUID string `json:"uuid"`
+
+	// Keyed by indexName.
+	Indexes map[string]*TrashedIndex `json:"indexes"`
+}
+
+// TrashedIndex is an index in the trash, along with its controls from
+// before it was trashed.
+type TrashedIndex struct {
+	IndexName string `json:"indexName"`
+	DeletedAt string `json:"deletedAt"`
+	PurgeAt   string `json:"purgeAt"`
+
+	CanRead    bool `json:"canRead"`
+	CanWrite   bool `json:"canWrite"`
+	PlanFrozen bool `json:"planFrozen"`
+}
+
+// IndexTrashGracePeriodOption returns the grace period of a node's
+// trashed indexes, where 0 means the trash is disabled.
+func IndexTrashGracePeriodOption(options map[string]string) (
+	time.Duration, error) {
+	v := options["indexTrashGracePeriod"]
+	if v == "" {
+		return IndexTrashGracePeriod, nil
+	}
+	if v == "0" {
+		return 0, nil
+	}
+	d, err := ParseExpireAfter(v)
+	if err != nil {
+		return 0, fmt.Errorf("index_trash: bad indexTrashGracePeriod: %q,"+
+			" err: %v", v, err)
+	}
+	return d, nil
+}
+
+// CfgGetIndexTrash returns the trashed indexes from the Cfg.
+func CfgGetIndexTrash(cfg cbgt.Cfg) (*IndexTrash, error) {
+	trash := &IndexTrash{}
+	_, _, err := CfgGetJSON(cfg, INDEX_TRASH_KEY, trash)
+	if err != nil {
+		return nil, err
+	}
+	if trash.Indexes == nil {
+		trash.Indexes = map[string]*TrashedIndex{}
+	}
+	return trash, nil
+}
+
+// IsTrashed returns the trashed index of an index name, or nil.
+func IsTrashed(cfg cbgt.Cfg, indexName string) (*TrashedIndex, error) {
+	trash, err := CfgGetIndexTrash(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return trash.Indexes[indexName], nil
+}
+
+func updateIndexTrash(cfg cbgt.Cfg, f func(trash *IndexTrash) error) error {
+	return CfgUpdateJSON(cfg, INDEX_TRASH_KEY,
+		func() interface{} { return &IndexTrash{} },
+		func(v interface{}) error {
+			trash := v.(*IndexTrash)
+			if trash.Indexes == nil {
+				trash.Indexes = map[string]*TrashedIndex{}
+			}
+			err := f(trash)
+			if err != nil {
+				return err
+			}
+			trash.UUID = cbgt.NewUUID()
+			return nil
+		})
+}
+
+// TrashIndex moves an index into the trash, returning false when the
+// index has no pindexes, so it should be deleted right away instead.
+func TrashIndex(mgr *cbgt.Manager, indexName string,
+	gracePeriod time.Duration, now time.Time) (*TrashedIndex, bool, error) {
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return nil, false, err
+	}
+
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil {
+		return nil, false, fmt.Errorf("index_trash: not an index,"+
+			" indexName: %s", indexName)
+	}
+
+	pindexImplType := cbgt.PIndexImplTypes[indexDef.Type]
+	if pindexImplType == nil || pindexImplType.New == nil {
+		return nil, false, nil
+	}
+
+	trashed, err := IsTrashed(mgr.Cfg(), indexName)
+	if err != nil || trashed != nil {
+		return trashed, trashed != nil, err
+	}
+
+	trashed = &TrashedIndex{
+		IndexName:  indexName,
+		DeletedAt:  now.Format(time.RFC3339Nano),
+		PurgeAt:    now.Add(gracePeriod).Format(time.RFC3339Nano),
+		CanRead:    true,
+		CanWrite:   true,
+		PlanFrozen: indexDef.PlanParams.PlanFrozen,
+	}
+	if np := indexDef.PlanParams.NodePlanParams[""][""]; np != nil {
+		trashed.CanRead = np.CanRead
+		trashed.CanWrite = np.CanWrite
+	}
+
+	err = updateIndexTrash(mgr.Cfg(), func(trash *IndexTrash) error {
+		trash.Indexes[indexName] = trashed
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = mgr.IndexControl(indexName, indexDef.UUID,
+		"disallow", "pause", "freeze")
+	if err != nil {
+		updateIndexTrash(mgr.Cfg(), func(trash *IndexTrash) error {
+			delete(trash.Indexes, indexName)
+			return nil
+		})
+		return nil, false, err
+	}
+
+	log.Printf("index_trash: trashed, index: %s, purgeAt: %s",
+		indexName, trashed.PurgeAt)
+
+	return trashed, true, nil
+}
+
+// RestoreIndex takes an index out of the trash, restoring its previous
+// controls.
+func RestoreIndex(mgr *cbgt.Manager, indexName string) error {
+	trashed, err := IsTrashed(mgr.Cfg(), indexName)
+	if err != nil {
+		return err
+	}
+	if trashed == nil {
+		return fmt.Errorf("index_trash: not in the trash, index: %s",
+			indexName)
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return err
+	}
+
+	if indexDef := indexDefsByName[indexName]; indexDef != nil {
+		readOp, writeOp, planFreezeOp := "allow", "resume", "unfreeze"
+		if !trashed.CanRead {
+			readOp = "disallow"
+		}
+		if !trashed.CanWrite {
+			writeOp = "pause"
+		}
+		if trashed.PlanFrozen {
+			planFreezeOp = "freeze"
+		}
+
+		err = mgr.IndexControl(indexName, indexDef.UUID,
+			readOp, writeOp, planFreezeOp)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = updateIndexTrash(mgr.Cfg(), func(trash *IndexTrash) error {
+		delete(trash.Indexes, indexName)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("index_trash: restored, index: %s", indexName)
+
+	return nil
+}
+
+// PurgeIndex deletes an index for good, whether it's in the trash or
+// not.
+func PurgeIndex(mgr *cbgt.Manager, indexName string) error {
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return err
+	}
+
+	if indexDefsByName[indexName] != nil {
+		err = mgr.DeleteIndex(indexName)
+		if err != nil {
+			return err
+		}
+	}
+
+	trashed, err := IsTrashed(mgr.Cfg(), indexName)
+	if err != nil || trashed == nil {
+		return err
+	}
+
+	err = updateIndexTrash(mgr.Cfg(), func(trash *IndexTrash) error {
+		delete(trash.Indexes, indexName)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("index_trash: purged, index: %s", indexName)
+
+	return nil
+}
+
+// IndexTrashStart starts a goroutine that, on the notifier node,
+// purges the trashed indexes whose grace period is over.
+func IndexTrashStart(mgr *cbgt.Manager) error {
+	_, err := IndexTrashGracePeriodOption(mgr.Options())
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(IndexTrashCheckInterval) {
+			notifier, err := webhookIsNotifier(mgr.Cfg())
+			if err == nil && notifier {
+				err = indexTrashCheck(mgr, time.Now())
+			}
+			if err != nil {
+				log.Printf("index_trash: check, err: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// indexTrashCheck purges the trashed indexes whose grace period is
+// over, and forgets those that were deleted by other means.
+func indexTrashCheck(mgr *cbgt.Manager, now time.Time) error {
+	trash, err := CfgGetIndexTrash(mgr.Cfg())
+	if err != nil {
+		return err
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return err
+	}
+
+	for indexName, trashed := range trash.Indexes {
+		purgeAt, err := time.Parse(time.RFC3339Nano, trashed.PurgeAt)
+		if err == nil && now.Before(purgeAt) &&
+			indexDefsByName[indexName] != nil {
+			continue
+		}
+
+		err = PurgeIndex(mgr, indexName)
+		if err != nil {
+			log.Printf("index_trash: could not purge, index: %s, err: %v",
+				indexName, err)
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------
+
+// IndexTrashGuardHandler is a REST handler that rejects a request
+// for a trashed index, and then delegates to the next handler.
+type IndexTrashGuardHandler struct {
+	mgr  *cbgt.Manager
+	next http.Handler
+}
+
+func NewIndexTrashGuardHandler(mgr *cbgt.Manager,
+	next http.Handler) *IndexTrashGuardHandler {
+	return &IndexTrashGuardHandler{mgr: mgr, next: next}
+}
+
+func (h *IndexTrashGuardHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	trashed, err := IsTrashed(h.mgr.Cfg(), indexName)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_trash: could not"+
+			" retrieve trash, err: %v", err), 500)
+		return
+	}
+
+	if trashed != nil {
+		_, indexDefsByName, err := h.mgr.GetIndexDefs(false)
+		if err == nil && indexDefsByName[indexName] == nil {
+			trashed = nil // The index was deleted by other means.
+		}
+	}
+
+	if trashed != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_trash: index: %s is"+
+			" in the trash, until: %s; please restore it first, with"+
+			" POST /api/index/%s/restore, or purge it, with"+
+			" DELETE /api/index/%s?purge=true", indexName,
+			trashed.PurgeAt, indexName, indexName), 400)
+		return
+	}
+
+	h.next.ServeHTTP(w, req)
+}
+
+// IndexTrashDeleteHandler is a REST handler that moves an index into
+// the trash instead of deleting it, unless the trash is disabled or
+// the request has a purge=true URL query parameter, where it
+// delegates to the next handler.
+type IndexTrashDeleteHandler struct {
+	mgr  *cbgt.Manager
+	next http.Handler
+}
+
+func NewIndexTrashDeleteHandler(mgr *cbgt.Manager,
+	next http.Handler) *IndexTrashDeleteHandler {
+	return &IndexTrashDeleteHandler{mgr: mgr, next: next}
+}
+
+func (h *IndexTrashDeleteHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	gracePeriod, err := IndexTrashGracePeriodOption(h.mgr.Options())
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 500)
+		return
+	}
+
+	if req.URL.Query().Get("purge") == "true" {
+		trashed, err := IsTrashed(h.mgr.Cfg(), indexName)
+		if err != nil {
+			rest.ShowError(w, req, err.Error(), 500)
+			return
+		}
+		if trashed != nil {
+			err = PurgeIndex(h.mgr, indexName)
+			if err != nil {
+				rest.ShowError(w, req, err.Error(), 400)
+				return
+			}
+			rest.MustEncode(w, struct {
+				Status string `json:"status"`
+			}{Status: "ok"})
+			return
+		}
+	}
+
+	if gracePeriod <= 0 || req.URL.Query().Get("purge") == "true" {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+
+	trashed, ok, err := TrashIndex(h.mgr, indexName, gracePeriod, time.Now())
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+	if !ok {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status  string `json:"status"`
+		Trashed bool   `json:"trashed"`
+		PurgeAt string `json:"purgeAt"`
+	}{
+		Status:  "ok",
+		Trashed: true,
+		PurgeAt: trashed.PurgeAt,
+	})
+}
+
+// IndexRestoreHandler is a REST handler that takes an index out of
+// the trash.
+type IndexRestoreHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexRestoreHandler(mgr *cbgt.Manager) *IndexRestoreHandler {
+	return &IndexRestoreHandler{mgr: mgr}
+}
+
+func (h *IndexRestoreHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	err := RestoreIndex(h.mgr, mux.Vars(req)["indexName"])
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// IndexTrashHandler is a REST handler that returns the trashed
+// indexes.
+type IndexTrashHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexTrashHandler(mgr *cbgt.Manager) *IndexTrashHandler {
+	return &IndexTrashHandler{mgr: mgr}
+}
+
+func (h *IndexTrashHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	trash, err := CfgGetIndexTrash(h.mgr.Cfg())
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_trash: could not"+
+			" retrieve trash, err: %v", err), 500)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status  string                   `json:"status"`
+		Indexes map[string]*TrashedIndex `json:"indexes"`
+	}{
+		Status:  "ok",
+		Indexes: trash.Indexes,
+	})
+}
@@ -0,0 +1,191 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestIndexTrashGracePeriodOption(t *testing.T) {
+	tests := []struct {
+		v      string
+		exp    time.Duration
+		expErr bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"2h", 2 * time.Hour, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"soon", 0, true},
+	}
+	for _, test := range tests {
+		d, err := IndexTrashGracePeriodOption(
+			map[string]string{"indexTrashGracePeriod": test.v})
+		if (err != nil) != test.expErr || d != test.exp {
+			t.Errorf("v: %q, expected: %v, got: %v, err: %v",
+				test.v, test.exp, d, err)
+		}
+	}
+}
+
+func TestIndexTrash(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	err := mgr.CreateIndex("primary", "src", "", "", "blackhole",
+		"idx", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	err = mgr.CreateIndex("nil", "", "", "", "alias",
+		"aka", `{"targets":{"idx":{}}}`, cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	now := time.Now()
+
+	_, ok, err := TrashIndex(mgr, "aka", time.Hour, now)
+	if err != nil || ok {
+		t.Errorf("expected an alias not trashed, ok: %v, err: %v", ok, err)
+	}
+
+	trashed, ok, err := TrashIndex(mgr, "idx", time.Hour, now)
+	if err != nil || !ok || !trashed.CanRead || !trashed.CanWrite {
+		t.Fatalf("expected trashed, got: %+v, ok: %v, err: %v",
+			trashed, ok, err)
+	}
+
+	_, indexDefsByName, _ := mgr.GetIndexDefs(true)
+	indexDef := indexDefsByName["idx"]
+	np := indexDef.PlanParams.NodePlanParams[""][""]
+	if np == nil || np.CanRead || np.CanWrite ||
+		!indexDef.PlanParams.PlanFrozen {
+		t.Errorf("expected a trashed index disallowed, paused and frozen")
+	}
+
+	r := mux.NewRouter()
+	ok200 := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	r.Handle("/api/index/{indexName}", NewIndexTrashGuardHandler(mgr, ok200))
+
+	for path, exp := range map[string]int{
+		"/api/index/idx": 400,
+		"/api/index/aka": 200,
+	} {
+		req, _ := http.NewRequest("PUT", path, nil)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != exp {
+			t.Errorf("path: %s, expected: %d, got: %d", path, exp, rr.Code)
+		}
+	}
+
+	// Not yet purged during the grace period.
+	err = indexTrashCheck(mgr, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	err = RestoreIndex(mgr, "idx")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if RestoreIndex(mgr, "idx") == nil {
+		t.Errorf("expected err on restoring an untrashed index")
+	}
+
+	_, indexDefsByName, _ = mgr.GetIndexDefs(true)
+	indexDef = indexDefsByName["idx"]
+	np = indexDef.PlanParams.NodePlanParams[""][""]
+	if np != nil && (!np.CanRead || !np.CanWrite) ||
+		indexDef.PlanParams.PlanFrozen {
+		t.Errorf("expected the previous controls restored, got: %+v",
+			indexDef.PlanParams)
+	}
+
+	_, _, err = TrashIndex(mgr, "idx", time.Hour, now)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	err = indexTrashCheck(mgr, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	_, indexDefsByName, _ = mgr.GetIndexDefs(true)
+	if indexDefsByName["idx"] != nil {
+		t.Errorf("expected the index purged after its grace period")
+	}
+	trash, _ := CfgGetIndexTrash(cfg)
+	if len(trash.Indexes) != 0 {
+		t.Errorf("expected an empty trash, got: %+v", trash.Indexes)
+	}
+}
+
+func TestIndexTrashDeleteHandlerOptIn(t *testing.T) {
+	for _, test := range []struct {
+		options    map[string]string
+		expTrashed bool
+	}{
+		{nil, false},
+		{map[string]string{"indexTrashGracePeriod": "0"}, false},
+		{map[string]string{"indexTrashGracePeriod": "1h"}, true},
+	} {
+		emptyDir, _ := ioutil.TempDir("./tmp", "test")
+		defer os.RemoveAll(emptyDir)
+
+		cfg := cbgt.NewCfgMem()
+		mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+			nil, "", 1, "", ":1000", emptyDir, "some-datasource",
+			test.options)
+		mgr.Start("wanted")
+
+		err := mgr.CreateIndex("primary", "src", "", "", "blackhole",
+			"idx", "", cbgt.PlanParams{}, "")
+		if err != nil {
+			t.Fatalf("expected no err, got: %v", err)
+		}
+
+		deleted := false
+		next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			deleted = true
+		})
+
+		r := mux.NewRouter()
+		r.Handle("/api/index/{indexName}", NewIndexTrashDeleteHandler(mgr, next))
+
+		req, _ := http.NewRequest("DELETE", "/api/index/idx", nil)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+
+		trashed, _ := IsTrashed(cfg, "idx")
+		if deleted == test.expTrashed || (trashed != nil) != test.expTrashed {
+			t.Errorf("options: %v, expected trashed: %v, got deleted: %v,"+
+				" trashed: %+v", test.options, test.expTrashed, deleted, trashed)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// An index create/update request may have an optional "expireAfter"
+// TTL, like "72h" or "7d", so that temporary or experimental indexes
+// are deleted automatically once they've been unused, meaning not
+// queried, for longer than the TTL.  The TTLs are kept in the Cfg,
+// along with when each index was last used, which every node
+// refreshes from the queries that it has handled.  The notifier node
+// of the webhooks (see webhooks.go) sends an indexExpiring webhook
+// event, and logs a warning, once an index is unused for
+// IndexTTLWarnFraction of its TTL, and it deletes the index once the
+// index is unused for the whole TTL.  An index update without an
+// expireAfter removes the index's TTL.
+
+// The Cfg key where the index TTLs are kept.
+const INDEX_TTLS_KEY = "indexTTLs"
+
+// How often the index TTLs are checked.
+var IndexTTLCheckInterval = time.Minute
+
+// The fraction of its TTL that an index is unused before the
+// indexExpiring warning.
+var IndexTTLWarnFraction = 0.9
+
+// IndexTTLs is the Cfg entry of all index TTLs.
+type IndexTTLs struct {
+	UUID string `json:"uuid"`
+
+	// Keyed by indexName.
+	Indexes map[string]*IndexTTL `json:"indexes"`
+}
+
+// IndexTTL is the TTL of an index.
+type IndexTTL struct {
+	IndexName   string `json:"indexName"`
+	ExpireAfter string `json:"expireAfter"`
+
+	// When the index was last queried, or else created or updated.
+	LastUsed string `json:"lastUsed"`
+
+	// True once the indexExpiring warning was sent, until the index
+	// is used again.
+	Warned bool `json:"warned,omitempty"`
+}
+
+// ParseExpireAfter parses an expireAfter TTL, which is a Go duration,
+// like "36h", or a number of days, like "7d".
+func ParseExpireAfter(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+
+	if strings.HasSuffix(s, "d") {
+		var days float64
+		days, err = strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		d = time.Duration(days * float64(24*time.Hour))
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("index_ttl: bad expireAfter: %q,"+
+			" should be a positive duration, like \"72h\" or \"7d\"", s)
+	}
+
+	return d, nil
+}
+
+// Times returns when an index will be warned about and when it will
+// expire, if it stays unused.
+func (t *IndexTTL) Times() (warnAt, expireAt time.Time, err error) {
+	ttl, err := ParseExpireAfter(t.ExpireAfter)
+	if err != nil {
+		return warnAt, expireAt, err
+	}
+
+	lastUsed, err := time.Parse(time.RFC3339Nano, t.LastUsed)
+	if err != nil {
+		return warnAt, expireAt, fmt.Errorf("index_ttl: bad lastUsed: %q,"+
+			" index: %s", t.LastUsed, t.IndexName)
+	}
+
+	warnAt = lastUsed.Add(time.Duration(float64(ttl) * IndexTTLWarnFraction))
+
+	return warnAt, lastUsed.Add(ttl), nil
+}
+
+// SetIndexTTL sets or, when expireAfter is "", removes the TTL of an
+// index, whose TTL starts over.
+func SetIndexTTL(cfg cbgt.Cfg, indexName, expireAfter string) error {
+	if expireAfter != "" {
+		_, err := ParseExpireAfter(expireAfter)
+		if err != nil {
+			return err
+		}
+	}
+
+	return updateIndexTTLs(cfg, func(ttls *IndexTTLs) error {
+		if expireAfter == "" {
+			delete(ttls.Indexes, indexName)
+			return nil
+		}
+
+		ttls.Indexes[indexName] = &IndexTTL{
+			IndexName:   indexName,
+			ExpireAfter: expireAfter,
+			LastUsed:    time.Now().Format(time.RFC3339Nano),
+		}
+
+		return nil
+	})
+}
+
+func updateIndexTTLs(cfg cbgt.Cfg, f func(ttls *IndexTTLs) error) error {
+	return CfgUpdateJSON(cfg, INDEX_TTLS_KEY,
+		func() interface{} { return &IndexTTLs{} },
+		func(v interface{}) error {
+			ttls := v.(*IndexTTLs)
+			if ttls.Indexes == nil {
+				ttls.Indexes = map[string]*IndexTTL{}
+			}
+
+			err := f(ttls)
+			if err != nil {
+				return err
+			}
+
+			ttls.UUID = cbgt.NewUUID()
+
+			return nil
+		})
+}
+
+// CfgGetIndexTTLs returns the index TTLs, which are never nil.
+func CfgGetIndexTTLs(cfg cbgt.Cfg) (*IndexTTLs, error) {
+	ttls := &IndexTTLs{}
+	_, _, err := CfgGetJSON(cfg, INDEX_TTLS_KEY, ttls)
+	if err != nil {
+		return nil, err
+	}
+	if ttls.Indexes == nil {
+		ttls.Indexes = map[string]*IndexTTL{}
+	}
+	return ttls, nil
+}
+
+// ---------------------------------------------------------
+
+// IndexTTLStart starts checking the index TTLs periodically.
+func IndexTTLStart(mgr *cbgt.Manager) {
+	go func() {
+		for range time.Tick(IndexTTLCheckInterval) {
+			notifier, err := webhookIsNotifier(mgr.Cfg())
+			if err == nil {
+				err = indexTTLCheck(mgr, notifier, time.Now())
+			}
+			if err != nil {
+				log.Printf("index_ttl: check, err: %v", err)
+			}
+		}
+	}()
+}
+
+// indexTTLCheck refreshes the lastUsed of the indexes with TTLs from
+// the queries of this node and then, on the notifier node, warns
+// about and deletes the unused indexes.
+func indexTTLCheck(mgr *cbgt.Manager, notifier bool, now time.Time) error {
+	cfg := mgr.Cfg()
+
+	ttls, err := CfgGetIndexTTLs(cfg)
+	if err != nil || len(ttls.Indexes) <= 0 {
+		return err
+	}
+
+	used := map[string]time.Time{}
+	for indexName, ttl := range ttls.Indexes {
+		lastQuery := IndexMetricsLastQuery(indexName)
+		if indexTTLUsed(ttl, lastQuery) {
+			used[indexName] = lastQuery
+		}
+	}
+
+	if len(used) > 0 {
+		err = updateIndexTTLs(cfg, func(ttls *IndexTTLs) error {
+			for indexName, lastQuery := range used {
+				if ttl := ttls.Indexes[indexName]; ttl != nil {
+					ttl.LastUsed = lastQuery.Format(time.RFC3339Nano)
+					ttl.Warned = false
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		ttls, err = CfgGetIndexTTLs(cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !notifier {
+		return nil
+	}
+
+	indexDefs, _, err := cbgt.CfgGetIndexDefs(cfg)
+	if err != nil {
+		return err
+	}
+
+	var removed, warned []string
+
+	for indexName, ttl := range ttls.Indexes {
+		if indexDefs == nil || indexDefs.IndexDefs[indexName] == nil {
+			removed = append(removed, indexName)
+			continue
+		}
+
+		warnAt, expireAt, err := ttl.Times()
+		if err != nil {
+			log.Printf("index_ttl: %v", err)
+			continue
+		}
+
+		if !now.Before(expireAt) {
+			log.Printf("index_ttl: deleting index: %s, unused since: %s,"+
+				" expireAfter: %s", indexName, ttl.LastUsed, ttl.ExpireAfter)
+
+			err = mgr.DeleteIndex(indexName)
+			if err != nil {
+				log.Printf("index_ttl: could not delete index: %s, err: %v",
+					indexName, err)
+				continue
+			}
+
+			removed = append(removed, indexName)
+		} else if !now.Before(warnAt) && !ttl.Warned {
+			log.Printf("index_ttl: index: %s will be deleted at: %s,"+
+				" unless it's queried, unused since: %s, expireAfter: %s",
+				indexName, expireAt.Format(time.RFC3339), ttl.LastUsed,
+				ttl.ExpireAfter)
+
+			WebhookNotify(&WebhookEvent{
+				Event:     WEBHOOK_EVENT_INDEX_EXPIRING,
+				IndexName: indexName,
+				IndexUUID: indexDefs.IndexDefs[indexName].UUID,
+				ExpireAt:  expireAt.Format(time.RFC3339Nano),
+			})
+
+			warned = append(warned, indexName)
+		}
+	}
+
+	if len(removed) <= 0 && len(warned) <= 0 {
+		return nil
+	}
+
+	return updateIndexTTLs(cfg, func(ttls *IndexTTLs) error {
+		for _, indexName := range removed {
+			delete(ttls.Indexes, indexName)
+		}
+		for _, indexName := range warned {
+			if ttl := ttls.Indexes[indexName]; ttl != nil {
+				ttl.Warned = true
+			}
+		}
+		return nil
+	})
+}
+
+// indexTTLUsed returns true when a query of this node is recent enough
+// to be recorded as the lastUsed of an index TTL, where, to limit Cfg
+// updates, a query must be at least a tenth of the TTL (and a check
+// interval) after the recorded lastUsed, unless the index was warned.
+func indexTTLUsed(ttl *IndexTTL, lastQuery time.Time) bool {
+	if lastQuery.IsZero() {
+		return false
+	}
+
+	d, err := ParseExpireAfter(ttl.ExpireAfter)
+	if err != nil {
+		return false
+	}
+
+	lastUsed, err := time.Parse(time.RFC3339Nano, ttl.LastUsed)
+	if err != nil {
+		return true
+	}
+
+	if ttl.Warned {
+		return lastQuery.After(lastUsed)
+	}
+
+	minGap := d / 10
+	if minGap < IndexTTLCheckInterval {
+		minGap = IndexTTLCheckInterval
+	}
+
+	return lastQuery.Sub(lastUsed) >= minGap
+}
+
+// ---------------------------------------------------------
+
+// IndexTTLHandler is a REST handler that sets the TTL of an index from
+// the expireAfter of an index create/update request, once the next
+// (usually the index create) handler succeeds.
+type IndexTTLHandler struct {
+	mgr  *cbgt.Manager
+	next http.Handler
+}
+
+func NewIndexTTLHandler(mgr *cbgt.Manager,
+	next http.Handler) *IndexTTLHandler {
+	return &IndexTTLHandler{mgr: mgr, next: next}
+}
+
+func (h *IndexTTLHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	err := req.ParseForm()
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_ttl: could not"+
+			" parse form, err: %v", err), 400)
+		return
+	}
+
+	var requestBody []byte
+	if req.Body != nil {
+		requestBody, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			rest.ShowError(w, req, fmt.Sprintf("index_ttl: could not"+
+				" read request body, err: %v", err), 400)
+			return
+		}
+	}
+
+	expireAfter := req.Form.Get("expireAfter")
+	if expireAfter == "" && len(bytes.TrimSpace(requestBody)) > 0 {
+		var body struct {
+			ExpireAfter string `json:"expireAfter"`
+		}
+		json.Unmarshal(requestBody, &body)
+		expireAfter = body.ExpireAfter
+	}
+
+	if expireAfter != "" {
+		_, err = ParseExpireAfter(expireAfter)
+		if err != nil {
+			rest.ShowError(w, req, err.Error(), 400)
+			return
+		}
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(requestBody))
+	req.ContentLength = int64(len(requestBody))
+
+	sw := &indexTTLResponseWriter{ResponseWriter: w}
+
+	h.next.ServeHTTP(sw, req)
+
+	if sw.status != 0 && sw.status != http.StatusOK {
+		return
+	}
+
+	err = SetIndexTTL(h.mgr.Cfg(), indexName, expireAfter)
+	if err != nil {
+		log.Printf("index_ttl: could not set TTL, index: %s, err: %v",
+			indexName, err)
+	}
+}
+
+// indexTTLResponseWriter records the status of a response.
+type indexTTLResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *indexTTLResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// IndexTTLsHandler is a REST handler that returns the index TTLs, with
+// when each unused index will expire.
+type IndexTTLsHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexTTLsHandler(mgr *cbgt.Manager) *IndexTTLsHandler {
+	return &IndexTTLsHandler{mgr: mgr}
+}
+
+func (h *IndexTTLsHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	ttls, err := CfgGetIndexTTLs(h.mgr.Cfg())
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("index_ttl: could not"+
+			" retrieve index TTLs, err: %v", err), 500)
+		return
+	}
+
+	type indexTTLJSON struct {
+		*IndexTTL
+		ExpireAt string `json:"expireAt,omitempty"`
+	}
+
+	indexes := map[string]*indexTTLJSON{}
+	for indexName, ttl := range ttls.Indexes {
+		rv := &indexTTLJSON{IndexTTL: ttl}
+		_, expireAt, err := ttl.Times()
+		if err == nil {
+			rv.ExpireAt = expireAt.Format(time.RFC3339Nano)
+		}
+		indexes[indexName] = rv
+	}
+
+	rest.MustEncode(w, struct {
+		Status  string                   `json:"status"`
+		Indexes map[string]*indexTTLJSON `json:"indexes"`
+	}{
+		Status:  "ok",
+		Indexes: indexes,
+	})
+}
@@ -0,0 +1,135 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestParseExpireAfter(t *testing.T) {
+	tests := map[string]time.Duration{
+		"36h":  36 * time.Hour,
+		"90m":  90 * time.Minute,
+		"7d":   7 * 24 * time.Hour,
+		"0.5d": 12 * time.Hour,
+	}
+	for s, exp := range tests {
+		d, err := ParseExpireAfter(s)
+		if err != nil || d != exp {
+			t.Errorf("expireAfter: %s, expected: %v, got: %v, err: %v",
+				s, exp, d, err)
+		}
+	}
+
+	for _, s := range []string{"", "x", "7", "-1h", "0d", "d"} {
+		_, err := ParseExpireAfter(s)
+		if err == nil {
+			t.Errorf("expected err on expireAfter: %q", s)
+		}
+	}
+}
+
+func TestIndexTTLUsed(t *testing.T) {
+	lastUsed := time.Now().Add(-10 * 24 * time.Hour)
+	ttl := &IndexTTL{
+		IndexName:   "tmp",
+		ExpireAfter: "20d",
+		LastUsed:    lastUsed.Format(time.RFC3339Nano),
+	}
+
+	if indexTTLUsed(ttl, time.Time{}) {
+		t.Errorf("expected unused without queries")
+	}
+	if indexTTLUsed(ttl, lastUsed.Add(time.Hour)) {
+		t.Errorf("expected a query within a tenth of the TTL ignored")
+	}
+	if !indexTTLUsed(ttl, lastUsed.Add(3*24*time.Hour)) {
+		t.Errorf("expected a later query recorded")
+	}
+
+	ttl.Warned = true
+	if !indexTTLUsed(ttl, lastUsed.Add(time.Hour)) {
+		t.Errorf("expected any later query recorded once warned")
+	}
+}
+
+func TestIndexTTLCheck(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	err := mgr.CreateIndex("nil", "", "", "",
+		"blackhole", "tmp", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	if SetIndexTTL(cfg, "tmp", "soon") == nil {
+		t.Errorf("expected err on a bad expireAfter")
+	}
+
+	err = SetIndexTTL(cfg, "tmp", "10h")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	err = SetIndexTTL(cfg, "gone", "10h")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	now := time.Now()
+
+	// Only the notifier node removes the TTLs of deleted indexes.
+	err = indexTTLCheck(mgr, false, now)
+	ttls, _ := CfgGetIndexTTLs(cfg)
+	if err != nil || len(ttls.Indexes) != 2 {
+		t.Errorf("expected no changes, got: %+v, err: %v", ttls, err)
+	}
+
+	err = indexTTLCheck(mgr, true, now)
+	ttls, _ = CfgGetIndexTTLs(cfg)
+	if err != nil || len(ttls.Indexes) != 1 || ttls.Indexes["tmp"].Warned {
+		t.Errorf("expected the TTL of a deleted index removed, got: %+v,"+
+			" err: %v", ttls, err)
+	}
+
+	err = indexTTLCheck(mgr, true, now.Add(9*time.Hour+30*time.Minute))
+	ttls, _ = CfgGetIndexTTLs(cfg)
+	if err != nil || !ttls.Indexes["tmp"].Warned {
+		t.Errorf("expected a warning, got: %+v, err: %v", ttls, err)
+	}
+
+	err = indexTTLCheck(mgr, true, now.Add(11*time.Hour))
+	ttls, _ = CfgGetIndexTTLs(cfg)
+	if err != nil || len(ttls.Indexes) != 0 {
+		t.Errorf("expected the TTL removed, got: %+v, err: %v", ttls, err)
+	}
+
+	indexDefs, _, _ := cbgt.CfgGetIndexDefs(cfg)
+	if indexDefs != nil && indexDefs.IndexDefs["tmp"] != nil {
+		t.Errorf("expected the expired index deleted")
+	}
+
+	err = SetIndexTTL(cfg, "tmp", "")
+	if err != nil {
+		t.Errorf("expected no err on removing a missing TTL, got: %v", err)
+	}
+}
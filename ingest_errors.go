@@ -0,0 +1,302 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// Each node keeps the ingest errors of each index, like documents
+// that aren't valid JSON or whose fields don't fit the index mapping,
+// summed across the index's pindexes on the node: the error counts
+// per failed operation, and a ring of the most recent failures, with
+// the doc IDs and reasons, which are available via
+// GET /api/index/{indexName}/ingestErrors.
+//
+// An index may also capture the documents that couldn't be indexed
+// into a dead-letter file, so they can be fixed and replayed, via the
+// "deadLetter" of its bleve index params, like...
+//
+//   {"mapping": {...},
+//    "deadLetter": {
+//      "dir": "/var/cbft/dead-letter", // Optional.
+//      "maxBytes": 100000000}}         // Optional.
+//
+// The dead-letter file of an index is "INDEX_NAME.deadletter.json"
+// in the dir, which defaults to a "dead-letter" subdirectory of the
+// node's data dir, where each line is the JSON of an
+// IngestDeadLetter.  When the file reaches maxBytes, it's renamed
+// with a ".1" suffix, replacing any previous one, and a new file is
+// started.
+
+// The max number of recent ingest errors kept per index.
+var IngestErrorsMaxSamples = 100
+
+// The default maxBytes of a dead-letter file.
+var IngestDeadLetterDefaultMaxBytes = int64(100 * 1024 * 1024)
+
+// BleveDeadLetter is the "deadLetter" of the bleve index params.
+type BleveDeadLetter struct {
+	Dir      string `json:"dir,omitempty"`
+	MaxBytes int64  `json:"maxBytes,omitempty"`
+}
+
+// validateBleveDeadLetter checks the deadLetter of the index params.
+func validateBleveDeadLetter(d *BleveDeadLetter) error {
+	if d == nil {
+		return nil
+	}
+	if d.Dir != "" && !filepath.IsAbs(d.Dir) {
+		return fmt.Errorf("dead_letter: dir must be an absolute path,"+
+			" dir: %s", d.Dir)
+	}
+	if d.MaxBytes < 0 {
+		return fmt.Errorf("dead_letter: maxBytes must be >= 0")
+	}
+	return nil
+}
+
+// IngestError is a recent ingest error of an index.
+type IngestError struct {
+	Time      string `json:"time"`
+	Op        string `json:"op"`
+	Partition string `json:"partition"`
+	Key       string `json:"key"`
+	Seq       uint64 `json:"seq"`
+	Reason    string `json:"reason"`
+}
+
+// IngestDeadLetter is a line of a dead-letter file.
+type IngestDeadLetter struct {
+	IngestError
+	Index string `json:"index"`
+	Doc   string `json:"doc"`
+}
+
+// IngestErrors holds the ingest errors of an index on this node.
+type IngestErrors struct {
+	m      sync.Mutex // Protects the fields that follow.
+	counts map[string]uint64
+	recent []*IngestError // A ring of IngestErrorsMaxSamples.
+	next   int            // The next slot of the ring.
+}
+
+var ingestErrorsM sync.Mutex // Protects the fields that follow.
+
+var ingestErrors = map[string]*IngestErrors{} // Keyed by index name.
+
+// IngestErrorsFor returns the IngestErrors of an index, creating them
+// if needed.
+func IngestErrorsFor(indexName string) *IngestErrors {
+	ingestErrorsM.Lock()
+	e := ingestErrors[indexName]
+	if e == nil {
+		e = &IngestErrors{counts: map[string]uint64{}}
+		ingestErrors[indexName] = e
+	}
+	ingestErrorsM.Unlock()
+	return e
+}
+
+func (e *IngestErrors) record(ie *IngestError) {
+	e.m.Lock()
+	e.counts[ie.Op]++
+	if IngestErrorsMaxSamples > 0 {
+		if len(e.recent) < IngestErrorsMaxSamples {
+			e.recent = append(e.recent, ie)
+		} else {
+			e.recent[e.next] = ie
+		}
+		e.next = (e.next + 1) % IngestErrorsMaxSamples
+	}
+	e.m.Unlock()
+}
+
+// Snapshot returns the error counts per op and the recent errors,
+// newest first.
+func (e *IngestErrors) Snapshot() (map[string]uint64, []*IngestError) {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	counts := make(map[string]uint64, len(e.counts))
+	for op, n := range e.counts {
+		counts[op] = n
+	}
+
+	recent := make([]*IngestError, 0, len(e.recent))
+	for i := 1; i <= len(e.recent); i++ {
+		recent = append(recent,
+			e.recent[(e.next-i+len(e.recent))%len(e.recent)])
+	}
+
+	return counts, recent
+}
+
+// ---------------------------------------------------------
+
+// Serializes the writes and rotations of the dead-letter files.
+var ingestDeadLetterM sync.Mutex
+
+// ingestDeadLetterPath returns the path of the dead-letter file of an
+// index.
+func ingestDeadLetterPath(d *BleveDeadLetter,
+	dataDir, indexName string) string {
+	dir := d.Dir
+	if dir == "" {
+		dir = filepath.Join(dataDir, "dead-letter")
+	}
+	return filepath.Join(dir, indexName+".deadletter.json")
+}
+
+// writeDeadLetter appends a document that couldn't be indexed to its
+// dead-letter file.
+func writeDeadLetter(d *BleveDeadLetter, path string,
+	dl *IngestDeadLetter) error {
+	buf, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	maxBytes := d.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = IngestDeadLetterDefaultMaxBytes
+	}
+
+	ingestDeadLetterM.Lock()
+	defer ingestDeadLetterM.Unlock()
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(path)
+	if err == nil && fi.Size() > 0 && fi.Size()+int64(len(buf)) > maxBytes {
+		err = os.Rename(path, path+".1")
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	errc := f.Close()
+	if err != nil {
+		return err
+	}
+	return errc
+}
+
+// recordIngestError tracks an ingest error of a BleveDest, and writes
+// the document, when there is one, to the dead-letter file.
+func (t *BleveDest) recordIngestError(op, partition string,
+	key []byte, seq uint64, val []byte, err error) {
+	ie := &IngestError{
+		Time:      time.Now().Format(time.RFC3339Nano),
+		Op:        op,
+		Partition: partition,
+		Key:       string(key),
+		Seq:       seq,
+		Reason:    fmt.Sprintf("%v", err),
+	}
+
+	t.ingestErrors.record(ie)
+
+	if t.deadLetter == nil || val == nil {
+		return
+	}
+
+	path := ingestDeadLetterPath(t.deadLetter,
+		filepath.Dir(t.path), t.indexName)
+	errw := writeDeadLetter(t.deadLetter, path, &IngestDeadLetter{
+		IngestError: *ie,
+		Index:       t.indexName,
+		Doc:         string(val),
+	})
+	if errw != nil {
+		log.Printf("dead_letter: could not write, path: %s, key: %q,"+
+			" err: %v", path, key, errw)
+	}
+}
+
+// ---------------------------------------------------------
+
+// IngestErrorsHandler is a REST handler that returns the ingest
+// errors of an index on this node.
+type IngestErrorsHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIngestErrorsHandler(mgr *cbgt.Manager) *IngestErrorsHandler {
+	return &IngestErrorsHandler{mgr: mgr}
+}
+
+func (h *IngestErrorsHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	_, indexDefsByName, err := h.mgr.GetIndexDefs(false)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("ingest_errors: could not"+
+			" retrieve index defs, err: %v", err), 500)
+		return
+	}
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil || indexDef.Type != "bleve" {
+		rest.ShowError(w, req, fmt.Sprintf("ingest_errors: not a bleve"+
+			" index, indexName: %s", indexName), 400)
+		return
+	}
+
+	counts, recent := IngestErrorsFor(indexName).Snapshot()
+
+	var total uint64
+	for _, n := range counts {
+		total += n
+	}
+
+	deadLetter := ""
+	if d := bleveIndexParams(h.mgr, indexName).DeadLetter; d != nil {
+		deadLetter = ingestDeadLetterPath(d, h.mgr.DataDir(), indexName)
+	}
+
+	rest.MustEncode(w, struct {
+		Status       string            `json:"status"`
+		IngestErrors uint64            `json:"ingestErrors"`
+		Counts       map[string]uint64 `json:"counts"`
+		Recent       []*IngestError    `json:"recent"`
+		DeadLetter   string            `json:"deadLetter,omitempty"`
+	}{
+		Status:       "ok",
+		IngestErrors: total,
+		Counts:       counts,
+		Recent:       recent,
+		DeadLetter:   deadLetter,
+	})
+}
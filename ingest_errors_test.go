@@ -0,0 +1,248 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestValidateBleveDeadLetter(t *testing.T) {
+	err := ValidateBlevePIndexImpl("bleve", "idx",
+		`{"deadLetter":{"dir":"/var/dead-letter","maxBytes":1000}}`)
+	if err != nil {
+		t.Errorf("expected valid params, got: %v", err)
+	}
+
+	for _, d := range []*BleveDeadLetter{
+		{Dir: "dead-letter"},
+		{MaxBytes: -1},
+	} {
+		if validateBleveDeadLetter(d) == nil {
+			t.Errorf("expected err, deadLetter: %#v", d)
+		}
+	}
+}
+
+func TestIngestErrorsRecent(t *testing.T) {
+	defer func(n int) { IngestErrorsMaxSamples = n }(IngestErrorsMaxSamples)
+	IngestErrorsMaxSamples = 3
+
+	e := &IngestErrors{counts: map[string]uint64{}}
+
+	counts, recent := e.Snapshot()
+	if len(counts) != 0 || len(recent) != 0 {
+		t.Errorf("expected no errors, got: %v, %v", counts, recent)
+	}
+
+	for i := 0; i < 5; i++ {
+		op := "json.Unmarshal"
+		if i%2 == 1 {
+			op = "batch.Index"
+		}
+		e.record(&IngestError{Op: op, Key: fmt.Sprintf("k%d", i)})
+
+		_, recent = e.Snapshot()
+		if recent[0].Key != fmt.Sprintf("k%d", i) {
+			t.Errorf("expected the newest first, got: %v", recent[0])
+		}
+	}
+
+	counts, recent = e.Snapshot()
+	if counts["json.Unmarshal"] != 3 || counts["batch.Index"] != 2 {
+		t.Errorf("unexpected counts: %v", counts)
+	}
+	if len(recent) != 3 || recent[0].Key != "k4" ||
+		recent[1].Key != "k3" || recent[2].Key != "k2" {
+		t.Errorf("expected the 3 most recent errors, got: %v", recent)
+	}
+}
+
+func TestWriteDeadLetter(t *testing.T) {
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	d := &BleveDeadLetter{MaxBytes: 200}
+	path := ingestDeadLetterPath(d, dir, "idx")
+	if path != filepath.Join(dir, "dead-letter", "idx.deadletter.json") {
+		t.Errorf("unexpected path: %s", path)
+	}
+
+	for i := 0; i < 3; i++ {
+		err := writeDeadLetter(d, path, &IngestDeadLetter{
+			IngestError: IngestError{Key: fmt.Sprintf("k%d", i)},
+			Index:       "idx",
+			Doc:         `{"a":"0123456789"}`,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each line is ~130 bytes, so the maxBytes of 200 rotates the file
+	// before each write.
+	for p, exp := range map[string]string{path: "k2", path + ".1": "k1"} {
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dl IngestDeadLetter
+		if err = json.Unmarshal(buf, &dl); err != nil || dl.Key != exp ||
+			dl.Doc != `{"a":"0123456789"}` {
+			t.Errorf("path: %s, expected key: %s, got: %s, err: %v",
+				p, exp, buf, err)
+		}
+	}
+}
+
+func TestIngestErrorsDataUpdate(t *testing.T) {
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	m := bleve.NewIndexMapping()
+	err := json.Unmarshal([]byte(`{"default_mapping": {
+		"properties": {"price": {"fields": [{"type": "number"}]}}}}`), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindex, err := bleve.NewMemOnly(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bdest := NewBleveDest(filepath.Join(dir, "ingestErrors_1234_5678.pindex"),
+		bindex, func() {})
+	bdest.deadLetter = &BleveDeadLetter{}
+	dest := &cbgt.DestForwarder{DestProvider: bdest}
+	defer dest.Close()
+
+	counts, _ := bdest.ingestErrors.Snapshot()
+
+	dest.SnapshotStart("0", 1, 3)
+	for i, val := range []string{
+		`{"price":10}`,
+		`{"price":`,
+		`{"price":{"amount":10}}`,
+	} {
+		err = dest.DataUpdate("0", []byte(fmt.Sprintf("k%d", i)),
+			uint64(i+1), []byte(val), 0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	countsAfter, recent := bdest.ingestErrors.Snapshot()
+	if countsAfter["json.Unmarshal"] != counts["json.Unmarshal"]+1 {
+		t.Errorf("expected a json.Unmarshal error, got: %v", countsAfter)
+	}
+	found := false
+	for _, ie := range recent {
+		if ie.Key == "k0" {
+			t.Errorf("expected no error for the good doc, got: %v", ie)
+		}
+		if ie.Key == "k1" && ie.Seq == 2 && ie.Op == "json.Unmarshal" &&
+			ie.Reason != "" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected an error for the bad json, got: %v", recent)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "dead-letter",
+		"ingestErrors.deadletter.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	docs := map[string]string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var dl IngestDeadLetter
+		if err = json.Unmarshal(s.Bytes(), &dl); err != nil {
+			t.Fatal(err)
+		}
+		if dl.Index != "ingestErrors" || dl.Partition != "0" {
+			t.Errorf("unexpected dead letter: %s", s.Bytes())
+		}
+		docs[dl.Key] = dl.Doc
+	}
+	if len(docs) != len(recent) || docs["k1"] != `{"price":` {
+		t.Errorf("expected the failed docs in the dead letter file,"+
+			" got: %v, recent: %v", docs, recent)
+	}
+}
+
+func TestIngestErrorsHandler(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	err := mgr.CreateIndex("nil", "", "", "",
+		"bleve", "ingestErrorsIdx", `{"deadLetter":{"dir":"/dl"}}`,
+		cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	IngestErrorsFor("ingestErrorsIdx").record(&IngestError{
+		Op: "batch.Index", Key: "k0", Reason: "oops"})
+
+	mr, _ := cbgt.NewMsgRing(os.Stderr, 1000)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", mr)
+	if err != nil || router == nil {
+		t.Errorf("no mux router")
+	}
+
+	tests := []*RESTHandlerTest{
+		{
+			Desc:   "ingest errors of a missing index",
+			Path:   "/api/index/not-an-index/ingestErrors",
+			Method: "GET",
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`not a bleve index`: true,
+			},
+		},
+		{
+			Desc:   "ingest errors of an index",
+			Path:   "/api/index/ingestErrorsIdx/ingestErrors",
+			Method: "GET",
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"ingestErrors":1`:           true,
+				`"counts":{"batch.Index":1}`: true,
+				`"key":"k0"`:                 true,
+				`"reason":"oops"`:            true,
+				`"deadLetter":"/dl/ingestErrorsIdx.deadletter.json"`: true,
+			},
+		},
+	}
+
+	testRESTHandlers(t, tests, router)
+}
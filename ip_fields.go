@@ -0,0 +1,184 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+)
+
+// A field of a bleve index mapping can have the "ip" type, like...
+//
+//   "properties": {
+//     "src_ip": {"fields": [{"name": "src_ip", "type": "ip"}]}}
+//
+// An ip field is indexed as a keyword field whose single term is the
+// address as 32 hex digits, where IPv4 addresses are first mapped
+// into IPv6 (::ffff:a.b.c.d), so that every CIDR block is a prefix of
+// the terms, and CIDR queries, like...
+//
+//   {"field": "src_ip", "cidr": "10.42.0.0/16"}
+//
+// are converted server-side before query execution into prefix
+// queries, where a CIDR block whose prefix length isn't a multiple of
+// 4 bits needs a disjunction of at most 8 prefix queries.  A "cidr"
+// without a prefix length, like "10.42.1.5", matches that single
+// address.  As documents are ingested, the values of ip fields, or of
+// the elements of arrays at those paths, are converted into their
+// terms, and a value that isn't an IP address is removed from its
+// document and reported as an ingest error of the index.
+
+// The field type of ip fields in bleve index mappings.
+const IP_FIELD_TYPE = "ip"
+
+// The analyzer of ip fields, so each value is a single term.
+const IP_FIELD_ANALYZER = "keyword"
+
+// applyIPFields converts the ip field mappings of an index mapping
+// into keyword text field mappings, returning the sorted paths of the
+// ip fields.
+func applyIPFields(m *bleve.IndexMapping) ([]string, error) {
+	return applyKeywordFieldType(m, IP_FIELD_TYPE, IP_FIELD_ANALYZER)
+}
+
+// ipTerm returns the indexed term of an IP address.
+func ipTerm(s string) (string, bool) {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil {
+		return "", false
+	}
+	return hex.EncodeToString(ip.To16()), true
+}
+
+// ipFieldsApply replaces the values of the ip fields of a parsed JSON
+// document with their terms, returning the errors of the values that
+// aren't IP addresses, which are removed from the document.
+func ipFieldsApply(m map[string]interface{}, fields []string) []error {
+	var errs []error
+
+	for _, field := range fields {
+		convert := func(v interface{}) interface{} {
+			s, ok := v.(string)
+			if ok {
+				var term string
+				if term, ok = ipTerm(s); ok {
+					return term
+				}
+			}
+			errs = append(errs, fmt.Errorf("ip_fields: not an IP address,"+
+				" field: %s, value: %v", field, v))
+			return nil
+		}
+
+		walkFieldValues(m, field, convert)
+	}
+
+	return errs
+}
+
+// cidrPrefixes returns the term prefixes that cover a CIDR block, or
+// a single IP address.
+func cidrPrefixes(cidr string) ([]string, error) {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		term, ok := ipTerm(cidr)
+		if !ok {
+			return nil, fmt.Errorf("ip_fields: not an IP address: %q", cidr)
+		}
+		return []string{term}, nil
+	}
+
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("ip_fields: could not parse cidr: %q,"+
+			" err: %v", cidr, err)
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	if bits == 8*net.IPv4len {
+		ones += 8 * (net.IPv6len - net.IPv4len)
+	}
+
+	ip := ipnet.IP.To16()
+	base := hex.EncodeToString(ip)
+
+	nibbles, rem := ones/4, uint(ones%4)
+	if rem == 0 {
+		return []string{base[:nibbles]}, nil
+	}
+
+	// The block's first nibble after the whole nibbles of the prefix,
+	// whose low bits are zero, is followed by the nibbles that have
+	// the same high bits.
+	first := (ip[nibbles/2] >> (4 * uint(1-nibbles%2))) & 0x0f
+
+	n := 1 << (4 - rem)
+	rv := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		rv = append(rv, fmt.Sprintf("%s%x", base[:nibbles], int(first)+i))
+	}
+	return rv, nil
+}
+
+// rewriteCIDRQueries converts the CIDR queries in a JSON search
+// request into prefix queries on the terms of ip fields.
+func rewriteCIDRQueries(req []byte) ([]byte, error) {
+	return rewriteQueryRequest(req, func(q map[string]interface{}) (
+		interface{}, error) {
+		v, exists := q["cidr"]
+		if !exists {
+			return nil, nil
+		}
+		cidr, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("ip_fields: cidr must be a string,"+
+				" cidr: %v", v)
+		}
+		field, _ := q["field"].(string)
+		if field == "" {
+			return nil, fmt.Errorf("ip_fields: cidr query needs a field,"+
+				" cidr: %s", cidr)
+		}
+
+		prefixes, err := cidrPrefixes(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%v, field: %s", err, field)
+		}
+
+		queries := make([]interface{}, 0, len(prefixes))
+		for _, prefix := range prefixes {
+			k := "prefix"
+			if len(prefix) == 2*net.IPv6len {
+				k = "term"
+			}
+			queries = append(queries, map[string]interface{}{
+				k:       prefix,
+				"field": field,
+			})
+		}
+
+		var rv map[string]interface{}
+		if len(queries) == 1 {
+			rv = queries[0].(map[string]interface{})
+		} else {
+			rv = map[string]interface{}{"disjuncts": queries, "min": 1}
+		}
+		if boost, exists := q["boost"]; exists {
+			rv["boost"] = boost
+		}
+		return rv, nil
+	})
+}
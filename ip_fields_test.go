@@ -0,0 +1,272 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func ipFieldsTestMapping(t *testing.T) *bleve.IndexMapping {
+	m := bleve.NewIndexMapping()
+	err := json.Unmarshal([]byte(`{
+		"default_mapping": {
+			"properties": {
+				"src_ip": {"fields": [{"name": "src_ip", "type": "ip",
+					"index": true}]},
+				"hops": {"properties": {
+					"addr": {"fields": [{"name": "addr", "type": "ip",
+						"index": true}]}}}
+			}
+		}
+	}`), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestApplyIPFields(t *testing.T) {
+	m := ipFieldsTestMapping(t)
+
+	paths, err := applyIPFields(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{"hops.addr", "src_ip"}) {
+		t.Errorf("unexpected ip field paths: %v", paths)
+	}
+
+	fm := m.DefaultMapping.Properties["src_ip"].Fields[0]
+	if fm.Type != "text" || fm.Analyzer != IP_FIELD_ANALYZER ||
+		fm.IncludeInAll {
+		t.Errorf("expected a keyword field mapping, got: %#v", fm)
+	}
+
+	err = ValidateBlevePIndexImpl("bleve", "idx", `{"mapping":{
+		"default_mapping":{"properties":{"src_ip":{"fields":[
+			{"name":"src_ip","type":"ip"}]}}}}}`)
+	if err != nil {
+		t.Errorf("expected valid params, got: %v", err)
+	}
+
+	paths, err = applyIPFields(bleve.NewIndexMapping())
+	if err != nil || paths != nil {
+		t.Errorf("expected no ip fields, got: %v, err: %v", paths, err)
+	}
+}
+
+func TestIPFieldsApply(t *testing.T) {
+	m := map[string]interface{}{
+		"src_ip": "10.42.1.5",
+		"hops": map[string]interface{}{
+			"addr": []interface{}{"2001:db8::1", "nope", 7.0},
+		},
+	}
+	errs := ipFieldsApply(m, []string{"hops.addr", "src_ip"})
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), "nope") {
+		t.Errorf("expected errs for the bad addresses, got: %v", errs)
+	}
+	if m["src_ip"] != "00000000000000000000ffff0a2a0105" {
+		t.Errorf("unexpected ipv4 term: %v", m["src_ip"])
+	}
+	addrs := nestedGet(m, "hops.addr").([]interface{})
+	if len(addrs) != 1 || addrs[0] != "20010db8000000000000000000000001" {
+		t.Errorf("unexpected ipv6 terms: %v", addrs)
+	}
+
+	var v map[string]interface{}
+	json.Unmarshal([]byte(`{"hops":[{"addr":"::1"},{"addr":["::2","x"]},`+
+		`{"other":1}],"src_ip":null}`), &v)
+	errs = ipFieldsApply(v, []string{"hops.addr", "src_ip"})
+	buf, _ := json.Marshal(v)
+	if len(errs) != 1 || string(buf) != `{"hops":[`+
+		`{"addr":"00000000000000000000000000000001"},`+
+		`{"addr":["00000000000000000000000000000002"]},`+
+		`{"other":1}],"src_ip":null}` {
+		t.Errorf("unexpected arrays of objects: %s, errs: %v", buf, errs)
+	}
+
+	m = map[string]interface{}{"src_ip": "10.42.1.256"}
+	errs = ipFieldsApply(m, []string{"src_ip"})
+	if len(errs) != 1 || m["src_ip"] != nil {
+		t.Errorf("expected the bad address to be removed, got: %v", m)
+	}
+}
+
+func TestCIDRPrefixes(t *testing.T) {
+	tests := map[string][]string{
+		"10.42.0.0/16": {"00000000000000000000ffff0a2a"},
+		"10.42.7.9/16": {"00000000000000000000ffff0a2a"},
+		"10.42.128.0/19": {
+			"00000000000000000000ffff0a2a8", "00000000000000000000ffff0a2a9",
+		},
+		"10.40.0.0/14": {
+			"00000000000000000000ffff0a28", "00000000000000000000ffff0a29",
+			"00000000000000000000ffff0a2a", "00000000000000000000ffff0a2b",
+		},
+		"10.42.1.5":     {"00000000000000000000ffff0a2a0105"},
+		"10.42.1.5/32":  {"00000000000000000000ffff0a2a0105"},
+		"2001:db8::/32": {"20010db8"},
+		"2001:db8::/33": {
+			"20010db80", "20010db81", "20010db82", "20010db83",
+			"20010db84", "20010db85", "20010db86", "20010db87",
+		},
+		"::ffff:0:0/96": {"00000000000000000000ffff"},
+		"172.16.0.0/12": {"00000000000000000000ffffac1"},
+		"192.168.0.0/23": {
+			"00000000000000000000ffffc0a800", "00000000000000000000ffffc0a801",
+		},
+	}
+	for cidr, exp := range tests {
+		prefixes, err := cidrPrefixes(cidr)
+		if err != nil || !reflect.DeepEqual(prefixes, exp) {
+			t.Errorf("cidr: %s, expected: %v, got: %v, err: %v",
+				cidr, exp, prefixes, err)
+		}
+	}
+
+	for _, cidr := range []string{"10.42.0.0/33", "10.42", "host/8"} {
+		if _, err := cidrPrefixes(cidr); err == nil {
+			t.Errorf("expected err, cidr: %s", cidr)
+		}
+	}
+}
+
+func TestRewriteCIDRQueries(t *testing.T) {
+	req := []byte(`{"query":{"conjuncts":[{"match":"denied","field":"msg"},` +
+		`{"cidr":"10.42.0.0/15","field":"src_ip","boost":2}]},"size":5}`)
+
+	out, err := rewriteCIDRQueries(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v struct {
+		Query struct {
+			Conjuncts []map[string]interface{} `json:"conjuncts"`
+		} `json:"query"`
+	}
+	json.Unmarshal(out, &v)
+
+	exp := map[string]interface{}{
+		"disjuncts": []interface{}{
+			map[string]interface{}{
+				"prefix": "00000000000000000000ffff0a2a", "field": "src_ip"},
+			map[string]interface{}{
+				"prefix": "00000000000000000000ffff0a2b", "field": "src_ip"},
+		},
+		"min":   1.0,
+		"boost": 2.0,
+	}
+	if len(v.Query.Conjuncts) != 2 ||
+		!reflect.DeepEqual(v.Query.Conjuncts[1], exp) {
+		t.Errorf("unexpected rewrite: %s", out)
+	}
+
+	out, err = rewriteCIDRQueries([]byte(`{"query":{"match":"x"}}`))
+	if err != nil || string(out) != `{"query":{"match":"x"}}` {
+		t.Errorf("expected no rewrite, got: %s, err: %v", out, err)
+	}
+
+	for _, req := range []string{
+		`{"query":{"cidr":"10.42.0.0/16"}}`,
+		`{"query":{"cidr":"10.42.0.0/99","field":"src_ip"}}`,
+		`{"query":{"cidr":16,"field":"src_ip"}}`,
+	} {
+		if _, err = rewriteCIDRQueries([]byte(req)); err == nil {
+			t.Errorf("expected err, req: %s", req)
+		}
+	}
+}
+
+func TestIPFieldsDataUpdate(t *testing.T) {
+	m := ipFieldsTestMapping(t)
+	ipFields, err := applyIPFields(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bindex, err := bleve.NewMemOnly(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bdest := NewBleveDest("/tmp/ipFields_1234_5678.pindex", bindex,
+		func() {})
+	bdest.ipFields = ipFields
+	dest := &cbgt.DestForwarder{DestProvider: bdest}
+	defer dest.Close()
+
+	docs := map[string]string{
+		"a": `{"src_ip":"10.42.1.5"}`,
+		"b": `{"src_ip":"10.43.200.1"}`,
+		"c": `{"src_ip":"10.44.0.1","hops":[{"addr":"10.42.9.9"}]}`,
+		"d": `{"src_ip":"2001:db8::1"}`,
+		"e": `{"src_ip":"not-an-ip"}`,
+	}
+
+	dest.SnapshotStart("0", 1, uint64(len(docs)))
+	seq := uint64(0)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		seq++
+		err = dest.DataUpdate("0", []byte(key), seq, []byte(docs[key]),
+			0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string][]string{
+		`{"cidr":"10.42.0.0/16","field":"src_ip"}`:    {"a"},
+		`{"cidr":"10.42.0.0/15","field":"src_ip"}`:    {"a", "b"},
+		`{"cidr":"10.0.0.0/8","field":"src_ip"}`:      {"a", "b", "c"},
+		`{"cidr":"10.42.1.5","field":"src_ip"}`:       {"a"},
+		`{"cidr":"10.42.0.0/16","field":"hops.addr"}`: {"c"},
+		`{"cidr":"2001:db8::/32","field":"src_ip"}`:   {"d"},
+	}
+	for q, exp := range tests {
+		req, err := rewriteCIDRQueries(
+			[]byte(`{"query":` + q + `,"size":10}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr := &bleve.SearchRequest{}
+		if err = json.Unmarshal(req, sr); err != nil {
+			t.Fatal(err)
+		}
+		res, err := bindex.Search(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, hit := range res.Hits {
+			ids = append(ids, hit.ID)
+		}
+		sort.Strings(ids)
+		if !reflect.DeepEqual(ids, exp) {
+			t.Errorf("query: %s, expected: %v, got: %v", q, exp, ids)
+		}
+	}
+
+	counts, _ := bdest.ingestErrors.Snapshot()
+	if counts["ipFields"] != 1 {
+		t.Errorf("expected an ipFields ingest error, got: %v", counts)
+	}
+}
@@ -0,0 +1,445 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A node can authenticate requests by their JWT bearer tokens, as
+// issued by an OAuth2 / OpenID Connect provider, where the tokens are
+// signed either with the shared secret of the "jwtSecretFile" node
+// option (HS256, HS384, HS512), or with the keys of the JWKS of the
+// "jwtJWKSURL" node option (RS256, RS384, RS512, ES256, ES384,
+// ES512).  Tokens need an "exp" claim, and the optional "jwtIssuer"
+// and "jwtAudience" node options check the "iss" and "aud" claims.
+//
+// The roles of a token (see auth.go) come from the claim of the
+// "jwtRolesClaim" node option (default "roles"), which can be a
+// dotted path, like "realm_access.roles", and which is an array or a
+// space-separated string, like a "scope" claim.  Claim values that
+// are role names are roles, unless the "jwtRoleMap" node option is
+// the path of a JSON file that maps claim values to roles...
+//
+//   {
+//     "search:read": ["search"],
+//     "search:admin": ["admin"]
+//   }
+
+// JWTLeeway is the allowed clock skew of the "exp" and "nbf" claims.
+var JWTLeeway = 60 * time.Second
+
+// JWKSTimeout is the timeout of the requests of the JWKS.
+var JWKSTimeout = 10 * time.Second
+
+// JWKSRefreshInterval is how often the JWKS is refreshed.
+var JWKSRefreshInterval = time.Hour
+
+// JWKSRefreshMinInterval limits the JWKS refreshes that are due to
+// tokens with unknown key ID's.
+var JWKSRefreshMinInterval = time.Minute
+
+type jwtAuth struct {
+	secret     []byte
+	jwks       *jwtKeySet
+	issuer     string
+	audience   string
+	rolesClaim []string
+	roleMap    map[string][]string
+}
+
+// The hashes of the supported JWT signature algorithms.
+var jwtAlgHashes = map[string]crypto.Hash{
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// NewJWTAuthenticator returns the Authenticator of the bearer tokens
+// of requests, or nil when the node doesn't have JWT node options.
+func NewJWTAuthenticator(options map[string]string) (Authenticator, error) {
+	secretFile, jwksURL := options["jwtSecretFile"], options["jwtJWKSURL"]
+	if secretFile == "" && jwksURL == "" {
+		return nil, nil
+	}
+	if secretFile != "" && jwksURL != "" {
+		return nil, fmt.Errorf("jwt_auth: jwtSecretFile and jwtJWKSURL" +
+			" are exclusive")
+	}
+
+	a := &jwtAuth{
+		issuer:     options["jwtIssuer"],
+		audience:   options["jwtAudience"],
+		rolesClaim: []string{"roles"},
+	}
+
+	if options["jwtRolesClaim"] != "" {
+		a.rolesClaim = strings.Split(options["jwtRolesClaim"], ".")
+	}
+
+	if secretFile != "" {
+		buf, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return nil, fmt.Errorf("jwt_auth: jwtSecretFile, err: %v", err)
+		}
+		a.secret = []byte(strings.TrimSpace(string(buf)))
+		if len(a.secret) < 32 {
+			return nil, fmt.Errorf("jwt_auth: jwtSecretFile, the secret" +
+				" needs at least 32 bytes")
+		}
+	}
+
+	if jwksURL != "" {
+		a.jwks = &jwtKeySet{
+			url:    jwksURL,
+			client: &http.Client{Timeout: JWKSTimeout},
+		}
+		err := a.jwks.refresh()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if roleMapFile := options["jwtRoleMap"]; roleMapFile != "" {
+		buf, err := ioutil.ReadFile(roleMapFile)
+		if err != nil {
+			return nil, fmt.Errorf("jwt_auth: jwtRoleMap, err: %v", err)
+		}
+
+		err = json.Unmarshal(buf, &a.roleMap)
+		if err != nil {
+			return nil, fmt.Errorf("jwt_auth: could not parse jwtRoleMap,"+
+				" err: %v", err)
+		}
+
+		for value, roles := range a.roleMap {
+			for _, role := range roles {
+				if _, exists := AuthRoles[role]; !exists {
+					return nil, fmt.Errorf("jwt_auth: jwtRoleMap,"+
+						" value: %s, unknown role: %s", value, role)
+				}
+			}
+		}
+	}
+
+	return a.authenticate, nil
+}
+
+func (a *jwtAuth) authenticate(req *http.Request) (*AuthIdentity, error) {
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) < 7 ||
+		!strings.EqualFold(authorization[:7], "Bearer ") {
+		return nil, nil
+	}
+
+	claims, err := a.verify(strings.TrimSpace(authorization[7:]), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	user, _ := claims["sub"].(string)
+
+	return &AuthIdentity{User: user, Roles: a.roles(claims), Source: "jwt"},
+		nil
+}
+
+// verify returns the claims of a token, after checking its signature
+// and its standard claims.
+func (a *jwtAuth) verify(token string, now time.Time) (
+	map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("jwt: malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := jwtDecodeJSON(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: malformed header, err: %v", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jwt: malformed signature")
+	}
+
+	hash, exists := jwtAlgHashes[header.Alg]
+	if !exists {
+		return nil, fmt.Errorf("jwt: unsupported alg: %q", header.Alg)
+	}
+
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(header.Alg, "HS"):
+		if a.secret == nil {
+			return nil, fmt.Errorf("jwt: unexpected alg: %s", header.Alg)
+		}
+		mac := hmac.New(hash.New, a.secret)
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, fmt.Errorf("jwt: bad signature")
+		}
+
+	default:
+		if a.jwks == nil {
+			return nil, fmt.Errorf("jwt: unexpected alg: %s", header.Alg)
+		}
+		key := a.jwks.key(header.Kid)
+		if key == nil {
+			return nil, fmt.Errorf("jwt: unknown kid: %q", header.Kid)
+		}
+		if !jwtVerifySig(header.Alg, key, hash, digest, sig) {
+			return nil, fmt.Errorf("jwt: bad signature")
+		}
+	}
+
+	claims := map[string]interface{}{}
+	err = jwtDecodeJSON(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: malformed claims, err: %v", err)
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("jwt: no exp claim")
+	}
+	if now.Add(-JWTLeeway).Unix() > int64(exp) {
+		return nil, fmt.Errorf("jwt: token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok &&
+		now.Add(JWTLeeway).Unix() < int64(nbf) {
+		return nil, fmt.Errorf("jwt: token not valid yet")
+	}
+
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return nil, fmt.Errorf("jwt: wrong iss: %v", claims["iss"])
+	}
+
+	if a.audience != "" && !jwtHasAudience(claims["aud"], a.audience) {
+		return nil, fmt.Errorf("jwt: wrong aud: %v", claims["aud"])
+	}
+
+	return claims, nil
+}
+
+// roles returns the roles of the roles claim of a token.
+func (a *jwtAuth) roles(claims map[string]interface{}) []string {
+	var v interface{} = claims
+	for _, name := range a.rolesClaim {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[name]
+	}
+
+	var values []string
+	switch x := v.(type) {
+	case string:
+		values = strings.Fields(x)
+	case []interface{}:
+		for _, item := range x {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	var roles []string
+	for _, value := range values {
+		if a.roleMap != nil {
+			roles = append(roles, a.roleMap[value]...)
+		} else if _, exists := AuthRoles[value]; exists {
+			roles = append(roles, value)
+		}
+	}
+
+	return roles
+}
+
+func jwtHasAudience(aud interface{}, audience string) bool {
+	switch x := aud.(type) {
+	case string:
+		return x == audience
+	case []interface{}:
+		for _, item := range x {
+			if item == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func jwtDecodeJSON(part string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+func jwtVerifySig(alg string, key crypto.PublicKey, hash crypto.Hash,
+	digest, sig []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") &&
+			rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+
+	return false
+}
+
+// ------------------------------------------------------------------
+
+// jwtKeySet is the cached JWKS of a URL.
+type jwtKeySet struct {
+	url    string
+	client *http.Client
+
+	m         sync.Mutex // Protects the fields that follow.
+	keys      map[string]crypto.PublicKey
+	refreshed time.Time
+}
+
+// key returns the public key of a key ID, refreshing the JWKS when
+// it's stale or when the key ID is unknown.
+func (ks *jwtKeySet) key(kid string) crypto.PublicKey {
+	ks.m.Lock()
+	key, exists := ks.keys[kid]
+	since := time.Since(ks.refreshed)
+	ks.m.Unlock()
+
+	if (!exists && since > JWKSRefreshMinInterval) ||
+		since > JWKSRefreshInterval {
+		err := ks.refresh()
+		if err != nil {
+			LogDebugf(LOG_CATEGORY_REST, "jwt_auth: %v", err)
+		}
+
+		ks.m.Lock()
+		key = ks.keys[kid]
+		ks.m.Unlock()
+	}
+
+	return key
+}
+
+func (ks *jwtKeySet) refresh() error {
+	ks.m.Lock()
+	ks.refreshed = time.Now() // Also limits the retries of failures.
+	ks.m.Unlock()
+
+	resp, err := ks.client.Get(ks.url)
+	if err != nil {
+		return fmt.Errorf("jwt_auth: jwtJWKSURL, err: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("jwt_auth: jwtJWKSURL, status code: %d",
+			resp.StatusCode)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&jwks)
+	if err != nil {
+		return fmt.Errorf("jwt_auth: could not parse jwtJWKSURL, err: %v", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil || len(e) > 4 {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+
+		case "EC":
+			curve := map[string]elliptic.Curve{
+				"P-256": elliptic.P256(),
+				"P-384": elliptic.P384(),
+				"P-521": elliptic.P521(),
+			}[k.Crv]
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if curve == nil || err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+
+	ks.m.Lock()
+	ks.keys = keys
+	ks.m.Unlock()
+
+	LogDebugf(LOG_CATEGORY_REST, "jwt_auth: refreshed jwks, url: %s,"+
+		" keys: %d", ks.url, len(keys))
+
+	return nil
+}
@@ -0,0 +1,286 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testJWT(t *testing.T, alg, kid string, key interface{},
+	claims map[string]interface{}) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	body, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(body)
+
+	hash := jwtAlgHashes[alg]
+	if hash == 0 {
+		return signed + "."
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[size-len(rb):size], rb)
+		copy(sig[2*size-len(sb):], sb)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + b64(sig)
+}
+
+func TestJWTSecret(t *testing.T) {
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	ioutil.WriteFile(filepath.Join(dir, "secret"), secret, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "short"), []byte("short"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "rolemap.json"), []byte(`{
+		"search:read": ["search"],
+		"search:admin": ["admin"]
+	}`), 0600)
+
+	restAuth, err := NewRESTAuth(map[string]string{
+		"jwtSecretFile": filepath.Join(dir, "secret"),
+		"jwtIssuer":     "https://idp.test",
+		"jwtAudience":   "cbft",
+		"jwtRolesClaim": "scope",
+		"jwtRoleMap":    filepath.Join(dir, "rolemap.json"),
+	})
+	if err != nil || !restAuth.Enabled() {
+		t.Fatalf("expected an enabled rest auth, err: %v", err)
+	}
+
+	h := restAuth.Handler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	claims := func(kvs ...interface{}) map[string]interface{} {
+		m := map[string]interface{}{
+			"sub":   "app",
+			"iss":   "https://idp.test",
+			"aud":   []interface{}{"other", "cbft"},
+			"exp":   exp,
+			"scope": "openid search:read",
+		}
+		for i := 0; i+1 < len(kvs); i += 2 {
+			if kvs[i+1] == nil {
+				delete(m, kvs[i].(string))
+			} else {
+				m[kvs[i].(string)] = kvs[i+1]
+			}
+		}
+		return m
+	}
+
+	tests := []struct {
+		token  string
+		method string
+		path   string
+		exp    int
+	}{
+		{testJWT(t, "HS256", "", secret, claims()),
+			"POST", "/api/index/x/query", 200},
+		{testJWT(t, "HS512", "", secret, claims()),
+			"POST", "/api/index/x/query", 200},
+		{testJWT(t, "HS256", "", secret, claims()),
+			"GET", "/api/index", 403},
+		{testJWT(t, "HS256", "", secret, claims("scope", "search:admin")),
+			"DELETE", "/api/index/x", 200},
+		{testJWT(t, "HS256", "", []byte("wrong-secret"), claims()),
+			"POST", "/api/index/x/query", 401},
+		{testJWT(t, "none", "", nil, claims()),
+			"POST", "/api/index/x/query", 401},
+		{testJWT(t, "HS256", "", secret, claims("exp", exp-2*3600)),
+			"POST", "/api/index/x/query", 401},
+		{testJWT(t, "HS256", "", secret, claims("exp", nil)),
+			"POST", "/api/index/x/query", 401},
+		{testJWT(t, "HS256", "", secret, claims("nbf", exp)),
+			"POST", "/api/index/x/query", 401},
+		{testJWT(t, "HS256", "", secret, claims("iss", "https://evil")),
+			"POST", "/api/index/x/query", 401},
+		{testJWT(t, "HS256", "", secret, claims("aud", "other")),
+			"POST", "/api/index/x/query", 401},
+		{"not-a-token", "POST", "/api/index/x/query", 401},
+		{"", "POST", "/api/index/x/query", 401},
+	}
+
+	for i, test := range tests {
+		req, _ := http.NewRequest(test.method, "http://x"+test.path, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		record := httptest.NewRecorder()
+		h.ServeHTTP(record, req)
+		if record.Code != test.exp {
+			t.Errorf("%d: %s %s, expected: %d, got: %d, body: %s",
+				i, test.method, test.path, test.exp, record.Code,
+				record.Body.String())
+		}
+	}
+
+	for _, options := range []map[string]string{
+		{"jwtSecretFile": filepath.Join(dir, "short")},
+		{"jwtSecretFile": filepath.Join(dir, "missing")},
+		{"jwtSecretFile": filepath.Join(dir, "secret"),
+			"jwtJWKSURL": "http://127.0.0.1:1/jwks"},
+	} {
+		_, err = NewJWTAuthenticator(options)
+		if err == nil {
+			t.Errorf("expected err, options: %v", options)
+		}
+	}
+}
+
+func TestJWTRoles(t *testing.T) {
+	a := &jwtAuth{rolesClaim: []string{"realm_access", "roles"}}
+
+	roles := a.roles(map[string]interface{}{
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"search", "offline_access", "monitor", 1},
+		},
+	})
+	if !reflect.DeepEqual(roles, []string{"search", "monitor"}) {
+		t.Errorf("expected role names, got: %v", roles)
+	}
+
+	roles = a.roles(map[string]interface{}{"realm_access": "search"})
+	if roles != nil {
+		t.Errorf("expected no roles, got: %v", roles)
+	}
+}
+
+func TestJWTJWKS(t *testing.T) {
+	defer func(d time.Duration) { JWKSRefreshMinInterval = d }(
+		JWKSRefreshMinInterval)
+	JWKSRefreshMinInterval = 0
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rotatedKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	b64 := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	ecJWK := func(kid, crv string, k *ecdsa.PrivateKey) map[string]string {
+		return map[string]string{"kty": "EC", "kid": kid, "crv": crv,
+			"x": b64(k.X.Bytes()), "y": b64(k.Y.Bytes())}
+	}
+
+	var m sync.Mutex
+	keys := []map[string]string{
+		{"kty": "RSA", "kid": "r1", "use": "sig",
+			"n": b64(rsaKey.N.Bytes()),
+			"e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		ecJWK("e1", "P-256", ecKey),
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			m.Lock()
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+			m.Unlock()
+		}))
+	defer s.Close()
+
+	authenticate, err := NewJWTAuthenticator(map[string]string{
+		"jwtJWKSURL": s.URL,
+	})
+	if err != nil || authenticate == nil {
+		t.Fatalf("expected an authenticator, err: %v", err)
+	}
+
+	claims := map[string]interface{}{
+		"sub":   "svc",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"roles": []string{"admin"},
+	}
+
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	tests := []struct {
+		token string
+		ok    bool
+	}{
+		{testJWT(t, "RS256", "r1", rsaKey, claims), true},
+		{testJWT(t, "ES256", "e1", ecKey, claims), true},
+		{testJWT(t, "ES256", "r1", ecKey, claims), false},
+		{testJWT(t, "RS256", "e1", rsaKey, claims), false},
+		{testJWT(t, "ES256", "e1", rotatedKey, claims), false},
+		{testJWT(t, "HS256", "r1", secret, claims), false},
+		{testJWT(t, "ES384", "e2", rotatedKey, claims), false},
+	}
+
+	for i, test := range tests {
+		req, _ := http.NewRequest("GET", "http://x/api/index", nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		identity, err := authenticate(req)
+		if test.ok != (err == nil && identity != nil) {
+			t.Errorf("%d: expected ok: %v, got: %v, err: %v",
+				i, test.ok, identity, err)
+		}
+		if test.ok && (identity.User != "svc" ||
+			!reflect.DeepEqual(identity.Roles, []string{"admin"})) {
+			t.Errorf("%d: expected svc admin, got: %#v", i, identity)
+		}
+	}
+
+	// A rotated key is fetched when its kid is unknown.
+	m.Lock()
+	keys = append(keys, ecJWK("e2", "P-384", rotatedKey))
+	m.Unlock()
+
+	req, _ := http.NewRequest("GET", "http://x/api/index", nil)
+	req.Header.Set("Authorization",
+		"Bearer "+testJWT(t, "ES384", "e2", rotatedKey, claims))
+	identity, err := authenticate(req)
+	if err != nil || identity == nil {
+		t.Errorf("expected the rotated key, got: %v, err: %v", identity, err)
+	}
+}
@@ -0,0 +1,59 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+// KeyFilter restricts the documents that a bleve index ingests from
+// its data source feed by document key, so that an index that only
+// cares about one family of documents (like keys that start with
+// "user::") doesn't spend CPU on parsing and analyzing the rest.
+// Documents with non-matching keys are dropped as they arrive from
+// the feed, before they reach a bleve batch, although their sequence
+// numbers are still tracked.  When both a Prefix and a Regexp are
+// provided, a key must match both.
+type KeyFilter struct {
+	Prefix string `json:"prefix,omitempty"`
+	Regexp string `json:"regexp,omitempty"`
+}
+
+// NewKeyFilterFunc returns a func that returns true for the document
+// keys that are accepted by a KeyFilter, or nil if all keys are
+// accepted.
+func NewKeyFilterFunc(kf *KeyFilter) (func(key []byte) bool, error) {
+	if kf == nil || (kf.Prefix == "" && kf.Regexp == "") {
+		return nil, nil
+	}
+
+	prefix := []byte(kf.Prefix)
+
+	var re *regexp.Regexp
+	if kf.Regexp != "" {
+		var err error
+		re, err = regexp.Compile(kf.Regexp)
+		if err != nil {
+			return nil, fmt.Errorf("key_filter: could not compile"+
+				" regexp: %q, err: %v", kf.Regexp, err)
+		}
+	}
+
+	return func(key []byte) bool {
+		if len(prefix) > 0 && !bytes.HasPrefix(key, prefix) {
+			return false
+		}
+		return re == nil || re.Match(key)
+	}, nil
+}
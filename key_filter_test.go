@@ -0,0 +1,72 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"testing"
+)
+
+func TestNewKeyFilterFunc(t *testing.T) {
+	f, err := NewKeyFilterFunc(nil)
+	if err != nil || f != nil {
+		t.Errorf("expected no filter for nil, got: %v", err)
+	}
+
+	f, err = NewKeyFilterFunc(&KeyFilter{})
+	if err != nil || f != nil {
+		t.Errorf("expected no filter for an empty filter, got: %v", err)
+	}
+
+	_, err = NewKeyFilterFunc(&KeyFilter{Regexp: "["})
+	if err == nil {
+		t.Errorf("expected err on a bad regexp")
+	}
+
+	tests := []struct {
+		kf   KeyFilter
+		key  string
+		want bool
+	}{
+		{KeyFilter{Prefix: "user::"}, "user::1", true},
+		{KeyFilter{Prefix: "user::"}, "order::1", false},
+		{KeyFilter{Regexp: "^(user|admin)::"}, "admin::1", true},
+		{KeyFilter{Regexp: "^(user|admin)::"}, "order::1", false},
+		{KeyFilter{Prefix: "user::", Regexp: "[0-9]+$"}, "user::1", true},
+		{KeyFilter{Prefix: "user::", Regexp: "[0-9]+$"}, "user::x", false},
+		{KeyFilter{Prefix: "user::", Regexp: "[0-9]+$"}, "order::1", false},
+	}
+
+	for i, test := range tests {
+		kf := test.kf
+		f, err := NewKeyFilterFunc(&kf)
+		if err != nil {
+			t.Fatalf("%d: expected no err, got: %v", i, err)
+		}
+		if f([]byte(test.key)) != test.want {
+			t.Errorf("%d: expected %v for key: %s", i, test.want, test.key)
+		}
+	}
+}
+
+func TestValidateKeyFilter(t *testing.T) {
+	err := ValidateBlevePIndexImpl("bleve", "idx",
+		`{"keyFilter":{"prefix":"user::"}}`)
+	if err != nil {
+		t.Errorf("expected valid params, got: %v", err)
+	}
+
+	err = ValidateBlevePIndexImpl("bleve", "idx",
+		`{"keyFilter":{"regexp":"("}}`)
+	if err == nil {
+		t.Errorf("expected err on a bad regexp")
+	}
+}
@@ -0,0 +1,143 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+)
+
+// Text fields that should be both searchable and usable in term
+// facets and exact filters can be listed in the "keywordSubFields" of
+// the bleve index params, like...
+//
+//   {"mapping": {...}, "keywordSubFields": ["brand", "owner.name"]}
+//
+// where "*" lists every explicitly mapped text field that isn't
+// already indexed with the keyword analyzer.  Each listed field keeps
+// its analyzed field mapping, and gets a sibling keyword field
+// mapping, named FIELD + KEYWORD_SUB_FIELD_SUFFIX, like
+// "brand.keyword", whose single term is the whole value, without term
+// vectors, stored copies or inclusion in the composite "_all" field.
+// A sub-field can itself be listed in the "filterOnlyFields".
+
+// The suffix of the names of keyword sub-fields.
+const KEYWORD_SUB_FIELD_SUFFIX = ".keyword"
+
+// The analyzer of keyword sub-fields, so each value is a single term.
+const KEYWORD_SUB_FIELD_ANALYZER = "keyword"
+
+// applyKeywordSubFields adds the keyword sub-field mappings of the
+// listed text fields of an index mapping.
+func applyKeywordSubFields(m *bleve.IndexMapping, fields []string) error {
+	if len(fields) <= 0 {
+		return nil
+	}
+
+	all := false
+	listed := map[string]bool{}
+	for _, field := range fields {
+		if field == "*" {
+			all = true
+		} else {
+			listed[field] = true
+		}
+	}
+
+	found := map[string]bool{}
+
+	add := func(dm *bleve.DocumentMapping, path []string) error {
+		names := map[string]bool{}
+		for _, fm := range dm.Fields {
+			names[fm.Name] = true
+		}
+
+		for _, fm := range dm.Fields {
+			name := fm.Name
+			if name == "" && len(path) > 0 {
+				name = path[len(path)-1]
+			}
+			fieldPath := name
+			if len(path) > 1 {
+				fieldPath = strings.Join(path[:len(path)-1], ".") + "." + name
+			}
+
+			if !listed[fieldPath] {
+				if !all || fm.Type != "text" || fieldPath == "" ||
+					fm.Analyzer == KEYWORD_SUB_FIELD_ANALYZER ||
+					strings.HasSuffix(name, KEYWORD_SUB_FIELD_SUFFIX) {
+					continue
+				}
+			}
+			if fm.Type != "text" {
+				return fmt.Errorf("keyword_fields: keyword sub-field: %s"+
+					" must be of a text field, type: %s", fieldPath, fm.Type)
+			}
+			found[fieldPath] = true
+
+			subName := name + KEYWORD_SUB_FIELD_SUFFIX
+			if names[subName] {
+				continue // Already added, or mapped by hand.
+			}
+			names[subName] = true
+
+			dm.Fields = append(dm.Fields, &bleve.FieldMapping{
+				Name:     subName,
+				Type:     "text",
+				Analyzer: KEYWORD_SUB_FIELD_ANALYZER,
+				Index:    true,
+			})
+		}
+		return nil
+	}
+
+	if m.DefaultMapping != nil {
+		err := keywordSubFieldsWalk(m.DefaultMapping, nil, add)
+		if err != nil {
+			return err
+		}
+	}
+	for _, dm := range m.TypeMapping {
+		err := keywordSubFieldsWalk(dm, nil, add)
+		if err != nil {
+			return err
+		}
+	}
+
+	for field := range listed {
+		if !found[field] {
+			return fmt.Errorf("keyword_fields: keyword sub-field: %s"+
+				" is not mapped", field)
+		}
+	}
+
+	return nil
+}
+
+// keywordSubFieldsWalk invokes f on a document mapping and on each of
+// its sub-document mappings, along with their property paths.
+func keywordSubFieldsWalk(dm *bleve.DocumentMapping, path []string,
+	f func(*bleve.DocumentMapping, []string) error) error {
+	err := f(dm, path)
+	if err != nil {
+		return err
+	}
+	for propName, sub := range dm.Properties {
+		err = keywordSubFieldsWalk(sub, append(path, propName), f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
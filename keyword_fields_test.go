@@ -0,0 +1,167 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+func keywordFieldsTestMapping() *bleve.IndexMapping {
+	brand := bleve.NewTextFieldMapping()
+	brand.Store = true
+
+	code := bleve.NewTextFieldMapping()
+	code.Analyzer = KEYWORD_SUB_FIELD_ANALYZER
+
+	ownerName := bleve.NewTextFieldMapping()
+	owner := bleve.NewDocumentMapping()
+	owner.AddFieldMappingsAt("name", ownerName)
+
+	count := bleve.NewNumericFieldMapping()
+
+	dm := bleve.NewDocumentMapping()
+	dm.AddFieldMappingsAt("brand", brand)
+	dm.AddFieldMappingsAt("code", code)
+	dm.AddFieldMappingsAt("count", count)
+	dm.AddSubDocumentMapping("owner", owner)
+
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = dm
+	return m
+}
+
+func TestApplyKeywordSubFields(t *testing.T) {
+	m := keywordFieldsTestMapping()
+
+	err := applyKeywordSubFields(m, []string{"brand", "owner.name"})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	fields := m.DefaultMapping.Properties["brand"].Fields
+	if len(fields) != 2 || fields[0].Analyzer != "" || !fields[0].Store {
+		t.Fatalf("expected the analyzed field and a sub-field, got: %#v",
+			fields)
+	}
+	fm := fields[1]
+	if fm.Name != "brand.keyword" || fm.Type != "text" || !fm.Index ||
+		fm.Store || fm.IncludeTermVectors || fm.IncludeInAll ||
+		fm.Analyzer != KEYWORD_SUB_FIELD_ANALYZER {
+		t.Errorf("unexpected sub-field: %#v", fm)
+	}
+	fields = m.DefaultMapping.Properties["owner"].Properties["name"].Fields
+	if len(fields) != 2 || fields[1].Name != "name.keyword" {
+		t.Errorf("expected an owner.name.keyword sub-field, got: %#v",
+			fields)
+	}
+	if len(m.DefaultMapping.Properties["code"].Fields) != 1 {
+		t.Errorf("expected no sub-field of an unlisted field")
+	}
+
+	err = applyKeywordSubFields(m, []string{"brand"})
+	if err != nil || len(m.DefaultMapping.Properties["brand"].Fields) != 2 {
+		t.Errorf("expected the sub-field to be added once, err: %v", err)
+	}
+
+	m = keywordFieldsTestMapping()
+	err = applyKeywordSubFields(m, []string{"*"})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	for prop, exp := range map[string]int{"brand": 2, "code": 1, "count": 1} {
+		if n := len(m.DefaultMapping.Properties[prop].Fields); n != exp {
+			t.Errorf("prop: %s, expected %d fields, got: %d", prop, exp, n)
+		}
+	}
+	if len(m.DefaultMapping.Properties["owner"].Properties["name"].Fields) != 2 {
+		t.Errorf("expected a sub-field of every text field")
+	}
+
+	for _, fields := range [][]string{{"missing"}, {"count"}} {
+		err = applyKeywordSubFields(keywordFieldsTestMapping(), fields)
+		if err == nil {
+			t.Errorf("expected err, fields: %v", fields)
+		}
+	}
+}
+
+func TestValidateKeywordSubFields(t *testing.T) {
+	bleveParams := NewBleveParams()
+	bleveParams.Mapping = *keywordFieldsTestMapping()
+	bleveParams.KeywordSubFields = []string{"brand"}
+	bleveParams.FilterOnlyFields = []string{"brand.keyword"}
+	buf, _ := json.Marshal(bleveParams)
+
+	err := ValidateBlevePIndexImpl("bleve", "idx", string(buf))
+	if err != nil {
+		t.Errorf("expected a filter-only sub-field, got: %v", err)
+	}
+
+	bleveParams.KeywordSubFields = []string{"count"}
+	buf, _ = json.Marshal(bleveParams)
+
+	err = ValidateBlevePIndexImpl("bleve", "idx", string(buf))
+	if err == nil {
+		t.Errorf("expected err on a non-text field")
+	}
+}
+
+func TestKeywordSubFieldsIndex(t *testing.T) {
+	m := keywordFieldsTestMapping()
+	err := applyKeywordSubFields(m, []string{"brand"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bindex, err := bleve.NewMemOnly(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, brand := range map[string]string{
+		"a": "Acme Corp", "b": "Acme Corp", "c": "Acme Labs",
+	} {
+		err = bindex.Index(id, map[string]interface{}{"brand": brand})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mq := bleve.NewMatchQuery("acme")
+	mq.SetField("brand")
+	req := bleve.NewSearchRequest(mq)
+	req.AddFacet("brands", bleve.NewFacetRequest("brand.keyword", 10))
+	res, err := bindex.Search(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 3 {
+		t.Errorf("expected the analyzed field to match, got: %d", res.Total)
+	}
+	terms := map[string]int{}
+	for _, tf := range res.Facets["brands"].Terms {
+		terms[tf.Term] = tf.Count
+	}
+	if len(terms) != 2 || terms["Acme Corp"] != 2 || terms["Acme Labs"] != 1 {
+		t.Errorf("expected whole values in the facet, got: %v", terms)
+	}
+
+	tq := bleve.NewTermQuery("Acme Corp")
+	tq.SetField("brand.keyword")
+	req = bleve.NewSearchRequest(tq)
+	res, err = bindex.Search(req)
+	if err != nil || res.Total != 2 {
+		t.Errorf("expected an exact match, got: %v, err: %v", res, err)
+	}
+}
@@ -0,0 +1,248 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A node can write its log to a file (the logFile command-line
+// parameter) that the node rotates itself, when the file reaches a max
+// size and/or a max age, by renaming the file to a backup with a time
+// suffix, like "cbft.log.20150601-102030", and then starting a new
+// file, where the oldest backups beyond a max number are removed.  As
+// the node rotates its own file, there are no copytruncate races
+// between the node and an external logrotate.
+
+// The time layout of the suffixes of the backups of a log file.
+const LOG_FILE_BACKUP_LAYOUT = "20060102-150405"
+
+// A RotatingFile is a log file that rotates itself.
+type RotatingFile struct {
+	path       string
+	maxBytes   int64         // 0 means no size based rotation.
+	maxAge     time.Duration // 0 means no time based rotation.
+	maxBackups int           // 0 means all backups are kept.
+
+	m      sync.Mutex // Protects the fields that follow.
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// NewRotatingFile opens a log file, appending to an existing file.
+func NewRotatingFile(path string, maxBytes int64, maxAge time.Duration,
+	maxBackups int) (*RotatingFile, error) {
+	if maxBytes < 0 || maxAge < 0 || maxBackups < 0 {
+		return nil, fmt.Errorf("log_file: negative limits, path: %s", path)
+	}
+
+	rf := &RotatingFile{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+
+	err := rf.openUnlocked()
+	if err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+func (rf *RotatingFile) openUnlocked() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("log_file: open, path: %s, err: %v", rf.path, err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("log_file: stat, path: %s, err: %v", rf.path, err)
+	}
+
+	rf.f = f
+	rf.size = fi.Size()
+	rf.opened = time.Now()
+
+	return nil
+}
+
+// Write writes a log message, rotating the file first when the
+// message would exceed the max size or when the file is too old.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.m.Lock()
+	defer rf.m.Unlock()
+
+	if rf.f == nil {
+		return 0, fmt.Errorf("log_file: closed, path: %s", rf.path)
+	}
+
+	if rf.size > 0 &&
+		((rf.maxBytes > 0 && rf.size+int64(len(p)) > rf.maxBytes) ||
+			(rf.maxAge > 0 && time.Since(rf.opened) >= rf.maxAge)) {
+		err := rf.rotateUnlocked(time.Now())
+		if err != nil {
+			// Keep logging to the current file rather than losing
+			// log messages.
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+
+	return n, err
+}
+
+// Rotate rotates the file now.
+func (rf *RotatingFile) Rotate() error {
+	rf.m.Lock()
+	defer rf.m.Unlock()
+
+	return rf.rotateUnlocked(time.Now())
+}
+
+func (rf *RotatingFile) rotateUnlocked(now time.Time) error {
+	backup := rf.path + "." + now.Format(LOG_FILE_BACKUP_LAYOUT)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			break
+		}
+		backup = fmt.Sprintf("%s.%s.%d",
+			rf.path, now.Format(LOG_FILE_BACKUP_LAYOUT), i)
+	}
+
+	err := os.Rename(rf.path, backup)
+	if err != nil {
+		return fmt.Errorf("log_file: rotate, path: %s, err: %v", rf.path, err)
+	}
+
+	rf.f.Close()
+
+	err = rf.openUnlocked()
+	if err != nil {
+		// Reopen the backup, so that the node keeps logging.
+		f, err2 := os.OpenFile(backup, os.O_WRONLY|os.O_APPEND, 0600)
+		if err2 == nil {
+			rf.f = f
+		}
+		return err
+	}
+
+	rf.removeBackupsUnlocked()
+
+	return nil
+}
+
+// LogFileBackups returns the backups of a log file, from the oldest.
+func LogFileBackups(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var backups logFileBackups
+	for _, match := range matches {
+		suffix := strings.TrimPrefix(match, path+".")
+		if len(suffix) < len(LOG_FILE_BACKUP_LAYOUT) {
+			continue
+		}
+		t, err := time.Parse(LOG_FILE_BACKUP_LAYOUT,
+			suffix[:len(LOG_FILE_BACKUP_LAYOUT)])
+		if err != nil {
+			continue
+		}
+		n := 0
+		if rest := suffix[len(LOG_FILE_BACKUP_LAYOUT):]; rest != "" {
+			n, err = strconv.Atoi(strings.TrimPrefix(rest, "."))
+			if err != nil || !strings.HasPrefix(rest, ".") {
+				continue
+			}
+		}
+		backups = append(backups, logFileBackup{match, t, n})
+	}
+
+	sort.Sort(backups)
+
+	rv := make([]string, len(backups))
+	for i, backup := range backups {
+		rv[i] = backup.path
+	}
+
+	return rv, nil
+}
+
+func (rf *RotatingFile) removeBackupsUnlocked() {
+	if rf.maxBackups <= 0 {
+		return
+	}
+
+	backups, err := LogFileBackups(rf.path)
+	if err != nil {
+		return
+	}
+
+	for len(backups) > rf.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// Close closes the file.
+func (rf *RotatingFile) Close() error {
+	rf.m.Lock()
+	defer rf.m.Unlock()
+
+	if rf.f == nil {
+		return nil
+	}
+
+	err := rf.f.Close()
+	rf.f = nil
+
+	return err
+}
+
+type logFileBackup struct {
+	path string
+	t    time.Time
+	n    int // The ".N" suffix of the backups of the same second.
+}
+
+// logFileBackups sorts backups from the oldest.
+type logFileBackups []logFileBackup
+
+func (a logFileBackups) Len() int {
+	return len(a)
+}
+
+func (a logFileBackups) Less(i, j int) bool {
+	if a[i].t.Equal(a[j].t) {
+		return a[i].n < a[j].n
+	}
+	return a[i].t.Before(a[j].t)
+}
+
+func (a logFileBackups) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
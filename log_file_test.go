@@ -0,0 +1,137 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRotatingFileSize(t *testing.T) {
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cbft.log")
+	ioutil.WriteFile(path, []byte("previous\n"), 0600)
+
+	rf, err := NewRotatingFile(path, 20, 0, 2)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	defer rf.Close()
+
+	for i := 0; i < 8; i++ {
+		n, err := rf.Write([]byte("0123456789\n"))
+		if err != nil || n != 11 {
+			t.Fatalf("expected a write, n: %d, err: %v", n, err)
+		}
+	}
+
+	buf, _ := ioutil.ReadFile(path)
+	if string(buf) != "0123456789\n" {
+		t.Errorf("expected the last message, got: %q", buf)
+	}
+
+	backups, err := LogFileBackups(path)
+	if err != nil || len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got: %v, err: %v", backups, err)
+	}
+	for _, backup := range backups {
+		buf, _ := ioutil.ReadFile(backup)
+		if string(buf) != "0123456789\n" {
+			t.Errorf("expected a message per backup, got: %q", buf)
+		}
+	}
+
+	rf.Close()
+	_, err = rf.Write([]byte("closed\n"))
+	if err == nil {
+		t.Errorf("expected err on a closed file")
+	}
+
+	_, err = NewRotatingFile(path, -1, 0, 0)
+	if err == nil {
+		t.Errorf("expected err on negative limits")
+	}
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cbft.log")
+
+	rf, err := NewRotatingFile(path, 0, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	defer rf.Close()
+
+	rf.Write([]byte("first\n"))
+	rf.Write([]byte("second\n"))
+
+	rf.m.Lock()
+	rf.opened = time.Now().Add(-2 * time.Hour)
+	rf.m.Unlock()
+
+	rf.Write([]byte("third\n"))
+
+	buf, _ := ioutil.ReadFile(path)
+	if string(buf) != "third\n" {
+		t.Errorf("expected a new file, got: %q", buf)
+	}
+
+	backups, _ := LogFileBackups(path)
+	if len(backups) != 1 {
+		t.Fatalf("expected 1 backup, got: %v", backups)
+	}
+	buf, _ = ioutil.ReadFile(backups[0])
+	if string(buf) != "first\nsecond\n" {
+		t.Errorf("expected the old messages, got: %q", buf)
+	}
+}
+
+func TestLogFileBackups(t *testing.T) {
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cbft.log")
+	for _, suffix := range []string{
+		".20150601-102030.10",
+		".20150601-102030",
+		".20150601-102030.2",
+		".20150531-235959",
+		".not-a-backup",
+		".20150601-102030x",
+	} {
+		ioutil.WriteFile(path+suffix, nil, 0600)
+	}
+
+	backups, err := LogFileBackups(path)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	exp := []string{
+		path + ".20150531-235959",
+		path + ".20150601-102030",
+		path + ".20150601-102030.2",
+		path + ".20150601-102030.10",
+	}
+	if !reflect.DeepEqual(backups, exp) {
+		t.Errorf("expected: %v, got: %v", exp, backups)
+	}
+}
@@ -0,0 +1,373 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The log of a node (its MsgRing) can be retrieved with server-side
+// filtering by level, substring and time range, and can be followed,
+// where new log messages are streamed as they're logged, so that a
+// busy node's log is still usable.
+
+// The markers of the log messages of the levels above normal, as
+// written by clog, from the highest level.
+var logLevelMarkers = []struct {
+	level  string
+	marker string
+}{
+	{"error", "FATAL: "},
+	{"error", "PANIC: "},
+	{"error", "ERROR: "},
+	{"warn", "WARNING: "},
+	{"debug", "DEBUG: "},
+}
+
+// The order of the log levels, for filtering by a min level.
+var logLevelOrder = map[string]int{
+	"debug":  0,
+	"normal": 1,
+	"warn":   2,
+	"error":  3,
+}
+
+// The layouts of the time prefixes of log messages.
+var logTimeLayouts = []string{
+	"2006/01/02 15:04:05.000000",
+	"2006/01/02 15:04:05",
+	"2006-01-02T15:04:05.000-07:00",
+}
+
+// LogMessageLevel returns the level of a log message.
+func LogMessageLevel(msg []byte) string {
+	s := string(msg)
+	for _, m := range logLevelMarkers {
+		if strings.Contains(s, m.marker) {
+			return m.level
+		}
+	}
+	return "normal"
+}
+
+// LogMessageTime returns the time of a log message from its time
+// prefix, if any.
+func LogMessageTime(msg []byte) (time.Time, bool) {
+	t, n := logMessageTimePrefix(msg)
+	return t, n > 0
+}
+
+// logMessageTimePrefix returns the time of a log message and the
+// length of its time prefix, which is 0 when there's no time prefix.
+func logMessageTimePrefix(msg []byte) (time.Time, int) {
+	for _, layout := range logTimeLayouts {
+		if len(msg) < len(layout) {
+			continue
+		}
+		t, err := time.ParseInLocation(layout,
+			string(msg[:len(layout)]), time.Local)
+		if err == nil {
+			return t, len(layout)
+		}
+	}
+	return time.Time{}, 0
+}
+
+// LogFilter represents the criteria of the log messages to be
+// retrieved, where zero values mean no filtering.
+type LogFilter struct {
+	Level    string // The min level.
+	Contains string
+	Since    time.Time
+	Until    time.Time
+	Limit    int // The max number of the most recent log messages.
+}
+
+// Empty returns true when the LogFilter doesn't filter.
+func (f *LogFilter) Empty() bool {
+	return f.Level == "" && f.Contains == "" &&
+		f.Since.IsZero() && f.Until.IsZero() && f.Limit <= 0
+}
+
+// Match returns true when a log message, logged at time t, meets the
+// LogFilter's criteria other than the Limit.
+func (f *LogFilter) Match(msg []byte, t time.Time) bool {
+	if f.Level != "" &&
+		logLevelOrder[LogMessageLevel(msg)] < logLevelOrder[f.Level] {
+		return false
+	}
+	if f.Contains != "" && !strings.Contains(string(msg), f.Contains) {
+		return false
+	}
+	if !f.Since.IsZero() && (t.IsZero() || t.Before(f.Since)) {
+		return false
+	}
+	if !f.Until.IsZero() && (t.IsZero() || t.After(f.Until)) {
+		return false
+	}
+	return true
+}
+
+// Filter returns the log messages that meet the LogFilter's
+// criteria.  A log message without a time prefix, such as a
+// continuation line, has the time of the log message before it.
+func (f *LogFilter) Filter(msgs [][]byte) [][]byte {
+	rv := [][]byte{}
+
+	var t time.Time
+	for _, msg := range msgs {
+		if mt, ok := LogMessageTime(msg); ok {
+			t = mt
+		}
+		if f.Match(msg, t) {
+			rv = append(rv, msg)
+		}
+	}
+
+	if f.Limit > 0 && len(rv) > f.Limit {
+		rv = rv[len(rv)-f.Limit:]
+	}
+
+	return rv
+}
+
+// ParseLogFilter parses the level, contains, since, until and limit
+// params of a request, where since and until are either RFC 3339
+// times or durations before now, like "15m".
+func ParseLogFilter(req *http.Request, now time.Time) (*LogFilter, error) {
+	f := &LogFilter{
+		Level:    req.FormValue("level"),
+		Contains: req.FormValue("contains"),
+	}
+
+	if _, exists := logLevelOrder[f.Level]; f.Level != "" && !exists {
+		return nil, fmt.Errorf("log_filter: unknown level: %q,"+
+			" must be one of: debug, normal, warn or error", f.Level)
+	}
+
+	parseTime := func(name string) (time.Time, error) {
+		v := req.FormValue(name)
+		if v == "" {
+			return time.Time{}, nil
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err == nil {
+			return t, nil
+		}
+		d, err := time.ParseDuration(v)
+		if err == nil && d >= 0 {
+			return now.Add(-d), nil
+		}
+		return time.Time{}, fmt.Errorf("log_filter: bad %s: %q, must be"+
+			" an RFC 3339 time or a duration, like \"15m\"", name, v)
+	}
+
+	var err error
+
+	f.Since, err = parseTime("since")
+	if err != nil {
+		return nil, err
+	}
+
+	f.Until, err = parseTime("until")
+	if err != nil {
+		return nil, err
+	}
+
+	if v := req.FormValue("limit"); v != "" {
+		f.Limit, err = strconv.Atoi(v)
+		if err != nil || f.Limit < 0 {
+			return nil, fmt.Errorf("log_filter: bad limit: %q", v)
+		}
+	}
+
+	return f, nil
+}
+
+// ---------------------------------------------------------
+
+// The max number of new log messages that are buffered for a
+// follower, beyond which new log messages are dropped for that
+// follower.
+var LogFollowBufferSize = 1000
+
+var logFollowersM sync.Mutex // Protects the fields that follow.
+
+var logFollowers = map[chan []byte]bool{}
+
+// LogFollowWriter returns an io.Writer of log messages, which writes
+// to w (usually the node's MsgRing) and also sends the log messages
+// to the followers of the log.  It's meant to be the clog output.
+func LogFollowWriter(w io.Writer) io.Writer {
+	return &logFollowWriter{w: w}
+}
+
+type logFollowWriter struct {
+	w io.Writer
+}
+
+func (lfw *logFollowWriter) Write(p []byte) (int, error) {
+	n, err := lfw.w.Write(p)
+
+	msg := append([]byte(nil), p...)
+
+	logFollowersM.Lock()
+	for ch := range logFollowers {
+		select {
+		case ch <- msg:
+		default: // The follower is too slow, so drop the message.
+		}
+	}
+	logFollowersM.Unlock()
+
+	return n, err
+}
+
+// logFollow returns a channel of the log messages that are written
+// to a LogFollowWriter, until logUnfollow.
+func logFollow() chan []byte {
+	ch := make(chan []byte, LogFollowBufferSize)
+
+	logFollowersM.Lock()
+	logFollowers[ch] = true
+	logFollowersM.Unlock()
+
+	return ch
+}
+
+func logUnfollow(ch chan []byte) {
+	logFollowersM.Lock()
+	delete(logFollowers, ch)
+	logFollowersM.Unlock()
+}
+
+// ---------------------------------------------------------
+
+// LogFilterHandler is a REST handler that returns the log messages of
+// the node that meet the filter params, or that follows the log with
+// the follow param, or else delegates to the next (usually the
+// unfiltered log) handler.
+type LogFilterHandler struct {
+	mr   *cbgt.MsgRing
+	next http.Handler
+}
+
+func NewLogFilterHandler(mr *cbgt.MsgRing,
+	next http.Handler) *LogFilterHandler {
+	return &LogFilterHandler{mr: mr, next: next}
+}
+
+func (h *LogFilterHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	f, err := ParseLogFilter(req, time.Now())
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	follow := req.FormValue("follow") == "true"
+	if !follow && f.Empty() {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+
+	var msgs [][]byte
+	if h.mr != nil {
+		msgs = f.Filter(h.mr.Messages())
+	}
+
+	if !follow {
+		rest.MustEncode(w, struct {
+			Status   string   `json:"status"`
+			Messages []string `json:"messages"`
+		}{
+			Status:   "ok",
+			Messages: logMessageStrings(msgs),
+		})
+		return
+	}
+
+	h.follow(w, req, f, msgs)
+}
+
+// follow streams the log messages, as plain text, until the client
+// goes away, starting with the recent log messages.
+func (h *LogFilterHandler) follow(w http.ResponseWriter,
+	req *http.Request, f *LogFilter, msgs [][]byte) {
+	ch := logFollow()
+	defer logUnfollow(ch)
+
+	var closeCh <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closeCh = cn.CloseNotify()
+	}
+
+	flusher, _ := w.(http.Flusher)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	write := func(msg []byte) error {
+		_, err := w.Write(msg)
+		if err == nil && len(msg) > 0 && msg[len(msg)-1] != '\n' {
+			_, err = w.Write([]byte("\n"))
+		}
+		return err
+	}
+
+	for _, msg := range msgs {
+		if write(msg) != nil {
+			return
+		}
+	}
+
+	// The Limit only applies to the recent log messages.
+	f.Limit = 0
+
+	var t time.Time
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-closeCh:
+			return
+		case msg := <-ch:
+			if mt, ok := LogMessageTime(msg); ok {
+				t = mt
+			}
+			if !f.Match(msg, t) {
+				continue
+			}
+			if write(msg) != nil {
+				return
+			}
+		}
+	}
+}
+
+func logMessageStrings(msgs [][]byte) []string {
+	rv := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		rv = append(rv, string(msg))
+	}
+	return rv
+}
@@ -0,0 +1,170 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+var testLogMessages = [][]byte{
+	[]byte("2015/06/01 10:00:00.000000 main: started\n"),
+	[]byte("2015/06/01 10:05:00.000000 WARNING: feed: slow\n"),
+	[]byte("  continued\n"),
+	[]byte("2015/06/01 10:10:00.000000 ERROR: bleve: failed\n"),
+	[]byte("2015/06/01 10:15:00.000000 DEBUG: query: req\n"),
+}
+
+func TestLogFilter(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		t, _ := time.ParseInLocation("2006/01/02 15:04",
+			"2015/06/01 "+hhmm, time.Local)
+		return t
+	}
+
+	tests := []struct {
+		f   LogFilter
+		exp []int
+	}{
+		{LogFilter{}, []int{0, 1, 2, 3, 4}},
+		{LogFilter{Level: "warn"}, []int{1, 3}},
+		{LogFilter{Level: "normal"}, []int{0, 1, 2, 3}},
+		{LogFilter{Contains: "feed"}, []int{1}},
+		{LogFilter{Since: at("10:05")}, []int{1, 2, 3, 4}},
+		{LogFilter{Until: at("10:05")}, []int{0, 1, 2}},
+		{LogFilter{Since: at("10:01"), Until: at("10:12")}, []int{1, 2, 3}},
+		{LogFilter{Limit: 2}, []int{3, 4}},
+		{LogFilter{Level: "error", Limit: 5}, []int{3}},
+	}
+
+	for i, test := range tests {
+		exp := [][]byte{}
+		for _, j := range test.exp {
+			exp = append(exp, testLogMessages[j])
+		}
+		got := test.f.Filter(testLogMessages)
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("test: %d, expected: %q, got: %q", i, exp, got)
+		}
+	}
+}
+
+func TestParseLogFilter(t *testing.T) {
+	now := time.Now()
+
+	req, _ := http.NewRequest("GET",
+		"/api/log?level=warn&contains=x&since=15m&limit=10", nil)
+	f, err := ParseLogFilter(req, now)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if f.Level != "warn" || f.Contains != "x" || f.Limit != 10 ||
+		!f.Since.Equal(now.Add(-15*time.Minute)) || !f.Until.IsZero() {
+		t.Errorf("unexpected filter: %#v", f)
+	}
+
+	for _, u := range []string{
+		"/api/log?level=loud",
+		"/api/log?since=yesterday",
+		"/api/log?until=-5m",
+		"/api/log?limit=-1",
+	} {
+		req, _ := http.NewRequest("GET", u, nil)
+		_, err := ParseLogFilter(req, now)
+		if err == nil {
+			t.Errorf("expected err for: %s", u)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/api/log", nil)
+	f, _ = ParseLogFilter(req, now)
+	if !f.Empty() {
+		t.Errorf("expected empty filter, got: %#v", f)
+	}
+}
+
+func TestLogFilterHandler(t *testing.T) {
+	mr, _ := cbgt.NewMsgRing(ioutil.Discard, 100)
+	for _, msg := range testLogMessages {
+		mr.Write(msg)
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("unfiltered"))
+	})
+
+	h := NewLogFilterHandler(mr, next)
+
+	req, _ := http.NewRequest("GET", "/api/log", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Body.String() != "unfiltered" {
+		t.Errorf("expected unfiltered, got: %s", rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/api/log?level=error", nil)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	var res struct {
+		Messages []string `json:"messages"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &res)
+	if err != nil || len(res.Messages) != 1 ||
+		res.Messages[0] != string(testLogMessages[3]) {
+		t.Errorf("expected the error message, got: %s, err: %v",
+			rr.Body.String(), err)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/log?limit=x", nil)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != 400 {
+		t.Errorf("expected 400, got: %d", rr.Code)
+	}
+}
+
+func TestLogFollowWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := LogFollowWriter(&buf)
+
+	ch := logFollow()
+	w.Write([]byte("hello\n"))
+	logUnfollow(ch)
+	w.Write([]byte("world\n"))
+
+	if buf.String() != "hello\nworld\n" {
+		t.Errorf("expected both messages written, got: %q", buf.String())
+	}
+
+	select {
+	case msg := <-ch:
+		if string(msg) != "hello\n" {
+			t.Errorf("expected hello, got: %q", msg)
+		}
+	default:
+		t.Errorf("expected a followed message")
+	}
+
+	select {
+	case msg := <-ch:
+		t.Errorf("expected no message after unfollow, got: %q", msg)
+	default:
+	}
+}
@@ -0,0 +1,142 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// With the "json" log format (the logFormat command-line parameter),
+// the log messages that a node writes to its log output are JSON
+// records, one per line, instead of free text, so that log pipelines
+// don't need to parse the text.  A record has the fields...
+//
+//   {"timestamp":"2015-06-01T10:20:30.123456Z","level":"normal",
+//    "subsystem":"bleve","index":"beers","pindex":"beers_1ad2_4a3b",
+//    "msg":"..."}
+//
+// The level, subsystem, index and pindex are parsed from the text of
+// the log messages, which follow the "subsystem: msg, key: val"
+// convention, where the index and pindex fields are omitted when a
+// message doesn't have them.  The in-memory log of the node (its
+// MsgRing, as served by /api/log) stays text.
+
+// The log formats.
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+// LogFormats are the names of the log formats.
+var LogFormats = []string{LOG_FORMAT_TEXT, LOG_FORMAT_JSON}
+
+// A LogRecord is a structured log message.
+type LogRecord struct {
+	Timestamp string `json:"timestamp"`
+	Level     string `json:"level"`
+	Subsystem string `json:"subsystem,omitempty"`
+	Index     string `json:"index,omitempty"`
+	PIndex    string `json:"pindex,omitempty"`
+	Msg       string `json:"msg"`
+}
+
+var logSubsystemRE = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9_]*): `)
+
+var logIndexRE = regexp.MustCompile(`\b(?:indexName|index): ([^\s,]+)`)
+
+var logPIndexRE = regexp.MustCompile(`\b(?:pindexName|pindex): ([^\s,]+)`)
+
+var logPathRE = regexp.MustCompile(`\bpath: ([^\s,]+\.pindex)\b`)
+
+// ParseLogRecord parses a text log message into a LogRecord, where a
+// message without a time prefix has the time now.
+func ParseLogRecord(msg []byte, now time.Time) *LogRecord {
+	t, n := logMessageTimePrefix(msg)
+	if n <= 0 {
+		t = now
+	}
+
+	s := strings.TrimLeft(strings.TrimRight(string(msg[n:]), "\n"), " ")
+
+	r := &LogRecord{
+		Timestamp: t.UTC().Format(time.RFC3339Nano),
+		Level:     LogMessageLevel(msg),
+	}
+
+	for _, m := range logLevelMarkers {
+		if strings.HasPrefix(s, m.marker) {
+			s = s[len(m.marker):]
+			break
+		}
+	}
+
+	if m := logSubsystemRE.FindStringSubmatch(s); m != nil {
+		r.Subsystem = m[1]
+		s = s[len(m[0]):]
+	}
+
+	if m := logIndexRE.FindStringSubmatch(s); m != nil {
+		r.Index = m[1]
+	}
+
+	if m := logPIndexRE.FindStringSubmatch(s); m != nil {
+		r.PIndex = m[1]
+	} else if m := logPathRE.FindStringSubmatch(s); m != nil {
+		r.PIndex = strings.TrimSuffix(filepath.Base(m[1]), ".pindex")
+	}
+
+	r.Msg = s
+
+	return r
+}
+
+// LogFormatWriter returns a writer of log messages in a log format
+// to a writer.
+func LogFormatWriter(w io.Writer, format string) (io.Writer, error) {
+	switch format {
+	case "", LOG_FORMAT_TEXT:
+		return w, nil
+	case LOG_FORMAT_JSON:
+		return &logJSONWriter{w: w}, nil
+	}
+	return nil, fmt.Errorf("log_format: unknown logFormat: %q,"+
+		" must be one of: %v", format, LogFormats)
+}
+
+type logJSONWriter struct {
+	w io.Writer
+}
+
+// Write writes a log message as a JSON record, where each Write is a
+// whole log message.
+func (ljw *logJSONWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+
+	err := json.NewEncoder(&buf).Encode(ParseLogRecord(p, time.Now()))
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = ljw.w.Write(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
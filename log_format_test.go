@@ -0,0 +1,116 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLogRecord(t *testing.T) {
+	now := time.Date(2015, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		msg string
+		exp LogRecord
+	}{
+		{"2015/06/01 10:20:30.123456 main: listening on: :8095\n",
+			LogRecord{
+				Level:     "normal",
+				Subsystem: "main",
+				Msg:       "listening on: :8095",
+			}},
+		{"2015/06/01 10:20:30.123456 ERROR: percolator: parse," +
+			" indexName: beers, err: bad query\n",
+			LogRecord{
+				Level:     "error",
+				Subsystem: "percolator",
+				Index:     "beers",
+				Msg:       "parse, indexName: beers, err: bad query",
+			}},
+		{"2015/06/01 10:20:30.123456 DEBUG: feed: pindexName: beers_1_2," +
+			" seq: 10\n",
+			LogRecord{
+				Level:     "debug",
+				Subsystem: "feed",
+				PIndex:    "beers_1_2",
+				Msg:       "pindexName: beers_1_2, seq: 10",
+			}},
+		{"2015/06/01 10:20:30.123456 expiry: sweep," +
+			" path: data/beers_1a_2b.pindex, removed: 3\n",
+			LogRecord{
+				Level:     "normal",
+				Subsystem: "expiry",
+				PIndex:    "beers_1a_2b",
+				Msg:       "sweep, path: data/beers_1a_2b.pindex, removed: 3",
+			}},
+		{"  a continuation line\n",
+			LogRecord{
+				Level: "normal",
+				Msg:   "a continuation line",
+			}},
+	}
+
+	for _, test := range tests {
+		r := ParseLogRecord([]byte(test.msg), now)
+
+		expTime := now
+		if test.msg[0] != ' ' {
+			expTime = time.Date(2015, 6, 1, 10, 20, 30, 123456000, time.Local)
+		}
+		test.exp.Timestamp = expTime.UTC().Format(time.RFC3339Nano)
+
+		if !reflect.DeepEqual(*r, test.exp) {
+			t.Errorf("msg: %q, expected: %#v, got: %#v", test.msg, test.exp, *r)
+		}
+	}
+}
+
+func TestLogFormatWriter(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := LogFormatWriter(&buf, LOG_FORMAT_TEXT)
+	if err != nil || w != &buf {
+		t.Errorf("expected the text writer to be the writer, err: %v", err)
+	}
+
+	_, err = LogFormatWriter(&buf, "xml")
+	if err == nil {
+		t.Errorf("expected err on unknown format")
+	}
+
+	w, err = LogFormatWriter(&buf, LOG_FORMAT_JSON)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	msg := []byte("2015/06/01 10:20:30.123456 WARNING: main: \"quoted\"\n")
+	n, err := w.Write(msg)
+	if err != nil || n != len(msg) {
+		t.Errorf("expected a whole write, n: %d, err: %v", n, err)
+	}
+
+	var r LogRecord
+	err = json.Unmarshal(buf.Bytes(), &r)
+	if err != nil {
+		t.Fatalf("expected a JSON record, got: %s, err: %v", buf.Bytes(), err)
+	}
+	if r.Level != "warn" || r.Subsystem != "main" || r.Msg != `"quoted"` {
+		t.Errorf("unexpected record: %#v", r)
+	}
+	if bytes.Count(buf.Bytes(), []byte("\n")) != 1 {
+		t.Errorf("expected one line, got: %q", buf.Bytes())
+	}
+}
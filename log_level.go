@@ -0,0 +1,244 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The log level of a node can be changed at runtime, both globally,
+// which sets the clog level that all log messages are subject to, and
+// per log category (subsystem), which controls the debug messages of
+// that category, so that debug logging can be turned on for only a
+// single subsystem while reproducing an issue.  The log level isn't
+// persisted, so a restarted node is back at the "normal" level.
+
+// The log categories, whose debug messages are logged with LogDebugf.
+const (
+	LOG_CATEGORY_FEED    = "feed"
+	LOG_CATEGORY_PLANNER = "planner"
+	LOG_CATEGORY_QUERY   = "query"
+	LOG_CATEGORY_REST    = "rest"
+)
+
+var LogCategories = []string{
+	LOG_CATEGORY_FEED,
+	LOG_CATEGORY_PLANNER,
+	LOG_CATEGORY_QUERY,
+	LOG_CATEGORY_REST,
+}
+
+// LogLevels maps the names of the log levels to the clog levels.
+var LogLevels = map[string]log.LogLevel{
+	"debug":  log.LevelDebug,
+	"normal": log.LevelNormal,
+	"warn":   log.LevelWarning,
+	"error":  log.LevelError,
+}
+
+const LOG_LEVEL_DEFAULT = "normal"
+
+// LogLevelSettings represents the log level of a node.
+type LogLevelSettings struct {
+	// The global log level, where "" means LOG_LEVEL_DEFAULT.
+	Level string `json:"level"`
+
+	// The log levels of categories, keyed by category, where a
+	// category that's not listed has the global log level.
+	Categories map[string]string `json:"categories,omitempty"`
+}
+
+var logLevelM sync.RWMutex // Protects the fields that follow.
+
+var logLevel = &LogLevelSettings{Level: LOG_LEVEL_DEFAULT}
+
+// CurrentLogLevel returns a copy of the node's log level.
+func CurrentLogLevel() *LogLevelSettings {
+	logLevelM.RLock()
+	defer logLevelM.RUnlock()
+
+	rv := &LogLevelSettings{
+		Level:      logLevel.Level,
+		Categories: map[string]string{},
+	}
+	for category, level := range logLevel.Categories {
+		rv.Categories[category] = level
+	}
+	return rv
+}
+
+// SetLogLevel validates and then replaces the node's log level.
+func SetLogLevel(s *LogLevelSettings) error {
+	level := s.Level
+	if level == "" {
+		level = LOG_LEVEL_DEFAULT
+	}
+	clogLevel, exists := LogLevels[level]
+	if !exists {
+		return fmt.Errorf("log_level: unknown level: %q, must be one of: %v",
+			s.Level, logLevelNames())
+	}
+
+	categories := map[string]string{}
+	for category, categoryLevel := range s.Categories {
+		known := false
+		for _, c := range LogCategories {
+			known = known || c == category
+		}
+		if !known {
+			return fmt.Errorf("log_level: unknown category: %q,"+
+				" must be one of: %v", category, LogCategories)
+		}
+		if _, exists := LogLevels[categoryLevel]; !exists {
+			return fmt.Errorf("log_level: unknown level: %q of category: %s,"+
+				" must be one of: %v", categoryLevel, category,
+				logLevelNames())
+		}
+		categories[category] = categoryLevel
+	}
+
+	logLevelM.Lock()
+	logLevel = &LogLevelSettings{Level: level, Categories: categories}
+	log.SetLevel(clogLevel)
+	logLevelM.Unlock()
+
+	return nil
+}
+
+func logLevelNames() []string {
+	rv := make([]string, 0, len(LogLevels))
+	for name := range LogLevels {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// LogDebugEnabled returns true when the debug messages of a log
+// category are to be logged.
+func LogDebugEnabled(category string) bool {
+	logLevelM.RLock()
+	level, exists := logLevel.Categories[category]
+	if !exists {
+		level = logLevel.Level
+	}
+	logLevelM.RUnlock()
+
+	return level == "debug"
+}
+
+// LogDebugf logs a debug message of a log category, if the category
+// is at the debug log level.
+func LogDebugf(category string, format string, args ...interface{}) {
+	if LogDebugEnabled(category) {
+		log.Printf("DEBUG: "+category+": "+format, args...)
+	}
+}
+
+// ---------------------------------------------------------
+
+// LogLevelGetHandler is a REST handler that returns the node's log
+// level.
+type LogLevelGetHandler struct{}
+
+func NewLogLevelGetHandler() *LogLevelGetHandler {
+	return &LogLevelGetHandler{}
+}
+
+func (h *LogLevelGetHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+		*LogLevelSettings
+		KnownCategories []string `json:"knownCategories"`
+	}{
+		Status:           "ok",
+		LogLevelSettings: CurrentLogLevel(),
+		KnownCategories:  LogCategories,
+	})
+}
+
+// LogLevelPutHandler is a REST handler that replaces the node's log
+// level with the JSON in the request body.
+type LogLevelPutHandler struct{}
+
+func NewLogLevelPutHandler() *LogLevelPutHandler {
+	return &LogLevelPutHandler{}
+}
+
+func (h *LogLevelPutHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("log_level: could not read"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	s := &LogLevelSettings{}
+	err = json.Unmarshal(requestBody, s)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("log_level: could not parse"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	err = SetLogLevel(s)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	log.Printf("log_level: set, level: %s", requestBody)
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// ---------------------------------------------------------
+
+// LogDebugHandler is a REST handler that logs the requests that it
+// delegates to the next handler, as debug messages of the "rest" log
+// category.
+type LogDebugHandler struct {
+	next http.Handler
+}
+
+func NewLogDebugHandler(next http.Handler) *LogDebugHandler {
+	return &LogDebugHandler{next: next}
+}
+
+func (h *LogDebugHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	if !LogDebugEnabled(LOG_CATEGORY_REST) {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+
+	startTime := time.Now()
+
+	h.next.ServeHTTP(w, req)
+
+	LogDebugf(LOG_CATEGORY_REST, "%s %s, remoteAddr: %s, duration: %v",
+		req.Method, req.URL, req.RemoteAddr, time.Since(startTime))
+}
@@ -0,0 +1,97 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetLogLevel(t *testing.T) {
+	defer SetLogLevel(&LogLevelSettings{})
+
+	if LogDebugEnabled(LOG_CATEGORY_QUERY) {
+		t.Errorf("expected no query debug by default")
+	}
+
+	err := SetLogLevel(&LogLevelSettings{
+		Categories: map[string]string{LOG_CATEGORY_QUERY: "debug"},
+	})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if !LogDebugEnabled(LOG_CATEGORY_QUERY) {
+		t.Errorf("expected query debug")
+	}
+	if LogDebugEnabled(LOG_CATEGORY_FEED) {
+		t.Errorf("expected no feed debug")
+	}
+	if CurrentLogLevel().Level != LOG_LEVEL_DEFAULT {
+		t.Errorf("expected default level, got: %#v", CurrentLogLevel())
+	}
+
+	err = SetLogLevel(&LogLevelSettings{
+		Level:      "debug",
+		Categories: map[string]string{LOG_CATEGORY_FEED: "normal"},
+	})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if !LogDebugEnabled(LOG_CATEGORY_QUERY) {
+		t.Errorf("expected query debug from the global level")
+	}
+	if LogDebugEnabled(LOG_CATEGORY_FEED) {
+		t.Errorf("expected feed category to override the global level")
+	}
+
+	for _, s := range []*LogLevelSettings{
+		{Level: "verbose"},
+		{Categories: map[string]string{"unknown": "debug"}},
+		{Categories: map[string]string{LOG_CATEGORY_REST: "verbose"}},
+	} {
+		if SetLogLevel(s) == nil {
+			t.Errorf("expected err for: %#v", s)
+		}
+	}
+	if CurrentLogLevel().Level != "debug" {
+		t.Errorf("expected a failed set to leave the level unchanged")
+	}
+}
+
+func TestLogLevelPutHandler(t *testing.T) {
+	defer SetLogLevel(&LogLevelSettings{})
+
+	for _, test := range []struct {
+		body string
+		code int
+	}{
+		{`{"level":"warn","categories":{"rest":"debug"}}`, 200},
+		{`{"level":"loud"}`, 400},
+		{`not json`, 400},
+	} {
+		req, _ := http.NewRequest("PUT", "/api/logLevel",
+			bytes.NewBufferString(test.body))
+		rr := httptest.NewRecorder()
+		NewLogLevelPutHandler().ServeHTTP(rr, req)
+		if rr.Code != test.code {
+			t.Errorf("expected %d for body: %s, got: %d, %s",
+				test.code, test.body, rr.Code, rr.Body.String())
+		}
+	}
+
+	s := CurrentLogLevel()
+	if s.Level != "warn" || s.Categories[LOG_CATEGORY_REST] != "debug" {
+		t.Errorf("expected the first body's log level, got: %#v", s)
+	}
+}
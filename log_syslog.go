@@ -0,0 +1,77 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package cbft
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/url"
+	"strings"
+)
+
+// NewSyslogWriter returns a writer that forwards log messages to
+// syslog, with the syslog severity of the level of each message,
+// where the addr is "local", for the local syslog daemon, or a
+// "udp://HOST:PORT" or "tcp://HOST:PORT" URL of a remote syslog
+// server.
+func NewSyslogWriter(addr, tag string) (io.Writer, error) {
+	network, raddr := "", ""
+	if addr != "local" {
+		u, err := url.Parse(addr)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") ||
+			u.Host == "" {
+			return nil, fmt.Errorf("log_syslog: logSyslog must be 'local'"+
+				" or a udp://HOST:PORT or tcp://HOST:PORT URL, addr: %q", addr)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON,
+		tag)
+	if err != nil {
+		return nil, fmt.Errorf("log_syslog: addr: %q, err: %v", addr, err)
+	}
+
+	return &syslogWriter{w: w}, nil
+}
+
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func (sw *syslogWriter) Write(p []byte) (int, error) {
+	// The syslog record has its own time, so the time prefix of the
+	// message is dropped.
+	_, n := logMessageTimePrefix(p)
+	msg := strings.TrimSpace(string(p[n:]))
+
+	var err error
+	switch LogMessageLevel(p) {
+	case "error":
+		err = sw.w.Err(msg)
+	case "warn":
+		err = sw.w.Warning(msg)
+	case "debug":
+		err = sw.w.Debug(msg)
+	default:
+		err = sw.w.Info(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
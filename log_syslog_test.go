@@ -0,0 +1,72 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package cbft
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogWriter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	w, err := NewSyslogWriter("udp://"+conn.LocalAddr().String(), "cbft")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	tests := []struct {
+		msg    string
+		expPri string // LOG_DAEMON (3) * 8 + severity.
+	}{
+		{"2015/06/01 10:20:30.123456 main: started\n", "<30>"},
+		{"2015/06/01 10:20:30.123456 ERROR: main: failed\n", "<27>"},
+		{"2015/06/01 10:20:30.123456 WARNING: main: slow\n", "<28>"},
+	}
+
+	for _, test := range tests {
+		_, err = w.Write([]byte(test.msg))
+		if err != nil {
+			t.Fatalf("expected no err, got: %v", err)
+		}
+
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("expected a syslog record, err: %v", err)
+		}
+
+		record := string(buf[:n])
+		if !strings.HasPrefix(record, test.expPri) ||
+			!strings.Contains(record, "cbft") ||
+			strings.Contains(record, "2015/06/01") {
+			t.Errorf("msg: %q, unexpected record: %q", test.msg, record)
+		}
+	}
+
+	for _, addr := range []string{"", "http://x:514", "udp://"} {
+		_, err = NewSyslogWriter(addr, "cbft")
+		if err == nil {
+			t.Errorf("expected err, addr: %q", addr)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/blevesearch/bleve"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// Materializing an alias copies the union of the alias's member
+// indexes into a single target index, by reading the stored fields
+// of every document and re-indexing them under the target's mapping,
+// so that indexes can be consolidated (such as after a migration)
+// without re-streaming from the source buckets.
+//
+// The target must be a bleve index with a "primary" source type
+// (which is only fed by the materialization), whose partitions are
+// local to the node that runs the materialization.  Progress is
+// checkpointed in the Cfg after every batch, so an interrupted
+// materialization can be resumed.  The documents are read in doc ID
+// order (see pindex_docs.go), optionally after waiting for the
+// members to reach the requested consistency seq's, and the last doc
+// ID that was copied is the checkpoint, so documents that change
+// during the materialization are neither skipped nor repeated, but
+// only the changes to doc ID's after the checkpoint are copied.
+
+// The Cfg key where the materialization tasks are kept.
+const MATERIALIZE_TASKS_KEY = "materializeTasks"
+
+// The number of documents read and written per batch/checkpoint.
+var MaterializeBatchSize = 100
+
+const (
+	MATERIALIZE_RUNNING = "running"
+	MATERIALIZE_DONE    = "done"
+	MATERIALIZE_FAILED  = "failed"
+)
+
+// MaterializeTasks is the Cfg entry of all materialization tasks.
+type MaterializeTasks struct {
+	UUID string `json:"uuid"`
+
+	// Keyed by target index name.
+	Tasks map[string]*MaterializeTask `json:"tasks"`
+}
+
+// MaterializeTask tracks the progress of a materialization.
+type MaterializeTask struct {
+	// The source index, which is a bleve index for a sample.
+	AliasName  string `json:"aliasName"`
+	TargetName string `json:"targetName"`
+	NodeUUID   string `json:"nodeUUID"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+
+	// The checkpoint, which is the last doc ID that's been read from
+	// the alias and written into the target, and the number of
+	// documents that have been read.
+	LastDocID  string `json:"lastDocID,omitempty"`
+	DocsCopied uint64 `json:"docsCopied"`
+	TotalDocs  uint64 `json:"totalDocs"`
+
+	Consistency *cbgt.ConsistencyParams `json:"consistency,omitempty"`
+
+	// When non-nil, only a sample of the documents are written.
+	Sample      *SampleParams `json:"sample,omitempty"`
+	DocsWritten uint64        `json:"docsWritten"`
+
+	StartTime  string `json:"startTime"`
+	UpdateTime string `json:"updateTime"`
+}
+
+// MaterializeRequest is the JSON request body of a materialization.
+type MaterializeRequest struct {
+	Target      string                  `json:"target"`
+	Resume      bool                    `json:"resume"`
+	Consistency *cbgt.ConsistencyParams `json:"consistency"`
+}
+
+// Materialize validates and starts an asynchronous materialization
+// of an alias into a target index.
+func Materialize(mgr *cbgt.Manager, aliasName string,
+	mreq *MaterializeRequest) error {
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return err
+	}
+
+	aliasDef := indexDefsByName[aliasName]
+	if aliasDef == nil || aliasDef.Type != "alias" {
+		return fmt.Errorf("materialize: not an alias, aliasName: %s",
+			aliasName)
+	}
+
+	targetDef := indexDefsByName[mreq.Target]
+	if targetDef == nil || targetDef.Type != "bleve" ||
+		targetDef.SourceType != "primary" {
+		return fmt.Errorf("materialize: target must be a bleve index"+
+			" with a primary source type, target: %s", mreq.Target)
+	}
+
+	_, err = materializeDests(mgr, mreq.Target)
+	if err != nil {
+		return err
+	}
+
+	task := &MaterializeTask{
+		AliasName:   aliasName,
+		TargetName:  mreq.Target,
+		NodeUUID:    mgr.UUID(),
+		Status:      MATERIALIZE_RUNNING,
+		Consistency: mreq.Consistency,
+		StartTime:   time.Now().Format(time.RFC3339Nano),
+	}
+
+	err = materializeUpdateTask(mgr.Cfg(), task.TargetName,
+		func(prev *MaterializeTask) (*MaterializeTask, error) {
+			if prev != nil && prev.Status == MATERIALIZE_RUNNING {
+				return nil, fmt.Errorf("materialize: already running,"+
+					" target: %s", task.TargetName)
+			}
+			if mreq.Resume {
+				if prev == nil || prev.AliasName != aliasName {
+					return nil, fmt.Errorf("materialize: nothing to"+
+						" resume, target: %s", task.TargetName)
+				}
+				task.LastDocID = prev.LastDocID
+				task.DocsCopied = prev.DocsCopied
+				task.DocsWritten = prev.DocsWritten
+			}
+			return task, nil
+		})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := materializeRun(mgr, task)
+		if err != nil {
+			log.Printf("materialize: run, aliasName: %s, target: %s,"+
+				" err: %v", task.AliasName, task.TargetName, err)
+		}
+	}()
+
+	return nil
+}
+
+// materializeDests returns the local dests of the target index's
+// primary feed, keyed by partition.
+func materializeDests(mgr *cbgt.Manager,
+	targetName string) (map[string]cbgt.Dest, error) {
+	feeds, _ := mgr.CurrentMaps()
+	for _, feed := range feeds {
+		if feed.IndexName() != targetName {
+			continue
+		}
+		if _, ok := feed.(*cbgt.PrimaryFeed); !ok {
+			continue
+		}
+		dests := feed.Dests()
+		if len(dests) > 0 {
+			return dests, nil
+		}
+	}
+
+	return nil, fmt.Errorf("materialize: no local partitions for"+
+		" target, target: %s", targetName)
+}
+
+func materializeRun(mgr *cbgt.Manager, task *MaterializeTask) error {
+	fail := func(err error) error {
+		task.Status = MATERIALIZE_FAILED
+		task.Error = err.Error()
+		materializeCheckpoint(mgr.Cfg(), task)
+		return err
+	}
+
+	dests, err := materializeDests(mgr, task.TargetName)
+	if err != nil {
+		return fail(err)
+	}
+
+	partitions := materializePartitions(dests)
+
+	var targets []bleve.Index
+	if task.Sample != nil {
+		targets, err = bleveIndexTargets(mgr,
+			task.AliasName, "", true, task.Consistency, nil)
+	} else {
+		targets, err = bleveIndexTargetsForUserIndexAlias(mgr,
+			task.AliasName, "", true, task.Consistency, nil)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	alias := bleve.NewIndexAlias(targets...)
+
+	task.TotalDocs, err = alias.DocCount()
+	if err != nil {
+		return fail(err)
+	}
+
+	it := newBleveDocIter(targets, task.LastDocID, MaterializeBatchSize)
+
+	for {
+		var docs []*bleveDoc
+		for len(docs) < MaterializeBatchSize {
+			doc, err := it.Next()
+			if err != nil {
+				return fail(err)
+			}
+			if doc == nil {
+				break
+			}
+			docs = append(docs, doc)
+		}
+		if len(docs) <= 0 {
+			break
+		}
+
+		// The seq's continue from the checkpoint, so they keep
+		// increasing across resumptions.
+		seqStart := task.DocsCopied + 1
+		seqEnd := task.DocsCopied + uint64(len(docs))
+
+		muts := make([]*materializeMutation, 0, len(docs))
+
+		for i, doc := range docs {
+			if task.Sample != nil && !task.Sample.Includes(doc.ID) {
+				continue
+			}
+
+			val, err := json.Marshal(MaterializeDoc(doc.Fields))
+			if err != nil {
+				return fail(err)
+			}
+
+			muts = append(muts, &materializeMutation{
+				id:  doc.ID,
+				seq: seqStart + uint64(i),
+				val: val,
+			})
+		}
+
+		err = materializeWrite(dests, partitions, seqStart, seqEnd, muts)
+		if err != nil {
+			return fail(err)
+		}
+
+		task.LastDocID = docs[len(docs)-1].ID
+		task.DocsCopied = seqEnd
+		task.DocsWritten += uint64(len(muts))
+
+		err = materializeCheckpoint(mgr.Cfg(), task)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	task.Status = MATERIALIZE_DONE
+
+	return materializeCheckpoint(mgr.Cfg(), task)
+}
+
+// A key that's never a real doc ID, used for advancing a partition's
+// seq to the snapshot end.
+const materializeNoopKey = "\x00materialize"
+
+type materializeMutation struct {
+	id  string
+	seq uint64
+	val []byte
+}
+
+// materializePartitions returns the sorted partitions of the dests.
+func materializePartitions(dests map[string]cbgt.Dest) []string {
+	partitions := make([]string, 0, len(dests))
+	for partition := range dests {
+		partitions = append(partitions, partition)
+	}
+	sort.Strings(partitions)
+	return partitions
+}
+
+// materializeWrite writes the mutations, whose seq's must be within
+// seqStart and seqEnd, as a snapshot into the partitions of the dests.
+func materializeWrite(dests map[string]cbgt.Dest, partitions []string,
+	seqStart, seqEnd uint64, muts []*materializeMutation) error {
+	for _, partition := range partitions {
+		err := dests[partition].SnapshotStart(partition, seqStart, seqEnd)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, mut := range muts {
+		partition := partitions[crc32.ChecksumIEEE([]byte(mut.id))%
+			uint32(len(partitions))]
+
+		err := dests[partition].DataUpdate(partition, []byte(mut.id),
+			mut.seq, mut.val, 0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Bump every partition to the snapshot end, so that their
+	// batches are applied before any checkpoint.
+	for _, partition := range partitions {
+		err := dests[partition].DataDelete(partition,
+			[]byte(materializeNoopKey), seqEnd, 0,
+			cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MaterializeDoc rebuilds a JSON document from the stored fields of
+// a search hit, where the dotted field names of nested fields (like
+// "address.city") become nested JSON objects.
+func MaterializeDoc(fields map[string]interface{}) map[string]interface{} {
+	rv := map[string]interface{}{}
+
+	for name, value := range fields {
+		parts := strings.Split(name, ".")
+
+		m := rv
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := m[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				m[part] = child
+			}
+			m = child
+		}
+
+		m[parts[len(parts)-1]] = value
+	}
+
+	return rv
+}
+
+func materializeCheckpoint(cfg cbgt.Cfg, task *MaterializeTask) error {
+	task.UpdateTime = time.Now().Format(time.RFC3339Nano)
+
+	return materializeUpdateTask(cfg, task.TargetName,
+		func(prev *MaterializeTask) (*MaterializeTask, error) {
+			return task, nil
+		})
+}
+
+// materializeUpdateTask updates a task in the Cfg.
+func materializeUpdateTask(cfg cbgt.Cfg, targetName string,
+	f func(prev *MaterializeTask) (*MaterializeTask, error)) error {
+	return CfgUpdateJSON(cfg, MATERIALIZE_TASKS_KEY,
+		func() interface{} { return &MaterializeTasks{} },
+		func(v interface{}) error {
+			mts := v.(*MaterializeTasks)
+			if mts.Tasks == nil {
+				mts.Tasks = map[string]*MaterializeTask{}
+			}
+
+			task, err := f(mts.Tasks[targetName])
+			if err != nil {
+				return err
+			}
+
+			mts.UUID = cbgt.NewUUID()
+			mts.Tasks[targetName] = task
+
+			return nil
+		})
+}
+
+// ---------------------------------------------------------
+
+// MaterializeHandler is a REST handler that starts (or resumes) the
+// materialization of an alias into a target index.
+type MaterializeHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewMaterializeHandler(mgr *cbgt.Manager) *MaterializeHandler {
+	return &MaterializeHandler{mgr: mgr}
+}
+
+func (h *MaterializeHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	aliasName := mux.Vars(req)["indexName"]
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("materialize: could not read"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	mreq := &MaterializeRequest{}
+	err = json.Unmarshal(requestBody, mreq)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("materialize: could not parse"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	err = Materialize(h.mgr, aliasName, mreq)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// MaterializeTasksHandler is a REST handler that returns the
+// materialization tasks of an alias.
+type MaterializeTasksHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewMaterializeTasksHandler(mgr *cbgt.Manager) *MaterializeTasksHandler {
+	return &MaterializeTasksHandler{mgr: mgr}
+}
+
+func (h *MaterializeTasksHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	aliasName := mux.Vars(req)["indexName"]
+
+	mts := &MaterializeTasks{}
+	_, _, err := CfgGetJSON(h.mgr.Cfg(), MATERIALIZE_TASKS_KEY, mts)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("materialize: could not"+
+			" retrieve tasks, err: %v", err), 500)
+		return
+	}
+
+	tasks := map[string]*MaterializeTask{}
+	for targetName, task := range mts.Tasks {
+		if task.AliasName == aliasName {
+			tasks[targetName] = task
+		}
+	}
+
+	rest.MustEncode(w, struct {
+		Status string                      `json:"status"`
+		Tasks  map[string]*MaterializeTask `json:"tasks"`
+	}{
+		Status: "ok",
+		Tasks:  tasks,
+	})
+}
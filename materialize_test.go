@@ -0,0 +1,130 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestMaterializeDoc(t *testing.T) {
+	actual := MaterializeDoc(map[string]interface{}{
+		"name":         "x",
+		"address.city": "sf",
+		"address.zip":  "94111",
+		"tags":         []interface{}{"a", "b"},
+	})
+	expected := map[string]interface{}{
+		"name": "x",
+		"address": map[string]interface{}{
+			"city": "sf",
+			"zip":  "94111",
+		},
+		"tags": []interface{}{"a", "b"},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected: %#v, got: %#v", expected, actual)
+	}
+}
+
+func TestMaterialize(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	for _, name := range []string{"src0", "src1", "tgt"} {
+		err := mgr.CreateIndex("primary", "", "", `{"numPartitions":1}`,
+			"bleve", name, "", cbgt.PlanParams{}, "")
+		if err != nil {
+			t.Fatalf("expected no err, got: %v", err)
+		}
+	}
+
+	err := mgr.CreateIndex("nil", "", "", "",
+		"alias", "a0", `{"targets":{"src0":{},"src1":{}}}`,
+		cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	feeds, _ := mgr.CurrentMaps()
+	for _, feed := range feeds {
+		if feed.IndexName() != "src0" && feed.IndexName() != "src1" {
+			continue
+		}
+		pf := feed.(*cbgt.PrimaryFeed)
+		pf.SnapshotStart("0", 1, 5)
+		for i := 1; i <= 5; i++ {
+			pf.DataUpdate("0",
+				[]byte(fmt.Sprintf("%s-%d", feed.IndexName(), i)),
+				uint64(i), []byte(`{"name":"x","address":{"city":"sf"}}`),
+				0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+		}
+	}
+
+	err = Materialize(mgr, "src0", &MaterializeRequest{Target: "tgt"})
+	if err == nil {
+		t.Errorf("expected err when not an alias")
+	}
+
+	err = Materialize(mgr, "a0", &MaterializeRequest{Target: "src1x"})
+	if err == nil {
+		t.Errorf("expected err on a missing target")
+	}
+
+	err = Materialize(mgr, "a0", &MaterializeRequest{
+		Target: "tgt",
+		Resume: true,
+	})
+	if err == nil {
+		t.Errorf("expected err on resume when nothing to resume")
+	}
+
+	MaterializeBatchSize = 3
+
+	err = Materialize(mgr, "a0", &MaterializeRequest{Target: "tgt"})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	var task *MaterializeTask
+	for i := 0; i < 100; i++ {
+		mts := &MaterializeTasks{}
+		CfgGetJSON(cfg, MATERIALIZE_TASKS_KEY, mts)
+		task = mts.Tasks["tgt"]
+		if task != nil && task.Status != MATERIALIZE_RUNNING {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if task == nil || task.Status != MATERIALIZE_DONE ||
+		task.DocsCopied != 10 || task.TotalDocs != 10 ||
+		task.LastDocID != "src1-5" {
+		t.Fatalf("expected done task, got: %#v", task)
+	}
+
+	count, err := CountBlevePIndexImpl(mgr, "tgt", "")
+	if err != nil || count != 10 {
+		t.Errorf("expected 10 docs in tgt, got: %d, err: %v", count, err)
+	}
+}
@@ -0,0 +1,572 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// A namespace lets a tenant manage its own indexes on a shared
+// cluster.  The indexes of a namespace are regular indexes whose
+// names are prefixed by the namespace's name and NAMESPACE_SEP, like
+// "acme__products".  Tenants use the /api/ns/{namespace}/... REST
+// routes with the namespace's auth key, where index names are local
+// to the namespace, so a tenant can't see or touch the indexes of
+// other namespaces.  A namespace may also have resource quotas,
+// which are enforced at index create/update time (see quota.go).
+
+// The Cfg key where the namespaces are kept.
+const NAMESPACES_KEY = "namespaces"
+
+// The separator between a namespace name and a local index name.
+const NAMESPACE_SEP = "__"
+
+// Namespace names can't have underscores, so that the first
+// NAMESPACE_SEP of an index name always ends the namespace name.
+var namespaceNameRE = regexp.MustCompile(`^[A-Za-z][0-9A-Za-z\-]*$`)
+
+// Namespaces is the Cfg entry of all namespaces.
+type Namespaces struct {
+	UUID string `json:"uuid"`
+
+	// Keyed by namespace name.
+	Namespaces map[string]*Namespace `json:"namespaces"`
+}
+
+type Namespace struct {
+	Name string `json:"name"`
+
+	// The sha256 hex of the namespace's auth key, where "" means
+	// that the namespace's routes don't need an auth key.
+	AuthKeyHash string `json:"authKeyHash,omitempty"`
+
+	// The max number of indexes in the namespace, where 0 means
+	// unlimited.
+	MaxIndexes int `json:"maxIndexes,omitempty"`
+
+	// The max total of estimated index disk usage of the namespace,
+	// across all nodes and replicas, where 0 means unlimited.
+	MaxDiskBytes int64 `json:"maxDiskBytes,omitempty"`
+
+	// The max total number of index partitions (plan pindexes) of
+	// the namespace, where 0 means unlimited.
+	MaxPartitions int `json:"maxPartitions,omitempty"`
+
+	// The max number of index partitions of any single index of the
+	// namespace, where 0 means unlimited.
+	MaxPartitionsPerIndex int `json:"maxPartitionsPerIndex,omitempty"`
+}
+
+// NamespaceIndexName returns the full index name of a local index
+// name of a namespace.
+func NamespaceIndexName(namespace, indexName string) string {
+	return namespace + NAMESPACE_SEP + indexName
+}
+
+// ParseNamespaceIndexName splits a full index name into its
+// namespace and local index name, where ok is false when the index
+// isn't in a namespace.
+func ParseNamespaceIndexName(fullName string) (
+	namespace, indexName string, ok bool) {
+	i := strings.Index(fullName, NAMESPACE_SEP)
+	if i <= 0 || !namespaceNameRE.MatchString(fullName[:i]) {
+		return "", fullName, false
+	}
+	return fullName[:i], fullName[i+len(NAMESPACE_SEP):], true
+}
+
+func namespaceAuthKeyHash(authKey string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(authKey)))
+}
+
+// GetNamespaces returns the namespaces from the Cfg.
+func GetNamespaces(cfg cbgt.Cfg) (*Namespaces, error) {
+	nss := &Namespaces{}
+	_, _, err := CfgGetJSON(cfg, NAMESPACES_KEY, nss)
+	if err != nil {
+		return nil, err
+	}
+	if nss.Namespaces == nil {
+		nss.Namespaces = map[string]*Namespace{}
+	}
+	return nss, nil
+}
+
+// GetNamespace returns a namespace from the Cfg, or nil if it
+// doesn't exist.
+func GetNamespace(cfg cbgt.Cfg, name string) (*Namespace, error) {
+	nss, err := GetNamespaces(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return nss.Namespaces[name], nil
+}
+
+// SetNamespace creates or replaces a namespace in the Cfg.
+func SetNamespace(cfg cbgt.Cfg, ns *Namespace) error {
+	if !namespaceNameRE.MatchString(ns.Name) {
+		return fmt.Errorf("namespace: invalid namespace name: %q,"+
+			" must match: %s", ns.Name, namespaceNameRE)
+	}
+	if ns.MaxIndexes < 0 || ns.MaxDiskBytes < 0 ||
+		ns.MaxPartitions < 0 || ns.MaxPartitionsPerIndex < 0 {
+		return fmt.Errorf("namespace: maxIndexes, maxDiskBytes," +
+			" maxPartitions and maxPartitionsPerIndex must be >= 0")
+	}
+
+	return CfgUpdateJSON(cfg, NAMESPACES_KEY,
+		func() interface{} { return &Namespaces{} },
+		func(v interface{}) error {
+			nss := v.(*Namespaces)
+			if nss.Namespaces == nil {
+				nss.Namespaces = map[string]*Namespace{}
+			}
+			nss.UUID = cbgt.NewUUID()
+			nss.Namespaces[ns.Name] = ns
+			return nil
+		})
+}
+
+// DeleteNamespace removes a namespace from the Cfg, which must not
+// have any indexes.
+func DeleteNamespace(mgr *cbgt.Manager, name string) error {
+	indexNames, err := NamespaceIndexNames(mgr, name)
+	if err != nil {
+		return err
+	}
+	if len(indexNames) > 0 {
+		return fmt.Errorf("namespace: namespace: %s still has indexes: %v",
+			name, indexNames)
+	}
+
+	return CfgUpdateJSON(mgr.Cfg(), NAMESPACES_KEY,
+		func() interface{} { return &Namespaces{} },
+		func(v interface{}) error {
+			nss := v.(*Namespaces)
+			if nss.Namespaces[name] == nil {
+				return fmt.Errorf("namespace: no namespace: %s", name)
+			}
+			nss.UUID = cbgt.NewUUID()
+			delete(nss.Namespaces, name)
+			return nil
+		})
+}
+
+// NamespaceIndexNames returns the sorted, full names of the indexes
+// of a namespace.
+func NamespaceIndexNames(mgr *cbgt.Manager, namespace string) (
+	[]string, error) {
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []string{}
+	for fullName := range indexDefsByName {
+		ns, _, ok := ParseNamespaceIndexName(fullName)
+		if ok && ns == namespace {
+			rv = append(rv, fullName)
+		}
+	}
+	sort.Strings(rv)
+
+	return rv, nil
+}
+
+// namespaceAuthorized returns true if a request has the auth key of a
+// namespace, either as a bearer token or as a basic auth password.
+func namespaceAuthorized(ns *Namespace, req *http.Request) bool {
+	if ns.AuthKeyHash == "" {
+		return true
+	}
+
+	authKey := ""
+	if a := req.Header.Get("Authorization"); strings.HasPrefix(a, "Bearer ") {
+		authKey = strings.TrimSpace(strings.TrimPrefix(a, "Bearer "))
+	} else if _, password, ok := req.BasicAuth(); ok {
+		authKey = password
+	}
+	if authKey == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(
+		[]byte(namespaceAuthKeyHash(authKey)),
+		[]byte(ns.AuthKeyHash)) == 1
+}
+
+// namespaceAuthorize looks up the namespace of a tenant request and
+// checks its auth key, showing an error and returning nil if the
+// request isn't allowed.
+func namespaceAuthorize(mgr *cbgt.Manager,
+	w http.ResponseWriter, req *http.Request) *Namespace {
+	namespace := mux.Vars(req)["namespace"]
+
+	ns, err := GetNamespace(mgr.Cfg(), namespace)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("namespace: could not"+
+			" retrieve namespaces, err: %v", err), 500)
+		return nil
+	}
+	if ns == nil {
+		rest.ShowError(w, req, fmt.Sprintf("namespace: no namespace: %s",
+			namespace), 404)
+		return nil
+	}
+
+	if !namespaceAuthorized(ns, req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+namespace+`"`)
+		rest.ShowError(w, req, fmt.Sprintf("namespace: not authorized"+
+			" for namespace: %s", namespace), 401)
+		return nil
+	}
+
+	return ns
+}
+
+// namespaceAliasParams prefixes the target index names of alias index
+// params with a namespace.
+func namespaceAliasParams(namespace, indexParams string) (string, error) {
+	params := AliasParams{}
+	err := json.Unmarshal([]byte(indexParams), &params)
+	if err != nil {
+		return "", fmt.Errorf("namespace: could not parse alias params,"+
+			" err: %v", err)
+	}
+
+	targets := map[string]*AliasParamsTarget{}
+	for indexName, target := range params.Targets {
+		targets[NamespaceIndexName(namespace, indexName)] = target
+	}
+	params.Targets = targets
+
+	buf, err := json.Marshal(&params)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// ---------------------------------------------------------
+
+// NamespaceListHandler is a REST handler that returns the namespaces.
+type NamespaceListHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewNamespaceListHandler(mgr *cbgt.Manager) *NamespaceListHandler {
+	return &NamespaceListHandler{mgr: mgr}
+}
+
+type namespaceView struct {
+	Name                  string          `json:"name"`
+	HasAuthKey            bool            `json:"hasAuthKey"`
+	MaxIndexes            int             `json:"maxIndexes"`
+	MaxDiskBytes          int64           `json:"maxDiskBytes"`
+	MaxPartitions         int             `json:"maxPartitions"`
+	MaxPartitionsPerIndex int             `json:"maxPartitionsPerIndex"`
+	Indexes               []string        `json:"indexes"`
+	Usage                 *NamespaceUsage `json:"usage"`
+}
+
+func (h *NamespaceListHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	nss, err := GetNamespaces(h.mgr.Cfg())
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("namespace: could not"+
+			" retrieve namespaces, err: %v", err), 500)
+		return
+	}
+
+	views := map[string]*namespaceView{}
+	for name, ns := range nss.Namespaces {
+		indexNames, err := NamespaceIndexNames(h.mgr, name)
+		if err != nil {
+			rest.ShowError(w, req, err.Error(), 500)
+			return
+		}
+		usage, err := CalcNamespaceUsage(h.mgr, name, "")
+		if err != nil {
+			rest.ShowError(w, req, err.Error(), 500)
+			return
+		}
+		views[name] = &namespaceView{
+			Name:                  name,
+			HasAuthKey:            ns.AuthKeyHash != "",
+			MaxIndexes:            ns.MaxIndexes,
+			MaxDiskBytes:          ns.MaxDiskBytes,
+			MaxPartitions:         ns.MaxPartitions,
+			MaxPartitionsPerIndex: ns.MaxPartitionsPerIndex,
+			Indexes:               indexNames,
+			Usage:                 usage,
+		}
+	}
+
+	rest.MustEncode(w, struct {
+		Status     string                    `json:"status"`
+		Namespaces map[string]*namespaceView `json:"namespaces"`
+	}{
+		Status:     "ok",
+		Namespaces: views,
+	})
+}
+
+// NamespacePutHandler is a REST handler that creates or updates a
+// namespace.
+type NamespacePutHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewNamespacePutHandler(mgr *cbgt.Manager) *NamespacePutHandler {
+	return &NamespacePutHandler{mgr: mgr}
+}
+
+func (h *NamespacePutHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	namespace := mux.Vars(req)["namespace"]
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("namespace: could not read"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	var r struct {
+		AuthKey               *string `json:"authKey"`
+		MaxIndexes            int     `json:"maxIndexes"`
+		MaxDiskBytes          int64   `json:"maxDiskBytes"`
+		MaxPartitions         int     `json:"maxPartitions"`
+		MaxPartitionsPerIndex int     `json:"maxPartitionsPerIndex"`
+	}
+	if len(bytes.TrimSpace(requestBody)) > 0 {
+		err = json.Unmarshal(requestBody, &r)
+		if err != nil {
+			rest.ShowError(w, req, fmt.Sprintf("namespace: could not"+
+				" parse request body, err: %v", err), 400)
+			return
+		}
+	}
+
+	ns := &Namespace{
+		Name:                  namespace,
+		MaxIndexes:            r.MaxIndexes,
+		MaxDiskBytes:          r.MaxDiskBytes,
+		MaxPartitions:         r.MaxPartitions,
+		MaxPartitionsPerIndex: r.MaxPartitionsPerIndex,
+	}
+
+	if r.AuthKey != nil {
+		if *r.AuthKey != "" {
+			ns.AuthKeyHash = namespaceAuthKeyHash(*r.AuthKey)
+		}
+	} else {
+		// Keep the auth key of an existing namespace.
+		prev, err := GetNamespace(h.mgr.Cfg(), namespace)
+		if err != nil {
+			rest.ShowError(w, req, err.Error(), 500)
+			return
+		}
+		if prev != nil {
+			ns.AuthKeyHash = prev.AuthKeyHash
+		}
+	}
+
+	err = SetNamespace(h.mgr.Cfg(), ns)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// NamespaceDeleteHandler is a REST handler that deletes a namespace.
+type NamespaceDeleteHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewNamespaceDeleteHandler(mgr *cbgt.Manager) *NamespaceDeleteHandler {
+	return &NamespaceDeleteHandler{mgr: mgr}
+}
+
+func (h *NamespaceDeleteHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	err := DeleteNamespace(h.mgr, mux.Vars(req)["namespace"])
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// NamespaceIndexListHandler is a REST handler that returns the index
+// definitions of a namespace, keyed by their local index names.
+type NamespaceIndexListHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewNamespaceIndexListHandler(mgr *cbgt.Manager) *NamespaceIndexListHandler {
+	return &NamespaceIndexListHandler{mgr: mgr}
+}
+
+func (h *NamespaceIndexListHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	ns := namespaceAuthorize(h.mgr, w, req)
+	if ns == nil {
+		return
+	}
+
+	_, indexDefsByName, err := h.mgr.GetIndexDefs(false)
+	if err != nil {
+		rest.ShowError(w, req, "could not retrieve index defs", 500)
+		return
+	}
+
+	indexDefs := map[string]*cbgt.IndexDef{}
+	for fullName, indexDef := range indexDefsByName {
+		namespace, indexName, ok := ParseNamespaceIndexName(fullName)
+		if ok && namespace == ns.Name {
+			indexDefs[indexName] = indexDef
+		}
+	}
+
+	rest.MustEncode(w, struct {
+		Status    string                    `json:"status"`
+		IndexDefs map[string]*cbgt.IndexDef `json:"indexDefs"`
+	}{
+		Status:    "ok",
+		IndexDefs: indexDefs,
+	})
+}
+
+// NamespaceIndexHandler is a REST handler for the tenant routes of a
+// namespace's index, like /api/ns/{namespace}/index/{indexName}/query,
+// which authorizes the request and then has the router handle it as
+// the corresponding /api/index/{fullIndexName}/... request.
+type NamespaceIndexHandler struct {
+	mgr *cbgt.Manager
+	r   *mux.Router
+}
+
+func NewNamespaceIndexHandler(mgr *cbgt.Manager,
+	r *mux.Router) *NamespaceIndexHandler {
+	return &NamespaceIndexHandler{mgr: mgr, r: r}
+}
+
+func (h *NamespaceIndexHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	ns := namespaceAuthorize(h.mgr, w, req)
+	if ns == nil {
+		return
+	}
+
+	indexName := mux.Vars(req)["indexName"]
+
+	prefix := "/api/ns/" + ns.Name + "/index/" + indexName
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		rest.ShowError(w, req, "namespace: unexpected path", 400)
+		return
+	}
+	suffix := strings.TrimPrefix(req.URL.Path, prefix)
+
+	if req.Method == "PUT" && suffix == "" {
+		err := h.prepareCreate(ns, req)
+		if err != nil {
+			rest.ShowError(w, req, err.Error(), 400)
+			return
+		}
+	}
+
+	req.URL.Path = "/api/index/" +
+		NamespaceIndexName(ns.Name, indexName) + suffix
+
+	h.r.ServeHTTP(w, req)
+}
+
+// prepareCreate has the target index names of an alias index create
+// request refer to the namespace's indexes.
+func (h *NamespaceIndexHandler) prepareCreate(ns *Namespace,
+	req *http.Request) error {
+	err := req.ParseForm()
+	if err != nil {
+		return fmt.Errorf("namespace: could not parse form, err: %v", err)
+	}
+
+	var requestBody []byte
+	if req.Body != nil {
+		requestBody, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return fmt.Errorf("namespace: could not read request body,"+
+				" err: %v", err)
+		}
+	}
+
+	var body map[string]interface{}
+	if len(bytes.TrimSpace(requestBody)) > 0 {
+		json.Unmarshal(requestBody, &body) // Non-JSON is left as-is.
+	}
+
+	indexType := req.Form.Get("indexType")
+	if indexType == "" && body != nil {
+		indexType, _ = body["type"].(string)
+	}
+
+	if indexType == "alias" {
+		if s := req.Form.Get("indexParams"); s != "" {
+			s, err = namespaceAliasParams(ns.Name, s)
+			if err != nil {
+				return err
+			}
+			req.Form.Set("indexParams", s)
+		} else if body != nil && body["params"] != nil {
+			s, ok := body["params"].(string)
+			if !ok {
+				buf, _ := json.Marshal(body["params"])
+				s = string(buf)
+			}
+			s, err = namespaceAliasParams(ns.Name, s)
+			if err != nil {
+				return err
+			}
+			body["params"] = s
+			requestBody, err = json.Marshal(body)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(requestBody))
+	req.ContentLength = int64(len(requestBody))
+
+	return nil
+}
@@ -0,0 +1,195 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestParseNamespaceIndexName(t *testing.T) {
+	tests := []struct {
+		fullName  string
+		namespace string
+		indexName string
+		ok        bool
+	}{
+		{"acme__products", "acme", "products", true},
+		{"acme__x__y", "acme", "x__y", true},
+		{"products", "", "products", false},
+		{"my_idx__x", "", "my_idx__x", false},
+		{"__x", "", "__x", false},
+	}
+
+	for i, test := range tests {
+		namespace, indexName, ok := ParseNamespaceIndexName(test.fullName)
+		if namespace != test.namespace || indexName != test.indexName ||
+			ok != test.ok {
+			t.Errorf("%d: expected: %#v, got: %s, %s, %v",
+				i, test, namespace, indexName, ok)
+		}
+		if ok && NamespaceIndexName(namespace, indexName) != test.fullName {
+			t.Errorf("%d: expected round trip", i)
+		}
+	}
+}
+
+func TestNamespaceAuthorized(t *testing.T) {
+	ns := &Namespace{Name: "acme"}
+
+	req, _ := http.NewRequest("GET", "/api/ns/acme/index", nil)
+	if !namespaceAuthorized(ns, req) {
+		t.Errorf("expected a namespace without an auth key to be open")
+	}
+
+	ns.AuthKeyHash = namespaceAuthKeyHash("secret")
+	if namespaceAuthorized(ns, req) {
+		t.Errorf("expected a missing auth key to be unauthorized")
+	}
+
+	req.Header.Set("Authorization", "Bearer wrong")
+	if namespaceAuthorized(ns, req) {
+		t.Errorf("expected a wrong auth key to be unauthorized")
+	}
+
+	req.Header.Set("Authorization", "Bearer secret")
+	if !namespaceAuthorized(ns, req) {
+		t.Errorf("expected a bearer auth key to be authorized")
+	}
+
+	req.Header.Del("Authorization")
+	req.SetBasicAuth("acme", "secret")
+	if !namespaceAuthorized(ns, req) {
+		t.Errorf("expected a basic auth key to be authorized")
+	}
+}
+
+func TestNamespaceAliasParams(t *testing.T) {
+	s, err := namespaceAliasParams("acme",
+		`{"targets":{"a":{},"b":{"indexUUID":"u1"}}}`)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	params := AliasParams{}
+	json.Unmarshal([]byte(s), &params)
+	if len(params.Targets) != 2 ||
+		params.Targets["acme__a"] == nil ||
+		params.Targets["acme__b"].IndexUUID != "u1" {
+		t.Errorf("expected namespaced targets, got: %s", s)
+	}
+
+	_, err = namespaceAliasParams("acme", "not json")
+	if err == nil {
+		t.Errorf("expected err on bad params")
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	err := SetNamespace(cfg, &Namespace{Name: "bad_name"})
+	if err == nil {
+		t.Errorf("expected err on a bad namespace name")
+	}
+
+	err = SetNamespace(cfg, &Namespace{
+		Name:        "acme",
+		AuthKeyHash: namespaceAuthKeyHash("secret"),
+		MaxIndexes:  1,
+	})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	err = mgr.CreateIndex("nil", "", "", "",
+		"blackhole", "acme__a", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	r := mux.NewRouter()
+
+	var gotIndexName string
+	r.HandleFunc("/api/index/{indexName}/count",
+		func(w http.ResponseWriter, req *http.Request) {
+			gotIndexName = mux.Vars(req)["indexName"]
+		}).Methods("GET")
+	r.Handle("/api/ns/{namespace}/index/{indexName}/count",
+		NewNamespaceIndexHandler(mgr, r)).Methods("GET")
+	r.Handle("/api/ns/{namespace}/index",
+		NewNamespaceIndexListHandler(mgr)).Methods("GET")
+
+	req, _ := http.NewRequest("GET", "/api/ns/acme/index/a/count", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != 401 || gotIndexName != "" {
+		t.Errorf("expected 401 without an auth key, got: %d", rr.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer secret")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != 200 || gotIndexName != "acme__a" {
+		t.Errorf("expected namespaced index name, got: %d, %s",
+			rr.Code, gotIndexName)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/ns/acme/index", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	var res struct {
+		IndexDefs map[string]*cbgt.IndexDef `json:"indexDefs"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &res)
+	if rr.Code != 200 || len(res.IndexDefs) != 1 ||
+		res.IndexDefs["a"] == nil {
+		t.Errorf("expected local index names, got: %s", rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/api/ns/missing/index", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != 404 {
+		t.Errorf("expected 404 on a missing namespace, got: %d", rr.Code)
+	}
+
+	err = DeleteNamespace(mgr, "acme")
+	if err == nil {
+		t.Errorf("expected err on deleting a namespace with indexes")
+	}
+
+	err = mgr.DeleteIndex("acme__a")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	err = DeleteNamespace(mgr, "acme")
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+}
@@ -0,0 +1,414 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+)
+
+// The elements of an array of objects are normally flattened into
+// their parent document, so a query for items.color:red AND
+// items.size:L matches a document whose red item and L item are
+// different elements.  A bleve index with "nested" paths, like...
+//
+//   {"mapping": {...}, "nested": ["items"]}
+//
+// also indexes each object element of the arrays at those paths as a
+// hidden nested document, with the same structure and mapping type as
+// its parent, but with only that one element at the path.  A nested
+// query then matches the parents of the nested documents that match
+// its inner query, like...
+//
+//   {"nested": {"path": "items",
+//               "query": {"conjuncts": [
+//                  {"field": "items.color", "match": "red"},
+//                  {"field": "items.size", "match": "L"}]}}}
+//
+// where the nested query is rewritten before scatter/gather into an
+// ids query of the matching parents, as the nested documents and
+// their parents can be in any partition.  Nested documents are
+// excluded from the results of every query.  The nested documents of
+// a parent are replaced when the parent is updated, and are removed
+// when the parent is deleted.
+
+// The keyword field where the path of a nested document is indexed.
+const NESTED_PATH_FIELD = "$nestedPath"
+
+// The keyword field where the parent doc ID of a nested document is
+// indexed.
+const NESTED_PARENT_FIELD = "$nestedParent"
+
+// Separates the parent doc ID, path and element position of the doc
+// ID of a nested document.
+const NESTED_KEY_SEP = "\x00"
+
+// The max number of parents that a nested query can match, and the
+// max number of nested documents of a parent.
+var NestedMaxDocs = 10000
+
+// validateNestedPaths checks the nested paths of the index params.
+func validateNestedPaths(paths []string) error {
+	seen := map[string]bool{}
+	for _, p := range paths {
+		if p == "" || strings.HasPrefix(p, "$") ||
+			strings.HasPrefix(p, ".") || strings.HasSuffix(p, ".") ||
+			strings.Contains(p, NESTED_KEY_SEP) {
+			return fmt.Errorf("nested: bad path: %q", p)
+		}
+		if seen[p] {
+			return fmt.Errorf("nested: duplicate path: %q", p)
+		}
+		seen[p] = true
+	}
+	return nil
+}
+
+// applyNestedMapping adds keyword NESTED_PATH_FIELD and
+// NESTED_PARENT_FIELD mappings to the default mapping and type
+// mappings of an index mapping.
+func applyNestedMapping(m *bleve.IndexMapping) {
+	add := func(dm *bleve.DocumentMapping) {
+		if dm == nil {
+			return
+		}
+		for _, field := range []string{NESTED_PATH_FIELD, NESTED_PARENT_FIELD} {
+			fm := bleve.NewTextFieldMapping()
+			fm.Analyzer = "keyword"
+			fm.Store = false
+			fm.IncludeTermVectors = false
+			fm.IncludeInAll = false
+			dm.AddFieldMappingsAt(field, fm)
+		}
+	}
+
+	add(m.DefaultMapping)
+	for _, dm := range m.TypeMapping {
+		add(dm)
+	}
+}
+
+// nestedGet returns the value at a dotted path of a parsed JSON
+// document.
+func nestedGet(v interface{}, path string) interface{} {
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = obj[part]
+	}
+	return v
+}
+
+// nestedSet sets the value at a dotted path of a parsed JSON
+// document, creating the intermediate objects.
+func nestedSet(m map[string]interface{}, path string, v interface{}) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		obj, ok := m[part].(map[string]interface{})
+		if !ok {
+			obj = map[string]interface{}{}
+			m[part] = obj
+		}
+		m = obj
+	}
+	m[parts[len(parts)-1]] = v
+}
+
+// walkFieldValues replaces the values at a dotted path of a parsed
+// JSON document, or the elements of an array at that path, with the
+// results of convert, where a nil result removes the value or
+// element.  Unlike nestedGet, arrays of objects along the path are
+// walked, like bleve does when it indexes them.
+func walkFieldValues(m map[string]interface{}, path string,
+	convert func(interface{}) interface{}) {
+	walkFieldValuesParts(m, strings.Split(path, "."), convert)
+}
+
+func walkFieldValuesParts(v interface{}, parts []string,
+	convert func(interface{}) interface{}) interface{} {
+	if len(parts) <= 0 {
+		switch x := v.(type) {
+		case nil:
+			return nil
+		case []interface{}:
+			rv := make([]interface{}, 0, len(x))
+			for _, elem := range x {
+				if elem = convert(elem); elem != nil {
+					rv = append(rv, elem)
+				}
+			}
+			return rv
+		default:
+			return convert(x)
+		}
+	}
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if sub, exists := x[parts[0]]; exists {
+			x[parts[0]] = walkFieldValuesParts(sub, parts[1:], convert)
+		}
+	case []interface{}:
+		for i, elem := range x {
+			x[i] = walkFieldValuesParts(elem, parts, convert)
+		}
+	}
+	return v
+}
+
+// nestedKey returns the doc ID of a nested document.
+func nestedKey(parent, path string, i int) string {
+	return fmt.Sprintf("%s%s%s%s%d",
+		parent, NESTED_KEY_SEP, path, NESTED_KEY_SEP, i)
+}
+
+// nestedParentKey returns the parent doc ID of a nested document's
+// doc ID, or "" when the doc ID isn't of a nested document.
+func nestedParentKey(key string) string {
+	i := strings.Index(key, NESTED_KEY_SEP)
+	if i < 0 {
+		return ""
+	}
+	return key[:i]
+}
+
+// nestedDocs returns the nested documents of a parsed JSON document,
+// keyed by doc ID.
+func nestedDocs(m *bleve.IndexMapping, key string,
+	doc map[string]interface{}, paths []string) map[string]interface{} {
+	typeField := m.TypeField
+	if typeField == "" {
+		typeField = "_type"
+	}
+	typeValue := nestedGet(doc, typeField)
+
+	rv := map[string]interface{}{}
+	for _, path := range paths {
+		elems, ok := nestedGet(doc, path).([]interface{})
+		if !ok {
+			continue
+		}
+		for i, elem := range elems {
+			if _, ok := elem.(map[string]interface{}); !ok {
+				continue
+			}
+			if len(rv) >= NestedMaxDocs {
+				return rv
+			}
+			n := map[string]interface{}{
+				NESTED_PATH_FIELD:   path,
+				NESTED_PARENT_FIELD: key,
+			}
+			if typeValue != nil {
+				nestedSet(n, typeField, typeValue)
+			}
+			nestedSet(n, path, elem)
+			rv[nestedKey(key, path, i)] = n
+		}
+	}
+	return rv
+}
+
+// nestedTermQuery returns the JSON of a term query on a keyword field.
+func nestedTermQuery(field, term string) map[string]interface{} {
+	return map[string]interface{}{"term": term, "field": field}
+}
+
+// ---------------------------------------------------------
+
+// deleteNestedUnlocked adds the deletion of the current nested
+// documents of a parent to the batch, including the nested documents
+// of the parent that are still in the batch.
+func (t *BleveDestPartition) deleteNestedUnlocked(key string) error {
+	for _, id := range t.nestedPending[key] {
+		t.batch.Delete(id)
+	}
+	delete(t.nestedPending, key)
+
+	q := bleve.NewTermQuery(key)
+	q.SetField(NESTED_PARENT_FIELD)
+	res, err := t.bindex.Search(bleve.NewSearchRequestOptions(q,
+		NestedMaxDocs, 0, false))
+	if err != nil {
+		return err
+	}
+	for _, hit := range res.Hits {
+		t.batch.Delete(hit.ID)
+	}
+	return nil
+}
+
+// indexNestedUnlocked adds the nested documents of a parent to the
+// batch, replacing its previous nested documents.
+func (t *BleveDestPartition) indexNestedUnlocked(key string,
+	doc map[string]interface{}) error {
+	err := t.deleteNestedUnlocked(key)
+	if err != nil {
+		return err
+	}
+
+	for id, n := range nestedDocs(t.bindex.Mapping(), key, doc,
+		t.bdest.nested) {
+		err = t.batch.Index(id, n)
+		if err != nil {
+			return err
+		}
+		if t.nestedPending == nil {
+			t.nestedPending = map[string][]string{}
+		}
+		t.nestedPending[key] = append(t.nestedPending[key], id)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------
+
+// rewriteNestedQueries rewrites any nested queries in a JSON search
+// request into ids queries of the matching parents, and excludes the
+// nested documents from the results.  The targets callback is invoked
+// lazily, only when there are nested queries.
+func rewriteNestedQueries(req []byte, paths []string,
+	targets func() ([]bleve.Index, error)) ([]byte, error) {
+	if len(paths) <= 0 {
+		return req, nil
+	}
+
+	isPath := map[string]bool{}
+	for _, p := range paths {
+		isPath[p] = true
+	}
+
+	req, err := rewriteQueryRequest(req, func(q map[string]interface{}) (
+		interface{}, error) {
+		nq, ok := q["nested"].(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+
+		path, _ := nq["path"].(string)
+		if !isPath[path] {
+			return nil, fmt.Errorf("nested: path: %q is not a nested"+
+				" path of the index", path)
+		}
+		inner, exists := nq["query"]
+		if !exists {
+			return nil, fmt.Errorf("nested: query needed, path: %s", path)
+		}
+
+		indexes, err := targets()
+		if err != nil {
+			return nil, err
+		}
+
+		parents, err := nestedParents(indexes, path, inner)
+		if err != nil {
+			return nil, err
+		}
+		if len(parents) <= 0 {
+			return map[string]interface{}{
+				"match_none": map[string]interface{}{}}, nil
+		}
+
+		rv := map[string]interface{}{"ids": parents}
+		if boost, exists := q["boost"]; exists {
+			rv["boost"] = jsonFloat(boost, 1.0)
+		}
+		return rv, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nestedExclude(req, paths)
+}
+
+// nestedParents returns the parent doc IDs of the nested documents at
+// a path that match a query.
+func nestedParents(indexes []bleve.Index, path string,
+	inner interface{}) ([]string, error) {
+	qBytes, err := json.Marshal(map[string]interface{}{
+		"conjuncts": []interface{}{
+			inner, nestedTermQuery(NESTED_PATH_FIELD, path),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	q, err := bleve.ParseQuery(qBytes)
+	if err != nil {
+		return nil, fmt.Errorf("nested: query, path: %s, err: %v", path, err)
+	}
+
+	seen := map[string]bool{}
+	var rv []string
+	for _, index := range indexes {
+		res, err := index.Search(bleve.NewSearchRequestOptions(q,
+			NestedMaxDocs, 0, false))
+		if err != nil {
+			return nil, err
+		}
+		if res.Total > uint64(len(res.Hits)) {
+			return nil, fmt.Errorf("nested: query, path: %s, matched"+
+				" more than %d nested documents", path, NestedMaxDocs)
+		}
+		for _, hit := range res.Hits {
+			parent := nestedParentKey(hit.ID)
+			if parent != "" && !seen[parent] {
+				seen[parent] = true
+				rv = append(rv, parent)
+			}
+		}
+	}
+	if len(rv) > NestedMaxDocs {
+		return nil, fmt.Errorf("nested: query, path: %s, matched more"+
+			" than %d parents", path, NestedMaxDocs)
+	}
+	return rv, nil
+}
+
+// nestedExclude rewrites the query of a JSON search request so that
+// the nested documents at the paths don't match.
+func nestedExclude(req []byte, paths []string) ([]byte, error) {
+	v, err := parseJSONUseNumber(req)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return req, nil
+	}
+	q, exists := m["query"]
+	if !exists {
+		return req, nil
+	}
+
+	disjuncts := make([]interface{}, 0, len(paths))
+	for _, p := range paths {
+		disjuncts = append(disjuncts, nestedTermQuery(NESTED_PATH_FIELD, p))
+	}
+
+	m["query"] = map[string]interface{}{
+		"must": map[string]interface{}{
+			"conjuncts": []interface{}{q},
+		},
+		"must_not": map[string]interface{}{
+			"disjuncts": disjuncts,
+		},
+	}
+
+	return json.Marshal(m)
+}
@@ -0,0 +1,172 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestValidateNestedPaths(t *testing.T) {
+	err := ValidateBlevePIndexImpl("bleve", "idx",
+		`{"nested":["items","order.lines"]}`)
+	if err != nil {
+		t.Errorf("expected valid params, got: %v", err)
+	}
+
+	for _, paths := range [][]string{
+		{""}, {"$x"}, {".items"}, {"items."}, {"items", "items"},
+	} {
+		if validateNestedPaths(paths) == nil {
+			t.Errorf("expected err, paths: %v", paths)
+		}
+	}
+}
+
+func TestNestedDocs(t *testing.T) {
+	m := bleve.NewIndexMapping()
+	m.TypeField = "type"
+
+	var doc map[string]interface{}
+	json.Unmarshal([]byte(`{"type":"order","order":{"lines":[
+		{"sku":"a"}, "junk", {"sku":"b"}]}, "items":{"x":1}}`), &doc)
+
+	docs := nestedDocs(m, "k", doc, []string{"order.lines", "items"})
+	if len(docs) != 2 {
+		t.Fatalf("expected 2 nested docs, got: %#v", docs)
+	}
+
+	n, _ := docs[nestedKey("k", "order.lines", 2)].(map[string]interface{})
+	if n == nil || n["type"] != "order" ||
+		n[NESTED_PATH_FIELD] != "order.lines" || n[NESTED_PARENT_FIELD] != "k" {
+		t.Fatalf("unexpected nested doc: %#v", n)
+	}
+	if nestedGet(n, "order.lines.sku") != "b" {
+		t.Errorf("expected only the element at the path, got: %#v", n)
+	}
+
+	if nestedParentKey(nestedKey("k", "order.lines", 2)) != "k" ||
+		nestedParentKey("k") != "" {
+		t.Errorf("unexpected parent keys")
+	}
+}
+
+func nestedTestSearch(t *testing.T, bindex bleve.Index, req string) []string {
+	rv, err := rewriteNestedQueries([]byte(req), []string{"items"},
+		func() ([]bleve.Index, error) {
+			return []bleve.Index{bindex}, nil
+		})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	sr := &bleve.SearchRequest{}
+	err = json.Unmarshal(rv, sr)
+	if err != nil {
+		t.Fatalf("expected no err, req: %s, got: %v", rv, err)
+	}
+	sr.Size = 100
+
+	res, err := bindex.Search(sr)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	var ids []string
+	for _, hit := range res.Hits {
+		ids = append(ids, hit.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestNestedQueries(t *testing.T) {
+	m := bleve.NewIndexMapping()
+	applyNestedMapping(m)
+
+	bindex, err := bleve.NewMemOnly(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bdest := NewBleveDest("/tmp/idx_1234_5678.pindex", bindex, func() {})
+	bdest.nested = []string{"items"}
+	dest := &cbgt.DestForwarder{DestProvider: bdest}
+	defer dest.Close()
+
+	update := func(key, val string, seq uint64) {
+		dest.SnapshotStart("0", seq, seq)
+		err := dest.DataUpdate("0", []byte(key), seq, []byte(val),
+			0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+		if err != nil {
+			t.Fatalf("expected no err, got: %v", err)
+		}
+	}
+
+	update("mixed", `{"items":[{"color":"red","size":"m"},`+
+		`{"color":"blue","size":"l"}]}`, 1)
+	update("match", `{"items":[{"color":"red","size":"l"}]}`, 2)
+
+	flat := `{"query":{"conjuncts":[{"field":"items.color","match":"red"},` +
+		`{"field":"items.size","match":"l"}]}}`
+	nested := `{"query":{"nested":{"path":"items","query":` +
+		`{"conjuncts":[{"field":"items.color","match":"red"},` +
+		`{"field":"items.size","match":"l"}]}}}}`
+
+	ids := nestedTestSearch(t, bindex, flat)
+	if len(ids) != 2 || ids[0] != "match" || ids[1] != "mixed" {
+		t.Errorf("expected the flattened parents only, got: %q", ids)
+	}
+
+	ids = nestedTestSearch(t, bindex, nested)
+	if len(ids) != 1 || ids[0] != "match" {
+		t.Errorf("expected per-element matching, got: %q", ids)
+	}
+
+	// Several updates in one batch replace the nested docs.
+	dest.SnapshotStart("0", 3, 5)
+	for i, val := range []string{
+		`{"items":[{"color":"red","size":"m"},{"color":"red","size":"l"}]}`,
+		`{"items":[{"color":"blue","size":"l"}]}`,
+	} {
+		dest.DataUpdate("0", []byte("mixed"), uint64(3+i), []byte(val),
+			0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+	}
+	dest.DataDelete("0", []byte("match"), 5, 0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+
+	ids = nestedTestSearch(t, bindex, nested)
+	if len(ids) != 0 {
+		t.Errorf("expected the nested docs to be replaced, got: %q", ids)
+	}
+
+	count, _ := bindex.DocCount()
+	if count != 2 {
+		t.Errorf("expected a parent and its nested doc, got: %d", count)
+	}
+
+	ids = nestedTestSearch(t, bindex, `{"query":{"match_all":{}}}`)
+	if len(ids) != 1 || ids[0] != "mixed" {
+		t.Errorf("expected the nested docs to be excluded, got: %q", ids)
+	}
+
+	_, err = rewriteNestedQueries([]byte(`{"query":{"nested":`+
+		`{"path":"other","query":{"match_all":{}}}}}`), []string{"items"},
+		func() ([]bleve.Index, error) { return nil, nil })
+	if err == nil {
+		t.Errorf("expected err on an unknown nested path")
+	}
+}
@@ -0,0 +1,746 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/blevesearch/bleve"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The percolator (or "reverse search") holds stored queries, which
+// are registered per index, and answers which stored queries match a
+// given document.  Stored queries that are marked as onIngest are
+// also evaluated against the incoming mutations of the index.
+//
+// So that the percolation doesn't slow down ingest, the mutations are
+// queued and percolated in batches by a background worker, where a
+// batch of an index is indexed into a single in-memory index, and
+// each onIngest query is searched once per batch.  When the queue is
+// full, mutations aren't percolated, and are counted as dropped.  The
+// matches are delivered to the webhooks that are subscribed to the
+// percolatorMatches event, and are also kept in a bounded list of
+// recent matches per index.  The stored queries of an index are
+// removed when the index is deleted.
+
+// The Cfg key where the stored percolator queries are kept.
+const PERCOLATOR_QUERIES_KEY = "percolatorQueries"
+
+// The max number of recent onIngest matches kept per index.
+var PercolatorMaxMatches = 1000
+
+// The max number of mutations that wait to be percolated, beyond
+// which mutations are dropped rather than slowing down ingest.
+var PercolatorQueueSize = 10000
+
+// The max number of mutations that are percolated together.
+var PercolatorBatchSize = 100
+
+// PercolatorQueries is the Cfg entry of all stored queries.
+type PercolatorQueries struct {
+	UUID string `json:"uuid"`
+
+	// Keyed by indexName, then by query name.
+	Queries map[string]map[string]*PercolatorQuery `json:"queries"`
+}
+
+// PercolatorQuery is a stored query.
+type PercolatorQuery struct {
+	Name     string          `json:"name"`
+	Query    json.RawMessage `json:"query"`
+	OnIngest bool            `json:"onIngest"`
+}
+
+// PercolatorMatch records the stored queries that matched a mutation
+// during ingest.
+type PercolatorMatch struct {
+	Time      string   `json:"time"`
+	DocID     string   `json:"docID"`
+	Partition string   `json:"partition"`
+	Seq       uint64   `json:"seq"`
+	Queries   []string `json:"queries"`
+}
+
+type percolatorCompiledQuery struct {
+	name  string
+	query bleve.Query
+}
+
+var percolatorM sync.Mutex // Protects the fields that follow.
+
+// Keyed by indexName, holding the compiled onIngest queries.
+var percolatorIngestQueries = map[string][]*percolatorCompiledQuery{}
+
+// Keyed by indexName, holding recent *PercolatorMatch'es.
+var percolatorMatches = map[string]*list.List{}
+
+// Keyed by indexName, the number of mutations that weren't
+// percolated as the queue was full.
+var percolatorDropped = map[string]uint64{}
+
+// The mutations that wait to be percolated.
+var percolatorQueue chan *percolatorDoc
+var percolatorQueueOnce sync.Once
+
+// A percolatorDoc is an incoming mutation that waits to be
+// percolated.
+type percolatorDoc struct {
+	indexName string
+	mapping   *bleve.IndexMapping
+	partition string
+	docID     string
+	seq       uint64
+	doc       interface{}
+}
+
+// ---------------------------------------------------------
+
+// PercolatorWatchCfg loads the stored queries and keeps the node's
+// cache of onIngest queries up to date with Cfg changes, and removes
+// the stored queries of deleted indexes.
+func PercolatorWatchCfg(cfg cbgt.Cfg) error {
+	ch := make(chan cbgt.CfgEvent, 1)
+
+	for _, key := range []string{PERCOLATOR_QUERIES_KEY,
+		cbgt.INDEX_DEFS_KEY} {
+		err := cfg.Subscribe(key, ch)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := percolatorPrune(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = percolatorRefresh(cfg)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for range ch {
+			err := percolatorPrune(cfg)
+			if err != nil {
+				log.Printf("percolator: prune, err: %v", err)
+			}
+			err = percolatorRefresh(cfg)
+			if err != nil {
+				log.Printf("percolator: refresh, err: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// percolatorPrune removes the stored queries and recent matches of
+// the indexes that no longer exist.
+func percolatorPrune(cfg cbgt.Cfg) error {
+	indexDefs, _, err := cbgt.CfgGetIndexDefs(cfg)
+	if err != nil {
+		return err
+	}
+
+	exists := func(indexName string) bool {
+		return indexDefs != nil && indexDefs.IndexDefs[indexName] != nil
+	}
+
+	percolatorM.Lock()
+	for indexName := range percolatorMatches {
+		if !exists(indexName) {
+			delete(percolatorMatches, indexName)
+			delete(percolatorDropped, indexName)
+		}
+	}
+	percolatorM.Unlock()
+
+	pqs := &PercolatorQueries{}
+	_, _, err = CfgGetJSON(cfg, PERCOLATOR_QUERIES_KEY, pqs)
+	if err != nil {
+		return err
+	}
+
+	stale := false
+	for indexName := range pqs.Queries {
+		if !exists(indexName) {
+			stale = true
+		}
+	}
+	if !stale {
+		return nil
+	}
+
+	return CfgUpdateJSON(cfg, PERCOLATOR_QUERIES_KEY,
+		func() interface{} { return &PercolatorQueries{} },
+		func(v interface{}) error {
+			pqs := v.(*PercolatorQueries)
+			for indexName := range pqs.Queries {
+				if !exists(indexName) {
+					delete(pqs.Queries, indexName)
+				}
+			}
+			pqs.UUID = cbgt.NewUUID()
+			return nil
+		})
+}
+
+func percolatorRefresh(cfg cbgt.Cfg) error {
+	pqs := &PercolatorQueries{}
+	_, _, err := CfgGetJSON(cfg, PERCOLATOR_QUERIES_KEY, pqs)
+	if err != nil {
+		return err
+	}
+
+	ingestQueries := map[string][]*percolatorCompiledQuery{}
+	for indexName, queries := range pqs.Queries {
+		for _, pq := range queries {
+			if !pq.OnIngest {
+				continue
+			}
+			q, err := bleve.ParseQuery(pq.Query)
+			if err != nil {
+				log.Printf("percolator: parse, indexName: %s,"+
+					" name: %s, err: %v", indexName, pq.Name, err)
+				continue
+			}
+			ingestQueries[indexName] = append(ingestQueries[indexName],
+				&percolatorCompiledQuery{name: pq.Name, query: q})
+		}
+	}
+
+	percolatorM.Lock()
+	percolatorIngestQueries = ingestQueries
+	percolatorM.Unlock()
+
+	return nil
+}
+
+// percolateOnIngest queues an incoming document of an index to be
+// percolated against the index's onIngest stored queries, without
+// waiting, where the document is dropped when the queue is full.
+func percolateOnIngest(indexName string, mapping *bleve.IndexMapping,
+	partition string, docID string, seq uint64, doc interface{}) {
+	percolatorM.Lock()
+	queries := percolatorIngestQueries[indexName]
+	percolatorM.Unlock()
+
+	if len(queries) <= 0 || mapping == nil {
+		return
+	}
+
+	percolatorQueueOnce.Do(func() {
+		percolatorQueue = make(chan *percolatorDoc, PercolatorQueueSize)
+		go percolatorWorker(percolatorQueue)
+	})
+
+	select {
+	case percolatorQueue <- &percolatorDoc{
+		indexName: indexName,
+		mapping:   mapping,
+		partition: partition,
+		docID:     docID,
+		seq:       seq,
+		doc:       doc,
+	}:
+	default:
+		percolatorM.Lock()
+		percolatorDropped[indexName]++
+		percolatorM.Unlock()
+	}
+}
+
+// percolatorWorker percolates the queued documents in batches.
+func percolatorWorker(queue chan *percolatorDoc) {
+	for pd := range queue {
+		batch := []*percolatorDoc{pd}
+
+	FILL:
+		for len(batch) < PercolatorBatchSize {
+			select {
+			case pd := <-queue:
+				batch = append(batch, pd)
+			default:
+				break FILL
+			}
+		}
+
+		percolateBatch(batch)
+	}
+}
+
+// percolateBatch percolates a batch of documents, grouped by their
+// index, and delivers the matches.
+func percolateBatch(batch []*percolatorDoc) {
+	for len(batch) > 0 {
+		indexName, mapping := batch[0].indexName, batch[0].mapping
+
+		var group, rest []*percolatorDoc
+		for _, pd := range batch {
+			if pd.indexName == indexName && pd.mapping == mapping {
+				group = append(group, pd)
+			} else {
+				rest = append(rest, pd)
+			}
+		}
+		batch = rest
+
+		percolatorM.Lock()
+		queries := percolatorIngestQueries[indexName]
+		percolatorM.Unlock()
+
+		if len(queries) <= 0 {
+			continue
+		}
+
+		// Only the latest mutation of a doc ID is percolated.
+		latest := map[string]*percolatorDoc{}
+		docs := map[string]interface{}{}
+		for _, pd := range group {
+			latest[pd.docID] = pd
+			docs[pd.docID] = pd.doc
+		}
+
+		matches, err := percolateDocs(mapping, queries, docs)
+		if err != nil {
+			log.Printf("percolator: percolateBatch, indexName: %s,"+
+				" err: %v", indexName, err)
+			continue
+		}
+
+		now := time.Now().Format(time.RFC3339Nano)
+
+		var ms []*PercolatorMatch
+		for _, pd := range group {
+			if latest[pd.docID] != pd || len(matches[pd.docID]) <= 0 {
+				continue
+			}
+			ms = append(ms, &PercolatorMatch{
+				Time:      now,
+				DocID:     pd.docID,
+				Partition: pd.partition,
+				Seq:       pd.seq,
+				Queries:   matches[pd.docID],
+			})
+		}
+		if len(ms) <= 0 {
+			continue
+		}
+
+		percolatorM.Lock()
+		l := percolatorMatches[indexName]
+		if l == nil {
+			l = list.New()
+			percolatorMatches[indexName] = l
+		}
+		for _, m := range ms {
+			for l.Len() >= PercolatorMaxMatches {
+				l.Remove(l.Front())
+			}
+			l.PushBack(m)
+		}
+		percolatorM.Unlock()
+
+		WebhookNotify(&WebhookEvent{
+			Event:     WEBHOOK_EVENT_PERCOLATOR_MATCHES,
+			IndexName: indexName,
+			Matches:   ms,
+		})
+	}
+}
+
+// Percolate returns the names of the stored queries that match a
+// document, where the document is analyzed using the given mapping.
+func Percolate(mapping *bleve.IndexMapping, queries []*PercolatorQuery,
+	docID string, doc interface{}) ([]string, error) {
+	compiled := make([]*percolatorCompiledQuery, 0, len(queries))
+	for _, pq := range queries {
+		q, err := bleve.ParseQuery(pq.Query)
+		if err != nil {
+			return nil, fmt.Errorf("percolator: parse, name: %s, err: %v",
+				pq.Name, err)
+		}
+		compiled = append(compiled,
+			&percolatorCompiledQuery{name: pq.Name, query: q})
+	}
+
+	matches, err := percolateDocs(mapping, compiled,
+		map[string]interface{}{docID: doc})
+	if err != nil {
+		return nil, err
+	}
+
+	rv := matches[docID]
+	if rv == nil {
+		rv = []string{}
+	}
+
+	return rv, nil
+}
+
+// percolateDocs returns the sorted names of the stored queries that
+// match each document, keyed by doc ID, by indexing the documents
+// into a single in-memory index.
+func percolateDocs(mapping *bleve.IndexMapping,
+	queries []*percolatorCompiledQuery,
+	docs map[string]interface{}) (map[string][]string, error) {
+	idx, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		return nil, err
+	}
+	defer idx.Close()
+
+	b := idx.NewBatch()
+	for docID, doc := range docs {
+		err = b.Index(docID, doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = idx.Batch(b)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string][]string{}
+	for _, q := range queries {
+		res, err := idx.Search(bleve.NewSearchRequestOptions(q.query,
+			len(docs), 0, false))
+		if err != nil {
+			return nil, fmt.Errorf("percolator: search, name: %s, err: %v",
+				q.name, err)
+		}
+		for _, hit := range res.Hits {
+			rv[hit.ID] = append(rv[hit.ID], q.name)
+		}
+	}
+
+	for _, names := range rv {
+		sort.Strings(names)
+	}
+
+	return rv, nil
+}
+
+// ---------------------------------------------------------
+
+// percolatorIndexDef returns the index definition for a bleve index.
+func percolatorIndexDef(mgr *cbgt.Manager, indexName string) (
+	*cbgt.IndexDef, error) {
+	_, indexDefsMap, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return nil, fmt.Errorf("percolator: could not retrieve index defs")
+	}
+	indexDef := indexDefsMap[indexName]
+	if indexDef == nil {
+		return nil, fmt.Errorf("percolator: not an index, indexName: %s",
+			indexName)
+	}
+	if !strings.HasPrefix(indexDef.Type, "bleve") {
+		return nil, fmt.Errorf("percolator: not a bleve index,"+
+			" indexName: %s", indexName)
+	}
+	return indexDef, nil
+}
+
+// PercolatorListHandler is a REST handler that lists the stored
+// queries of an index.
+type PercolatorListHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPercolatorListHandler(mgr *cbgt.Manager) *PercolatorListHandler {
+	return &PercolatorListHandler{mgr: mgr}
+}
+
+func (h *PercolatorListHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	_, err := percolatorIndexDef(h.mgr, indexName)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	pqs := &PercolatorQueries{}
+	_, _, err = CfgGetJSON(h.mgr.Cfg(), PERCOLATOR_QUERIES_KEY, pqs)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 500)
+		return
+	}
+
+	queries := pqs.Queries[indexName]
+	if queries == nil {
+		queries = map[string]*PercolatorQuery{}
+	}
+
+	rest.MustEncode(w, struct {
+		Status  string                      `json:"status"`
+		Queries map[string]*PercolatorQuery `json:"queries"`
+	}{
+		Status:  "ok",
+		Queries: queries,
+	})
+}
+
+// PercolatorPutHandler is a REST handler that creates or updates a
+// stored query of an index.
+type PercolatorPutHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPercolatorPutHandler(mgr *cbgt.Manager) *PercolatorPutHandler {
+	return &PercolatorPutHandler{mgr: mgr}
+}
+
+func (h *PercolatorPutHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+	queryName := mux.Vars(req)["queryName"]
+
+	_, err := percolatorIndexDef(h.mgr, indexName)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("percolator: could not read"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	pq := &PercolatorQuery{}
+	err = json.Unmarshal(requestBody, pq)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("percolator: could not parse"+
+			" request body, err: %v", err), 400)
+		return
+	}
+	pq.Name = queryName
+
+	q, err := bleve.ParseQuery(pq.Query)
+	if err == nil {
+		err = q.Validate()
+	}
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("percolator: invalid query,"+
+			" err: %v", err), 400)
+		return
+	}
+
+	cfg := h.mgr.Cfg()
+
+	pqs := &PercolatorQueries{}
+	cas, _, err := CfgGetJSON(cfg, PERCOLATOR_QUERIES_KEY, pqs)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 500)
+		return
+	}
+	if pqs.Queries == nil {
+		pqs.Queries = map[string]map[string]*PercolatorQuery{}
+	}
+	if pqs.Queries[indexName] == nil {
+		pqs.Queries[indexName] = map[string]*PercolatorQuery{}
+	}
+	pqs.Queries[indexName][queryName] = pq
+	pqs.UUID = cbgt.NewUUID()
+
+	_, err = CfgSetJSON(cfg, PERCOLATOR_QUERIES_KEY, pqs, cas)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("percolator: could not save"+
+			" query, err: %v", err), 500)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// PercolatorDeleteHandler is a REST handler that deletes a stored
+// query of an index.
+type PercolatorDeleteHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPercolatorDeleteHandler(mgr *cbgt.Manager) *PercolatorDeleteHandler {
+	return &PercolatorDeleteHandler{mgr: mgr}
+}
+
+func (h *PercolatorDeleteHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+	queryName := mux.Vars(req)["queryName"]
+
+	cfg := h.mgr.Cfg()
+
+	pqs := &PercolatorQueries{}
+	cas, _, err := CfgGetJSON(cfg, PERCOLATOR_QUERIES_KEY, pqs)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 500)
+		return
+	}
+	if pqs.Queries[indexName][queryName] == nil {
+		rest.ShowError(w, req, fmt.Sprintf("percolator: no such query,"+
+			" indexName: %s, queryName: %s", indexName, queryName), 400)
+		return
+	}
+	delete(pqs.Queries[indexName], queryName)
+	if len(pqs.Queries[indexName]) <= 0 {
+		delete(pqs.Queries, indexName)
+	}
+	pqs.UUID = cbgt.NewUUID()
+
+	_, err = CfgSetJSON(cfg, PERCOLATOR_QUERIES_KEY, pqs, cas)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("percolator: could not delete"+
+			" query, err: %v", err), 500)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// PercolateHandler is a REST handler that returns the stored queries
+// of an index that match the document provided in the request body.
+type PercolateHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPercolateHandler(mgr *cbgt.Manager) *PercolateHandler {
+	return &PercolateHandler{mgr: mgr}
+}
+
+func (h *PercolateHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	indexDef, err := percolatorIndexDef(h.mgr, indexName)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	bleveParams := NewBleveParams()
+	if len(indexDef.Params) > 0 {
+		err = json.Unmarshal([]byte(indexDef.Params), bleveParams)
+		if err != nil {
+			rest.ShowError(w, req, fmt.Sprintf("percolator: could not"+
+				" parse index params, err: %v", err), 500)
+			return
+		}
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("percolator: could not read"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	var doc interface{}
+	err = json.Unmarshal(requestBody, &doc)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("percolator: could not parse"+
+			" document, err: %v", err), 400)
+		return
+	}
+
+	docID := req.FormValue("docID")
+	if docID == "" {
+		docID = "_percolate"
+	}
+
+	pqs := &PercolatorQueries{}
+	_, _, err = CfgGetJSON(h.mgr.Cfg(), PERCOLATOR_QUERIES_KEY, pqs)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 500)
+		return
+	}
+
+	queries := make([]*PercolatorQuery, 0, len(pqs.Queries[indexName]))
+	for _, pq := range pqs.Queries[indexName] {
+		queries = append(queries, pq)
+	}
+
+	matches, err := Percolate(&bleveParams.Mapping, queries, docID, doc)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status  string   `json:"status"`
+		Matches []string `json:"matches"`
+	}{
+		Status:  "ok",
+		Matches: matches,
+	})
+}
+
+// PercolatorMatchesHandler is a REST handler that returns the recent
+// onIngest matches of an index that were seen by this node.
+type PercolatorMatchesHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPercolatorMatchesHandler(mgr *cbgt.Manager) *PercolatorMatchesHandler {
+	return &PercolatorMatchesHandler{mgr: mgr}
+}
+
+func (h *PercolatorMatchesHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	matches := []*PercolatorMatch{}
+
+	percolatorM.Lock()
+	if l := percolatorMatches[indexName]; l != nil {
+		for e := l.Front(); e != nil; e = e.Next() {
+			matches = append(matches, e.Value.(*PercolatorMatch))
+		}
+	}
+	dropped := percolatorDropped[indexName]
+	percolatorM.Unlock()
+
+	rest.MustEncode(w, struct {
+		Status  string             `json:"status"`
+		Matches []*PercolatorMatch `json:"matches"`
+		Dropped uint64             `json:"dropped"`
+	}{
+		Status:  "ok",
+		Matches: matches,
+		Dropped: dropped,
+	})
+}
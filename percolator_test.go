@@ -0,0 +1,308 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"container/list"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestIndexNameFromPIndexPath(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"/data/myIndex_6cc599ab7a85bf3b_0a1b2c3d.pindex", "myIndex"},
+		{"data/my_index_6cc599ab7a85bf3b_0a1b2c3d.pindex", "my_index"},
+		{"noUnderscores.pindex", "noUnderscores"},
+	}
+
+	for _, test := range tests {
+		actual := indexNameFromPIndexPath(test.in)
+		if actual != test.out {
+			t.Errorf("expected '%s' got '%s' for '%s'",
+				test.out, actual, test.in)
+		}
+	}
+}
+
+func TestPercolate(t *testing.T) {
+	queries := []*PercolatorQuery{
+		{Name: "red", Query: json.RawMessage(`{"match":"red"}`)},
+		{Name: "cheap", Query: json.RawMessage(`{"field":"price","max":10}`)},
+		{Name: "blue", Query: json.RawMessage(`{"match":"blue"}`)},
+	}
+
+	matches, err := Percolate(bleve.NewIndexMapping(), queries, "car0",
+		map[string]interface{}{
+			"desc":  "a shiny red car",
+			"price": 5,
+		})
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	if !reflect.DeepEqual(matches, []string{"cheap", "red"}) {
+		t.Errorf("expected cheap and red, got: %#v", matches)
+	}
+
+	_, err = Percolate(bleve.NewIndexMapping(), []*PercolatorQuery{
+		{Name: "bad", Query: json.RawMessage(`{"not-a-query":true}`)},
+	}, "car0", map[string]interface{}{})
+	if err == nil {
+		t.Errorf("expected err on bad stored query")
+	}
+}
+
+func TestPercolatorHandlers(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	err := mgr.CreateIndex("nil", "", "", "",
+		"bleve", "idx0", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+
+	mr, _ := cbgt.NewMsgRing(os.Stderr, 1000)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", mr)
+	if err != nil || router == nil {
+		t.Errorf("no mux router")
+	}
+
+	tests := []*RESTHandlerTest{
+		{
+			Desc:   "list percolator queries of a missing index",
+			Path:   "/api/index/not-an-index/percolator",
+			Method: "GET",
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`not an index`: true,
+			},
+		},
+		{
+			Desc:         "list percolator queries when none",
+			Path:         "/api/index/idx0/percolator",
+			Method:       "GET",
+			Status:       http.StatusOK,
+			ResponseBody: []byte(`{"status":"ok","queries":{}}`),
+		},
+		{
+			Desc:   "put a bad percolator query",
+			Path:   "/api/index/idx0/percolator/q0",
+			Method: "PUT",
+			Body:   []byte(`{"query":{"not-a-query":true}}`),
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`invalid query`: true,
+			},
+		},
+		{
+			Desc:   "put a percolator query",
+			Path:   "/api/index/idx0/percolator/q0",
+			Method: "PUT",
+			Body:   []byte(`{"query":{"match":"red"}}`),
+			Status: http.StatusOK,
+		},
+		{
+			Desc:   "list percolator queries",
+			Path:   "/api/index/idx0/percolator",
+			Method: "GET",
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"q0":{"name":"q0"`: true,
+			},
+		},
+		{
+			Desc:         "percolate a matching doc",
+			Path:         "/api/index/idx0/percolate",
+			Method:       "POST",
+			Body:         []byte(`{"desc":"a red car"}`),
+			Status:       http.StatusOK,
+			ResponseBody: []byte(`{"status":"ok","matches":["q0"]}`),
+		},
+		{
+			Desc:         "percolate a non-matching doc",
+			Path:         "/api/index/idx0/percolate",
+			Method:       "POST",
+			Body:         []byte(`{"desc":"a blue car"}`),
+			Status:       http.StatusOK,
+			ResponseBody: []byte(`{"status":"ok","matches":[]}`),
+		},
+		{
+			Desc:   "delete a percolator query",
+			Path:   "/api/index/idx0/percolator/q0",
+			Method: "DELETE",
+			Status: http.StatusOK,
+		},
+		{
+			Desc:   "delete a missing percolator query",
+			Path:   "/api/index/idx0/percolator/q0",
+			Method: "DELETE",
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`no such query`: true,
+			},
+		},
+		{
+			Desc:         "percolator matches when none",
+			Path:         "/api/index/idx0/percolatorMatches",
+			Method:       "GET",
+			Status:       http.StatusOK,
+			ResponseBody: []byte(`{"status":"ok","matches":[],"dropped":0}`),
+		},
+	}
+
+	testRESTHandlers(t, tests, router)
+}
+
+func TestPercolateBatch(t *testing.T) {
+	eventCh := make(chan *WebhookEvent, 10)
+
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			event := &WebhookEvent{}
+			body, _ := ioutil.ReadAll(req.Body)
+			json.Unmarshal(body, event)
+			eventCh <- event
+		}))
+	defer s.Close()
+
+	webhookM.Lock()
+	webhookHooks = map[string]*Webhook{
+		"matches": &Webhook{Name: "matches", URL: s.URL,
+			Events: []string{WEBHOOK_EVENT_PERCOLATOR_MATCHES}},
+	}
+	webhookM.Unlock()
+
+	red, _ := bleve.ParseQuery(json.RawMessage(`{"match":"red"}`))
+
+	percolatorM.Lock()
+	percolatorIngestQueries = map[string][]*percolatorCompiledQuery{
+		"idxB": {{name: "red", query: red}},
+	}
+	percolatorM.Unlock()
+
+	defer func() {
+		webhookM.Lock()
+		webhookHooks = nil
+		webhookM.Unlock()
+
+		percolatorM.Lock()
+		percolatorIngestQueries = map[string][]*percolatorCompiledQuery{}
+		delete(percolatorMatches, "idxB")
+		percolatorM.Unlock()
+	}()
+
+	mapping := bleve.NewIndexMapping()
+
+	percolateBatch([]*percolatorDoc{
+		{indexName: "idxB", mapping: mapping, docID: "a", seq: 1,
+			doc: map[string]interface{}{"desc": "a red car"}},
+		{indexName: "idxB", mapping: mapping, docID: "b", seq: 2,
+			doc: map[string]interface{}{"desc": "a blue car"}},
+		{indexName: "idxB", mapping: mapping, docID: "b", seq: 3,
+			doc: map[string]interface{}{"desc": "a red bike"}},
+		{indexName: "idxB", mapping: mapping, docID: "c", seq: 4,
+			doc: map[string]interface{}{"desc": "a red van"}},
+		{indexName: "idxB", mapping: mapping, docID: "c", seq: 5,
+			doc: map[string]interface{}{"desc": "a green van"}},
+	})
+
+	select {
+	case event := <-eventCh:
+		if event.Event != WEBHOOK_EVENT_PERCOLATOR_MATCHES ||
+			event.IndexName != "idxB" || len(event.Matches) != 2 ||
+			event.Matches[0].DocID != "a" || event.Matches[0].Seq != 1 ||
+			event.Matches[1].DocID != "b" || event.Matches[1].Seq != 3 ||
+			!reflect.DeepEqual(event.Matches[1].Queries, []string{"red"}) {
+			t.Errorf("unexpected event: %#v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected webhook delivery")
+	}
+
+	percolatorM.Lock()
+	n := percolatorMatches["idxB"].Len()
+	percolatorM.Unlock()
+	if n != 2 {
+		t.Errorf("expected 2 recent matches, got: %d", n)
+	}
+}
+
+func TestPercolatorPrune(t *testing.T) {
+	cfg := cbgt.NewCfgMem()
+
+	indexDefs := cbgt.NewIndexDefs(cbgt.VERSION)
+	indexDefs.IndexDefs["idx0"] = &cbgt.IndexDef{
+		Type: "bleve", Name: "idx0", UUID: "u0", SourceType: "nil",
+	}
+	_, err := cbgt.CfgSetIndexDefs(cfg, indexDefs, 0)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	_, err = CfgSetJSON(cfg, PERCOLATOR_QUERIES_KEY, &PercolatorQueries{
+		Queries: map[string]map[string]*PercolatorQuery{
+			"idx0": {"q0": {Name: "q0",
+				Query: json.RawMessage(`{"match":"red"}`)}},
+			"gone": {"q1": {Name: "q1",
+				Query: json.RawMessage(`{"match":"red"}`)}},
+		},
+	}, 0)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	percolatorM.Lock()
+	percolatorMatches["gone"] = list.New()
+	percolatorDropped["gone"] = 1
+	percolatorM.Unlock()
+
+	err = percolatorPrune(cfg)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	pqs := &PercolatorQueries{}
+	_, _, err = CfgGetJSON(cfg, PERCOLATOR_QUERIES_KEY, pqs)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if len(pqs.Queries) != 1 || pqs.Queries["idx0"]["q0"] == nil {
+		t.Errorf("expected only idx0's queries, got: %#v", pqs.Queries)
+	}
+
+	percolatorM.Lock()
+	_, matchesExists := percolatorMatches["gone"]
+	_, droppedExists := percolatorDropped["gone"]
+	percolatorM.Unlock()
+	if matchesExists || droppedExists {
+		t.Errorf("expected gone's matches to be pruned")
+	}
+}
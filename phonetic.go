@@ -0,0 +1,827 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blevesearch/bleve/analysis"
+	"github.com/blevesearch/bleve/registry"
+)
+
+// The phonetic token filters replace each token with its metaphone
+// or double metaphone code, so that differently spelled names that
+// sound alike, like "Smith" and "Smyth", match.  They're used in the
+// custom analyzers of an index mapping, like...
+//
+//   "analysis": {
+//     "token_filters": {
+//       "names_phonetic": {"type": "double_metaphone", "replace": false}
+//     },
+//     "analyzers": {
+//       "names": {"type": "custom", "tokenizer": "unicode",
+//                 "token_filters": ["to_lower", "names_phonetic"]}
+//     }
+//   }
+//
+// With "replace": false, the codes are added at the positions of the
+// original tokens, which are kept, so exact spellings still score
+// higher.  The double metaphone filter adds both the primary and
+// alternate codes of a token when they differ.  The "max_code_len"
+// config limits the length of the codes.
+
+const PHONETIC_METAPHONE = "metaphone"
+
+const PHONETIC_DOUBLE_METAPHONE = "double_metaphone"
+
+const PHONETIC_DEFAULT_MAX_CODE_LEN = 4
+
+func init() {
+	registry.RegisterTokenFilter(PHONETIC_METAPHONE,
+		phoneticFilterConstructor(func(s string, n int) []string {
+			return []string{Metaphone(s, n)}
+		}))
+	registry.RegisterTokenFilter(PHONETIC_DOUBLE_METAPHONE,
+		phoneticFilterConstructor(func(s string, n int) []string {
+			primary, alternate := DoubleMetaphone(s, n)
+			return []string{primary, alternate}
+		}))
+}
+
+// PhoneticFilter is a bleve token filter that replaces or augments
+// tokens with their phonetic codes.
+type PhoneticFilter struct {
+	encode     func(s string, maxCodeLen int) []string
+	maxCodeLen int
+	replace    bool
+}
+
+func phoneticFilterConstructor(encode func(string, int) []string) registry.TokenFilterConstructor {
+	return func(config map[string]interface{}, cache *registry.Cache) (
+		analysis.TokenFilter, error) {
+		f := &PhoneticFilter{
+			encode:     encode,
+			maxCodeLen: PHONETIC_DEFAULT_MAX_CODE_LEN,
+			replace:    true,
+		}
+		if v, exists := config["replace"]; exists {
+			replace, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("phonetic: replace must be a bool")
+			}
+			f.replace = replace
+		}
+		if v, exists := config["max_code_len"]; exists {
+			n, ok := v.(float64)
+			if !ok || n < 1 || n != float64(int(n)) {
+				return nil, fmt.Errorf("phonetic: max_code_len must be" +
+					" a positive integer")
+			}
+			f.maxCodeLen = int(n)
+		}
+		return f, nil
+	}
+}
+
+func (f *PhoneticFilter) Filter(input analysis.TokenStream) analysis.TokenStream {
+	rv := make(analysis.TokenStream, 0, len(input))
+	for _, token := range input {
+		var codes []string
+		for _, code := range f.encode(string(token.Term), f.maxCodeLen) {
+			if code != "" && (len(codes) <= 0 || codes[0] != code) {
+				codes = append(codes, code)
+			}
+		}
+		if len(codes) <= 0 {
+			rv = append(rv, token)
+			continue
+		}
+		if !f.replace {
+			rv = append(rv, token)
+		}
+		for _, code := range codes {
+			rv = append(rv, &analysis.Token{
+				Start:    token.Start,
+				End:      token.End,
+				Term:     []byte(code),
+				Position: token.Position,
+				Type:     token.Type,
+			})
+		}
+	}
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// Metaphone returns the metaphone code of a word, as in Lawrence
+// Philips' original algorithm, limited to maxCodeLen.
+func Metaphone(word string, maxCodeLen int) string {
+	w := []rune(strings.ToUpper(word))
+	if len(w) <= 0 {
+		return ""
+	}
+	if len(w) == 1 {
+		return string(w)
+	}
+
+	// Initial letters that are skipped or transformed.
+	switch w[0] {
+	case 'K', 'G', 'P':
+		if w[1] == 'N' {
+			w = w[1:]
+		}
+	case 'A':
+		if w[1] == 'E' {
+			w = w[1:]
+		}
+	case 'W':
+		if w[1] == 'R' {
+			w = w[1:]
+		} else if w[1] == 'H' {
+			w = append([]rune{'W'}, w[2:]...)
+		}
+	case 'X':
+		w = append([]rune{'S'}, w[1:]...)
+	}
+
+	n := len(w)
+	at := func(i int) rune {
+		if i < 0 || i >= n {
+			return 0
+		}
+		return w[i]
+	}
+	isVowel := func(i int) bool {
+		return strings.ContainsRune("AEIOU", at(i))
+	}
+	isFrontVowel := func(i int) bool {
+		return strings.ContainsRune("EIY", at(i))
+	}
+	matches := func(i int, s string) bool {
+		return i >= 0 && i+len(s) <= n && string(w[i:i+len(s)]) == s
+	}
+
+	var code []rune
+	for i := 0; i < n && len(code) < maxCodeLen; i++ {
+		c := w[i]
+		if c != 'C' && at(i-1) == c {
+			continue // Skip double letters, except for CC.
+		}
+
+		last := i == n-1
+
+		switch c {
+		case 'A', 'E', 'I', 'O', 'U':
+			if i == 0 {
+				code = append(code, c)
+			}
+		case 'B':
+			if !(at(i-1) == 'M' && last) {
+				code = append(code, 'B')
+			}
+		case 'C':
+			if at(i-1) == 'S' && isFrontVowel(i+1) {
+				break // SCI, SCE, SCY.
+			}
+			if matches(i, "CIA") {
+				code = append(code, 'X')
+			} else if isFrontVowel(i + 1) {
+				code = append(code, 'S')
+			} else if at(i-1) == 'S' && at(i+1) == 'H' {
+				code = append(code, 'K')
+			} else if at(i+1) == 'H' {
+				if i == 0 && n >= 3 && isVowel(2) {
+					code = append(code, 'K')
+				} else {
+					code = append(code, 'X')
+				}
+			} else {
+				code = append(code, 'K')
+			}
+		case 'D':
+			if at(i+1) == 'G' && isFrontVowel(i+2) {
+				code = append(code, 'J')
+				i += 2
+			} else {
+				code = append(code, 'T')
+			}
+		case 'G':
+			if at(i+1) == 'H' && (i+1 == n-1 || !isVowel(i+2)) {
+				break
+			}
+			if i > 0 && matches(i, "GN") {
+				break
+			}
+			if isFrontVowel(i+1) && at(i-1) != 'G' {
+				code = append(code, 'J')
+			} else {
+				code = append(code, 'K')
+			}
+		case 'H':
+			if last || strings.ContainsRune("CSPTG", at(i-1)) {
+				break
+			}
+			if isVowel(i + 1) {
+				code = append(code, 'H')
+			}
+		case 'F', 'J', 'L', 'M', 'N', 'R':
+			code = append(code, c)
+		case 'K':
+			if at(i-1) != 'C' {
+				code = append(code, 'K')
+			}
+		case 'P':
+			if at(i+1) == 'H' {
+				code = append(code, 'F')
+			} else {
+				code = append(code, 'P')
+			}
+		case 'Q':
+			code = append(code, 'K')
+		case 'S':
+			if matches(i, "SH") || matches(i, "SIO") || matches(i, "SIA") {
+				code = append(code, 'X')
+			} else {
+				code = append(code, 'S')
+			}
+		case 'T':
+			if matches(i, "TIA") || matches(i, "TIO") {
+				code = append(code, 'X')
+			} else if matches(i, "TCH") {
+				break
+			} else if matches(i, "TH") {
+				code = append(code, '0')
+			} else {
+				code = append(code, 'T')
+			}
+		case 'V':
+			code = append(code, 'F')
+		case 'W', 'Y':
+			if isVowel(i + 1) {
+				code = append(code, c)
+			}
+		case 'X':
+			code = append(code, 'K', 'S')
+		case 'Z':
+			code = append(code, 'S')
+		}
+	}
+
+	if len(code) > maxCodeLen {
+		code = code[:maxCodeLen]
+	}
+	return string(code)
+}
+
+// ---------------------------------------------------------
+
+// DoubleMetaphone returns the primary and alternate double metaphone
+// codes of a word, as in Lawrence Philips' algorithm, limited to
+// maxCodeLen.
+func DoubleMetaphone(word string, maxCodeLen int) (string, string) {
+	d := &doubleMetaphone{
+		w:      []rune(strings.ToUpper(strings.TrimSpace(word))),
+		maxLen: maxCodeLen,
+	}
+	if len(d.w) <= 0 {
+		return "", ""
+	}
+	d.run()
+	return string(d.primary), string(d.alternate)
+}
+
+type doubleMetaphone struct {
+	w      []rune
+	maxLen int
+
+	slavoGermanic bool
+
+	primary   []rune
+	alternate []rune
+}
+
+func (d *doubleMetaphone) at(i int) rune {
+	if i < 0 || i >= len(d.w) {
+		return 0
+	}
+	return d.w[i]
+}
+
+// is returns whether the length of any of the strings, starting at
+// position i, matches one of them.
+func (d *doubleMetaphone) is(i int, strs ...string) bool {
+	for _, s := range strs {
+		if i >= 0 && i+len(s) <= len(d.w) && string(d.w[i:i+len(s)]) == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *doubleMetaphone) isVowel(i int) bool {
+	return strings.ContainsRune("AEIOUY", d.at(i))
+}
+
+func (d *doubleMetaphone) last() int {
+	return len(d.w) - 1
+}
+
+func (d *doubleMetaphone) addPrimary(s string) {
+	for _, r := range s {
+		if len(d.primary) < d.maxLen {
+			d.primary = append(d.primary, r)
+		}
+	}
+}
+
+func (d *doubleMetaphone) addAlternate(s string) {
+	for _, r := range s {
+		if len(d.alternate) < d.maxLen {
+			d.alternate = append(d.alternate, r)
+		}
+	}
+}
+
+// add appends to the primary code, and to the alternate code, which
+// is the same as the primary when not given.
+func (d *doubleMetaphone) add(primary string, alternate ...string) {
+	d.addPrimary(primary)
+	if len(alternate) > 0 {
+		d.addAlternate(alternate[0])
+	} else {
+		d.addAlternate(primary)
+	}
+}
+
+func (d *doubleMetaphone) complete() bool {
+	return len(d.primary) >= d.maxLen && len(d.alternate) >= d.maxLen
+}
+
+// skip returns the position after c, skipping a doubled c.
+func (d *doubleMetaphone) skip(i int, c rune) int {
+	if d.at(i+1) == c {
+		return i + 2
+	}
+	return i + 1
+}
+
+func (d *doubleMetaphone) run() {
+	s := string(d.w)
+	d.slavoGermanic = strings.ContainsAny(s, "WK") ||
+		strings.Contains(s, "CZ") || strings.Contains(s, "WITZ")
+
+	i := 0
+	if d.is(0, "GN", "KN", "PN", "WR", "PS") {
+		i = 1
+	}
+
+	for !d.complete() && i <= d.last() {
+		switch d.w[i] {
+		case 'A', 'E', 'I', 'O', 'U', 'Y':
+			if i == 0 {
+				d.add("A")
+			}
+			i++
+		case 'B':
+			d.add("P")
+			i = d.skip(i, 'B')
+		case 'Ç':
+			d.add("S")
+			i++
+		case 'C':
+			i = d.handleC(i)
+		case 'D':
+			i = d.handleD(i)
+		case 'F':
+			d.add("F")
+			i = d.skip(i, 'F')
+		case 'G':
+			i = d.handleG(i)
+		case 'H':
+			i = d.handleH(i)
+		case 'J':
+			i = d.handleJ(i)
+		case 'K':
+			d.add("K")
+			i = d.skip(i, 'K')
+		case 'L':
+			i = d.handleL(i)
+		case 'M':
+			d.add("M")
+			if d.at(i+1) == 'M' || (d.is(i-1, "UMB") &&
+				(i+1 == d.last() || d.is(i+2, "ER"))) {
+				i += 2
+			} else {
+				i++
+			}
+		case 'N':
+			d.add("N")
+			i = d.skip(i, 'N')
+		case 'Ñ':
+			d.add("N")
+			i++
+		case 'P':
+			if d.at(i+1) == 'H' {
+				d.add("F")
+				i += 2
+			} else {
+				d.add("P")
+				if d.is(i+1, "P", "B") {
+					i += 2
+				} else {
+					i++
+				}
+			}
+		case 'Q':
+			d.add("K")
+			i = d.skip(i, 'Q')
+		case 'R':
+			if i == d.last() && !d.slavoGermanic &&
+				d.is(i-2, "IE") && !d.is(i-4, "ME", "MA") {
+				d.addAlternate("R")
+			} else {
+				d.add("R")
+			}
+			i = d.skip(i, 'R')
+		case 'S':
+			i = d.handleS(i)
+		case 'T':
+			i = d.handleT(i)
+		case 'V':
+			d.add("F")
+			i = d.skip(i, 'V')
+		case 'W':
+			i = d.handleW(i)
+		case 'X':
+			i = d.handleX(i)
+		case 'Z':
+			i = d.handleZ(i)
+		default:
+			i++
+		}
+	}
+}
+
+func (d *doubleMetaphone) handleC(i int) int {
+	switch {
+	case d.is(i, "CHIA") || (i > 1 && !d.isVowel(i-2) && d.is(i-1, "ACH") &&
+		((d.at(i+2) != 'I' && d.at(i+2) != 'E') ||
+			d.is(i-2, "BACHER", "MACHER"))):
+		d.add("K") // Germanic, like BACHER and MACHER.
+		return i + 2
+	case i == 0 && d.is(i, "CAESAR"):
+		d.add("S")
+		return i + 2
+	case d.is(i, "CH"):
+		return d.handleCH(i)
+	case d.is(i, "CZ") && !d.is(i-2, "WICZ"):
+		d.add("S", "X")
+		return i + 2
+	case d.is(i+1, "CIA"):
+		d.add("X")
+		return i + 3
+	case d.is(i, "CC") && !(i == 1 && d.at(0) == 'M'):
+		if d.is(i+2, "I", "E", "H") && !d.is(i+2, "HU") {
+			if (i == 1 && d.at(i-1) == 'A') || d.is(i-1, "UCCEE", "UCCES") {
+				d.add("KS") // ACCIDENT, SUCCEED.
+			} else {
+				d.add("X") // BACCI, BERTUCCI.
+			}
+			return i + 3
+		}
+		d.add("K")
+		return i + 2
+	case d.is(i, "CK", "CG", "CQ"):
+		d.add("K")
+		return i + 2
+	case d.is(i, "CI", "CE", "CY"):
+		if d.is(i, "CIO", "CIE", "CIA") {
+			d.add("S", "X")
+		} else {
+			d.add("S")
+		}
+		return i + 2
+	}
+
+	d.add("K")
+	if d.is(i+1, " C", " Q", " G") {
+		return i + 3
+	}
+	if d.is(i+1, "C", "K", "Q") && !d.is(i+1, "CE", "CI") {
+		return i + 2
+	}
+	return i + 1
+}
+
+func (d *doubleMetaphone) handleCH(i int) int {
+	if i > 0 && d.is(i, "CHAE") {
+		d.add("K", "X") // MICHAEL.
+		return i + 2
+	}
+
+	// Greek roots, like CHARACTER and CHORUS, but not CHORE.
+	if i == 0 && (d.is(i+1, "HARAC", "HARIS") ||
+		d.is(i+1, "HOR", "HYM", "HIA", "HEM")) && !d.is(0, "CHORE") {
+		d.add("K")
+		return i + 2
+	}
+
+	// Germanic and Greek roots, like ORCHESTRA and SCHOOL.
+	if d.is(0, "VAN ", "VON ") || d.is(0, "SCH") ||
+		d.is(i-2, "ORCHES", "ARCHIT", "ORCHID") ||
+		d.is(i+2, "T", "S") ||
+		((d.is(i-1, "A", "O", "U", "E") || i == 0) &&
+			(d.is(i+2, "L", "R", "N", "M", "B", "H", "F", "V", "W", " ") ||
+				i+1 == d.last())) {
+		d.add("K")
+		return i + 2
+	}
+
+	if i > 0 {
+		if d.is(0, "MC") {
+			d.add("K")
+		} else {
+			d.add("X", "K")
+		}
+	} else {
+		d.add("X")
+	}
+	return i + 2
+}
+
+func (d *doubleMetaphone) handleD(i int) int {
+	if d.is(i, "DG") {
+		if d.is(i+2, "I", "E", "Y") {
+			d.add("J") // EDGE.
+			return i + 3
+		}
+		d.add("TK") // EDGAR.
+		return i + 2
+	}
+	d.add("T")
+	if d.is(i, "DT", "DD") {
+		return i + 2
+	}
+	return i + 1
+}
+
+func (d *doubleMetaphone) handleG(i int) int {
+	switch {
+	case d.at(i+1) == 'H':
+		return d.handleGH(i)
+	case d.at(i+1) == 'N':
+		if i == 1 && d.isVowel(0) && !d.slavoGermanic {
+			d.add("KN", "N")
+		} else if !d.is(i+2, "EY") && d.at(i+1) != 'Y' && !d.slavoGermanic {
+			d.add("N", "KN")
+		} else {
+			d.add("KN")
+		}
+		return i + 2
+	case d.is(i+1, "LI") && !d.slavoGermanic:
+		d.add("KL", "L") // TAGLIARO.
+		return i + 2
+	case i == 0 && (d.at(i+1) == 'Y' || d.is(i+1, "ES", "EP", "EB", "EL",
+		"EY", "IB", "IL", "IN", "IE", "EI", "ER")):
+		d.add("K", "J")
+		return i + 2
+	case (d.is(i+1, "ER") || d.at(i+1) == 'Y') &&
+		!d.is(0, "DANGER", "RANGER", "MANGER") &&
+		!d.is(i-1, "E", "I") && !d.is(i-1, "RGY", "OGY"):
+		d.add("K", "J")
+		return i + 2
+	case d.is(i+1, "E", "I", "Y") || d.is(i-1, "AGGI", "OGGI"):
+		if d.is(0, "VAN ", "VON ") || d.is(0, "SCH") || d.is(i+1, "ET") {
+			d.add("K")
+		} else if d.is(i+1, "IER") {
+			d.add("J")
+		} else {
+			d.add("J", "K")
+		}
+		return i + 2
+	}
+
+	d.add("K")
+	return d.skip(i, 'G')
+}
+
+func (d *doubleMetaphone) handleGH(i int) int {
+	if i > 0 && !d.isVowel(i-1) {
+		d.add("K")
+		return i + 2
+	}
+	if i == 0 {
+		if d.at(i+2) == 'I' {
+			d.add("J")
+		} else {
+			d.add("K")
+		}
+		return i + 2
+	}
+	if (i > 1 && d.is(i-2, "B", "H", "D")) ||
+		(i > 2 && d.is(i-3, "B", "H", "D")) ||
+		(i > 3 && d.is(i-4, "B", "H")) {
+		return i + 2 // HUGH, BOUGH, BROUGHTON.
+	}
+	if i > 2 && d.at(i-1) == 'U' && d.is(i-3, "C", "G", "L", "R", "T") {
+		d.add("F") // LAUGH, COUGH, ROUGH.
+	} else if d.at(i-1) != 'I' {
+		d.add("K")
+	}
+	return i + 2
+}
+
+func (d *doubleMetaphone) handleH(i int) int {
+	if (i == 0 || d.isVowel(i-1)) && d.isVowel(i+1) {
+		d.add("H")
+		return i + 2
+	}
+	return i + 1
+}
+
+func (d *doubleMetaphone) handleJ(i int) int {
+	if d.is(i, "JOSE") || d.is(0, "SAN ") {
+		if (i == 0 && d.at(i+4) == ' ') || len(d.w) == 4 || d.is(0, "SAN ") {
+			d.add("H")
+		} else {
+			d.add("J", "H")
+		}
+		return i + 1
+	}
+
+	if i == 0 {
+		d.add("J", "A") // JANKELOWICZ.
+	} else if d.isVowel(i-1) && !d.slavoGermanic &&
+		(d.at(i+1) == 'A' || d.at(i+1) == 'O') {
+		d.add("J", "H") // BAJADOR.
+	} else if i == d.last() {
+		d.add("J", "")
+	} else if !d.is(i+1, "L", "T", "K", "S", "N", "M", "B", "Z") &&
+		!d.is(i-1, "S", "K", "L") {
+		d.add("J")
+	}
+	return d.skip(i, 'J')
+}
+
+func (d *doubleMetaphone) handleL(i int) int {
+	if d.at(i+1) != 'L' {
+		d.add("L")
+		return i + 1
+	}
+	// Spanish, like CABRILLO and GALLEGOS.
+	if (i == len(d.w)-3 && d.is(i-1, "ILLO", "ILLA", "ALLE")) ||
+		((d.is(len(d.w)-2, "AS", "OS") || d.is(d.last(), "A", "O")) &&
+			d.is(i-1, "ALLE")) {
+		d.addPrimary("L")
+	} else {
+		d.add("L")
+	}
+	return i + 2
+}
+
+func (d *doubleMetaphone) handleS(i int) int {
+	switch {
+	case d.is(i-1, "ISL", "YSL"):
+		return i + 1 // ISLAND, CARLYSLE.
+	case i == 0 && d.is(i, "SUGAR"):
+		d.add("X", "S")
+		return i + 1
+	case d.is(i, "SH"):
+		if d.is(i+1, "HEIM", "HOEK", "HOLM", "HOLZ") {
+			d.add("S")
+		} else {
+			d.add("X")
+		}
+		return i + 2
+	case d.is(i, "SIO", "SIA") || d.is(i, "SIAN"):
+		if d.slavoGermanic {
+			d.add("S")
+		} else {
+			d.add("S", "X")
+		}
+		return i + 3
+	case (i == 0 && d.is(i+1, "M", "N", "L", "W")) || d.is(i+1, "Z"):
+		d.add("S", "X") // SMITH and SCHMIDT, SNIDER and SCHNEIDER.
+		if d.is(i+1, "Z") {
+			return i + 2
+		}
+		return i + 1
+	case d.is(i, "SC"):
+		return d.handleSC(i)
+	}
+
+	if i == d.last() && d.is(i-2, "AI", "OI") {
+		d.addAlternate("S") // French, like RESNAIS.
+	} else {
+		d.add("S")
+	}
+	if d.is(i+1, "S", "Z") {
+		return i + 2
+	}
+	return i + 1
+}
+
+func (d *doubleMetaphone) handleSC(i int) int {
+	if d.at(i+2) == 'H' {
+		if d.is(i+3, "OO", "ER", "EN", "UY", "ED", "EM") {
+			if d.is(i+3, "ER", "EN") {
+				d.add("X", "SK") // SCHERMERHORN, SCHENKER.
+			} else {
+				d.add("SK") // SCHOOL, SCHOONER.
+			}
+		} else if i == 0 && !d.isVowel(3) && d.at(3) != 'W' {
+			d.add("X", "S")
+		} else {
+			d.add("X")
+		}
+	} else if d.is(i+2, "I", "E", "Y") {
+		d.add("S")
+	} else {
+		d.add("SK")
+	}
+	return i + 3
+}
+
+func (d *doubleMetaphone) handleT(i int) int {
+	switch {
+	case d.is(i, "TION"), d.is(i, "TIA", "TCH"):
+		d.add("X")
+		return i + 3
+	case d.is(i, "TH") || d.is(i, "TTH"):
+		if d.is(i+2, "OM", "AM") || d.is(0, "VAN ", "VON ") || d.is(0, "SCH") {
+			d.add("T") // THOMAS, THAMES.
+		} else {
+			d.add("0", "T")
+		}
+		return i + 2
+	}
+	d.add("T")
+	if d.is(i+1, "T", "D") {
+		return i + 2
+	}
+	return i + 1
+}
+
+func (d *doubleMetaphone) handleW(i int) int {
+	if d.is(i, "WR") {
+		d.add("R")
+		return i + 2
+	}
+	switch {
+	case i == 0 && (d.isVowel(i+1) || d.is(i, "WH")):
+		if d.isVowel(i + 1) {
+			d.add("A", "F") // WASSERMAN and VASSERMAN.
+		} else {
+			d.add("A")
+		}
+		return i + 1
+	case (i == d.last() && d.isVowel(i-1)) ||
+		d.is(i-1, "EWSKI", "EWSKY", "OWSKI", "OWSKY") || d.is(0, "SCH"):
+		d.addAlternate("F") // Polish, like FILIPOWICZ.
+		return i + 1
+	case d.is(i, "WICZ", "WITZ"):
+		d.add("TS", "FX")
+		return i + 4
+	}
+	return i + 1
+}
+
+func (d *doubleMetaphone) handleX(i int) int {
+	if i == 0 {
+		d.add("S") // XAVIER.
+		return i + 1
+	}
+	// French, like BREAUX.
+	if !(i == d.last() && (d.is(i-3, "IAU", "EAU") || d.is(i-2, "AU", "OU"))) {
+		d.add("KS")
+	}
+	if d.is(i+1, "C", "X") {
+		return i + 2
+	}
+	return i + 1
+}
+
+func (d *doubleMetaphone) handleZ(i int) int {
+	if d.at(i+1) == 'H' {
+		d.add("J") // Chinese pinyin, like ZHAO.
+		return i + 2
+	}
+	if d.is(i+1, "ZO", "ZI", "ZA") ||
+		(d.slavoGermanic && i > 0 && d.at(i-1) != 'T') {
+		d.add("S", "TS")
+	} else {
+		d.add("S")
+	}
+	return d.skip(i, 'Z')
+}
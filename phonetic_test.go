@@ -0,0 +1,110 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/registry"
+)
+
+func TestMetaphone(t *testing.T) {
+	tests := map[string]string{
+		"Smith":     "SM0",
+		"Smyth":     "SM0",
+		"Knight":    "NT",
+		"Catherine": "K0RN",
+		"Kathryn":   "K0RN",
+		"Xavier":    "SFR",
+		"123":       "",
+		"":          "",
+	}
+	for word, exp := range tests {
+		if got := Metaphone(word, 4); got != exp {
+			t.Errorf("word: %s, expected: %s, got: %s", word, exp, got)
+		}
+	}
+}
+
+func TestDoubleMetaphone(t *testing.T) {
+	tests := map[string][2]string{
+		"Smith":     {"SM0", "XMT"},
+		"Schmidt":   {"XMT", "SMT"},
+		"Thomas":    {"TMS", "TMS"},
+		"Jose":      {"HS", "HS"},
+		"Michael":   {"MKL", "MXL"},
+		"Xavier":    {"SF", "SFR"},
+		"Gallegos":  {"KLKS", "KKS"},
+		"Wasserman": {"ASRM", "FSRM"},
+		"Laugh":     {"LF", "LF"},
+		"Edge":      {"AJ", "AJ"},
+	}
+	for word, exp := range tests {
+		primary, alternate := DoubleMetaphone(word, 4)
+		if primary != exp[0] || alternate != exp[1] {
+			t.Errorf("word: %s, expected: %v, got: %s, %s",
+				word, exp, primary, alternate)
+		}
+	}
+
+	if primary, _ := DoubleMetaphone("Catherine", 2); primary != "K0" {
+		t.Errorf("expected max code len, got: %s", primary)
+	}
+}
+
+func TestPhoneticFilter(t *testing.T) {
+	m := bleve.NewIndexMapping()
+	err := json.Unmarshal([]byte(`{
+		"default_analyzer": "names",
+		"analysis": {
+			"token_filters": {
+				"names_phonetic": {"type": "double_metaphone", "replace": false}
+			},
+			"analyzers": {
+				"names": {"type": "custom", "tokenizer": "unicode",
+					"token_filters": ["to_lower", "names_phonetic"]}
+			}
+		}
+	}`), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bindex, err := bleve.NewMemOnly(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindex.Index("a", map[string]interface{}{"name": "John Smyth"})
+	bindex.Index("b", map[string]interface{}{"name": "Jon Smith"})
+
+	res, err := bindex.Search(bleve.NewSearchRequest(
+		bleve.NewMatchQuery("smith")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Hits) != 2 || res.Hits[0].ID != "b" {
+		t.Errorf("expected both spellings, exact first, got: %v", res)
+	}
+
+	for _, config := range []map[string]interface{}{
+		{"type": PHONETIC_METAPHONE, "replace": "yes"},
+		{"type": PHONETIC_METAPHONE, "max_code_len": 0.0},
+		{"type": PHONETIC_DOUBLE_METAPHONE, "max_code_len": 1.5},
+	} {
+		_, err = registry.NewCache().DefineTokenFilter("f", config)
+		if err == nil {
+			t.Errorf("expected err, config: %v", config)
+		}
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 
 	"github.com/blevesearch/bleve"
@@ -65,6 +66,10 @@ func ValidateAlias(indexType, indexName, indexParams string) error {
 
 func CountAlias(mgr *cbgt.Manager,
 	indexName, indexUUID string) (uint64, error) {
+	if target := aliasReshardTarget(mgr, indexName); target != "" {
+		return CountBlevePIndexImpl(mgr, target, "")
+	}
+
 	alias, err := bleveIndexAliasForUserIndexAlias(mgr,
 		indexName, indexUUID, false, nil, nil)
 	if err != nil {
@@ -77,19 +82,97 @@ func CountAlias(mgr *cbgt.Manager,
 }
 
 func QueryAlias(mgr *cbgt.Manager, indexName, indexUUID string,
-	req []byte, res io.Writer) error {
+	req []byte, res io.Writer) (err error) {
+	// A re-sharded index is an alias of only its shadow index, which
+	// serves the queries with all the features of a bleve index.
+	if target := aliasReshardTarget(mgr, indexName); target != "" {
+		return QueryBlevePIndexImpl(mgr, target, "", req, res)
+	}
+
+	var warnings []string
+
+	startTime := queryLogNow()
+	defer func(req []byte) {
+		queryLogRecord(mgr.UUID(), indexName, req, startTime, err, warnings)
+		IndexMetricsFor(indexName).recordQuery(err)
+	}(req)
+
 	queryCtlParams := cbgt.QueryCtlParams{
 		Ctl: cbgt.QueryCtl{
 			Timeout: cbgt.QUERY_CTL_DEFAULT_TIMEOUT_MS,
 		},
 	}
 
-	err := json.Unmarshal(req, &queryCtlParams)
+	err = json.Unmarshal(req, &queryCtlParams)
 	if err != nil {
 		return fmt.Errorf("alias: QueryAlias"+
 			" parsing queryCtlParams, req: %s, err: %v", req, err)
 	}
 
+	warnings = queryRequestWarnings(req)
+
+	err = checkAliasQueryRequest(req)
+	if err != nil {
+		return err
+	}
+
+	aq, err := StartActiveQuery(indexName, req)
+	if err != nil {
+		return err
+	}
+	defer aq.Done()
+
+	req, fnScore, err := rewriteFunctionScore(req)
+	if err != nil {
+		return err
+	}
+
+	req, err = rewriteMoreLikeThis(req, func() ([]bleve.Index, error) {
+		return bleveIndexTargetsForUserIndexAlias(mgr,
+			indexName, indexUUID, true, nil, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("alias: QueryAlias"+
+			" more_like_this, err: %v", err)
+	}
+
+	// The aliased indexes might declare different query string
+	// dialects, so only the dialect of the request is used.
+	req, err = rewriteQueryStrings(req, nil)
+	if err != nil {
+		return fmt.Errorf("alias: QueryAlias"+
+			" query string, err: %v", err)
+	}
+
+	// The analyzers are checked by the aliased indexes.
+	req, err = rewriteQueryAnalyzers(req, nil)
+	if err != nil {
+		return fmt.Errorf("alias: QueryAlias"+
+			" analyzers, err: %v", err)
+	}
+
+	// The aliased indexes might declare different units, so only
+	// the base units are used.
+	req, err = rewriteUnitRanges(req, nil)
+	if err != nil {
+		return fmt.Errorf("alias: QueryAlias"+
+			" units, err: %v", err)
+	}
+
+	req, err = rewriteCIDRQueries(req)
+	if err != nil {
+		return fmt.Errorf("alias: QueryAlias"+
+			" cidr, err: %v", err)
+	}
+
+	// The aliased indexes might declare different geo shape
+	// precisions, so only the default precision is used.
+	req, err = rewriteGeoShapeQueries(req, nil)
+	if err != nil {
+		return fmt.Errorf("alias: QueryAlias"+
+			" geo_shape, err: %v", err)
+	}
+
 	searchRequest := &bleve.SearchRequest{}
 
 	err = json.Unmarshal(req, searchRequest)
@@ -103,25 +186,220 @@ func QueryAlias(mgr *cbgt.Manager, indexName, indexUUID string,
 		return err
 	}
 
-	cancelCh := cbgt.TimeoutCancelChan(queryCtlParams.Ctl.Timeout)
+	cancelCh := aq.CancelCh(
+		cbgt.TimeoutCancelChan(queryCtlParams.Ctl.Timeout))
 
-	alias, err := bleveIndexAliasForUserIndexAlias(mgr,
+	targets, err := bleveIndexTargetsForUserIndexAlias(mgr,
 		indexName, indexUUID, true,
 		queryCtlParams.Ctl.Consistency, cancelCh)
 	if err != nil {
 		return err
 	}
 
-	searchResponse, err := alias.Search(searchRequest)
+	warnings = append(warnings, aliasTargetsWarnings(mgr, indexName)...)
+
+	gatherRequest := searchRequest
+	if countOnlyRequest := queryCountOnlyRequest(searchRequest); countOnlyRequest != nil {
+		gatherRequest = countOnlyRequest
+		fnScore = nil
+	} else if fnScore != nil {
+		gatherRequest = fnScore.gatherRequest(searchRequest)
+		targets = functionScoreTargets(targets, fnScore)
+	}
+
+	memoryMax := queryMemoryMax(mgr)
+	err = checkQueryMemory(searchRequest, len(targets), memoryMax)
 	if err != nil {
 		return err
 	}
+	if memoryMax > 0 {
+		targets = queryMemoryTargets(targets, aq, memoryMax)
+	}
+
+	searchResponse, err := bleve.NewIndexAlias(targets...).Search(gatherRequest)
+	if err := aq.Err(); err != nil {
+		return fmt.Errorf("alias: QueryAlias, err: %v", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if fnScore != nil {
+		searchResultPage(searchResponse, searchRequest)
+		filterHitFields(searchResponse.Hits,
+			append([]string{}, searchRequest.Fields...))
+	}
+
+	fetchPartial := false
+	if queryFetchFromKV(req) {
+		fetchWarnings, partial, err := fetchHitsFromKV(mgr, indexName,
+			searchResponse.Hits)
+		if err != nil {
+			return err
+		}
+		warnings = append(warnings, fetchWarnings...)
+		fetchPartial = partial
+	}
+
+	resultEx := newSearchResultEx(searchResponse, warnings)
+	resultEx.Partial = fetchPartial
+
+	rest.MustEncode(res, resultEx)
+
+	return nil
+}
+
+// aliasReshardTarget returns the shadow index of an alias which is a
+// re-sharded index, or "".
+func aliasReshardTarget(mgr *cbgt.Manager, indexName string) string {
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return ""
+	}
+
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil || indexDef.Type != "alias" {
+		return ""
+	}
+
+	return reshardAliasTarget(indexDef)
+}
+
+// Top-level fields of a query request that are only supported by the
+// queries of bleve indexes.
+var aliasUnsupportedQueryFields = []string{
+	"aggregations", "collapse", "group", "geoDistance",
+}
+
+// The ctl params of a query request that are only supported by the
+// queries of bleve indexes.
+var aliasUnsupportedQueryCtlParams = []string{
+	"allowPartial", "globalScoring", "mergePolicy", "tieBreak", "rerank",
+}
+
+// The facet params of a query request that are only supported by the
+// queries of bleve indexes.
+var aliasUnsupportedQueryFacetParams = []string{
+	"order", "offset", "after", "cardinality", "missing", "missingTerm",
+}
+
+// checkAliasQueryRequest returns an error when a query request of a
+// user-defined alias uses a param that only the queries of bleve
+// indexes support, rather than silently ignoring the param.
+func checkAliasQueryRequest(req []byte) error {
+	var p struct {
+		Ctl    map[string]interface{}            `json:"ctl"`
+		Facets map[string]map[string]interface{} `json:"facets"`
+	}
+	var m map[string]interface{}
+
+	err := json.Unmarshal(req, &p)
+	if err == nil {
+		err = json.Unmarshal(req, &m)
+	}
+	if err != nil {
+		return fmt.Errorf("alias: QueryAlias"+
+			" parsing request, err: %v", err)
+	}
 
-	rest.MustEncode(res, searchResponse)
+	for _, name := range aliasUnsupportedQueryFields {
+		if !aliasQueryParamZero(m[name]) {
+			return fmt.Errorf("alias: request field: %s is not"+
+				" supported by the queries of an alias", name)
+		}
+	}
+	for _, name := range aliasUnsupportedQueryCtlParams {
+		if !aliasQueryParamZero(p.Ctl[name]) {
+			return fmt.Errorf("alias: ctl param: %s is not"+
+				" supported by the queries of an alias", name)
+		}
+	}
+	for facetName, facet := range p.Facets {
+		for _, name := range aliasUnsupportedQueryFacetParams {
+			if !aliasQueryParamZero(facet[name]) {
+				return fmt.Errorf("alias: facet: %s, param: %s is not"+
+					" supported by the queries of an alias", facetName, name)
+			}
+		}
+	}
 
 	return nil
 }
 
+// aliasQueryParamZero returns true when a JSON param is missing or
+// has its zero value, which asks for no feature.
+func aliasQueryParamZero(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !x
+	case float64:
+		return x == 0
+	case string:
+		return x == ""
+	}
+	return false
+}
+
+// aliasTargetsWarnings returns warnings about the target indexes of
+// an alias whose index params change the scoring of their queries,
+// which the queries of the alias don't apply.
+func aliasTargetsWarnings(mgr *cbgt.Manager, indexName string) []string {
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return nil
+	}
+
+	var rv []string
+
+	visited := map[string]bool{}
+
+	var visit func(name string)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+
+		indexDef := indexDefsByName[name]
+		if indexDef == nil {
+			return
+		}
+
+		if indexDef.Type == "alias" {
+			params := AliasParams{}
+			if json.Unmarshal([]byte(indexDef.Params), &params) != nil {
+				return
+			}
+			names := make([]string, 0, len(params.Targets))
+			for targetName := range params.Targets {
+				names = append(names, targetName)
+			}
+			sort.Strings(names)
+			for _, targetName := range names {
+				visit(targetName)
+			}
+			return
+		}
+
+		bleveParams := bleveIndexParams(mgr, name)
+		if bleveParams.Similarity.IsBM25() {
+			rv = append(rv, fmt.Sprintf("alias target: %s scores with"+
+				" bm25, which the queries of an alias don't apply;"+
+				" hits are scored by tf-idf", name))
+		}
+		if bleveParams.Rerank != nil {
+			rv = append(rv, fmt.Sprintf("alias target: %s has a rerank,"+
+				" which the queries of an alias don't apply", name))
+		}
+	}
+
+	visit(indexName)
+
+	return rv
+}
+
 // The indexName/indexUUID is for a user-defined index alias.
 //
 // TODO: One day support user-defined aliases for non-bleve indexes.
@@ -130,7 +408,23 @@ func bleveIndexAliasForUserIndexAlias(mgr *cbgt.Manager,
 	consistencyParams *cbgt.ConsistencyParams,
 	cancelCh <-chan bool) (
 	bleve.IndexAlias, error) {
-	alias := bleve.NewIndexAlias()
+	targets, err := bleveIndexTargetsForUserIndexAlias(mgr,
+		indexName, indexUUID, ensureCanRead, consistencyParams, cancelCh)
+	if err != nil {
+		return nil, err
+	}
+
+	return bleve.NewIndexAlias(targets...), nil
+}
+
+// Returns the bleve.Index'es of all the PIndexes of all the indexes
+// that a user-defined index alias resolves to.
+func bleveIndexTargetsForUserIndexAlias(mgr *cbgt.Manager,
+	indexName, indexUUID string, ensureCanRead bool,
+	consistencyParams *cbgt.ConsistencyParams,
+	cancelCh <-chan bool) (
+	[]bleve.Index, error) {
+	var targets []bleve.Index
 
 	indexDefs, _, err := cbgt.CfgGetIndexDefs(mgr.Cfg())
 	if err != nil {
@@ -199,13 +493,13 @@ func bleveIndexAliasForUserIndexAlias(mgr *cbgt.Manager,
 					return err
 				}
 			} else if strings.HasPrefix(targetDef.Type, "bleve") {
-				subAlias, err := bleveIndexAlias(mgr, targetName,
+				subTargets, err := bleveIndexTargets(mgr, targetName,
 					targetSpec.IndexUUID, ensureCanRead,
 					consistencyParams, cancelCh)
 				if err != nil {
 					return err
 				}
-				alias.Add(subAlias)
+				targets = append(targets, subTargets...)
 				num += 1
 			} else {
 				return fmt.Errorf("alias: unsupported target type: %s,"+
@@ -222,5 +516,5 @@ func bleveIndexAliasForUserIndexAlias(mgr *cbgt.Manager,
 		return nil, err
 	}
 
-	return alias, nil
+	return targets, nil
 }
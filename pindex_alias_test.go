@@ -0,0 +1,51 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"testing"
+)
+
+func TestCheckAliasQueryRequest(t *testing.T) {
+	for _, req := range []string{
+		`{"query":{"match_all":{}}}`,
+		`{"query":{"match_all":{}},"size":10,"ctl":{"timeout":1000}}`,
+		`{"query":{},"ctl":{"allowPartial":false,"mergePolicy":""}}`,
+		`{"query":{},"facets":{"f":{"field":"type","size":5}}}`,
+		`{"query":{},"fetchFromKV":false}`,
+		`{"query":{},"fetchFromKV":true}`,
+	} {
+		err := checkAliasQueryRequest([]byte(req))
+		if err != nil {
+			t.Errorf("expected no err, req: %s, got: %v", req, err)
+		}
+	}
+
+	for _, req := range []string{
+		`{"query":{},"ctl":{"allowPartial":true}}`,
+		`{"query":{},"ctl":{"globalScoring":true}}`,
+		`{"query":{},"ctl":{"tieBreak":"id"}}`,
+		`{"query":{},"aggregations":{"a":{"type":"sum","field":"x"}}}`,
+		`{"query":{},"collapse":{"field":"type"}}`,
+		`{"query":{},"group":{"field":"type"}}`,
+		`{"query":{},"geoDistance":{"field":"loc","origin":[0,0]}}`,
+		`{"query":{},"facets":{"f":{"field":"type","offset":10}}}`,
+		`{"query":{},"facets":{"f":{"field":"type","cardinality":true}}}`,
+		`{"query":{},"facets":{"f":{"field":"type","missing":true}}}`,
+		`not json`,
+	} {
+		err := checkAliasQueryRequest([]byte(req))
+		if err == nil {
+			t.Errorf("expected err, req: %s", req)
+		}
+	}
+}
@@ -21,9 +21,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -45,6 +47,77 @@ import (
 type BleveParams struct {
 	Mapping bleve.IndexMapping     `json:"mapping"`
 	Store   map[string]interface{} `json:"store"`
+
+	// Optional units of numeric fields, keyed by field name, for
+	// unit-suffixed range query values (see query_units.go).
+	Units map[string]string `json:"units,omitempty"`
+
+	// Optional keyword fields that are only used in exact filters,
+	// which are indexed without term vectors or stored copies (see
+	// filter_fields.go).
+	FilterOnlyFields []string `json:"filterOnlyFields,omitempty"`
+
+	// Optional text fields that are also indexed as exact keyword
+	// sub-fields, named FIELD.keyword, or "*" for every text field (see
+	// keyword_fields.go).
+	KeywordSubFields []string `json:"keywordSubFields,omitempty"`
+
+	// Optional filter on the keys of the documents that are ingested
+	// from the data source (see key_filter.go).
+	KeyFilter *KeyFilter `json:"keyFilter,omitempty"`
+
+	// When true, the expiry times of documents are indexed and
+	// expired documents are periodically swept away (see expiry.go).
+	ExpiryAware bool `json:"expiryAware,omitempty"`
+
+	// When true, the mapping type of each document is indexed, for
+	// the document counts per type (see doc_type_stats.go).
+	DocTypeStats bool `json:"docTypeStats,omitempty"`
+
+	// Optional dialect of the query string queries, such as their
+	// default operator and fields (see query_string.go).
+	QueryStringDialect *QueryStringDialect `json:"queryStringDialect,omitempty"`
+
+	// Optional scoring model, such as BM25 instead of the default
+	// tf-idf (see query_bm25.go).
+	Similarity *BleveSimilarity `json:"similarity,omitempty"`
+
+	// Optional query requests that are run against each pindex when
+	// it's pre-opened at node startup (see warmup.go).
+	WarmupQueries []json.RawMessage `json:"warmupQueries,omitempty"`
+
+	// Optional priority of the pindexes when they're opened at node
+	// startup, either "high", "" (normal) or "low" (see warmup.go).
+	LoadPriority string `json:"loadPriority,omitempty"`
+
+	// Optional sizing and flush interval of the batches of ingested
+	// mutations (see batching.go).
+	Batching *BleveBatching `json:"batching,omitempty"`
+
+	// Optional external reranker of the merged hits of queries (see
+	// query_rerank.go).
+	Rerank *BleveRerank `json:"rerank,omitempty"`
+
+	// Optional paths of arrays of objects whose elements are also
+	// indexed as nested documents, for per-element matching by nested
+	// queries (see nested.go).
+	Nested []string `json:"nested,omitempty"`
+
+	// Optional extraction of the text of attachments, like PDFs, that
+	// are stored as base64 fields (see attachments.go).
+	Attachments *BleveAttachments `json:"attachments,omitempty"`
+
+	// Optional date layouts that are accepted by datetime fields,
+	// keyed by field path (see date_formats.go).
+	DateFormats map[string][]string `json:"dateFormats,omitempty"`
+
+	// Optional capture of the documents that couldn't be indexed into
+	// a dead-letter file (see ingest_errors.go).
+	DeadLetter *BleveDeadLetter `json:"deadLetter,omitempty"`
+
+	// Optional precision of the geohash cells of geoshape fields (see
+	// geo_shapes.go).
+	GeoShape *BleveGeoShape `json:"geoShape,omitempty"`
 }
 
 func NewBleveParams() *BleveParams {
@@ -57,11 +130,38 @@ func NewBleveParams() *BleveParams {
 }
 
 type BleveDest struct {
-	path string
+	path      string
+	indexName string
 
 	// Invoked when mgr should restart this BleveDest, like on rollback.
 	restart func()
 
+	// When non-nil, only documents whose keys are accepted by
+	// keyFilter are indexed.
+	keyFilter    func(key []byte) bool
+	keysFiltered uint64 // Accessed via atomic.
+
+	mutations uint64 // Ingested updates and deletes, accessed via atomic.
+
+	metrics      *IndexMetrics
+	ingestErrors *IngestErrors
+
+	expiryAware  bool
+	docTypeStats bool
+
+	batching *BleveBatching
+
+	nested []string
+
+	attachments *BleveAttachments
+	dateFormats map[string][]string
+	ipFields    []string
+
+	geoShapeFields []string
+	geoShape       *BleveGeoShape
+
+	deadLetter *BleveDeadLetter
+
 	m          sync.Mutex // Protects the fields that follow.
 	bindex     bleve.Index
 	partitions map[string]*BleveDestPartition
@@ -82,20 +182,34 @@ type BleveDestPartition struct {
 	seqMaxBatch uint64       // Max seq # that got through batch apply/commit.
 	seqSnapEnd  uint64       // To track snapshot end seq # for this partition.
 	batch       *bleve.Batch // Batch applied when we hit seqSnapEnd.
+	caughtUp    bool         // True once caught up with the source.
+
+	batchBytes int         // Approximate bytes of the batch's mutations.
+	batchStart time.Time   // When the batch got its first mutation.
+	flushTimer *time.Timer // Non-nil when a batch flush is deferred.
 
 	lastOpaque []byte // Cache most recent value for OpaqueSet()/OpaqueGet().
 	lastUUID   string // Cache most recent partition UUID from lastOpaque.
 
+	// The doc IDs of the nested documents in the batch, keyed by the
+	// parent doc ID.
+	nestedPending map[string][]string
+
 	cwrQueue cbgt.CwrQueue
 }
 
 func NewBleveDest(path string, bindex bleve.Index,
 	restart func()) *BleveDest {
+	indexName := indexNameFromPIndexPath(path)
+
 	return &BleveDest{
-		path:       path,
-		restart:    restart,
-		bindex:     bindex,
-		partitions: make(map[string]*BleveDestPartition),
+		path:         path,
+		indexName:    indexName,
+		restart:      restart,
+		metrics:      IndexMetricsFor(indexName),
+		ingestErrors: IngestErrorsFor(indexName),
+		bindex:       bindex,
+		partitions:   make(map[string]*BleveDestPartition),
 		stats: cbgt.PIndexStoreStats{
 			TimerBatchStore: metrics.NewTimer(),
 			Errors:          list.New(),
@@ -103,6 +217,21 @@ func NewBleveDest(path string, bindex bleve.Index,
 	}
 }
 
+// indexNameFromPIndexPath returns the index name of a pindex, based
+// on the pindex path, which cbgt forms as...
+// DATA_DIR/INDEX_NAME_INDEX_UUID_HASH.pindex
+func indexNameFromPIndexPath(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), ".pindex")
+	for i := 0; i < 2; i++ {
+		j := strings.LastIndex(name, "_")
+		if j <= 0 {
+			break
+		}
+		name = name[:j]
+	}
+	return name
+}
+
 // ---------------------------------------------------------
 
 const bleveQueryHelp = `<a href="http://www.blevesearch.com/docs/Query-String-Query/">
@@ -134,13 +263,92 @@ func init() {
 func ValidateBlevePIndexImpl(indexType, indexName, indexParams string) error {
 	bleveParams := NewBleveParams()
 	if len(indexParams) > 0 {
-		return json.Unmarshal([]byte(indexParams), bleveParams)
+		err := json.Unmarshal([]byte(indexParams), bleveParams)
+		if err != nil {
+			return err
+		}
 	}
-	return nil
+	err := validateUnits(bleveParams.Units)
+	if err != nil {
+		return err
+	}
+	_, err = NewKeyFilterFunc(bleveParams.KeyFilter)
+	if err != nil {
+		return err
+	}
+	err = validateQueryStringDialect(bleveParams.QueryStringDialect)
+	if err != nil {
+		return err
+	}
+	err = validateBleveSimilarity(bleveParams.Similarity)
+	if err != nil {
+		return err
+	}
+	err = validateBleveBatching(bleveParams.Batching)
+	if err != nil {
+		return err
+	}
+	err = validateBleveRerank(bleveParams.Rerank)
+	if err != nil {
+		return err
+	}
+	err = validateNestedPaths(bleveParams.Nested)
+	if err != nil {
+		return err
+	}
+	err = validateBleveAttachments(bleveParams.Attachments)
+	if err != nil {
+		return err
+	}
+	err = validateDateFormats(bleveParams.DateFormats)
+	if err != nil {
+		return err
+	}
+	err = validateBleveDeadLetter(bleveParams.DeadLetter)
+	if err != nil {
+		return err
+	}
+	err = validateBleveGeoShape(bleveParams.GeoShape)
+	if err != nil {
+		return err
+	}
+	if _, exists := PIndexLoadPriorities[bleveParams.LoadPriority]; !exists {
+		return fmt.Errorf("bleve: unknown loadPriority: %q",
+			bleveParams.LoadPriority)
+	}
+	_, err = applyIPFields(&bleveParams.Mapping)
+	if err != nil {
+		return err
+	}
+	_, err = applyGeoShapeFields(&bleveParams.Mapping)
+	if err != nil {
+		return err
+	}
+	err = applyKeywordSubFields(&bleveParams.Mapping,
+		bleveParams.KeywordSubFields)
+	if err != nil {
+		return err
+	}
+	return applyFilterOnlyFields(&bleveParams.Mapping,
+		bleveParams.FilterOnlyFields)
 }
 
 func NewBlevePIndexImpl(indexType, indexParams, path string,
 	restart func()) (cbgt.PIndexImpl, cbgt.Dest, error) {
+	seeded, err := replicaSeed(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if seeded {
+		impl, dest, err := OpenBlevePIndexImpl(indexType, path, restart)
+		if err == nil {
+			return impl, dest, nil
+		}
+		log.Printf("bleve: could not open seeded pindex, path: %s,"+
+			" err: %v", path, err)
+		os.RemoveAll(path)
+	}
+
 	bleveParams := NewBleveParams()
 	if len(indexParams) > 0 {
 		err := json.Unmarshal([]byte(indexParams), bleveParams)
@@ -149,6 +357,43 @@ func NewBlevePIndexImpl(indexType, indexParams, path string,
 		}
 	}
 
+	ipFields, err := applyIPFields(&bleveParams.Mapping)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bleve: ipFields, err: %v", err)
+	}
+
+	geoShapeFields, err := applyGeoShapeFields(&bleveParams.Mapping)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bleve: geoShapeFields, err: %v", err)
+	}
+
+	err = applyKeywordSubFields(&bleveParams.Mapping,
+		bleveParams.KeywordSubFields)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bleve: keywordSubFields, err: %v", err)
+	}
+
+	err = applyFilterOnlyFields(&bleveParams.Mapping,
+		bleveParams.FilterOnlyFields)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bleve: filterOnlyFields, err: %v", err)
+	}
+
+	keyFilter, err := NewKeyFilterFunc(bleveParams.KeyFilter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if bleveParams.ExpiryAware {
+		applyExpiryMapping(&bleveParams.Mapping)
+	}
+	if bleveParams.DocTypeStats {
+		applyDocTypeMapping(&bleveParams.Mapping)
+	}
+	if len(bleveParams.Nested) > 0 {
+		applyNestedMapping(&bleveParams.Mapping)
+	}
+
 	kvStoreName, ok := bleveParams.Store["kvStoreName"].(string)
 	if !ok || kvStoreName == "" {
 		kvStoreName = bleve.Config.DefaultKVStore
@@ -162,6 +407,10 @@ func NewBlevePIndexImpl(indexType, indexParams, path string,
 		kvConfig[k] = v
 	}
 
+	// Encrypt the KV values when the node has an encryption key (see
+	// encryption.go).
+	kvStoreName = applyEncryptionKVConfig(kvStoreName, kvConfig)
+
 	// Always use the "metrics" wrapper KVStore if it's available and
 	// also not already configured.
 	_, exists := kvConfig["kvStoreName_actual"]
@@ -191,13 +440,48 @@ func NewBlevePIndexImpl(indexType, indexParams, path string,
 		return nil, nil, err
 	}
 
+	dest := NewBleveDest(path, bindex, restart)
+	dest.keyFilter = keyFilter
+	dest.expiryAware = bleveParams.ExpiryAware
+	dest.docTypeStats = bleveParams.DocTypeStats
+	dest.batching = bleveParams.Batching
+	dest.nested = bleveParams.Nested
+	dest.attachments = bleveParams.Attachments
+	dest.dateFormats = bleveParams.DateFormats
+	dest.ipFields = ipFields
+	dest.geoShapeFields = geoShapeFields
+	dest.geoShape = bleveParams.GeoShape
+	dest.deadLetter = bleveParams.DeadLetter
+	if dest.expiryAware {
+		go dest.runExpirySweep()
+	}
+
 	return bindex, &cbgt.DestForwarder{
-		DestProvider: NewBleveDest(path, bindex, restart),
+		DestProvider: dest,
 	}, nil
 }
 
 func OpenBlevePIndexImpl(indexType, path string,
 	restart func()) (cbgt.PIndexImpl, cbgt.Dest, error) {
+	if bindex, dest, ok := warmupClaim(path, restart); ok {
+		return bindex, &cbgt.DestForwarder{
+			DestProvider: dest,
+		}, nil
+	}
+
+	bindex, dest, err := openBleveDest(path, restart)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return bindex, &cbgt.DestForwarder{
+		DestProvider: dest,
+	}, nil
+}
+
+// openBleveDest opens the bleve index of an existing pindex path.
+func openBleveDest(path string, restart func()) (
+	bleve.Index, *BleveDest, error) {
 	buf, err := ioutil.ReadFile(path +
 		string(os.PathSeparator) + "PINDEX_BLEVE_META")
 	if err != nil {
@@ -210,6 +494,21 @@ func OpenBlevePIndexImpl(indexType, path string,
 		return nil, nil, fmt.Errorf("bleve: parse params: %v", err)
 	}
 
+	keyFilter, err := NewKeyFilterFunc(bleveParams.KeyFilter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ipFields, err := applyIPFields(&bleveParams.Mapping)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	geoShapeFields, err := applyGeoShapeFields(&bleveParams.Mapping)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// TODO: boltdb sometimes locks on Open(), so need to investigate,
 	// where perhaps there was a previous missing or race-y Close().
 	bindex, err := bleve.Open(path)
@@ -217,9 +516,23 @@ func OpenBlevePIndexImpl(indexType, path string,
 		return nil, nil, err
 	}
 
-	return bindex, &cbgt.DestForwarder{
-		DestProvider: NewBleveDest(path, bindex, restart),
-	}, nil
+	dest := NewBleveDest(path, bindex, restart)
+	dest.keyFilter = keyFilter
+	dest.expiryAware = bleveParams.ExpiryAware
+	dest.docTypeStats = bleveParams.DocTypeStats
+	dest.batching = bleveParams.Batching
+	dest.nested = bleveParams.Nested
+	dest.attachments = bleveParams.Attachments
+	dest.dateFormats = bleveParams.DateFormats
+	dest.ipFields = ipFields
+	dest.geoShapeFields = geoShapeFields
+	dest.geoShape = bleveParams.GeoShape
+	dest.deadLetter = bleveParams.DeadLetter
+	if dest.expiryAware {
+		go dest.runExpirySweep()
+	}
+
+	return bindex, dest, nil
 }
 
 // ---------------------------------------------------------------
@@ -236,19 +549,94 @@ func CountBlevePIndexImpl(mgr *cbgt.Manager, indexName, indexUUID string) (
 }
 
 func QueryBlevePIndexImpl(mgr *cbgt.Manager, indexName, indexUUID string,
-	req []byte, res io.Writer) error {
+	req []byte, res io.Writer) (err error) {
+	var warnings []string
+
+	startTime := queryLogNow()
+	defer func(req []byte) {
+		queryLogRecord(mgr.UUID(), indexName, req, startTime, err, warnings)
+		IndexMetricsFor(indexName).recordQuery(err)
+	}(req)
+
 	queryCtlParams := cbgt.QueryCtlParams{
 		Ctl: cbgt.QueryCtl{
 			Timeout: cbgt.QUERY_CTL_DEFAULT_TIMEOUT_MS,
 		},
 	}
 
-	err := json.Unmarshal(req, &queryCtlParams)
+	err = json.Unmarshal(req, &queryCtlParams)
 	if err != nil {
 		return fmt.Errorf("bleve: QueryBlevePIndexImpl"+
 			" parsing queryCtlParams, req: %s, err: %v", req, err)
 	}
 
+	warnings = queryRequestWarnings(req)
+
+	aq, err := StartActiveQuery(indexName, req)
+	if err != nil {
+		return err
+	}
+	defer aq.Done()
+
+	req, fnScore, err := rewriteFunctionScore(req)
+	if err != nil {
+		return err
+	}
+
+	req, err = rewriteMoreLikeThis(req, func() ([]bleve.Index, error) {
+		return bleveIndexTargets(mgr, indexName, indexUUID, true, nil, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBlevePIndexImpl"+
+			" more_like_this, err: %v", err)
+	}
+
+	bleveParams := bleveIndexParams(mgr, indexName)
+
+	req, err = rewriteQueryStrings(req, bleveParams.QueryStringDialect)
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBlevePIndexImpl"+
+			" query string, err: %v", err)
+	}
+
+	req, err = rewriteQueryAnalyzers(req, &bleveParams.Mapping)
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBlevePIndexImpl"+
+			" analyzers, err: %v", err)
+	}
+
+	req, err = rewriteUnitRanges(req, bleveParams.Units)
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBlevePIndexImpl"+
+			" units, err: %v", err)
+	}
+
+	req, err = rewriteCIDRQueries(req)
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBlevePIndexImpl"+
+			" cidr, err: %v", err)
+	}
+
+	req, err = rewriteGeoShapeQueries(req, bleveParams.GeoShape)
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBlevePIndexImpl"+
+			" geo_shape, err: %v", err)
+	}
+
+	err = checkFilterOnlyFields(req, bleveParams.FilterOnlyFields)
+	if err != nil {
+		return err
+	}
+
+	req, err = rewriteNestedQueries(req, bleveParams.Nested,
+		func() ([]bleve.Index, error) {
+			return bleveIndexTargets(mgr, indexName, indexUUID, true, nil, nil)
+		})
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBlevePIndexImpl"+
+			" nested, err: %v", err)
+	}
+
 	searchRequest := &bleve.SearchRequest{}
 
 	err = json.Unmarshal(req, searchRequest)
@@ -262,35 +650,303 @@ func QueryBlevePIndexImpl(mgr *cbgt.Manager, indexName, indexUUID string,
 		return err
 	}
 
-	cancelCh := cbgt.TimeoutCancelChan(queryCtlParams.Ctl.Timeout)
+	err = validateQueryFields(searchRequest.Fields)
+	if err != nil {
+		return err
+	}
+
+	cancelCh := aq.CancelCh(
+		cbgt.TimeoutCancelChan(queryCtlParams.Ctl.Timeout))
 
-	alias, err := bleveIndexAlias(mgr, indexName, indexUUID, true,
-		queryCtlParams.Ctl.Consistency, cancelCh)
+	sortHits, err := queryMergeSorter(req, searchRequest)
 	if err != nil {
 		return err
 	}
 
-	doneCh := make(chan struct{})
+	aggs, err := queryAggregations(req)
+	if err != nil {
+		return err
+	}
 
-	var searchResult *bleve.SearchResult
+	cardinalities, err := queryCardinalityFacets(req)
+	if err != nil {
+		return err
+	}
 
-	go func() {
-		searchResult, err = alias.Search(searchRequest)
+	facetOpts, err := queryFacetOptions(req)
+	if err != nil {
+		return err
+	}
+	for name := range cardinalities {
+		delete(facetOpts, name)
+	}
 
-		close(doneCh)
-	}()
+	err = checkQueryFacetSizes(searchRequest, queryFacetSizeMax(mgr))
+	if err != nil {
+		return err
+	}
 
-	select {
-	case <-cancelCh:
-		err = fmt.Errorf("pindex_bleve: query timeout")
+	facetMissing, err := queryFacetMissing(req)
+	if err != nil {
+		return err
+	}
+
+	collapse, err := queryCollapseParams(req)
+	if err != nil {
+		return err
+	}
 
-	case <-doneCh:
-		if searchResult != nil {
-			rest.MustEncode(res, searchResult)
+	grouping, err := queryGroupingParams(req)
+	if err != nil {
+		return err
+	}
+
+	geoDistance, err := queryGeoDistanceParams(req)
+	if err != nil {
+		return err
+	}
+
+	allowPartial := queryAllowPartial(req)
+	globalScoring := queryGlobalScoring(req)
+	bm25 := bleveParams.Similarity.IsBM25()
+
+	rescoreWindow, err := queryRescoreWindow(req)
+	if err != nil {
+		return err
+	}
+
+	targets, names, err := bleveIndexTargetsNamed(mgr, indexName,
+		indexUUID, true, queryCtlParams.Ctl.Consistency, cancelCh)
+	if err != nil {
+		return err
+	}
+
+	gatherRequest := queryFieldsGatherRequest(searchRequest)
+	countOnlyRequest := queryCountOnlyRequest(searchRequest)
+	if countOnlyRequest != nil {
+		gatherRequest = countOnlyRequest
+		globalScoring = false
+		bm25 = false
+	} else if globalScoring || bm25 {
+		gatherRequest = queryRescoreGatherRequest(gatherRequest,
+			rescoreWindow)
+		rescoreWindow = gatherRequest.Size
+	}
+
+	gatherTargets := targets
+	if countOnlyRequest != nil {
+		fnScore = nil
+	} else if fnScore != nil {
+		gatherRequest = fnScore.gatherRequest(gatherRequest)
+		if !globalScoring && !bm25 {
+			gatherTargets = functionScoreTargets(targets, fnScore)
 		}
 	}
 
-	return err
+	rerank := queryRerank(req, bleveParams.Rerank)
+	if countOnlyRequest != nil || grouping != nil {
+		rerank = nil
+	} else if rerank != nil {
+		gatherRequest = rerank.gatherRequest(gatherRequest)
+	}
+
+	collapseWindow := 0
+	if countOnlyRequest != nil {
+		collapse = nil
+	} else if collapse != nil {
+		gatherRequest = collapse.gatherRequest(gatherRequest)
+		collapseWindow = gatherRequest.Size
+	}
+
+	groupingWindow := 0
+	if countOnlyRequest != nil {
+		grouping = nil
+	} else if grouping != nil {
+		gatherRequest = grouping.gatherRequest(gatherRequest)
+		groupingWindow = gatherRequest.Size
+	}
+
+	geoDistanceWindow := 0
+	if countOnlyRequest != nil {
+		geoDistance = nil
+	} else if geoDistance != nil {
+		gatherRequest = geoDistance.gatherRequest(gatherRequest)
+		geoDistanceWindow = gatherRequest.Size
+	}
+
+	gatherRequest = queryFacetsGatherRequest(gatherRequest, facetOpts)
+	gatherRequest = queryAggregationsGatherRequest(gatherRequest, aggs)
+	gatherRequest = queryCardinalityGatherRequest(gatherRequest,
+		cardinalities)
+
+	// The pre-check is of the requested sizes, as the gather request
+	// of a paged facet asks for every term of the facet.
+	memoryMax := queryMemoryMax(mgr)
+	err = checkQueryMemory(searchRequest, len(gatherTargets), memoryMax)
+	if err != nil {
+		return err
+	}
+	if memoryMax > 0 {
+		gatherTargets = queryMemoryTargets(gatherTargets, aq, memoryMax)
+	}
+
+	searchResult, failed, err := queryGather(gatherTargets, names,
+		gatherRequest, cancelCh, sortHits)
+	if err := aq.Err(); err != nil {
+		return fmt.Errorf("bleve: QueryBlevePIndexImpl, err: %v", err)
+	}
+	if err != nil || (len(failed) > 0 && !allowPartial) {
+		return queryGatherError(failed)
+	}
+
+	if globalScoring || bm25 {
+		responsive := queryResponsiveTargets(targets, names, failed)
+
+		if bm25 {
+			if !globalScoring {
+				responsive = nil // Use the per-pindex doc frequencies.
+			}
+			indexDefs, _, _ := mgr.GetIndexDefs(false)
+			avgLengths := bm25IndexAvgFieldLengths(indexDefs,
+				indexName, searchResult.Hits)
+			err = bm25Scoring(searchResult, bleveParams.Similarity,
+				avgLengths, responsive, searchRequest.Explain, sortHits)
+		} else {
+			err = globalIDFScoring(searchResult, responsive,
+				searchRequest.Explain, sortHits)
+		}
+		if err != nil {
+			return err
+		}
+		if warning := queryRescoreWarning(searchResult,
+			rescoreWindow); warning != "" {
+			warnings = append(warnings, warning)
+		}
+
+		// The function_score is applied after the rescoring, as the
+		// rescoring recomputes the scores from the explanations.
+		if fnScore != nil {
+			fnScore.rescore(searchResult.Hits)
+			sortHits(searchResult.Hits)
+		}
+	}
+
+	// The collapsing is of the merged hits of all the pindexes, as
+	// the docs of a group may be in any partition.
+	if collapse != nil {
+		collapse.collapse(searchResult)
+		if warning := collapse.warning(searchResult, collapseWindow,
+			searchRequest); warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+
+	// The reranking is of the final merged order, before paging.
+	if rerank != nil {
+		if warning := rerank.rerank(indexName, req, searchResult); warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+
+	// The distances are of the merged hits, too, which are sorted by
+	// distance after any reranking.
+	var geoDistances map[string]float64
+	if geoDistance != nil {
+		geoDistances = geoDistance.distances(searchResult.Hits)
+		geoDistance.sort(searchResult, geoDistances)
+		if warning := geoDistance.warning(searchResult,
+			geoDistanceWindow); warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+
+	// The grouping is of the merged hits of all the pindexes, too, and
+	// pages through the groups instead of the hits.
+	var groupsResult *QueryGroupsResult
+	if grouping != nil {
+		var warning string
+		groupsResult, warning = grouping.group(searchResult,
+			searchRequest, groupingWindow)
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+	} else if globalScoring || bm25 || fnScore != nil || rerank != nil ||
+		collapse != nil || geoDistance != nil {
+		searchResultPage(searchResult, searchRequest)
+	}
+
+	var collapseResult *QueryCollapseResult
+	if collapse != nil {
+		collapseResult = collapse.result(searchResult.Hits)
+		err = collapse.groupCounts(req, collapseResult,
+			queryResponsiveTargets(targets, names, failed))
+		if err != nil {
+			return err
+		}
+	}
+
+	if grouping != nil {
+		warning, err := grouping.totals(req, groupsResult,
+			queryResponsiveTargets(targets, names, failed))
+		if err != nil {
+			return err
+		}
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+
+	searchResult.Request = searchRequest
+
+	facetPages := queryFacetsPages(searchResult, searchRequest, facetOpts)
+	queryFacetsMissingBuckets(searchResult, searchRequest, facetMissing)
+	aggResults := queryAggregationsResults(searchResult, aggs)
+	cardinalityResults := queryCardinalityResults(searchResult,
+		cardinalities)
+
+	patterns := queryFieldsPatterns(searchRequest.Fields)
+	if patterns == nil && (fnScore != nil || collapse != nil ||
+		grouping != nil || geoDistance != nil) {
+		// Drop the additional fields of the functions, groupings or
+		// distances.
+		patterns = append([]string{}, searchRequest.Fields...)
+	}
+	if patterns != nil {
+		filterHitFields(searchResult.Hits, patterns)
+	}
+
+	fetchPartial := false
+	if queryFetchFromKV(req) {
+		fetchWarnings, partial, err := fetchHitsFromKV(mgr, indexName,
+			searchResult.Hits)
+		if err != nil {
+			return err
+		}
+		warnings = append(warnings, fetchWarnings...)
+		fetchPartial = partial
+	}
+
+	resultEx := newSearchResultEx(searchResult, warnings)
+	resultEx.Aggregations = aggResults
+	resultEx.FacetPages = facetPages
+	resultEx.Cardinalities = cardinalityResults
+	resultEx.Collapse = collapseResult
+	resultEx.Groups = groupsResult
+	if geoDistance != nil {
+		resultEx.GeoDistance = geoDistance.result(searchResult.Hits,
+			geoDistances)
+	}
+	if len(failed) > 0 {
+		resultEx.Partial = true
+		resultEx.FailedPIndexes = failed
+	}
+	if fetchPartial {
+		resultEx.Partial = true
+	}
+
+	rest.MustEncode(res, resultEx)
+
+	return nil
 }
 
 // ---------------------------------------------------------
@@ -347,6 +1003,9 @@ func (t *BleveDest) closeUnlocked() error {
 	t.bindex.Close()
 	t.bindex = nil
 
+	removePIndexSnapshots(t.path, 0)
+	prunePIndexFileChecksums(t.path)
+
 	go func() {
 		// Cancel/error any consistency wait requests.
 		err := fmt.Errorf("bleve: closeUnlocked")
@@ -357,6 +1016,7 @@ func (t *BleveDest) closeUnlocked() error {
 				cwr.DoneCh <- err
 				close(cwr.DoneCh)
 			}
+			bdp.resetBatchUnlocked()
 			bdp.m.Unlock()
 		}
 	}()
@@ -367,8 +1027,13 @@ func (t *BleveDest) closeUnlocked() error {
 // ---------------------------------------------------------
 
 func (t *BleveDest) Rollback(partition string, rollbackSeq uint64) error {
+	LogDebugf(LOG_CATEGORY_FEED, "bleve: rollback, path: %s,"+
+		" partition: %s, rollbackSeq: %d", t.path, partition, rollbackSeq)
+
 	t.AddError("dest rollback", partition, nil, rollbackSeq, nil, nil)
 
+	atomic.AddUint64(&t.metrics.DCPRollbacks, 1)
+
 	t.m.Lock()
 	defer t.m.Unlock()
 
@@ -397,6 +1062,14 @@ func (t *BleveDest) Rollback(partition string, rollbackSeq uint64) error {
 
 	os.RemoveAll(t.path)
 
+	WebhookNotify(&WebhookEvent{
+		Event:       WEBHOOK_EVENT_FEED_ROLLBACK,
+		IndexName:   t.indexName,
+		PIndexName:  strings.TrimSuffix(filepath.Base(t.path), ".pindex"),
+		Partition:   partition,
+		RollbackSeq: rollbackSeq,
+	})
+
 	t.restart()
 
 	return nil
@@ -441,6 +1114,16 @@ func (t *BleveDest) ConsistencyWait(partition, partitionUUID string,
 		close(cwr.DoneCh)
 	} else if cwr.ConsistencySeq > seq {
 		heap.Push(&bdp.cwrQueue, cwr)
+
+		// A deferred batch flush is applied right away for the waiter.
+		if bdp.flushTimer != nil && cwr.ConsistencySeq <= bdp.seqMax {
+			err = bdp.applyBatchUnlocked()
+			if err != nil {
+				bdp.m.Unlock()
+				t.m.Unlock()
+				return err
+			}
+		}
 	} else {
 		close(cwr.DoneCh)
 	}
@@ -500,11 +1183,16 @@ func (t *BleveDest) Query(pindex *cbgt.PIndex, req []byte, res io.Writer,
 		return err
 	}
 
+	LogDebugf(LOG_CATEGORY_QUERY, "bleve: query, path: %s, req: %s",
+		t.path, req)
+
 	searchResponse, err := t.bindex.Search(searchRequest)
 	if err != nil {
 		return err
 	}
 
+	queryCardinalitySketches(searchResponse)
+
 	rest.MustEncode(res, searchResponse)
 
 	return nil
@@ -517,6 +1205,11 @@ func (t *BleveDest) AddError(op, partition string,
 	log.Printf("bleve: %s, partition: %s, key: %q, seq: %d,"+
 		" val: %q, err: %v", op, partition, key, seq, val, err)
 
+	if err != nil {
+		atomic.AddUint64(&t.metrics.IngestErrors, 1)
+		t.recordIngestError(op, partition, key, seq, val, err)
+	}
+
 	e := struct {
 		Time      string
 		Op        string
@@ -604,6 +1297,15 @@ func (t *BleveDest) Stats(w io.Writer) (err error) {
 	t.m.Unlock()
 	w.Write(cbgt.JsonCloseBrace)
 
+	w.Write([]byte(`,"quarantined":`))
+	w.Write([]byte(strconv.FormatBool(IsQuarantined(t.indexName))))
+
+	if t.keyFilter != nil {
+		w.Write([]byte(`,"keysFiltered":`))
+		w.Write([]byte(strconv.FormatUint(
+			atomic.LoadUint64(&t.keysFiltered), 10)))
+	}
+
 	w.Write(cbgt.JsonCloseBrace)
 
 	return nil
@@ -619,18 +1321,70 @@ func (t *BleveDestPartition) DataUpdate(partition string,
 	key []byte, seq uint64, val []byte,
 	cas uint64,
 	extrasType cbgt.DestExtrasType, extras []byte) error {
+	diskWatermarkWait(t.bdest)
+
+	defer t.bdest.metrics.recordFeedCall(time.Now())
+
+	if t.bdest.keyFilter != nil && !t.bdest.keyFilter(key) {
+		return t.skip(seq)
+	}
+
 	k := string(key)
 
 	var v interface{}
 
 	var errv error
 	var erri error
+	var erra []error
+	var errd []error
+	var errp []error
+	var errg []error
+
+	errv = json.Unmarshal(val, &v)
+
+	// Attachments are extracted outside of the lock, as extraction may
+	// be slow.
+	if errv == nil && t.bdest.attachments != nil {
+		if m, ok := v.(map[string]interface{}); ok {
+			erra = t.bdest.attachments.extract(m)
+		}
+	}
+	if errv == nil && len(t.bdest.dateFormats) > 0 {
+		if m, ok := v.(map[string]interface{}); ok {
+			errd = dateFormatsApply(m, t.bdest.dateFormats)
+		}
+	}
+	if errv == nil && len(t.bdest.ipFields) > 0 {
+		if m, ok := v.(map[string]interface{}); ok {
+			errp = ipFieldsApply(m, t.bdest.ipFields)
+		}
+	}
+	if errv == nil && len(t.bdest.geoShapeFields) > 0 {
+		if m, ok := v.(map[string]interface{}); ok {
+			errg = geoShapesApply(m, t.bdest.geoShapeFields,
+				t.bdest.geoShape)
+		}
+	}
 
 	t.m.Lock()
 
-	errv = json.Unmarshal(val, &v)
 	if errv == nil {
+		if m, ok := v.(map[string]interface{}); ok {
+			if t.bdest.expiryAware {
+				if exp := dcpExtrasExpiry(extrasType, extras); exp > 0 {
+					m[EXPIRY_FIELD] = float64(exp)
+				}
+			}
+			if t.bdest.docTypeStats {
+				m[DOC_TYPE_FIELD] = docMappingType(t.bindex.Mapping(), m)
+			}
+		}
 		erri = t.batch.Index(k, v)
+		if erri == nil && len(t.bdest.nested) > 0 {
+			m, _ := v.(map[string]interface{})
+			erri = t.indexNestedUnlocked(k, m)
+		}
+		t.batchOpUnlocked(len(val))
 	}
 	err := t.updateSeqUnlocked(seq)
 
@@ -642,6 +1396,29 @@ func (t *BleveDestPartition) DataUpdate(partition string,
 	if erri != nil {
 		t.bdest.AddError("batch.Index", partition, key, seq, val, erri)
 	}
+	for _, err := range erra {
+		t.bdest.AddError("attachments", partition, key, seq, nil, err)
+	}
+	for _, err := range errd {
+		t.bdest.AddError("dateFormats", partition, key, seq, nil, err)
+	}
+	for _, err := range errp {
+		t.bdest.AddError("ipFields", partition, key, seq, nil, err)
+	}
+	for _, err := range errg {
+		t.bdest.AddError("geoShapes", partition, key, seq, nil, err)
+	}
+
+	atomic.AddUint64(&t.bdest.mutations, 1)
+	atomic.AddUint64(&t.bdest.metrics.BytesIndexed, uint64(len(val)))
+
+	ingestBudgetRecord(t.bdest.indexName, errv != nil || erri != nil ||
+		len(erra) > 0 || len(errd) > 0 || len(errp) > 0 || len(errg) > 0)
+
+	if errv == nil && erri == nil {
+		percolateOnIngest(t.bdest.indexName, t.bindex.Mapping(),
+			partition, k, seq, v)
+	}
 
 	return err
 }
@@ -650,20 +1427,59 @@ func (t *BleveDestPartition) DataDelete(partition string,
 	key []byte, seq uint64,
 	cas uint64,
 	extrasType cbgt.DestExtrasType, extras []byte) error {
+	diskWatermarkWait(t.bdest)
+
+	defer t.bdest.metrics.recordFeedCall(time.Now())
+
+	if t.bdest.keyFilter != nil && !t.bdest.keyFilter(key) {
+		return t.skip(seq)
+	}
+
 	t.m.Lock()
 
 	t.batch.Delete(string(key)) // TODO: string(key) makes garbage?
+	var errn error
+	if len(t.bdest.nested) > 0 {
+		errn = t.deleteNestedUnlocked(string(key))
+	}
+	t.batchOpUnlocked(len(key))
 	err := t.updateSeqUnlocked(seq)
 
 	t.m.Unlock()
+
+	if errn != nil {
+		t.bdest.AddError("nested", partition, key, seq, nil, errn)
+	}
+
+	atomic.AddUint64(&t.bdest.mutations, 1)
+
+	ingestBudgetRecord(t.bdest.indexName, errn != nil)
+
+	return err
+}
+
+// skip tracks the seq of a mutation whose key was rejected by the
+// dest's keyFilter, without touching the batch.
+func (t *BleveDestPartition) skip(seq uint64) error {
+	atomic.AddUint64(&t.bdest.keysFiltered, 1)
+
+	t.m.Lock()
+	err := t.updateSeqUnlocked(seq)
+	t.m.Unlock()
+
 	return err
 }
 
 func (t *BleveDestPartition) SnapshotStart(partition string,
 	snapStart, snapEnd uint64) error {
+	LogDebugf(LOG_CATEGORY_FEED, "bleve: snapshot start, partition: %s,"+
+		" snapStart: %d, snapEnd: %d", partition, snapStart, snapEnd)
+
+	defer t.bdest.metrics.recordFeedCall(time.Now())
+
 	t.m.Lock()
 
-	err := t.applyBatchUnlocked()
+	err := t.flushUnlocked()
 	if err != nil {
 		t.m.Unlock()
 		return err
@@ -769,13 +1585,18 @@ func (t *BleveDestPartition) updateSeqUnlocked(seq uint64) error {
 	}
 
 	if seq < t.seqSnapEnd {
+		if t.batchFullUnlocked() {
+			return t.applyBatchUnlocked()
+		}
 		return nil
 	}
 
-	return t.applyBatchUnlocked()
+	return t.flushUnlocked()
 }
 
 func (t *BleveDestPartition) applyBatchUnlocked() error {
+	ops := t.batch.Size()
+
 	err := cbgt.Timer(func() error {
 		return t.bindex.Batch(t.batch)
 	}, t.bdest.stats.TimerBatchStore)
@@ -783,8 +1604,18 @@ func (t *BleveDestPartition) applyBatchUnlocked() error {
 		return err
 	}
 
+	if ops > 0 {
+		t.bdest.metrics.recordBatch(ops)
+	}
+
 	t.seqMaxBatch = t.seqMax
 
+	if !t.caughtUp && t.seqMaxBatch > 0 {
+		t.caughtUp = webhookPartitionApplied(t.bdest.indexName,
+			strings.TrimSuffix(filepath.Base(t.bdest.path), ".pindex"),
+			t.partition, t.seqMaxBatch, t.seqSnapEnd)
+	}
+
 	for t.cwrQueue.Len() > 0 &&
 		t.cwrQueue[0].ConsistencySeq <= t.seqMaxBatch {
 		cwr := heap.Pop(&t.cwrQueue).(*cbgt.ConsistencyWaitReq)
@@ -796,6 +1627,9 @@ func (t *BleveDestPartition) applyBatchUnlocked() error {
 	// TODO: Would be good to reuse batch's memory; but, would need
 	// some public Reset() kind of method on bleve.Batch?
 	t.batch = t.bindex.NewBatch()
+	t.nestedPending = nil
+
+	t.resetBatchUnlocked()
 
 	return nil
 }
@@ -815,6 +1649,52 @@ func (t *BleveDestPartition) applyBatchUnlocked() error {
 func bleveIndexAlias(mgr *cbgt.Manager, indexName, indexUUID string,
 	ensureCanRead bool, consistencyParams *cbgt.ConsistencyParams,
 	cancelCh <-chan bool) (bleve.IndexAlias, error) {
+	targets, err := bleveIndexTargets(mgr, indexName, indexUUID,
+		ensureCanRead, consistencyParams, cancelCh)
+	if err != nil {
+		return nil, err
+	}
+
+	return bleve.NewIndexAlias(targets...), nil
+}
+
+// bleveIndexParams returns the BleveParams of a bleve index's
+// definition, or default BleveParams if the definition isn't
+// available.
+func bleveIndexParams(mgr *cbgt.Manager, indexName string) *BleveParams {
+	bleveParams := NewBleveParams()
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return bleveParams
+	}
+	indexDef, exists := indexDefsByName[indexName]
+	if !exists || indexDef == nil || len(indexDef.Params) <= 0 {
+		return bleveParams
+	}
+
+	err = json.Unmarshal([]byte(indexDef.Params), bleveParams)
+	if err != nil {
+		return NewBleveParams()
+	}
+	return bleveParams
+}
+
+// Returns the bleve.Index'es that represent all the PIndexes for the
+// index, including perhaps bleve remote client PIndexes.
+func bleveIndexTargets(mgr *cbgt.Manager, indexName, indexUUID string,
+	ensureCanRead bool, consistencyParams *cbgt.ConsistencyParams,
+	cancelCh <-chan bool) ([]bleve.Index, error) {
+	targets, _, err := bleveIndexTargetsNamed(mgr, indexName, indexUUID,
+		ensureCanRead, consistencyParams, cancelCh)
+	return targets, err
+}
+
+// bleveIndexTargetsNamed is like bleveIndexTargets, but also returns
+// the PIndex names of the bleve.Index'es.
+func bleveIndexTargetsNamed(mgr *cbgt.Manager, indexName, indexUUID string,
+	ensureCanRead bool, consistencyParams *cbgt.ConsistencyParams,
+	cancelCh <-chan bool) ([]bleve.Index, []string, error) {
 	planPIndexNodeFilter := cbgt.PlanPIndexNodeOk
 	if ensureCanRead {
 		planPIndexNodeFilter = cbgt.PlanPIndexNodeCanRead
@@ -824,20 +1704,27 @@ func bleveIndexAlias(mgr *cbgt.Manager, indexName, indexUUID string,
 		mgr.CoveringPIndexes(indexName, indexUUID, planPIndexNodeFilter,
 			"queries")
 	if err != nil {
-		return nil, fmt.Errorf("bleve: bleveIndexAlias, err: %v", err)
+		return nil, nil, fmt.Errorf("bleve: bleveIndexTargets, err: %v", err)
 	}
 
-	alias := bleve.NewIndexAlias()
+	var m sync.Mutex // Protects targets and names.
+	var targets []bleve.Index
+	var names []string
 
 	for _, remotePlanPIndex := range remotePlanPIndexes {
-		baseURL := "http://" + remotePlanPIndex.NodeDef.HostPort +
+		baseURL := NodeURL(remotePlanPIndex.NodeDef.HostPort) +
 			"/api/pindex/" + remotePlanPIndex.PlanPIndex.Name
-		alias.Add(&IndexClient{
+		docURL := NodeURL(remotePlanPIndex.NodeDef.HostPort) +
+			"/api/pindex-bleve/" + remotePlanPIndex.PlanPIndex.Name + "/doc/"
+		targets = append(targets, &IndexClient{
 			QueryURL:    baseURL + "/query",
 			CountURL:    baseURL + "/count",
+			DocURL:      docURL,
+			DocsURL:     baseURL + "/docs",
 			Consistency: consistencyParams,
 			// TODO: Propagate auth to remote client.
 		})
+		names = append(names, remotePlanPIndex.PlanPIndex.Name)
 	}
 
 	// TODO: Should kickoff remote queries concurrently before we wait.
@@ -851,14 +1738,17 @@ func bleveIndexAlias(mgr *cbgt.Manager, indexName, indexUUID string,
 				return fmt.Errorf("bleve: wrong type, localPIndex: %#v",
 					localPIndex)
 			}
-			alias.Add(bindex)
+			m.Lock()
+			targets = append(targets, bindex)
+			names = append(names, localPIndex.Name)
+			m.Unlock()
 			return nil
 		})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return alias, nil
+	return targets, names, nil
 }
 
 // ---------------------------------------------------------
@@ -966,6 +1856,21 @@ func BlevePIndexQuerySamples() []cbgt.Documentation {
 				},
 			},
 		},
+		cbgt.Documentation{
+			Text: `A "more like this" query POST body, which finds documents
+that are similar to the given document(s) and/or text, excluding the
+given documents:`,
+			JSON: map[string]interface{}{
+				"size": 10,
+				"query": map[string]interface{}{
+					"more_like_this": map[string]interface{}{
+						"docIDs":        []string{"doc-123"},
+						"fields":        []string{"description"},
+						"maxQueryTerms": MLT_DEFAULT_MAX_QUERY_TERMS,
+					},
+				},
+			},
+		},
 		cbgt.Documentation{
 			Text: `An example POST body using from/size for results paging,
 using ctl for a timeout and for "at_plus" consistency level.
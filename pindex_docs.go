@@ -0,0 +1,265 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/document"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// Reading every document of an index, such as for a materialization
+// or an index archive, can't page through a match_all query by
+// offsets, as the hits tie on score and the index keeps changing, so
+// pages would skip or repeat documents, and deep offsets would make
+// the whole scan quadratic.  Instead, the doc ID's of each pindex are
+// iterated in key order, and the pindexes are merged by doc ID, so
+// that a scan can be resumed after the last doc ID that it read.
+
+// The max number of docs that are returned per pindex docs request.
+const PINDEX_DOCS_LIMIT_MAX = 10000
+
+// A bleveDoc is a document with its stored fields.
+type bleveDoc struct {
+	ID     string                 `json:"id"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// bleveDocsAfter returns up to limit docs of a bleve index, in doc ID
+// order, whose doc ID's are after a doc ID, or from the start when
+// the doc ID is "".
+func bleveDocsAfter(bindex bleve.Index, after string, limit int) (
+	[]*bleveDoc, error) {
+	if r, ok := bindex.(*IndexClient); ok {
+		return r.DocsAfter(after, limit)
+	}
+
+	idx, _, err := bindex.Advanced()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := idx.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	start := ""
+	if after != "" {
+		start = after + "\x00" // The first key after the doc ID.
+	}
+
+	docIDReader, err := reader.DocIDReader(start, "")
+	if err != nil {
+		return nil, err
+	}
+	defer docIDReader.Close()
+
+	var rv []*bleveDoc
+
+	for len(rv) < limit {
+		docID, err := docIDReader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if docID == "" {
+			break
+		}
+
+		doc, err := reader.Document(docID)
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			continue
+		}
+
+		rv = append(rv, &bleveDoc{ID: docID, Fields: bleveDocFields(doc)})
+	}
+
+	return rv, nil
+}
+
+// bleveDocFields returns the stored fields of a document, like the
+// fields of a search hit, where a repeated field becomes an array.
+func bleveDocFields(doc *document.Document) map[string]interface{} {
+	rv := map[string]interface{}{}
+
+	for _, f := range doc.Fields {
+		var v interface{}
+		switch f := f.(type) {
+		case *document.TextField:
+			v = string(f.Value())
+		case *document.NumericField:
+			n, err := f.Number()
+			if err != nil {
+				continue
+			}
+			v = n
+		case *document.DateTimeField:
+			t, err := f.DateTime()
+			if err != nil {
+				continue
+			}
+			v = t.Format(time.RFC3339)
+		default:
+			continue
+		}
+
+		switch prev := rv[f.Name()].(type) {
+		case nil:
+			rv[f.Name()] = v
+		case []interface{}:
+			rv[f.Name()] = append(prev, v)
+		default:
+			rv[f.Name()] = []interface{}{prev, v}
+		}
+	}
+
+	return rv
+}
+
+// A bleveDocIter iterates the docs of some bleve indexes, like the
+// pindexes of an index, in doc ID order, by merging the docs of each
+// index as they're read in batches.
+type bleveDocIter struct {
+	targets []bleve.Index
+	batch   int
+	afters  []string      // The last doc ID read, per target.
+	bufs    [][]*bleveDoc // The docs read but not yet returned.
+	done    []bool
+}
+
+// newBleveDocIter returns an iterator of the docs whose doc ID's are
+// after a doc ID, or of all the docs when the doc ID is "".
+func newBleveDocIter(targets []bleve.Index, after string,
+	batch int) *bleveDocIter {
+	it := &bleveDocIter{
+		targets: targets,
+		batch:   batch,
+		afters:  make([]string, len(targets)),
+		bufs:    make([][]*bleveDoc, len(targets)),
+		done:    make([]bool, len(targets)),
+	}
+	for i := range targets {
+		it.afters[i] = after
+	}
+	return it
+}
+
+// Next returns the next doc, or nil when there are no more docs.  A
+// doc ID that's in several targets is only returned once.
+func (it *bleveDocIter) Next() (*bleveDoc, error) {
+	min := -1
+
+	for i, target := range it.targets {
+		if len(it.bufs[i]) <= 0 && !it.done[i] {
+			docs, err := bleveDocsAfter(target, it.afters[i], it.batch)
+			if err != nil {
+				return nil, err
+			}
+			if len(docs) <= 0 {
+				it.done[i] = true
+				continue
+			}
+			it.bufs[i] = docs
+			it.afters[i] = docs[len(docs)-1].ID
+		}
+		if len(it.bufs[i]) > 0 &&
+			(min < 0 || it.bufs[i][0].ID < it.bufs[min][0].ID) {
+			min = i
+		}
+	}
+
+	if min < 0 {
+		return nil, nil
+	}
+
+	rv := it.bufs[min][0]
+
+	for i := range it.bufs {
+		if len(it.bufs[i]) > 0 && it.bufs[i][0].ID == rv.ID {
+			it.bufs[i] = it.bufs[i][1:]
+		}
+	}
+
+	return rv, nil
+}
+
+// ---------------------------------------------------------
+
+// PIndexDocsHandler is a REST handler that returns the docs of a
+// local pindex in doc ID order, so that remote nodes can iterate the
+// docs of an index.
+type PIndexDocsHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPIndexDocsHandler(mgr *cbgt.Manager) *PIndexDocsHandler {
+	return &PIndexDocsHandler{mgr: mgr}
+}
+
+func (h *PIndexDocsHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	pindexName := mux.Vars(req)["pindexName"]
+
+	_, pindexes := h.mgr.CurrentMaps()
+	pindex := pindexes[pindexName]
+	if pindex == nil {
+		rest.ShowError(w, req, fmt.Sprintf("pindex_docs: no pindex,"+
+			" pindexName: %s", pindexName), 400)
+		return
+	}
+
+	bindex, ok := pindex.Impl.(bleve.Index)
+	if !ok || bindex == nil {
+		rest.ShowError(w, req, fmt.Sprintf("pindex_docs: not a bleve"+
+			" pindex, pindexName: %s", pindexName), 400)
+		return
+	}
+
+	limit := MaterializeBatchSize
+	if v := req.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > PINDEX_DOCS_LIMIT_MAX {
+			rest.ShowError(w, req, fmt.Sprintf("pindex_docs: limit must"+
+				" be between 1 and %d, limit: %s", PINDEX_DOCS_LIMIT_MAX, v), 400)
+			return
+		}
+		limit = n
+	}
+
+	docs, err := bleveDocsAfter(bindex, req.FormValue("after"), limit)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("pindex_docs: could not read"+
+			" docs, pindexName: %s, err: %v", pindexName, err), 500)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string      `json:"status"`
+		Docs   []*bleveDoc `json:"docs"`
+	}{
+		Status: "ok",
+		Docs:   docs,
+	})
+}
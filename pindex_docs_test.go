@@ -0,0 +1,98 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+func TestBleveDocsAfter(t *testing.T) {
+	index, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"c", "a", "b", "ab"} {
+		index.Index(id, map[string]interface{}{"name": id})
+	}
+
+	docs, err := bleveDocsAfter(index, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 || docs[0].ID != "a" || docs[1].ID != "ab" {
+		t.Fatalf("expected the first docs in doc ID order, got: %#v", docs)
+	}
+
+	docs, err = bleveDocsAfter(index, "ab", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 || docs[0].ID != "b" || docs[1].ID != "c" {
+		t.Fatalf("expected the docs after ab, got: %#v", docs)
+	}
+
+	docs, err = bleveDocsAfter(index, "c", 10)
+	if err != nil || len(docs) != 0 {
+		t.Errorf("expected no docs after c, got: %#v, err: %v", docs, err)
+	}
+}
+
+func TestBleveDocIter(t *testing.T) {
+	var targets []bleve.Index
+	for _, ids := range [][]string{
+		{"a", "d", "e"},
+		{"b", "c", "d", "f"},
+		{},
+	} {
+		index, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids {
+			index.Index(id, map[string]interface{}{"name": id})
+		}
+		targets = append(targets, index)
+	}
+
+	ids := func(after string) []string {
+		var rv []string
+		it := newBleveDocIter(targets, after, 2)
+		for {
+			doc, err := it.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if doc == nil {
+				return rv
+			}
+			if doc.Fields["name"] != doc.ID {
+				t.Errorf("expected the stored fields, got: %#v", doc)
+			}
+			rv = append(rv, doc.ID)
+		}
+	}
+
+	exp := []string{"a", "b", "c", "d", "e", "f"}
+	if got := ids(""); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+
+	// Resuming after a checkpoint.
+	exp = []string{"e", "f"}
+	if got := ids("d"); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+}
@@ -0,0 +1,1156 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"archive/tar"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The pindex file transfer protocol copies the files of a pindex
+// from one node to another, such as for shipping pindex snapshots
+// instead of rebuilding pindexes from their data sources.  The
+// source node serves...
+//
+//   GET /api/pindex/{pindexName}/files
+//       lists the files with their sizes and checksums.
+//   GET /api/pindex/{pindexName}/file/{path}
+//       returns a file, with HTTP range requests and caching
+//       (ETag of the checksum, If-Range, If-None-Match).
+//   GET /api/pindex/{pindexName}/filesBulk?path=...
+//       returns several (small) files as a tar, in one request.
+//   POST /api/pindex/{pindexName}/snapshot
+//       copies the files of the pindex, while its ingest is paused,
+//       into a snapshot, returning the snapshot's ID and seq's.
+//   DELETE /api/pindex/{pindexName}/snapshot/{snapshot}
+//       releases a snapshot.
+//
+// The files, file and filesBulk requests serve the files of a
+// snapshot instead of the live pindex when given a snapshot=ID query
+// param, so that a transfer sees a consistent copy of the pindex
+// whose files don't change under it.  Unreleased snapshots are
+// removed after PIndexSnapshotTTL, and when the pindex is closed.
+//
+// A PIndexFileTransfer fetches the files in chunks into partial files
+// in the destination dir, so that a transfer which was interrupted
+// resumes from where it left off rather than from zero, and verifies
+// the checksum of every file.
+
+// The suffix of a partially transferred file.
+const PINDEX_TRANSFER_PART_SUFFIX = ".part"
+
+// The suffix of the dir of a pindex snapshot, which is followed by
+// the snapshot's ID.
+const PINDEX_SNAPSHOT_SUFFIX = ".snapshot-"
+
+// The age after which an unreleased pindex snapshot is removed.
+var PIndexSnapshotTTL = time.Hour
+
+// PIndexFile describes a file of a pindex.
+type PIndexFile struct {
+	Path     string `json:"path"` // Relative to the pindex dir.
+	Size     int64  `json:"size"`
+	ModTime  string `json:"modTime"`
+	Checksum string `json:"checksum"` // Hex of the SHA-1 of the file.
+}
+
+// PIndexTransferStats are the node's pindex file transfer stats.
+type PIndexTransferStats struct {
+	TotServeList        uint64
+	TotServeFile        uint64
+	TotServeRange       uint64
+	TotServeBulk        uint64
+	TotServeBytes       uint64
+	TotFetchFile        uint64
+	TotFetchFileSkip    uint64
+	TotFetchChunk       uint64
+	TotFetchBulk        uint64
+	TotFetchBytes       uint64
+	TotFetchResume      uint64
+	TotFetchRetry       uint64
+	TotFetchChecksumErr uint64
+}
+
+var pindexTransferStats PIndexTransferStats
+
+// CurrentPIndexTransferStats returns a copy of the node's pindex file
+// transfer stats.
+func CurrentPIndexTransferStats() PIndexTransferStats {
+	s := &pindexTransferStats
+	return PIndexTransferStats{
+		TotServeList:        atomic.LoadUint64(&s.TotServeList),
+		TotServeFile:        atomic.LoadUint64(&s.TotServeFile),
+		TotServeRange:       atomic.LoadUint64(&s.TotServeRange),
+		TotServeBulk:        atomic.LoadUint64(&s.TotServeBulk),
+		TotServeBytes:       atomic.LoadUint64(&s.TotServeBytes),
+		TotFetchFile:        atomic.LoadUint64(&s.TotFetchFile),
+		TotFetchFileSkip:    atomic.LoadUint64(&s.TotFetchFileSkip),
+		TotFetchChunk:       atomic.LoadUint64(&s.TotFetchChunk),
+		TotFetchBulk:        atomic.LoadUint64(&s.TotFetchBulk),
+		TotFetchBytes:       atomic.LoadUint64(&s.TotFetchBytes),
+		TotFetchResume:      atomic.LoadUint64(&s.TotFetchResume),
+		TotFetchRetry:       atomic.LoadUint64(&s.TotFetchRetry),
+		TotFetchChecksumErr: atomic.LoadUint64(&s.TotFetchChecksumErr),
+	}
+}
+
+// ---------------------------------------------------------
+
+type pindexFileChecksum struct {
+	size     int64
+	modTime  time.Time
+	checksum string
+}
+
+var pindexFileChecksumsM sync.Mutex
+
+// Cache of file checksums, keyed by absolute file path, which are
+// recomputed when a file's size or modTime changes.
+var pindexFileChecksums = map[string]*pindexFileChecksum{}
+
+// PIndexFileChecksum returns the hex of the SHA-1 of a file.
+func PIndexFileChecksum(path string, fi os.FileInfo) (string, error) {
+	pindexFileChecksumsM.Lock()
+	c := pindexFileChecksums[path]
+	pindexFileChecksumsM.Unlock()
+
+	if c != nil && c.size == fi.Size() && c.modTime.Equal(fi.ModTime()) {
+		return c.checksum, nil
+	}
+
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		return "", err
+	}
+
+	pindexFileChecksumsM.Lock()
+	pindexFileChecksums[path] = &pindexFileChecksum{
+		size:     fi.Size(),
+		modTime:  fi.ModTime(),
+		checksum: checksum,
+	}
+	pindexFileChecksumsM.Unlock()
+
+	return checksum, nil
+}
+
+// prunePIndexFileChecksums removes the cached checksums of the files
+// under a dir, such as of a closed pindex or a released snapshot.
+func prunePIndexFileChecksums(dir string) {
+	prefix := filepath.Clean(dir) + string(filepath.Separator)
+
+	pindexFileChecksumsM.Lock()
+	for path := range pindexFileChecksums {
+		if strings.HasPrefix(path, prefix) {
+			delete(pindexFileChecksums, path)
+		}
+	}
+	pindexFileChecksumsM.Unlock()
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ListPIndexFiles returns the files of a pindex dir, sorted by path.
+func ListPIndexFiles(dir string) ([]*PIndexFile, error) {
+	var rv []*PIndexFile
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		checksum, err := PIndexFileChecksum(path, fi)
+		if err != nil {
+			return err
+		}
+
+		rv = append(rv, &PIndexFile{
+			Path:     filepath.ToSlash(rel),
+			Size:     fi.Size(),
+			ModTime:  fi.ModTime().Format(time.RFC3339Nano),
+			Checksum: checksum,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(pindexFilesByPath(rv))
+
+	return rv, nil
+}
+
+type pindexFilesByPath []*PIndexFile
+
+func (a pindexFilesByPath) Len() int           { return len(a) }
+func (a pindexFilesByPath) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a pindexFilesByPath) Less(i, j int) bool { return a[i].Path < a[j].Path }
+
+// pindexFilePath returns the absolute path of a file of a pindex dir,
+// or an error if the relative path escapes the pindex dir.
+func pindexFilePath(dir, rel string) (string, error) {
+	p := filepath.Clean(filepath.FromSlash(rel))
+	if p == "." || filepath.IsAbs(p) ||
+		p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("pindex_transfer: bad path: %s", rel)
+	}
+	return filepath.Join(dir, p), nil
+}
+
+// pindexDir returns the dir of a local pindex.
+func pindexDir(mgr *cbgt.Manager, pindexName string) (string, error) {
+	_, pindexes := mgr.CurrentMaps()
+	pindex := pindexes[pindexName]
+	if pindex == nil {
+		return "", fmt.Errorf("pindex_transfer: no pindex,"+
+			" pindexName: %s", pindexName)
+	}
+	return pindex.Path, nil
+}
+
+// pindexRequestDir returns the dir of the local pindex of a request,
+// or of the pindex's snapshot when the request has a snapshot param.
+func pindexRequestDir(mgr *cbgt.Manager, req *http.Request) (string, error) {
+	dir, err := pindexDir(mgr, mux.Vars(req)["pindexName"])
+	if err != nil {
+		return "", err
+	}
+
+	snapshot := req.URL.Query().Get("snapshot")
+	if snapshot == "" {
+		return dir, nil
+	}
+
+	return pindexSnapshotDir(dir, snapshot)
+}
+
+// pindexSnapshotDir returns the dir of an existing snapshot of a
+// pindex dir.
+func pindexSnapshotDir(dir, snapshot string) (string, error) {
+	if snapshot == "" || strings.ContainsAny(snapshot, "./\\") {
+		return "", fmt.Errorf("pindex_transfer: bad snapshot: %s", snapshot)
+	}
+
+	rv := dir + PINDEX_SNAPSHOT_SUFFIX + snapshot
+
+	fi, err := os.Stat(rv)
+	if err != nil || !fi.IsDir() {
+		return "", fmt.Errorf("pindex_transfer: no snapshot: %s", snapshot)
+	}
+
+	return rv, nil
+}
+
+// removePIndexSnapshots removes the snapshots of a pindex dir that
+// are older than the maxAge, or all of them when maxAge is 0.
+func removePIndexSnapshots(dir string, maxAge time.Duration) {
+	paths, _ := filepath.Glob(dir + PINDEX_SNAPSHOT_SUFFIX + "*")
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if maxAge > 0 && time.Since(fi.ModTime()) < maxAge {
+			continue
+		}
+
+		os.RemoveAll(path)
+		prunePIndexFileChecksums(path)
+	}
+}
+
+// copyPIndexFiles copies the files of a pindex dir into a new dir.
+func copyPIndexFiles(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(out, in)
+		if err != nil {
+			out.Close()
+			return err
+		}
+
+		err = out.Close()
+		if err != nil {
+			return err
+		}
+
+		// Keep the modTime, so the source's cached checksums stay
+		// meaningful for the copy.
+		return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+	})
+}
+
+// snapshotFiles copies the files of the BleveDest into a dir while
+// the ingest of all its partitions is paused, so that the copy is
+// consistent, returning the seq of each partition that the copy has
+// applied.
+func (t *BleveDest) snapshotFiles(dir string) (map[string]uint64, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.bindex == nil {
+		return nil, fmt.Errorf("pindex_transfer: BleveDest closed")
+	}
+
+	seqs := map[string]uint64{}
+
+	for partition, bdp := range t.partitions {
+		bdp.m.Lock()
+		defer bdp.m.Unlock()
+
+		seqs[partition] = bdp.seqMaxBatch
+	}
+
+	err := copyPIndexFiles(t.path, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return seqs, nil
+}
+
+// ---------------------------------------------------------
+
+// PIndexFilesHandler is a REST handler that lists the files of a
+// local pindex.
+type PIndexFilesHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPIndexFilesHandler(mgr *cbgt.Manager) *PIndexFilesHandler {
+	return &PIndexFilesHandler{mgr: mgr}
+}
+
+func (h *PIndexFilesHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	dir, err := pindexRequestDir(h.mgr, req)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	files, err := ListPIndexFiles(dir)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("pindex_transfer: could not"+
+			" list files, err: %v", err), 500)
+		return
+	}
+
+	atomic.AddUint64(&pindexTransferStats.TotServeList, 1)
+
+	rest.MustEncode(w, struct {
+		Status string        `json:"status"`
+		Files  []*PIndexFile `json:"files"`
+	}{
+		Status: "ok",
+		Files:  files,
+	})
+}
+
+// PIndexFileHandler is a REST handler that returns a file of a local
+// pindex, supporting range requests and caching.
+type PIndexFileHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPIndexFileHandler(mgr *cbgt.Manager) *PIndexFileHandler {
+	return &PIndexFileHandler{mgr: mgr}
+}
+
+func (h *PIndexFileHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	dir, err := pindexRequestDir(h.mgr, req)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	path, err := pindexFilePath(dir, vars["path"])
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("pindex_transfer: could not"+
+			" open file, err: %v", err), 404)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		rest.ShowError(w, req, "pindex_transfer: not a file", 404)
+		return
+	}
+
+	checksum, err := PIndexFileChecksum(path, fi)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("pindex_transfer: could not"+
+			" checksum file, err: %v", err), 500)
+		return
+	}
+
+	etag := `"` + checksum + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	atomic.AddUint64(&pindexTransferStats.TotServeFile, 1)
+	if req.Header.Get("Range") != "" {
+		atomic.AddUint64(&pindexTransferStats.TotServeRange, 1)
+	}
+
+	// ServeContent handles the Range and If-Range headers.
+	http.ServeContent(&countingResponseWriter{w},
+		req, fi.Name(), fi.ModTime(), f)
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	atomic.AddUint64(&pindexTransferStats.TotServeBytes, uint64(n))
+	return n, err
+}
+
+// PIndexFilesBulkHandler is a REST handler that returns several files
+// of a local pindex as a tar.
+type PIndexFilesBulkHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPIndexFilesBulkHandler(mgr *cbgt.Manager) *PIndexFilesBulkHandler {
+	return &PIndexFilesBulkHandler{mgr: mgr}
+}
+
+func (h *PIndexFilesBulkHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	dir, err := pindexRequestDir(h.mgr, req)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rels := req.URL.Query()["path"]
+	if len(rels) <= 0 {
+		rest.ShowError(w, req, "pindex_transfer: path is required", 400)
+		return
+	}
+
+	paths := make([]string, 0, len(rels))
+	for _, rel := range rels {
+		path, err := pindexFilePath(dir, rel)
+		if err != nil {
+			rest.ShowError(w, req, err.Error(), 400)
+			return
+		}
+		paths = append(paths, path)
+	}
+
+	atomic.AddUint64(&pindexTransferStats.TotServeBulk, 1)
+
+	w.Header().Set("Content-Type", "application/x-tar")
+
+	tw := tar.NewWriter(&countingResponseWriter{w})
+
+	for i, path := range paths {
+		err = writePIndexFileTar(tw, rels[i], path)
+		if err != nil {
+			// The response has started, so the client will see a
+			// truncated tar.
+			log.Printf("pindex_transfer: bulk, path: %s, err: %v",
+				path, err)
+			return
+		}
+	}
+
+	tw.Close()
+}
+
+func writePIndexFileTar(tw *tar.Writer, rel, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    rel,
+		Mode:    0600,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(tw, f, fi.Size())
+	return err
+}
+
+// PIndexSnapshotHandler is a REST handler that creates a snapshot of
+// a local pindex.
+type PIndexSnapshotHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPIndexSnapshotHandler(mgr *cbgt.Manager) *PIndexSnapshotHandler {
+	return &PIndexSnapshotHandler{mgr: mgr}
+}
+
+func (h *PIndexSnapshotHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	pindexName := mux.Vars(req)["pindexName"]
+
+	_, pindexes := h.mgr.CurrentMaps()
+	pindex := pindexes[pindexName]
+	if pindex == nil {
+		rest.ShowError(w, req, fmt.Sprintf("pindex_transfer: no pindex,"+
+			" pindexName: %s", pindexName), 400)
+		return
+	}
+
+	var bdest *BleveDest
+	if df, ok := pindex.Dest.(*cbgt.DestForwarder); ok {
+		bdest, _ = df.DestProvider.(*BleveDest)
+	}
+	if bdest == nil {
+		rest.ShowError(w, req, fmt.Sprintf("pindex_transfer: not a bleve"+
+			" pindex, pindexName: %s", pindexName), 400)
+		return
+	}
+
+	removePIndexSnapshots(pindex.Path, PIndexSnapshotTTL)
+
+	snapshot := cbgt.NewUUID()
+
+	seqs, err := bdest.snapshotFiles(pindex.Path +
+		PINDEX_SNAPSHOT_SUFFIX + snapshot)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("pindex_transfer: could not"+
+			" snapshot, err: %v", err), 500)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status   string            `json:"status"`
+		Snapshot string            `json:"snapshot"`
+		Seqs     map[string]uint64 `json:"seqs"`
+	}{
+		Status:   "ok",
+		Snapshot: snapshot,
+		Seqs:     seqs,
+	})
+}
+
+// PIndexSnapshotReleaseHandler is a REST handler that removes a
+// snapshot of a local pindex.
+type PIndexSnapshotReleaseHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPIndexSnapshotReleaseHandler(
+	mgr *cbgt.Manager) *PIndexSnapshotReleaseHandler {
+	return &PIndexSnapshotReleaseHandler{mgr: mgr}
+}
+
+func (h *PIndexSnapshotReleaseHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	dir, err := pindexDir(h.mgr, vars["pindexName"])
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	snapshotDir, err := pindexSnapshotDir(dir, vars["snapshot"])
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 404)
+		return
+	}
+
+	os.RemoveAll(snapshotDir)
+	prunePIndexFileChecksums(snapshotDir)
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// PIndexTransferStatsHandler is a REST handler that returns the
+// node's pindex file transfer stats.
+type PIndexTransferStatsHandler struct{}
+
+func NewPIndexTransferStatsHandler() *PIndexTransferStatsHandler {
+	return &PIndexTransferStatsHandler{}
+}
+
+func (h *PIndexTransferStatsHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	rest.MustEncode(w, struct {
+		Status string              `json:"status"`
+		Stats  PIndexTransferStats `json:"stats"`
+	}{
+		Status: "ok",
+		Stats:  CurrentPIndexTransferStats(),
+	})
+}
+
+// ---------------------------------------------------------
+
+// PIndexFileTransfer fetches the files of a pindex from a remote node
+// into a local dir, resuming from any partial files of a previous
+// interrupted transfer.
+type PIndexFileTransfer struct {
+	// The base URL of the remote node, like "http://HOST:PORT".
+	BaseURL    string
+	PIndexName string
+
+	// The local dir where the files are written.
+	Dir string
+
+	// When non-empty, the ID of the remote snapshot whose files are
+	// fetched, instead of the files of the live remote pindex.
+	Snapshot string
+
+	Client *http.Client
+
+	// The size of each range request.  Files no larger than the
+	// chunk size are fetched with bulk requests.
+	ChunkSize int64
+
+	// When > 0, the max fetch throughput.
+	BytesPerSec int64
+
+	// The max number of retries of a failed request, with a backoff
+	// that doubles from RetryBackoff.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// NewPIndexFileTransfer returns a PIndexFileTransfer with defaults.
+func NewPIndexFileTransfer(baseURL, pindexName,
+	dir string) *PIndexFileTransfer {
+	return &PIndexFileTransfer{
+		BaseURL:      strings.TrimSuffix(baseURL, "/"),
+		PIndexName:   pindexName,
+		Dir:          dir,
+		Client:       NodeHTTPClient,
+		ChunkSize:    4 * 1024 * 1024,
+		MaxRetries:   5,
+		RetryBackoff: 500 * time.Millisecond,
+	}
+}
+
+// Run fetches all the files of the remote pindex.
+func (t *PIndexFileTransfer) Run() error {
+	var files []*PIndexFile
+
+	err := t.retry(func() error {
+		var err error
+		files, err = t.listFiles()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var small []*PIndexFile
+
+	for _, file := range files {
+		path, err := pindexFilePath(t.Dir, file.Path)
+		if err != nil {
+			return err
+		}
+
+		checksum, err := fileChecksum(path)
+		if err == nil && checksum == file.Checksum {
+			atomic.AddUint64(&pindexTransferStats.TotFetchFileSkip, 1)
+			continue // Already fetched by a previous transfer.
+		}
+
+		if file.Size <= t.ChunkSize {
+			small = append(small, file)
+			continue
+		}
+
+		err = t.fetchFile(file, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(small) > 0 {
+		return t.retry(func() error {
+			return t.fetchBulk(small)
+		})
+	}
+
+	return nil
+}
+
+func (t *PIndexFileTransfer) pindexURL() string {
+	return t.BaseURL + "/api/pindex/" + url.QueryEscape(t.PIndexName)
+}
+
+// query returns the query params of a request for files, which are
+// of the snapshot, if any.
+func (t *PIndexFileTransfer) query() url.Values {
+	q := url.Values{}
+	if t.Snapshot != "" {
+		q.Set("snapshot", t.Snapshot)
+	}
+	return q
+}
+
+// CreateSnapshot creates a snapshot of the remote pindex, whose files
+// are then fetched by the transfer, returning the seq of each
+// partition that the snapshot has applied.
+func (t *PIndexFileTransfer) CreateSnapshot() (map[string]uint64, error) {
+	resp, err := t.Client.Post(t.pindexURL()+"/snapshot",
+		"application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("pindex_transfer: snapshot,"+
+			" pindexName: %s, status: %d", t.PIndexName, resp.StatusCode)
+	}
+
+	var r struct {
+		Snapshot string            `json:"snapshot"`
+		Seqs     map[string]uint64 `json:"seqs"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Snapshot = r.Snapshot
+
+	return r.Seqs, nil
+}
+
+// ReleaseSnapshot removes the remote snapshot of the transfer.
+func (t *PIndexFileTransfer) ReleaseSnapshot() error {
+	if t.Snapshot == "" {
+		return nil
+	}
+
+	req, err := http.NewRequest("DELETE", t.pindexURL()+"/snapshot/"+
+		url.QueryEscape(t.Snapshot), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("pindex_transfer: release snapshot,"+
+			" pindexName: %s, status: %d", t.PIndexName, resp.StatusCode)
+	}
+
+	t.Snapshot = ""
+
+	return nil
+}
+
+func (t *PIndexFileTransfer) listFiles() ([]*PIndexFile, error) {
+	resp, err := t.Client.Get(t.pindexURL() + "/files?" + t.query().Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("pindex_transfer: list files,"+
+			" pindexName: %s, status: %d", t.PIndexName, resp.StatusCode)
+	}
+
+	var r struct {
+		Files []*PIndexFile `json:"files"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Files, nil
+}
+
+// fetchFile fetches a file in chunks into a partial file, which is
+// renamed to the file once its checksum is verified.
+func (t *PIndexFileTransfer) fetchFile(file *PIndexFile, path string) error {
+	atomic.AddUint64(&pindexTransferStats.TotFetchFile, 1)
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	partPath := path + PINDEX_TRANSFER_PART_SUFFIX
+
+	f, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	offset := fi.Size()
+	if offset > file.Size {
+		offset = 0
+	}
+	resumed := offset > 0
+	if resumed {
+		atomic.AddUint64(&pindexTransferStats.TotFetchResume, 1)
+	}
+
+	for offset < file.Size {
+		err = t.retry(func() error {
+			var err error
+			offset, err = t.fetchChunk(file, f, offset)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = f.Truncate(file.Size)
+	if err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	checksum, err := fileChecksum(partPath)
+	if err != nil {
+		return err
+	}
+	if checksum != file.Checksum {
+		atomic.AddUint64(&pindexTransferStats.TotFetchChecksumErr, 1)
+		os.Remove(partPath)
+		if resumed {
+			// The partial file was stale, so start again from zero.
+			return t.fetchFile(file, path)
+		}
+		return fmt.Errorf("pindex_transfer: checksum mismatch,"+
+			" pindexName: %s, path: %s", t.PIndexName, file.Path)
+	}
+
+	return os.Rename(partPath, path)
+}
+
+// fetchChunk fetches a range of a file starting at the offset, and
+// returns the next offset.
+func (t *PIndexFileTransfer) fetchChunk(file *PIndexFile, f *os.File,
+	offset int64) (int64, error) {
+	end := offset + t.ChunkSize - 1
+	if end >= file.Size {
+		end = file.Size - 1
+	}
+
+	req, err := http.NewRequest("GET",
+		t.pindexURL()+"/file/"+file.Path+"?"+t.query().Encode(), nil)
+	if err != nil {
+		return offset, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, end))
+	// If the file changed, the whole (new) file is returned.
+	req.Header.Set("If-Range", `"`+file.Checksum+`"`)
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return offset, err
+	}
+	defer resp.Body.Close()
+
+	atomic.AddUint64(&pindexTransferStats.TotFetchChunk, 1)
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return offset, fmt.Errorf("pindex_transfer: file changed"+
+			" during transfer, pindexName: %s, path: %s",
+			t.PIndexName, file.Path)
+	default:
+		return offset, fmt.Errorf("pindex_transfer: fetch chunk,"+
+			" pindexName: %s, path: %s, status: %d",
+			t.PIndexName, file.Path, resp.StatusCode)
+	}
+
+	_, err = f.Seek(offset, 0)
+	if err != nil {
+		return offset, err
+	}
+
+	// Bytes written before an error are kept, so a retry continues
+	// after them.
+	n, err := io.Copy(f, t.throttle(resp.Body))
+	return offset + n, err
+}
+
+// fetchBulk fetches small files with a single bulk request.
+func (t *PIndexFileTransfer) fetchBulk(files []*PIndexFile) error {
+	atomic.AddUint64(&pindexTransferStats.TotFetchBulk, 1)
+
+	checksums := map[string]string{}
+
+	q := t.query()
+	for _, file := range files {
+		q.Add("path", file.Path)
+		checksums[file.Path] = file.Checksum
+	}
+
+	resp, err := t.Client.Get(t.pindexURL() + "/filesBulk?" + q.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("pindex_transfer: fetch bulk,"+
+			" pindexName: %s, status: %d", t.PIndexName, resp.StatusCode)
+	}
+
+	tr := tar.NewReader(t.throttle(resp.Body))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		checksum, exists := checksums[hdr.Name]
+		if !exists {
+			return fmt.Errorf("pindex_transfer: unexpected bulk file,"+
+				" pindexName: %s, path: %s", t.PIndexName, hdr.Name)
+		}
+
+		path, err := pindexFilePath(t.Dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		err = writeVerifiedFile(path, tr, checksum)
+		if err != nil {
+			return err
+		}
+
+		atomic.AddUint64(&pindexTransferStats.TotFetchFile, 1)
+		delete(checksums, hdr.Name)
+	}
+
+	if len(checksums) > 0 {
+		return fmt.Errorf("pindex_transfer: incomplete bulk fetch,"+
+			" pindexName: %s, missing: %d", t.PIndexName, len(checksums))
+	}
+
+	return nil
+}
+
+// writeVerifiedFile writes a file via a partial file, which is
+// renamed to the file once its checksum is verified.
+func writeVerifiedFile(path string, r io.Reader, checksum string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	partPath := path + PINDEX_TRANSFER_PART_SUFFIX
+
+	f, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+
+	h := sha1.New()
+
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != checksum {
+		atomic.AddUint64(&pindexTransferStats.TotFetchChecksumErr, 1)
+		os.Remove(partPath)
+		return fmt.Errorf("pindex_transfer: checksum mismatch, path: %s",
+			path)
+	}
+
+	return os.Rename(partPath, path)
+}
+
+func (t *PIndexFileTransfer) retry(f func() error) error {
+	backoff := t.RetryBackoff
+
+	var err error
+	for i := 0; i <= t.MaxRetries; i++ {
+		if i > 0 {
+			atomic.AddUint64(&pindexTransferStats.TotFetchRetry, 1)
+			log.Printf("pindex_transfer: retrying, pindexName: %s,"+
+				" attempt: %d, err: %v", t.PIndexName, i, err)
+			time.Sleep(backoff)
+			backoff = backoff * 2
+		}
+
+		err = f()
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// throttle returns a reader that counts the fetched bytes and limits
+// the read throughput to BytesPerSec.
+func (t *PIndexFileTransfer) throttle(r io.Reader) io.Reader {
+	return &throttledReader{r: r, bytesPerSec: t.BytesPerSec,
+		start: time.Now()}
+}
+
+type throttledReader struct {
+	r           io.Reader
+	bytesPerSec int64
+	start       time.Time
+	n           int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.bytesPerSec > 0 && int64(len(p)) > t.bytesPerSec {
+		p = p[:t.bytesPerSec] // Reads of at most a second's worth.
+	}
+
+	n, err := t.r.Read(p)
+
+	atomic.AddUint64(&pindexTransferStats.TotFetchBytes, uint64(n))
+
+	if t.bytesPerSec > 0 && n > 0 {
+		t.n += int64(n)
+		expected := time.Duration(t.n * int64(time.Second) / t.bytesPerSec)
+		if d := expected - time.Since(t.start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,263 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestPIndexFilePath(t *testing.T) {
+	for _, rel := range []string{"", ".", "..", "../x", "a/../../x", "/etc/x"} {
+		_, err := pindexFilePath("/data/p.pindex", rel)
+		if err == nil {
+			t.Errorf("expected err on bad path: %q", rel)
+		}
+	}
+
+	path, err := pindexFilePath("/data/p.pindex", "store/a/../b")
+	if err != nil || path != filepath.Join("/data/p.pindex", "store", "b") {
+		t.Errorf("expected ok path, got: %s, err: %v", path, err)
+	}
+}
+
+func TestPIndexFileTransfer(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	mgr := cbgt.NewManager(cbgt.VERSION, cbgt.NewCfgMem(), cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	err := mgr.CreateIndex("primary", "", "", "",
+		"bleve", "idx", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	_, pindexes := mgr.CurrentMaps()
+	if len(pindexes) != 1 {
+		t.Fatalf("expected 1 pindex, got: %#v", pindexes)
+	}
+	var pindex *cbgt.PIndex
+	for _, p := range pindexes {
+		pindex = p
+	}
+
+	// A large file, so that it's fetched in chunks.
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+	ioutil.WriteFile(filepath.Join(pindex.Path, "big"), big, 0600)
+
+	r := mux.NewRouter()
+	r.Handle("/api/pindex/{pindexName}/files",
+		NewPIndexFilesHandler(mgr)).Methods("GET")
+	r.Handle("/api/pindex/{pindexName}/file/{path:.*}",
+		NewPIndexFileHandler(mgr)).Methods("GET")
+	r.Handle("/api/pindex/{pindexName}/filesBulk",
+		NewPIndexFilesBulkHandler(mgr)).Methods("GET")
+
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	files, err := ListPIndexFiles(pindex.Path)
+	if err != nil || len(files) <= 1 {
+		t.Fatalf("expected files, got: %#v, err: %v", files, err)
+	}
+
+	destDir := filepath.Join(emptyDir, "dest")
+
+	fetch := func() {
+		x := NewPIndexFileTransfer(s.URL, pindex.Name, destDir)
+		x.ChunkSize = 1024
+		x.MaxRetries = 0
+		err := x.Run()
+		if err != nil {
+			t.Fatalf("expected no err, got: %v", err)
+		}
+
+		for _, file := range files {
+			checksum, err := fileChecksum(filepath.Join(destDir,
+				filepath.FromSlash(file.Path)))
+			if err != nil || checksum != file.Checksum {
+				t.Errorf("expected fetched file: %s, err: %v",
+					file.Path, err)
+			}
+		}
+	}
+
+	fetch()
+
+	// An interrupted transfer of the big file resumes from its
+	// partial file.
+	bigPath := filepath.Join(destDir, "big")
+	os.Remove(bigPath)
+	ioutil.WriteFile(bigPath+PINDEX_TRANSFER_PART_SUFFIX, big[:3000], 0600)
+
+	before := CurrentPIndexTransferStats()
+
+	fetch()
+
+	after := CurrentPIndexTransferStats()
+	if after.TotFetchResume != before.TotFetchResume+1 {
+		t.Errorf("expected a resume, before: %#v, after: %#v",
+			before, after)
+	}
+	if after.TotFetchFileSkip-before.TotFetchFileSkip !=
+		uint64(len(files)-1) {
+		t.Errorf("expected the other files to be skipped, after: %#v",
+			after)
+	}
+	if after.TotFetchChunk-before.TotFetchChunk != 7 {
+		t.Errorf("expected 7 chunks for the rest of the big file,"+
+			" got: %d", after.TotFetchChunk-before.TotFetchChunk)
+	}
+
+	// A stale partial file is detected by its checksum.
+	os.Remove(bigPath)
+	ioutil.WriteFile(bigPath+PINDEX_TRANSFER_PART_SUFFIX,
+		bytes.Repeat([]byte("x"), 3000), 0600)
+
+	fetch()
+
+	x := NewPIndexFileTransfer(s.URL, "not-a-pindex", destDir)
+	x.MaxRetries = 0
+	if x.Run() == nil {
+		t.Errorf("expected err on a missing pindex")
+	}
+}
+
+func TestPIndexSnapshotTransfer(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	mgr := cbgt.NewManager(cbgt.VERSION, cbgt.NewCfgMem(), cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	err := mgr.CreateIndex("primary", "", "", "",
+		"bleve", "idx", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	_, pindexes := mgr.CurrentMaps()
+	var pindex *cbgt.PIndex
+	for _, p := range pindexes {
+		pindex = p
+	}
+	if pindex == nil {
+		t.Fatalf("expected a pindex")
+	}
+
+	r := mux.NewRouter()
+	r.Handle("/api/pindex/{pindexName}/files",
+		NewPIndexFilesHandler(mgr)).Methods("GET")
+	r.Handle("/api/pindex/{pindexName}/file/{path:.*}",
+		NewPIndexFileHandler(mgr)).Methods("GET")
+	r.Handle("/api/pindex/{pindexName}/filesBulk",
+		NewPIndexFilesBulkHandler(mgr)).Methods("GET")
+	r.Handle("/api/pindex/{pindexName}/snapshot",
+		NewPIndexSnapshotHandler(mgr)).Methods("POST")
+	r.Handle("/api/pindex/{pindexName}/snapshot/{snapshot}",
+		NewPIndexSnapshotReleaseHandler(mgr)).Methods("DELETE")
+
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	destDir := filepath.Join(emptyDir, "dest")
+
+	x := NewPIndexFileTransfer(s.URL, pindex.Name, destDir)
+	x.MaxRetries = 0
+
+	_, err = x.CreateSnapshot()
+	if err != nil || x.Snapshot == "" {
+		t.Fatalf("expected a snapshot, got: %q, err: %v", x.Snapshot, err)
+	}
+	snapshotDir := pindex.Path + PINDEX_SNAPSHOT_SUFFIX + x.Snapshot
+
+	// A file written to the live pindex after the snapshot isn't
+	// part of the snapshot.
+	ioutil.WriteFile(filepath.Join(pindex.Path, "later"), []byte("x"), 0600)
+
+	err = x.Run()
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(destDir, "later")); err == nil {
+		t.Errorf("expected only the files of the snapshot")
+	}
+
+	files, err := ListPIndexFiles(snapshotDir)
+	if err != nil || len(files) <= 0 {
+		t.Fatalf("expected snapshot files, got: %#v, err: %v", files, err)
+	}
+	for _, file := range files {
+		checksum, err := fileChecksum(filepath.Join(destDir,
+			filepath.FromSlash(file.Path)))
+		if err != nil || checksum != file.Checksum {
+			t.Errorf("expected fetched file: %s, err: %v", file.Path, err)
+		}
+	}
+
+	err = x.ReleaseSnapshot()
+	if err != nil || x.Snapshot != "" {
+		t.Errorf("expected a released snapshot, err: %v", err)
+	}
+	if _, err = os.Stat(snapshotDir); err == nil {
+		t.Errorf("expected the snapshot dir to be removed")
+	}
+
+	x.Snapshot = "not-a-snapshot"
+	if x.Run() == nil {
+		t.Errorf("expected err on a missing snapshot")
+	}
+	x.Snapshot = "../x"
+	if x.Run() == nil {
+		t.Errorf("expected err on a bad snapshot")
+	}
+}
+
+func TestPrunePIndexFileChecksums(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	a := filepath.Join(emptyDir, "a.pindex")
+	ab := filepath.Join(emptyDir, "ab.pindex")
+	for _, dir := range []string{a, ab} {
+		os.MkdirAll(dir, 0700)
+		ioutil.WriteFile(filepath.Join(dir, "f"), []byte("x"), 0600)
+		_, err := ListPIndexFiles(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prunePIndexFileChecksums(a)
+
+	pindexFileChecksumsM.Lock()
+	_, aok := pindexFileChecksums[filepath.Join(a, "f")]
+	_, abok := pindexFileChecksums[filepath.Join(ab, "f")]
+	pindexFileChecksumsM.Unlock()
+
+	if aok || !abok {
+		t.Errorf("expected only the checksums of the dir to be pruned,"+
+			" a: %v, ab: %v", aok, abok)
+	}
+}
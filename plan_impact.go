@@ -0,0 +1,325 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The rebuild throughput that's assumed when projecting rebuild
+// times, unless the caller provides a measured value.
+var PlanImpactDefaultRebuildBytesPerSec = int64(10 * 1024 * 1024)
+
+// PlanImpact represents the projected effects of a node removal.
+type PlanImpact struct {
+	RemoveNode         string                      `json:"removeNode"`
+	Indexes            map[string]*PlanImpactIndex `json:"indexes"`
+	Moves              []*PlanImpactMove           `json:"moves"`
+	TotalBytesToMove   int64                       `json:"totalBytesToMove"`
+	EstRebuildSecs     float64                     `json:"estRebuildSecs"`
+	RebuildBytesPerSec int64                       `json:"rebuildBytesPerSec"`
+}
+
+// PlanImpactIndex summarizes the projected effects of a node removal
+// on a single index.
+type PlanImpactIndex struct {
+	NumPIndexes int `json:"numPIndexes"`
+
+	// Number of plan pindexes that had a copy on the removed node.
+	PIndexesOnNode int `json:"pindexesOnNode"`
+
+	// Number of plan pindexes that would still have at least one
+	// copy on a remaining node, but would be short a replica until
+	// the rebuild finishes.
+	PIndexesLosingReplica int `json:"pindexesLosingReplica"`
+
+	// Number of plan pindexes whose only copy was on the removed
+	// node, so they'd need a rebuild from the data source before the
+	// index can fully answer queries again.
+	PIndexesLosingAllCopies int `json:"pindexesLosingAllCopies"`
+
+	BytesToMove    int64   `json:"bytesToMove"`
+	EstRebuildSecs float64 `json:"estRebuildSecs"`
+}
+
+// PlanImpactMove represents a plan pindex that would be (re-)built
+// on one or more nodes due to a node removal.
+type PlanImpactMove struct {
+	PlanPIndex string   `json:"planPIndex"`
+	IndexName  string   `json:"indexName"`
+	FromNodes  []string `json:"fromNodes"`
+	ToNodes    []string `json:"toNodes"`
+	Bytes      int64    `json:"bytes"`
+	BytesKnown bool     `json:"bytesKnown"`
+}
+
+// CalcPlanImpact computes the effects of removing a node from the
+// cluster by running the planner against a copy of the nodeDefs that
+// lacks the removed node, and comparing the resulting plan against
+// the current plan.  The pindexBytes callback provides the size of a
+// plan pindex, where the returned bool is false when the size isn't
+// known.  Projected rebuild times assume serial rebuilds, so are on
+// the pessimistic side.
+func CalcPlanImpact(indexDefs *cbgt.IndexDefs, nodeDefs *cbgt.NodeDefs,
+	planPIndexes *cbgt.PlanPIndexes, removeNode, version, server string,
+	pindexBytes func(*cbgt.PlanPIndex) (int64, bool),
+	rebuildBytesPerSec int64) (*PlanImpact, error) {
+	if nodeDefs == nil || nodeDefs.NodeDefs[removeNode] == nil {
+		return nil, fmt.Errorf("plan_impact: unknown removeNode: %s",
+			removeNode)
+	}
+	if rebuildBytesPerSec <= 0 {
+		rebuildBytesPerSec = PlanImpactDefaultRebuildBytesPerSec
+	}
+
+	nodeDefsAfter := &cbgt.NodeDefs{
+		UUID:        nodeDefs.UUID,
+		NodeDefs:    map[string]*cbgt.NodeDef{},
+		ImplVersion: nodeDefs.ImplVersion,
+	}
+	for uuid, nodeDef := range nodeDefs.NodeDefs {
+		if uuid != removeNode {
+			nodeDefsAfter.NodeDefs[uuid] = nodeDef
+		}
+	}
+
+	planPIndexesPrev, err := copyPlanPIndexes(planPIndexes)
+	if err != nil {
+		return nil, err
+	}
+
+	planPIndexesAfter, err := cbgt.CalcPlan(indexDefs, nodeDefsAfter,
+		planPIndexesPrev, version, server)
+	if err != nil {
+		return nil, fmt.Errorf("plan_impact: CalcPlan, err: %v", err)
+	}
+
+	rv := &PlanImpact{
+		RemoveNode:         removeNode,
+		Indexes:            map[string]*PlanImpactIndex{},
+		Moves:              []*PlanImpactMove{},
+		RebuildBytesPerSec: rebuildBytesPerSec,
+	}
+
+	if planPIndexes == nil {
+		return rv, nil
+	}
+
+	names := make([]string, 0, len(planPIndexes.PlanPIndexes))
+	for name := range planPIndexes.PlanPIndexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		planPIndex := planPIndexes.PlanPIndexes[name]
+
+		pi := rv.Indexes[planPIndex.IndexName]
+		if pi == nil {
+			pi = &PlanImpactIndex{}
+			rv.Indexes[planPIndex.IndexName] = pi
+		}
+		pi.NumPIndexes++
+
+		if planPIndex.Nodes[removeNode] != nil {
+			pi.PIndexesOnNode++
+			if len(planPIndex.Nodes) > 1 {
+				pi.PIndexesLosingReplica++
+			} else {
+				pi.PIndexesLosingAllCopies++
+			}
+		}
+
+		var nodesAfter map[string]*cbgt.PlanPIndexNode
+		if planPIndexesAfter != nil &&
+			planPIndexesAfter.PlanPIndexes[name] != nil {
+			nodesAfter = planPIndexesAfter.PlanPIndexes[name].Nodes
+		}
+
+		fromNodes := []string{}
+		for uuid := range planPIndex.Nodes {
+			if nodesAfter[uuid] == nil {
+				fromNodes = append(fromNodes, uuid)
+			}
+		}
+		sort.Strings(fromNodes)
+
+		toNodes := []string{}
+		for uuid := range nodesAfter {
+			if planPIndex.Nodes[uuid] == nil {
+				toNodes = append(toNodes, uuid)
+			}
+		}
+		sort.Strings(toNodes)
+
+		if len(toNodes) <= 0 {
+			continue
+		}
+
+		bytes, bytesKnown := int64(0), false
+		if pindexBytes != nil {
+			bytes, bytesKnown = pindexBytes(planPIndex)
+		}
+		bytes = bytes * int64(len(toNodes))
+
+		rv.Moves = append(rv.Moves, &PlanImpactMove{
+			PlanPIndex: name,
+			IndexName:  planPIndex.IndexName,
+			FromNodes:  fromNodes,
+			ToNodes:    toNodes,
+			Bytes:      bytes,
+			BytesKnown: bytesKnown,
+		})
+
+		pi.BytesToMove += bytes
+		pi.EstRebuildSecs = float64(pi.BytesToMove) /
+			float64(rebuildBytesPerSec)
+
+		rv.TotalBytesToMove += bytes
+	}
+
+	rv.EstRebuildSecs =
+		float64(rv.TotalBytesToMove) / float64(rebuildBytesPerSec)
+
+	return rv, nil
+}
+
+// ---------------------------------------------------------
+
+// PlanImpactHandler is a REST handler that simulates the removal of
+// a node and reports the projected impact.
+type PlanImpactHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPlanImpactHandler(mgr *cbgt.Manager) *PlanImpactHandler {
+	return &PlanImpactHandler{mgr: mgr}
+}
+
+func (h *PlanImpactHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	removeNode := req.FormValue("removeNode")
+	if removeNode == "" {
+		rest.ShowError(w, req, "plan_impact: removeNode is required", 400)
+		return
+	}
+
+	rebuildBytesPerSec := PlanImpactDefaultRebuildBytesPerSec
+	if v := req.FormValue("rebuildBytesPerSec"); v != "" {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || i <= 0 {
+			rest.ShowError(w, req, fmt.Sprintf("plan_impact:"+
+				" bad rebuildBytesPerSec: %q", v), 400)
+			return
+		}
+		rebuildBytesPerSec = i
+	}
+
+	cfg := h.mgr.Cfg()
+
+	indexDefs, _, err := cbgt.CfgGetIndexDefs(cfg)
+	if err != nil {
+		rest.ShowError(w, req, "could not retrieve index defs", 500)
+		return
+	}
+
+	nodeDefs, _, err := cbgt.CfgGetNodeDefs(cfg, cbgt.NODE_DEFS_WANTED)
+	if err != nil {
+		rest.ShowError(w, req, "could not retrieve node defs (wanted)", 500)
+		return
+	}
+
+	planPIndexes, _, err := cbgt.CfgGetPlanPIndexes(cfg)
+	if err != nil {
+		rest.ShowError(w, req, "could not retrieve plan pIndexes", 500)
+		return
+	}
+
+	impact, err := CalcPlanImpact(indexDefs, nodeDefs, planPIndexes,
+		removeNode, cbgt.VERSION, h.mgr.Server(),
+		LocalPIndexBytesEstimator(h.mgr, planPIndexes),
+		rebuildBytesPerSec)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+		*PlanImpact
+	}{
+		Status:     "ok",
+		PlanImpact: impact,
+	})
+}
+
+// ---------------------------------------------------------
+
+// LocalPIndexBytesEstimator returns a callback that estimates the
+// size of a plan pindex.  The on-disk size is used for pindexes that
+// are local to this node, while for other pindexes the average size
+// of the local pindexes of the same index is used as an estimate.
+func LocalPIndexBytesEstimator(mgr *cbgt.Manager,
+	planPIndexes *cbgt.PlanPIndexes) func(*cbgt.PlanPIndex) (int64, bool) {
+	_, pindexes := mgr.CurrentMaps()
+
+	localBytes := map[string]int64{} // Keyed by pindex name.
+	indexBytes := map[string]int64{} // Keyed by index name.
+	indexCount := map[string]int64{} // Keyed by index name.
+
+	for name, pindex := range pindexes {
+		bytes, err := DirSize(pindex.Path)
+		if err != nil {
+			continue
+		}
+		localBytes[name] = bytes
+		indexBytes[pindex.IndexName] += bytes
+		indexCount[pindex.IndexName]++
+	}
+
+	return func(planPIndex *cbgt.PlanPIndex) (int64, bool) {
+		bytes, exists := localBytes[planPIndex.Name]
+		if exists {
+			return bytes, true
+		}
+		if indexCount[planPIndex.IndexName] > 0 {
+			return indexBytes[planPIndex.IndexName] /
+				indexCount[planPIndex.IndexName], true
+		}
+		return 0, false
+	}
+}
+
+// DirSize returns the total size in bytes of the regular files under
+// a directory.
+func DirSize(dir string) (int64, error) {
+	var rv int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			rv += info.Size()
+		}
+		return nil
+	})
+	return rv, err
+}
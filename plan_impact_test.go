@@ -0,0 +1,136 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestPlanImpactHandler(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	uuid := cbgt.NewUUID()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, uuid,
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	err := mgr.CreateIndex("nil", "", "", "",
+		"blackhole", "idx0", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	mgr.Kick("test-start-kick")
+
+	mr, _ := cbgt.NewMsgRing(os.Stderr, 1000)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", mr)
+	if err != nil || router == nil {
+		t.Errorf("no mux router")
+	}
+
+	tests := []*RESTHandlerTest{
+		{
+			Desc:   "plan impact with no removeNode",
+			Path:   "/api/plan/impact",
+			Method: "GET",
+			Params: nil,
+			Body:   nil,
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`removeNode is required`: true,
+			},
+		},
+		{
+			Desc:   "plan impact with unknown removeNode",
+			Path:   "/api/plan/impact",
+			Method: "GET",
+			Params: url.Values{
+				"removeNode": []string{"not-a-node"},
+			},
+			Body:   nil,
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`unknown removeNode`: true,
+			},
+		},
+		{
+			Desc:   "plan impact with bad rebuildBytesPerSec",
+			Path:   "/api/plan/impact",
+			Method: "GET",
+			Params: url.Values{
+				"removeNode":         []string{uuid},
+				"rebuildBytesPerSec": []string{"fast"},
+			},
+			Body:   nil,
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`bad rebuildBytesPerSec`: true,
+			},
+		},
+		{
+			Desc:   "plan impact of removing the only node",
+			Path:   "/api/plan/impact",
+			Method: "GET",
+			Params: url.Values{
+				"removeNode": []string{uuid},
+			},
+			Body:   nil,
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"status":"ok"`:               true,
+				`"idx0":{`:                    true,
+				`"pindexesOnNode":1`:          true,
+				`"pindexesLosingAllCopies":1`: true,
+				`"pindexesLosingReplica":0`:   true,
+				`"moves":[]`:                  true,
+			},
+		},
+	}
+
+	testRESTHandlers(t, tests, router)
+}
+
+func TestCalcPlanImpactUnknownNode(t *testing.T) {
+	_, err := CalcPlanImpact(nil, nil, nil, "node0",
+		cbgt.VERSION, "", nil, 0)
+	if err == nil {
+		t.Errorf("expected err on nil nodeDefs")
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	ioutil.WriteFile(emptyDir+string(os.PathSeparator)+"a",
+		[]byte("hello"), 0600)
+	ioutil.WriteFile(emptyDir+string(os.PathSeparator)+"b",
+		[]byte("world!"), 0600)
+
+	n, err := DirSize(emptyDir)
+	if err != nil || n != 11 {
+		t.Errorf("expected 11 bytes, got: %d, err: %v", n, err)
+	}
+
+	_, err = DirSize(emptyDir + string(os.PathSeparator) + "not-there")
+	if err == nil {
+		t.Errorf("expected err on missing dir")
+	}
+}
@@ -0,0 +1,366 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// PlanWhatIfRequest describes hypothetical cluster changes, whose
+// pindex moves are to be simulated without applying the changes.
+type PlanWhatIfRequest struct {
+	// Nodes to be added, which only need a uuid and hostPort, and
+	// optionally a weight and container.
+	AddNodes []*cbgt.NodeDef `json:"addNodes"`
+
+	// UUIDs of nodes to be removed.
+	RemoveNodes []string `json:"removeNodes"`
+
+	// New plan params of existing indexes, keyed by index name.
+	PlanParams map[string]*cbgt.PlanParams `json:"planParams"`
+
+	// The rebuild throughput used for projecting rebuild times, where
+	// 0 means PlanImpactDefaultRebuildBytesPerSec.
+	RebuildBytesPerSec int64 `json:"rebuildBytesPerSec"`
+}
+
+// PlanWhatIf represents the simulated effects of hypothetical
+// cluster changes.
+type PlanWhatIf struct {
+	Indexes map[string]*PlanWhatIfIndex `json:"indexes"`
+
+	// The plan pindexes that would be (re-)built on nodes, including
+	// new plan pindexes, which have no fromNodes.
+	Moves []*PlanImpactMove `json:"moves"`
+
+	// The plan pindexes that would be removed, such as due to a
+	// changed maxPartitionsPerPIndex.
+	Removed []string `json:"removed"`
+
+	TotalBytesToMove   int64   `json:"totalBytesToMove"`
+	EstRebuildSecs     float64 `json:"estRebuildSecs"`
+	RebuildBytesPerSec int64   `json:"rebuildBytesPerSec"`
+}
+
+// PlanWhatIfIndex summarizes the simulated effects on an index.
+type PlanWhatIfIndex struct {
+	NumPIndexesBefore int     `json:"numPIndexesBefore"`
+	NumPIndexesAfter  int     `json:"numPIndexesAfter"`
+	PIndexesMoved     int     `json:"pindexesMoved"`
+	BytesToMove       int64   `json:"bytesToMove"`
+	EstRebuildSecs    float64 `json:"estRebuildSecs"`
+}
+
+// CalcPlanWhatIf simulates hypothetical cluster changes by running
+// the planner (or the policy-aware planner, when the policy is
+// non-nil) against copies of the index and node definitions that
+// have the changes, and comparing the resulting plan against the
+// current plan.  The size of a new plan pindex is estimated as an
+// even share of the current size of its index.
+func CalcPlanWhatIf(indexDefs *cbgt.IndexDefs, nodeDefs *cbgt.NodeDefs,
+	planPIndexes *cbgt.PlanPIndexes, r *PlanWhatIfRequest,
+	version, server string, policy PlannerPolicy,
+	pindexBytes func(*cbgt.PlanPIndex) (int64, bool)) (*PlanWhatIf, error) {
+	rebuildBytesPerSec := r.RebuildBytesPerSec
+	if rebuildBytesPerSec <= 0 {
+		rebuildBytesPerSec = PlanImpactDefaultRebuildBytesPerSec
+	}
+
+	nodeDefsAfter := &cbgt.NodeDefs{
+		NodeDefs:    map[string]*cbgt.NodeDef{},
+		ImplVersion: version,
+	}
+	if nodeDefs != nil {
+		nodeDefsAfter.UUID = nodeDefs.UUID
+		nodeDefsAfter.ImplVersion = nodeDefs.ImplVersion
+		for uuid, nodeDef := range nodeDefs.NodeDefs {
+			nodeDefsAfter.NodeDefs[uuid] = nodeDef
+		}
+	}
+	for _, uuid := range r.RemoveNodes {
+		if nodeDefsAfter.NodeDefs[uuid] == nil {
+			return nil, fmt.Errorf("plan_whatif: unknown removeNode: %s", uuid)
+		}
+		delete(nodeDefsAfter.NodeDefs, uuid)
+	}
+	for _, nodeDef := range r.AddNodes {
+		if nodeDef == nil || nodeDef.UUID == "" || nodeDef.HostPort == "" {
+			return nil, fmt.Errorf("plan_whatif: addNodes need a uuid" +
+				" and hostPort")
+		}
+		if nodeDefsAfter.NodeDefs[nodeDef.UUID] != nil {
+			return nil, fmt.Errorf("plan_whatif: addNode: %s already exists",
+				nodeDef.UUID)
+		}
+		nd := *nodeDef
+		if nd.ImplVersion == "" {
+			nd.ImplVersion = version
+		}
+		if nd.Weight <= 0 {
+			nd.Weight = 1
+		}
+		nodeDefsAfter.NodeDefs[nd.UUID] = &nd
+	}
+
+	indexDefsAfter := indexDefs
+	if len(r.PlanParams) > 0 {
+		if indexDefs == nil {
+			indexDefs = cbgt.NewIndexDefs(version)
+		}
+		indexDefsAfter = &cbgt.IndexDefs{
+			UUID:        indexDefs.UUID,
+			IndexDefs:   map[string]*cbgt.IndexDef{},
+			ImplVersion: indexDefs.ImplVersion,
+		}
+		for name, indexDef := range indexDefs.IndexDefs {
+			indexDefsAfter.IndexDefs[name] = indexDef
+		}
+		for name, planParams := range r.PlanParams {
+			indexDef := indexDefsAfter.IndexDefs[name]
+			if indexDef == nil {
+				return nil, fmt.Errorf("plan_whatif: unknown index: %s", name)
+			}
+			if planParams == nil {
+				return nil, fmt.Errorf("plan_whatif: missing planParams"+
+					" of index: %s", name)
+			}
+			id := *indexDef
+			id.PlanParams = *planParams
+			indexDefsAfter.IndexDefs[name] = &id
+		}
+	}
+
+	planPIndexesPrev, err := copyPlanPIndexes(planPIndexes)
+	if err != nil {
+		return nil, err
+	}
+
+	var planPIndexesAfter *cbgt.PlanPIndexes
+	if policy != nil {
+		planPIndexesAfter, err = CalcPolicyPlan(policy, indexDefsAfter,
+			nodeDefsAfter, planPIndexesPrev, version, server)
+	} else {
+		planPIndexesAfter, err = cbgt.CalcPlan(indexDefsAfter, nodeDefsAfter,
+			planPIndexesPrev, version, server)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("plan_whatif: CalcPlan, err: %v", err)
+	}
+
+	before := map[string]*cbgt.PlanPIndex{}
+	if planPIndexes != nil {
+		before = planPIndexes.PlanPIndexes
+	}
+	after := map[string]*cbgt.PlanPIndex{}
+	if planPIndexesAfter != nil {
+		after = planPIndexesAfter.PlanPIndexes
+	}
+
+	rv := &PlanWhatIf{
+		Indexes:            map[string]*PlanWhatIfIndex{},
+		Moves:              []*PlanImpactMove{},
+		Removed:            []string{},
+		RebuildBytesPerSec: rebuildBytesPerSec,
+	}
+
+	getIndex := func(indexName string) *PlanWhatIfIndex {
+		wi := rv.Indexes[indexName]
+		if wi == nil {
+			wi = &PlanWhatIfIndex{}
+			rv.Indexes[indexName] = wi
+		}
+		return wi
+	}
+
+	// The current sizes of the indexes, for estimating the sizes of
+	// new plan pindexes.
+	indexBytes := map[string]int64{}
+	indexBytesKnown := map[string]bool{}
+
+	for _, planPIndex := range before {
+		getIndex(planPIndex.IndexName).NumPIndexesBefore++
+		if pindexBytes != nil {
+			bytes, ok := pindexBytes(planPIndex)
+			if ok {
+				indexBytes[planPIndex.IndexName] += bytes
+				indexBytesKnown[planPIndex.IndexName] = true
+			}
+		}
+	}
+	for _, planPIndex := range after {
+		getIndex(planPIndex.IndexName).NumPIndexesAfter++
+	}
+
+	names := make([]string, 0, len(before)+len(after))
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if before[name] == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		planPIndexBefore := before[name]
+		planPIndexAfter := after[name]
+
+		if planPIndexAfter == nil {
+			rv.Removed = append(rv.Removed, name)
+			continue
+		}
+
+		var nodesBefore map[string]*cbgt.PlanPIndexNode
+		if planPIndexBefore != nil {
+			nodesBefore = planPIndexBefore.Nodes
+		}
+
+		fromNodes := []string{}
+		for uuid := range nodesBefore {
+			if planPIndexAfter.Nodes[uuid] == nil {
+				fromNodes = append(fromNodes, uuid)
+			}
+		}
+		sort.Strings(fromNodes)
+
+		toNodes := []string{}
+		for uuid := range planPIndexAfter.Nodes {
+			if nodesBefore[uuid] == nil {
+				toNodes = append(toNodes, uuid)
+			}
+		}
+		sort.Strings(toNodes)
+
+		if len(toNodes) <= 0 {
+			continue
+		}
+
+		indexName := planPIndexAfter.IndexName
+
+		bytes, bytesKnown := int64(0), false
+		if planPIndexBefore != nil {
+			if pindexBytes != nil {
+				bytes, bytesKnown = pindexBytes(planPIndexBefore)
+			}
+		} else if n := rv.Indexes[indexName].NumPIndexesAfter; n > 0 {
+			bytes = indexBytes[indexName] / int64(n)
+			bytesKnown = indexBytesKnown[indexName]
+		}
+		bytes = bytes * int64(len(toNodes))
+
+		rv.Moves = append(rv.Moves, &PlanImpactMove{
+			PlanPIndex: name,
+			IndexName:  indexName,
+			FromNodes:  fromNodes,
+			ToNodes:    toNodes,
+			Bytes:      bytes,
+			BytesKnown: bytesKnown,
+		})
+
+		wi := getIndex(indexName)
+		wi.PIndexesMoved++
+		wi.BytesToMove += bytes
+		wi.EstRebuildSecs = float64(wi.BytesToMove) /
+			float64(rebuildBytesPerSec)
+
+		rv.TotalBytesToMove += bytes
+	}
+
+	rv.EstRebuildSecs =
+		float64(rv.TotalBytesToMove) / float64(rebuildBytesPerSec)
+
+	return rv, nil
+}
+
+// ---------------------------------------------------------
+
+// PlanWhatIfHandler is a REST handler that simulates the hypothetical
+// cluster changes of the JSON request body and reports the pindex
+// moves that would occur, without applying the changes.
+type PlanWhatIfHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPlanWhatIfHandler(mgr *cbgt.Manager) *PlanWhatIfHandler {
+	return &PlanWhatIfHandler{mgr: mgr}
+}
+
+func (h *PlanWhatIfHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("plan_whatif: could not read"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	r := &PlanWhatIfRequest{}
+	err = json.Unmarshal(requestBody, r)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("plan_whatif: could not parse"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	var policy PlannerPolicy
+	if v := h.mgr.Options()["plannerPolicy"]; v != "" {
+		policy, err = ParsePlannerPolicy(v)
+		if err != nil {
+			rest.ShowError(w, req, err.Error(), 500)
+			return
+		}
+	}
+
+	cfg := h.mgr.Cfg()
+
+	indexDefs, _, err := cbgt.CfgGetIndexDefs(cfg)
+	if err != nil {
+		rest.ShowError(w, req, "could not retrieve index defs", 500)
+		return
+	}
+
+	nodeDefs, _, err := cbgt.CfgGetNodeDefs(cfg, cbgt.NODE_DEFS_WANTED)
+	if err != nil {
+		rest.ShowError(w, req, "could not retrieve node defs (wanted)", 500)
+		return
+	}
+
+	planPIndexes, _, err := cbgt.CfgGetPlanPIndexes(cfg)
+	if err != nil {
+		rest.ShowError(w, req, "could not retrieve plan pIndexes", 500)
+		return
+	}
+
+	whatIf, err := CalcPlanWhatIf(indexDefs, nodeDefs, planPIndexes, r,
+		cbgt.VERSION, h.mgr.Server(), policy,
+		LocalPIndexBytesEstimator(h.mgr, planPIndexes))
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+		*PlanWhatIf
+	}{
+		Status:     "ok",
+		PlanWhatIf: whatIf,
+	})
+}
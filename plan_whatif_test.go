@@ -0,0 +1,108 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func testPlanWhatIfDefs(t *testing.T) (*cbgt.IndexDefs, *cbgt.NodeDefs,
+	*cbgt.PlanPIndexes) {
+	indexDefs := cbgt.NewIndexDefs(cbgt.VERSION)
+	indexDefs.IndexDefs["idx"] = &cbgt.IndexDef{
+		Type:       "blackhole",
+		Name:       "idx",
+		UUID:       "u0",
+		SourceType: "nil",
+	}
+
+	nodeDefs := cbgt.NewNodeDefs(cbgt.VERSION)
+	for _, uuid := range []string{"a", "b"} {
+		nodeDefs.NodeDefs[uuid] = &cbgt.NodeDef{
+			HostPort:    uuid + ":1000",
+			UUID:        uuid,
+			ImplVersion: cbgt.VERSION,
+			Weight:      1,
+		}
+	}
+
+	planPIndexes, err := cbgt.CalcPlan(indexDefs, nodeDefs,
+		nil, cbgt.VERSION, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	return indexDefs, nodeDefs, planPIndexes
+}
+
+func TestCalcPlanWhatIfNoChanges(t *testing.T) {
+	indexDefs, nodeDefs, planPIndexes := testPlanWhatIfDefs(t)
+
+	whatIf, err := CalcPlanWhatIf(indexDefs, nodeDefs, planPIndexes,
+		&PlanWhatIfRequest{}, cbgt.VERSION, "", nil, nil)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if len(whatIf.Moves) != 0 || len(whatIf.Removed) != 0 {
+		t.Errorf("expected no moves, got: %#v", whatIf)
+	}
+	wi := whatIf.Indexes["idx"]
+	if wi == nil || wi.NumPIndexesBefore != wi.NumPIndexesAfter {
+		t.Errorf("expected same pindexes, got: %#v", wi)
+	}
+}
+
+func TestCalcPlanWhatIfReplicas(t *testing.T) {
+	indexDefs, nodeDefs, planPIndexes := testPlanWhatIfDefs(t)
+
+	whatIf, err := CalcPlanWhatIf(indexDefs, nodeDefs, planPIndexes,
+		&PlanWhatIfRequest{
+			PlanParams: map[string]*cbgt.PlanParams{
+				"idx": {NumReplicas: 1},
+			},
+		}, cbgt.VERSION, "", nil,
+		func(*cbgt.PlanPIndex) (int64, bool) { return 100, true })
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if len(whatIf.Moves) != len(planPIndexes.PlanPIndexes) {
+		t.Errorf("expected a replica move per pindex, got: %#v", whatIf.Moves)
+	}
+	for _, move := range whatIf.Moves {
+		if len(move.ToNodes) != 1 || !move.BytesKnown || move.Bytes != 100 {
+			t.Errorf("expected a replica move, got: %#v", move)
+		}
+	}
+	if indexDefs.IndexDefs["idx"].PlanParams.NumReplicas != 0 {
+		t.Errorf("expected the index defs to be left unchanged")
+	}
+}
+
+func TestCalcPlanWhatIfErrs(t *testing.T) {
+	indexDefs, nodeDefs, planPIndexes := testPlanWhatIfDefs(t)
+
+	for _, r := range []*PlanWhatIfRequest{
+		{RemoveNodes: []string{"not-a-node"}},
+		{AddNodes: []*cbgt.NodeDef{{UUID: "c"}}},
+		{AddNodes: []*cbgt.NodeDef{{UUID: "a", HostPort: "a:1000"}}},
+		{PlanParams: map[string]*cbgt.PlanParams{"not-an-index": {}}},
+		{PlanParams: map[string]*cbgt.PlanParams{"idx": nil}},
+	} {
+		_, err := CalcPlanWhatIf(indexDefs, nodeDefs, planPIndexes, r,
+			cbgt.VERSION, "", nil, nil)
+		if err == nil {
+			t.Errorf("expected err for: %#v", r)
+		}
+	}
+}
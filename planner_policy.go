@@ -0,0 +1,372 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// A planner policy influences the pindex placement decisions of the
+// planner, such as to favor the nodes with bigger hardware, beyond
+// the node weights and containers of the node definitions.  A node
+// that's started with the plannerPolicy node option (the -options
+// command-line flag) runs a policy-aware planner instead of the
+// default cbgt planner, where the plannerPolicy is either...
+//
+//   NAME - a planner policy that was registered, in Go, with
+//     RegisterPlannerPolicy.
+//   script:PATH - an executable that's given the PlannerPolicyInput
+//     as JSON on stdin and that must write a PlannerPolicyResult as
+//     JSON to stdout.
+//
+// The policy-aware planner replans whenever the index definitions or
+// the wanted node definitions change.
+
+// PlannerPolicyInput is the input of a planner policy.
+type PlannerPolicyInput struct {
+	IndexDefs *cbgt.IndexDefs `json:"indexDefs"`
+
+	// The wanted nodes, with their weights and containers.
+	NodeDefs *cbgt.NodeDefs `json:"nodeDefs"`
+
+	// The current assignments of pindexes to nodes, which may be nil.
+	PlanPIndexes *cbgt.PlanPIndexes `json:"planPIndexes"`
+}
+
+// PlannerPolicyResult holds the preferences of a planner policy,
+// which are all optional.
+type PlannerPolicyResult struct {
+	// Node weights, keyed by node UUID, that override the weights of
+	// the node definitions for the planning.
+	NodeWeights map[string]int `json:"nodeWeights,omitempty"`
+
+	// The preferred nodes for the primary copies of the pindexes of
+	// an index, in order of preference, keyed by index name.  Of the
+	// nodes that hold a copy of a pindex, the most preferred one is
+	// made the primary.
+	PreferPrimary map[string][]string `json:"preferPrimary,omitempty"`
+}
+
+// A PlannerPolicy returns the planning preferences for its input.
+type PlannerPolicy func(in *PlannerPolicyInput) (*PlannerPolicyResult, error)
+
+// PlannerPolicies are the registered planner policies, keyed by name.
+var PlannerPolicies = map[string]PlannerPolicy{}
+
+// RegisterPlannerPolicy registers a planner policy, which should be
+// done during init().
+func RegisterPlannerPolicy(name string, p PlannerPolicy) {
+	PlannerPolicies[name] = p
+}
+
+// The max duration of a planner policy script.
+var PlannerPolicyScriptTimeout = 30 * time.Second
+
+// The node roles (tags) of a node that runs the policy-aware planner
+// instead of the default planner, when the node has no tags.
+var PlannerPolicyDefaultTags = []string{"feed", "janitor", "pindex", "queryer"}
+
+// ParsePlannerPolicy returns the planner policy of a plannerPolicy
+// node option.
+func ParsePlannerPolicy(v string) (PlannerPolicy, error) {
+	if strings.HasPrefix(v, "script:") {
+		path := strings.TrimPrefix(v, "script:")
+		if path == "" {
+			return nil, fmt.Errorf("planner_policy: missing script path")
+		}
+		return func(in *PlannerPolicyInput) (*PlannerPolicyResult, error) {
+			return runPlannerPolicyScript(path, in)
+		}, nil
+	}
+
+	p := PlannerPolicies[v]
+	if p == nil {
+		return nil, fmt.Errorf("planner_policy: unknown plannerPolicy: %q,"+
+			" registered planner policies: %v", v, plannerPolicyNames())
+	}
+	return p, nil
+}
+
+func runPlannerPolicyScript(path string, in *PlannerPolicyInput) (
+	*PlannerPolicyResult, error) {
+	buf, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(path)
+	cmd.Stdin = bytes.NewReader(buf)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("planner_policy: could not start script: %s,"+
+			" err: %v", path, err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-time.After(PlannerPolicyScriptTimeout):
+		cmd.Process.Kill()
+		<-done
+		err = fmt.Errorf("timeout after %v", PlannerPolicyScriptTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("planner_policy: script: %s, err: %v,"+
+			" stderr: %s", path, err, stderr.String())
+	}
+
+	rv := &PlannerPolicyResult{}
+	err = json.Unmarshal(stdout.Bytes(), rv)
+	if err != nil {
+		return nil, fmt.Errorf("planner_policy: script: %s, could not"+
+			" parse result, err: %v", path, err)
+	}
+	return rv, nil
+}
+
+// PlannerPolicyTags returns the node roles (tags) of a node that runs
+// the policy-aware planner, which are its tags without the planner
+// role, so that the default planner doesn't also run on the node.
+func PlannerPolicyTags(tags []string) []string {
+	if len(tags) <= 0 {
+		return append([]string(nil), PlannerPolicyDefaultTags...)
+	}
+
+	rv := []string{}
+	for _, tag := range tags {
+		if tag != "planner" {
+			rv = append(rv, tag)
+		}
+	}
+	return rv
+}
+
+// CalcPolicyPlan computes a plan like the default planner, but with
+// the preferences of a planner policy applied.
+func CalcPolicyPlan(policy PlannerPolicy, indexDefs *cbgt.IndexDefs,
+	nodeDefs *cbgt.NodeDefs, planPIndexesPrev *cbgt.PlanPIndexes,
+	version, server string) (*cbgt.PlanPIndexes, error) {
+	planPIndexesPrev, err := copyPlanPIndexes(planPIndexesPrev)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := policy(&PlannerPolicyInput{
+		IndexDefs:    indexDefs,
+		NodeDefs:     nodeDefs,
+		PlanPIndexes: planPIndexesPrev,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		res = &PlannerPolicyResult{}
+	}
+
+	nodeDefsPolicy := nodeDefs
+	if nodeDefs != nil && len(res.NodeWeights) > 0 {
+		nodeDefsPolicy = &cbgt.NodeDefs{
+			UUID:        nodeDefs.UUID,
+			NodeDefs:    map[string]*cbgt.NodeDef{},
+			ImplVersion: nodeDefs.ImplVersion,
+		}
+		for uuid, nodeDef := range nodeDefs.NodeDefs {
+			if weight, exists := res.NodeWeights[uuid]; exists {
+				if weight <= 0 {
+					return nil, fmt.Errorf("planner_policy: weight: %d"+
+						" of node: %s must be > 0", weight, uuid)
+				}
+				nd := *nodeDef
+				nd.Weight = weight
+				nodeDef = &nd
+			}
+			nodeDefsPolicy.NodeDefs[uuid] = nodeDef
+		}
+	}
+
+	planPIndexes, err := cbgt.CalcPlan(indexDefs, nodeDefsPolicy,
+		planPIndexesPrev, version, server)
+	if err != nil {
+		return nil, fmt.Errorf("planner_policy: CalcPlan, err: %v", err)
+	}
+
+	applyPreferPrimary(planPIndexes, res.PreferPrimary)
+
+	return planPIndexes, nil
+}
+
+// applyPreferPrimary makes the most preferred node that holds a copy
+// of a plan pindex the primary (priority 0) of the plan pindex, by
+// swapping priorities with the current primary.
+func applyPreferPrimary(planPIndexes *cbgt.PlanPIndexes,
+	preferPrimary map[string][]string) {
+	if planPIndexes == nil {
+		return
+	}
+
+	for _, planPIndex := range planPIndexes.PlanPIndexes {
+		for _, uuid := range preferPrimary[planPIndex.IndexName] {
+			preferred := planPIndex.Nodes[uuid]
+			if preferred == nil {
+				continue
+			}
+			if preferred.Priority > 0 {
+				for _, node := range planPIndex.Nodes {
+					if node.Priority <= 0 {
+						node.Priority = preferred.Priority
+					}
+				}
+				preferred.Priority = 0
+			}
+			break
+		}
+	}
+}
+
+// copyPlanPIndexes returns a deep copy of a plan, so that the planner
+// can't modify the original.
+func copyPlanPIndexes(planPIndexes *cbgt.PlanPIndexes) (
+	*cbgt.PlanPIndexes, error) {
+	if planPIndexes == nil {
+		return nil, nil
+	}
+
+	buf, err := json.Marshal(planPIndexes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &cbgt.PlanPIndexes{}
+	err = json.Unmarshal(buf, rv)
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// PlannerPolicyOnce runs the policy-aware planner once, storing the
+// plan into the Cfg when it changed.
+func PlannerPolicyOnce(mgr *cbgt.Manager, policy PlannerPolicy) (
+	bool, error) {
+	cfg := mgr.Cfg()
+
+	indexDefs, _, err := cbgt.CfgGetIndexDefs(cfg)
+	if err != nil {
+		return false, fmt.Errorf("planner_policy: could not retrieve"+
+			" index defs, err: %v", err)
+	}
+
+	nodeDefs, _, err := cbgt.CfgGetNodeDefs(cfg, cbgt.NODE_DEFS_WANTED)
+	if err != nil {
+		return false, fmt.Errorf("planner_policy: could not retrieve"+
+			" node defs, err: %v", err)
+	}
+
+	planPIndexesPrev, cas, err := cbgt.CfgGetPlanPIndexes(cfg)
+	if err != nil {
+		return false, fmt.Errorf("planner_policy: could not retrieve"+
+			" plan pindexes, err: %v", err)
+	}
+
+	planPIndexes, err := CalcPolicyPlan(policy, indexDefs, nodeDefs,
+		planPIndexesPrev, cbgt.VERSION, mgr.Server())
+	if err != nil {
+		return false, err
+	}
+
+	if planPIndexesPrev != nil &&
+		cbgt.SamePlanPIndexes(planPIndexes, planPIndexesPrev) {
+		return false, nil
+	}
+
+	_, err = cbgt.CfgSetPlanPIndexes(cfg, planPIndexes, cas)
+	if err != nil {
+		return false, fmt.Errorf("planner_policy: could not save"+
+			" plan pindexes, err: %v", err)
+	}
+
+	return true, nil
+}
+
+// PlannerPolicyStart starts the policy-aware planner of a node, if
+// the node has a plannerPolicy option.  The node must not also run
+// the default planner (see PlannerPolicyTags).
+func PlannerPolicyStart(mgr *cbgt.Manager) error {
+	v := mgr.Options()["plannerPolicy"]
+	if v == "" {
+		return nil
+	}
+
+	policy, err := ParsePlannerPolicy(v)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan cbgt.CfgEvent, 1)
+
+	cfg := mgr.Cfg()
+	for _, key := range []string{cbgt.INDEX_DEFS_KEY,
+		cbgt.CfgNodeDefsKey(cbgt.NODE_DEFS_WANTED)} {
+		err = cfg.Subscribe(key, ch)
+		if err != nil {
+			return err
+		}
+	}
+
+	replan := func() {
+		changed, err := PlannerPolicyOnce(mgr, policy)
+		if err != nil {
+			log.Printf("planner_policy: plannerPolicy: %s, err: %v", v, err)
+			return
+		}
+		if changed {
+			log.Printf("planner_policy: plannerPolicy: %s, plan changed", v)
+		}
+	}
+
+	go func() {
+		replan()
+		for range ch {
+			replan()
+		}
+	}()
+
+	return nil
+}
+
+// plannerPolicyNames returns the names of the registered planner
+// policies.
+func plannerPolicyNames() []string {
+	rv := make([]string, 0, len(PlannerPolicies))
+	for name := range PlannerPolicies {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
@@ -0,0 +1,185 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestPlannerPolicyTags(t *testing.T) {
+	if !reflect.DeepEqual(PlannerPolicyTags(nil), PlannerPolicyDefaultTags) {
+		t.Errorf("expected default tags, got: %v", PlannerPolicyTags(nil))
+	}
+	got := PlannerPolicyTags([]string{"pindex", "planner", "queryer"})
+	if !reflect.DeepEqual(got, []string{"pindex", "queryer"}) {
+		t.Errorf("expected no planner tag, got: %v", got)
+	}
+}
+
+func TestParsePlannerPolicy(t *testing.T) {
+	RegisterPlannerPolicy("testPolicy",
+		func(in *PlannerPolicyInput) (*PlannerPolicyResult, error) {
+			return nil, nil
+		})
+	defer delete(PlannerPolicies, "testPolicy")
+
+	for _, test := range []struct {
+		v     string
+		expOk bool
+	}{
+		{"testPolicy", true},
+		{"script:/bin/true", true},
+		{"script:", false},
+		{"notAPolicy", false},
+	} {
+		p, err := ParsePlannerPolicy(test.v)
+		if (err == nil) != test.expOk || (p != nil) != test.expOk {
+			t.Errorf("v: %s, expected ok: %v, got err: %v",
+				test.v, test.expOk, err)
+		}
+	}
+}
+
+func TestPlannerPolicyScript(t *testing.T) {
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policy.sh")
+	ioutil.WriteFile(path, []byte("#!/bin/sh\n"+
+		"cat > /dev/null\n"+
+		`echo '{"nodeWeights":{"a":3},"preferPrimary":{"idx":["b"]}}'`+"\n"),
+		0700)
+
+	p, err := ParsePlannerPolicy("script:" + path)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	res, err := p(&PlannerPolicyInput{})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	exp := &PlannerPolicyResult{
+		NodeWeights:   map[string]int{"a": 3},
+		PreferPrimary: map[string][]string{"idx": []string{"b"}},
+	}
+	if !reflect.DeepEqual(res, exp) {
+		t.Errorf("expected: %#v, got: %#v", exp, res)
+	}
+
+	p, _ = ParsePlannerPolicy("script:" + filepath.Join(dir, "missing"))
+	_, err = p(&PlannerPolicyInput{})
+	if err == nil {
+		t.Errorf("expected err on a missing script")
+	}
+}
+
+func TestApplyPreferPrimary(t *testing.T) {
+	planPIndexes := &cbgt.PlanPIndexes{
+		PlanPIndexes: map[string]*cbgt.PlanPIndex{
+			"p0": {
+				IndexName: "idx",
+				Nodes: map[string]*cbgt.PlanPIndexNode{
+					"a": {CanRead: true, CanWrite: true, Priority: 0},
+					"b": {CanRead: true, CanWrite: true, Priority: 1},
+				},
+			},
+			"p1": {
+				IndexName: "other",
+				Nodes: map[string]*cbgt.PlanPIndexNode{
+					"a": {CanRead: true, CanWrite: true, Priority: 0},
+					"b": {CanRead: true, CanWrite: true, Priority: 1},
+				},
+			},
+		},
+	}
+
+	applyPreferPrimary(planPIndexes, map[string][]string{
+		"idx": []string{"c", "b", "a"},
+	})
+
+	p0 := planPIndexes.PlanPIndexes["p0"].Nodes
+	if p0["b"].Priority != 0 || p0["a"].Priority != 1 {
+		t.Errorf("expected b to be primary of p0, got a: %d, b: %d",
+			p0["a"].Priority, p0["b"].Priority)
+	}
+	p1 := planPIndexes.PlanPIndexes["p1"].Nodes
+	if p1["a"].Priority != 0 || p1["b"].Priority != 1 {
+		t.Errorf("expected p1 unchanged")
+	}
+}
+
+func TestCalcPolicyPlan(t *testing.T) {
+	indexDefs := cbgt.NewIndexDefs(cbgt.VERSION)
+	indexDefs.IndexDefs["idx"] = &cbgt.IndexDef{
+		Type:       "blackhole",
+		Name:       "idx",
+		UUID:       "u0",
+		SourceType: "nil",
+		PlanParams: cbgt.PlanParams{NumReplicas: 1},
+	}
+
+	nodeDefs := cbgt.NewNodeDefs(cbgt.VERSION)
+	for _, uuid := range []string{"a", "b"} {
+		nodeDefs.NodeDefs[uuid] = &cbgt.NodeDef{
+			HostPort:    uuid + ":1000",
+			UUID:        uuid,
+			ImplVersion: cbgt.VERSION,
+			Weight:      1,
+		}
+	}
+
+	var in *PlannerPolicyInput
+
+	policy := func(pin *PlannerPolicyInput) (*PlannerPolicyResult, error) {
+		in = pin
+		return &PlannerPolicyResult{
+			NodeWeights:   map[string]int{"a": 2},
+			PreferPrimary: map[string][]string{"idx": []string{"b"}},
+		}, nil
+	}
+
+	planPIndexes, err := CalcPolicyPlan(policy, indexDefs, nodeDefs,
+		nil, cbgt.VERSION, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if in == nil || in.IndexDefs != indexDefs || in.NodeDefs != nodeDefs {
+		t.Errorf("expected the policy input, got: %#v", in)
+	}
+	if nodeDefs.NodeDefs["a"].Weight != 1 {
+		t.Errorf("expected the node defs to be left unchanged")
+	}
+	if planPIndexes == nil || len(planPIndexes.PlanPIndexes) <= 0 {
+		t.Fatalf("expected plan pindexes, got: %#v", planPIndexes)
+	}
+	for name, planPIndex := range planPIndexes.PlanPIndexes {
+		if planPIndex.Nodes["b"] == nil || planPIndex.Nodes["b"].Priority != 0 {
+			t.Errorf("expected b to be primary of: %s, got: %#v",
+				name, planPIndex.Nodes)
+		}
+	}
+
+	badPolicy := func(pin *PlannerPolicyInput) (*PlannerPolicyResult, error) {
+		return &PlannerPolicyResult{NodeWeights: map[string]int{"a": 0}}, nil
+	}
+	_, err = CalcPolicyPlan(badPolicy, indexDefs, nodeDefs,
+		nil, cbgt.VERSION, "")
+	if err == nil {
+		t.Errorf("expected err on a zero weight")
+	}
+}
@@ -0,0 +1,143 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	runtimePprof "runtime/pprof"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The profiling endpoints (the standard /debug/pprof endpoints and
+// /api/runtime/profile) are only enabled when a node is started with
+// the -pprof flag, which is the "pprof" node option, as profiles
+// expose a node's internals and a CPU profile slows the node down.
+// They're served by the REST router, alongside the REST API, rather
+// than by the default http mux.
+
+// The default and max durations of a CPU profile.
+var ProfileDefaultCPUSecs = 30
+var ProfileMaxCPUSecs = 300
+
+// ProfilingEnabled returns true when a node's profiling endpoints
+// are enabled.
+func ProfilingEnabled(mgr *cbgt.Manager) bool {
+	return mgr != nil && mgr.Options()["pprof"] == "true"
+}
+
+// ProfilingGuardHandler is a REST handler that delegates to the next
+// (profiling) handler only when the node's profiling endpoints are
+// enabled.
+type ProfilingGuardHandler struct {
+	mgr  *cbgt.Manager
+	next http.Handler
+}
+
+func NewProfilingGuardHandler(mgr *cbgt.Manager,
+	next http.Handler) *ProfilingGuardHandler {
+	return &ProfilingGuardHandler{mgr: mgr, next: next}
+}
+
+func (h *ProfilingGuardHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	if !ProfilingEnabled(h.mgr) {
+		rest.ShowError(w, req, "profiling: not enabled,"+
+			" start the node with the -pprof flag", 404)
+		return
+	}
+
+	h.next.ServeHTTP(w, req)
+}
+
+// InitPprofRoutes registers the standard /debug/pprof endpoints onto
+// a router, guarded by ProfilingGuardHandler.
+func InitPprofRoutes(r *mux.Router, mgr *cbgt.Manager) {
+	guard := func(f http.HandlerFunc) http.Handler {
+		return NewProfilingGuardHandler(mgr, f)
+	}
+
+	r.Handle("/debug/pprof/cmdline", guard(pprof.Cmdline))
+	r.Handle("/debug/pprof/profile", guard(pprof.Profile))
+	r.Handle("/debug/pprof/symbol", guard(pprof.Symbol))
+	r.Handle("/debug/pprof/trace", guard(pprof.Trace))
+	r.PathPrefix("/debug/pprof/").Handler(guard(pprof.Index))
+}
+
+// ---------------------------------------------------------
+
+// ProfileHandler is a REST handler that captures a profile of the
+// node on demand, such as a CPU profile over some seconds or a heap
+// profile, as a downloadable pprof file.
+type ProfileHandler struct{}
+
+func NewProfileHandler() *ProfileHandler {
+	return &ProfileHandler{}
+}
+
+func (h *ProfileHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	profileType := req.FormValue("type")
+	if profileType == "" {
+		profileType = "cpu"
+	}
+
+	secs := ProfileDefaultCPUSecs
+	if v := req.FormValue("secs"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > ProfileMaxCPUSecs {
+			rest.ShowError(w, req, fmt.Sprintf("profiling: bad secs: %q,"+
+				" must be 1 to %d", v, ProfileMaxCPUSecs), 400)
+			return
+		}
+		secs = n
+	}
+
+	var p *runtimePprof.Profile
+	if profileType != "cpu" {
+		p = runtimePprof.Lookup(profileType)
+		if p == nil {
+			rest.ShowError(w, req, fmt.Sprintf("profiling: unknown type: %q",
+				profileType), 400)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition",
+		"attachment; filename=cbft-"+profileType+"-"+
+			time.Now().UTC().Format("20060102T150405Z")+".pprof")
+
+	if p != nil {
+		p.WriteTo(w, 0)
+		return
+	}
+
+	err := runtimePprof.StartCPUProfile(w)
+	if err != nil {
+		w.Header().Del("Content-Disposition")
+		rest.ShowError(w, req, fmt.Sprintf("profiling: could not start"+
+			" cpu profile, err: %v", err), 409)
+		return
+	}
+
+	time.Sleep(time.Duration(secs) * time.Second)
+
+	runtimePprof.StopCPUProfile()
+}
@@ -0,0 +1,79 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestProfilingGuard(t *testing.T) {
+	for _, test := range []struct {
+		options map[string]string
+		code    int
+	}{
+		{nil, 404},
+		{map[string]string{"pprof": "false"}, 404},
+		{map[string]string{"pprof": "true"}, 200},
+	} {
+		mgr := cbgt.NewManagerEx(cbgt.VERSION, cbgt.NewCfgMem(),
+			cbgt.NewUUID(), nil, "", 1, "", ":1000", "", "", nil,
+			test.options)
+
+		r := mux.NewRouter()
+		InitPprofRoutes(r, mgr)
+
+		for _, path := range []string{
+			"/debug/pprof/",
+			"/debug/pprof/goroutine",
+			"/debug/pprof/cmdline",
+		} {
+			req, _ := http.NewRequest("GET", path, nil)
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			if rr.Code != test.code {
+				t.Errorf("expected %d for options: %v, path: %s, got: %d",
+					test.code, test.options, path, rr.Code)
+			}
+		}
+	}
+}
+
+func TestProfileHandler(t *testing.T) {
+	for _, test := range []struct {
+		url  string
+		code int
+	}{
+		{"/api/runtime/profile?type=heap", 200},
+		{"/api/runtime/profile?type=goroutine", 200},
+		{"/api/runtime/profile?type=cpu&secs=1", 200},
+		{"/api/runtime/profile?type=nope", 400},
+		{"/api/runtime/profile?secs=0", 400},
+		{"/api/runtime/profile?secs=x", 400},
+	} {
+		req, _ := http.NewRequest("GET", test.url, nil)
+		rr := httptest.NewRecorder()
+		NewProfileHandler().ServeHTTP(rr, req)
+		if rr.Code != test.code {
+			t.Errorf("expected %d for: %s, got: %d, %s",
+				test.code, test.url, rr.Code, rr.Body.String())
+		}
+		if test.code == 200 && rr.Body.Len() <= 0 {
+			t.Errorf("expected a profile for: %s", test.url)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// An index is quarantined when its rate of ingest errors (such as
+// malformed documents) within a window exceeds the ingest error
+// budget of the cluster settings, so that a bad application deploy
+// doesn't silently degrade search quality.  Quarantining pauses the
+// index's ingest, records the index in the Cfg and fires a webhook.
+// Each node enforces the budget on the mutations of its own pindexes.
+
+// The Cfg key where the quarantined indexes are kept.
+const QUARANTINE_KEY = "quarantinedIndexes"
+
+// The window over which ingest errors are counted.
+var IngestErrorBudgetWindow = time.Hour
+
+// The default min number of mutations within the window before the
+// ingest error budget is enforced.
+var IngestErrorBudgetDefaultMinMutations = uint64(1000)
+
+// QuarantinedIndexes is the Cfg entry of all quarantined indexes.
+type QuarantinedIndexes struct {
+	UUID string `json:"uuid"`
+
+	// Keyed by indexName.
+	Indexes map[string]*Quarantine `json:"indexes"`
+}
+
+// Quarantine records why an index was quarantined.
+type Quarantine struct {
+	IndexName string  `json:"indexName"`
+	IndexUUID string  `json:"indexUUID"`
+	NodeUUID  string  `json:"nodeUUID"`
+	Time      string  `json:"time"`
+	Mutations uint64  `json:"mutations"`
+	Errors    uint64  `json:"errors"`
+	Budget    float64 `json:"budget"`
+}
+
+type ingestBudget struct {
+	windowStart  time.Time
+	mutations    uint64
+	errors       uint64
+	quarantining bool
+}
+
+var quarantineM sync.Mutex // Protects the fields that follow.
+
+var quarantineMgr *cbgt.Manager
+
+// Keyed by indexName.
+var ingestBudgets = map[string]*ingestBudget{}
+
+// The node's cache of the quarantined index names.
+var quarantined = map[string]bool{}
+
+// ---------------------------------------------------------
+
+// QuarantineStart enables quarantining and keeps the node's cache of
+// quarantined indexes up to date with Cfg changes.
+func QuarantineStart(mgr *cbgt.Manager) error {
+	cfg := mgr.Cfg()
+
+	ch := make(chan cbgt.CfgEvent, 1)
+
+	err := cfg.Subscribe(QUARANTINE_KEY, ch)
+	if err != nil {
+		return err
+	}
+
+	quarantineM.Lock()
+	quarantineMgr = mgr
+	quarantineM.Unlock()
+
+	err = quarantineRefresh(cfg)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for range ch {
+			err := quarantineRefresh(cfg)
+			if err != nil {
+				log.Printf("quarantine: refresh, err: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func quarantineRefresh(cfg cbgt.Cfg) error {
+	qis := &QuarantinedIndexes{}
+	_, _, err := CfgGetJSON(cfg, QUARANTINE_KEY, qis)
+	if err != nil {
+		return err
+	}
+
+	m := map[string]bool{}
+	for indexName := range qis.Indexes {
+		m[indexName] = true
+	}
+
+	quarantineM.Lock()
+	quarantined = m
+
+	// Released indexes start again with a fresh budget.
+	for indexName, b := range ingestBudgets {
+		if b.quarantining && !m[indexName] {
+			delete(ingestBudgets, indexName)
+		}
+	}
+	quarantineM.Unlock()
+
+	return nil
+}
+
+// IsQuarantined returns true if the index is quarantined.
+func IsQuarantined(indexName string) bool {
+	quarantineM.Lock()
+	rv := quarantined[indexName]
+	quarantineM.Unlock()
+	return rv
+}
+
+// ingestBudgetRecord records the outcome of a mutation of an index,
+// and quarantines the index when its error budget is exceeded.
+func ingestBudgetRecord(indexName string, errored bool) {
+	settings := CurrentClusterSettings()
+	if settings.IngestErrorBudget <= 0 {
+		return
+	}
+
+	minMutations := settings.IngestErrorBudgetMinMutations
+	if minMutations <= 0 {
+		minMutations = IngestErrorBudgetDefaultMinMutations
+	}
+
+	now := time.Now()
+
+	quarantineM.Lock()
+
+	b := ingestBudgets[indexName]
+	if b == nil || (!b.quarantining &&
+		now.Sub(b.windowStart) >= IngestErrorBudgetWindow) {
+		b = &ingestBudget{windowStart: now}
+		ingestBudgets[indexName] = b
+	}
+
+	b.mutations++
+	if errored {
+		b.errors++
+	}
+
+	if !errored || b.quarantining || quarantineMgr == nil ||
+		b.mutations < minMutations ||
+		float64(b.errors) <= settings.IngestErrorBudget*float64(b.mutations) {
+		quarantineM.Unlock()
+		return
+	}
+
+	b.quarantining = true
+
+	mgr := quarantineMgr
+	q := &Quarantine{
+		IndexName: indexName,
+		NodeUUID:  mgr.UUID(),
+		Time:      now.Format(time.RFC3339Nano),
+		Mutations: b.mutations,
+		Errors:    b.errors,
+		Budget:    settings.IngestErrorBudget,
+	}
+
+	quarantineM.Unlock()
+
+	// Asynchronous, as the caller is in the midst of a feed callback.
+	go func() {
+		err := QuarantineIndex(mgr, q)
+		if err != nil {
+			log.Printf("quarantine: index, indexName: %s, err: %v",
+				indexName, err)
+		}
+	}()
+}
+
+// QuarantineIndex pauses the ingest of an index, records the index
+// as quarantined in the Cfg and fires a webhook.
+func QuarantineIndex(mgr *cbgt.Manager, q *Quarantine) error {
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return err
+	}
+	indexDef := indexDefsByName[q.IndexName]
+	if indexDef == nil {
+		return fmt.Errorf("quarantine: not an index, indexName: %s",
+			q.IndexName)
+	}
+	q.IndexUUID = indexDef.UUID
+
+	log.Printf("quarantine: quarantining, indexName: %s, mutations: %d,"+
+		" errors: %d, budget: %f", q.IndexName, q.Mutations, q.Errors,
+		q.Budget)
+
+	err = CfgUpdateJSON(mgr.Cfg(), QUARANTINE_KEY,
+		func() interface{} { return &QuarantinedIndexes{} },
+		func(v interface{}) error {
+			qis := v.(*QuarantinedIndexes)
+			if qis.Indexes == nil {
+				qis.Indexes = map[string]*Quarantine{}
+			}
+			qis.UUID = cbgt.NewUUID()
+			qis.Indexes[q.IndexName] = q
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	err = mgr.IndexControl(q.IndexName, q.IndexUUID, "", "pause", "")
+	if err != nil {
+		return err
+	}
+
+	WebhookNotify(&WebhookEvent{
+		Event:     WEBHOOK_EVENT_INDEX_QUARANTINED,
+		IndexName: q.IndexName,
+		IndexUUID: q.IndexUUID,
+	})
+
+	return nil
+}
+
+// ReleaseQuarantine removes an index from quarantine and resumes the
+// index's ingest.
+func ReleaseQuarantine(mgr *cbgt.Manager, indexName string) error {
+	var q *Quarantine
+
+	err := CfgUpdateJSON(mgr.Cfg(), QUARANTINE_KEY,
+		func() interface{} { return &QuarantinedIndexes{} },
+		func(v interface{}) error {
+			qis := v.(*QuarantinedIndexes)
+			q = qis.Indexes[indexName]
+			if q == nil {
+				return fmt.Errorf("quarantine: not quarantined,"+
+					" indexName: %s", indexName)
+			}
+			qis.UUID = cbgt.NewUUID()
+			delete(qis.Indexes, indexName)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return err
+	}
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil {
+		return nil // The index was deleted while quarantined.
+	}
+	if IndexDefFrozen(indexDef) {
+		return nil // The index stays paused until it's unfrozen.
+	}
+
+	return mgr.IndexControl(indexName, indexDef.UUID, "", "resume", "")
+}
+
+// ---------------------------------------------------------
+
+// QuarantineListHandler is a REST handler that returns the
+// quarantined indexes.
+type QuarantineListHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewQuarantineListHandler(mgr *cbgt.Manager) *QuarantineListHandler {
+	return &QuarantineListHandler{mgr: mgr}
+}
+
+func (h *QuarantineListHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	qis := &QuarantinedIndexes{}
+	_, _, err := CfgGetJSON(h.mgr.Cfg(), QUARANTINE_KEY, qis)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("quarantine: could not"+
+			" retrieve quarantined indexes, err: %v", err), 500)
+		return
+	}
+
+	indexes := qis.Indexes
+	if indexes == nil {
+		indexes = map[string]*Quarantine{}
+	}
+
+	rest.MustEncode(w, struct {
+		Status  string                 `json:"status"`
+		Indexes map[string]*Quarantine `json:"indexes"`
+	}{
+		Status:  "ok",
+		Indexes: indexes,
+	})
+}
+
+// QuarantineReleaseHandler is a REST handler that releases an index
+// from quarantine.
+type QuarantineReleaseHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewQuarantineReleaseHandler(
+	mgr *cbgt.Manager) *QuarantineReleaseHandler {
+	return &QuarantineReleaseHandler{mgr: mgr}
+}
+
+func (h *QuarantineReleaseHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	err := ReleaseQuarantine(h.mgr, indexName)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
@@ -0,0 +1,108 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestQuarantine(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	_, err := CfgSetJSON(cfg, CLUSTER_SETTINGS_KEY, &ClusterSettings{
+		IngestErrorBudget:             0.5,
+		IngestErrorBudgetMinMutations: 4,
+	}, 0)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	defer CfgSetJSON(cfg, CLUSTER_SETTINGS_KEY, &ClusterSettings{}, 0)
+
+	err = ClusterSettingsWatchCfg(cfg)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	err = QuarantineStart(mgr)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	err = mgr.CreateIndex("primary", "", "", `{"numPartitions":1}`,
+		"bleve", "q0", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	feeds, _ := mgr.CurrentMaps()
+	var pf *cbgt.PrimaryFeed
+	for _, feed := range feeds {
+		if feed.IndexName() == "q0" {
+			pf = feed.(*cbgt.PrimaryFeed)
+		}
+	}
+	if pf == nil {
+		t.Fatalf("expected a primary feed")
+	}
+
+	pf.SnapshotStart("0", 1, 10)
+	for i := 1; i <= 6; i++ {
+		val := []byte(`{"name":"x"}`)
+		if i > 2 {
+			val = []byte(`not json`)
+		}
+		pf.DataUpdate("0", []byte(fmt.Sprintf("doc-%d", i)),
+			uint64(i), val, 0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+	}
+
+	for i := 0; i < 100 && !IsQuarantined("q0"); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !IsQuarantined("q0") {
+		t.Fatalf("expected q0 to be quarantined")
+	}
+
+	qis := &QuarantinedIndexes{}
+	CfgGetJSON(cfg, QUARANTINE_KEY, qis)
+	q := qis.Indexes["q0"]
+	if q == nil || q.Mutations != 4 || q.Errors != 2 ||
+		q.NodeUUID != mgr.UUID() {
+		t.Errorf("expected quarantine entry, got: %#v", q)
+	}
+
+	err = ReleaseQuarantine(mgr, "q0")
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	err = ReleaseQuarantine(mgr, "q0")
+	if err == nil {
+		t.Errorf("expected err on releasing an unquarantined index")
+	}
+
+	for i := 0; i < 100 && IsQuarantined("q0"); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if IsQuarantined("q0") {
+		t.Errorf("expected q0 to be released")
+	}
+}
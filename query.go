@@ -0,0 +1,159 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// A queryRewriter is invoked on each JSON object in a query tree and
+// can return a replacement for that object, or nil for no change.
+type queryRewriter func(q map[string]interface{}) (interface{}, error)
+
+// parseJSONUseNumber parses JSON into a generic value, keeping numbers
+// as json.Number's so that large values (like the seq numbers in
+// consistency vectors) aren't corrupted by a float64 round-trip.
+func parseJSONUseNumber(buf []byte) (interface{}, error) {
+	var rv interface{}
+	d := json.NewDecoder(bytes.NewReader(buf))
+	d.UseNumber()
+	err := d.Decode(&rv)
+	return rv, err
+}
+
+// rewriteQueryTree walks a generic JSON query tree, giving the
+// rewriter a chance to replace each query object.  Replacements are
+// not walked any further.
+func rewriteQueryTree(q interface{}, f queryRewriter) (interface{}, error) {
+	switch qq := q.(type) {
+	case map[string]interface{}:
+		r, err := f(qq)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			return r, nil
+		}
+		for k, v := range qq {
+			nv, err := rewriteQueryTree(v, f)
+			if err != nil {
+				return nil, err
+			}
+			qq[k] = nv
+		}
+	case []interface{}:
+		for i, v := range qq {
+			nv, err := rewriteQueryTree(v, f)
+			if err != nil {
+				return nil, err
+			}
+			qq[i] = nv
+		}
+	}
+	return q, nil
+}
+
+// rewriteQueryRequest applies a queryRewriter to the "query" of a
+// JSON search request.  The original req is returned when the
+// rewriter didn't change anything.
+func rewriteQueryRequest(req []byte, f queryRewriter) ([]byte, error) {
+	v, err := parseJSONUseNumber(req)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return req, nil
+	}
+	q, exists := m["query"]
+	if !exists {
+		return req, nil
+	}
+
+	changed := false
+
+	q, err = rewriteQueryTree(q, func(qm map[string]interface{}) (
+		interface{}, error) {
+		r, err := f(qm)
+		if r != nil {
+			changed = true
+		}
+		return r, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return req, nil
+	}
+
+	m["query"] = q
+
+	return json.Marshal(m)
+}
+
+// jsonInt returns the integer value of a generic JSON value, or the
+// defaultVal if the value is missing or not a number.
+func jsonInt(v interface{}, defaultVal int) int {
+	switch vv := v.(type) {
+	case json.Number:
+		i, err := vv.Int64()
+		if err == nil {
+			return int(i)
+		}
+		f, err := vv.Float64()
+		if err == nil {
+			return int(f)
+		}
+	case float64:
+		return int(vv)
+	case int:
+		return vv
+	}
+	return defaultVal
+}
+
+// jsonFloat returns the float64 value of a generic JSON value, or the
+// defaultVal if the value is missing or not a number.
+func jsonFloat(v interface{}, defaultVal float64) float64 {
+	switch vv := v.(type) {
+	case json.Number:
+		f, err := vv.Float64()
+		if err == nil {
+			return f
+		}
+	case float64:
+		return vv
+	case int:
+		return float64(vv)
+	}
+	return defaultVal
+}
+
+// jsonStrings returns the strings of a generic JSON value, which may
+// be either a string or an array of strings.
+func jsonStrings(v interface{}) []string {
+	switch vv := v.(type) {
+	case string:
+		return []string{vv}
+	case []interface{}:
+		rv := make([]string, 0, len(vv))
+		for _, x := range vv {
+			if s, ok := x.(string); ok {
+				rv = append(rv, s)
+			}
+		}
+		return rv
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// Every query that a node is running is an active query, with an ID
+// that's either the query's ctl "queryId" or else assigned by the
+// node, so that a runaway query, like an expensive regexp query, can
+// be listed (GET /api/query/active) and cancelled (DELETE
+// /api/query/{queryId}) without restarting the node.  Cancelling a
+// query closes its cancelCh, like its ctl timeout does, so the query
+// stops waiting for its pindexes and fails right away, and the
+// searches of the pindexes that haven't started are skipped.  This
+// version of bleve can't interrupt the search of a pindex, though, so
+// the searches that are already running on the pindexes still finish
+// in the background, which are counted as orphaned searches.
+
+// An ActiveQuery is a query that a node is running.
+type ActiveQuery struct {
+	QueryID   string          `json:"queryId"`
+	IndexName string          `json:"indexName"`
+	Query     json.RawMessage `json:"query"`
+	StartTime time.Time       `json:"startTime"`
+	Cancelled bool            `json:"cancelled,omitempty"`
+	MemBytes  int64           `json:"memBytes"` // See query_memory.go.
+
+	err        error // The reason of a cancel, protected by activeQueriesM.
+	cancelCh   chan bool
+	cancelOnce sync.Once
+	doneCh     chan struct{}
+}
+
+type queryActiveCtlParams struct {
+	Ctl struct {
+		QueryID string `json:"queryId"`
+	} `json:"ctl"`
+}
+
+var activeQueriesM sync.Mutex // Protects activeQueries.
+var activeQueries = map[string]*ActiveQuery{}
+
+var activeQueryLastID uint64
+
+// The number of pindex searches that are still running after their
+// queries were cancelled or timed out, and the total number of such
+// searches since the node started.  Accessed via atomic.
+var queryOrphanedSearches int64
+var queryOrphanedSearchesTotal uint64
+
+// StartActiveQuery registers a query as active, until its Done.
+func StartActiveQuery(indexName string, req []byte) (*ActiveQuery, error) {
+	var p queryActiveCtlParams
+	json.Unmarshal(req, &p)
+
+	queryID := p.Ctl.QueryID
+	if queryID == "" {
+		queryID = strconv.FormatUint(
+			atomic.AddUint64(&activeQueryLastID, 1), 10)
+	}
+
+	aq := &ActiveQuery{
+		QueryID:   queryID,
+		IndexName: indexName,
+		Query:     json.RawMessage(append([]byte(nil), req...)),
+		StartTime: time.Now(),
+		cancelCh:  make(chan bool),
+		doneCh:    make(chan struct{}),
+	}
+
+	activeQueriesM.Lock()
+	defer activeQueriesM.Unlock()
+
+	if activeQueries[queryID] != nil {
+		return nil, fmt.Errorf("query_active: queryId is already active,"+
+			" queryId: %s", queryID)
+	}
+	activeQueries[queryID] = aq
+
+	return aq, nil
+}
+
+// CancelCh returns a cancelCh that's closed when the query is
+// cancelled or when the timeoutCh is closed.
+func (aq *ActiveQuery) CancelCh(timeoutCh <-chan bool) <-chan bool {
+	rv := make(chan bool)
+	go func() {
+		select {
+		case <-timeoutCh:
+		case <-aq.cancelCh:
+		case <-aq.doneCh:
+			return
+		}
+		close(rv)
+	}()
+	return rv
+}
+
+// Cancel cancels the query.
+func (aq *ActiveQuery) Cancel() {
+	aq.abort(fmt.Errorf("query_active: query cancelled,"+
+		" queryId: %s", aq.QueryID))
+}
+
+// abort cancels the query for a reason, where only the first reason
+// is kept.
+func (aq *ActiveQuery) abort(err error) {
+	aq.cancelOnce.Do(func() {
+		activeQueriesM.Lock()
+		aq.Cancelled = true
+		aq.err = err
+		activeQueriesM.Unlock()
+
+		close(aq.cancelCh)
+	})
+}
+
+// IsCancelled returns true when the query was cancelled.
+func (aq *ActiveQuery) IsCancelled() bool {
+	select {
+	case <-aq.cancelCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Err returns the reason that the query was cancelled, or nil.
+func (aq *ActiveQuery) Err() error {
+	activeQueriesM.Lock()
+	defer activeQueriesM.Unlock()
+	return aq.err
+}
+
+// Done unregisters a finished query.
+func (aq *ActiveQuery) Done() {
+	activeQueriesM.Lock()
+	if activeQueries[aq.QueryID] == aq {
+		delete(activeQueries, aq.QueryID)
+	}
+	activeQueriesM.Unlock()
+
+	close(aq.doneCh)
+}
+
+// ActiveQueries returns copies of the active queries of an index, or
+// of all indexes when the indexName is "", from the oldest.
+func ActiveQueries(indexName string) []*ActiveQuery {
+	activeQueriesM.Lock()
+	rv := make(activeQueriesByStartTime, 0, len(activeQueries))
+	for _, aq := range activeQueries {
+		if indexName == "" || aq.IndexName == indexName {
+			rv = append(rv, &ActiveQuery{
+				QueryID:   aq.QueryID,
+				IndexName: aq.IndexName,
+				Query:     aq.Query,
+				StartTime: aq.StartTime,
+				Cancelled: aq.Cancelled,
+				MemBytes:  atomic.LoadInt64(&aq.MemBytes),
+			})
+		}
+	}
+	activeQueriesM.Unlock()
+
+	sort.Sort(rv)
+
+	return rv
+}
+
+// CancelActiveQuery cancels an active query, returning false when
+// there's no such active query.
+func CancelActiveQuery(queryID string) bool {
+	activeQueriesM.Lock()
+	aq := activeQueries[queryID]
+	activeQueriesM.Unlock()
+
+	if aq == nil {
+		return false
+	}
+
+	aq.Cancel()
+
+	return true
+}
+
+type activeQueriesByStartTime []*ActiveQuery
+
+func (a activeQueriesByStartTime) Len() int {
+	return len(a)
+}
+
+func (a activeQueriesByStartTime) Less(i, j int) bool {
+	if a[i].StartTime.Equal(a[j].StartTime) {
+		return a[i].QueryID < a[j].QueryID
+	}
+	return a[i].StartTime.Before(a[j].StartTime)
+}
+
+func (a activeQueriesByStartTime) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+// ---------------------------------------------------------
+
+// QueryActiveHandler is a REST handler that lists the active queries
+// of the node.
+type QueryActiveHandler struct{}
+
+func NewQueryActiveHandler() *QueryActiveHandler {
+	return &QueryActiveHandler{}
+}
+
+func (h *QueryActiveHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+
+	type activeQueryJSON struct {
+		*ActiveQuery
+		ElapsedMS int64 `json:"elapsedMS"`
+	}
+
+	aqs := ActiveQueries(req.FormValue("indexName"))
+
+	queries := make([]activeQueryJSON, len(aqs))
+	for i, aq := range aqs {
+		queries[i] = activeQueryJSON{
+			ActiveQuery: aq,
+			ElapsedMS:   int64(now.Sub(aq.StartTime) / time.Millisecond),
+		}
+	}
+
+	rest.MustEncode(w, struct {
+		Status                string            `json:"status"`
+		Queries               []activeQueryJSON `json:"queries"`
+		OrphanedSearches      int64             `json:"orphanedSearches"`
+		OrphanedSearchesTotal uint64            `json:"orphanedSearchesTotal"`
+	}{
+		Status:                "ok",
+		Queries:               queries,
+		OrphanedSearches:      atomic.LoadInt64(&queryOrphanedSearches),
+		OrphanedSearchesTotal: atomic.LoadUint64(&queryOrphanedSearchesTotal),
+	})
+}
+
+// QueryCancelHandler is a REST handler that cancels an active query.
+type QueryCancelHandler struct{}
+
+func NewQueryCancelHandler() *QueryCancelHandler {
+	return &QueryCancelHandler{}
+}
+
+func (h *QueryCancelHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	queryID := mux.Vars(req)["queryId"]
+	if queryID == "" {
+		rest.ShowError(w, req, "query_active: queryId is required", 400)
+		return
+	}
+
+	if !CancelActiveQuery(queryID) {
+		rest.ShowError(w, req, fmt.Sprintf("query_active: no active query,"+
+			" queryId: %s", queryID), http.StatusNotFound)
+		return
+	}
+
+	log.Printf("query_active: cancelled, queryId: %s", queryID)
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
@@ -0,0 +1,135 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestActiveQueries(t *testing.T) {
+	aq, err := StartActiveQuery("beers",
+		[]byte(`{"query":{"regexp":"a.*"},"ctl":{"queryId":"q-1"}}`))
+	if err != nil || aq.QueryID != "q-1" {
+		t.Fatalf("expected queryId q-1, got: %+v, err: %v", aq, err)
+	}
+
+	_, err = StartActiveQuery("beers", []byte(`{"ctl":{"queryId":"q-1"}}`))
+	if err == nil {
+		t.Errorf("expected err on a duplicate queryId")
+	}
+
+	aq2, err := StartActiveQuery("wines", []byte(`{"query":{}}`))
+	if err != nil || aq2.QueryID == "" {
+		t.Fatalf("expected an assigned queryId, got: %+v, err: %v", aq2, err)
+	}
+
+	if len(ActiveQueries("")) != 2 {
+		t.Errorf("expected 2 active queries, got: %v", ActiveQueries(""))
+	}
+	beers := ActiveQueries("beers")
+	if len(beers) != 1 || beers[0].QueryID != "q-1" {
+		t.Errorf("expected the beers query, got: %v", beers)
+	}
+
+	cancelCh := aq.CancelCh(nil)
+	if aq.IsCancelled() {
+		t.Errorf("expected not cancelled yet")
+	}
+	if CancelActiveQuery("not-a-query") {
+		t.Errorf("expected no cancel of an unknown queryId")
+	}
+	if !CancelActiveQuery("q-1") {
+		t.Errorf("expected cancel of q-1")
+	}
+	aq.Cancel() // Cancelling twice is ok.
+
+	select {
+	case <-cancelCh:
+	case <-time.After(time.Second):
+		t.Errorf("expected cancelCh closed after a cancel")
+	}
+	if !aq.IsCancelled() || !ActiveQueries("beers")[0].Cancelled {
+		t.Errorf("expected cancelled")
+	}
+
+	timeoutCh := make(chan bool)
+	cancelCh2 := aq2.CancelCh(timeoutCh)
+	close(timeoutCh)
+	select {
+	case <-cancelCh2:
+	case <-time.After(time.Second):
+		t.Errorf("expected cancelCh closed after a timeout")
+	}
+	if aq2.IsCancelled() {
+		t.Errorf("expected a timeout not to be a cancel")
+	}
+
+	aq.Done()
+	aq2.Done()
+	if len(ActiveQueries("")) != 0 {
+		t.Errorf("expected no active queries after done")
+	}
+}
+
+func TestQueryActiveHandlers(t *testing.T) {
+	aq, _ := StartActiveQuery("beers",
+		[]byte(`{"query":{"match":"ale"},"ctl":{"queryId":"q-2"}}`))
+	defer aq.Done()
+
+	r := mux.NewRouter()
+	r.Handle("/api/query/active", NewQueryActiveHandler()).Methods("GET")
+	r.Handle("/api/query/{queryId}", NewQueryCancelHandler()).
+		Methods("DELETE")
+
+	req, _ := http.NewRequest("GET", "/api/query/active?indexName=beers", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	var res struct {
+		Status  string
+		Queries []struct {
+			QueryID   string          `json:"queryId"`
+			IndexName string          `json:"indexName"`
+			Query     json.RawMessage `json:"query"`
+			ElapsedMS int64           `json:"elapsedMS"`
+		}
+		OrphanedSearches *int64 `json:"orphanedSearches"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &res)
+	if rr.Code != 200 || err != nil || len(res.Queries) != 1 ||
+		res.OrphanedSearches == nil ||
+		res.Queries[0].QueryID != "q-2" ||
+		string(res.Queries[0].Query) !=
+			`{"query":{"match":"ale"},"ctl":{"queryId":"q-2"}}` {
+		t.Errorf("unexpected active queries: %d, %s", rr.Code, rr.Body)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/api/query/not-a-query", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got: %d", rr.Code)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/api/query/q-2", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != 200 || !aq.IsCancelled() {
+		t.Errorf("expected cancel, got: %d, %s", rr.Code, rr.Body)
+	}
+}
@@ -0,0 +1,160 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/numeric_util"
+	"github.com/blevesearch/bleve/search"
+)
+
+// A query request can have numeric metric aggregations over the
+// matching docs, keyed by aggregation name, like...
+//
+//   {"query": {...},
+//    "aggregations": {"priceStats": {"field": "price"}}}
+//
+// where each aggregation returns the count, sum, min, max and avg of
+// the values of a numeric field, as the "aggregations" of the result.
+//
+// Each aggregation is computed by each pindex as a terms facet on the
+// numeric field, whose full precision terms are the field's values,
+// and the facets are merged in the gather phase, so the metrics are
+// exact across all the pindexes.
+
+// The prefix of the names of the facets that compute aggregations.
+const QUERY_AGGREGATION_FACET_PREFIX = "_aggregation_"
+
+// QueryAggregationRequest is a numeric metric aggregation request.
+type QueryAggregationRequest struct {
+	Field string `json:"field"`
+}
+
+// QueryAggregationResult holds the metrics of the values of a numeric
+// field of the matching docs, where a doc with more than one value
+// contributes each value.
+type QueryAggregationResult struct {
+	Field string   `json:"field"`
+	Count int      `json:"count"`
+	Sum   float64  `json:"sum"`
+	Min   *float64 `json:"min"`
+	Max   *float64 `json:"max"`
+	Avg   *float64 `json:"avg"`
+}
+
+type queryAggregationsParams struct {
+	Aggregations map[string]*QueryAggregationRequest `json:"aggregations"`
+}
+
+// queryAggregations returns the aggregation requests of a query
+// request.
+func queryAggregations(req []byte) (
+	map[string]*QueryAggregationRequest, error) {
+	var p queryAggregationsParams
+	err := json.Unmarshal(req, &p)
+	if err != nil {
+		return nil, err
+	}
+	for name, a := range p.Aggregations {
+		if a == nil || a.Field == "" {
+			return nil, fmt.Errorf("query_aggregations: aggregation: %s"+
+				" needs a field", name)
+		}
+	}
+	return p.Aggregations, nil
+}
+
+// queryAggregationsGatherRequest returns the search request to gather
+// with, which has a facet for each aggregation.
+func queryAggregationsGatherRequest(req *bleve.SearchRequest,
+	aggs map[string]*QueryAggregationRequest) *bleve.SearchRequest {
+	if len(aggs) <= 0 {
+		return req
+	}
+
+	r := *req
+	r.Facets = bleve.FacetsRequest{}
+	for name, fr := range req.Facets {
+		r.Facets[name] = fr
+	}
+	for name, a := range aggs {
+		// Every term is needed, as the terms are the field's values.
+		r.Facets[QUERY_AGGREGATION_FACET_PREFIX+name] =
+			bleve.NewFacetRequest(a.Field, math.MaxInt32)
+	}
+
+	return &r
+}
+
+// queryAggregationsResults computes the aggregations from the facets
+// of a gathered search result, removing the facets from the result.
+func queryAggregationsResults(sr *bleve.SearchResult,
+	aggs map[string]*QueryAggregationRequest) map[string]*QueryAggregationResult {
+	if len(aggs) <= 0 {
+		return nil
+	}
+
+	rv := map[string]*QueryAggregationResult{}
+	for name, a := range aggs {
+		facetName := QUERY_AGGREGATION_FACET_PREFIX + name
+		rv[name] = queryAggregationResult(a.Field, sr.Facets[facetName])
+		delete(sr.Facets, facetName)
+	}
+	return rv
+}
+
+// queryAggregationResult computes the metrics of a numeric field from
+// a terms facet on the field.
+func queryAggregationResult(field string,
+	fr *search.FacetResult) *QueryAggregationResult {
+	rv := &QueryAggregationResult{Field: field}
+	if fr == nil {
+		return rv
+	}
+
+	for _, tf := range fr.Terms {
+		pc := numeric_util.PrefixCoded(tf.Term)
+
+		// Only the full precision terms are the field's values.
+		shift, err := pc.Shift()
+		if err != nil || shift != 0 {
+			continue
+		}
+		i64, err := pc.Int64()
+		if err != nil {
+			continue
+		}
+		v := numeric_util.Int64ToFloat64(i64)
+
+		rv.Count += tf.Count
+		rv.Sum += v * float64(tf.Count)
+		if rv.Min == nil || v < *rv.Min {
+			min := v
+			rv.Min = &min
+		}
+		if rv.Max == nil || v > *rv.Max {
+			max := v
+			rv.Max = &max
+		}
+	}
+
+	if rv.Count > 0 {
+		avg := rv.Sum / float64(rv.Count)
+		rv.Avg = &avg
+	}
+
+	return rv
+}
@@ -0,0 +1,93 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+func TestQueryAggregations(t *testing.T) {
+	aggs, err := queryAggregations([]byte(`{"query":{},` +
+		`"aggregations":{"priceStats":{"field":"price"}}}`))
+	if err != nil || aggs["priceStats"].Field != "price" {
+		t.Errorf("unexpected aggs: %#v, err: %v", aggs, err)
+	}
+
+	_, err = queryAggregations([]byte(`{"aggregations":{"x":{}}}`))
+	if err == nil {
+		t.Errorf("expected err on an aggregation without a field")
+	}
+}
+
+func TestQueryAggregationsGather(t *testing.T) {
+	// The prices are split across two indexes, like two pindexes.
+	a, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prices := []float64{10, 2.5, 10, 100, -4, 7}
+	for i, price := range prices {
+		idx := a
+		if i%2 == 1 {
+			idx = b
+		}
+		idx.Index(fmt.Sprintf("d%d", i), map[string]interface{}{
+			"type":  "product",
+			"price": price,
+		})
+	}
+	a.Index("noPrice", map[string]interface{}{"type": "product"})
+
+	aggs := map[string]*QueryAggregationRequest{
+		"priceStats": &QueryAggregationRequest{Field: "price"},
+	}
+
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	req.AddFacet("types", bleve.NewFacetRequest("type", 3))
+
+	gatherRequest := queryAggregationsGatherRequest(req, aggs)
+	if len(req.Facets) != 1 || len(gatherRequest.Facets) != 2 {
+		t.Fatalf("expected an added facet on a copy")
+	}
+
+	sr, err := bleve.NewIndexAlias(a, b).Search(gatherRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := queryAggregationsResults(sr, aggs)
+
+	r := results["priceStats"]
+	if r == nil || r.Count != 6 || r.Sum != 125.5 ||
+		*r.Min != -4 || *r.Max != 100 ||
+		*r.Avg != 125.5/6 {
+		t.Errorf("unexpected result: %#v", r)
+	}
+	if len(sr.Facets) != 1 || sr.Facets["types"] == nil {
+		t.Errorf("expected only the requested facets, got: %#v", sr.Facets)
+	}
+}
+
+func TestQueryAggregationResultNoValues(t *testing.T) {
+	r := queryAggregationResult("price", nil)
+	if r.Count != 0 || r.Min != nil || r.Max != nil || r.Avg != nil {
+		t.Errorf("unexpected result: %#v", r)
+	}
+}
@@ -0,0 +1,95 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/blevesearch/bleve"
+)
+
+// A query request can override the analyzers that are used to
+// analyze the text of its match and match_phrase queries, keyed by
+// field name, without changing the index mapping, such as to search
+// a text field with the "keyword" analyzer...
+//
+//   {"ctl": {"analyzers": {"title": "keyword"}},
+//    "query": {"match": "Pale Ale", "field": "title"}}
+//
+// An "analyzer" that's set on a query takes precedence over the
+// override of its field.
+
+type queryAnalyzersCtlParams struct {
+	Ctl struct {
+		Analyzers map[string]string `json:"analyzers"`
+	} `json:"ctl"`
+}
+
+// queryAnalyzerKinds are the kinds of queries whose text is analyzed.
+var queryAnalyzerKinds = []string{"match", "match_phrase"}
+
+// rewriteQueryAnalyzers applies the analyzer overrides of the ctl of
+// a JSON search request to its queries, and checks that all of the
+// analyzers of the request are known to the index mapping, if any.
+func rewriteQueryAnalyzers(req []byte,
+	m *bleve.IndexMapping) ([]byte, error) {
+	var p queryAnalyzersCtlParams
+	err := json.Unmarshal(req, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	checkAnalyzer := func(name string) error {
+		if m != nil && m.AnalyzerNamed(name) == nil {
+			return fmt.Errorf("query_analyzers: unknown analyzer: %q", name)
+		}
+		return nil
+	}
+
+	for field, name := range p.Ctl.Analyzers {
+		if field == "" {
+			return nil, fmt.Errorf("query_analyzers: missing field name"+
+				" for analyzer: %q", name)
+		}
+		err = checkAnalyzer(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rewriteQueryRequest(req, func(q map[string]interface{}) (
+		interface{}, error) {
+		if analyzer, ok := q["analyzer"].(string); ok && analyzer != "" {
+			return nil, checkAnalyzer(analyzer)
+		}
+
+		field, _ := q["field"].(string)
+		analyzer, exists := p.Ctl.Analyzers[field]
+		if !exists {
+			return nil, nil
+		}
+
+		for _, kind := range queryAnalyzerKinds {
+			if _, ok := q[kind].(string); ok {
+				rv := make(map[string]interface{}, len(q)+1)
+				for k, v := range q {
+					rv[k] = v
+				}
+				rv["analyzer"] = analyzer
+				return rv, nil
+			}
+		}
+
+		return nil, nil
+	})
+}
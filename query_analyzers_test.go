@@ -0,0 +1,74 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+func TestRewriteQueryAnalyzers(t *testing.T) {
+	m := bleve.NewIndexMapping()
+
+	req := []byte(`{"query":{"match":"Pale Ale","field":"title"}}`)
+	rv, err := rewriteQueryAnalyzers(req, m)
+	if err != nil || string(rv) != string(req) {
+		t.Errorf("expected no rewrite without overrides, got: %s, %v", rv, err)
+	}
+
+	req = []byte(`{"ctl":{"analyzers":{"title":"keyword"}},
+		"query":{"conjuncts":[
+			{"match":"Pale Ale","field":"title"},
+			{"match_phrase":"pale ale","field":"title","analyzer":"standard"},
+			{"match":"pale","field":"desc"},
+			{"term":"Pale","field":"title"}]}}`)
+	rv, err = rewriteQueryAnalyzers(req, m)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+
+	var r struct {
+		Query struct {
+			Conjuncts []map[string]interface{} `json:"conjuncts"`
+		} `json:"query"`
+	}
+	json.Unmarshal(rv, &r)
+	exp := []interface{}{"keyword", "standard", nil, nil}
+	if len(r.Query.Conjuncts) != len(exp) {
+		t.Fatalf("unexpected rewrite: %s", rv)
+	}
+	for i, c := range r.Query.Conjuncts {
+		if c["analyzer"] != exp[i] {
+			t.Errorf("%d: expected analyzer: %v, got: %v", i, exp[i], c)
+		}
+	}
+
+	for _, req := range []string{
+		`{"ctl":{"analyzers":{"title":"not-an-analyzer"}},"query":{"match":"x"}}`,
+		`{"ctl":{"analyzers":{"":"keyword"}},"query":{"match":"x"}}`,
+		`{"query":{"match":"x","field":"title","analyzer":"not-an-analyzer"}}`,
+	} {
+		_, err = rewriteQueryAnalyzers([]byte(req), m)
+		if err == nil {
+			t.Errorf("expected err, req: %s", req)
+		}
+	}
+
+	// Without a mapping, as for index aliases, analyzers aren't checked.
+	_, err = rewriteQueryAnalyzers([]byte(`{"ctl":{"analyzers":`+
+		`{"title":"not-an-analyzer"}},"query":{"match":"x"}}`), nil)
+	if err != nil {
+		t.Errorf("expected no err without a mapping, got: %v", err)
+	}
+}
@@ -0,0 +1,422 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// The scoring model of a bleve index is tf-idf by default, which
+// favors short fields too strongly for some use cases, like product
+// titles.  The "similarity" of the bleve index params can instead
+// select BM25...
+//
+//   {"similarity": {
+//      "model": "bm25",   // Or "tfidf", the default.
+//      "k1": 1.2,         // Optional, the term frequency saturation.
+//      "b": 0.75,         // Optional, the field length normalization.
+//      "avgFieldLengths": {"title": 6.5}}} // Optional.
+//
+// Like global scoring (see query_global_idf.go), the hits are
+// gathered with explanations, and each term's score is recomputed
+// with BM25 from its term frequency, doc frequency and field norm.
+// The field length of a hit is derived from its field norm, which is
+// 1/sqrt(length).  As the index doesn't keep the average length of
+// each field, it's estimated from the field lengths of the hits of
+// all the queries of the index on this node, unless it's given in
+// the avgFieldLengths.
+//
+// The hits are a window of the top hits by their tf-idf scores (see
+// queryRescoreGatherRequest), so the BM25 scoring is approximate: a
+// doc outside the window of every pindex isn't rescored.
+
+const BM25_DEFAULT_K1 = 1.2
+const BM25_DEFAULT_B = 0.75
+
+type BleveSimilarity struct {
+	Model           string             `json:"model,omitempty"`
+	K1              *float64           `json:"k1,omitempty"`
+	B               *float64           `json:"b,omitempty"`
+	AvgFieldLengths map[string]float64 `json:"avgFieldLengths,omitempty"`
+}
+
+// IsBM25 returns true when the similarity selects BM25.
+func (s *BleveSimilarity) IsBM25() bool {
+	return s != nil && strings.ToLower(s.Model) == "bm25"
+}
+
+func (s *BleveSimilarity) k1() float64 {
+	if s.K1 != nil {
+		return *s.K1
+	}
+	return BM25_DEFAULT_K1
+}
+
+func (s *BleveSimilarity) b() float64 {
+	if s.B != nil {
+		return *s.B
+	}
+	return BM25_DEFAULT_B
+}
+
+// validateBleveSimilarity checks the similarity of the index params.
+func validateBleveSimilarity(s *BleveSimilarity) error {
+	if s == nil {
+		return nil
+	}
+
+	switch strings.ToLower(s.Model) {
+	case "", "tfidf":
+		if s.K1 != nil || s.B != nil || len(s.AvgFieldLengths) > 0 {
+			return fmt.Errorf("query_bm25: k1, b and avgFieldLengths" +
+				" are only for the bm25 similarity model")
+		}
+		return nil
+	case "bm25":
+	default:
+		return fmt.Errorf("query_bm25: unknown similarity model: %q,"+
+			" must be \"tfidf\" or \"bm25\"", s.Model)
+	}
+
+	if s.k1() < 0 {
+		return fmt.Errorf("query_bm25: k1 must be >= 0, k1: %v", s.k1())
+	}
+	if s.b() < 0 || s.b() > 1 {
+		return fmt.Errorf("query_bm25: b must be between 0 and 1,"+
+			" b: %v", s.b())
+	}
+	for field, n := range s.AvgFieldLengths {
+		if n <= 0 {
+			return fmt.Errorf("query_bm25: avgFieldLengths must be > 0,"+
+				" field: %s", field)
+		}
+	}
+
+	return nil
+}
+
+// bm25IDF returns the BM25 IDF of a term, which is always positive.
+func bm25IDF(docFreq, docTotal uint64) float64 {
+	return math.Log(1.0 +
+		(float64(docTotal)-float64(docFreq)+0.5)/(float64(docFreq)+0.5))
+}
+
+// bm25TermFreq parses the term frequency out of a tf explanation,
+// like "tf(termFreq(desc:beer)=3", falling back to the tf value,
+// which is sqrt(freq).
+func bm25TermFreq(e *search.Explanation) float64 {
+	i := strings.LastIndex(e.Message, "=")
+	if i >= 0 {
+		n, err := strconv.ParseFloat(strings.TrimRight(e.Message[i+1:], ")"), 64)
+		if err == nil {
+			return n
+		}
+	}
+	return e.Value * e.Value
+}
+
+// bm25FieldLength returns the field length of a fieldNorm value.
+func bm25FieldLength(norm float64) float64 {
+	if norm <= 0 {
+		return 0
+	}
+	return 1.0 / (norm * norm)
+}
+
+// bm25FieldWeights visits the fieldWeight explanations of the terms
+// in an explanation tree.
+func bm25FieldWeights(e *search.Explanation,
+	visit func(e *search.Explanation, t *globalIDFTerm)) {
+	if e == nil {
+		return
+	}
+	if strings.HasPrefix(e.Message, "fieldWeight(") {
+		t, _, ok := globalIDFTermFromMessage(e.Message)
+		if ok {
+			visit(e, t)
+		}
+		return
+	}
+	for _, c := range e.Children {
+		bm25FieldWeights(c, visit)
+	}
+}
+
+// bm25FieldStats are the summed field lengths and counts of the
+// fields of the terms in some hits.
+type bm25FieldStats struct {
+	indexUUID string
+	sums      map[string]float64
+	counts    map[string]float64
+}
+
+func newBM25FieldStats() *bm25FieldStats {
+	return &bm25FieldStats{
+		sums:   map[string]float64{},
+		counts: map[string]float64{},
+	}
+}
+
+// add sums the field lengths of the terms in the hits, from their
+// field norms.
+func (s *bm25FieldStats) add(hits search.DocumentMatchCollection) {
+	for _, hit := range hits {
+		bm25FieldWeights(hit.Expl, func(e *search.Explanation, t *globalIDFTerm) {
+			for _, c := range e.Children {
+				if c != nil && strings.HasPrefix(c.Message, "fieldNorm(") {
+					s.sums[t.Field] += bm25FieldLength(c.Value)
+					s.counts[t.Field]++
+				}
+			}
+		})
+	}
+}
+
+// avgFieldLengths returns the average length of each field.
+func (s *bm25FieldStats) avgFieldLengths() map[string]float64 {
+	rv := map[string]float64{}
+	for field, sum := range s.sums {
+		if sum > 0 {
+			rv[field] = sum / s.counts[field]
+		}
+	}
+	return rv
+}
+
+// bm25AvgFieldLengths estimates the average length of each field of
+// the terms in the hits, from their field norms.
+func bm25AvgFieldLengths(hits search.DocumentMatchCollection) map[string]float64 {
+	s := newBM25FieldStats()
+	s.add(hits)
+	return s.avgFieldLengths()
+}
+
+// The max number of field lengths of a field that are averaged, past
+// which the stats are halved, so that they follow the index's docs as
+// they change.
+var BM25FieldStatsMaxCount = 100000.0
+
+var bm25IndexFieldStatsM sync.Mutex
+
+// The field stats of the BM25 indexes, keyed by index name.
+var bm25IndexFieldStats = map[string]*bm25FieldStats{}
+
+// bm25IndexAvgFieldLengths adds the field lengths of the hits to the
+// field stats of an index, and returns its average field lengths.
+// The stats of deleted or recreated indexes are dropped.
+func bm25IndexAvgFieldLengths(indexDefs *cbgt.IndexDefs, indexName string,
+	hits search.DocumentMatchCollection) map[string]float64 {
+	bm25IndexFieldStatsM.Lock()
+	defer bm25IndexFieldStatsM.Unlock()
+
+	var indexUUID string
+	if indexDefs != nil {
+		for name := range bm25IndexFieldStats {
+			if indexDefs.IndexDefs[name] == nil {
+				delete(bm25IndexFieldStats, name)
+			}
+		}
+		if indexDef := indexDefs.IndexDefs[indexName]; indexDef != nil {
+			indexUUID = indexDef.UUID
+		}
+	}
+
+	s := bm25IndexFieldStats[indexName]
+	if s == nil || s.indexUUID != indexUUID {
+		s = newBM25FieldStats()
+		s.indexUUID = indexUUID
+		bm25IndexFieldStats[indexName] = s
+	}
+
+	s.add(hits)
+
+	for field, count := range s.counts {
+		if count > BM25FieldStatsMaxCount {
+			s.sums[field] = s.sums[field] / 2
+			s.counts[field] = count / 2
+		}
+	}
+
+	return s.avgFieldLengths()
+}
+
+// A bm25Scorer recomputes explanation trees with BM25.
+type bm25Scorer struct {
+	k1, b      float64
+	avgLengths map[string]float64
+
+	// When there are global stats, the doc frequencies are from the
+	// stats instead of the explanations.
+	docTotal uint64
+	docFreqs map[globalIDFTerm]uint64
+}
+
+// fieldWeight recomputes a term's fieldWeight explanation, whose
+// children are its tf, idf and fieldNorm explanations.
+func (s *bm25Scorer) fieldWeight(e *search.Explanation, t *globalIDFTerm) float64 {
+	var tf, idf, norm *search.Explanation
+	for _, c := range e.Children {
+		switch {
+		case c == nil:
+		case strings.HasPrefix(c.Message, "tf("):
+			tf = c
+		case strings.HasPrefix(c.Message, "idf("):
+			idf = c
+		case strings.HasPrefix(c.Message, "fieldNorm("):
+			norm = c
+		}
+	}
+	if tf == nil || idf == nil {
+		return e.Value
+	}
+
+	var docFreq, docTotal uint64
+	fmt.Sscanf(idf.Message, "idf(docFreq=%d, maxDocs=%d)", &docFreq, &docTotal)
+	if s.docFreqs != nil {
+		docFreq, docTotal = s.docFreqs[*t], s.docTotal
+	}
+
+	freq := bm25TermFreq(tf)
+
+	avgLength := s.avgLengths[t.Field]
+	length := avgLength
+	if norm != nil {
+		length = bm25FieldLength(norm.Value)
+	}
+
+	lengthNorm := 1.0
+	if avgLength > 0 {
+		lengthNorm = 1.0 - s.b + s.b*length/avgLength
+	}
+
+	tfNorm := freq * (s.k1 + 1.0) / (freq + s.k1*lengthNorm)
+
+	e.Children = []*search.Explanation{
+		{
+			Value: tfNorm,
+			Message: fmt.Sprintf("tfNorm(freq=%v, k1=%v, b=%v,"+
+				" fieldLength=%v, avgFieldLength=%v)",
+				freq, s.k1, s.b, length, avgLength),
+		},
+		{
+			Value: bm25IDF(docFreq, docTotal),
+			Message: fmt.Sprintf("idf(docFreq=%d, maxDocs=%d)",
+				docFreq, docTotal),
+		},
+	}
+	e.Message = strings.Replace(e.Message, "fieldWeight(", "bm25(", 1)
+	e.Value = e.Children[0].Value * e.Children[1].Value
+
+	return e.Value
+}
+
+// rescore recomputes the value of an explanation tree with BM25,
+// returning the new value.  The queryWeight of each term is left as
+// just its boost, as BM25 doesn't normalize the query.
+func (s *bm25Scorer) rescore(e *search.Explanation, parentMsg string) float64 {
+	if strings.HasPrefix(e.Message, "fieldWeight(") {
+		t, _, ok := globalIDFTermFromMessage(e.Message)
+		if ok {
+			return s.fieldWeight(e, t)
+		}
+		return e.Value
+	}
+
+	if len(e.Children) <= 0 {
+		if strings.HasPrefix(parentMsg, "queryWeight(") &&
+			(strings.HasPrefix(e.Message, "idf(") || e.Message == "queryNorm") {
+			e.Value = 1.0
+		}
+		return e.Value
+	}
+
+	var product, sum float64 = 1.0, 0.0
+	for _, c := range e.Children {
+		if c == nil {
+			continue
+		}
+		v := s.rescore(c, e.Message)
+		product = product * v
+		sum = sum + v
+	}
+
+	if strings.HasSuffix(e.Message, "product of:") {
+		e.Value = product
+	} else if strings.HasSuffix(e.Message, "sum of:") {
+		e.Value = sum
+	}
+
+	return e.Value
+}
+
+// bm25Scoring rescores the hits of a search result, which must have
+// explanations, with BM25, and then reorders the hits.  The average
+// field lengths are estimated from the hits when avgLengths is nil.
+// When there are targets, the doc frequencies of the terms are the
+// global stats from the targets.
+func bm25Scoring(sr *bleve.SearchResult, sim *BleveSimilarity,
+	avgLengths map[string]float64, targets []bleve.Index, explain bool,
+	sortHits func(search.DocumentMatchCollection)) error {
+	if avgLengths == nil {
+		avgLengths = bm25AvgFieldLengths(sr.Hits)
+	}
+	s := &bm25Scorer{
+		k1:         sim.k1(),
+		b:          sim.b(),
+		avgLengths: map[string]float64{},
+	}
+	for field, n := range avgLengths {
+		s.avgLengths[field] = n
+	}
+	for field, n := range sim.AvgFieldLengths {
+		s.avgLengths[field] = n
+	}
+
+	if len(targets) > 0 {
+		terms := map[globalIDFTerm]float64{}
+		for _, hit := range sr.Hits {
+			globalIDFTerms(hit.Expl, terms)
+		}
+
+		var err error
+		s.docTotal, s.docFreqs, err = globalIDFStats(targets, terms)
+		if err != nil {
+			return err
+		}
+	}
+
+	sr.MaxScore = 0
+	for _, hit := range sr.Hits {
+		if hit.Expl != nil {
+			hit.Score = s.rescore(hit.Expl, "")
+		}
+		if hit.Score > sr.MaxScore {
+			sr.MaxScore = hit.Score
+		}
+		if !explain {
+			hit.Expl = nil
+		}
+	}
+
+	sortHits(sr.Hits)
+
+	return nil
+}
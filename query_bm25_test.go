@@ -0,0 +1,189 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"math"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestValidateBleveSimilarity(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		s      *BleveSimilarity
+		expErr bool
+	}{
+		{nil, false},
+		{&BleveSimilarity{}, false},
+		{&BleveSimilarity{Model: "tfidf"}, false},
+		{&BleveSimilarity{Model: "BM25"}, false},
+		{&BleveSimilarity{Model: "bm25", K1: f(0), B: f(1)}, false},
+		{&BleveSimilarity{Model: "bm25",
+			AvgFieldLengths: map[string]float64{"title": 6.5}}, false},
+		{&BleveSimilarity{Model: "dfr"}, true},
+		{&BleveSimilarity{Model: "tfidf", K1: f(1.2)}, true},
+		{&BleveSimilarity{Model: "bm25", K1: f(-1)}, true},
+		{&BleveSimilarity{Model: "bm25", B: f(1.5)}, true},
+		{&BleveSimilarity{Model: "bm25",
+			AvgFieldLengths: map[string]float64{"title": 0}}, true},
+	}
+
+	for i, test := range tests {
+		err := validateBleveSimilarity(test.s)
+		if (err != nil) != test.expErr {
+			t.Errorf("%d: expErr: %v, got err: %v", i, test.expErr, err)
+		}
+	}
+}
+
+func TestBM25Scoring(t *testing.T) {
+	index, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index.Index("d1", map[string]interface{}{"title": "beer"})
+	index.Index("d2", map[string]interface{}{"title": "beer beer"})
+	index.Index("d3", map[string]interface{}{"title": "wine"})
+	index.Index("d4", map[string]interface{}{"title": "beer wine ale cider"})
+
+	sortHits := func(hits search.DocumentMatchCollection) {
+		QueryMergeByScore(nil, "_id", hits)
+	}
+
+	doSearch := func() *bleve.SearchResult {
+		q := bleve.NewMatchQuery("beer")
+		q.SetField("title")
+		sr, err := index.Search(bleve.NewSearchRequestOptions(q, 10, 0, true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sr
+	}
+
+	sr := doSearch()
+	err = bm25Scoring(sr, &BleveSimilarity{Model: "bm25"}, nil, nil, true,
+		sortHits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The freqs and lengths of the "beer" term of the hits, where the
+	// average length of the hits is (1 + 2 + 4) / 3.
+	idf := math.Log(1.0 + (4.0-3.0+0.5)/(3.0+0.5))
+	avgLength := 7.0 / 3.0
+	exp := map[string]float64{}
+	for id, fl := range map[string][2]float64{
+		"d1": {1, 1}, "d2": {2, 2}, "d4": {1, 4},
+	} {
+		freq, length := fl[0], fl[1]
+		exp[id] = idf * freq * (BM25_DEFAULT_K1 + 1.0) /
+			(freq + BM25_DEFAULT_K1*(1.0-BM25_DEFAULT_B+
+				BM25_DEFAULT_B*length/avgLength))
+	}
+
+	if len(sr.Hits) != 3 {
+		t.Fatalf("expected 3 hits, got: %d", len(sr.Hits))
+	}
+	for _, hit := range sr.Hits {
+		if math.Abs(hit.Score-exp[hit.ID]) > 1e-4 {
+			t.Errorf("hit: %s, expected score: %f, got: %f",
+				hit.ID, exp[hit.ID], hit.Score)
+		}
+		if hit.Expl == nil || math.Abs(hit.Expl.Value-hit.Score) > 1e-9 {
+			t.Errorf("hit: %s, expected explanation of score", hit.ID)
+		}
+	}
+	if sr.Hits[0].ID != "d2" || sr.Hits[2].ID != "d4" {
+		t.Errorf("unexpected order: %s, %s, %s",
+			sr.Hits[0].ID, sr.Hits[1].ID, sr.Hits[2].ID)
+	}
+	if sr.MaxScore != sr.Hits[0].Score {
+		t.Errorf("expected MaxScore of first hit")
+	}
+
+	// With k1 of 0, the term freqs and lengths don't matter.
+	k1 := 0.0
+	sr = doSearch()
+	err = bm25Scoring(sr, &BleveSimilarity{Model: "bm25", K1: &k1}, nil, nil,
+		false, sortHits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hit := range sr.Hits {
+		if math.Abs(hit.Score-idf) > 1e-9 || hit.Expl != nil {
+			t.Errorf("hit: %s, expected score: %f, got: %f, expl: %v",
+				hit.ID, idf, hit.Score, hit.Expl)
+		}
+	}
+}
+
+func TestBM25TermFreq(t *testing.T) {
+	n := bm25TermFreq(&search.Explanation{
+		Value: 1.732051, Message: "tf(termFreq(title:beer)=3"})
+	if n != 3 {
+		t.Errorf("expected 3, got: %f", n)
+	}
+
+	n = bm25TermFreq(&search.Explanation{Value: 2, Message: "tf"})
+	if n != 4 {
+		t.Errorf("expected 4 from the tf value, got: %f", n)
+	}
+}
+
+func TestBM25IndexAvgFieldLengths(t *testing.T) {
+	defer func() {
+		bm25IndexFieldStats = map[string]*bm25FieldStats{}
+	}()
+
+	hit := func(length float64) search.DocumentMatchCollection {
+		return search.DocumentMatchCollection{&search.DocumentMatch{
+			Expl: &search.Explanation{
+				Message: "fieldWeight(title:beer in d), product of:",
+				Children: []*search.Explanation{{
+					Value:   1 / math.Sqrt(length),
+					Message: "fieldNorm(field=title, doc=d)",
+				}},
+			},
+		}}
+	}
+
+	indexDefs := cbgt.NewIndexDefs(cbgt.VERSION)
+	indexDefs.IndexDefs["i"] = &cbgt.IndexDef{Name: "i", UUID: "u1"}
+
+	// The stats accumulate across the hits of the queries.
+	bm25IndexAvgFieldLengths(indexDefs, "i", hit(2))
+	avg := bm25IndexAvgFieldLengths(indexDefs, "i", hit(4))
+	if math.Abs(avg["title"]-3) > 1e-9 {
+		t.Errorf("expected avg of 3, got: %v", avg)
+	}
+
+	// A recreated index starts over.
+	indexDefs.IndexDefs["i"] = &cbgt.IndexDef{Name: "i", UUID: "u2"}
+	avg = bm25IndexAvgFieldLengths(indexDefs, "i", hit(8))
+	if math.Abs(avg["title"]-8) > 1e-9 {
+		t.Errorf("expected avg of 8, got: %v", avg)
+	}
+
+	// A deleted index's stats are dropped.
+	delete(indexDefs.IndexDefs, "i")
+	bm25IndexAvgFieldLengths(indexDefs, "j", nil)
+	if bm25IndexFieldStats["i"] != nil {
+		t.Errorf("expected the stats of the deleted index to be dropped")
+	}
+}
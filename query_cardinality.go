@@ -0,0 +1,239 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+// A facet of a query request with "cardinality": true is a distinct
+// count facet, like...
+//
+//   {"query": {...},
+//    "facets": {"sellers": {"field": "seller", "cardinality": true}}}
+//
+// which returns the approximate number of distinct terms of the field
+// in the matching docs, as the "cardinalities" of the result.
+//
+// Each pindex computes a HyperLogLog sketch of the field's terms, and
+// returns the sketch's registers as the terms of the facet, like
+// "REGISTER:RANK", so that the facets of the pindexes can be merged
+// as usual, and the merged sketch is the max rank of each register.
+// With 2^12 registers, the standard error is about 1.6%.
+
+// The prefix of the names of the facets that compute cardinalities.
+const QUERY_CARDINALITY_FACET_PREFIX = "_cardinality_"
+
+// The prefix of the field of a facet result that holds a sketch.
+const QUERY_CARDINALITY_SKETCH_PREFIX = "hll:"
+
+// The number of bits of the register index of the sketches.
+const QUERY_CARDINALITY_PRECISION = 12
+
+// QueryCardinalityResult holds the approximate number of distinct
+// terms of a field in the matching docs.
+type QueryCardinalityResult struct {
+	Field       string `json:"field"`
+	Cardinality uint64 `json:"cardinality"`
+}
+
+type queryCardinalityParams struct {
+	Facets map[string]*struct {
+		Field       string `json:"field"`
+		Cardinality bool   `json:"cardinality"`
+	} `json:"facets"`
+}
+
+// queryCardinalityFacets returns the fields of the cardinality facets
+// of a query request, keyed by facet name.
+func queryCardinalityFacets(req []byte) (map[string]string, error) {
+	var p queryCardinalityParams
+	err := json.Unmarshal(req, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv map[string]string
+	for name, f := range p.Facets {
+		if f == nil || !f.Cardinality {
+			continue
+		}
+		if f.Field == "" {
+			return nil, fmt.Errorf("query_cardinality: facet: %s"+
+				" needs a field", name)
+		}
+		if rv == nil {
+			rv = map[string]string{}
+		}
+		rv[name] = f.Field
+	}
+	return rv, nil
+}
+
+// queryCardinalityGatherRequest returns the search request to gather
+// with, where each cardinality facet is replaced by an internal terms
+// facet on the field.
+func queryCardinalityGatherRequest(req *bleve.SearchRequest,
+	cardinalities map[string]string) *bleve.SearchRequest {
+	if len(cardinalities) <= 0 {
+		return req
+	}
+
+	r := *req
+	r.Facets = bleve.FacetsRequest{}
+	for name, fr := range req.Facets {
+		if _, exists := cardinalities[name]; !exists {
+			r.Facets[name] = fr
+		}
+	}
+	for name, field := range cardinalities {
+		// Every term is needed for the sketch.
+		r.Facets[QUERY_CARDINALITY_FACET_PREFIX+name] =
+			bleve.NewFacetRequest(field, math.MaxInt32)
+	}
+
+	return &r
+}
+
+// queryCardinalitySketches replaces the terms of the internal
+// cardinality facets of a pindex's search result with the registers
+// of their sketches, unless that was already done.
+func queryCardinalitySketches(sr *bleve.SearchResult) {
+	if sr == nil {
+		return
+	}
+
+	for name, fr := range sr.Facets {
+		if fr == nil ||
+			!strings.HasPrefix(name, QUERY_CARDINALITY_FACET_PREFIX) ||
+			strings.HasPrefix(fr.Field, QUERY_CARDINALITY_SKETCH_PREFIX) {
+			continue
+		}
+
+		registers := make([]uint8, 1<<QUERY_CARDINALITY_PRECISION)
+		for _, tf := range fr.Terms {
+			hllAdd(registers, tf.Term)
+		}
+
+		fr.Field = QUERY_CARDINALITY_SKETCH_PREFIX + fr.Field
+		fr.Terms = nil
+		for i, rank := range registers {
+			if rank > 0 {
+				fr.Terms = append(fr.Terms, &search.TermFacet{
+					Term:  strconv.Itoa(i) + ":" + strconv.Itoa(int(rank)),
+					Count: 1,
+				})
+			}
+		}
+	}
+}
+
+// queryCardinalityResults estimates the cardinalities from the merged
+// sketches of a gathered search result, removing the internal facets
+// from the result.
+func queryCardinalityResults(sr *bleve.SearchResult,
+	cardinalities map[string]string) map[string]*QueryCardinalityResult {
+	if len(cardinalities) <= 0 {
+		return nil
+	}
+
+	rv := map[string]*QueryCardinalityResult{}
+	for name, field := range cardinalities {
+		facetName := QUERY_CARDINALITY_FACET_PREFIX + name
+
+		registers := make([]uint8, 1<<QUERY_CARDINALITY_PRECISION)
+		if fr := sr.Facets[facetName]; fr != nil {
+			for _, tf := range fr.Terms {
+				parts := strings.Split(tf.Term, ":")
+				if len(parts) != 2 {
+					continue
+				}
+				i, err := strconv.Atoi(parts[0])
+				if err != nil || i < 0 || i >= len(registers) {
+					continue
+				}
+				rank, err := strconv.Atoi(parts[1])
+				if err == nil && uint8(rank) > registers[i] {
+					registers[i] = uint8(rank)
+				}
+			}
+		}
+
+		rv[name] = &QueryCardinalityResult{
+			Field:       field,
+			Cardinality: hllEstimate(registers),
+		}
+
+		delete(sr.Facets, facetName)
+	}
+	return rv
+}
+
+// hllAdd adds a term to the registers of a HyperLogLog sketch.
+func hllAdd(registers []uint8, term string) {
+	h := fnv.New64a()
+	h.Write([]byte(term))
+	x := h.Sum64()
+
+	// Mix the bits, as the high bits of FNV hashes of similar short
+	// terms are poorly distributed (the finalizer of murmur3).
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	i := x >> (64 - QUERY_CARDINALITY_PRECISION)
+
+	// The rank is the position of the leftmost 1 bit of the rest.
+	rank := uint8(1)
+	for w := x << QUERY_CARDINALITY_PRECISION; rank <=
+		64-QUERY_CARDINALITY_PRECISION && w&(1<<63) == 0; w = w << 1 {
+		rank++
+	}
+
+	if rank > registers[i] {
+		registers[i] = rank
+	}
+}
+
+// hllEstimate returns the estimated cardinality of a HyperLogLog
+// sketch, using linear counting for small cardinalities.
+func hllEstimate(registers []uint8) uint64 {
+	m := float64(len(registers))
+
+	sum := 0.0
+	zeros := 0
+	for _, rank := range registers {
+		sum += 1.0 / float64(uint64(1)<<rank)
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1.0 + 1.079/m)
+	estimate := alpha * m * m / sum
+
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
@@ -0,0 +1,102 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+func TestQueryCardinalityFacets(t *testing.T) {
+	c, err := queryCardinalityFacets([]byte(`{"facets":{` +
+		`"sellers":{"field":"seller","cardinality":true},` +
+		`"types":{"field":"type","size":3}}}`))
+	if err != nil || len(c) != 1 || c["sellers"] != "seller" {
+		t.Errorf("unexpected cardinalities: %#v, err: %v", c, err)
+	}
+
+	_, err = queryCardinalityFacets([]byte(`{"facets":{` +
+		`"x":{"cardinality":true}}}`))
+	if err == nil {
+		t.Errorf("expected err on a cardinality facet without a field")
+	}
+}
+
+func TestHLLEstimate(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 100000} {
+		registers := make([]uint8, 1<<QUERY_CARDINALITY_PRECISION)
+		for i := 0; i < n; i++ {
+			hllAdd(registers, fmt.Sprintf("term-%d", i))
+			hllAdd(registers, fmt.Sprintf("term-%d", i)) // Duplicate.
+		}
+
+		est := float64(hllEstimate(registers))
+		if math.Abs(est-float64(n)) > 0.05*float64(n)+1 {
+			t.Errorf("n: %d, estimate: %f", n, est)
+		}
+	}
+}
+
+func TestQueryCardinalityGather(t *testing.T) {
+	// The sellers of the two indexes overlap, so the distinct count
+	// isn't the sum of the distinct counts of the indexes.
+	a, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1500; i++ {
+		a.Index(fmt.Sprintf("a%d", i),
+			map[string]interface{}{"seller": fmt.Sprintf("s%d", i%1000)})
+		b.Index(fmt.Sprintf("b%d", i),
+			map[string]interface{}{"seller": fmt.Sprintf("s%d", 500+i%1000)})
+	}
+
+	cardinalities := map[string]string{"sellers": "seller"}
+
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	req.AddFacet("sellers", bleve.NewFacetRequest("seller", 10))
+
+	gatherRequest := queryCardinalityGatherRequest(req, cardinalities)
+	if len(gatherRequest.Facets) != 1 ||
+		gatherRequest.Facets[QUERY_CARDINALITY_FACET_PREFIX+"sellers"] == nil {
+		t.Fatalf("expected only the internal facet, got: %#v",
+			gatherRequest.Facets)
+	}
+
+	sr, _, err := queryGather([]bleve.Index{a, b}, []string{"a", "b"},
+		gatherRequest, make(chan bool),
+		func(hits search.DocumentMatchCollection) {
+			QueryMergeByScore(req, "_id", hits)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := queryCardinalityResults(sr, cardinalities)
+
+	r := results["sellers"]
+	if r == nil || r.Field != "seller" ||
+		math.Abs(float64(r.Cardinality)-1500) > 0.05*1500 {
+		t.Errorf("unexpected result: %#v", r)
+	}
+	if len(sr.Facets) != 0 {
+		t.Errorf("expected the internal facet to be removed")
+	}
+}
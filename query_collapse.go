@@ -0,0 +1,304 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+// A query request may collapse its hits on the value of a field, like...
+//
+//   {"query": {...},
+//    "collapse": {"field": "productGroupId",
+//                 "window": 500,         // Optional.
+//                 "groupCount": true}}   // Optional, default true.
+//
+// which returns only the best hit of each group of hits that have the
+// same field value, along with the number of matching docs in the
+// group, as the "collapse" of the result.  The field must be a stored
+// field, indexed with the keyword analyzer or as a number, and a hit
+// with more than one value is grouped by its first value.  Hits
+// without a value aren't collapsed.
+//
+// As the docs of a group may be in any partition, the collapsing is of
+// the merged hits of all the pindexes, where a window of the top hits
+// is gathered, which is by default QUERY_COLLAPSE_WINDOW_FACTOR times
+// from+size hits.  The group counts are summed across the pindexes.
+// The total, facets and aggregations of the result are still of all
+// the matching docs.
+
+// The default window of a collapse is this many times from+size.
+const QUERY_COLLAPSE_WINDOW_FACTOR = 4
+
+// The max window of a collapse.
+const QUERY_COLLAPSE_WINDOW_MAX = 10000
+
+type queryCollapse struct {
+	Field      string `json:"field"`
+	Window     int    `json:"window"`
+	GroupCount *bool  `json:"groupCount"`
+}
+
+// QueryCollapseResult holds the groups of the hits of a collapsed
+// query, keyed by the ID of each group's hit.
+type QueryCollapseResult struct {
+	Field  string                         `json:"field"`
+	Groups map[string]*QueryCollapseGroup `json:"groups"`
+}
+
+// QueryCollapseGroup is the group of a hit of a collapsed query.
+type QueryCollapseGroup struct {
+	Value interface{} `json:"value"`
+	Count uint64      `json:"count,omitempty"`
+}
+
+// queryCollapseParams returns the collapse of a query request, or nil.
+func queryCollapseParams(req []byte) (*queryCollapse, error) {
+	var p struct {
+		Collapse *queryCollapse `json:"collapse"`
+	}
+	err := json.Unmarshal(req, &p)
+	if err != nil {
+		return nil, err
+	}
+	c := p.Collapse
+	if c == nil {
+		return nil, nil
+	}
+	if c.Field == "" {
+		return nil, fmt.Errorf("query_collapse: collapse needs a field")
+	}
+	if c.Window < 0 || c.Window > QUERY_COLLAPSE_WINDOW_MAX {
+		return nil, fmt.Errorf("query_collapse: window must be"+
+			" between 0 and %d", QUERY_COLLAPSE_WINDOW_MAX)
+	}
+	return c, nil
+}
+
+func (c *queryCollapse) groupCount() bool {
+	return c.GroupCount == nil || *c.GroupCount
+}
+
+// gatherRequest returns the search request to gather, which loads the
+// collapse field, and whose window of hits is collapsed.
+func (c *queryCollapse) gatherRequest(req *bleve.SearchRequest) *bleve.SearchRequest {
+	r := *req
+
+	if !queryFieldsMatch(c.Field, req.Fields) {
+		r.Fields = append(append([]string(nil), req.Fields...), c.Field)
+	}
+
+	n := req.From + req.Size
+	r.From = 0
+	r.Size = n * QUERY_COLLAPSE_WINDOW_FACTOR
+	if c.Window > 0 {
+		r.Size = c.Window
+	}
+	if r.Size > QUERY_COLLAPSE_WINDOW_MAX {
+		r.Size = QUERY_COLLAPSE_WINDOW_MAX
+	}
+	if r.Size < n {
+		r.Size = n
+	}
+
+	return &r
+}
+
+// queryCollapseValue returns the first value of a hit's field, and a
+// key for grouping the value.
+func queryCollapseValue(hit *search.DocumentMatch, field string) (
+	interface{}, string, bool) {
+	v := hit.Fields[field]
+	if vs, ok := v.([]interface{}); ok {
+		if len(vs) <= 0 {
+			return nil, "", false
+		}
+		v = vs[0]
+	}
+
+	switch x := v.(type) {
+	case string:
+		return x, "s:" + x, true
+	case float64:
+		return x, "n:" + strconv.FormatFloat(x, 'g', -1, 64), true
+	}
+	return nil, "", false
+}
+
+// collapse keeps only the first hit of each group of the sorted hits
+// of a search result.
+func (c *queryCollapse) collapse(sr *bleve.SearchResult) {
+	seen := map[string]bool{}
+	hits := sr.Hits[:0]
+	for _, hit := range sr.Hits {
+		if _, key, ok := queryCollapseValue(hit, c.Field); ok {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		hits = append(hits, hit)
+	}
+	sr.Hits = hits
+}
+
+// result returns the groups of the collapsed hits.
+func (c *queryCollapse) result(
+	hits search.DocumentMatchCollection) *QueryCollapseResult {
+	rv := &QueryCollapseResult{
+		Field:  c.Field,
+		Groups: map[string]*QueryCollapseGroup{},
+	}
+	for _, hit := range hits {
+		if v, _, ok := queryCollapseValue(hit, c.Field); ok {
+			rv.Groups[hit.ID] = &QueryCollapseGroup{Value: v}
+		}
+	}
+	return rv
+}
+
+// warning returns a warning when the collapsed hits of a full window
+// don't fill the requested page, as more groups may be beyond the
+// window.
+func (c *queryCollapse) warning(sr *bleve.SearchResult, window int,
+	req *bleve.SearchRequest) string {
+	if sr.Total <= uint64(window) || len(sr.Hits) >= req.From+req.Size {
+		return ""
+	}
+	return fmt.Sprintf("collapse: only %d groups were found in the top"+
+		" %d hits, so there may be more groups; please use a larger"+
+		" collapse window", len(sr.Hits), window)
+}
+
+// queryCollapseCountQuery returns the query of the matching docs of a
+// group.
+func queryCollapseCountQuery(query json.RawMessage, field string,
+	value interface{}) ([]byte, error) {
+	var groupQuery map[string]interface{}
+	switch x := value.(type) {
+	case string:
+		groupQuery = map[string]interface{}{"term": x, "field": field}
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return nil, fmt.Errorf("query_collapse: bad value: %v", x)
+		}
+		groupQuery = map[string]interface{}{
+			"min": x, "inclusive_min": true,
+			"max": x, "inclusive_max": true,
+			"field": field,
+		}
+	default:
+		return nil, fmt.Errorf("query_collapse: bad value: %v", value)
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"conjuncts": []interface{}{query, groupQuery},
+	})
+}
+
+// groupCounts sets the number of docs that match the query in each
+// group, summed across the targets.
+func (c *queryCollapse) groupCounts(req []byte, cr *QueryCollapseResult,
+	targets []bleve.Index) error {
+	if !c.groupCount() || len(cr.Groups) <= 0 {
+		return nil
+	}
+
+	values := map[string]interface{}{}
+	for id, g := range cr.Groups {
+		values[id] = g.Value
+	}
+
+	counts, err := queryFieldValueCounts(req, c.Field, values, targets)
+	if err != nil {
+		return err
+	}
+	for id, n := range counts {
+		cr.Groups[id].Count = n
+	}
+
+	return nil
+}
+
+// queryFieldValueCounts returns the number of docs that match the
+// query of a request and have a field value, summed across the
+// targets, for each of the keyed values.
+func queryFieldValueCounts(req []byte, field string,
+	values map[string]interface{}, targets []bleve.Index) (
+	map[string]uint64, error) {
+	var r struct {
+		Query json.RawMessage `json:"query"`
+	}
+	err := json.Unmarshal(req, &r)
+	if err != nil {
+		return nil, err
+	}
+
+	queries := map[string]bleve.Query{}
+	for key, value := range values {
+		qBytes, err := queryCollapseCountQuery(r.Query, field, value)
+		if err != nil {
+			return nil, err
+		}
+		q, err := bleve.ParseQuery(qBytes)
+		if err != nil {
+			return nil, fmt.Errorf("query_collapse: count query, err: %v", err)
+		}
+		queries[key] = q
+	}
+
+	type counts struct {
+		counts map[string]uint64
+		err    error
+	}
+
+	countsCh := make(chan *counts, len(targets))
+
+	for _, target := range targets {
+		go func(target bleve.Index) {
+			s := &counts{counts: map[string]uint64{}}
+			for key, q := range queries {
+				var sr *bleve.SearchResult
+				sr, s.err = target.Search(
+					bleve.NewSearchRequestOptions(q, 0, 0, false))
+				if s.err != nil {
+					break
+				}
+				s.counts[key] = sr.Total
+			}
+			countsCh <- s
+		}(target)
+	}
+
+	rv := map[string]uint64{}
+	for range targets {
+		s := <-countsCh
+		if s.err != nil {
+			err = s.err
+			continue
+		}
+		for key, n := range s.counts {
+			rv[key] += n
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query_collapse: counts, err: %v", err)
+	}
+
+	return rv, nil
+}
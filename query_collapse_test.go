@@ -0,0 +1,202 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+func TestQueryCollapseParams(t *testing.T) {
+	c, err := queryCollapseParams([]byte(`{"query":{}}`))
+	if err != nil || c != nil {
+		t.Errorf("expected no collapse, got: %#v, err: %v", c, err)
+	}
+
+	c, err = queryCollapseParams([]byte(`{"collapse":{"field":"g"}}`))
+	if err != nil || c == nil || c.Field != "g" || !c.groupCount() {
+		t.Errorf("expected collapse, got: %#v, err: %v", c, err)
+	}
+
+	c, err = queryCollapseParams(
+		[]byte(`{"collapse":{"field":"g","groupCount":false}}`))
+	if err != nil || c == nil || c.groupCount() {
+		t.Errorf("expected no group count, got: %#v, err: %v", c, err)
+	}
+
+	for _, req := range []string{
+		`{"collapse":{}}`,
+		`{"collapse":{"field":"g","window":-1}}`,
+		`{"collapse":{"field":"g","window":1000000}}`,
+	} {
+		_, err = queryCollapseParams([]byte(req))
+		if err == nil {
+			t.Errorf("expected err, req: %s", req)
+		}
+	}
+}
+
+func TestQueryCollapseGatherRequest(t *testing.T) {
+	req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 10, 20, false)
+	req.Fields = []string{"title"}
+
+	c := &queryCollapse{Field: "g"}
+	r := c.gatherRequest(req)
+	if r.From != 0 || r.Size != 30*QUERY_COLLAPSE_WINDOW_FACTOR ||
+		len(r.Fields) != 2 || r.Fields[1] != "g" || len(req.Fields) != 1 {
+		t.Errorf("unexpected gather request: %#v", r)
+	}
+
+	c = &queryCollapse{Field: "title", Window: 5}
+	r = c.gatherRequest(req)
+	if r.Size != 30 || len(r.Fields) != 1 {
+		t.Errorf("expected the window to be at least from+size, got: %#v", r)
+	}
+
+	req.Size = QUERY_COLLAPSE_WINDOW_MAX
+	r = c.gatherRequest(req)
+	if r.Size != QUERY_COLLAPSE_WINDOW_MAX+20 {
+		t.Errorf("expected from+size, got: %d", r.Size)
+	}
+}
+
+func TestQueryCollapse(t *testing.T) {
+	sr := &bleve.SearchResult{
+		Total: 100,
+		Hits: search.DocumentMatchCollection{
+			&search.DocumentMatch{ID: "a", Fields: map[string]interface{}{"g": "x"}},
+			&search.DocumentMatch{ID: "b", Fields: map[string]interface{}{"g": []interface{}{"x", "y"}}},
+			&search.DocumentMatch{ID: "c", Fields: map[string]interface{}{}},
+			&search.DocumentMatch{ID: "d", Fields: map[string]interface{}{"g": 1.0}},
+			&search.DocumentMatch{ID: "e", Fields: map[string]interface{}{"g": "y"}},
+			&search.DocumentMatch{ID: "f", Fields: map[string]interface{}{"g": 1.0}},
+			&search.DocumentMatch{ID: "g", Fields: map[string]interface{}{}},
+		},
+	}
+
+	c := &queryCollapse{Field: "g"}
+	c.collapse(sr)
+
+	ids := ""
+	for _, hit := range sr.Hits {
+		ids += hit.ID
+	}
+	if ids != "acdeg" {
+		t.Errorf("unexpected collapsed hits: %s", ids)
+	}
+
+	cr := c.result(sr.Hits)
+	if len(cr.Groups) != 3 || cr.Groups["a"].Value != "x" ||
+		cr.Groups["d"].Value != 1.0 || cr.Groups["e"].Value != "y" {
+		t.Errorf("unexpected groups: %#v", cr.Groups)
+	}
+
+	req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 10, 0, false)
+	if c.warning(sr, 20, req) == "" {
+		t.Errorf("expected a warning for a full window")
+	}
+	if c.warning(sr, 200, req) != "" {
+		t.Errorf("expected no warning when the window had every hit")
+	}
+	req.Size = 5
+	if c.warning(sr, 20, req) != "" {
+		t.Errorf("expected no warning when the page is full")
+	}
+}
+
+func TestQueryCollapseGroupCounts(t *testing.T) {
+	a, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		a.Index(fmt.Sprintf("a%d", i), map[string]interface{}{
+			"g": fmt.Sprintf("g%d", i%3), "n": float64(i % 2)})
+		b.Index(fmt.Sprintf("b%d", i), map[string]interface{}{
+			"g": fmt.Sprintf("g%d", i%3), "n": float64(i % 2)})
+	}
+	a.Index("z0", map[string]interface{}{"desc": "none"})
+
+	targets := []bleve.Index{a, b}
+	names := []string{"a", "b"}
+	reqJSON := []byte(`{"query":{"match_all":{}},"size":2,` +
+		`"collapse":{"field":"g","window":20}}`)
+
+	c, err := queryCollapseParams(reqJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 2, 0, false)
+	sortHits := func(hits search.DocumentMatchCollection) {
+		QueryMergeByScore(req, "_id", hits)
+	}
+
+	gatherRequest := c.gatherRequest(req)
+	sr, _, err := queryGather(targets, names, gatherRequest,
+		make(chan bool), sortHits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.collapse(sr)
+	if len(sr.Hits) != 4 {
+		t.Fatalf("expected 3 groups and a hit without a group, got: %d",
+			len(sr.Hits))
+	}
+	searchResultPage(sr, req)
+
+	cr := c.result(sr.Hits)
+	err = c.groupCounts(reqJSON, cr, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cr.Groups) != 2 {
+		t.Fatalf("expected 2 groups, got: %#v", cr.Groups)
+	}
+	for id, g := range cr.Groups {
+		if g.Count != 4 {
+			t.Errorf("expected 4 docs across the pindexes, hit: %s,"+
+				" group: %#v", id, g)
+		}
+	}
+
+	c = &queryCollapse{Field: "n"}
+	cr = &QueryCollapseResult{Field: "n", Groups: map[string]*QueryCollapseGroup{
+		"a1": {Value: 1.0},
+	}}
+	err = c.groupCounts(reqJSON, cr, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Groups["a1"].Count != 6 {
+		t.Errorf("expected 6 docs with a numeric value, got: %d",
+			cr.Groups["a1"].Count)
+	}
+
+	c = &queryCollapse{Field: "g", GroupCount: new(bool)}
+	cr = &QueryCollapseResult{Field: "g", Groups: map[string]*QueryCollapseGroup{
+		"a1": {Value: "g1"},
+	}}
+	err = c.groupCounts(reqJSON, cr, targets)
+	if err != nil || cr.Groups["a1"].Count != 0 {
+		t.Errorf("expected no group count, got: %#v, err: %v",
+			cr.Groups["a1"], err)
+	}
+}
@@ -0,0 +1,154 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/blevesearch/bleve"
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// A query with a size of 0 and without facets only needs the total
+// number of matching docs, so the pindexes are searched without hit
+// collection, highlighting or stored field loading.  The count of a
+// query can also be requested with a POST to
+// /api/index/{indexName}/count, whose body is a query request, and
+// which returns just the count.
+
+// queryCountOnlyRequest returns the search request to gather a
+// count-only search request with, or nil if the search request isn't
+// count-only.
+func queryCountOnlyRequest(req *bleve.SearchRequest) *bleve.SearchRequest {
+	if req.Size != 0 || len(req.Facets) > 0 {
+		return nil
+	}
+
+	r := *req
+	r.From = 0
+	r.Highlight = nil
+	r.Fields = nil
+	r.Explain = false
+
+	return &r
+}
+
+// countOnlyQueryRequest rewrites a JSON query request into a
+// count-only query request.
+func countOnlyQueryRequest(req []byte) ([]byte, error) {
+	var m map[string]interface{}
+
+	d := json.NewDecoder(bytes.NewReader(req))
+	d.UseNumber()
+
+	err := d.Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, fmt.Errorf("query_count: request must be an object")
+	}
+
+	m["size"] = 0
+	m["from"] = 0
+	for _, k := range []string{"highlight", "fields", "facets", "explain",
+		"fetchFromKV"} {
+		delete(m, k)
+	}
+
+	return json.Marshal(m)
+}
+
+// QueryCountHandler is a REST handler that returns the number of docs
+// that match a query.
+type QueryCountHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewQueryCountHandler(mgr *cbgt.Manager) *QueryCountHandler {
+	return &QueryCountHandler{mgr: mgr}
+}
+
+func (h *QueryCountHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	_, indexDefsByName, err := h.mgr.GetIndexDefs(false)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("query_count: could not"+
+			" retrieve index defs, err: %v", err), 500)
+		return
+	}
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil {
+		rest.ShowError(w, req, fmt.Sprintf("query_count: not an index,"+
+			" indexName: %s", indexName), 400)
+		return
+	}
+
+	pindexImplType := cbgt.PIndexImplTypes[indexDef.Type]
+	if pindexImplType == nil || pindexImplType.Query == nil {
+		rest.ShowError(w, req, fmt.Sprintf("query_count: no query"+
+			" support, indexName: %s, indexType: %s",
+			indexName, indexDef.Type), 400)
+		return
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("query_count: could not"+
+			" read request body, err: %v", err), 400)
+		return
+	}
+
+	countRequest, err := countOnlyQueryRequest(requestBody)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("query_count: could not"+
+			" parse request body, err: %v", err), 400)
+		return
+	}
+
+	var res bytes.Buffer
+
+	err = pindexImplType.Query(h.mgr, indexName, indexDef.UUID,
+		countRequest, &res)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("query_count: query,"+
+			" indexName: %s, err: %v", indexName, err), 400)
+		return
+	}
+
+	var result struct {
+		TotalHits uint64 `json:"total_hits"`
+	}
+	err = json.Unmarshal(res.Bytes(), &result)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("query_count: could not"+
+			" parse query result, err: %v", err), 500)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+		Count  uint64 `json:"count"`
+	}{
+		Status: "ok",
+		Count:  result.TotalHits,
+	})
+}
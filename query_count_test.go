@@ -0,0 +1,72 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+func TestQueryCountOnlyRequest(t *testing.T) {
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	if queryCountOnlyRequest(req) != nil {
+		t.Errorf("expected a sized request to not be count-only")
+	}
+
+	req.Size = 0
+	req.Fields = []string{"title"}
+	req.Highlight = bleve.NewHighlight()
+	req.Explain = true
+
+	r := queryCountOnlyRequest(req)
+	if r == nil || r.Fields != nil || r.Highlight != nil || r.Explain {
+		t.Errorf("expected a stripped count-only request, got: %#v", r)
+	}
+	if req.Fields == nil || req.Highlight == nil {
+		t.Errorf("expected the original request to be unchanged")
+	}
+
+	req.AddFacet("types", bleve.NewFacetRequest("type", 3))
+	if queryCountOnlyRequest(req) != nil {
+		t.Errorf("expected a request with facets to not be count-only")
+	}
+}
+
+func TestCountOnlyQueryRequest(t *testing.T) {
+	buf, err := countOnlyQueryRequest([]byte(`{"query":{"match":"x"},` +
+		`"size":10,"from":20,"fields":["*"],"highlight":{},` +
+		`"facets":{},"explain":true,"ctl":{"timeout":1000}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m map[string]interface{}
+	json.Unmarshal(buf, &m)
+
+	exp := map[string]interface{}{
+		"query": map[string]interface{}{"match": "x"},
+		"size":  0.0,
+		"from":  0.0,
+		"ctl":   map[string]interface{}{"timeout": 1000.0},
+	}
+	if !reflect.DeepEqual(m, exp) {
+		t.Errorf("unexpected count request: %s", buf)
+	}
+
+	_, err = countOnlyQueryRequest([]byte(`[]`))
+	if err == nil {
+		t.Errorf("expected err on a non-object request")
+	}
+}
@@ -0,0 +1,293 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// A terms facet of a query request can be paged, like...
+//
+//   {"field": "category", "size": 20,
+//    "order": "term", "offset": 40, "after": "books"}
+//
+// where the order is either "count" (descending count, then term),
+// which is the default, or "term" (ascending term), where the offset
+// skips terms, and where the after skips the terms up to and including
+// the after term, as returned by the "next" of the previous page.
+// The paging of each paged facet is returned in the "facetPages" of
+// the result.
+//
+// The size of a facet is capped by QueryFacetSizeMax, which can be
+// changed with the facetSizeMax node option, where bigger sizes are
+// rejected with an error instead of being silently truncated.
+
+// A facet with "missing": true also has a bucket for the matching
+// docs that lack the faceted field, whose term (or range name) is
+// the facet's "missingTerm", which is "_missing" by default, and
+// which is appended after the facet's other terms or ranges.
+
+// The default term of the missing bucket of a facet.
+var QueryFacetMissingTerm = "_missing"
+
+// The default max size of a facet.
+var QueryFacetSizeMax = 1000
+
+// QueryFacetOptions are the paging options of a facet.
+type QueryFacetOptions struct {
+	Size   int    `json:"size"`
+	Order  string `json:"order"`
+	Offset int    `json:"offset"`
+	After  string `json:"after"`
+}
+
+// QueryFacetPage describes the page of terms of a paged facet.
+type QueryFacetPage struct {
+	Order  string `json:"order"`
+	Offset int    `json:"offset"`
+	After  string `json:"after,omitempty"`
+	Next   string `json:"next,omitempty"` // The after of the next page.
+}
+
+// queryFacetSizeMax returns the max size of a facet of a node.
+func queryFacetSizeMax(mgr *cbgt.Manager) int {
+	if mgr != nil {
+		v, err := strconv.Atoi(mgr.Options()["facetSizeMax"])
+		if err == nil && v > 0 {
+			return v
+		}
+	}
+	return QueryFacetSizeMax
+}
+
+// queryFacetOptions returns the options of the paged facets of a
+// query request, keyed by facet name.
+func queryFacetOptions(req []byte) (map[string]*QueryFacetOptions, error) {
+	var p struct {
+		Facets map[string]*QueryFacetOptions `json:"facets"`
+	}
+	err := json.Unmarshal(req, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv map[string]*QueryFacetOptions
+	for name, o := range p.Facets {
+		if o == nil || (o.Order == "" && o.Offset == 0 && o.After == "") {
+			continue
+		}
+		if o.Order == "" {
+			o.Order = "count"
+		}
+		if o.Order != "count" && o.Order != "term" {
+			return nil, fmt.Errorf("query_facets: facet: %s, unknown"+
+				" order: %q, must be \"count\" or \"term\"", name, o.Order)
+		}
+		if o.Offset < 0 {
+			return nil, fmt.Errorf("query_facets: facet: %s,"+
+				" offset must be >= 0", name)
+		}
+		if rv == nil {
+			rv = map[string]*QueryFacetOptions{}
+		}
+		rv[name] = o
+	}
+	return rv, nil
+}
+
+// checkQueryFacetSizes returns an error when a facet of a search
+// request is bigger than the max size.
+func checkQueryFacetSizes(req *bleve.SearchRequest, max int) error {
+	for name, fr := range req.Facets {
+		if fr != nil && fr.Size > max {
+			return fmt.Errorf("query_facets: facet: %s, size: %d is more"+
+				" than the max facet size: %d; please page through"+
+				" the facet's terms with an offset or after",
+				name, fr.Size, max)
+		}
+	}
+	return nil
+}
+
+// queryFacetsGatherRequest returns the search request to gather with,
+// whose paged facets ask for enough terms for their pages.
+func queryFacetsGatherRequest(req *bleve.SearchRequest,
+	opts map[string]*QueryFacetOptions) *bleve.SearchRequest {
+	if len(opts) <= 0 {
+		return req
+	}
+
+	r := *req
+	r.Facets = bleve.FacetsRequest{}
+	for name, fr := range req.Facets {
+		o := opts[name]
+		if o == nil || fr == nil {
+			r.Facets[name] = fr
+			continue
+		}
+
+		// Every term is needed, as the top terms of each pindex
+		// aren't necessarily the top terms of the merged facet.
+		frCopy := *fr
+		frCopy.Size = math.MaxInt32
+		r.Facets[name] = &frCopy
+	}
+
+	return &r
+}
+
+// queryFacetsPages replaces the terms of the paged facets of a
+// gathered search result with their pages.
+func queryFacetsPages(sr *bleve.SearchResult, req *bleve.SearchRequest,
+	opts map[string]*QueryFacetOptions) map[string]*QueryFacetPage {
+	if len(opts) <= 0 {
+		return nil
+	}
+
+	rv := map[string]*QueryFacetPage{}
+	for name, o := range opts {
+		fr := sr.Facets[name]
+		freq := req.Facets[name]
+		if fr == nil || freq == nil {
+			continue
+		}
+
+		terms := append(search.TermFacets(nil), fr.Terms...)
+		sort.Sort(&queryFacetTermsSorter{terms: terms, order: o.Order})
+
+		start := 0
+		if o.After != "" {
+			start = len(terms)
+			for i, tf := range terms {
+				if tf.Term == o.After {
+					start = i + 1
+					break
+				}
+				if o.Order == "term" && tf.Term > o.After {
+					start = i
+					break
+				}
+			}
+		}
+
+		start += o.Offset
+		if start > len(terms) {
+			start = len(terms)
+		}
+		end := start + freq.Size
+		if end > len(terms) {
+			end = len(terms)
+		}
+
+		page := &QueryFacetPage{
+			Order:  o.Order,
+			Offset: o.Offset,
+			After:  o.After,
+		}
+		if end < len(terms) && end > start {
+			page.Next = terms[end-1].Term
+		}
+		rv[name] = page
+
+		fr.Terms = terms[start:end]
+
+		sum := 0
+		for _, tf := range fr.Terms {
+			sum += tf.Count
+		}
+		fr.Other = fr.Total - fr.Missing - sum
+	}
+
+	return rv
+}
+
+type queryFacetTermsSorter struct {
+	terms search.TermFacets
+	order string
+}
+
+func (s *queryFacetTermsSorter) Len() int { return len(s.terms) }
+
+func (s *queryFacetTermsSorter) Swap(i, j int) {
+	s.terms[i], s.terms[j] = s.terms[j], s.terms[i]
+}
+
+func (s *queryFacetTermsSorter) Less(i, j int) bool {
+	if s.order == "count" && s.terms[i].Count != s.terms[j].Count {
+		return s.terms[i].Count > s.terms[j].Count
+	}
+	return s.terms[i].Term < s.terms[j].Term
+}
+
+// queryFacetMissing returns the terms of the missing buckets of the
+// facets of a query request, keyed by facet name.
+func queryFacetMissing(req []byte) (map[string]string, error) {
+	var p struct {
+		Facets map[string]*struct {
+			Missing     bool   `json:"missing"`
+			MissingTerm string `json:"missingTerm"`
+		} `json:"facets"`
+	}
+	err := json.Unmarshal(req, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv map[string]string
+	for name, f := range p.Facets {
+		if f == nil || !f.Missing {
+			continue
+		}
+		if rv == nil {
+			rv = map[string]string{}
+		}
+		rv[name] = f.MissingTerm
+		if rv[name] == "" {
+			rv[name] = QueryFacetMissingTerm
+		}
+	}
+	return rv, nil
+}
+
+// queryFacetsMissingBuckets appends the missing buckets to the facets
+// of a gathered search result.
+func queryFacetsMissingBuckets(sr *bleve.SearchResult,
+	req *bleve.SearchRequest, missing map[string]string) {
+	for name, term := range missing {
+		fr := sr.Facets[name]
+		freq := req.Facets[name]
+		if fr == nil || freq == nil {
+			continue
+		}
+
+		switch {
+		case len(freq.NumericRanges) > 0:
+			fr.NumericRanges = append(fr.NumericRanges,
+				&search.NumericRangeFacet{Name: term, Count: fr.Missing})
+		case len(freq.DateTimeRanges) > 0:
+			fr.DateRanges = append(fr.DateRanges,
+				&search.DateRangeFacet{Name: term, Count: fr.Missing})
+		default:
+			fr.Terms = append(fr.Terms,
+				&search.TermFacet{Term: term, Count: fr.Missing})
+		}
+	}
+}
@@ -0,0 +1,186 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+func TestQueryFacetOptions(t *testing.T) {
+	opts, err := queryFacetOptions([]byte(`{"facets":{` +
+		`"a":{"field":"a","size":3},` +
+		`"b":{"field":"b","size":3,"offset":3},` +
+		`"c":{"field":"c","size":3,"order":"term","after":"x"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts["a"] != nil || opts["b"].Order != "count" ||
+		opts["c"].Order != "term" || opts["c"].After != "x" {
+		t.Errorf("unexpected opts: %#v", opts)
+	}
+
+	_, err = queryFacetOptions([]byte(`{"facets":{"a":{"order":"nope"}}}`))
+	if err == nil {
+		t.Errorf("expected err on unknown order")
+	}
+	_, err = queryFacetOptions([]byte(`{"facets":{"a":{"offset":-1}}}`))
+	if err == nil {
+		t.Errorf("expected err on negative offset")
+	}
+}
+
+func TestCheckQueryFacetSizes(t *testing.T) {
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	req.AddFacet("a", bleve.NewFacetRequest("a", 10))
+	if checkQueryFacetSizes(req, 10) != nil {
+		t.Errorf("expected no err at the max size")
+	}
+	if checkQueryFacetSizes(req, 9) == nil {
+		t.Errorf("expected err over the max size")
+	}
+}
+
+func queryFacetsTestTerms(fr *search.FacetResult) string {
+	rv := ""
+	for _, tf := range fr.Terms {
+		rv = rv + fmt.Sprintf("%s=%d,", tf.Term, tf.Count)
+	}
+	return rv
+}
+
+func TestQueryFacetsPages(t *testing.T) {
+	a, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Category cN has N docs, split across the two indexes.
+	n := 0
+	for c := 1; c <= 6; c++ {
+		for i := 0; i < c; i++ {
+			idx := a
+			if n%2 == 1 {
+				idx = b
+			}
+			idx.Index(fmt.Sprintf("d%d", n), map[string]interface{}{
+				"category": fmt.Sprintf("c%d", c),
+			})
+			n++
+		}
+	}
+
+	tests := []struct {
+		opts     *QueryFacetOptions
+		expTerms string
+		expNext  string
+	}{
+		{&QueryFacetOptions{Order: "count"}, "c6=6,c5=5,", "c5"},
+		{&QueryFacetOptions{Order: "count", Offset: 2}, "c4=4,c3=3,", "c3"},
+		{&QueryFacetOptions{Order: "count", Offset: 4}, "c2=2,c1=1,", ""},
+		{&QueryFacetOptions{Order: "term"}, "c1=1,c2=2,", "c2"},
+		{&QueryFacetOptions{Order: "term", After: "c2"}, "c3=3,c4=4,", "c4"},
+		{&QueryFacetOptions{Order: "term", After: "c35"}, "c4=4,c5=5,", "c5"},
+		{&QueryFacetOptions{Order: "term", After: "c5"}, "c6=6,", ""},
+	}
+
+	for i, test := range tests {
+		req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+		req.AddFacet("categories", bleve.NewFacetRequest("category", 2))
+
+		opts := map[string]*QueryFacetOptions{"categories": test.opts}
+
+		sr, _, err := queryGather([]bleve.Index{a, b}, []string{"a", "b"},
+			queryFacetsGatherRequest(req, opts), make(chan bool),
+			func(hits search.DocumentMatchCollection) {
+				QueryMergeByScore(req, "_id", hits)
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pages := queryFacetsPages(sr, req, opts)
+
+		fr := sr.Facets["categories"]
+		if queryFacetsTestTerms(fr) != test.expTerms ||
+			pages["categories"].Next != test.expNext {
+			t.Errorf("test: %d, terms: %s, next: %s", i,
+				queryFacetsTestTerms(fr), pages["categories"].Next)
+		}
+
+		sum := 0
+		for _, tf := range fr.Terms {
+			sum += tf.Count
+		}
+		if fr.Other != 21-sum {
+			t.Errorf("test: %d, other: %d", i, fr.Other)
+		}
+	}
+}
+
+func TestQueryFacetMissing(t *testing.T) {
+	missing, err := queryFacetMissing([]byte(`{"facets":{` +
+		`"a":{"field":"a","missing":true},` +
+		`"b":{"field":"b","missing":true,"missingTerm":"(none)"},` +
+		`"c":{"field":"c"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 2 || missing["a"] != QueryFacetMissingTerm ||
+		missing["b"] != "(none)" {
+		t.Errorf("unexpected missing: %#v", missing)
+	}
+}
+
+func TestQueryFacetsMissingBuckets(t *testing.T) {
+	idx, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Index("a", map[string]interface{}{"type": "x", "price": 1.0})
+	idx.Index("b", map[string]interface{}{"type": "x"})
+	idx.Index("c", map[string]interface{}{"price": 20.0})
+
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	req.AddFacet("types", bleve.NewFacetRequest("type", 10))
+	prices := bleve.NewFacetRequest("price", 10)
+	max := 10.0
+	prices.AddNumericRange("cheap", nil, &max)
+	req.AddFacet("prices", prices)
+
+	sr, err := idx.Search(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryFacetsMissingBuckets(sr, req,
+		map[string]string{"types": "_missing", "prices": "none"})
+
+	terms := sr.Facets["types"].Terms
+	last := terms[len(terms)-1]
+	if last.Term != "_missing" || last.Count != 1 {
+		t.Errorf("unexpected types missing bucket: %#v", last)
+	}
+
+	ranges := sr.Facets["prices"].NumericRanges
+	lastRange := ranges[len(ranges)-1]
+	if lastRange.Name != "none" || lastRange.Count != 1 {
+		t.Errorf("unexpected prices missing bucket: %#v", lastRange)
+	}
+}
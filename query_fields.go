@@ -0,0 +1,328 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+
+	"github.com/couchbase/go-couchbase"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// The "fields" of a query request, which are the stored fields that
+// are returned with each hit, may have wildcard patterns, like...
+//
+//   {"query": {...}, "fields": ["title", "address.*"]}
+//
+// where the patterns are matched like path.Match().  A query request
+// with "fetchFromKV": true has each hit enriched with the full JSON
+// document, as "_source" in the hit's fields, which is fetched from
+// the Couchbase bucket of the index, or, for an alias, of the aliased
+// index that the hit came from.
+
+// The hit field of a document that's fetched from the KV store.
+const QUERY_FIELDS_SOURCE = "_source"
+
+// queryFieldsPatterns returns the wildcard patterns of the fields of
+// a search request, or nil if the fields have no wildcards.
+func queryFieldsPatterns(fields []string) []string {
+	for _, f := range fields {
+		if f != "*" && strings.ContainsAny(f, "*?[") {
+			return fields
+		}
+	}
+	return nil
+}
+
+// queryFieldsMatch returns true when a field name matches any of the
+// patterns.
+func queryFieldsMatch(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if p == "*" || p == name {
+			return true
+		}
+		matched, err := path.Match(p, name)
+		if err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validateQueryFields checks the wildcard patterns of fields.
+func validateQueryFields(fields []string) error {
+	for _, f := range fields {
+		_, err := path.Match(f, "")
+		if err != nil {
+			return fmt.Errorf("query_fields: bad fields pattern: %q,"+
+				" err: %v", f, err)
+		}
+	}
+	return nil
+}
+
+// filterHitFields removes the fields of hits that don't match the
+// patterns.
+func filterHitFields(hits search.DocumentMatchCollection,
+	patterns []string) {
+	for _, hit := range hits {
+		for name := range hit.Fields {
+			if !queryFieldsMatch(name, patterns) {
+				delete(hit.Fields, name)
+			}
+		}
+	}
+}
+
+// ---------------------------------------------------------
+
+type queryFetchFromKVParams struct {
+	FetchFromKV bool `json:"fetchFromKV"`
+}
+
+// queryFetchFromKV returns true when a query request asks for its
+// hits to be enriched with the documents from the KV store.
+func queryFetchFromKV(req []byte) bool {
+	var p queryFetchFromKVParams
+	err := json.Unmarshal(req, &p)
+	return err == nil && p.FetchFromKV
+}
+
+var queryFetchBucketsM sync.Mutex
+
+// The connected buckets, keyed by server URL and bucket name.
+var queryFetchBuckets = map[string]*couchbase.Bucket{}
+
+// queryFetchBucket returns a cached connection to the source bucket
+// of an index definition.
+func queryFetchBucket(server string, indexDef *cbgt.IndexDef) (
+	*couchbase.Bucket, error) {
+	if indexDef.SourceType != "couchbase" {
+		return nil, fmt.Errorf("query_fields: fetchFromKV needs a"+
+			" couchbase source, sourceType: %s", indexDef.SourceType)
+	}
+
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+
+	if indexDef.SourceParams != "" {
+		params := cbgt.CBFeedParams{}
+		err = json.Unmarshal([]byte(indexDef.SourceParams), &params)
+		if err == nil && params.AuthUser != "" {
+			u.User = url.UserPassword(params.AuthUser, params.AuthPassword)
+		}
+	}
+
+	key := u.String() + "/" + indexDef.SourceName
+
+	queryFetchBucketsM.Lock()
+	defer queryFetchBucketsM.Unlock()
+
+	bucket := queryFetchBuckets[key]
+	if bucket == nil {
+		bucket, err = couchbase.GetBucket(u.String(), "default",
+			indexDef.SourceName)
+		if err != nil {
+			return nil, fmt.Errorf("query_fields: could not connect to"+
+				" bucket: %s, err: %v", indexDef.SourceName, err)
+		}
+		queryFetchBuckets[key] = bucket
+	}
+
+	return bucket, nil
+}
+
+// queryFetchBucketClose drops a cached bucket connection, such as
+// after an error.
+func queryFetchBucketClose(bucket *couchbase.Bucket) {
+	queryFetchBucketsM.Lock()
+	for key, b := range queryFetchBuckets {
+		if b == bucket {
+			delete(queryFetchBuckets, key)
+		}
+	}
+	queryFetchBucketsM.Unlock()
+
+	bucket.Close()
+}
+
+// fetchHitsFromKV enriches hits with their documents from the source
+// buckets of their indexes, where the hits of an alias are resolved to
+// the aliased indexes by the pindexes that they came from.  It returns
+// warnings about the documents that couldn't be fetched, and returns
+// partial as true when some documents weren't fetched due to errors,
+// as opposed to not existing.
+func fetchHitsFromKV(mgr *cbgt.Manager, indexName string,
+	hits search.DocumentMatchCollection) ([]string, bool, error) {
+	if len(hits) <= 0 {
+		return nil, false, nil
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return nil, false, err
+	}
+
+	sources, err := queryFetchSourceIndexes(indexDefsByName, indexName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var warnings []string
+	partial := false
+
+	var names []string
+	byIndex := map[string][]*search.DocumentMatch{}
+
+	for _, hit := range hits {
+		name := indexNameFromPIndexPath(hit.Index)
+		if !sources[name] {
+			if len(sources) != 1 {
+				warnings = append(warnings, fmt.Sprintf("fetchFromKV:"+
+					" could not resolve the index of doc: %s", hit.ID))
+				partial = true
+				continue
+			}
+			for name = range sources {
+			}
+		}
+		if byIndex[name] == nil {
+			names = append(names, name)
+		}
+		byIndex[name] = append(byIndex[name], hit)
+	}
+
+	for _, name := range names {
+		w, p, err := fetchIndexHitsFromKV(mgr, indexDefsByName[name],
+			byIndex[name])
+		if err != nil {
+			return nil, false, err
+		}
+		warnings = append(warnings, w...)
+		partial = partial || p
+	}
+
+	return warnings, partial, nil
+}
+
+// queryFetchSourceIndexes returns the names of the indexes that an
+// index resolves to, following aliases.
+func queryFetchSourceIndexes(indexDefsByName map[string]*cbgt.IndexDef,
+	indexName string) (map[string]bool, error) {
+	rv := map[string]bool{}
+	seen := map[string]bool{}
+
+	var visit func(name string) error
+
+	visit = func(name string) error {
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+
+		indexDef := indexDefsByName[name]
+		if indexDef == nil {
+			return fmt.Errorf("query_fields: no index: %s", name)
+		}
+		if indexDef.Type != "alias" {
+			rv[name] = true
+			return nil
+		}
+
+		params := AliasParams{}
+		err := json.Unmarshal([]byte(indexDef.Params), &params)
+		if err != nil {
+			return fmt.Errorf("query_fields: could not parse alias"+
+				" params, indexName: %s, err: %v", name, err)
+		}
+		for targetName := range params.Targets {
+			err = visit(targetName)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return rv, visit(indexName)
+}
+
+// fetchIndexHitsFromKV enriches hits of an index with their documents,
+// which are fetched in bulk from the source bucket of the index.
+func fetchIndexHitsFromKV(mgr *cbgt.Manager, indexDef *cbgt.IndexDef,
+	hits []*search.DocumentMatch) ([]string, bool, error) {
+	bucket, err := queryFetchBucket(mgr.Server(), indexDef)
+	if err != nil {
+		return nil, false, err
+	}
+
+	keys := make([]string, 0, len(hits))
+	for _, hit := range hits {
+		keys = append(keys, hit.ID)
+	}
+
+	var warnings []string
+	partial := false
+
+	// On an error, the docs that were fetched are still used, but
+	// the missing docs can't be told apart from the failed ones.
+	docs, err := bucket.GetBulk(keys)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("fetchFromKV:"+
+			" could not fetch docs, indexName: %s, err: %v",
+			indexDef.Name, err))
+		partial = true
+		queryFetchBucketClose(bucket)
+	}
+
+	for _, hit := range hits {
+		res := docs[hit.ID]
+		if res == nil {
+			if !partial {
+				warnings = append(warnings, fmt.Sprintf("fetchFromKV:"+
+					" no such doc: %s", hit.ID))
+			}
+			continue
+		}
+
+		if hit.Fields == nil {
+			hit.Fields = map[string]interface{}{}
+		}
+		doc := json.RawMessage(res.Body)
+		hit.Fields[QUERY_FIELDS_SOURCE] = &doc
+	}
+
+	return warnings, partial, nil
+}
+
+// queryFieldsGatherRequest returns the search request to gather with,
+// which asks for all stored fields when the fields have wildcards.
+func queryFieldsGatherRequest(req *bleve.SearchRequest) *bleve.SearchRequest {
+	if queryFieldsPatterns(req.Fields) == nil {
+		return req
+	}
+	r := *req
+	r.Fields = []string{"*"}
+	return &r
+}
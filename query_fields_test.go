@@ -0,0 +1,122 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestQueryFieldsPatterns(t *testing.T) {
+	if queryFieldsPatterns([]string{"title", "price"}) != nil {
+		t.Errorf("expected no patterns without wildcards")
+	}
+	if queryFieldsPatterns([]string{"*"}) != nil {
+		t.Errorf("expected no patterns for just *")
+	}
+	if queryFieldsPatterns([]string{"title", "address.*"}) == nil {
+		t.Errorf("expected patterns")
+	}
+
+	err := validateQueryFields([]string{"title", "a[b"})
+	if err == nil {
+		t.Errorf("expected err on bad pattern")
+	}
+}
+
+func TestFilterHitFields(t *testing.T) {
+	hits := search.DocumentMatchCollection{
+		&search.DocumentMatch{ID: "a", Fields: map[string]interface{}{
+			"title":        "t",
+			"price":        1.0,
+			"address.city": "c",
+			"address.zip":  "z",
+			"desc":         "d",
+		}},
+	}
+
+	filterHitFields(hits, []string{"title", "address.*", "pri?e"})
+
+	exp := map[string]interface{}{
+		"title":        "t",
+		"price":        1.0,
+		"address.city": "c",
+		"address.zip":  "z",
+	}
+	if !reflect.DeepEqual(hits[0].Fields, exp) {
+		t.Errorf("unexpected fields: %#v", hits[0].Fields)
+	}
+}
+
+func TestQueryFieldsGatherRequest(t *testing.T) {
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	req.Fields = []string{"title"}
+	if queryFieldsGatherRequest(req) != req {
+		t.Errorf("expected the same request without wildcards")
+	}
+
+	req.Fields = []string{"address.*"}
+	r := queryFieldsGatherRequest(req)
+	if !reflect.DeepEqual(r.Fields, []string{"*"}) ||
+		!reflect.DeepEqual(req.Fields, []string{"address.*"}) {
+		t.Errorf("expected a copy asking for all fields, got: %#v", r.Fields)
+	}
+}
+
+func TestQueryFetchFromKV(t *testing.T) {
+	if queryFetchFromKV([]byte(`{"query":{}}`)) {
+		t.Errorf("expected no fetchFromKV")
+	}
+	if !queryFetchFromKV([]byte(`{"fetchFromKV":true}`)) {
+		t.Errorf("expected fetchFromKV")
+	}
+
+	_, err := queryFetchBucket("http://127.0.0.1:8091",
+		&cbgt.IndexDef{SourceType: "nil"})
+	if err == nil {
+		t.Errorf("expected err on a non-couchbase source")
+	}
+}
+
+func TestQueryFetchSourceIndexes(t *testing.T) {
+	indexDefsByName := map[string]*cbgt.IndexDef{
+		"a": &cbgt.IndexDef{Name: "a", Type: "bleve"},
+		"b": &cbgt.IndexDef{Name: "b", Type: "bleve"},
+		"x": &cbgt.IndexDef{Name: "x", Type: "alias",
+			Params: `{"targets":{"a":{},"y":{}}}`},
+		"y": &cbgt.IndexDef{Name: "y", Type: "alias",
+			Params: `{"targets":{"b":{},"x":{}}}`},
+		"z": &cbgt.IndexDef{Name: "z", Type: "alias",
+			Params: `{"targets":{"missing":{}}}`},
+	}
+
+	sources, err := queryFetchSourceIndexes(indexDefsByName, "a")
+	if err != nil || !reflect.DeepEqual(sources, map[string]bool{"a": true}) {
+		t.Errorf("expected a, got: %v, err: %v", sources, err)
+	}
+
+	sources, err = queryFetchSourceIndexes(indexDefsByName, "x")
+	if err != nil || !reflect.DeepEqual(sources,
+		map[string]bool{"a": true, "b": true}) {
+		t.Errorf("expected a and b, got: %v, err: %v", sources, err)
+	}
+
+	_, err = queryFetchSourceIndexes(indexDefsByName, "z")
+	if err == nil {
+		t.Errorf("expected err on a missing target")
+	}
+}
@@ -0,0 +1,540 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+// A function_score query wraps the top-level query of a request, and
+// modifies the scores of its hits with functions of the stored field
+// values of the hits, like...
+//
+//   {"function_score": {
+//      "query": {"match": "beer", "field": "desc"},
+//      "functions": [
+//        {"field_value_factor": {
+//           "field": "popularity",
+//           "factor": 1.0,        // Optional.
+//           "modifier": "log1p",  // Optional, see below.
+//           "missing": 1.0}},     // Optional.
+//        {"decay": {
+//           "field": "updated",
+//           "function": "exp",    // Or "gauss" or "linear".
+//           "origin": "now",      // A number, date or "now[+-]N<unit>".
+//           "scale": "30d",       // A number, or a duration for dates.
+//           "offset": "1d",       // Optional.
+//           "decay": 0.5},        // Optional, the value at the scale.
+//         "weight": 2.0}],        // Optional, for any function.
+//      "score_mode": "multiply",  // How functions are combined.
+//      "boost_mode": "multiply",  // How they're combined with the score.
+//      "window": 100}}            // Optional, the hits to rescore.
+//
+// The function_score is unwrapped before query execution, and the
+// hits of each pindex are rescored, before the merge, by wrapping the
+// pindex targets.  The top "window" hits of each pindex, by their
+// query score, are rescored, where the window is at least from+size.
+// The fields of the functions must be stored fields.
+
+var functionScoreModifiers = map[string]func(float64) float64{
+	"":           func(v float64) float64 { return v },
+	"none":       func(v float64) float64 { return v },
+	"log":        math.Log10,
+	"log1p":      func(v float64) float64 { return math.Log10(v + 1) },
+	"log2p":      func(v float64) float64 { return math.Log10(v + 2) },
+	"ln":         math.Log,
+	"ln1p":       math.Log1p,
+	"ln2p":       func(v float64) float64 { return math.Log(v + 2) },
+	"square":     func(v float64) float64 { return v * v },
+	"sqrt":       math.Sqrt,
+	"reciprocal": func(v float64) float64 { return 1.0 / v },
+}
+
+// The score_mode's, which combine the values of the functions.
+var functionScoreModes = map[string]bool{
+	"multiply": true, "sum": true, "avg": true, "max": true, "min": true,
+}
+
+// The boost_mode's, which combine the query score with the combined
+// value of the functions.
+var functionScoreBoostModes = map[string]bool{
+	"multiply": true, "sum": true, "replace": true,
+}
+
+type functionScore struct {
+	Functions []*scoreFunction `json:"functions"`
+	ScoreMode string           `json:"score_mode"`
+	BoostMode string           `json:"boost_mode"`
+	Window    int              `json:"window"`
+}
+
+type scoreFunction struct {
+	FieldValueFactor *fieldValueFactor `json:"field_value_factor"`
+	Decay            *decayFunction    `json:"decay"`
+	Weight           *float64          `json:"weight"`
+}
+
+type fieldValueFactor struct {
+	Field    string   `json:"field"`
+	Factor   *float64 `json:"factor"`
+	Modifier string   `json:"modifier"`
+	Missing  *float64 `json:"missing"`
+}
+
+type decayFunction struct {
+	Field    string      `json:"field"`
+	Function string      `json:"function"`
+	Origin   interface{} `json:"origin"`
+	Scale    interface{} `json:"scale"`
+	Offset   interface{} `json:"offset"`
+	Decay    *float64    `json:"decay"`
+
+	// The parsed origin, scale and offset, in seconds for dates.
+	date                  bool
+	origin, scale, offset float64
+}
+
+// rewriteFunctionScore unwraps the function_score of the top-level
+// query of a JSON search request, returning the request with just the
+// wrapped query, and the parsed function_score, which is nil when
+// there's no function_score.
+func rewriteFunctionScore(req []byte) ([]byte, *functionScore, error) {
+	v, err := parseJSONUseNumber(req)
+	if err != nil {
+		return req, nil, nil // Let the search request parsing report the error.
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return req, nil, nil
+	}
+	q, ok := m["query"].(map[string]interface{})
+	if !ok {
+		return req, nil, nil
+	}
+
+	fsm, ok := q["function_score"].(map[string]interface{})
+	if !ok {
+		return req, nil, checkNoFunctionScore(q)
+	}
+
+	inner, ok := fsm["query"].(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("query_function_score: missing query")
+	}
+
+	err = checkNoFunctionScore(inner)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fsj, err := json.Marshal(fsm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fs := &functionScore{}
+	err = json.Unmarshal(fsj, fs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query_function_score: parsing,"+
+			" err: %v", err)
+	}
+
+	err = fs.init(queryUnitsNow())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if boost, exists := q["boost"]; exists {
+		inner["boost"] = jsonFloat(boost, 1.0)
+	}
+
+	m["query"] = inner
+
+	req, err = json.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return req, fs, nil
+}
+
+// checkNoFunctionScore returns an error when there's a function_score
+// in a query tree, as it's only supported as the top-level query.
+func checkNoFunctionScore(q interface{}) error {
+	_, err := rewriteQueryTree(q, func(qm map[string]interface{}) (
+		interface{}, error) {
+		if _, exists := qm["function_score"]; exists {
+			return nil, fmt.Errorf("query_function_score: function_score" +
+				" is only supported as the top-level query")
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// init validates the function_score and parses its decay params.
+func (fs *functionScore) init(now time.Time) error {
+	if len(fs.Functions) <= 0 {
+		return fmt.Errorf("query_function_score: missing functions")
+	}
+	if fs.ScoreMode == "" {
+		fs.ScoreMode = "multiply"
+	}
+	if !functionScoreModes[fs.ScoreMode] {
+		return fmt.Errorf("query_function_score: unknown score_mode: %q",
+			fs.ScoreMode)
+	}
+	if fs.BoostMode == "" {
+		fs.BoostMode = "multiply"
+	}
+	if !functionScoreBoostModes[fs.BoostMode] {
+		return fmt.Errorf("query_function_score: unknown boost_mode: %q",
+			fs.BoostMode)
+	}
+	if fs.Window < 0 {
+		return fmt.Errorf("query_function_score: window must be >= 0")
+	}
+
+	for i, f := range fs.Functions {
+		if f == nil || (f.FieldValueFactor == nil) == (f.Decay == nil) {
+			return fmt.Errorf("query_function_score: function %d must have"+
+				" either a field_value_factor or a decay", i)
+		}
+
+		if fvf := f.FieldValueFactor; fvf != nil {
+			if fvf.Field == "" {
+				return fmt.Errorf("query_function_score: function %d,"+
+					" missing field", i)
+			}
+			if _, exists := functionScoreModifiers[fvf.Modifier]; !exists {
+				return fmt.Errorf("query_function_score: function %d,"+
+					" unknown modifier: %q", i, fvf.Modifier)
+			}
+		}
+
+		if f.Decay != nil {
+			err := f.Decay.init(now)
+			if err != nil {
+				return fmt.Errorf("query_function_score: function %d,"+
+					" decay, err: %v", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// init parses the origin, scale and offset of a decay function, where
+// an origin that's a date, or "now", makes it a decay over dates.
+func (d *decayFunction) init(now time.Time) error {
+	if d.Field == "" {
+		return fmt.Errorf("missing field")
+	}
+	switch d.Function {
+	case "":
+		d.Function = "exp"
+	case "exp", "gauss", "linear":
+	default:
+		return fmt.Errorf("unknown function: %q", d.Function)
+	}
+	if d.Decay == nil {
+		decay := 0.5
+		d.Decay = &decay
+	}
+	if *d.Decay <= 0 || *d.Decay >= 1 {
+		return fmt.Errorf("decay must be between 0 and 1, exclusive")
+	}
+
+	if s, ok := d.Origin.(string); ok {
+		date, ok, err := convertUnitDate(s, now)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			date = s
+		}
+		t, err := time.Parse(time.RFC3339, date)
+		if err != nil {
+			return fmt.Errorf("invalid origin date: %q", s)
+		}
+		d.date = true
+		d.origin = float64(t.UnixNano()) / float64(time.Second)
+	} else if d.Origin != nil {
+		d.origin = jsonFloat(d.Origin, math.NaN())
+		if math.IsNaN(d.origin) {
+			return fmt.Errorf("invalid origin: %v", d.Origin)
+		}
+	} else {
+		return fmt.Errorf("missing origin")
+	}
+
+	// The scale and offset of dates are durations, in seconds.
+	unit := ""
+	if d.date {
+		unit = "s"
+	}
+
+	parse := func(v interface{}) (float64, error) {
+		if s, ok := v.(string); ok {
+			return convertUnitValue(s, unit)
+		}
+		n := jsonFloat(v, math.NaN())
+		if math.IsNaN(n) {
+			return 0, fmt.Errorf("invalid number: %v", v)
+		}
+		return n, nil
+	}
+
+	var err error
+	d.scale, err = parse(d.Scale)
+	if err != nil {
+		return fmt.Errorf("scale, err: %v", err)
+	}
+	if d.scale <= 0 {
+		return fmt.Errorf("scale must be > 0")
+	}
+
+	if d.Offset != nil {
+		d.offset, err = parse(d.Offset)
+		if err != nil {
+			return fmt.Errorf("offset, err: %v", err)
+		}
+		if d.offset < 0 {
+			return fmt.Errorf("offset must be >= 0")
+		}
+	}
+
+	return nil
+}
+
+// fields returns the names of the fields of the functions.
+func (fs *functionScore) fields() []string {
+	var rv []string
+	for _, f := range fs.Functions {
+		if f.FieldValueFactor != nil {
+			rv = append(rv, f.FieldValueFactor.Field)
+		}
+		if f.Decay != nil {
+			rv = append(rv, f.Decay.Field)
+		}
+	}
+	return rv
+}
+
+// gatherRequest returns the search request to gather, which loads the
+// fields of the functions, and whose window of hits is rescored.
+func (fs *functionScore) gatherRequest(req *bleve.SearchRequest) *bleve.SearchRequest {
+	r := *req
+
+	r.Fields = append([]string(nil), req.Fields...)
+	for _, field := range fs.fields() {
+		if !queryFieldsMatch(field, r.Fields) {
+			r.Fields = append(r.Fields, field)
+		}
+	}
+
+	r.From = 0
+	r.Size = req.From + req.Size
+	if r.Size < fs.Window {
+		r.Size = fs.Window
+	}
+
+	return &r
+}
+
+// functionScoreFieldValue returns the first numeric value of a hit's
+// field, where the values of date fields are in seconds.
+func functionScoreFieldValue(hit *search.DocumentMatch, field string,
+	date bool) (float64, bool) {
+	v := hit.Fields[field]
+	if vs, ok := v.([]interface{}); ok {
+		if len(vs) <= 0 {
+			return 0, false
+		}
+		v = vs[0]
+	}
+
+	if s, ok := v.(string); ok {
+		if !date {
+			return 0, false
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return 0, false
+		}
+		return float64(t.UnixNano()) / float64(time.Second), true
+	}
+
+	n := jsonFloat(v, math.NaN())
+	return n, !math.IsNaN(n)
+}
+
+// value returns the value of a field_value_factor function for a hit.
+func (fvf *fieldValueFactor) value(hit *search.DocumentMatch) float64 {
+	v, ok := functionScoreFieldValue(hit, fvf.Field, false)
+	if !ok {
+		if fvf.Missing == nil {
+			return 1.0
+		}
+		v = *fvf.Missing
+	}
+	if fvf.Factor != nil {
+		v = v * *fvf.Factor
+	}
+	v = functionScoreModifiers[fvf.Modifier](v)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0.0
+	}
+	return v
+}
+
+// value returns the value of a decay function for a hit, which is 1
+// within the offset of the origin, and the decay at the scale beyond
+// the offset.  A hit without the field isn't decayed.
+func (d *decayFunction) value(hit *search.DocumentMatch) float64 {
+	x, ok := functionScoreFieldValue(hit, d.Field, d.date)
+	if !ok {
+		return 1.0
+	}
+
+	dist := math.Max(0, math.Abs(x-d.origin)-d.offset)
+
+	switch d.Function {
+	case "gauss":
+		sigmaSquared := -d.scale * d.scale / (2.0 * math.Log(*d.Decay))
+		return math.Exp(-dist * dist / (2.0 * sigmaSquared))
+	case "linear":
+		s := d.scale / (1.0 - *d.Decay)
+		return math.Max(0, (s-dist)/s)
+	}
+
+	return math.Exp(math.Log(*d.Decay) / d.scale * dist)
+}
+
+// value returns the combined value of the functions for a hit.
+func (fs *functionScore) value(hit *search.DocumentMatch) float64 {
+	var rv float64
+	for i, f := range fs.Functions {
+		var v float64
+		if f.FieldValueFactor != nil {
+			v = f.FieldValueFactor.value(hit)
+		} else {
+			v = f.Decay.value(hit)
+		}
+		if f.Weight != nil {
+			v = v * *f.Weight
+		}
+
+		if i == 0 {
+			rv = v
+			continue
+		}
+		switch fs.ScoreMode {
+		case "multiply":
+			rv = rv * v
+		case "sum", "avg":
+			rv = rv + v
+		case "max":
+			rv = math.Max(rv, v)
+		case "min":
+			rv = math.Min(rv, v)
+		}
+	}
+
+	if fs.ScoreMode == "avg" {
+		rv = rv / float64(len(fs.Functions))
+	}
+
+	return rv
+}
+
+// rescore modifies the scores of the hits with the functions.
+func (fs *functionScore) rescore(hits search.DocumentMatchCollection) {
+	for _, hit := range hits {
+		v := fs.value(hit)
+
+		score := hit.Score
+		switch fs.BoostMode {
+		case "multiply":
+			score = score * v
+		case "sum":
+			score = score + v
+		case "replace":
+			score = v
+		}
+
+		if hit.Expl != nil {
+			hit.Expl = &search.Explanation{
+				Value: score,
+				Message: fmt.Sprintf("function_score(score_mode=%s,"+
+					" boost_mode=%s)", fs.ScoreMode, fs.BoostMode),
+				Children: []*search.Explanation{
+					hit.Expl,
+					{Value: v, Message: "functions"},
+				},
+			}
+		}
+
+		hit.Score = score
+	}
+}
+
+// functionScoreBaseIndex is embedded so that the wrapped bleve.Index
+// methods are promoted.
+type functionScoreBaseIndex interface {
+	bleve.Index
+}
+
+// A functionScoreIndex rescores the hits of a pindex target.
+type functionScoreIndex struct {
+	functionScoreBaseIndex
+	fs *functionScore
+}
+
+func (t *functionScoreIndex) Search(req *bleve.SearchRequest) (
+	*bleve.SearchResult, error) {
+	sr, err := bleve.Index(t.functionScoreBaseIndex).Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	t.fs.rescore(sr.Hits)
+
+	sr.MaxScore = 0
+	for _, hit := range sr.Hits {
+		if hit.Score > sr.MaxScore {
+			sr.MaxScore = hit.Score
+		}
+	}
+
+	return sr, nil
+}
+
+// functionScoreTargets wraps the pindex targets so that their hits are
+// rescored by the function_score.
+func functionScoreTargets(targets []bleve.Index,
+	fs *functionScore) []bleve.Index {
+	rv := make([]bleve.Index, 0, len(targets))
+	for _, target := range targets {
+		rv = append(rv, &functionScoreIndex{
+			functionScoreBaseIndex: target,
+			fs:                     fs,
+		})
+	}
+	return rv
+}
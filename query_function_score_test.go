@@ -0,0 +1,170 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+func TestRewriteFunctionScore(t *testing.T) {
+	req := []byte(`{"query":{"match":"beer"},"size":10}`)
+	rv, fs, err := rewriteFunctionScore(req)
+	if err != nil || fs != nil || string(rv) != string(req) {
+		t.Errorf("expected no function_score, got: %s, %v, %v", rv, fs, err)
+	}
+
+	req = []byte(`{"query":{"function_score":{
+		"query":{"match":"beer","field":"desc"},
+		"functions":[{"field_value_factor":{"field":"popularity"}}]},
+		"boost":2},"size":10}`)
+	rv, fs, err = rewriteFunctionScore(req)
+	if err != nil || fs == nil {
+		t.Fatalf("expected function_score, got err: %v", err)
+	}
+	if fs.ScoreMode != "multiply" || fs.BoostMode != "multiply" {
+		t.Errorf("expected default modes, got: %#v", fs)
+	}
+	var m map[string]interface{}
+	json.Unmarshal(rv, &m)
+	q := m["query"].(map[string]interface{})
+	if q["match"] != "beer" || q["field"] != "desc" || q["boost"] != 2.0 {
+		t.Errorf("expected unwrapped query, got: %s", rv)
+	}
+
+	for _, req := range []string{
+		`{"query":{"function_score":{"functions":[
+			{"field_value_factor":{"field":"a"}}]}}}`,
+		`{"query":{"function_score":{"query":{"match_all":{}}}}}`,
+		`{"query":{"function_score":{"query":{"match_all":{}},
+			"functions":[{"field_value_factor":{"field":"a"},
+				"decay":{"field":"b","origin":0,"scale":1}}]}}}`,
+		`{"query":{"function_score":{"query":{"match_all":{}},
+			"functions":[{"field_value_factor":{"field":"a",
+				"modifier":"cube"}}]}}}`,
+		`{"query":{"function_score":{"query":{"match_all":{}},
+			"score_mode":"first",
+			"functions":[{"field_value_factor":{"field":"a"}}]}}}`,
+		`{"query":{"function_score":{"query":{"match_all":{}},
+			"functions":[{"decay":{"field":"b","origin":0,"scale":0}}]}}}`,
+		`{"query":{"function_score":{"query":{"match_all":{}},
+			"functions":[{"decay":{"field":"b","origin":"yesterday",
+				"scale":"1d"}}]}}}`,
+		`{"query":{"conjuncts":[{"function_score":{"query":{"match_all":{}},
+			"functions":[{"field_value_factor":{"field":"a"}}]}}]}}`,
+	} {
+		_, _, err = rewriteFunctionScore([]byte(req))
+		if err == nil {
+			t.Errorf("expected err, req: %s", req)
+		}
+	}
+}
+
+func TestFunctionScoreDecay(t *testing.T) {
+	now := time.Date(2015, 6, 30, 12, 0, 0, 0, time.UTC)
+
+	decay := 0.5
+	hit := func(v interface{}) *search.DocumentMatch {
+		return &search.DocumentMatch{
+			Fields: map[string]interface{}{"f": v},
+		}
+	}
+
+	for _, fn := range []string{"exp", "gauss", "linear"} {
+		d := &decayFunction{Field: "f", Function: fn,
+			Origin: 100.0, Scale: 10.0, Offset: 5.0, Decay: &decay}
+		err := d.init(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := d.value(hit(103.0)); v != 1.0 {
+			t.Errorf("%s: expected no decay within the offset, got: %f", fn, v)
+		}
+		if v := d.value(hit(85.0)); math.Abs(v-0.5) > 1e-9 {
+			t.Errorf("%s: expected the decay at the scale, got: %f", fn, v)
+		}
+		if v := d.value(hit("not-a-number")); v != 1.0 {
+			t.Errorf("%s: expected no decay without a value, got: %f", fn, v)
+		}
+	}
+
+	d := &decayFunction{Field: "f", Origin: "now", Scale: "30d", Decay: &decay}
+	err := d.init(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := d.value(hit([]interface{}{"2015-05-31T12:00:00Z"}))
+	if !d.date || math.Abs(v-0.5) > 1e-9 {
+		t.Errorf("expected the decay 30 days ago, got: %f", v)
+	}
+}
+
+func TestFunctionScoreIndex(t *testing.T) {
+	index, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index.Index("a", map[string]interface{}{"desc": "beer", "popularity": 1})
+	index.Index("b", map[string]interface{}{"desc": "beer", "popularity": 99})
+	index.Index("c", map[string]interface{}{"desc": "beer"})
+
+	fs := &functionScore{
+		Functions: []*scoreFunction{
+			{FieldValueFactor: &fieldValueFactor{
+				Field: "popularity", Modifier: "log1p"}},
+		},
+		BoostMode: "replace",
+		Window:    5,
+	}
+	err = fs.init(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := bleve.NewMatchQuery("beer")
+	q.SetField("desc")
+	req := bleve.NewSearchRequestOptions(q, 2, 0, true)
+
+	gatherReq := fs.gatherRequest(req)
+	if gatherReq.Size != 5 || len(gatherReq.Fields) != 1 ||
+		gatherReq.Fields[0] != "popularity" {
+		t.Errorf("unexpected gather request: %#v", gatherReq)
+	}
+
+	targets := functionScoreTargets([]bleve.Index{index}, fs)
+
+	sr, err := targets[0].Search(gatherReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string]float64{"a": math.Log10(2), "b": 2, "c": 1}
+	for _, hit := range sr.Hits {
+		if math.Abs(hit.Score-exp[hit.ID]) > 1e-9 {
+			t.Errorf("hit: %s, expected score: %f, got: %f",
+				hit.ID, exp[hit.ID], hit.Score)
+		}
+		if hit.Expl == nil || hit.Expl.Value != hit.Score ||
+			len(hit.Expl.Children) != 2 {
+			t.Errorf("hit: %s, expected function_score explanation", hit.ID)
+		}
+	}
+	if sr.MaxScore != 2 {
+		t.Errorf("expected MaxScore of 2, got: %f", sr.MaxScore)
+	}
+}
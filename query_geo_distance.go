@@ -0,0 +1,316 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+// A query request may ask for the distance of each hit from an
+// origin, and may sort its hits by that distance, like...
+//
+//   {"query": {...},
+//    "geoDistance": {"field": "location",
+//                    "origin": {"lon": -122.41, "lat": 37.77},
+//                    "unit": "km",          // Optional, default "m".
+//                    "sort": "asc",         // Optional, or "desc".
+//                    "window": 1000}}       // Optional.
+//
+// The location of a hit is read from its stored fields, either as the
+// numeric "FIELD.lat" and "FIELD.lon" fields of a {"lat": ..., "lon":
+// ...} object, or as a "lat,lon" string in the FIELD itself.  The
+// origin is a {"lon", "lat"} object, a [lon, lat] array, as in
+// GeoJSON, or a "lat,lon" string.  The great-circle (haversine)
+// distances are returned as the "geoDistance" of the result, keyed by
+// hit ID, where hits without a location have no distance.
+//
+// Sorting is of the merged hits of all the pindexes, so a window of
+// the top hits by score is gathered, which is by default
+// QUERY_GEO_DISTANCE_WINDOW_DEFAULT hits, and at least from+size.
+// Hits without a location sort last, and hits at the same distance
+// keep their order by score.  A query that matches more docs than the
+// window should be narrowed, such as with a geo_shape query around
+// the origin, for the sort to be of every match.
+
+// The default window of a geoDistance sort.
+const QUERY_GEO_DISTANCE_WINDOW_DEFAULT = 1000
+
+// The max window of a geoDistance sort.
+const QUERY_GEO_DISTANCE_WINDOW_MAX = 10000
+
+// The mean radius of the earth, in meters.
+const geoEarthRadiusMeters = 6371008.8
+
+type queryGeoDistance struct {
+	Field  string      `json:"field"`
+	Origin interface{} `json:"origin"`
+	Unit   string      `json:"unit"`
+	Sort   string      `json:"sort"`
+	Window int         `json:"window"`
+
+	origin geoPoint
+	factor float64 // Meters per unit.
+}
+
+// QueryGeoDistanceResult holds the distances of the hits of a query
+// from its geoDistance origin, keyed by hit ID, in the unit.
+type QueryGeoDistanceResult struct {
+	Field     string             `json:"field"`
+	Unit      string             `json:"unit"`
+	Distances map[string]float64 `json:"distances"`
+}
+
+// queryGeoDistanceParams returns the geoDistance of a query request,
+// or nil.
+func queryGeoDistanceParams(req []byte) (*queryGeoDistance, error) {
+	var p struct {
+		GeoDistance *queryGeoDistance `json:"geoDistance"`
+	}
+	err := json.Unmarshal(req, &p)
+	if err != nil {
+		return nil, err
+	}
+	g := p.GeoDistance
+	if g == nil {
+		return nil, nil
+	}
+	if g.Field == "" {
+		return nil, fmt.Errorf("query_geo_distance: geoDistance needs a field")
+	}
+
+	origin, ok := parseGeoDistancePoint(g.Origin)
+	if !ok {
+		return nil, fmt.Errorf("query_geo_distance: bad origin: %v",
+			g.Origin)
+	}
+	g.origin = origin
+
+	if g.Unit == "" {
+		g.Unit = "m"
+	}
+	family, factor, ok := unitLookup(g.Unit, unitFamilies[0])
+	if !ok || family != unitFamilies[0] {
+		return nil, fmt.Errorf("query_geo_distance: unknown distance"+
+			" unit: %s", g.Unit)
+	}
+	g.factor = factor
+
+	if g.Sort != "" && g.Sort != "asc" && g.Sort != "desc" {
+		return nil, fmt.Errorf("query_geo_distance: sort must be"+
+			" asc or desc, sort: %s", g.Sort)
+	}
+	if g.Window < 0 || g.Window > QUERY_GEO_DISTANCE_WINDOW_MAX {
+		return nil, fmt.Errorf("query_geo_distance: window must be"+
+			" between 0 and %d", QUERY_GEO_DISTANCE_WINDOW_MAX)
+	}
+	return g, nil
+}
+
+// parseGeoDistancePoint parses a {"lon", "lat"} object, a [lon, lat]
+// array or a "lat,lon" string.
+func parseGeoDistancePoint(v interface{}) (geoPoint, bool) {
+	var lon, lat interface{}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		lon, lat = x["lon"], x["lat"]
+	case []interface{}:
+		if len(x) != 2 {
+			return geoPoint{}, false
+		}
+		lon, lat = x[0], x[1]
+	case string:
+		parts := strings.Split(x, ",")
+		if len(parts) != 2 {
+			return geoPoint{}, false
+		}
+		lon, lat = strings.TrimSpace(parts[1]), strings.TrimSpace(parts[0])
+	default:
+		return geoPoint{}, false
+	}
+
+	x, xok := geoDistanceCoord(lon)
+	y, yok := geoDistanceCoord(lat)
+	if !xok || !yok || x < -180 || x > 180 || y < -90 || y > 90 {
+		return geoPoint{}, false
+	}
+	return geoPoint{x, y}, true
+}
+
+func geoDistanceCoord(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		f, err := strconv.ParseFloat(x, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// geoDistanceMeters returns the great-circle distance between two
+// points, by the haversine formula.
+func geoDistanceMeters(a, b geoPoint) float64 {
+	rad := math.Pi / 180
+	dLon := (b[0] - a[0]) * rad
+	dLat := (b[1] - a[1]) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a[1]*rad)*math.Cos(b[1]*rad)*
+			math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * geoEarthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// fields returns the stored fields that hold the location of a hit.
+func (g *queryGeoDistance) fields() []string {
+	return []string{g.Field, g.Field + ".lat", g.Field + ".lon"}
+}
+
+// location returns the location of a hit from its stored fields,
+// using the first value of a field that has more than one value.
+func (g *queryGeoDistance) location(hit *search.DocumentMatch) (
+	geoPoint, bool) {
+	first := func(v interface{}) interface{} {
+		if vs, ok := v.([]interface{}); ok {
+			if len(vs) <= 0 {
+				return nil
+			}
+			return vs[0]
+		}
+		return v
+	}
+
+	lat, lon := first(hit.Fields[g.Field+".lat"]),
+		first(hit.Fields[g.Field+".lon"])
+	if lat != nil && lon != nil {
+		return parseGeoDistancePoint(
+			map[string]interface{}{"lat": lat, "lon": lon})
+	}
+	if s, ok := first(hit.Fields[g.Field]).(string); ok {
+		return parseGeoDistancePoint(s)
+	}
+	return geoPoint{}, false
+}
+
+// gatherRequest returns the search request to gather, which loads the
+// location fields, and whose window of hits is sorted when the
+// geoDistance has a sort.
+func (g *queryGeoDistance) gatherRequest(req *bleve.SearchRequest) *bleve.SearchRequest {
+	r := *req
+
+	r.Fields = append([]string(nil), req.Fields...)
+	for _, field := range g.fields() {
+		if !queryFieldsMatch(field, r.Fields) {
+			r.Fields = append(r.Fields, field)
+		}
+	}
+
+	if g.Sort != "" {
+		n := req.From + req.Size
+		r.From = 0
+		r.Size = QUERY_GEO_DISTANCE_WINDOW_DEFAULT
+		if g.Window > 0 {
+			r.Size = g.Window
+		}
+		if r.Size < n {
+			r.Size = n
+		}
+	}
+
+	return &r
+}
+
+// distances returns the distances of the hits that have a location,
+// keyed by hit ID, in the unit.
+func (g *queryGeoDistance) distances(
+	hits search.DocumentMatchCollection) map[string]float64 {
+	rv := map[string]float64{}
+	for _, hit := range hits {
+		if p, ok := g.location(hit); ok {
+			rv[hit.ID] = geoDistanceMeters(g.origin, p) / g.factor
+		}
+	}
+	return rv
+}
+
+// sort orders the hits of a search result by their distances, when
+// the geoDistance has a sort, keeping the order of equal distances.
+func (g *queryGeoDistance) sort(sr *bleve.SearchResult,
+	distances map[string]float64) {
+	if g.Sort == "" {
+		return
+	}
+	sort.Stable(&queryGeoDistanceSorter{
+		hits:      sr.Hits,
+		distances: distances,
+		desc:      g.Sort == "desc",
+	})
+}
+
+// warning returns a warning when the sorted window of hits doesn't
+// hold every match, so closer hits may be beyond the window.
+func (g *queryGeoDistance) warning(sr *bleve.SearchResult,
+	window int) string {
+	if g.Sort == "" || sr.Total <= uint64(window) {
+		return ""
+	}
+	return fmt.Sprintf("geoDistance: only the top %d of %d hits by"+
+		" score were sorted by distance; please narrow the query, such"+
+		" as with a geo_shape query, or use a larger geoDistance window",
+		window, sr.Total)
+}
+
+// result returns the distances of the paged hits.
+func (g *queryGeoDistance) result(hits search.DocumentMatchCollection,
+	distances map[string]float64) *QueryGeoDistanceResult {
+	rv := &QueryGeoDistanceResult{
+		Field:     g.Field,
+		Unit:      g.Unit,
+		Distances: map[string]float64{},
+	}
+	for _, hit := range hits {
+		if d, exists := distances[hit.ID]; exists {
+			rv.Distances[hit.ID] = d
+		}
+	}
+	return rv
+}
+
+type queryGeoDistanceSorter struct {
+	hits      search.DocumentMatchCollection
+	distances map[string]float64
+	desc      bool
+}
+
+func (s *queryGeoDistanceSorter) Len() int { return len(s.hits) }
+
+func (s *queryGeoDistanceSorter) Swap(i, j int) {
+	s.hits[i], s.hits[j] = s.hits[j], s.hits[i]
+}
+
+func (s *queryGeoDistanceSorter) Less(i, j int) bool {
+	di, iok := s.distances[s.hits[i].ID]
+	dj, jok := s.distances[s.hits[j].ID]
+	if !iok || !jok {
+		return iok && !jok // Hits without a location sort last.
+	}
+	if s.desc {
+		return di > dj
+	}
+	return di < dj
+}
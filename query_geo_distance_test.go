@@ -0,0 +1,208 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"math"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+func TestQueryGeoDistanceParams(t *testing.T) {
+	g, err := queryGeoDistanceParams([]byte(`{"query":{}}`))
+	if err != nil || g != nil {
+		t.Errorf("expected no geoDistance, got: %#v, err: %v", g, err)
+	}
+
+	g, err = queryGeoDistanceParams([]byte(`{"geoDistance":{` +
+		`"field":"loc","origin":[-122.41,37.77],"unit":"KM","sort":"asc"}}`))
+	if err != nil || g == nil || g.origin != (geoPoint{-122.41, 37.77}) ||
+		g.factor != 1000 {
+		t.Errorf("expected geoDistance, got: %#v, err: %v", g, err)
+	}
+
+	g, err = queryGeoDistanceParams([]byte(`{"geoDistance":{` +
+		`"field":"loc","origin":"37.77, -122.41"}}`))
+	if err != nil || g == nil || g.origin != (geoPoint{-122.41, 37.77}) ||
+		g.Unit != "m" || g.factor != 1 {
+		t.Errorf("expected a lat,lon origin, got: %#v, err: %v", g, err)
+	}
+
+	for _, req := range []string{
+		`{"geoDistance":{"origin":[0,0]}}`,
+		`{"geoDistance":{"field":"loc"}}`,
+		`{"geoDistance":{"field":"loc","origin":[0,91]}}`,
+		`{"geoDistance":{"field":"loc","origin":{"lon":0}}}`,
+		`{"geoDistance":{"field":"loc","origin":"0;0"}}`,
+		`{"geoDistance":{"field":"loc","origin":[0,0],"unit":"s"}}`,
+		`{"geoDistance":{"field":"loc","origin":[0,0],"sort":"up"}}`,
+		`{"geoDistance":{"field":"loc","origin":[0,0],"window":-1}}`,
+		`{"geoDistance":{"field":"loc","origin":[0,0],"window":1000000}}`,
+	} {
+		_, err = queryGeoDistanceParams([]byte(req))
+		if err == nil {
+			t.Errorf("expected err, req: %s", req)
+		}
+	}
+}
+
+func TestGeoDistanceMeters(t *testing.T) {
+	tests := []struct {
+		a, b geoPoint
+		exp  float64
+	}{
+		{geoPoint{0, 0}, geoPoint{0, 0}, 0},
+		{geoPoint{0, 0}, geoPoint{0, 1}, 111195},
+		{geoPoint{0, 0}, geoPoint{180, 0}, math.Pi * geoEarthRadiusMeters},
+		// San Francisco to Los Angeles.
+		{geoPoint{-122.4194, 37.7749}, geoPoint{-118.2437, 34.0522}, 559121},
+	}
+	for i, test := range tests {
+		got := geoDistanceMeters(test.a, test.b)
+		if math.Abs(got-test.exp) > 1 {
+			t.Errorf("%d: expected: %f, got: %f", i, test.exp, got)
+		}
+	}
+}
+
+func TestQueryGeoDistanceGatherRequest(t *testing.T) {
+	req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 10, 20, false)
+	req.Fields = []string{"title"}
+
+	g := &queryGeoDistance{Field: "loc"}
+	r := g.gatherRequest(req)
+	if r.From != 20 || r.Size != 10 || len(r.Fields) != 4 ||
+		r.Fields[2] != "loc.lat" || len(req.Fields) != 1 {
+		t.Errorf("unexpected gather request: %#v", r)
+	}
+
+	g = &queryGeoDistance{Field: "loc", Sort: "asc"}
+	r = g.gatherRequest(req)
+	if r.From != 0 || r.Size != QUERY_GEO_DISTANCE_WINDOW_DEFAULT {
+		t.Errorf("expected the default window, got: %#v", r)
+	}
+
+	req.Fields = []string{"*"}
+	g = &queryGeoDistance{Field: "loc", Sort: "asc", Window: 5}
+	r = g.gatherRequest(req)
+	if r.Size != 30 || len(r.Fields) != 1 {
+		t.Errorf("expected the window to be at least from+size, got: %#v", r)
+	}
+}
+
+func TestQueryGeoDistanceSort(t *testing.T) {
+	sr := &bleve.SearchResult{
+		Total: 100,
+		Hits: search.DocumentMatchCollection{
+			&search.DocumentMatch{ID: "a", Fields: map[string]interface{}{
+				"loc.lat": 0.0, "loc.lon": 2.0}},
+			&search.DocumentMatch{ID: "b", Fields: map[string]interface{}{}},
+			&search.DocumentMatch{ID: "c", Fields: map[string]interface{}{
+				"loc": "0,1"}},
+			&search.DocumentMatch{ID: "d", Fields: map[string]interface{}{
+				"loc.lat": []interface{}{0.0, 5.0},
+				"loc.lon": []interface{}{3.0, 5.0}}},
+			&search.DocumentMatch{ID: "e", Fields: map[string]interface{}{
+				"loc": "0,2"}},
+			&search.DocumentMatch{ID: "f", Fields: map[string]interface{}{
+				"loc": "nowhere"}},
+		},
+	}
+
+	g := &queryGeoDistance{Field: "loc", Unit: "km", Sort: "asc",
+		origin: geoPoint{0, 0}, factor: 1000}
+	distances := g.distances(sr.Hits)
+	if len(distances) != 4 || math.Abs(distances["c"]-111.195) > 0.001 {
+		t.Errorf("unexpected distances: %v", distances)
+	}
+
+	g.sort(sr, distances)
+	ids := ""
+	for _, hit := range sr.Hits {
+		ids += hit.ID
+	}
+	if ids != "caedbf" {
+		t.Errorf("unexpected sorted hits: %s", ids)
+	}
+
+	g.Sort = "desc"
+	g.sort(sr, distances)
+	ids = ""
+	for _, hit := range sr.Hits {
+		ids += hit.ID
+	}
+	if ids != "daecbf" {
+		t.Errorf("unexpected desc sorted hits: %s", ids)
+	}
+
+	gr := g.result(sr.Hits[:2], distances)
+	if gr.Field != "loc" || gr.Unit != "km" || len(gr.Distances) != 2 ||
+		gr.Distances["d"] != distances["d"] {
+		t.Errorf("unexpected result: %#v", gr)
+	}
+
+	if g.warning(sr, 20) == "" {
+		t.Errorf("expected a warning for a partial window")
+	}
+	if g.warning(sr, 200) != "" {
+		t.Errorf("expected no warning when the window had every hit")
+	}
+	g.Sort = ""
+	if g.warning(sr, 20) != "" {
+		t.Errorf("expected no warning without a sort")
+	}
+}
+
+func TestQueryGeoDistanceIndex(t *testing.T) {
+	bindex, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, doc := range map[string]interface{}{
+		"sf": map[string]interface{}{"city": "sf",
+			"loc": map[string]interface{}{"lat": 37.7749, "lon": -122.4194}},
+		"la": map[string]interface{}{"city": "la",
+			"loc": map[string]interface{}{"lat": 34.0522, "lon": -118.2437}},
+		"oak": map[string]interface{}{"city": "oak", "loc": "37.8044,-122.2712"},
+	} {
+		if err = bindex.Index(id, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g, err := queryGeoDistanceParams([]byte(`{"geoDistance":{"field":"loc",` +
+		`"origin":{"lat":37.7749,"lon":-122.4194},"unit":"km","sort":"desc"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 2, 0, false)
+	sr, err := bindex.Search(g.gatherRequest(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	distances := g.distances(sr.Hits)
+	g.sort(sr, distances)
+	searchResultPage(sr, req)
+
+	if len(sr.Hits) != 2 || sr.Hits[0].ID != "la" || sr.Hits[1].ID != "oak" {
+		t.Errorf("unexpected hits: %v", sr.Hits)
+	}
+	gr := g.result(sr.Hits, distances)
+	if len(gr.Distances) != 2 || math.Abs(gr.Distances["la"]-559.12) > 0.01 ||
+		math.Abs(gr.Distances["oak"]-13.4) > 0.1 {
+		t.Errorf("unexpected distances: %v", gr.Distances)
+	}
+}
@@ -0,0 +1,324 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+// Each pindex computes the IDF of a term from its own docs, so the
+// score of a doc depends on which pindex the doc landed in.  A query
+// with a ctl of {"globalScoring": true} is instead scored with global
+// IDF's, similar to a DFS query-then-fetch...
+//
+//   1) the candidates phase: the pindexes are searched with
+//      explanations for a window of their top hits, which is by
+//      default QUERY_RESCORE_WINDOW_DEFAULT hits, and at least
+//      from+size, or the ctl's rescoreWindow;
+//   2) the stats phase: the terms of the candidates' explanations
+//      are gathered, and the doc frequency of each term and the doc
+//      count are summed across all the pindexes, including the
+//      pindexes that have no candidates;
+//   3) the scoring phase: each candidate's explanation is recomputed
+//      with the global IDF's, the candidates are re-sorted by their
+//      new scores, and then paged by from and size.
+//
+// As the queryNorm only scales the scores of all hits equally, it's
+// recomputed from the gathered terms.  The pindexes can't score with
+// stats that are given to them, so the candidates are still selected
+// by their local scores, which makes the global scoring approximate:
+// a doc outside the window of every pindex isn't rescored.  The
+// result has a warning when the query matched more docs than the
+// window, where a larger rescoreWindow is more accurate.
+
+// The default number of top hits that are rescored.
+const QUERY_RESCORE_WINDOW_DEFAULT = 1000
+
+// The max number of top hits that are rescored.
+const QUERY_RESCORE_WINDOW_MAX = 10000
+
+type queryGlobalScoringCtlParams struct {
+	Ctl struct {
+		GlobalScoring bool `json:"globalScoring"`
+		RescoreWindow int  `json:"rescoreWindow"`
+	} `json:"ctl"`
+}
+
+// queryGlobalScoring returns true when a query request asks for
+// scoring with global IDF's.
+func queryGlobalScoring(req []byte) bool {
+	var p queryGlobalScoringCtlParams
+	err := json.Unmarshal(req, &p)
+	return err == nil && p.Ctl.GlobalScoring
+}
+
+// queryRescoreWindow returns the rescoreWindow of a query request,
+// or 0 for the default.
+func queryRescoreWindow(req []byte) (int, error) {
+	var p queryGlobalScoringCtlParams
+	err := json.Unmarshal(req, &p)
+	if err != nil {
+		return 0, err
+	}
+	if p.Ctl.RescoreWindow < 0 ||
+		p.Ctl.RescoreWindow > QUERY_RESCORE_WINDOW_MAX {
+		return 0, fmt.Errorf("query_global_idf: rescoreWindow must be"+
+			" between 0 and %d", QUERY_RESCORE_WINDOW_MAX)
+	}
+	return p.Ctl.RescoreWindow, nil
+}
+
+// queryRescoreGatherRequest returns the request that gathers the
+// candidates of a rescoring, with their explanations.
+func queryRescoreGatherRequest(req *bleve.SearchRequest,
+	window int) *bleve.SearchRequest {
+	r := *req
+	r.From = 0
+	r.Size = QUERY_RESCORE_WINDOW_DEFAULT
+	if window > 0 {
+		r.Size = window
+	}
+	if r.Size < req.From+req.Size {
+		r.Size = req.From + req.Size
+	}
+	r.Explain = true
+	return &r
+}
+
+// queryRescoreWarning returns a warning when the rescored window of
+// candidates doesn't hold every match.
+func queryRescoreWarning(sr *bleve.SearchResult, window int) string {
+	if sr.Total <= uint64(window) {
+		return ""
+	}
+	return fmt.Sprintf("rescoring: only the top %d of %d hits by their"+
+		" local scores were rescored, so the scores are approximate;"+
+		" please use a larger ctl rescoreWindow for more accuracy",
+		window, sr.Total)
+}
+
+// A globalIDFTerm is a term of a field, as found in explanations.
+type globalIDFTerm struct {
+	Field string
+	Term  string
+}
+
+// globalIDFTermFromMessage parses the field and term out of a term
+// scorer's explanation message, like "fieldWeight(desc:beer in doc1),
+// product of:" or "queryWeight(desc:beer^1.000000), product of:",
+// also returning the boost of a queryWeight message.
+func globalIDFTermFromMessage(msg string) (*globalIDFTerm, float64, bool) {
+	boost := 1.0
+
+	var s string
+	switch {
+	case strings.HasPrefix(msg, "fieldWeight("):
+		s = strings.TrimPrefix(msg, "fieldWeight(")
+		i := strings.LastIndex(s, " in ")
+		if i < 0 {
+			return nil, 0, false
+		}
+		s = s[:i]
+	case strings.HasPrefix(msg, "queryWeight("):
+		s = strings.TrimPrefix(msg, "queryWeight(")
+		s = strings.TrimSuffix(s, "), product of:")
+		i := strings.LastIndex(s, "^")
+		if i < 0 {
+			return nil, 0, false
+		}
+		b, err := strconv.ParseFloat(s[i+1:], 64)
+		if err == nil {
+			boost = b
+		}
+		s = s[:i]
+	default:
+		return nil, 0, false
+	}
+
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return nil, 0, false
+	}
+
+	return &globalIDFTerm{Field: s[:i], Term: s[i+1:]}, boost, true
+}
+
+// globalIDFTerms gathers the terms, and their boosts, of the idf's in
+// an explanation tree.
+func globalIDFTerms(e *search.Explanation, rv map[globalIDFTerm]float64) {
+	if e == nil {
+		return
+	}
+	for _, c := range e.Children {
+		if c != nil && strings.HasPrefix(c.Message, "idf(") {
+			t, boost, ok := globalIDFTermFromMessage(e.Message)
+			if ok {
+				if _, exists := rv[*t]; !exists ||
+					strings.HasPrefix(e.Message, "queryWeight(") {
+					rv[*t] = boost
+				}
+			}
+		}
+		globalIDFTerms(c, rv)
+	}
+}
+
+// globalIDF returns the IDF of a term the same way as bleve's term
+// scorer, but from the global stats.
+func globalIDF(docFreq, docTotal uint64) float64 {
+	return 1.0 + math.Log(float64(docTotal)/float64(docFreq+1.0))
+}
+
+// globalIDFStats sums the doc count and the doc frequencies of the
+// terms across the targets.
+func globalIDFStats(targets []bleve.Index, terms map[globalIDFTerm]float64) (
+	uint64, map[globalIDFTerm]uint64, error) {
+	type stats struct {
+		docTotal uint64
+		docFreqs map[globalIDFTerm]uint64
+		err      error
+	}
+
+	statsCh := make(chan *stats, len(targets))
+
+	for _, target := range targets {
+		go func(target bleve.Index) {
+			s := &stats{docFreqs: map[globalIDFTerm]uint64{}}
+			s.docTotal, s.err = target.DocCount()
+			for t := range terms {
+				if s.err != nil {
+					break
+				}
+				q := bleve.NewTermQuery(t.Term)
+				q.SetField(t.Field)
+				var sr *bleve.SearchResult
+				sr, s.err = target.Search(
+					bleve.NewSearchRequestOptions(q, 0, 0, false))
+				if sr != nil {
+					s.docFreqs[t] = sr.Total
+				}
+			}
+			statsCh <- s
+		}(target)
+	}
+
+	var docTotal uint64
+	docFreqs := map[globalIDFTerm]uint64{}
+
+	var err error
+	for range targets {
+		s := <-statsCh
+		if s.err != nil {
+			err = s.err
+			continue
+		}
+		docTotal += s.docTotal
+		for t, n := range s.docFreqs {
+			docFreqs[t] += n
+		}
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("query_global_idf: stats, err: %v", err)
+	}
+
+	return docTotal, docFreqs, nil
+}
+
+// globalIDFRescore recomputes the value of an explanation tree with
+// the global IDF's and queryNorm, returning the new value.
+func globalIDFRescore(e *search.Explanation, parentMsg string,
+	idfs map[globalIDFTerm]float64, queryNorm float64) float64 {
+	if len(e.Children) <= 0 {
+		if strings.HasPrefix(e.Message, "idf(") {
+			t, _, ok := globalIDFTermFromMessage(parentMsg)
+			if ok {
+				if idf, exists := idfs[*t]; exists {
+					e.Value = idf
+				}
+			}
+		} else if e.Message == "queryNorm" {
+			e.Value = queryNorm
+		}
+		return e.Value
+	}
+
+	var product, sum float64 = 1.0, 0.0
+	for _, c := range e.Children {
+		if c == nil {
+			continue
+		}
+		v := globalIDFRescore(c, e.Message, idfs, queryNorm)
+		product = product * v
+		sum = sum + v
+	}
+
+	if strings.HasSuffix(e.Message, "product of:") {
+		e.Value = product
+	} else if strings.HasSuffix(e.Message, "sum of:") {
+		e.Value = sum
+	}
+
+	return e.Value
+}
+
+// globalIDFScoring rescores the hits of a search result, which must
+// have explanations, with the global IDF's of the terms, where the
+// stats come from the targets, and then reorders the hits.
+func globalIDFScoring(sr *bleve.SearchResult, targets []bleve.Index,
+	explain bool, sortHits func(search.DocumentMatchCollection)) error {
+	terms := map[globalIDFTerm]float64{}
+	for _, hit := range sr.Hits {
+		globalIDFTerms(hit.Expl, terms)
+	}
+
+	docTotal, docFreqs, err := globalIDFStats(targets, terms)
+	if err != nil {
+		return err
+	}
+
+	idfs := map[globalIDFTerm]float64{}
+	sumOfSquaredWeights := 0.0
+	for t, boost := range terms {
+		idfs[t] = globalIDF(docFreqs[t], docTotal)
+		w := boost * idfs[t]
+		sumOfSquaredWeights += w * w
+	}
+
+	queryNorm := 1.0
+	if sumOfSquaredWeights > 0 {
+		queryNorm = 1.0 / math.Sqrt(sumOfSquaredWeights)
+	}
+
+	sr.MaxScore = 0
+	for _, hit := range sr.Hits {
+		if hit.Expl != nil {
+			hit.Score = globalIDFRescore(hit.Expl, "", idfs, queryNorm)
+		}
+		if hit.Score > sr.MaxScore {
+			sr.MaxScore = hit.Score
+		}
+		if !explain {
+			hit.Expl = nil
+		}
+	}
+
+	sortHits(sr.Hits)
+
+	return nil
+}
@@ -0,0 +1,162 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+func TestQueryGlobalScoring(t *testing.T) {
+	if queryGlobalScoring([]byte(`{"query":{}}`)) {
+		t.Errorf("expected no globalScoring")
+	}
+	if !queryGlobalScoring([]byte(`{"ctl":{"globalScoring":true}}`)) {
+		t.Errorf("expected globalScoring")
+	}
+}
+
+func TestGlobalIDFTermFromMessage(t *testing.T) {
+	term, boost, ok := globalIDFTermFromMessage(
+		"fieldWeight(desc:beer in doc1), product of:")
+	if !ok || term.Field != "desc" || term.Term != "beer" || boost != 1.0 {
+		t.Errorf("unexpected fieldWeight parse: %#v, %f, %v", term, boost, ok)
+	}
+
+	term, boost, ok = globalIDFTermFromMessage(
+		"queryWeight(desc:beer^2.000000), product of:")
+	if !ok || term.Field != "desc" || term.Term != "beer" || boost != 2.0 {
+		t.Errorf("unexpected queryWeight parse: %#v, %f, %v", term, boost, ok)
+	}
+
+	_, _, ok = globalIDFTermFromMessage("sum of:")
+	if ok {
+		t.Errorf("expected no parse")
+	}
+}
+
+func TestGlobalIDFScoring(t *testing.T) {
+	// Index a has "beer" in 1 of 10 docs, while index b has "beer"
+	// in all of its docs, so their local IDF's differ a lot.
+	a, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Index("a0", map[string]interface{}{"desc": "beer"})
+	for i := 1; i < 10; i++ {
+		a.Index(fmt.Sprintf("a%d", i), map[string]interface{}{"desc": "wine"})
+	}
+	for i := 0; i < 5; i++ {
+		b.Index(fmt.Sprintf("b%d", i), map[string]interface{}{"desc": "beer"})
+	}
+
+	targets := []bleve.Index{a, b}
+
+	q := bleve.NewMatchQuery("beer")
+	q.SetField("desc")
+
+	req := bleve.NewSearchRequestOptions(q, 10, 0, true)
+
+	sr, err := bleve.NewIndexAlias(targets...).Search(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sr.Hits) != 6 {
+		t.Fatalf("expected 6 hits, got: %d", len(sr.Hits))
+	}
+	if sr.Hits[0].ID != "a0" {
+		t.Errorf("expected local IDF's to rank a0 first, got: %s",
+			sr.Hits[0].ID)
+	}
+
+	err = globalIDFScoring(sr, targets, false,
+		func(hits search.DocumentMatchCollection) {
+			QueryMergeByScore(req, "_id", hits)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hit := range sr.Hits {
+		if math.Abs(hit.Score-sr.Hits[0].Score) > 1e-9 {
+			t.Errorf("expected equal global scores, hit: %s, score: %f,"+
+				" first score: %f", hit.ID, hit.Score, sr.Hits[0].Score)
+		}
+		if hit.Expl != nil {
+			t.Errorf("expected explanations to be removed")
+		}
+	}
+	if sr.MaxScore != sr.Hits[0].Score {
+		t.Errorf("expected MaxScore to be recomputed")
+	}
+}
+
+func TestQueryRescoreWindow(t *testing.T) {
+	tests := []struct {
+		req    string
+		window int
+		err    bool
+	}{
+		{`{"query":{}}`, 0, false},
+		{`{"ctl":{"rescoreWindow":50}}`, 50, false},
+		{`{"ctl":{"rescoreWindow":-1}}`, 0, true},
+		{`{"ctl":{"rescoreWindow":10001}}`, 0, true},
+	}
+	for _, test := range tests {
+		window, err := queryRescoreWindow([]byte(test.req))
+		if (err != nil) != test.err || window != test.window {
+			t.Errorf("req: %s, window: %d, err: %v",
+				test.req, window, err)
+		}
+	}
+}
+
+func TestQueryRescoreGatherRequest(t *testing.T) {
+	req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(),
+		10, 20, false)
+
+	r := queryRescoreGatherRequest(req, 0)
+	if r.From != 0 || r.Size != QUERY_RESCORE_WINDOW_DEFAULT || !r.Explain {
+		t.Errorf("expected the default window, got: %#v", r)
+	}
+	if req.From != 20 || req.Size != 10 || req.Explain {
+		t.Errorf("expected the request to be unchanged, got: %#v", req)
+	}
+
+	r = queryRescoreGatherRequest(req, 5)
+	if r.Size != 30 {
+		t.Errorf("expected a window of at least from+size, got: %d", r.Size)
+	}
+
+	r = queryRescoreGatherRequest(req, 100)
+	if r.Size != 100 {
+		t.Errorf("expected the rescoreWindow, got: %d", r.Size)
+	}
+}
+
+func TestQueryRescoreWarning(t *testing.T) {
+	if queryRescoreWarning(&bleve.SearchResult{Total: 100}, 100) != "" {
+		t.Errorf("expected no warning when the window holds every hit")
+	}
+	if queryRescoreWarning(&bleve.SearchResult{Total: 101}, 100) == "" {
+		t.Errorf("expected a warning when the window is exceeded")
+	}
+}
@@ -0,0 +1,197 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+// A query request may group its hits by the value of a field, like...
+//
+//   {"query": {...}, "size": 10,
+//    "group": {"field": "category",
+//              "size": 3,          // Optional, the hits per group.
+//              "window": 1000}}    // Optional.
+//
+// which returns the top hits of each group, as the "groups" of the
+// result, ordered by each group's best hit, with the group's value,
+// the total number of matching docs in the group, and the IDs of the
+// group's hits.  The from and size of the request page through the
+// groups, and the hits of the result are the hits of the groups of
+// the page, in order.  Like a collapse (see query_collapse.go), the
+// grouping is of the merged hits of all the pindexes, within a window
+// of the top hits, the group totals are summed across the pindexes,
+// and hits without a value of the field aren't in any group.
+
+// The default number of hits of each group.
+const QUERY_GROUP_DEFAULT_SIZE = 3
+
+type queryGrouping struct {
+	Field  string `json:"field"`
+	Size   int    `json:"size"`
+	Window int    `json:"window"`
+}
+
+// QueryGroupsResult holds the groups of the hits of a grouped query.
+type QueryGroupsResult struct {
+	Field  string        `json:"field"`
+	Groups []*QueryGroup `json:"groups"`
+}
+
+// QueryGroup is a group of the hits of a grouped query.
+type QueryGroup struct {
+	Value  interface{} `json:"value"`
+	Total  uint64      `json:"total"`
+	HitIDs []string    `json:"hitIds"`
+}
+
+// queryGroupingParams returns the grouping of a query request, or nil.
+func queryGroupingParams(req []byte) (*queryGrouping, error) {
+	var p struct {
+		Group    *queryGrouping  `json:"group"`
+		Collapse json.RawMessage `json:"collapse"`
+	}
+	err := json.Unmarshal(req, &p)
+	if err != nil {
+		return nil, err
+	}
+	g := p.Group
+	if g == nil {
+		return nil, nil
+	}
+	if len(p.Collapse) > 0 {
+		return nil, fmt.Errorf("query_group: a query can't have both" +
+			" a group and a collapse")
+	}
+	if g.Field == "" {
+		return nil, fmt.Errorf("query_group: group needs a field")
+	}
+	if g.Size < 0 {
+		return nil, fmt.Errorf("query_group: size must be >= 0")
+	}
+	if g.Size == 0 {
+		g.Size = QUERY_GROUP_DEFAULT_SIZE
+	}
+	if g.Window < 0 || g.Window > QUERY_COLLAPSE_WINDOW_MAX {
+		return nil, fmt.Errorf("query_group: window must be"+
+			" between 0 and %d", QUERY_COLLAPSE_WINDOW_MAX)
+	}
+	return g, nil
+}
+
+// gatherRequest returns the search request to gather, which loads the
+// group field, and whose window of hits is grouped.
+func (g *queryGrouping) gatherRequest(req *bleve.SearchRequest) *bleve.SearchRequest {
+	c := &queryCollapse{Field: g.Field, Window: g.Window}
+	if c.Window <= 0 {
+		// Enough hits for every group of the page to be full.
+		r := *req
+		r.From = 0
+		r.Size = (req.From + req.Size) * g.Size
+		return c.gatherRequest(&r)
+	}
+	return c.gatherRequest(req)
+}
+
+// group replaces the sorted hits of a search result with the hits of
+// the page of groups of a search request, returning the groups, and a
+// warning when the groups of a full window don't fill the page.
+func (g *queryGrouping) group(sr *bleve.SearchResult,
+	req *bleve.SearchRequest, window int) (*QueryGroupsResult, string) {
+	var groups []*QueryGroup
+	groupsByKey := map[string]*QueryGroup{}
+	hitsByID := map[string]*search.DocumentMatch{}
+
+	for _, hit := range sr.Hits {
+		v, key, ok := queryCollapseValue(hit, g.Field)
+		if !ok {
+			continue
+		}
+		qg := groupsByKey[key]
+		if qg == nil {
+			qg = &QueryGroup{Value: v}
+			groupsByKey[key] = qg
+			groups = append(groups, qg)
+		}
+		if len(qg.HitIDs) < g.Size {
+			qg.HitIDs = append(qg.HitIDs, hit.ID)
+			hitsByID[hit.ID] = hit
+		}
+	}
+
+	warning := ""
+	if sr.Total > uint64(window) && len(groups) < req.From+req.Size {
+		warning = fmt.Sprintf("group: only %d groups were found in the"+
+			" top %d hits, so there may be more groups; please use a"+
+			" larger group window", len(groups), window)
+	}
+
+	if req.From < len(groups) {
+		groups = groups[req.From:]
+	} else {
+		groups = groups[:0]
+	}
+	if req.Size < len(groups) {
+		groups = groups[:req.Size]
+	}
+
+	hits := make(search.DocumentMatchCollection, 0, len(groups)*g.Size)
+	for _, qg := range groups {
+		for _, id := range qg.HitIDs {
+			hits = append(hits, hitsByID[id])
+		}
+	}
+	sr.Hits = hits
+
+	return &QueryGroupsResult{Field: g.Field, Groups: groups}, warning
+}
+
+// totals sets the number of docs that match the query in each group,
+// summed across the targets, returning a warning when some groups may
+// be missing hits that were beyond the window.
+func (g *queryGrouping) totals(req []byte, gr *QueryGroupsResult,
+	targets []bleve.Index) (string, error) {
+	if len(gr.Groups) <= 0 {
+		return "", nil
+	}
+
+	values := map[string]interface{}{}
+	for i, qg := range gr.Groups {
+		values[fmt.Sprintf("%d", i)] = qg.Value
+	}
+
+	counts, err := queryFieldValueCounts(req, g.Field, values, targets)
+	if err != nil {
+		return "", err
+	}
+
+	var partial []string
+	for i, qg := range gr.Groups {
+		qg.Total = counts[fmt.Sprintf("%d", i)]
+		if len(qg.HitIDs) < g.Size && qg.Total > uint64(len(qg.HitIDs)) {
+			partial = append(partial, fmt.Sprintf("%v", qg.Value))
+		}
+	}
+	if len(partial) <= 0 {
+		return "", nil
+	}
+	sort.Strings(partial)
+
+	return fmt.Sprintf("group: some groups may be missing hits that"+
+		" were beyond the group window, groups: %v; please use a larger"+
+		" group window", partial), nil
+}
@@ -0,0 +1,167 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+func TestQueryGroupingParams(t *testing.T) {
+	g, err := queryGroupingParams([]byte(`{"query":{}}`))
+	if err != nil || g != nil {
+		t.Errorf("expected no grouping, got: %#v, err: %v", g, err)
+	}
+
+	g, err = queryGroupingParams([]byte(`{"group":{"field":"c"}}`))
+	if err != nil || g == nil || g.Field != "c" ||
+		g.Size != QUERY_GROUP_DEFAULT_SIZE {
+		t.Errorf("expected grouping, got: %#v, err: %v", g, err)
+	}
+
+	for _, req := range []string{
+		`{"group":{}}`,
+		`{"group":{"field":"c","size":-1}}`,
+		`{"group":{"field":"c","window":1000000}}`,
+		`{"group":{"field":"c"},"collapse":{"field":"c"}}`,
+	} {
+		_, err = queryGroupingParams([]byte(req))
+		if err == nil {
+			t.Errorf("expected err, req: %s", req)
+		}
+	}
+}
+
+func TestQueryGroupingGatherRequest(t *testing.T) {
+	req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 10, 10, false)
+
+	g := &queryGrouping{Field: "c", Size: 2}
+	r := g.gatherRequest(req)
+	if r.From != 0 || r.Size != 20*2*QUERY_COLLAPSE_WINDOW_FACTOR ||
+		len(r.Fields) != 1 || r.Fields[0] != "c" {
+		t.Errorf("unexpected gather request: %#v", r)
+	}
+
+	g = &queryGrouping{Field: "c", Size: 2, Window: 100}
+	r = g.gatherRequest(req)
+	if r.From != 0 || r.Size != 100 {
+		t.Errorf("expected the window, got: %#v", r)
+	}
+}
+
+func TestQueryGroup(t *testing.T) {
+	hit := func(id string, c interface{}) *search.DocumentMatch {
+		fields := map[string]interface{}{}
+		if c != nil {
+			fields["c"] = c
+		}
+		return &search.DocumentMatch{ID: id, Fields: fields}
+	}
+
+	sr := &bleve.SearchResult{
+		Total: 100,
+		Hits: search.DocumentMatchCollection{
+			hit("a", "x"), hit("b", "y"), hit("c", nil), hit("d", "x"),
+			hit("e", "x"), hit("f", 1.0), hit("g", "y"), hit("h", "z"),
+		},
+	}
+
+	g := &queryGrouping{Field: "c", Size: 2}
+	req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 2, 1, false)
+
+	gr, warning := g.group(sr, req, 1000)
+	if warning != "" {
+		t.Errorf("expected no warning, got: %s", warning)
+	}
+	if len(gr.Groups) != 2 || gr.Groups[0].Value != "y" ||
+		gr.Groups[1].Value != 1.0 {
+		t.Fatalf("unexpected groups: %#v", gr.Groups)
+	}
+
+	ids := ""
+	for _, hit := range sr.Hits {
+		ids += hit.ID
+	}
+	if ids != "bgf" {
+		t.Errorf("expected the hits of the page of groups, got: %s", ids)
+	}
+
+	sr.Hits = search.DocumentMatchCollection{hit("a", "x")}
+	req = bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 2, 0, false)
+	gr, warning = g.group(sr, req, 10)
+	if warning == "" || len(gr.Groups) != 1 {
+		t.Errorf("expected a warning for a full window, got: %#v", gr)
+	}
+}
+
+func TestQueryGroupTotals(t *testing.T) {
+	a, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 9; i++ {
+		a.Index(fmt.Sprintf("a%d", i),
+			map[string]interface{}{"c": fmt.Sprintf("c%d", i%3)})
+		b.Index(fmt.Sprintf("b%d", i),
+			map[string]interface{}{"c": fmt.Sprintf("c%d", i%3)})
+	}
+
+	targets := []bleve.Index{a, b}
+	reqJSON := []byte(`{"query":{"match_all":{}},"size":2,` +
+		`"group":{"field":"c","size":2}}`)
+
+	g, err := queryGroupingParams(reqJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 2, 0, false)
+	gatherRequest := g.gatherRequest(req)
+	sr, _, err := queryGather(targets, []string{"a", "b"}, gatherRequest,
+		make(chan bool), func(hits search.DocumentMatchCollection) {
+			QueryMergeByScore(req, "_id", hits)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gr, _ := g.group(sr, req, gatherRequest.Size)
+	if len(gr.Groups) != 2 || len(sr.Hits) != 4 {
+		t.Fatalf("expected 2 groups of 2 hits, got: %#v, hits: %d",
+			gr.Groups, len(sr.Hits))
+	}
+
+	warning, err := g.totals(reqJSON, gr, targets)
+	if err != nil || warning != "" {
+		t.Fatalf("expected no err or warning, got: %s, err: %v", warning, err)
+	}
+	for _, qg := range gr.Groups {
+		if qg.Total != 6 {
+			t.Errorf("expected 6 docs across the pindexes, got: %#v", qg)
+		}
+	}
+
+	gr.Groups[0].HitIDs = gr.Groups[0].HitIDs[:1]
+	warning, err = g.totals(reqJSON, gr, targets)
+	if err != nil || !strings.Contains(warning, "missing hits") {
+		t.Errorf("expected a warning for a partial group, got: %s, err: %v",
+			warning, err)
+	}
+}
@@ -0,0 +1,49 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// A node can have a second, query-only REST listener (the
+// bindHttpQuery command-line parameter), so that the query endpoints
+// can be exposed on an application network while the index
+// management, cfg and node-to-node endpoints stay on the internal
+// network of the main listener (bindHttp).  The query endpoints are
+// an explicit allowlist of the queries and counts of indexes,
+// including index aliases, which are queried like any other index.
+
+var queryListenerPathRE = regexp.MustCompile(
+	`^/api/(v1/)?index/[^/]+/(query|count)$`)
+
+// IsQueryRequest returns true if a request is to a query endpoint.
+func IsQueryRequest(req *http.Request) bool {
+	return queryListenerPathRE.MatchString(req.URL.Path)
+}
+
+// QueryListenerHandler returns the handler of a query-only listener,
+// where requests to other endpoints are not found (404).
+func QueryListenerHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !IsQueryRequest(req) {
+			rest.ShowError(w, req, "not a query endpoint on this listener",
+				http.StatusNotFound)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,58 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQueryListenerHandler(t *testing.T) {
+	h := QueryListenerHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+
+	tests := []struct {
+		method string
+		path   string
+		exp    int
+	}{
+		{"POST", "/api/index/x/query", 200},
+		{"POST", "/api/v1/index/x/query", 200},
+		{"GET", "/api/index/x/count", 200},
+		{"POST", "/api/index/pindexes/query", 200},
+		{"GET", "/api/index", 404},
+		{"PUT", "/api/index/x", 404},
+		{"GET", "/api/cfg", 404},
+		{"GET", "/debug/vars", 404},
+		{"GET", "/", 404},
+		{"POST", "/api/pindex/x_123/query", 404},
+		{"POST", "/api/v1/pindex/x_123/query", 404},
+		{"GET", "/api/pindex-bleve/x_123/doc/a", 404},
+		{"POST", "/api/index/x/sample", 404},
+		{"POST", "/api/index/x/percolate", 404},
+		{"GET", "/api/index/x/facetSuggestions", 404},
+		{"POST", "/api/index/x/query/more", 404},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "http://x"+test.path, nil)
+		record := httptest.NewRecorder()
+		h.ServeHTTP(record, req)
+		if record.Code != test.exp {
+			t.Errorf("%s %s, expected: %d, got: %d",
+				test.method, test.path, test.exp, record.Code)
+		}
+	}
+}
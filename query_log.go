@@ -0,0 +1,419 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/couchbase/clog"
+	"github.com/couchbase/go-couchbase"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// Each node keeps a daily (UTC) query log of its slow queries, its
+// per-index query stats rollups and its per-index advisor findings
+// (the counts of query warnings).  After each day ends, the day's
+// query log is exported to the queryLogExport target of the cluster
+// settings, so that long-term trending lives somewhere durable even
+// when cbft nodes are replaced.  The target is either a directory
+// path or a Couchbase bucket URL, like "couchbase://HOST:8091/BUCKET".
+//
+// The exported schema is a QueryLogDay JSON document, whose bucket
+// key is "cbft-query-log::DATE::NODE_UUID" or whose file name is
+// "cbft-query-log-DATE-NODE_UUID.json", where DATE is like
+// "2015-06-30".
+
+// The type field of an exported QueryLogDay document.
+const QUERY_LOG_DOC_TYPE = "cbftQueryLog"
+
+// The default duration beyond which a query is logged as slow, when
+// the cluster settings have no slowQueryThresholdMS.
+var QueryLogDefaultSlowThreshold = time.Second
+
+// The max number of slow queries kept per day.
+var QueryLogMaxSlowQueries = 1000
+
+// The max length of a logged slow query request.
+var QueryLogMaxRequestLen = 2000
+
+// How often the exporter checks whether a day has ended.
+var QueryLogExportInterval = time.Minute
+
+// QueryLogDay is the query log of a node for a single day, which is
+// also the schema of the exported documents.
+type QueryLogDay struct {
+	Type        string                       `json:"type"`
+	NodeUUID    string                       `json:"nodeUUID"`
+	Date        string                       `json:"date"`
+	SlowQueries []*SlowQuery                 `json:"slowQueries"`
+	Rollups     map[string]*QueryRollup      `json:"rollups"`  // Keyed by index name.
+	Findings    map[string]map[string]uint64 `json:"findings"` // Keyed by index name, then finding.
+
+	// The number of slow queries that weren't kept, due to
+	// QueryLogMaxSlowQueries.
+	SlowQueriesDropped uint64 `json:"slowQueriesDropped"`
+}
+
+// SlowQuery is a query that took longer than the slow query threshold.
+type SlowQuery struct {
+	Time       string `json:"time"`
+	IndexName  string `json:"indexName"`
+	DurationMS int64  `json:"durationMS"`
+	Request    string `json:"request"`
+	Error      string `json:"error,omitempty"`
+}
+
+// QueryRollup is the aggregate of the queries of an index in a day.
+type QueryRollup struct {
+	Count   uint64 `json:"count"`
+	Errors  uint64 `json:"errors"`
+	Slow    uint64 `json:"slow"`
+	TotalMS uint64 `json:"totalMS"`
+	MaxMS   uint64 `json:"maxMS"`
+}
+
+var queryLogM sync.Mutex // Protects the fields that follow.
+
+var queryLogCur *QueryLogDay
+var queryLogEnded []*QueryLogDay // Ended days, awaiting export.
+
+// The max number of ended days that are kept while exports fail.
+var QueryLogMaxEndedDays = 7
+
+var queryLogNow = time.Now // Overridable for testing.
+
+func newQueryLogDay(nodeUUID, date string) *QueryLogDay {
+	return &QueryLogDay{
+		Type:        QUERY_LOG_DOC_TYPE,
+		NodeUUID:    nodeUUID,
+		Date:        date,
+		SlowQueries: []*SlowQuery{},
+		Rollups:     map[string]*QueryRollup{},
+		Findings:    map[string]map[string]uint64{},
+	}
+}
+
+// queryLogDayLOCKED returns the current day's query log, ending the
+// previous day if needed.
+func queryLogDayLOCKED(nodeUUID string, now time.Time) *QueryLogDay {
+	date := now.UTC().Format("2006-01-02")
+	if queryLogCur != nil && queryLogCur.Date == date {
+		return queryLogCur
+	}
+
+	if queryLogCur != nil {
+		queryLogEnded = append(queryLogEnded, queryLogCur)
+		if len(queryLogEnded) > QueryLogMaxEndedDays {
+			queryLogEnded = queryLogEnded[len(queryLogEnded)-QueryLogMaxEndedDays:]
+		}
+	}
+
+	queryLogCur = newQueryLogDay(nodeUUID, date)
+
+	return queryLogCur
+}
+
+// queryLogRecord records a completed query into the query log.
+func queryLogRecord(nodeUUID, indexName string, req []byte,
+	startTime time.Time, err error, warnings []string) {
+	now := queryLogNow()
+	d := now.Sub(startTime)
+	ms := uint64(d / time.Millisecond)
+
+	threshold := QueryLogDefaultSlowThreshold
+	if s := CurrentClusterSettings(); s.SlowQueryThresholdMS > 0 {
+		threshold = time.Duration(s.SlowQueryThresholdMS) * time.Millisecond
+	}
+
+	queryLogM.Lock()
+	defer queryLogM.Unlock()
+
+	day := queryLogDayLOCKED(nodeUUID, now)
+
+	r := day.Rollups[indexName]
+	if r == nil {
+		r = &QueryRollup{}
+		day.Rollups[indexName] = r
+	}
+	r.Count++
+	r.TotalMS += ms
+	if r.MaxMS < ms {
+		r.MaxMS = ms
+	}
+	if err != nil {
+		r.Errors++
+	}
+
+	if len(warnings) > 0 {
+		f := day.Findings[indexName]
+		if f == nil {
+			f = map[string]uint64{}
+			day.Findings[indexName] = f
+		}
+		for _, warning := range warnings {
+			f[warning]++
+		}
+	}
+
+	if d < threshold {
+		return
+	}
+
+	r.Slow++
+
+	if len(day.SlowQueries) >= QueryLogMaxSlowQueries {
+		day.SlowQueriesDropped++
+		return
+	}
+
+	sq := &SlowQuery{
+		Time:       startTime.UTC().Format(time.RFC3339Nano),
+		IndexName:  indexName,
+		DurationMS: int64(ms),
+		Request:    string(req),
+	}
+	if len(sq.Request) > QueryLogMaxRequestLen {
+		sq.Request = sq.Request[:QueryLogMaxRequestLen] + "..."
+	}
+	if err != nil {
+		sq.Error = err.Error()
+	}
+	day.SlowQueries = append(day.SlowQueries, sq)
+}
+
+// CurrentQueryLogDay returns a copy of the node's query log for the
+// current day.
+func CurrentQueryLogDay(nodeUUID string) *QueryLogDay {
+	queryLogM.Lock()
+	defer queryLogM.Unlock()
+
+	day := queryLogDayLOCKED(nodeUUID, queryLogNow())
+
+	buf, _ := json.Marshal(day)
+	rv := &QueryLogDay{}
+	json.Unmarshal(buf, rv)
+	return rv
+}
+
+// CurrentQueryRollups returns the date and a copy of the per-index
+// query rollups of the node's query log for the current day.
+func CurrentQueryRollups(nodeUUID string) (string, map[string]QueryRollup) {
+	queryLogM.Lock()
+	defer queryLogM.Unlock()
+
+	day := queryLogDayLOCKED(nodeUUID, queryLogNow())
+
+	rv := make(map[string]QueryRollup, len(day.Rollups))
+	for indexName, r := range day.Rollups {
+		rv[indexName] = *r
+	}
+	return day.Date, rv
+}
+
+// ---------------------------------------------------------
+
+// parseQueryLogExport validates a queryLogExport target, returning
+// the couchbase server URL and bucket name of a bucket target, or ""
+// for a directory target.
+func parseQueryLogExport(target string) (
+	server, bucket string, err error) {
+	if !strings.HasPrefix(target, "couchbase://") {
+		if !filepath.IsAbs(target) {
+			return "", "", fmt.Errorf("query_log: queryLogExport must be"+
+				" an absolute directory path or a couchbase:// URL,"+
+				" target: %s", target)
+		}
+		return "", "", nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", "", fmt.Errorf("query_log: could not parse"+
+			" queryLogExport, err: %v", err)
+	}
+
+	bucket = strings.Trim(u.Path, "/")
+	if u.Host == "" || bucket == "" || strings.Contains(bucket, "/") {
+		return "", "", fmt.Errorf("query_log: queryLogExport must be"+
+			" like couchbase://HOST:8091/BUCKET, target: %s", target)
+	}
+
+	host := u.Host
+	if !strings.Contains(host, ":") {
+		host = host + ":8091"
+	}
+
+	server = "http://" + host
+	if u.User != nil {
+		server = "http://" + u.User.String() + "@" + host
+	}
+
+	return server, bucket, nil
+}
+
+// ExportQueryLogDay writes a day's query log to a queryLogExport
+// target.
+func ExportQueryLogDay(target string, day *QueryLogDay) error {
+	server, bucketName, err := parseQueryLogExport(target)
+	if err != nil {
+		return err
+	}
+
+	if bucketName == "" {
+		buf, err := json.Marshal(day)
+		if err != nil {
+			return err
+		}
+
+		err = os.MkdirAll(target, 0700)
+		if err != nil {
+			return err
+		}
+
+		name := "cbft-query-log-" + day.Date + "-" + day.NodeUUID + ".json"
+
+		// Write then rename, so that readers never see a partial file.
+		path := filepath.Join(target, name)
+		err = ioutil.WriteFile(path+".tmp", buf, 0600)
+		if err != nil {
+			return err
+		}
+		return os.Rename(path+".tmp", path)
+	}
+
+	bucket, err := couchbase.GetBucket(server, "default", bucketName)
+	if err != nil {
+		return fmt.Errorf("query_log: could not connect to bucket: %s,"+
+			" err: %v", bucketName, err)
+	}
+	defer bucket.Close()
+
+	return bucket.Set("cbft-query-log::"+day.Date+"::"+day.NodeUUID,
+		0, day)
+}
+
+// QueryLogExportStart starts a goroutine that exports the query log
+// of each day after the day ends.
+func QueryLogExportStart(mgr *cbgt.Manager) {
+	go func() {
+		for {
+			time.Sleep(QueryLogExportInterval)
+
+			err := queryLogExportEnded(mgr.UUID(),
+				CurrentClusterSettings().QueryLogExport)
+			if err != nil {
+				log.Printf("query_log: export, err: %v", err)
+			}
+		}
+	}()
+}
+
+// queryLogExportEnded exports the days that have ended, keeping the
+// days whose export failed so the export is retried later.
+func queryLogExportEnded(nodeUUID, target string) error {
+	queryLogM.Lock()
+	queryLogDayLOCKED(nodeUUID, queryLogNow()) // Ends the previous day.
+	ended := queryLogEnded
+	queryLogEnded = nil
+	queryLogM.Unlock()
+
+	if target == "" || len(ended) <= 0 {
+		return nil
+	}
+
+	var errs []string
+	var failed []*QueryLogDay
+
+	for _, day := range ended {
+		err := ExportQueryLogDay(target, day)
+		if err != nil {
+			errs = append(errs, err.Error())
+			failed = append(failed, day)
+		}
+	}
+
+	if len(failed) > 0 {
+		queryLogM.Lock()
+		queryLogEnded = append(failed, queryLogEnded...)
+		queryLogM.Unlock()
+
+		return fmt.Errorf("query_log: could not export %d days,"+
+			" errs: %v", len(failed), errs)
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------
+
+// QueryLogHandler is a REST handler that returns the node's query
+// log of the current day.
+type QueryLogHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewQueryLogHandler(mgr *cbgt.Manager) *QueryLogHandler {
+	return &QueryLogHandler{mgr: mgr}
+}
+
+func (h *QueryLogHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	rest.MustEncode(w, struct {
+		Status string       `json:"status"`
+		Day    *QueryLogDay `json:"day"`
+	}{
+		Status: "ok",
+		Day:    CurrentQueryLogDay(h.mgr.UUID()),
+	})
+}
+
+// QueryLogExportHandler is a REST handler that exports the node's
+// query log of the current day right away, such as for testing the
+// queryLogExport target.
+type QueryLogExportHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewQueryLogExportHandler(mgr *cbgt.Manager) *QueryLogExportHandler {
+	return &QueryLogExportHandler{mgr: mgr}
+}
+
+func (h *QueryLogExportHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	target := CurrentClusterSettings().QueryLogExport
+	if target == "" {
+		rest.ShowError(w, req, "query_log: no queryLogExport"+
+			" in the cluster settings", 400)
+		return
+	}
+
+	err := ExportQueryLogDay(target, CurrentQueryLogDay(h.mgr.UUID()))
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 500)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
@@ -0,0 +1,231 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// The memory of a query is estimated, so that a query that would use
+// more than the max query memory of a node (the queryMemoryMaxBytes
+// node option) fails with an error instead of running the node out of
+// memory.  A query is checked twice: before it's searched, from the
+// hits and facet terms that its request asks every pindex for, and
+// while it's searched, as the results of the pindexes (their hits,
+// stored fields, highlights, explanations and facet terms) arrive,
+// where exceeding the max cancels the query.  The estimate of an
+// active query is its memBytes in GET /api/query/active.
+
+// QueryMemoryMaxBytes is the default max memory of a query, where the
+// queryMemoryMaxBytes node option of 0 means no max.
+var QueryMemoryMaxBytes = int64(512 * 1024 * 1024)
+
+// The estimated bytes of the parts of query results.
+var (
+	QueryMemoryHitBytes       = int64(256)
+	QueryMemoryFacetTermBytes = int64(64)
+	QueryMemoryLocationBytes  = int64(64)
+	QueryMemoryExplBytes      = int64(64)
+	QueryMemoryValueBytes     = int64(16)
+)
+
+// queryMemoryMax returns the max memory of a query of a node, where 0
+// means no max.
+func queryMemoryMax(mgr *cbgt.Manager) int64 {
+	if mgr != nil {
+		v, err := strconv.ParseInt(mgr.Options()["queryMemoryMaxBytes"],
+			10, 64)
+		if err == nil && v >= 0 {
+			return v
+		}
+	}
+	return QueryMemoryMaxBytes
+}
+
+// EstimateSearchRequestMemory estimates the memory of the results of
+// a search request on a number of pindexes, before the search.
+func EstimateSearchRequestMemory(req *bleve.SearchRequest,
+	numTargets int) int64 {
+	var rv int64
+
+	rv += int64(req.From+req.Size) * QueryMemoryHitBytes
+	for _, fr := range req.Facets {
+		if fr != nil {
+			rv += int64(fr.Size) * QueryMemoryFacetTermBytes
+		}
+	}
+
+	return rv * int64(numTargets)
+}
+
+// EstimateSearchResultMemory estimates the memory of a search result.
+func EstimateSearchResultMemory(sr *bleve.SearchResult) int64 {
+	if sr == nil {
+		return 0
+	}
+
+	var rv int64
+
+	for _, hit := range sr.Hits {
+		rv += QueryMemoryHitBytes + int64(len(hit.ID))
+
+		for name, v := range hit.Fields {
+			rv += int64(len(name)) + queryMemoryValue(v)
+		}
+
+		for name, fragments := range hit.Fragments {
+			rv += int64(len(name))
+			for _, fragment := range fragments {
+				rv += int64(len(fragment))
+			}
+		}
+
+		for _, termLocations := range hit.Locations {
+			for term, locations := range termLocations {
+				rv += int64(len(term)) +
+					int64(len(locations))*QueryMemoryLocationBytes
+			}
+		}
+
+		rv += queryMemoryExpl(hit.Expl)
+	}
+
+	for name, fr := range sr.Facets {
+		if fr == nil {
+			continue
+		}
+		rv += int64(len(name))
+		for _, tf := range fr.Terms {
+			rv += QueryMemoryFacetTermBytes + int64(len(tf.Term))
+		}
+		rv += int64(len(fr.NumericRanges)+len(fr.DateRanges)) *
+			QueryMemoryFacetTermBytes
+	}
+
+	return rv
+}
+
+func queryMemoryValue(v interface{}) int64 {
+	switch x := v.(type) {
+	case string:
+		return int64(len(x))
+	case []interface{}:
+		var rv int64
+		for _, item := range x {
+			rv += queryMemoryValue(item)
+		}
+		return rv
+	}
+	return QueryMemoryValueBytes
+}
+
+func queryMemoryExpl(expl *search.Explanation) int64 {
+	if expl == nil {
+		return 0
+	}
+	rv := QueryMemoryExplBytes + int64(len(expl.Message))
+	for _, child := range expl.Children {
+		rv += queryMemoryExpl(child)
+	}
+	return rv
+}
+
+// checkQueryMemory returns an error when the estimated memory of a
+// search request is more than the max query memory.
+func checkQueryMemory(req *bleve.SearchRequest, numTargets int,
+	max int64) error {
+	if max <= 0 {
+		return nil
+	}
+
+	estimate := EstimateSearchRequestMemory(req, numTargets)
+	if estimate > max {
+		return fmt.Errorf("query_memory: estimated memory of the query:"+
+			" %d bytes, for a size+from of %d and facet sizes on %d"+
+			" pindexes, is more than the max query memory: %d bytes"+
+			" (the queryMemoryMaxBytes node option); please lower the"+
+			" size/from or page through the results, and lower the"+
+			" facet sizes or page through the facet's terms",
+			estimate, req.From+req.Size, numTargets, max)
+	}
+
+	return nil
+}
+
+// AddMemory adds to the estimated memory of an active query, which is
+// cancelled with an error when its memory exceeds the max, where a
+// max of 0 means no max.
+func (aq *ActiveQuery) AddMemory(n, max int64) error {
+	total := atomic.AddInt64(&aq.MemBytes, n)
+	if max > 0 && total > max {
+		err := fmt.Errorf("query_memory: estimated memory of the query:"+
+			" %d bytes, is more than the max query memory: %d bytes"+
+			" (the queryMemoryMaxBytes node option), so the query was"+
+			" cancelled, queryId: %s; please lower the size/from, the"+
+			" facet sizes, or the fields, highlights and explanations"+
+			" that are requested", total, max, aq.QueryID)
+		aq.abort(err)
+		return err
+	}
+	return nil
+}
+
+// queryMemoryBaseIndex is embedded so that the wrapped bleve.Index
+// methods are promoted.
+type queryMemoryBaseIndex interface {
+	bleve.Index
+}
+
+// A queryMemoryIndex adds the estimated memory of the results of a
+// pindex target to its active query.
+type queryMemoryIndex struct {
+	queryMemoryBaseIndex
+	aq  *ActiveQuery
+	max int64
+}
+
+func (t *queryMemoryIndex) Search(req *bleve.SearchRequest) (
+	*bleve.SearchResult, error) {
+	sr, err := bleve.Index(t.queryMemoryBaseIndex).Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.aq.AddMemory(EstimateSearchResultMemory(sr), t.max)
+	if err != nil {
+		return nil, err
+	}
+
+	return sr, nil
+}
+
+// queryMemoryTargets wraps the pindex targets so that the memory of
+// their results is added to the active query.
+func queryMemoryTargets(targets []bleve.Index, aq *ActiveQuery,
+	max int64) []bleve.Index {
+	rv := make([]bleve.Index, 0, len(targets))
+	for _, target := range targets {
+		rv = append(rv, &queryMemoryIndex{
+			queryMemoryBaseIndex: target,
+			aq:                   aq,
+			max:                  max,
+		})
+	}
+	return rv
+}
@@ -0,0 +1,105 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+func TestQueryMemoryMax(t *testing.T) {
+	if queryMemoryMax(nil) != QueryMemoryMaxBytes {
+		t.Errorf("expected the default max")
+	}
+}
+
+func TestEstimateSearchRequestMemory(t *testing.T) {
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	req.Size = 10
+	req.AddFacet("types", bleve.NewFacetRequest("type", 100000))
+
+	exp := 3 * (10*QueryMemoryHitBytes + 100000*QueryMemoryFacetTermBytes)
+	if got := EstimateSearchRequestMemory(req, 3); got != exp {
+		t.Errorf("expected: %d, got: %d", exp, got)
+	}
+
+	if checkQueryMemory(req, 3, 0) != nil {
+		t.Errorf("expected no err without a max")
+	}
+	if checkQueryMemory(req, 3, exp) != nil {
+		t.Errorf("expected no err at the max")
+	}
+	err := checkQueryMemory(req, 3, exp-1)
+	if err == nil || !strings.Contains(err.Error(), "queryMemoryMaxBytes") {
+		t.Errorf("expected a descriptive err, got: %v", err)
+	}
+}
+
+func TestEstimateSearchResultMemory(t *testing.T) {
+	if EstimateSearchResultMemory(nil) != 0 {
+		t.Errorf("expected 0 for no result")
+	}
+
+	hit := &search.DocumentMatch{ID: "doc-1", Score: 1}
+	sr := &bleve.SearchResult{Hits: search.DocumentMatchCollection{hit}}
+
+	base := EstimateSearchResultMemory(sr)
+	if base != QueryMemoryHitBytes+5 {
+		t.Errorf("unexpected estimate of a bare hit: %d", base)
+	}
+
+	hit.Fields = map[string]interface{}{
+		"desc": strings.Repeat("x", 1000),
+		"tags": []interface{}{"a", "b", 1.0},
+	}
+	hit.Expl = &search.Explanation{Message: "sum",
+		Children: []*search.Explanation{{Message: "weight"}}}
+
+	if got := EstimateSearchResultMemory(sr); got <= base+1000 {
+		t.Errorf("expected fields and explanations counted, got: %d", got)
+	}
+}
+
+func TestQueryMemoryTargets(t *testing.T) {
+	aq, _ := StartActiveQuery("beers", []byte(`{}`))
+	defer aq.Done()
+
+	hits := search.DocumentMatchCollection{
+		&search.DocumentMatch{ID: "a", Score: 1},
+		&search.DocumentMatch{ID: "b", Score: 2},
+	}
+	perTarget := 2*QueryMemoryHitBytes + 2
+
+	targets := queryMemoryTargets([]bleve.Index{
+		&partialTestIndex{hits: hits},
+		&partialTestIndex{hits: hits},
+	}, aq, perTarget+1)
+
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+
+	_, err := targets[0].Search(req)
+	if err != nil || aq.MemBytes != perTarget || aq.IsCancelled() {
+		t.Errorf("expected memory under the max, got: %d, err: %v",
+			aq.MemBytes, err)
+	}
+
+	_, err = targets[1].Search(req)
+	if err == nil || !aq.IsCancelled() || aq.Err() != err {
+		t.Errorf("expected the query cancelled over the max, err: %v", err)
+	}
+	if ActiveQueries("beers")[0].MemBytes != 2*perTarget {
+		t.Errorf("expected memBytes in the active queries")
+	}
+}
@@ -0,0 +1,161 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+// The hits from the pindexes of a query are merged and ordered by a
+// merge policy, which is chosen with the ctl's mergePolicy, and which
+// is "score" by default.  The "score" policy orders the hits by
+// descending score, breaking ties by the ctl's tieBreak, so that the
+// order of hits with equal scores is the same from run to run, where
+// the tieBreak is either...
+//
+//   _id - the doc ID, which is the default;
+//   FIELD - the value of a stored field that's requested in the
+//     "fields" of the query, and then the doc ID.
+//
+// Custom rankers can be registered, in Go, with
+// RegisterQueryMergePolicy.
+
+// A QueryMergePolicy orders the merged hits of a query, in place,
+// before the hits are paged.
+type QueryMergePolicy func(req *bleve.SearchRequest, tieBreak string,
+	hits search.DocumentMatchCollection)
+
+// QueryMergePolicies are the registered merge policies, keyed by name.
+var QueryMergePolicies = map[string]QueryMergePolicy{
+	"score": QueryMergeByScore,
+}
+
+// The default merge policy and tieBreak.
+var QueryMergePolicyDefault = "score"
+var QueryMergeTieBreakDefault = "_id"
+
+// RegisterQueryMergePolicy registers a merge policy, which should be
+// done during init().
+func RegisterQueryMergePolicy(name string, p QueryMergePolicy) {
+	QueryMergePolicies[name] = p
+}
+
+type queryMergeCtlParams struct {
+	Ctl struct {
+		MergePolicy string `json:"mergePolicy"`
+		TieBreak    string `json:"tieBreak"`
+	} `json:"ctl"`
+}
+
+// queryMergeSorter returns the func that orders the merged hits of a
+// query request, according to the request's merge policy.
+func queryMergeSorter(req []byte, searchRequest *bleve.SearchRequest) (
+	func(search.DocumentMatchCollection), error) {
+	var p queryMergeCtlParams
+	err := json.Unmarshal(req, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	name := p.Ctl.MergePolicy
+	if name == "" {
+		name = QueryMergePolicyDefault
+	}
+
+	policy := QueryMergePolicies[name]
+	if policy == nil {
+		return nil, fmt.Errorf("query_merge: unknown mergePolicy: %q", name)
+	}
+
+	tieBreak := p.Ctl.TieBreak
+	if tieBreak == "" {
+		tieBreak = QueryMergeTieBreakDefault
+	}
+
+	return func(hits search.DocumentMatchCollection) {
+		policy(searchRequest, tieBreak, hits)
+	}, nil
+}
+
+// QueryMergeByScore is the "score" merge policy, which orders hits by
+// descending score, and then by the tieBreak.
+func QueryMergeByScore(req *bleve.SearchRequest, tieBreak string,
+	hits search.DocumentMatchCollection) {
+	sort.Sort(&queryMergeByScoreSorter{hits: hits, tieBreak: tieBreak})
+}
+
+type queryMergeByScoreSorter struct {
+	hits     search.DocumentMatchCollection
+	tieBreak string
+}
+
+func (s *queryMergeByScoreSorter) Len() int { return len(s.hits) }
+
+func (s *queryMergeByScoreSorter) Swap(i, j int) {
+	s.hits[i], s.hits[j] = s.hits[j], s.hits[i]
+}
+
+func (s *queryMergeByScoreSorter) Less(i, j int) bool {
+	hi, hj := s.hits[i], s.hits[j]
+	if hi.Score != hj.Score {
+		return hi.Score > hj.Score
+	}
+	if s.tieBreak != "_id" {
+		c := queryMergeCompareValues(hi.Fields[s.tieBreak],
+			hj.Fields[s.tieBreak])
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return hi.ID < hj.ID
+}
+
+// queryMergeCompareValues compares two stored field values, where
+// numbers are compared numerically, other values by their string
+// form, and missing values sort last.
+func queryMergeCompareValues(a, b interface{}) int {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return 0
+		}
+		if a == nil {
+			return 1
+		}
+		return -1
+	}
+
+	fa, aok := a.(float64)
+	fb, bok := b.(float64)
+	if aok && bok {
+		if fa < fb {
+			return -1
+		}
+		if fa > fb {
+			return 1
+		}
+		return 0
+	}
+
+	sa, sb := fmt.Sprint(a), fmt.Sprint(b)
+	if sa < sb {
+		return -1
+	}
+	if sa > sb {
+		return 1
+	}
+	return 0
+}
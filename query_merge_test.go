@@ -0,0 +1,95 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+func queryMergeTestHits() search.DocumentMatchCollection {
+	return search.DocumentMatchCollection{
+		&search.DocumentMatch{ID: "c", Score: 1,
+			Fields: map[string]interface{}{"price": 5.0}},
+		&search.DocumentMatch{ID: "b", Score: 1,
+			Fields: map[string]interface{}{"price": 10.0}},
+		&search.DocumentMatch{ID: "z", Score: 2},
+		&search.DocumentMatch{ID: "a", Score: 1},
+	}
+}
+
+func queryMergeTestIDs(hits search.DocumentMatchCollection) string {
+	rv := ""
+	for _, hit := range hits {
+		rv = rv + hit.ID
+	}
+	return rv
+}
+
+func TestQueryMergeSorter(t *testing.T) {
+	searchRequest := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+
+	tests := []struct {
+		req string
+		exp string
+	}{
+		{`{}`, "zabc"},
+		{`{"ctl":{"mergePolicy":"score","tieBreak":"_id"}}`, "zabc"},
+		{`{"ctl":{"tieBreak":"price"}}`, "zcba"},
+	}
+
+	for i, test := range tests {
+		sortHits, err := queryMergeSorter([]byte(test.req), searchRequest)
+		if err != nil {
+			t.Fatalf("test: %d, err: %v", i, err)
+		}
+		hits := queryMergeTestHits()
+		sortHits(hits)
+		if queryMergeTestIDs(hits) != test.exp {
+			t.Errorf("test: %d, req: %s, got: %s, exp: %s",
+				i, test.req, queryMergeTestIDs(hits), test.exp)
+		}
+	}
+
+	_, err := queryMergeSorter([]byte(`{"ctl":{"mergePolicy":"nope"}}`),
+		searchRequest)
+	if err == nil {
+		t.Errorf("expected err on unknown mergePolicy")
+	}
+}
+
+func TestRegisterQueryMergePolicy(t *testing.T) {
+	RegisterQueryMergePolicy("testReverseID",
+		func(req *bleve.SearchRequest, tieBreak string,
+			hits search.DocumentMatchCollection) {
+			for i := 1; i < len(hits); i++ {
+				for j := i; j > 0 && hits[j].ID > hits[j-1].ID; j-- {
+					hits[j], hits[j-1] = hits[j-1], hits[j]
+				}
+			}
+		})
+	defer delete(QueryMergePolicies, "testReverseID")
+
+	sortHits, err := queryMergeSorter(
+		[]byte(`{"ctl":{"mergePolicy":"testReverseID"}}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits := queryMergeTestHits()
+	sortHits(hits)
+	if queryMergeTestIDs(hits) != "zcba" {
+		t.Errorf("expected custom policy order, got: %s",
+			queryMergeTestIDs(hits))
+	}
+}
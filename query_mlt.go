@@ -0,0 +1,235 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/document"
+)
+
+// A "more like this" (MLT) query finds documents that are similar to
+// some given documents or text, and looks like...
+//
+//   {"more_like_this": {
+//      "docIDs": ["doc-123"],   // And/or "text": "some text".
+//      "fields": ["desc"],      // Optional, defaults to all text fields.
+//      "maxQueryTerms": 25,     // Optional.
+//      "minTermFreq": 1,        // Optional.
+//      "minWordLen": 3,         // Optional.
+//      "maxWordLen": 0,         // Optional, 0 means unlimited.
+//      "minShouldMatch": 1},    // Optional.
+//    "boost": 1.0}              // Optional.
+//
+// The MLT query is rewritten before query execution into a
+// disjunction of the most frequent terms, where each term is analyzed
+// at query time by its field's analyzer and weighted by its
+// frequency, and where the given documents are excluded from the
+// results.  Since the rewrite happens before scatter/gather, the
+// documents can be in any partition of the index.
+
+const MLT_DEFAULT_MAX_QUERY_TERMS = 25
+const MLT_DEFAULT_MIN_TERM_FREQ = 1
+const MLT_DEFAULT_MIN_WORD_LEN = 3
+
+type mltTerm struct {
+	field string
+	term  string
+	freq  int
+}
+
+type mltTerms []*mltTerm
+
+func (a mltTerms) Len() int      { return len(a) }
+func (a mltTerms) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a mltTerms) Less(i, j int) bool {
+	if a[i].freq != a[j].freq {
+		return a[i].freq > a[j].freq
+	}
+	if a[i].field != a[j].field {
+		return a[i].field < a[j].field
+	}
+	return a[i].term < a[j].term
+}
+
+// rewriteMoreLikeThis rewrites any more_like_this queries in a JSON
+// search request.  The targets callback is invoked lazily, only when
+// there are docIDs to be looked up.
+func rewriteMoreLikeThis(req []byte,
+	targets func() ([]bleve.Index, error)) ([]byte, error) {
+	return rewriteQueryRequest(req, func(q map[string]interface{}) (
+		interface{}, error) {
+		mlt, ok := q["more_like_this"].(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+
+		fields := jsonStrings(mlt["fields"])
+		docIDs := jsonStrings(mlt["docIDs"])
+
+		texts := map[string][]string{} // Keyed by field name.
+
+		if text, ok := mlt["text"].(string); ok && text != "" {
+			if len(fields) <= 0 {
+				texts[""] = append(texts[""], text)
+			}
+			for _, field := range fields {
+				texts[field] = append(texts[field], text)
+			}
+		}
+
+		if len(docIDs) > 0 {
+			indexes, err := targets()
+			if err != nil {
+				return nil, err
+			}
+			for _, docID := range docIDs {
+				err = moreLikeThisDocTexts(indexes, docID, fields, texts)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		terms := moreLikeThisTerms(texts,
+			jsonInt(mlt["minTermFreq"], MLT_DEFAULT_MIN_TERM_FREQ),
+			jsonInt(mlt["minWordLen"], MLT_DEFAULT_MIN_WORD_LEN),
+			jsonInt(mlt["maxWordLen"], 0),
+			jsonInt(mlt["maxQueryTerms"], MLT_DEFAULT_MAX_QUERY_TERMS))
+		if len(terms) <= 0 {
+			return map[string]interface{}{"match_none": map[string]interface{}{}}, nil
+		}
+
+		disjuncts := make([]interface{}, 0, len(terms))
+		for _, t := range terms {
+			d := map[string]interface{}{
+				"match": t.term,
+				"boost": float64(t.freq),
+			}
+			if t.field != "" {
+				d["field"] = t.field
+			}
+			disjuncts = append(disjuncts, d)
+		}
+
+		rv := map[string]interface{}{
+			"should": map[string]interface{}{
+				"disjuncts": disjuncts,
+				"min":       jsonInt(mlt["minShouldMatch"], 1),
+			},
+		}
+		if len(docIDs) > 0 {
+			rv["must_not"] = map[string]interface{}{
+				"disjuncts": []interface{}{
+					map[string]interface{}{"ids": docIDs},
+				},
+			}
+		}
+		if boost, exists := q["boost"]; exists {
+			rv["boost"] = jsonFloat(boost, 1.0)
+		}
+
+		return rv, nil
+	})
+}
+
+// moreLikeThisDocTexts adds the text fields of a document, found by
+// looking through the bleve indexes, into the texts map.
+func moreLikeThisDocTexts(indexes []bleve.Index, docID string,
+	fields []string, texts map[string][]string) error {
+	var doc *document.Document
+
+	for _, index := range indexes {
+		d, err := index.Document(docID)
+		if err == indexClientUnimplementedErr {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("query_mlt: could not get document,"+
+				" docID: %s, err: %v", docID, err)
+		}
+		if d != nil && len(d.Fields) > 0 {
+			doc = d
+			break
+		}
+	}
+
+	if doc == nil {
+		return fmt.Errorf("query_mlt: document not found, docID: %s", docID)
+	}
+
+	wanted := map[string]bool{}
+	for _, field := range fields {
+		wanted[field] = true
+	}
+
+	for _, f := range doc.Fields {
+		if _, ok := f.(*document.TextField); !ok {
+			continue
+		}
+		if len(wanted) > 0 && !wanted[f.Name()] {
+			continue
+		}
+		texts[f.Name()] = append(texts[f.Name()], string(f.Value()))
+	}
+
+	return nil
+}
+
+// moreLikeThisTerms tokenizes the texts and returns the most frequent
+// terms.  The tokenization here is intentionally simple, as it's only
+// used to pick terms; the picked terms are later analyzed by the
+// field's real analyzer during query execution.
+func moreLikeThisTerms(texts map[string][]string,
+	minTermFreq, minWordLen, maxWordLen, maxQueryTerms int) mltTerms {
+	counts := map[string]map[string]int{} // Keyed by field, term.
+
+	for field, fieldTexts := range texts {
+		for _, text := range fieldTexts {
+			words := strings.FieldsFunc(strings.ToLower(text),
+				func(r rune) bool {
+					return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+				})
+			for _, word := range words {
+				n := len([]rune(word))
+				if n < minWordLen || (maxWordLen > 0 && n > maxWordLen) {
+					continue
+				}
+				if counts[field] == nil {
+					counts[field] = map[string]int{}
+				}
+				counts[field][word]++
+			}
+		}
+	}
+
+	rv := mltTerms{}
+	for field, fieldCounts := range counts {
+		for term, freq := range fieldCounts {
+			if freq >= minTermFreq {
+				rv = append(rv, &mltTerm{field: field, term: term, freq: freq})
+			}
+		}
+	}
+
+	sort.Sort(rv)
+
+	if maxQueryTerms > 0 && len(rv) > maxQueryTerms {
+		rv = rv[:maxQueryTerms]
+	}
+
+	return rv
+}
@@ -0,0 +1,105 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+func TestMoreLikeThisTerms(t *testing.T) {
+	terms := moreLikeThisTerms(map[string][]string{
+		"desc": []string{"Red shoes, red boots; and a red hat."},
+	}, 1, 3, 0, 2)
+	if len(terms) != 2 {
+		t.Errorf("expected 2 terms, got: %#v", terms)
+	}
+	if terms[0].term != "red" || terms[0].freq != 3 ||
+		terms[0].field != "desc" {
+		t.Errorf("expected red as most frequent, got: %#v", terms[0])
+	}
+	for _, term := range terms {
+		if term.term == "a" || term.term == "and" {
+			t.Errorf("expected short words to be skipped, got: %#v", term)
+		}
+	}
+
+	terms = moreLikeThisTerms(map[string][]string{
+		"desc": []string{"Red shoes, red boots; and a red hat."},
+	}, 2, 3, 0, 25)
+	if len(terms) != 1 || terms[0].term != "red" {
+		t.Errorf("expected minTermFreq to filter, got: %#v", terms)
+	}
+}
+
+func TestRewriteMoreLikeThisNoMLT(t *testing.T) {
+	req := []byte(`{"query":{"query":"hello"},"size":10}`)
+	res, err := rewriteMoreLikeThis(req, nil)
+	if err != nil || string(res) != string(req) {
+		t.Errorf("expected unchanged req, got: %s, err: %v", res, err)
+	}
+}
+
+func TestRewriteMoreLikeThisText(t *testing.T) {
+	req := []byte(`{"query":{"more_like_this":{` +
+		`"text":"couchbase couchbase search","fields":["desc"]}},` +
+		`"ctl":{"consistency":{"level":"at_plus",` +
+		`"vectors":{"idx":{"0":9007199254740993}}}}}`)
+	res, err := rewriteMoreLikeThis(req, nil)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	s := string(res)
+	if strings.Contains(s, "more_like_this") ||
+		!strings.Contains(s, `"match":"couchbase"`) ||
+		!strings.Contains(s, `"field":"desc"`) ||
+		strings.Contains(s, "must_not") {
+		t.Errorf("expected rewritten query, got: %s", s)
+	}
+	if !strings.Contains(s, "9007199254740993") {
+		t.Errorf("expected large seq numbers to be preserved, got: %s", s)
+	}
+}
+
+func TestRewriteMoreLikeThisDocIDs(t *testing.T) {
+	bindex, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	bindex.Index("a", map[string]interface{}{
+		"desc": "lightweight waterproof hiking boots",
+	})
+
+	targets := func() ([]bleve.Index, error) {
+		return []bleve.Index{&IndexClient{}, bindex}, nil
+	}
+
+	req := []byte(`{"query":{"more_like_this":{"docIDs":["a"]}}}`)
+	res, err := rewriteMoreLikeThis(req, targets)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	s := string(res)
+	if !strings.Contains(s, `"match":"waterproof"`) ||
+		!strings.Contains(s, `"must_not"`) ||
+		!strings.Contains(s, `"ids":["a"]`) {
+		t.Errorf("expected rewritten query, got: %s", s)
+	}
+
+	req = []byte(`{"query":{"more_like_this":{"docIDs":["not-a-doc"]}}}`)
+	_, err = rewriteMoreLikeThis(req, targets)
+	if err == nil {
+		t.Errorf("expected err on missing doc")
+	}
+}
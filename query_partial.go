@@ -0,0 +1,210 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+// A query with a ctl of {"allowPartial": true} is searched on each
+// pindex separately, and returns the merged results of the pindexes
+// that responded within the ctl timeout, instead of failing or
+// hanging when a pindex is slow or its node is down.  The result then
+// has "partial": true, and the failed pindexes, along with their
+// errors, as "failedPIndexes".
+
+type queryPartialCtlParams struct {
+	Ctl struct {
+		AllowPartial bool `json:"allowPartial"`
+	} `json:"ctl"`
+}
+
+// queryAllowPartial returns true when a query request allows partial
+// results.
+func queryAllowPartial(req []byte) bool {
+	var p queryPartialCtlParams
+	err := json.Unmarshal(req, &p)
+	return err == nil && p.Ctl.AllowPartial
+}
+
+type queryPartialResult struct {
+	i   int
+	sr  *bleve.SearchResult
+	err error
+}
+
+// queryGather searches each target separately, returning the merged
+// results of the targets that responded before the cancelCh was
+// closed, ordered by the sortHits func, and the errors of the other
+// targets, keyed by their pindex names.  The targets that haven't
+// started their searches by then are skipped.  An error is returned
+// only when no target responded.
+func queryGather(targets []bleve.Index, names []string,
+	req *bleve.SearchRequest, cancelCh <-chan bool,
+	sortHits func(search.DocumentMatchCollection)) (
+	*bleve.SearchResult, map[string]string, error) {
+	if len(targets) <= 0 {
+		return &bleve.SearchResult{
+			Request: req,
+			Hits:    search.DocumentMatchCollection{},
+			Facets:  search.FacetResults{},
+		}, map[string]string{}, nil
+	}
+
+	// Every target returns its top From+Size hits, for the merge.
+	targetReq := *req
+	targetReq.From = 0
+	targetReq.Size = req.From + req.Size
+
+	resultCh := make(chan *queryPartialResult, len(targets))
+
+	// The searches that are running when the cancelCh is closed are
+	// orphaned, as they can't be interrupted (see query_active.go).
+	var m sync.Mutex // Protects the fields that follow.
+	var running int64
+	var abandoned bool
+
+	for i, target := range targets {
+		if queryGatherCancelled(cancelCh) {
+			break // Skip the targets that haven't started.
+		}
+
+		go func(i int, target bleve.Index) {
+			m.Lock()
+			if abandoned || queryGatherCancelled(cancelCh) {
+				m.Unlock()
+				return
+			}
+			running++
+			m.Unlock()
+
+			sr, err := target.Search(&targetReq)
+
+			m.Lock()
+			running--
+			if abandoned {
+				atomic.AddInt64(&queryOrphanedSearches, -1)
+			}
+			m.Unlock()
+
+			resultCh <- &queryPartialResult{i: i, sr: sr, err: err}
+		}(i, target)
+	}
+
+	failed := map[string]string{}
+	for _, name := range names {
+		failed[name] = "timeout"
+	}
+
+	var rv *bleve.SearchResult
+
+COLLECT:
+	for n := 0; n < len(targets); n++ {
+		select {
+		case <-cancelCh:
+			m.Lock()
+			abandoned = true
+			atomic.AddInt64(&queryOrphanedSearches, running)
+			atomic.AddUint64(&queryOrphanedSearchesTotal, uint64(running))
+			m.Unlock()
+			break COLLECT
+
+		case r := <-resultCh:
+			if r.err != nil {
+				failed[names[r.i]] = r.err.Error()
+				continue
+			}
+
+			delete(failed, names[r.i])
+
+			queryCardinalitySketches(r.sr)
+
+			if rv == nil {
+				rv = r.sr
+			} else {
+				rv.Merge(r.sr)
+			}
+		}
+	}
+
+	if rv == nil {
+		return nil, failed, fmt.Errorf("query_partial: no pindexes"+
+			" responded, failed: %v", failed)
+	}
+
+	sortHits(rv.Hits)
+
+	searchResultPage(rv, req)
+
+	for name, fr := range req.Facets {
+		rv.Facets.Fixup(name, fr.Size)
+	}
+
+	return rv, failed, nil
+}
+
+// queryGatherCancelled returns true when the cancelCh is closed.
+func queryGatherCancelled(cancelCh <-chan bool) bool {
+	select {
+	case <-cancelCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// searchResultPage trims the sorted hits of a search result, which
+// has the top From+Size hits, to the page of a search request.
+func searchResultPage(sr *bleve.SearchResult, req *bleve.SearchRequest) {
+	if req.From < len(sr.Hits) {
+		sr.Hits = sr.Hits[req.From:]
+	} else {
+		sr.Hits = sr.Hits[:0]
+	}
+	if req.Size < len(sr.Hits) {
+		sr.Hits = sr.Hits[:req.Size]
+	}
+
+	sr.Request = req
+}
+
+// queryResponsiveTargets returns the targets whose pindexes didn't
+// fail.
+func queryResponsiveTargets(targets []bleve.Index, names []string,
+	failed map[string]string) []bleve.Index {
+	var rv []bleve.Index
+	for i, target := range targets {
+		if _, exists := failed[names[i]]; !exists {
+			rv = append(rv, target)
+		}
+	}
+	return rv
+}
+
+// queryGatherError returns the error of a query whose pindexes
+// failed, which is a timeout error when all the failures were
+// timeouts.
+func queryGatherError(failed map[string]string) error {
+	for _, err := range failed {
+		if err != "timeout" {
+			return fmt.Errorf("pindex_bleve: query failed,"+
+				" pindexes: %v", failed)
+		}
+	}
+	return fmt.Errorf("pindex_bleve: query timeout")
+}
@@ -0,0 +1,188 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+// partialTestBaseIndex is embedded by partialTestIndex, as a field
+// named Index would hide the Index() method of bleve.Index.
+type partialTestBaseIndex interface {
+	bleve.Index
+}
+
+// partialTestIndex is a bleve.Index whose Search returns canned
+// results, after a delay.
+type partialTestIndex struct {
+	partialTestBaseIndex
+	hits  search.DocumentMatchCollection
+	delay time.Duration
+	err   error
+}
+
+func (p *partialTestIndex) Search(req *bleve.SearchRequest) (
+	*bleve.SearchResult, error) {
+	time.Sleep(p.delay)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &bleve.SearchResult{
+		Request: req,
+		Hits:    p.hits,
+		Total:   uint64(len(p.hits)),
+	}, nil
+}
+
+func TestQueryAllowPartial(t *testing.T) {
+	if queryAllowPartial([]byte(`{"query":{}}`)) {
+		t.Errorf("expected no allowPartial")
+	}
+	if !queryAllowPartial([]byte(`{"ctl":{"timeout":10,"allowPartial":true}}`)) {
+		t.Errorf("expected allowPartial")
+	}
+}
+
+func TestQueryPartial(t *testing.T) {
+	targets := []bleve.Index{
+		&partialTestIndex{hits: search.DocumentMatchCollection{
+			&search.DocumentMatch{ID: "a", Score: 1},
+			&search.DocumentMatch{ID: "b", Score: 3},
+		}},
+		&partialTestIndex{hits: search.DocumentMatchCollection{
+			&search.DocumentMatch{ID: "c", Score: 2},
+		}},
+		&partialTestIndex{err: fmt.Errorf("node down")},
+		&partialTestIndex{delay: time.Second},
+	}
+	names := []string{"p0", "p1", "p2", "p3"}
+
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	req.Size = 2
+
+	cancelCh := make(chan bool)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(cancelCh)
+	}()
+
+	sr, failed, err := queryGather(targets, names, req, cancelCh,
+		func(hits search.DocumentMatchCollection) {
+			QueryMergeByScore(req, "_id", hits)
+		})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if sr.Total != 3 || len(sr.Hits) != 2 ||
+		sr.Hits[0].ID != "b" || sr.Hits[1].ID != "c" {
+		t.Errorf("unexpected merged results: %#v", sr)
+	}
+	if len(failed) != 2 ||
+		failed["p2"] != "node down" || failed["p3"] != "timeout" {
+		t.Errorf("unexpected failed: %#v", failed)
+	}
+}
+
+func TestQueryPartialNoneResponded(t *testing.T) {
+	targets := []bleve.Index{&partialTestIndex{err: fmt.Errorf("down")}}
+
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+
+	_, failed, err := queryGather(targets, []string{"p0"}, req,
+		make(chan bool), nil)
+	if err == nil || failed["p0"] != "down" {
+		t.Errorf("expected err, got: %v, failed: %#v", err, failed)
+	}
+}
+
+// partialBlockingIndex is a bleve.Index whose Search blocks until its
+// releaseCh is closed.
+type partialBlockingIndex struct {
+	partialTestBaseIndex
+	startedCh chan bool
+	releaseCh chan bool
+}
+
+func (p *partialBlockingIndex) Search(req *bleve.SearchRequest) (
+	*bleve.SearchResult, error) {
+	p.startedCh <- true
+	<-p.releaseCh
+	return &bleve.SearchResult{Request: req}, nil
+}
+
+func TestQueryPartialCancelled(t *testing.T) {
+	startedCh := make(chan bool, 10)
+	releaseCh := make(chan bool)
+
+	targets := []bleve.Index{
+		&partialBlockingIndex{startedCh: startedCh, releaseCh: releaseCh},
+		&partialBlockingIndex{startedCh: startedCh, releaseCh: releaseCh},
+	}
+	names := []string{"p0", "p1"}
+
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+
+	orphaned := atomic.LoadInt64(&queryOrphanedSearches)
+	orphanedTotal := atomic.LoadUint64(&queryOrphanedSearchesTotal)
+
+	// A query that's cancelled before its searches start skips them.
+	cancelCh := make(chan bool)
+	close(cancelCh)
+
+	_, failed, err := queryGather(targets, names, req, cancelCh, nil)
+	if err == nil || len(failed) != 2 {
+		t.Errorf("expected err, got: %v, failed: %#v", err, failed)
+	}
+	select {
+	case <-startedCh:
+		t.Errorf("expected no search to start")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The searches that are running when the query is cancelled are
+	// orphaned until they finish.
+	cancelCh = make(chan bool)
+	go func() {
+		<-startedCh
+		<-startedCh
+		close(cancelCh)
+	}()
+
+	_, _, err = queryGather(targets, names, req, cancelCh, nil)
+	if err == nil {
+		t.Errorf("expected err on a cancelled query")
+	}
+	if atomic.LoadInt64(&queryOrphanedSearches) != orphaned+2 ||
+		atomic.LoadUint64(&queryOrphanedSearchesTotal) != orphanedTotal+2 {
+		t.Errorf("expected 2 orphaned searches, got: %d",
+			atomic.LoadInt64(&queryOrphanedSearches)-orphaned)
+	}
+
+	close(releaseCh)
+
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt64(&queryOrphanedSearches) == orphaned {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt64(&queryOrphanedSearches) != orphaned ||
+		atomic.LoadUint64(&queryOrphanedSearchesTotal) != orphanedTotal+2 {
+		t.Errorf("expected the orphaned searches to finish")
+	}
+}
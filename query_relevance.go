@@ -0,0 +1,509 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// A relevance judgment set is a named list of queries, where each
+// query has relevance ratings of documents, and looks like...
+//
+//   {"queries": [
+//      {"id": "q1",
+//       "query": {"match": "pale ale", "field": "desc"},
+//       "ratings": {"beer-1": 3, "beer-7": 1, "beer-9": 0}}]}
+//
+// The ratings are graded, where 0 means not relevant and higher
+// means more relevant, and unrated documents count as not relevant.
+// The judgment sets are kept in the Cfg, and a set can be run against
+// any index, returning the precision@k, recall@k, NDCG@k, reciprocal
+// rank and average precision of each query, along with their means,
+// so that mapping and analyzer changes can be compared
+// quantitatively, such as by running the same set against an index
+// and its clone with a new mapping.  The top k hits that aren't rated
+// are returned, too, so that they can be judged.
+
+// The Cfg key where the relevance judgment sets are kept.
+const RELEVANCE_SETS_KEY = "relevanceSets"
+
+const RELEVANCE_DEFAULT_K = 10
+
+// RelevanceSets is the Cfg entry of all relevance judgment sets.
+type RelevanceSets struct {
+	UUID string `json:"uuid"`
+
+	// Keyed by set name.
+	Sets map[string]*RelevanceSet `json:"sets"`
+}
+
+// RelevanceSet is a relevance judgment set.
+type RelevanceSet struct {
+	Name    string            `json:"name"`
+	Queries []*RelevanceQuery `json:"queries"`
+}
+
+// RelevanceQuery is a query of a relevance judgment set, with the
+// ratings of documents keyed by doc ID.
+type RelevanceQuery struct {
+	ID      string          `json:"id"`
+	Query   json.RawMessage `json:"query"`
+	Ratings map[string]int  `json:"ratings"`
+}
+
+// RelevanceMetrics are the relevance metrics of a query, or their
+// means over the queries of a set.
+type RelevanceMetrics struct {
+	Precision        float64 `json:"precision"`
+	Recall           float64 `json:"recall"`
+	NDCG             float64 `json:"ndcg"`
+	ReciprocalRank   float64 `json:"reciprocalRank"`
+	AveragePrecision float64 `json:"averagePrecision"`
+}
+
+// RelevanceQueryResult is the evaluation of a query.
+type RelevanceQueryResult struct {
+	ID      string           `json:"id"`
+	Metrics RelevanceMetrics `json:"metrics"`
+	Hits    []string         `json:"hits"`
+	Unrated []string         `json:"unrated,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// RelevanceEvaluation is the evaluation of a relevance judgment set
+// against an index.
+type RelevanceEvaluation struct {
+	IndexName string                  `json:"indexName"`
+	K         int                     `json:"k"`
+	Metrics   RelevanceMetrics        `json:"metrics"`
+	Queries   []*RelevanceQueryResult `json:"queries"`
+	Errors    int                     `json:"errors"`
+}
+
+// ComputeRelevanceMetrics returns the relevance metrics of the ranked
+// doc IDs of the top k hits of a query, along with the hits that
+// aren't rated.
+func ComputeRelevanceMetrics(hits []string, ratings map[string]int,
+	k int) (m RelevanceMetrics, unrated []string) {
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+
+	var relevantRatings []int
+	for _, rating := range ratings {
+		if rating > 0 {
+			relevantRatings = append(relevantRatings, rating)
+		}
+	}
+
+	var relevantHits int
+	var dcg, sumPrecision float64
+
+	for i, hit := range hits {
+		rating, rated := ratings[hit]
+		if !rated {
+			unrated = append(unrated, hit)
+		}
+		if rating <= 0 {
+			continue
+		}
+
+		relevantHits++
+		if m.ReciprocalRank == 0 {
+			m.ReciprocalRank = 1.0 / float64(i+1)
+		}
+		sumPrecision += float64(relevantHits) / float64(i+1)
+		dcg += relevanceGain(rating, i)
+	}
+
+	if k > 0 {
+		m.Precision = float64(relevantHits) / float64(k)
+	}
+
+	if len(relevantRatings) > 0 {
+		m.Recall = float64(relevantHits) / float64(len(relevantRatings))
+
+		n := len(relevantRatings)
+		if n > k {
+			n = k
+		}
+		m.AveragePrecision = sumPrecision / float64(n)
+
+		sort.Sort(sort.Reverse(sort.IntSlice(relevantRatings)))
+
+		var idcg float64
+		for i := 0; i < n; i++ {
+			idcg += relevanceGain(relevantRatings[i], i)
+		}
+		m.NDCG = dcg / idcg
+	}
+
+	return m, unrated
+}
+
+// relevanceGain returns the discounted gain of a rating at a 0-based
+// rank.
+func relevanceGain(rating, rank int) float64 {
+	return (math.Pow(2, float64(rating)) - 1) / math.Log2(float64(rank+2))
+}
+
+// EvaluateRelevance runs the queries of a relevance judgment set
+// against an index, using the query implementation of the index's
+// type, so the index may also be an alias.
+func EvaluateRelevance(mgr *cbgt.Manager, indexName string,
+	set *RelevanceSet, k int) (*RelevanceEvaluation, error) {
+	if k <= 0 {
+		k = RELEVANCE_DEFAULT_K
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return nil, err
+	}
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil {
+		return nil, fmt.Errorf("query_relevance: no index: %s", indexName)
+	}
+
+	pindexImplType := cbgt.PIndexImplTypes[indexDef.Type]
+	if pindexImplType == nil || pindexImplType.Query == nil {
+		return nil, fmt.Errorf("query_relevance: index: %s, of type: %s,"+
+			" isn't queryable", indexName, indexDef.Type)
+	}
+
+	rv := &RelevanceEvaluation{IndexName: indexName, K: k}
+
+	for _, q := range set.Queries {
+		result := &RelevanceQueryResult{ID: q.ID, Hits: []string{}}
+		rv.Queries = append(rv.Queries, result)
+
+		hits, err := relevanceQueryHits(mgr, pindexImplType, indexDef, q, k)
+		if err != nil {
+			result.Error = err.Error()
+			rv.Errors++
+			continue
+		}
+
+		result.Hits = hits
+		result.Metrics, result.Unrated =
+			ComputeRelevanceMetrics(hits, q.Ratings, k)
+
+		rv.Metrics.Precision += result.Metrics.Precision
+		rv.Metrics.Recall += result.Metrics.Recall
+		rv.Metrics.NDCG += result.Metrics.NDCG
+		rv.Metrics.ReciprocalRank += result.Metrics.ReciprocalRank
+		rv.Metrics.AveragePrecision += result.Metrics.AveragePrecision
+	}
+
+	if n := float64(len(rv.Queries) - rv.Errors); n > 0 {
+		rv.Metrics.Precision /= n
+		rv.Metrics.Recall /= n
+		rv.Metrics.NDCG /= n
+		rv.Metrics.ReciprocalRank /= n
+		rv.Metrics.AveragePrecision /= n
+	}
+
+	return rv, nil
+}
+
+// relevanceQueryHits returns the ranked doc IDs of the top k hits of a
+// query.
+func relevanceQueryHits(mgr *cbgt.Manager, pindexImplType *cbgt.PIndexImplType,
+	indexDef *cbgt.IndexDef, q *RelevanceQuery, k int) ([]string, error) {
+	req, err := json.Marshal(map[string]interface{}{
+		"query": q.Query,
+		"size":  k,
+		"from":  0,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var res bytes.Buffer
+	err = pindexImplType.Query(mgr, indexDef.Name, indexDef.UUID, req, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	var sr struct {
+		Hits []struct {
+			ID string `json:"id"`
+		} `json:"hits"`
+	}
+	err = json.Unmarshal(res.Bytes(), &sr)
+	if err != nil {
+		return nil, fmt.Errorf("query_relevance: could not parse query"+
+			" result, err: %v", err)
+	}
+
+	hits := make([]string, 0, len(sr.Hits))
+	for _, hit := range sr.Hits {
+		hits = append(hits, hit.ID)
+	}
+
+	return hits, nil
+}
+
+// SetRelevanceSet creates or replaces a relevance judgment set.
+func SetRelevanceSet(cfg cbgt.Cfg, set *RelevanceSet) error {
+	if set.Name == "" {
+		return fmt.Errorf("query_relevance: name is required")
+	}
+	err := validateRelevanceQueries(set.Queries)
+	if err != nil {
+		return err
+	}
+
+	return updateRelevanceSets(cfg, func(rs *RelevanceSets) error {
+		rs.Sets[set.Name] = set
+		return nil
+	})
+}
+
+func validateRelevanceQueries(queries []*RelevanceQuery) error {
+	if len(queries) <= 0 {
+		return fmt.Errorf("query_relevance: queries are required")
+	}
+	ids := map[string]bool{}
+	for i, q := range queries {
+		if q.ID == "" {
+			q.ID = fmt.Sprintf("%d", i)
+		}
+		if ids[q.ID] {
+			return fmt.Errorf("query_relevance: duplicate query id: %s",
+				q.ID)
+		}
+		ids[q.ID] = true
+		if len(bytes.TrimSpace(q.Query)) <= 0 {
+			return fmt.Errorf("query_relevance: query is required,"+
+				" id: %s", q.ID)
+		}
+	}
+	return nil
+}
+
+// DeleteRelevanceSet deletes a relevance judgment set.
+func DeleteRelevanceSet(cfg cbgt.Cfg, name string) error {
+	return updateRelevanceSets(cfg, func(rs *RelevanceSets) error {
+		if rs.Sets[name] == nil {
+			return fmt.Errorf("query_relevance: no set, name: %s", name)
+		}
+		delete(rs.Sets, name)
+		return nil
+	})
+}
+
+// CfgGetRelevanceSets returns the relevance judgment sets from the
+// Cfg.
+func CfgGetRelevanceSets(cfg cbgt.Cfg) (*RelevanceSets, error) {
+	rs := &RelevanceSets{}
+	_, _, err := CfgGetJSON(cfg, RELEVANCE_SETS_KEY, rs)
+	if err != nil {
+		return nil, err
+	}
+	if rs.Sets == nil {
+		rs.Sets = map[string]*RelevanceSet{}
+	}
+	return rs, nil
+}
+
+func updateRelevanceSets(cfg cbgt.Cfg,
+	f func(rs *RelevanceSets) error) error {
+	return CfgUpdateJSON(cfg, RELEVANCE_SETS_KEY,
+		func() interface{} { return &RelevanceSets{} },
+		func(v interface{}) error {
+			rs := v.(*RelevanceSets)
+			if rs.Sets == nil {
+				rs.Sets = map[string]*RelevanceSet{}
+			}
+			err := f(rs)
+			if err != nil {
+				return err
+			}
+			rs.UUID = cbgt.NewUUID()
+			return nil
+		})
+}
+
+// ---------------------------------------------------------
+
+// RelevanceSetListHandler is a REST handler that returns the
+// relevance judgment sets.
+type RelevanceSetListHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewRelevanceSetListHandler(mgr *cbgt.Manager) *RelevanceSetListHandler {
+	return &RelevanceSetListHandler{mgr: mgr}
+}
+
+func (h *RelevanceSetListHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	rs, err := CfgGetRelevanceSets(h.mgr.Cfg())
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("query_relevance: could not"+
+			" retrieve sets, err: %v", err), 500)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string                   `json:"status"`
+		Sets   map[string]*RelevanceSet `json:"sets"`
+	}{
+		Status: "ok",
+		Sets:   rs.Sets,
+	})
+}
+
+// RelevanceSetPutHandler is a REST handler that uploads a relevance
+// judgment set.
+type RelevanceSetPutHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewRelevanceSetPutHandler(mgr *cbgt.Manager) *RelevanceSetPutHandler {
+	return &RelevanceSetPutHandler{mgr: mgr}
+}
+
+func (h *RelevanceSetPutHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("query_relevance: could not"+
+			" read request body, err: %v", err), 400)
+		return
+	}
+
+	set := &RelevanceSet{}
+	err = json.Unmarshal(requestBody, set)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("query_relevance: could not"+
+			" parse request body, err: %v", err), 400)
+		return
+	}
+	set.Name = mux.Vars(req)["name"]
+
+	err = SetRelevanceSet(h.mgr.Cfg(), set)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// RelevanceSetDeleteHandler is a REST handler that deletes a
+// relevance judgment set.
+type RelevanceSetDeleteHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewRelevanceSetDeleteHandler(
+	mgr *cbgt.Manager) *RelevanceSetDeleteHandler {
+	return &RelevanceSetDeleteHandler{mgr: mgr}
+}
+
+func (h *RelevanceSetDeleteHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	err := DeleteRelevanceSet(h.mgr.Cfg(), mux.Vars(req)["name"])
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// RelevanceEvalHandler is a REST handler that runs a relevance
+// judgment set, either a stored one or one in the request body,
+// against an index.
+type RelevanceEvalHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewRelevanceEvalHandler(mgr *cbgt.Manager) *RelevanceEvalHandler {
+	return &RelevanceEvalHandler{mgr: mgr}
+}
+
+func (h *RelevanceEvalHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("query_relevance: could not"+
+			" read request body, err: %v", err), 400)
+		return
+	}
+
+	var r struct {
+		Set     string            `json:"set"`
+		Queries []*RelevanceQuery `json:"queries"`
+		K       int               `json:"k"`
+	}
+	err = json.Unmarshal(requestBody, &r)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("query_relevance: could not"+
+			" parse request body, err: %v", err), 400)
+		return
+	}
+
+	set := &RelevanceSet{Queries: r.Queries}
+	if r.Set != "" {
+		rs, err := CfgGetRelevanceSets(h.mgr.Cfg())
+		if err != nil {
+			rest.ShowError(w, req, fmt.Sprintf("query_relevance: could"+
+				" not retrieve sets, err: %v", err), 500)
+			return
+		}
+		set = rs.Sets[r.Set]
+		if set == nil {
+			rest.ShowError(w, req, fmt.Sprintf("query_relevance: no set,"+
+				" name: %s", r.Set), 400)
+			return
+		}
+	} else {
+		err = validateRelevanceQueries(set.Queries)
+		if err != nil {
+			rest.ShowError(w, req, err.Error(), 400)
+			return
+		}
+	}
+
+	eval, err := EvaluateRelevance(h.mgr, mux.Vars(req)["indexName"],
+		set, r.K)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+		*RelevanceEvaluation
+	}{
+		Status:              "ok",
+		RelevanceEvaluation: eval,
+	})
+}
@@ -0,0 +1,97 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestComputeRelevanceMetrics(t *testing.T) {
+	near := func(a, b float64) bool { return math.Abs(a-b) < 0.0001 }
+
+	ratings := map[string]int{"a": 3, "b": 0, "c": 1, "e": 2}
+
+	m, unrated := ComputeRelevanceMetrics(
+		[]string{"a", "b", "c", "d", "e"}, ratings, 4)
+	if !near(m.Precision, 0.5) ||
+		!near(m.Recall, 2.0/3.0) ||
+		!near(m.ReciprocalRank, 1.0) ||
+		!near(m.AveragePrecision, (1.0+2.0/3.0)/3.0) ||
+		!near(m.NDCG, 7.5/(7.0+3.0/math.Log2(3)+0.5)) {
+		t.Errorf("unexpected metrics: %+v", m)
+	}
+	if !reflect.DeepEqual(unrated, []string{"d"}) {
+		t.Errorf("expected the unrated hits, got: %v", unrated)
+	}
+
+	m, _ = ComputeRelevanceMetrics([]string{"a", "e", "c"}, ratings, 3)
+	if !near(m.NDCG, 1.0) || !near(m.AveragePrecision, 1.0) {
+		t.Errorf("expected an ideal ranking, got: %+v", m)
+	}
+
+	m, _ = ComputeRelevanceMetrics([]string{"b", "d"}, ratings, 10)
+	if m.Precision != 0 || m.NDCG != 0 || m.ReciprocalRank != 0 {
+		t.Errorf("expected no relevant hits, got: %+v", m)
+	}
+
+	m, _ = ComputeRelevanceMetrics([]string{"x", "c"}, ratings, 10)
+	if !near(m.ReciprocalRank, 0.5) {
+		t.Errorf("expected the first relevant hit at rank 2, got: %+v", m)
+	}
+}
+
+func TestRelevanceSets(t *testing.T) {
+	cfg := cbgt.NewCfgMem()
+
+	bad := []*RelevanceSet{
+		{},
+		{Name: "s"},
+		{Name: "s", Queries: []*RelevanceQuery{{ID: "q1"}}},
+		{Name: "s", Queries: []*RelevanceQuery{
+			{ID: "q1", Query: json.RawMessage(`{"match_all":{}}`)},
+			{ID: "q1", Query: json.RawMessage(`{"match_all":{}}`)},
+		}},
+	}
+	for i, set := range bad {
+		if SetRelevanceSet(cfg, set) == nil {
+			t.Errorf("%d - expected err for set: %+v", i, set)
+		}
+	}
+
+	err := SetRelevanceSet(cfg, &RelevanceSet{Name: "s",
+		Queries: []*RelevanceQuery{
+			{Query: json.RawMessage(`{"match_all":{}}`),
+				Ratings: map[string]int{"a": 1}},
+		}})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	rs, _ := CfgGetRelevanceSets(cfg)
+	if rs.Sets["s"] == nil || rs.Sets["s"].Queries[0].ID != "0" {
+		t.Errorf("expected the set with a default query id, got: %+v",
+			rs.Sets["s"])
+	}
+
+	err = DeleteRelevanceSet(cfg, "s")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if DeleteRelevanceSet(cfg, "s") == nil {
+		t.Errorf("expected err on a missing set")
+	}
+}
@@ -0,0 +1,248 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+// An index may have an external reranker, like an ML ranking
+// service, in its bleve index params...
+//
+//   "rerank": {
+//     "url": "http://ranker:8080/rerank",
+//     "topN": 50,         // Optional, the number of top hits to rerank.
+//     "timeoutMs": 250}   // Optional.
+//
+// After the hits of a query are merged (and rescored), the top N hits
+// are POST'ed to the url as JSON, as {"index": ..., "request": ...,
+// "hits": [{"id": ..., "score": ..., "fields": ...}, ...]}, and the
+// reranker responds with the hits in their new order, as {"hits":
+// [{"id": ..., "score": ...}, ...]}, where the scores are optional.
+// Hits that the reranker leaves out keep their original order after
+// the reranked hits.  When the reranker fails or times out, the hits
+// keep their original order, with a warning.  A query with a ctl of
+// {"rerank": false} skips the reranker.
+
+const RERANK_DEFAULT_TOP_N = 50
+const RERANK_DEFAULT_TIMEOUT_MS = 250
+
+// BleveRerank is the external reranker of an index.
+type BleveRerank struct {
+	URL       string `json:"url"`
+	TopN      int    `json:"topN,omitempty"`
+	TimeoutMs int    `json:"timeoutMs,omitempty"`
+}
+
+func (r *BleveRerank) topN() int {
+	if r.TopN > 0 {
+		return r.TopN
+	}
+	return RERANK_DEFAULT_TOP_N
+}
+
+func (r *BleveRerank) timeout() time.Duration {
+	if r.TimeoutMs > 0 {
+		return time.Duration(r.TimeoutMs) * time.Millisecond
+	}
+	return RERANK_DEFAULT_TIMEOUT_MS * time.Millisecond
+}
+
+// validateBleveRerank checks the reranker of the index params.
+func validateBleveRerank(r *BleveRerank) error {
+	if r == nil {
+		return nil
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		return fmt.Errorf("query_rerank: url must be an http or https"+
+			" URL, url: %q", r.URL)
+	}
+	if r.TopN < 0 || r.TimeoutMs < 0 {
+		return fmt.Errorf("query_rerank: topN and timeoutMs must be >= 0")
+	}
+	return nil
+}
+
+type queryRerankCtlParams struct {
+	Ctl struct {
+		Rerank *bool `json:"rerank"`
+	} `json:"ctl"`
+}
+
+// queryRerank returns the reranker of a query request, or nil when
+// the index has no reranker or the request skips it.
+func queryRerank(req []byte, r *BleveRerank) *BleveRerank {
+	if r == nil {
+		return nil
+	}
+	var p queryRerankCtlParams
+	err := json.Unmarshal(req, &p)
+	if err == nil && p.Ctl.Rerank != nil && !*p.Ctl.Rerank {
+		return nil
+	}
+	return r
+}
+
+// gatherRequest returns the search request that gathers at least the
+// top N hits from the start, for the results to be paged after the
+// reranking.
+func (r *BleveRerank) gatherRequest(
+	req *bleve.SearchRequest) *bleve.SearchRequest {
+	rv := *req
+	rv.Size = req.From + req.Size
+	if rv.Size < r.topN() {
+		rv.Size = r.topN()
+	}
+	rv.From = 0
+	return &rv
+}
+
+type rerankHit struct {
+	ID     string                 `json:"id"`
+	Score  float64                `json:"score"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+type rerankResponseHit struct {
+	ID    string   `json:"id"`
+	Score *float64 `json:"score"`
+}
+
+// rerankHTTPPost posts a rerank request, and may be overridden for
+// testing.
+var rerankHTTPPost = func(u string, body []byte, timeout time.Duration) (
+	[]byte, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status: %d, body: %s",
+			resp.StatusCode, respBody)
+	}
+	return respBody, nil
+}
+
+// rerank reorders the top N hits of a search result with the
+// reranker, returning a warning when the hits keep their original
+// order because the reranker failed.
+func (r *BleveRerank) rerank(indexName string, req []byte,
+	sr *bleve.SearchResult) string {
+	n := r.topN()
+	if n > len(sr.Hits) {
+		n = len(sr.Hits)
+	}
+	if n <= 1 {
+		return ""
+	}
+
+	hits := make([]*rerankHit, n)
+	for i, hit := range sr.Hits[:n] {
+		hits[i] = &rerankHit{ID: hit.ID, Score: hit.Score, Fields: hit.Fields}
+	}
+
+	body, err := json.Marshal(struct {
+		Index   string          `json:"index"`
+		Request json.RawMessage `json:"request"`
+		Hits    []*rerankHit    `json:"hits"`
+	}{
+		Index:   indexName,
+		Request: json.RawMessage(req),
+		Hits:    hits,
+	})
+	if err != nil {
+		return fmt.Sprintf("rerank: could not marshal request, err: %v;"+
+			" kept the original order", err)
+	}
+
+	respBody, err := rerankHTTPPost(r.URL, body, r.timeout())
+	if err != nil {
+		return fmt.Sprintf("rerank: reranker failed, err: %v;"+
+			" kept the original order", err)
+	}
+
+	var resp struct {
+		Hits []*rerankResponseHit `json:"hits"`
+	}
+	err = json.Unmarshal(respBody, &resp)
+	if err != nil {
+		return fmt.Sprintf("rerank: could not parse response, err: %v;"+
+			" kept the original order", err)
+	}
+
+	rerankApply(sr, n, resp.Hits)
+
+	return ""
+}
+
+// rerankApply reorders the top n hits of a search result in the order
+// of the reranked hits, where the top n hits that aren't reranked keep
+// their original order after the reranked hits.
+func rerankApply(sr *bleve.SearchResult, n int, reranked []*rerankResponseHit) {
+	top := map[string]*search.DocumentMatch{}
+	for _, hit := range sr.Hits[:n] {
+		top[hit.ID] = hit
+	}
+
+	ordered := make(search.DocumentMatchCollection, 0, n)
+	scores := map[*search.DocumentMatch]float64{}
+	for _, rh := range reranked {
+		hit := top[rh.ID]
+		if hit == nil {
+			continue // Unknown or duplicate.
+		}
+		delete(top, rh.ID)
+		if rh.Score != nil {
+			scores[hit] = *rh.Score
+		}
+		ordered = append(ordered, hit)
+	}
+	for _, hit := range sr.Hits[:n] {
+		if top[hit.ID] != nil {
+			delete(top, hit.ID)
+			ordered = append(ordered, hit)
+		}
+	}
+	if len(ordered) != n {
+		return // Duplicate doc IDs, which aren't reranked.
+	}
+
+	copy(sr.Hits, ordered)
+	for hit, score := range scores {
+		hit.Score = score
+	}
+
+	sr.MaxScore = 0
+	for _, hit := range sr.Hits {
+		if hit.Score > sr.MaxScore {
+			sr.MaxScore = hit.Score
+		}
+	}
+}
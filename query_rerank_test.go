@@ -0,0 +1,150 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+func rerankTestResult(ids ...string) *bleve.SearchResult {
+	sr := &bleve.SearchResult{}
+	for i, id := range ids {
+		sr.Hits = append(sr.Hits, &search.DocumentMatch{
+			ID: id, Score: float64(len(ids) - i)})
+	}
+	return sr
+}
+
+func rerankTestIDs(sr *bleve.SearchResult) string {
+	var ids []string
+	for _, hit := range sr.Hits {
+		ids = append(ids, hit.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestValidateBleveRerank(t *testing.T) {
+	if validateBleveRerank(nil) != nil {
+		t.Errorf("expected no reranker ok")
+	}
+	if validateBleveRerank(&BleveRerank{URL: "http://ranker:8080/r"}) != nil {
+		t.Errorf("expected a valid reranker")
+	}
+	for _, r := range []*BleveRerank{
+		{},
+		{URL: "ranker:8080"},
+		{URL: "ftp://ranker/r"},
+		{URL: "http://ranker/r", TopN: -1},
+	} {
+		if validateBleveRerank(r) == nil {
+			t.Errorf("expected err for reranker: %+v", r)
+		}
+	}
+}
+
+func TestQueryRerank(t *testing.T) {
+	r := &BleveRerank{URL: "http://ranker/r"}
+	if queryRerank([]byte(`{}`), nil) != nil {
+		t.Errorf("expected no reranker")
+	}
+	if queryRerank([]byte(`{"ctl":{"timeout":10}}`), r) != r {
+		t.Errorf("expected the reranker by default")
+	}
+	if queryRerank([]byte(`{"ctl":{"rerank":false}}`), r) != nil {
+		t.Errorf("expected the reranker skipped")
+	}
+
+	req := r.gatherRequest(&bleve.SearchRequest{From: 10, Size: 10})
+	if req.From != 0 || req.Size != RERANK_DEFAULT_TOP_N {
+		t.Errorf("expected the top N gathered, got: %d, %d",
+			req.From, req.Size)
+	}
+	req = r.gatherRequest(&bleve.SearchRequest{From: 60, Size: 10})
+	if req.From != 0 || req.Size != 70 {
+		t.Errorf("expected the requested page gathered, got: %d, %d",
+			req.From, req.Size)
+	}
+}
+
+func TestRerankApply(t *testing.T) {
+	score := 9.0
+	sr := rerankTestResult("a", "b", "c", "d", "e")
+	rerankApply(sr, 4, []*rerankResponseHit{
+		{ID: "c", Score: &score}, {ID: "x"}, {ID: "a"}, {ID: "c"},
+	})
+	if ids := rerankTestIDs(sr); ids != "c,a,b,d,e" {
+		t.Errorf("unexpected order: %s", ids)
+	}
+	if sr.Hits[0].Score != 9.0 || sr.MaxScore != 9.0 {
+		t.Errorf("expected the reranked score, got: %v", sr.Hits[0].Score)
+	}
+}
+
+func TestRerank(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			var body struct {
+				Index string `json:"index"`
+				Hits  []struct {
+					ID string `json:"id"`
+				} `json:"hits"`
+			}
+			json.NewDecoder(req.Body).Decode(&body)
+			if body.Index == "slow" {
+				time.Sleep(200 * time.Millisecond)
+			}
+			if body.Index == "broken" {
+				http.Error(w, "oops", 500)
+				return
+			}
+			// Reverse the hits.
+			fmt.Fprint(w, `{"hits":[`)
+			for i := len(body.Hits) - 1; i >= 0; i-- {
+				fmt.Fprintf(w, `{"id":%q}`, body.Hits[i].ID)
+				if i > 0 {
+					fmt.Fprint(w, ",")
+				}
+			}
+			fmt.Fprint(w, `]}`)
+		}))
+	defer server.Close()
+
+	r := &BleveRerank{URL: server.URL, TopN: 3, TimeoutMs: 50}
+
+	sr := rerankTestResult("a", "b", "c", "d")
+	if warning := r.rerank("idx", []byte(`{}`), sr); warning != "" {
+		t.Errorf("expected no warning, got: %s", warning)
+	}
+	if ids := rerankTestIDs(sr); ids != "c,b,a,d" {
+		t.Errorf("expected the top 3 reranked, got: %s", ids)
+	}
+
+	for _, indexName := range []string{"slow", "broken"} {
+		sr = rerankTestResult("a", "b", "c", "d")
+		if warning := r.rerank(indexName, []byte(`{}`), sr); warning == "" {
+			t.Errorf("index: %s, expected a warning", indexName)
+		}
+		if ids := rerankTestIDs(sr); ids != "a,b,c,d" {
+			t.Errorf("index: %s, expected the original order, got: %s",
+				indexName, ids)
+		}
+	}
+}
@@ -0,0 +1,498 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A query string query, like {"query": "+beer name:ale~1"}, is
+// normally parsed by bleve, where the clauses without a "+" or "-"
+// prefix are optional (OR'ed), the clauses without a field are
+// searched in the _all field, and the fuzzy (~N), wildcard (* and ?)
+// and regexp (/re/) syntaxes are always enabled.
+//
+// A QueryStringDialect, from the bleve index params and/or from the
+// ctl of a query request, changes those defaults...
+//
+//   {"queryStringDialect": {
+//      "defaultOperator": "and",        // Optional, "or" or "and".
+//      "defaultFields": ["name", "desc"], // Optional.
+//      "disableFuzzy": true,            // Optional.
+//      "disableWildcard": true,         // Optional.
+//      "disableRegexp": true}}          // Optional.
+//
+// When there's a dialect, the query string queries are parsed by cbft
+// and rewritten into boolean queries before query execution.
+
+type QueryStringDialect struct {
+	// The operator of the clauses without a "+" or "-" prefix, either
+	// "or" (the default) or "and".
+	DefaultOperator string `json:"defaultOperator,omitempty"`
+
+	// The fields that are searched by the clauses without a field,
+	// instead of the _all field.
+	DefaultFields []string `json:"defaultFields,omitempty"`
+
+	DisableFuzzy    bool `json:"disableFuzzy,omitempty"`
+	DisableWildcard bool `json:"disableWildcard,omitempty"`
+	DisableRegexp   bool `json:"disableRegexp,omitempty"`
+}
+
+type queryStringDialectCtlParams struct {
+	Ctl struct {
+		QueryStringDialect *QueryStringDialect `json:"queryStringDialect"`
+	} `json:"ctl"`
+}
+
+// validateQueryStringDialect checks the dialect of the index params.
+func validateQueryStringDialect(d *QueryStringDialect) error {
+	if d == nil {
+		return nil
+	}
+	switch strings.ToLower(d.DefaultOperator) {
+	case "", "or", "and":
+		return nil
+	}
+	return fmt.Errorf("query_string: unknown defaultOperator: %q,"+
+		" must be \"or\" or \"and\"", d.DefaultOperator)
+}
+
+// mergeQueryStringDialects overlays the dialect of a query request
+// over the dialect of the index.  A request can change the default
+// operator and fields, but it can't enable a syntax that's disabled
+// by the index.  Returns nil when there's no dialect.
+func mergeQueryStringDialects(index, request *QueryStringDialect) *QueryStringDialect {
+	if index == nil && request == nil {
+		return nil
+	}
+
+	rv := &QueryStringDialect{}
+	for _, d := range []*QueryStringDialect{index, request} {
+		if d == nil {
+			continue
+		}
+		if d.DefaultOperator != "" {
+			rv.DefaultOperator = strings.ToLower(d.DefaultOperator)
+		}
+		if len(d.DefaultFields) > 0 {
+			rv.DefaultFields = d.DefaultFields
+		}
+		rv.DisableFuzzy = rv.DisableFuzzy || d.DisableFuzzy
+		rv.DisableWildcard = rv.DisableWildcard || d.DisableWildcard
+		rv.DisableRegexp = rv.DisableRegexp || d.DisableRegexp
+	}
+
+	return rv
+}
+
+// rewriteQueryStrings rewrites the query string queries of a JSON
+// search request according to the dialect of the index merged with
+// the dialect of the request, if any.
+func rewriteQueryStrings(req []byte,
+	indexDialect *QueryStringDialect) ([]byte, error) {
+	var p queryStringDialectCtlParams
+	err := json.Unmarshal(req, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateQueryStringDialect(p.Ctl.QueryStringDialect)
+	if err != nil {
+		return nil, err
+	}
+
+	d := mergeQueryStringDialects(indexDialect, p.Ctl.QueryStringDialect)
+	if d == nil {
+		return req, nil
+	}
+
+	return rewriteQueryRequest(req, func(q map[string]interface{}) (
+		interface{}, error) {
+		s, ok := q["query"].(string)
+		if !ok {
+			return nil, nil
+		}
+
+		rv, err := parseQueryString(s, d)
+		if err != nil {
+			return nil, err
+		}
+		if boost, exists := q["boost"]; exists {
+			rv["boost"] = jsonFloat(boost, 1.0)
+		}
+
+		return rv, nil
+	})
+}
+
+// A queryStringClause is a parsed clause of a query string, whose
+// query doesn't have its field yet.
+type queryStringClause struct {
+	occur string // "must", "should" or "must_not".
+	field string
+	query map[string]interface{}
+}
+
+// parseQueryString parses a query string into the JSON of an
+// equivalent boolean query.
+func parseQueryString(s string,
+	d *QueryStringDialect) (map[string]interface{}, error) {
+	defaultOccur := "should"
+	if d.DefaultOperator == "and" {
+		defaultOccur = "must"
+	}
+
+	p := &queryStringParser{s: s, rs: []rune(s), d: d}
+
+	occurs := map[string][]interface{}{}
+
+	for {
+		c, err := p.parseClause(defaultOccur)
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			break
+		}
+		occurs[c.occur] = append(occurs[c.occur], c.fieldQuery(d.DefaultFields))
+	}
+
+	if len(occurs) <= 0 {
+		return map[string]interface{}{"match_none": map[string]interface{}{}}, nil
+	}
+
+	if len(occurs["must"]) <= 0 && len(occurs["should"]) <= 0 {
+		occurs["must"] = []interface{}{
+			map[string]interface{}{"match_all": map[string]interface{}{}},
+		}
+	}
+
+	rv := map[string]interface{}{}
+	if len(occurs["must"]) > 0 {
+		rv["must"] = map[string]interface{}{"conjuncts": occurs["must"]}
+	}
+	if len(occurs["should"]) > 0 {
+		rv["should"] = map[string]interface{}{"disjuncts": occurs["should"]}
+	}
+	if len(occurs["must_not"]) > 0 {
+		rv["must_not"] = map[string]interface{}{"disjuncts": occurs["must_not"]}
+	}
+
+	return rv, nil
+}
+
+// fieldQuery returns the query of a clause on its field, or on each
+// of the default fields when the clause doesn't have a field.
+func (c *queryStringClause) fieldQuery(defaultFields []string) interface{} {
+	onField := func(field string) map[string]interface{} {
+		rv := make(map[string]interface{}, len(c.query)+1)
+		for k, v := range c.query {
+			rv[k] = v
+		}
+		if field != "" {
+			rv["field"] = field
+		}
+		return rv
+	}
+
+	if c.field != "" || len(defaultFields) <= 0 {
+		return onField(c.field)
+	}
+	if len(defaultFields) == 1 {
+		return onField(defaultFields[0])
+	}
+
+	disjuncts := make([]interface{}, 0, len(defaultFields))
+	for _, field := range defaultFields {
+		disjuncts = append(disjuncts, onField(field))
+	}
+
+	return map[string]interface{}{"disjuncts": disjuncts}
+}
+
+type queryStringParser struct {
+	s  string
+	rs []rune
+	i  int
+	d  *QueryStringDialect
+}
+
+func (p *queryStringParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("query_string: "+format+", query: %q",
+		append(args, p.s)...)
+}
+
+// parseClause parses the next clause, like "+name:ale~1^2", returning
+// nil at the end of the query string.
+func (p *queryStringParser) parseClause(defaultOccur string) (
+	*queryStringClause, error) {
+	for p.i < len(p.rs) && unicode.IsSpace(p.rs[p.i]) {
+		p.i++
+	}
+	if p.i >= len(p.rs) {
+		return nil, nil
+	}
+
+	c := &queryStringClause{occur: defaultOccur}
+
+	switch p.rs[p.i] {
+	case '+':
+		c.occur = "must"
+		p.i++
+	case '-':
+		c.occur = "must_not"
+		p.i++
+	}
+
+	c.field = p.parseField()
+
+	if p.i >= len(p.rs) || unicode.IsSpace(p.rs[p.i]) {
+		return nil, p.errorf("missing value at offset %d", p.i)
+	}
+
+	var err error
+
+	switch p.rs[p.i] {
+	case '"':
+		var text string
+		text, err = p.parseQuoted('"')
+		c.query = map[string]interface{}{"match_phrase": text}
+	case '/':
+		if p.d.DisableRegexp {
+			return nil, p.errorf("regexp syntax is disabled")
+		}
+		var re string
+		re, err = p.parseQuoted('/')
+		c.query = map[string]interface{}{"regexp": re}
+	case '>', '<':
+		c.query, err = p.parseRange()
+	default:
+		c.query, err = p.parseWord()
+		if err != nil {
+			return nil, err
+		}
+		return c, nil // A word parses its own boost.
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.parseBoost(c.query)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// parseField parses the optional "field:" of a clause.
+func (p *queryStringParser) parseField() string {
+	if p.i >= len(p.rs) || p.rs[p.i] == '"' || p.rs[p.i] == '/' {
+		return ""
+	}
+
+	var field []rune
+	for j := p.i; j < len(p.rs) && !unicode.IsSpace(p.rs[j]); j++ {
+		switch p.rs[j] {
+		case '\\':
+			if j+1 < len(p.rs) {
+				j++
+				field = append(field, p.rs[j])
+			}
+		case ':':
+			if len(field) <= 0 {
+				return ""
+			}
+			p.i = j + 1
+			return string(field)
+		default:
+			field = append(field, p.rs[j])
+		}
+	}
+
+	return ""
+}
+
+// parseQuoted parses a "phrase" or a /regexp/, where the quote
+// character can be escaped with a backslash.
+func (p *queryStringParser) parseQuoted(quote rune) (string, error) {
+	start := p.i
+	p.i++
+
+	var rv []rune
+	for p.i < len(p.rs) {
+		r := p.rs[p.i]
+		p.i++
+		if r == quote {
+			return string(rv), nil
+		}
+		if r == '\\' && p.i < len(p.rs) && p.rs[p.i] == quote {
+			r = quote
+			p.i++
+		}
+		rv = append(rv, r)
+	}
+
+	return "", p.errorf("unterminated %c at offset %d", quote, start)
+}
+
+// parseRange parses a numeric range, like ">=5", or a date range,
+// like <"2015-06-01".
+func (p *queryStringParser) parseRange() (map[string]interface{}, error) {
+	upper := p.rs[p.i] == '<'
+	p.i++
+
+	inclusive := false
+	if p.i < len(p.rs) && p.rs[p.i] == '=' {
+		inclusive = true
+		p.i++
+	}
+
+	if p.i < len(p.rs) && p.rs[p.i] == '"' {
+		date, err := p.parseQuoted('"')
+		if err != nil {
+			return nil, err
+		}
+		if upper {
+			return map[string]interface{}{
+				"end": date, "inclusive_end": inclusive,
+			}, nil
+		}
+		return map[string]interface{}{
+			"start": date, "inclusive_start": inclusive,
+		}, nil
+	}
+
+	start := p.i
+	for p.i < len(p.rs) && !unicode.IsSpace(p.rs[p.i]) && p.rs[p.i] != '^' {
+		p.i++
+	}
+
+	n, err := strconv.ParseFloat(string(p.rs[start:p.i]), 64)
+	if err != nil {
+		return nil, p.errorf("invalid range value: %q",
+			string(p.rs[start:p.i]))
+	}
+
+	if upper {
+		return map[string]interface{}{
+			"max": n, "inclusive_max": inclusive,
+		}, nil
+	}
+	return map[string]interface{}{
+		"min": n, "inclusive_min": inclusive,
+	}, nil
+}
+
+// parseBoost parses the optional "^boost" suffix of a clause.
+func (p *queryStringParser) parseBoost(q map[string]interface{}) error {
+	if p.i >= len(p.rs) || unicode.IsSpace(p.rs[p.i]) {
+		return nil
+	}
+	if p.rs[p.i] != '^' {
+		return p.errorf("unexpected %q at offset %d", p.rs[p.i], p.i)
+	}
+
+	start := p.i + 1
+	for p.i < len(p.rs) && !unicode.IsSpace(p.rs[p.i]) {
+		p.i++
+	}
+
+	boost, err := strconv.ParseFloat(string(p.rs[start:p.i]), 64)
+	if err != nil {
+		return p.errorf("invalid boost: %q", string(p.rs[start:p.i]))
+	}
+	q["boost"] = boost
+
+	return nil
+}
+
+// parseWord parses a term with its optional fuzzy and boost suffixes,
+// like "ale~1^2", which is a match query, or a wildcard query when the
+// term has an unescaped '*' or '?'.
+func (p *queryStringParser) parseWord() (map[string]interface{}, error) {
+	var word []rune
+	var escaped []bool
+	for p.i < len(p.rs) && !unicode.IsSpace(p.rs[p.i]) {
+		r := p.rs[p.i]
+		p.i++
+		if r == '\\' && p.i < len(p.rs) {
+			word = append(word, p.rs[p.i])
+			escaped = append(escaped, true)
+			p.i++
+			continue
+		}
+		word = append(word, r)
+		escaped = append(escaped, false)
+	}
+
+	lastUnescaped := func(r rune) int {
+		for k := len(word) - 1; k >= 0; k-- {
+			if word[k] == r && !escaped[k] {
+				return k
+			}
+		}
+		return -1
+	}
+
+	rv := map[string]interface{}{}
+
+	if k := lastUnescaped('^'); k >= 0 {
+		boost, err := strconv.ParseFloat(string(word[k+1:]), 64)
+		if err != nil {
+			return nil, p.errorf("invalid boost: %q", string(word[k+1:]))
+		}
+		rv["boost"] = boost
+		word, escaped = word[:k], escaped[:k]
+	}
+
+	if k := lastUnescaped('~'); k >= 0 {
+		if p.d.DisableFuzzy {
+			return nil, p.errorf("fuzzy syntax is disabled")
+		}
+		fuzziness := 1
+		if k+1 < len(word) {
+			var err error
+			fuzziness, err = strconv.Atoi(string(word[k+1:]))
+			if err != nil || fuzziness < 0 {
+				return nil, p.errorf("invalid fuzziness: %q",
+					string(word[k+1:]))
+			}
+		}
+		rv["fuzziness"] = fuzziness
+		word, escaped = word[:k], escaped[:k]
+	}
+
+	if len(word) <= 0 {
+		return nil, p.errorf("missing term at offset %d", p.i)
+	}
+
+	if lastUnescaped('*') >= 0 || lastUnescaped('?') >= 0 {
+		if p.d.DisableWildcard {
+			return nil, p.errorf("wildcard syntax is disabled")
+		}
+		if _, exists := rv["fuzziness"]; exists {
+			return nil, p.errorf("fuzzy wildcard term: %q", string(word))
+		}
+		rv["wildcard"] = string(word)
+		return rv, nil
+	}
+
+	rv["match"] = string(word)
+
+	return rv, nil
+}
@@ -0,0 +1,127 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseQueryString(t *testing.T) {
+	tests := []struct {
+		s      string
+		d      QueryStringDialect
+		exp    string
+		expErr bool
+	}{
+		{"beer", QueryStringDialect{},
+			`{"should":{"disjuncts":[{"match":"beer"}]}}`, false},
+		{"beer ale", QueryStringDialect{DefaultOperator: "and"},
+			`{"must":{"conjuncts":[{"match":"beer"},{"match":"ale"}]}}`, false},
+		{`+name:"pale ale"^2 -style:stout`, QueryStringDialect{},
+			`{"must":{"conjuncts":[{"match_phrase":"pale ale","field":"name","boost":2}]},
+			  "must_not":{"disjuncts":[{"match":"stout","field":"style"}]}}`, false},
+		{"-stout", QueryStringDialect{},
+			`{"must":{"conjuncts":[{"match_all":{}}]},
+			  "must_not":{"disjuncts":[{"match":"stout"}]}}`, false},
+		{"ale~2 abv:>=5.5 updated:<\"2015-06-01\"", QueryStringDialect{},
+			`{"should":{"disjuncts":[{"match":"ale","fuzziness":2},
+			  {"min":5.5,"inclusive_min":true,"field":"abv"},
+			  {"end":"2015-06-01","inclusive_end":false,"field":"updated"}]}}`, false},
+		{"pa* /st.*t/ a\\*b", QueryStringDialect{},
+			`{"should":{"disjuncts":[{"wildcard":"pa*"},{"regexp":"st.*t"},
+			  {"match":"a*b"}]}}`, false},
+		{"ale", QueryStringDialect{DefaultFields: []string{"name", "desc"}},
+			`{"should":{"disjuncts":[{"disjuncts":[
+			  {"match":"ale","field":"name"},{"match":"ale","field":"desc"}]}]}}`, false},
+		{"style:ale", QueryStringDialect{DefaultFields: []string{"name"}},
+			`{"should":{"disjuncts":[{"match":"ale","field":"style"}]}}`, false},
+		{"", QueryStringDialect{}, `{"match_none":{}}`, false},
+		{"ale~1", QueryStringDialect{DisableFuzzy: true}, ``, true},
+		{"pa*", QueryStringDialect{DisableWildcard: true}, ``, true},
+		{"/p.*/", QueryStringDialect{DisableRegexp: true}, ``, true},
+		{`"pale ale`, QueryStringDialect{}, ``, true},
+		{"abv:>high", QueryStringDialect{}, ``, true},
+		{"ale^high", QueryStringDialect{}, ``, true},
+		{"name:", QueryStringDialect{}, ``, true},
+	}
+
+	for i, test := range tests {
+		q, err := parseQueryString(test.s, &test.d)
+		if (err != nil) != test.expErr {
+			t.Errorf("%d: expErr: %v, got err: %v", i, test.expErr, err)
+		}
+		if err != nil || test.expErr {
+			continue
+		}
+
+		var exp, got interface{}
+		json.Unmarshal([]byte(test.exp), &exp)
+		b, _ := json.Marshal(q)
+		json.Unmarshal(b, &got)
+		if !reflect.DeepEqual(exp, got) {
+			t.Errorf("%d: s: %q, expected: %s, got: %s", i, test.s, test.exp, b)
+		}
+	}
+}
+
+func TestMergeQueryStringDialects(t *testing.T) {
+	if mergeQueryStringDialects(nil, nil) != nil {
+		t.Errorf("expected nil dialect")
+	}
+
+	d := mergeQueryStringDialects(
+		&QueryStringDialect{DefaultOperator: "AND", DisableRegexp: true,
+			DefaultFields: []string{"name"}},
+		&QueryStringDialect{DefaultOperator: "or", DisableFuzzy: true})
+	if d.DefaultOperator != "or" ||
+		!reflect.DeepEqual(d.DefaultFields, []string{"name"}) ||
+		!d.DisableRegexp || !d.DisableFuzzy || d.DisableWildcard {
+		t.Errorf("unexpected merged dialect: %#v", d)
+	}
+}
+
+func TestRewriteQueryStrings(t *testing.T) {
+	req := []byte(`{"query":{"query":"beer ale","boost":2},"size":10}`)
+
+	rv, err := rewriteQueryStrings(req, nil)
+	if err != nil || string(rv) != string(req) {
+		t.Errorf("expected no rewrite without a dialect, got: %s, %v", rv, err)
+	}
+
+	rv, err = rewriteQueryStrings(req,
+		&QueryStringDialect{DefaultOperator: "and"})
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	var m map[string]interface{}
+	json.Unmarshal(rv, &m)
+	q := m["query"].(map[string]interface{})
+	if q["boost"] != 2.0 || q["must"] == nil || q["should"] != nil {
+		t.Errorf("expected an AND'ed rewrite, got: %s", rv)
+	}
+
+	req = []byte(`{"ctl":{"queryStringDialect":{"disableWildcard":true}},
+		"query":{"conjuncts":[{"query":"pa*"}]}}`)
+	_, err = rewriteQueryStrings(req, nil)
+	if err == nil {
+		t.Errorf("expected err on a disabled wildcard")
+	}
+
+	req = []byte(`{"ctl":{"queryStringDialect":{"defaultOperator":"xor"}},
+		"query":{"query":"beer"}}`)
+	_, err = rewriteQueryStrings(req, nil)
+	if err == nil {
+		t.Errorf("expected err on an unknown defaultOperator")
+	}
+}
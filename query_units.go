@@ -0,0 +1,249 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Range query values can be given with unit suffixes, which are
+// converted server-side before query execution, like...
+//
+//   {"field": "size", "min": "2GiB", "max": "1TB"}
+//   {"field": "distance", "max": "5km"}
+//   {"field": "updated", "start": "now-30d", "end": "now"}
+//
+// A numeric field's unit is declared in the "units" of the bleve
+// index params, which maps field names to units, like...
+//
+//   {"mapping": {...}, "units": {"size": "KiB", "distance": "m"}}
+//
+// Numeric min/max values are converted into the field's declared unit,
+// or into the base unit of the value's unit family ("m", "B" or "s")
+// when the field has no declared unit.  Date start/end values of the
+// form "now", "now-<duration>" or "now+<duration>" are converted into
+// RFC3339 timestamps relative to the query's time.
+
+// A unitFamily is a set of units, each with its factor relative to
+// the family's base unit.  Unit names are case-insensitive.
+type unitFamily struct {
+	name    string
+	factors map[string]float64
+}
+
+// Distance and bytes are looked up before durations, so that a bare
+// "m" means meters unless a field is declared with a duration unit.
+var unitFamilies = []*unitFamily{
+	{"distance", map[string]float64{
+		"mm": 0.001,
+		"cm": 0.01,
+		"m":  1,
+		"km": 1000,
+		"in": 0.0254,
+		"ft": 0.3048,
+		"yd": 0.9144,
+		"mi": 1609.344,
+		"nm": 1852, // Nautical miles.
+	}},
+	{"bytes", map[string]float64{
+		"b":   1,
+		"kb":  1e3,
+		"mb":  1e6,
+		"gb":  1e9,
+		"tb":  1e12,
+		"pb":  1e15,
+		"kib": 1 << 10,
+		"mib": 1 << 20,
+		"gib": 1 << 30,
+		"tib": 1 << 40,
+		"pib": 1 << 50,
+	}},
+	{"duration", map[string]float64{
+		"ns":  1e-9,
+		"us":  1e-6,
+		"ms":  1e-3,
+		"s":   1,
+		"m":   60,
+		"min": 60,
+		"h":   3600,
+		"d":   86400,
+		"w":   7 * 86400,
+	}},
+}
+
+var unitValueRE = regexp.MustCompile(
+	`^\s*([-+]?[0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?)\s*([a-zA-Z]*)\s*$`)
+
+var unitNowRE = regexp.MustCompile(`^\s*now\s*(?:([-+])\s*(.+))?$`)
+
+// queryUnitsNow is the clock for relative date values, overridable
+// for testing.
+var queryUnitsNow = time.Now
+
+// unitLookup returns the family and factor of a unit, preferring the
+// given family when it's non-nil.
+func unitLookup(unit string, prefer *unitFamily) (*unitFamily, float64, bool) {
+	u := strings.ToLower(unit)
+	if prefer != nil {
+		if f, exists := prefer.factors[u]; exists {
+			return prefer, f, true
+		}
+	}
+	for _, family := range unitFamilies {
+		if f, exists := family.factors[u]; exists {
+			return family, f, true
+		}
+	}
+	return nil, 0, false
+}
+
+// validateUnits checks the declared units of an index's fields.
+func validateUnits(units map[string]string) error {
+	for field, unit := range units {
+		_, _, ok := unitLookup(unit, nil)
+		if !ok {
+			return fmt.Errorf("query_units: unknown unit: %s,"+
+				" field: %s", unit, field)
+		}
+	}
+	return nil
+}
+
+// convertUnitValue converts a unit-suffixed value, like "5km", into
+// the given field unit, or into its family's base unit when the field
+// unit is "".
+func convertUnitValue(s, fieldUnit string) (float64, error) {
+	var prefer *unitFamily
+	var fieldFactor float64 = 1
+
+	if fieldUnit != "" {
+		family, f, ok := unitLookup(fieldUnit, nil)
+		if !ok {
+			return 0, fmt.Errorf("query_units: unknown field unit: %s",
+				fieldUnit)
+		}
+		prefer, fieldFactor = family, f
+	}
+
+	m := unitValueRE.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("query_units: could not parse value: %q", s)
+	}
+
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("query_units: could not parse value: %q,"+
+			" err: %v", s, err)
+	}
+
+	if m[2] == "" {
+		return n, nil // Already in the field's unit.
+	}
+
+	family, f, ok := unitLookup(m[2], prefer)
+	if !ok {
+		return 0, fmt.Errorf("query_units: unknown unit: %s, value: %q",
+			m[2], s)
+	}
+	if prefer != nil && family != prefer {
+		return 0, fmt.Errorf("query_units: unit: %s (%s) does not match"+
+			" field unit: %s (%s), value: %q",
+			m[2], family.name, fieldUnit, prefer.name, s)
+	}
+
+	return n * f / fieldFactor, nil
+}
+
+// convertUnitDate converts a relative date value, like "now-30d",
+// into an RFC3339 timestamp.  The ok result is false when the value
+// isn't a relative date value, in which case it's left as-is.
+func convertUnitDate(s string, now time.Time) (string, bool, error) {
+	m := unitNowRE.FindStringSubmatch(s)
+	if m == nil {
+		return "", false, nil
+	}
+
+	t := now
+	if m[1] != "" {
+		secs, err := convertUnitValue(m[2], "s")
+		if err != nil {
+			return "", false, err
+		}
+		d := time.Duration(secs * float64(time.Second))
+		if m[1] == "-" {
+			d = -d
+		}
+		t = t.Add(d)
+	}
+
+	return t.Format(time.RFC3339Nano), true, nil
+}
+
+// rewriteUnitRanges converts any unit-suffixed values of the range
+// queries in a JSON search request, where units maps field names to
+// their declared units (and may be nil).
+func rewriteUnitRanges(req []byte,
+	units map[string]string) ([]byte, error) {
+	now := queryUnitsNow()
+
+	return rewriteQueryRequest(req, func(q map[string]interface{}) (
+		interface{}, error) {
+		field, _ := q["field"].(string)
+
+		var rv map[string]interface{}
+
+		replace := func(k string, v interface{}) {
+			if rv == nil {
+				rv = make(map[string]interface{}, len(q))
+				for qk, qv := range q {
+					rv[qk] = qv
+				}
+			}
+			rv[k] = v
+		}
+
+		for _, k := range []string{"min", "max"} {
+			s, ok := q[k].(string)
+			if !ok {
+				continue
+			}
+			n, err := convertUnitValue(s, units[field])
+			if err != nil {
+				return nil, fmt.Errorf("%v, field: %s", err, field)
+			}
+			replace(k, n)
+		}
+
+		for _, k := range []string{"start", "end"} {
+			s, ok := q[k].(string)
+			if !ok {
+				continue
+			}
+			t, ok, err := convertUnitDate(s, now)
+			if err != nil {
+				return nil, fmt.Errorf("%v, field: %s", err, field)
+			}
+			if ok {
+				replace(k, t)
+			}
+		}
+
+		if rv == nil {
+			return nil, nil
+		}
+		return rv, nil
+	})
+}
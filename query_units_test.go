@@ -0,0 +1,136 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestConvertUnitValue(t *testing.T) {
+	tests := []struct {
+		s         string
+		fieldUnit string
+		exp       float64
+		expErr    bool
+	}{
+		{"5km", "", 5000, false},
+		{"5km", "m", 5000, false},
+		{"5000m", "km", 5, false},
+		{"2GiB", "", 2 << 30, false},
+		{"2GiB", "MiB", 2048, false},
+		{"1.5 kb", "B", 1500, false},
+		{"30d", "h", 720, false},
+		{"30m", "s", 1800, false}, // Minutes, given a duration field.
+		{"30m", "", 30, false},    // Meters, by default.
+		{"42", "KiB", 42, false},
+		{"5km", "GiB", 0, true},
+		{"5parsecs", "", 0, true},
+		{"five km", "", 0, true},
+		{"5km", "furlongs", 0, true},
+	}
+
+	for i, test := range tests {
+		n, err := convertUnitValue(test.s, test.fieldUnit)
+		if (err != nil) != test.expErr {
+			t.Errorf("%d: expErr: %v, got err: %v", i, test.expErr, err)
+		}
+		if err == nil && n != test.exp {
+			t.Errorf("%d: expected: %v, got: %v", i, test.exp, n)
+		}
+	}
+}
+
+func TestConvertUnitDate(t *testing.T) {
+	now := time.Date(2015, 6, 30, 12, 0, 0, 0, time.UTC)
+
+	s, ok, err := convertUnitDate("now-30d", now)
+	if err != nil || !ok || s != "2015-05-31T12:00:00Z" {
+		t.Errorf("expected 30 days ago, got: %s, %v, %v", s, ok, err)
+	}
+
+	s, ok, err = convertUnitDate("now", now)
+	if err != nil || !ok || s != "2015-06-30T12:00:00Z" {
+		t.Errorf("expected now, got: %s, %v, %v", s, ok, err)
+	}
+
+	_, ok, err = convertUnitDate("2015-01-01", now)
+	if err != nil || ok {
+		t.Errorf("expected absolute dates to be left as-is")
+	}
+
+	_, _, err = convertUnitDate("now-3km", now)
+	if err == nil {
+		t.Errorf("expected err on non-duration unit")
+	}
+}
+
+func TestRewriteUnitRanges(t *testing.T) {
+	prevNow := queryUnitsNow
+	defer func() { queryUnitsNow = prevNow }()
+	queryUnitsNow = func() time.Time {
+		return time.Date(2015, 6, 30, 12, 0, 0, 0, time.UTC)
+	}
+
+	req := []byte(`{"query":{"query":"hello"},"size":10}`)
+	res, err := rewriteUnitRanges(req, nil)
+	if err != nil || string(res) != string(req) {
+		t.Errorf("expected unchanged req, got: %s, err: %v", res, err)
+	}
+
+	req = []byte(`{"query":{"conjuncts":[` +
+		`{"field":"size","min":"2GiB","max":4096},` +
+		`{"field":"updated","start":"now-1h","end":"2015-07-01"}]}}`)
+	res, err = rewriteUnitRanges(req, map[string]string{"size": "MiB"})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	var r struct {
+		Query struct {
+			Conjuncts []map[string]interface{} `json:"conjuncts"`
+		} `json:"query"`
+	}
+	err = json.Unmarshal(res, &r)
+	if err != nil || len(r.Query.Conjuncts) != 2 {
+		t.Fatalf("expected 2 conjuncts, got: %s, err: %v", res, err)
+	}
+	if r.Query.Conjuncts[0]["min"] != float64(2048) ||
+		r.Query.Conjuncts[0]["max"] != float64(4096) {
+		t.Errorf("expected converted min, got: %#v", r.Query.Conjuncts[0])
+	}
+	if r.Query.Conjuncts[1]["start"] != "2015-06-30T11:00:00Z" ||
+		r.Query.Conjuncts[1]["end"] != "2015-07-01" {
+		t.Errorf("expected converted start, got: %#v", r.Query.Conjuncts[1])
+	}
+
+	req = []byte(`{"query":{"field":"size","min":"2km"}}`)
+	_, err = rewriteUnitRanges(req, map[string]string{"size": "MiB"})
+	if err == nil {
+		t.Errorf("expected err on mismatched units")
+	}
+}
+
+func TestValidateUnits(t *testing.T) {
+	err := ValidateBlevePIndexImpl("bleve", "idx",
+		`{"units":{"size":"KiB","distance":"km"}}`)
+	if err != nil {
+		t.Errorf("expected valid units, err: %v", err)
+	}
+
+	err = ValidateBlevePIndexImpl("bleve", "idx",
+		`{"units":{"size":"bogus"}}`)
+	if err == nil {
+		t.Errorf("expected err on unknown unit")
+	}
+}
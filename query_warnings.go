@@ -0,0 +1,160 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/blevesearch/bleve"
+)
+
+// Query responses carry a "warnings" array, which is a channel for
+// giving clients advance notice of behavioral changes (like ignored,
+// deprecated or unsupported request fields) without breaking them.
+
+// SearchResultEx is a bleve.SearchResult with cbft-specific
+// additions to the query response.
+type SearchResultEx struct {
+	*bleve.SearchResult
+	Warnings []string `json:"warnings"`
+
+	// Set when the query allowed partial results and some pindexes
+	// didn't respond, keyed by pindex name, with the pindex's error,
+	// or when some hits couldn't be fetched from the KV store.
+	Partial        bool              `json:"partial,omitempty"`
+	FailedPIndexes map[string]string `json:"failedPIndexes,omitempty"`
+
+	Aggregations map[string]*QueryAggregationResult `json:"aggregations,omitempty"`
+
+	Cardinalities map[string]*QueryCardinalityResult `json:"cardinalities,omitempty"`
+
+	FacetPages map[string]*QueryFacetPage `json:"facetPages,omitempty"`
+
+	Collapse *QueryCollapseResult `json:"collapse,omitempty"`
+
+	Groups *QueryGroupsResult `json:"groups,omitempty"`
+
+	GeoDistance *QueryGeoDistanceResult `json:"geoDistance,omitempty"`
+}
+
+// The top-level fields of a query request that are understood,
+// keyed by field name.  Features that add request fields should
+// register them here, so that they don't trigger warnings.
+var QueryRequestFields = map[string]bool{
+	"ctl":       true,
+	"query":     true,
+	"size":      true,
+	"from":      true,
+	"highlight": true,
+	"fields":    true,
+	"facets":    true,
+	"explain":   true,
+
+	"fetchFromKV":  true,
+	"aggregations": true,
+	"collapse":     true,
+	"group":        true,
+	"geoDistance":  true,
+}
+
+// Top-level fields of a query request that are deprecated, keyed by
+// field name, with a warning message.
+var QueryRequestFieldsDeprecated = map[string]string{
+	"timeout": "deprecated request field: timeout, which is ignored;" +
+		" please use ctl.timeout instead",
+	"consistency": "deprecated request field: consistency, which is" +
+		" ignored; please use ctl.consistency instead",
+}
+
+// Top-level fields of a query request that are not supported by
+// this version, keyed by field name, with a warning message.
+var QueryRequestFieldsUnsupported = map[string]string{
+	"sort": "unsupported request field: sort, which is ignored;" +
+		" results are ordered by score",
+}
+
+// queryRequestWarnings returns warnings about the fields of a JSON
+// query request.
+func queryRequestWarnings(req []byte) []string {
+	v, err := parseJSONUseNumber(req)
+	if err != nil {
+		return nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rv []string
+	for _, name := range names {
+		if QueryRequestFields[name] {
+			continue
+		}
+		if msg, exists := QueryRequestFieldsDeprecated[name]; exists {
+			rv = append(rv, msg)
+			continue
+		}
+		if msg, exists := QueryRequestFieldsUnsupported[name]; exists {
+			rv = append(rv, msg)
+			continue
+		}
+		rv = append(rv, fmt.Sprintf("unknown request field: %s,"+
+			" which is ignored", name))
+	}
+
+	return rv
+}
+
+// queryResultWarnings returns warnings about a search result, such
+// as facets that were truncated by their requested size.
+func queryResultWarnings(sr *bleve.SearchResult) []string {
+	if sr == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(sr.Facets))
+	for name := range sr.Facets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rv []string
+	for _, name := range names {
+		fr := sr.Facets[name]
+		if fr != nil && fr.Other > 0 {
+			rv = append(rv, fmt.Sprintf("facet size truncated,"+
+				" facet: %s, other: %d", name, fr.Other))
+		}
+	}
+
+	return rv
+}
+
+// newSearchResultEx wraps a search result along with its warnings.
+func newSearchResultEx(sr *bleve.SearchResult,
+	warnings []string) *SearchResultEx {
+	warnings = append(warnings, queryResultWarnings(sr)...)
+	if warnings == nil {
+		warnings = []string{}
+	}
+	return &SearchResultEx{
+		SearchResult: sr,
+		Warnings:     warnings,
+	}
+}
@@ -0,0 +1,77 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+func TestQueryRequestWarnings(t *testing.T) {
+	tests := []struct {
+		req      string
+		warnings []string
+	}{
+		{`{"query":{"query":"x"},"size":10,"ctl":{"timeout":10}}`, nil},
+		{`not json`, nil},
+		{`{"query":{"query":"x"},"timeout":10}`,
+			[]string{"deprecated request field: timeout"}},
+		{`{"query":{"query":"x"},"sort":["name"]}`,
+			[]string{"unsupported request field: sort"}},
+		{`{"query":{"query":"x"},"bogus":1,"zzz":2}`,
+			[]string{"unknown request field: bogus",
+				"unknown request field: zzz"}},
+	}
+
+	for _, test := range tests {
+		warnings := queryRequestWarnings([]byte(test.req))
+		if len(warnings) != len(test.warnings) {
+			t.Errorf("expected warnings: %#v, got: %#v, req: %s",
+				test.warnings, warnings, test.req)
+			continue
+		}
+		for i, w := range warnings {
+			if !strings.HasPrefix(w, test.warnings[i]) {
+				t.Errorf("expected warning: %s, got: %s, req: %s",
+					test.warnings[i], w, test.req)
+			}
+		}
+	}
+}
+
+func TestNewSearchResultEx(t *testing.T) {
+	sr := &bleve.SearchResult{
+		Facets: search.FacetResults{
+			"type": &search.FacetResult{Field: "type", Total: 10, Other: 3},
+			"tags": &search.FacetResult{Field: "tags", Total: 10},
+		},
+	}
+
+	srx := newSearchResultEx(sr, nil)
+	if len(srx.Warnings) != 1 ||
+		!strings.HasPrefix(srx.Warnings[0], "facet size truncated") {
+		t.Errorf("expected facet truncation warning, got: %#v",
+			srx.Warnings)
+	}
+
+	buf, err := json.Marshal(newSearchResultEx(&bleve.SearchResult{}, nil))
+	if err != nil ||
+		!strings.Contains(string(buf), `"warnings":[]`) ||
+		!strings.Contains(string(buf), `"total_hits":0`) {
+		t.Errorf("expected warnings and flattened result, got: %s, err: %v",
+			buf, err)
+	}
+}
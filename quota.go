@@ -0,0 +1,274 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// IndexQuotaRequest holds the parts of an index create/update
+// request that are needed to check the quotas of the index's
+// namespace, or to detect an update of only its replicas.
+type IndexQuotaRequest struct {
+	IndexName     string
+	IndexType     string
+	IndexParams   string
+	SourceType    string
+	SourceName    string
+	SourceUUID    string
+	SourceParams  string
+	PlanParams    cbgt.PlanParams
+	PrevIndexUUID string
+}
+
+// NamespaceUsage represents the resources used by the indexes of a
+// namespace, as counted against the namespace's quotas.
+type NamespaceUsage struct {
+	Indexes    int `json:"indexes"`
+	Partitions int `json:"partitions"`
+
+	// The estimated disk usage across all nodes and replicas, where
+	// the plan pindexes whose size isn't known yet aren't counted.
+	DiskBytes int64 `json:"diskBytes"`
+}
+
+// CalcNamespaceUsage computes the resources used by the indexes of
+// a namespace, optionally excluding an index (such as an index that's
+// being updated).
+func CalcNamespaceUsage(mgr *cbgt.Manager, namespace, excludeIndex string) (
+	*NamespaceUsage, error) {
+	indexNames, err := NamespaceIndexNames(mgr, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	planPIndexes, _, err := cbgt.CfgGetPlanPIndexes(mgr.Cfg())
+	if err != nil {
+		return nil, fmt.Errorf("quota: could not retrieve plan pindexes,"+
+			" err: %v", err)
+	}
+
+	rv := &NamespaceUsage{}
+
+	included := map[string]bool{}
+	for _, indexName := range indexNames {
+		if indexName != excludeIndex {
+			included[indexName] = true
+			rv.Indexes++
+		}
+	}
+
+	if planPIndexes != nil {
+		pindexBytes := LocalPIndexBytesEstimator(mgr, planPIndexes)
+
+		for _, planPIndex := range planPIndexes.PlanPIndexes {
+			if !included[planPIndex.IndexName] {
+				continue
+			}
+			rv.Partitions++
+
+			bytes, ok := pindexBytes(planPIndex)
+			if ok {
+				rv.DiskBytes += bytes * int64(len(planPIndex.Nodes))
+			}
+		}
+	}
+
+	return rv, nil
+}
+
+// IndexQuotaPartitions returns the number of partitions (plan
+// pindexes) that an index create/update request would have, based on
+// the current partitions of the data source and the request's
+// maxPartitionsPerPIndex.
+func IndexQuotaPartitions(mgr *cbgt.Manager, r *IndexQuotaRequest) (
+	int, error) {
+	if r.IndexType == "alias" {
+		return 0, nil // An alias has no pindexes.
+	}
+
+	feedType, exists := cbgt.FeedTypes[r.SourceType]
+	if !exists || feedType == nil || feedType.Partitions == nil {
+		return 1, nil // Leave it to the create handler to complain.
+	}
+
+	partitions, err := feedType.Partitions(r.SourceType, r.SourceName,
+		r.SourceUUID, r.SourceParams, mgr.Server())
+	if err != nil {
+		return 0, fmt.Errorf("quota: could not retrieve partitions of"+
+			" sourceName: %s, err: %v", r.SourceName, err)
+	}
+
+	maxPerPIndex := r.PlanParams.MaxPartitionsPerPIndex
+	if len(partitions) <= 0 || maxPerPIndex <= 0 {
+		return 1, nil
+	}
+
+	return (len(partitions) + maxPerPIndex - 1) / maxPerPIndex, nil
+}
+
+// CheckNamespaceQuota returns an error if an index create/update
+// request would exceed a quota of the index's namespace.  The
+// maxIndexes and maxDiskBytes quotas only limit the creation of new
+// indexes, so that an existing index can always be updated, such as
+// to reduce its partitions.  Indexes that aren't in a namespace are
+// always allowed.
+func CheckNamespaceQuota(mgr *cbgt.Manager, r *IndexQuotaRequest) error {
+	namespace, _, ok := ParseNamespaceIndexName(r.IndexName)
+	if !ok {
+		return nil
+	}
+
+	ns, err := GetNamespace(mgr.Cfg(), namespace)
+	if err != nil || ns == nil {
+		return err
+	}
+	if ns.MaxIndexes <= 0 && ns.MaxDiskBytes <= 0 &&
+		ns.MaxPartitions <= 0 && ns.MaxPartitionsPerIndex <= 0 {
+		return nil
+	}
+
+	usage, err := CalcNamespaceUsage(mgr, namespace, r.IndexName)
+	if err != nil {
+		return err
+	}
+
+	indexNames, err := NamespaceIndexNames(mgr, namespace)
+	if err != nil {
+		return err
+	}
+	update := len(indexNames) > usage.Indexes
+
+	if !update {
+		if ns.MaxIndexes > 0 && usage.Indexes >= ns.MaxIndexes {
+			return fmt.Errorf("quota: namespace: %s is at its quota"+
+				" of maxIndexes: %d", namespace, ns.MaxIndexes)
+		}
+
+		if ns.MaxDiskBytes > 0 && usage.DiskBytes >= ns.MaxDiskBytes {
+			return fmt.Errorf("quota: namespace: %s is at its quota"+
+				" of maxDiskBytes: %d, diskBytes: %d",
+				namespace, ns.MaxDiskBytes, usage.DiskBytes)
+		}
+	}
+
+	if ns.MaxPartitions <= 0 && ns.MaxPartitionsPerIndex <= 0 {
+		return nil
+	}
+
+	partitions, err := IndexQuotaPartitions(mgr, r)
+	if err != nil {
+		return err
+	}
+
+	if ns.MaxPartitionsPerIndex > 0 && partitions > ns.MaxPartitionsPerIndex {
+		return fmt.Errorf("quota: index: %s would have %d partitions,"+
+			" exceeding the quota of maxPartitionsPerIndex: %d"+
+			" of namespace: %s, try a larger maxPartitionsPerPIndex"+
+			" planParam", r.IndexName, partitions,
+			ns.MaxPartitionsPerIndex, namespace)
+	}
+
+	if ns.MaxPartitions > 0 && usage.Partitions+partitions > ns.MaxPartitions {
+		return fmt.Errorf("quota: index: %s would have %d partitions,"+
+			" but namespace: %s already has %d of its quota of"+
+			" maxPartitions: %d", r.IndexName, partitions,
+			namespace, usage.Partitions, ns.MaxPartitions)
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------
+
+// readIndexQuotaRequest retrieves the quota related params of an
+// index create/update request, leaving the request body intact for
+// the next handler.
+func readIndexQuotaRequest(indexName string, req *http.Request) (
+	*IndexQuotaRequest, error) {
+	err := req.ParseForm()
+	if err != nil {
+		return nil, fmt.Errorf("quota: could not parse form, err: %v", err)
+	}
+
+	var requestBody []byte
+	if req.Body != nil {
+		requestBody, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("quota: could not read request body,"+
+				" err: %v", err)
+		}
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(requestBody))
+	req.ContentLength = int64(len(requestBody))
+
+	return parseIndexQuotaRequest(indexName, req, requestBody)
+}
+
+// parseIndexQuotaRequest retrieves the quota related params of an
+// index create/update request from either its form params or its
+// JSON request body.
+func parseIndexQuotaRequest(indexName string, req *http.Request,
+	requestBody []byte) (*IndexQuotaRequest, error) {
+	var body map[string]interface{}
+	if len(bytes.TrimSpace(requestBody)) > 0 {
+		json.Unmarshal(requestBody, &body) // Non-JSON is left as-is.
+	}
+
+	param := func(formName, bodyName string) string {
+		if s := req.Form.Get(formName); s != "" {
+			return s
+		}
+		if body == nil || body[bodyName] == nil {
+			return ""
+		}
+		if s, ok := body[bodyName].(string); ok {
+			return s
+		}
+		buf, _ := json.Marshal(body[bodyName])
+		return string(buf)
+	}
+
+	r := &IndexQuotaRequest{
+		IndexName:     indexName,
+		IndexType:     param("indexType", "type"),
+		IndexParams:   param("indexParams", "params"),
+		SourceType:    param("sourceType", "sourceType"),
+		SourceName:    param("sourceName", "sourceName"),
+		SourceUUID:    param("sourceUUID", "sourceUUID"),
+		SourceParams:  param("sourceParams", "sourceParams"),
+		PrevIndexUUID: param("prevIndexUUID", "prevIndexUUID"),
+	}
+	if r.SourceName == "" {
+		r.SourceName = indexName
+	}
+
+	if s := param("planParams", "planParams"); s != "" {
+		err := json.Unmarshal([]byte(s), &r.PlanParams)
+		if err != nil {
+			return nil, fmt.Errorf("quota: could not parse planParams,"+
+				" err: %v", err)
+		}
+	}
+
+	return r, nil
+}
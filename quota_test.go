@@ -0,0 +1,137 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestParseIndexQuotaRequest(t *testing.T) {
+	body := []byte(`{"type":"bleve","sourceType":"couchbase",` +
+		`"planParams":{"maxPartitionsPerPIndex":16}}`)
+	req, _ := http.NewRequest("PUT", "/api/index/acme__a",
+		bytes.NewBuffer(body))
+	req.ParseForm()
+
+	r, err := parseIndexQuotaRequest("acme__a", req, body)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if r.IndexType != "bleve" || r.SourceType != "couchbase" ||
+		r.SourceName != "acme__a" || r.PlanParams.MaxPartitionsPerPIndex != 16 {
+		t.Errorf("unexpected quota request: %#v", r)
+	}
+
+	req, _ = http.NewRequest("PUT",
+		"/api/index/acme__a?indexType=alias&planParams=bad", nil)
+	req.ParseForm()
+
+	_, err = parseIndexQuotaRequest("acme__a", req, nil)
+	if err == nil {
+		t.Errorf("expected err on bad planParams")
+	}
+}
+
+func TestCheckNamespaceQuota(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	err := SetNamespace(cfg, &Namespace{Name: "acme", MaxPartitions: -1})
+	if err == nil {
+		t.Errorf("expected err on a negative quota")
+	}
+
+	err = SetNamespace(cfg, &Namespace{
+		Name:                  "acme",
+		MaxIndexes:            1,
+		MaxPartitionsPerIndex: 1,
+	})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	newReq := func(indexName string) *IndexQuotaRequest {
+		return &IndexQuotaRequest{
+			IndexName:  indexName,
+			IndexType:  "blackhole",
+			SourceType: "nil",
+		}
+	}
+
+	err = CheckNamespaceQuota(mgr, newReq("acme__a"))
+	if err != nil {
+		t.Errorf("expected room for an index, err: %v", err)
+	}
+
+	err = mgr.CreateIndex("nil", "", "", "",
+		"blackhole", "acme__a", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	err = CheckNamespaceQuota(mgr, newReq("acme__a"))
+	if err != nil {
+		t.Errorf("expected updates to be allowed, err: %v", err)
+	}
+	err = CheckNamespaceQuota(mgr, newReq("acme__b"))
+	if err == nil {
+		t.Errorf("expected err on exceeding maxIndexes")
+	}
+	err = CheckNamespaceQuota(mgr, newReq("other"))
+	if err != nil {
+		t.Errorf("expected indexes outside namespaces to be allowed")
+	}
+
+	usage, err := CalcNamespaceUsage(mgr, "acme", "")
+	if err != nil || usage.Indexes != 1 {
+		t.Errorf("expected usage of 1 index, got: %#v, err: %v", usage, err)
+	}
+
+	// The create guard handler rejects before reaching the next
+	// handler.
+	called := false
+	h := NewIndexCreateGuardHandler(mgr, http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) { called = true }))
+
+	r := mux.NewRouter()
+	r.Handle("/api/index/{indexName}", h).Methods("PUT")
+	req, _ := http.NewRequest("PUT",
+		"/api/index/acme__b?indexType=blackhole&sourceType=nil", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != 400 || called {
+		t.Errorf("expected 400 on exceeding maxIndexes, got: %d", rr.Code)
+	}
+
+	req, _ = http.NewRequest("PUT",
+		"/api/index/acme__a?indexType=blackhole&sourceType=nil", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if !called {
+		t.Errorf("expected an update to reach the next handler, got: %d",
+			rr.Code)
+	}
+}
@@ -14,8 +14,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/blevesearch/bleve"
 	"github.com/blevesearch/bleve/document"
@@ -25,8 +29,16 @@ import (
 	"github.com/couchbaselabs/cbgt"
 )
 
-var httpPost = http.Post // Overridable for unit-testability.
-var httpGet = http.Get   // Overridable for unit-testability.
+// Overridable for unit-testability.
+var httpPost = func(url, bodyType string, body io.Reader) (
+	*http.Response, error) {
+	return NodeHTTPClient.Post(url, bodyType, body)
+}
+
+// Overridable for unit-testability.
+var httpGet = func(url string) (*http.Response, error) {
+	return NodeHTTPClient.Get(url)
+}
 
 var indexClientUnimplementedErr = errors.New("unimplemented")
 
@@ -40,6 +52,8 @@ var indexClientUnimplementedErr = errors.New("unimplemented")
 type IndexClient struct {
 	QueryURL    string
 	CountURL    string
+	DocURL      string // Optional, a prefix that's completed by a docID.
+	DocsURL     string // Optional, for iterating the docs in doc ID order.
 	Consistency *cbgt.ConsistencyParams
 }
 
@@ -55,8 +69,90 @@ func (r *IndexClient) Batch(b *bleve.Batch) error {
 	return indexClientUnimplementedErr
 }
 
+// Document retrieves the stored fields of a document from the remote
+// pindex.  Only the stored fields that have string values (or arrays
+// of strings) are returned, as text fields.
 func (r *IndexClient) Document(id string) (*document.Document, error) {
-	return nil, indexClientUnimplementedErr
+	if r.DocURL == "" {
+		return nil, indexClientUnimplementedErr
+	}
+	docURL := r.DocURL + strings.Replace(url.QueryEscape(id), "+", "%20", -1)
+	resp, err := httpGet(docURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return nil, nil
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("remote: document got status code: %d,"+
+			" docURL: %s, resp: %#v", resp.StatusCode, docURL, resp)
+	}
+	respBuf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("remote: document error reading resp.Body,"+
+			" docURL: %s, resp: %#v", docURL, resp)
+	}
+	rv := struct {
+		ID     string                 `json:"id"`
+		Fields map[string]interface{} `json:"fields"`
+	}{}
+	err = json.Unmarshal(respBuf, &rv)
+	if err != nil {
+		return nil, fmt.Errorf("remote: document error parsing respBuf: %s,"+
+			" docURL: %s, resp: %#v", respBuf, docURL, resp)
+	}
+	doc := document.NewDocument(id)
+	for name, v := range rv.Fields {
+		switch v := v.(type) {
+		case string:
+			doc.AddField(document.NewTextField(name, nil, []byte(v)))
+		case []interface{}:
+			for i, vi := range v {
+				if s, ok := vi.(string); ok {
+					doc.AddField(document.NewTextField(name,
+						[]uint64{uint64(i)}, []byte(s)))
+				}
+			}
+		}
+	}
+	return doc, nil
+}
+
+// DocsAfter retrieves up to limit docs of the remote pindex, in doc
+// ID order, whose doc ID's are after a doc ID.
+func (r *IndexClient) DocsAfter(after string, limit int) (
+	[]*bleveDoc, error) {
+	if r.DocsURL == "" {
+		return nil, indexClientUnimplementedErr
+	}
+	docsURL := r.DocsURL + "?after=" + url.QueryEscape(after) +
+		"&limit=" + strconv.Itoa(limit)
+	resp, err := httpGet(docsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("remote: docs got status code: %d,"+
+			" docsURL: %s, resp: %#v", resp.StatusCode, docsURL, resp)
+	}
+	respBuf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("remote: docs error reading resp.Body,"+
+			" docsURL: %s, resp: %#v", docsURL, resp)
+	}
+	rv := struct {
+		Status string      `json:"status"`
+		Docs   []*bleveDoc `json:"docs"`
+	}{}
+	err = json.Unmarshal(respBuf, &rv)
+	if err != nil {
+		return nil, fmt.Errorf("remote: docs error parsing respBuf: %s,"+
+			" docsURL: %s, resp: %#v", respBuf, docsURL, resp)
+	}
+	return rv.Docs, nil
 }
 
 func (r *IndexClient) DocCount() (uint64, error) {
@@ -0,0 +1,388 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The numReplicas of a live index can be raised or lowered without
+// rebuilding the index.  An index update that only changes the
+// numReplicas of the plan params is applied in place, keeping the
+// index's UUID, so that the planner keeps the index's existing
+// pindexes and only adds or removes their replica copies.
+//
+// A new replica copy of a pindex is seeded, when possible, from a
+// node that already has the pindex, using the pindex file transfer
+// protocol, so that the replica only needs to catch up from the
+// seeded snapshot's seq's instead of indexing from zero.  Only a
+// replica (not the primary) of a partition that the source has
+// already built is seeded, so a new index or a moved primary is
+// built from its data source as usual.  The source copies its files
+// into a snapshot while its ingest is paused, and the files of the
+// snapshot are fetched by a background goroutine into a seed dir,
+// outside of the janitor, which is kicked to create the pindex from
+// the seed dir once the fetch is done.  Seeding is best-effort,
+// falling back to a full build of the replica, and can be turned off
+// with the replicaCatchUp=false node option.
+
+var replicaM sync.Mutex // Protects the fields that follow.
+
+var replicaMgr *cbgt.Manager
+
+// The seeds of new replica pindexes, keyed by pindex path.
+var replicaSeeds = map[string]*replicaSeedState{}
+
+type replicaSeedState struct {
+	done bool
+	ok   bool
+}
+
+// The suffix of the dir that a new replica pindex is seeded into,
+// which is renamed to the pindex's path once the seed is complete.
+const REPLICA_SEED_SUFFIX = ".seed"
+
+var errReplicaSeeding = errors.New("replicas: seeding from a peer")
+
+// ReplicaCatchUpStart enables the seeding of new replica pindexes of
+// a node from the node's peers.
+func ReplicaCatchUpStart(mgr *cbgt.Manager) {
+	if mgr.Options()["replicaCatchUp"] == "false" {
+		return
+	}
+
+	replicaM.Lock()
+	replicaMgr = mgr
+	replicaM.Unlock()
+}
+
+// IndexReplicasOnlyChange returns true when an index update request
+// only changes the numReplicas of an index definition.
+func IndexReplicasOnlyChange(indexDef *cbgt.IndexDef,
+	r *IndexQuotaRequest) bool {
+	if indexDef == nil || r.PrevIndexUUID != indexDef.UUID {
+		return false
+	}
+
+	if r.PlanParams.NumReplicas == indexDef.PlanParams.NumReplicas {
+		return false
+	}
+
+	planParams := r.PlanParams
+	planParams.NumReplicas = indexDef.PlanParams.NumReplicas
+
+	return r.IndexType == indexDef.Type &&
+		r.SourceType == indexDef.SourceType &&
+		r.SourceName == indexDef.SourceName &&
+		(r.SourceUUID == "" || r.SourceUUID == indexDef.SourceUUID) &&
+		jsonStringsEqual(r.IndexParams, indexDef.Params) &&
+		jsonStringsEqual(r.SourceParams, indexDef.SourceParams) &&
+		reflect.DeepEqual(planParams, indexDef.PlanParams)
+}
+
+// SetIndexNumReplicas changes the numReplicas of an index definition
+// in place, keeping the index's UUID, where the index must still have
+// the indexUUID.
+func SetIndexNumReplicas(cfg cbgt.Cfg, indexName, indexUUID string,
+	numReplicas int) error {
+	if numReplicas < 0 {
+		return fmt.Errorf("replicas: numReplicas must be >= 0,"+
+			" indexName: %s", indexName)
+	}
+
+	return CfgUpdateJSON(cfg, cbgt.INDEX_DEFS_KEY,
+		func() interface{} { return &cbgt.IndexDefs{} },
+		func(v interface{}) error {
+			indexDefs := v.(*cbgt.IndexDefs)
+
+			indexDef := indexDefs.IndexDefs[indexName]
+			if indexDef == nil || indexDef.UUID != indexUUID {
+				return fmt.Errorf("replicas: index was changed,"+
+					" indexName: %s, indexUUID: %s", indexName, indexUUID)
+			}
+
+			indexDef.PlanParams.NumReplicas = numReplicas
+
+			indexDefs.UUID = cbgt.NewUUID()
+			indexDefs.ImplVersion = cbgt.VERSION
+
+			return nil
+		})
+}
+
+// ---------------------------------------------------------
+
+// replicaSeed returns true when the path of a new pindex was filled
+// with the files of a copy of the pindex from a peer node.  When the
+// pindex can be seeded, the seed is started in the background and
+// errReplicaSeeding is returned, so that the janitor creates the
+// pindex once it's kicked by the completed seed.
+func replicaSeed(path string) (bool, error) {
+	replicaM.Lock()
+	mgr := replicaMgr
+	s := replicaSeeds[path]
+	if s != nil && s.done {
+		delete(replicaSeeds, path)
+	}
+	replicaM.Unlock()
+
+	if mgr == nil {
+		return false, nil
+	}
+
+	seedDir := path + REPLICA_SEED_SUFFIX
+
+	if s != nil {
+		if !s.done {
+			return false, errReplicaSeeding
+		}
+		if !s.ok {
+			return false, nil
+		}
+
+		os.RemoveAll(path)
+
+		err := os.Rename(seedDir, path)
+		if err != nil {
+			log.Printf("replicas: seed rename, path: %s, err: %v",
+				path, err)
+			os.RemoveAll(seedDir)
+			return false, nil
+		}
+
+		return true, nil
+	}
+
+	pindexName := strings.TrimSuffix(filepath.Base(path), ".pindex")
+
+	nodeDefs, peers := replicaSeedSources(mgr, pindexName)
+	if len(peers) <= 0 {
+		return false, nil
+	}
+
+	replicaM.Lock()
+	replicaSeeds[path] = &replicaSeedState{}
+	replicaM.Unlock()
+
+	go func() {
+		ok := replicaSeedFetch(seedDir, pindexName, nodeDefs, peers)
+
+		// The pindex may no longer be a replica of this node.
+		_, peers := replicaSeedSources(mgr, pindexName)
+		planned := len(peers) > 0
+
+		replicaM.Lock()
+		if planned {
+			replicaSeeds[path] = &replicaSeedState{done: true, ok: ok}
+		} else {
+			delete(replicaSeeds, path)
+		}
+		replicaM.Unlock()
+
+		if !planned {
+			os.RemoveAll(seedDir)
+		}
+
+		mgr.JanitorKick("replicas: seeded, pindexName: " + pindexName)
+	}()
+
+	return false, errReplicaSeeding
+}
+
+// replicaSeedSources returns the peers that can seed a pindex of this
+// node, with the primary first, when the pindex is planned as a
+// replica on this node.
+func replicaSeedSources(mgr *cbgt.Manager, pindexName string) (
+	*cbgt.NodeDefs, []string) {
+	planPIndexes, _, err := cbgt.CfgGetPlanPIndexes(mgr.Cfg())
+	if err != nil || planPIndexes == nil {
+		return nil, nil
+	}
+
+	planPIndex := planPIndexes.PlanPIndexes[pindexName]
+	if planPIndex == nil {
+		return nil, nil
+	}
+
+	self := planPIndex.Nodes[mgr.UUID()]
+	if self == nil || self.Priority <= 0 {
+		return nil, nil
+	}
+
+	nodeDefs, _, err := cbgt.CfgGetNodeDefs(mgr.Cfg(), cbgt.NODE_DEFS_KNOWN)
+	if err != nil || nodeDefs == nil {
+		return nil, nil
+	}
+
+	return nodeDefs, ReplicaSeedPeers(planPIndex, mgr.UUID())
+}
+
+// replicaSeedFetch fetches the files of a snapshot of a pindex from
+// the first peer that has built the pindex into the seed dir,
+// returning true on success.
+func replicaSeedFetch(seedDir, pindexName string,
+	nodeDefs *cbgt.NodeDefs, peers []string) bool {
+	for _, uuid := range peers {
+		nodeDef := nodeDefs.NodeDefs[uuid]
+		if nodeDef == nil {
+			continue
+		}
+
+		// Files of an earlier seed are of another snapshot.
+		os.RemoveAll(seedDir)
+
+		t := NewPIndexFileTransfer(NodeURL(nodeDef.HostPort),
+			pindexName, seedDir)
+
+		// A peer that doesn't have the pindex yet is skipped quickly.
+		seqs, err := t.CreateSnapshot()
+		if err != nil {
+			continue
+		}
+
+		if !replicaSeedBuilt(seqs) {
+			t.ReleaseSnapshot()
+			continue
+		}
+
+		err = t.Run()
+		t.ReleaseSnapshot()
+		if err != nil {
+			log.Printf("replicas: seed, pindexName: %s, from: %s, err: %v",
+				pindexName, nodeDef.HostPort, err)
+			os.RemoveAll(seedDir)
+			continue
+		}
+
+		log.Printf("replicas: seeded, pindexName: %s, from: %s",
+			pindexName, nodeDef.HostPort)
+
+		return true
+	}
+
+	return false
+}
+
+// replicaSeedBuilt returns true when a snapshot has applied any
+// mutations, so the source's partition isn't also brand new.
+func replicaSeedBuilt(seqs map[string]uint64) bool {
+	for _, seq := range seqs {
+		if seq > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplicaSeedPeers returns the other nodes of a plan pindex, which
+// can seed a new copy of the pindex, with the primary first.
+func ReplicaSeedPeers(planPIndex *cbgt.PlanPIndex, selfUUID string) []string {
+	rv := make([]string, 0, len(planPIndex.Nodes))
+	for uuid := range planPIndex.Nodes {
+		if uuid != selfUUID {
+			rv = append(rv, uuid)
+		}
+	}
+
+	sort.Sort(&replicaSeedPeersSorter{planPIndex: planPIndex, uuids: rv})
+
+	return rv
+}
+
+type replicaSeedPeersSorter struct {
+	planPIndex *cbgt.PlanPIndex
+	uuids      []string
+}
+
+func (s *replicaSeedPeersSorter) Len() int { return len(s.uuids) }
+
+func (s *replicaSeedPeersSorter) Swap(i, j int) {
+	s.uuids[i], s.uuids[j] = s.uuids[j], s.uuids[i]
+}
+
+func (s *replicaSeedPeersSorter) Less(i, j int) bool {
+	pi := s.planPIndex.Nodes[s.uuids[i]].Priority
+	pj := s.planPIndex.Nodes[s.uuids[j]].Priority
+	if pi != pj {
+		return pi < pj
+	}
+	return s.uuids[i] < s.uuids[j]
+}
+
+// ---------------------------------------------------------
+
+// IndexReplicasHandler is a REST handler that applies an index
+// update that only changes the numReplicas of an index in place, or
+// else delegates to the next (usually the create index) handler.
+type IndexReplicasHandler struct {
+	mgr  *cbgt.Manager
+	next http.Handler
+}
+
+func NewIndexReplicasHandler(mgr *cbgt.Manager,
+	next http.Handler) *IndexReplicasHandler {
+	return &IndexReplicasHandler{mgr: mgr, next: next}
+}
+
+func (h *IndexReplicasHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	r, err := readIndexQuotaRequest(indexName, req)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	_, indexDefsByName, err := h.mgr.GetIndexDefs(false)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("replicas: could not"+
+			" retrieve index defs, err: %v", err), 500)
+		return
+	}
+
+	indexDef := indexDefsByName[indexName]
+	if !IndexReplicasOnlyChange(indexDef, r) {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+
+	err = SetIndexNumReplicas(h.mgr.Cfg(), indexName, indexDef.UUID,
+		r.PlanParams.NumReplicas)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	log.Printf("replicas: index: %s, numReplicas: %d -> %d",
+		indexName, indexDef.PlanParams.NumReplicas,
+		r.PlanParams.NumReplicas)
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
@@ -0,0 +1,195 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestIndexReplicasOnlyChange(t *testing.T) {
+	indexDef := &cbgt.IndexDef{
+		Type:         "bleve",
+		Name:         "idx",
+		UUID:         "u0",
+		Params:       `{"mapping":{}}`,
+		SourceType:   "couchbase",
+		SourceName:   "beer-sample",
+		SourceParams: `{}`,
+		PlanParams: cbgt.PlanParams{
+			MaxPartitionsPerPIndex: 32,
+			NumReplicas:            1,
+		},
+	}
+
+	r := func(f func(r *IndexQuotaRequest)) *IndexQuotaRequest {
+		rv := &IndexQuotaRequest{
+			IndexName:     "idx",
+			IndexType:     "bleve",
+			IndexParams:   `{ "mapping": {} }`,
+			SourceType:    "couchbase",
+			SourceName:    "beer-sample",
+			SourceParams:  `{}`,
+			PrevIndexUUID: "u0",
+			PlanParams: cbgt.PlanParams{
+				MaxPartitionsPerPIndex: 32,
+				NumReplicas:            2,
+			},
+		}
+		if f != nil {
+			f(rv)
+		}
+		return rv
+	}
+
+	tests := []struct {
+		r   *IndexQuotaRequest
+		exp bool
+	}{
+		{r(nil), true},
+		{r(func(r *IndexQuotaRequest) { r.PlanParams.NumReplicas = 0 }), true},
+		{r(func(r *IndexQuotaRequest) { r.PlanParams.NumReplicas = 1 }), false},
+		{r(func(r *IndexQuotaRequest) { r.PrevIndexUUID = "" }), false},
+		{r(func(r *IndexQuotaRequest) { r.IndexParams = `{}` }), false},
+		{r(func(r *IndexQuotaRequest) { r.SourceName = "other" }), false},
+		{r(func(r *IndexQuotaRequest) {
+			r.PlanParams.MaxPartitionsPerPIndex = 8
+		}), false},
+	}
+	for i, test := range tests {
+		got := IndexReplicasOnlyChange(indexDef, test.r)
+		if got != test.exp {
+			t.Errorf("test: %d, expected: %v, got: %v", i, test.exp, got)
+		}
+	}
+
+	if IndexReplicasOnlyChange(nil, r(nil)) {
+		t.Errorf("expected false on a missing index")
+	}
+}
+
+func TestSetIndexNumReplicas(t *testing.T) {
+	cfg := cbgt.NewCfgMem()
+
+	indexDefs := cbgt.NewIndexDefs(cbgt.VERSION)
+	indexDefs.IndexDefs["idx"] = &cbgt.IndexDef{
+		Type: "bleve", Name: "idx", UUID: "u0",
+	}
+	_, err := cbgt.CfgSetIndexDefs(cfg, indexDefs, 0)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	err = SetIndexNumReplicas(cfg, "idx", "u0", 2)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+
+	indexDefs, _, err = cbgt.CfgGetIndexDefs(cfg)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	indexDef := indexDefs.IndexDefs["idx"]
+	if indexDef.UUID != "u0" || indexDef.PlanParams.NumReplicas != 2 {
+		t.Errorf("expected an in place change, got: %#v", indexDef)
+	}
+
+	if SetIndexNumReplicas(cfg, "idx", "not-the-uuid", 1) == nil {
+		t.Errorf("expected err on a changed index")
+	}
+	if SetIndexNumReplicas(cfg, "idx", "u0", -1) == nil {
+		t.Errorf("expected err on negative numReplicas")
+	}
+}
+
+func TestReplicaSeedPeers(t *testing.T) {
+	planPIndex := &cbgt.PlanPIndex{
+		Nodes: map[string]*cbgt.PlanPIndexNode{
+			"a": {CanRead: true, CanWrite: true, Priority: 1},
+			"b": {CanRead: true, CanWrite: true, Priority: 0},
+			"c": {CanRead: true, CanWrite: true, Priority: 1},
+			"d": {CanRead: true, CanWrite: true, Priority: 2},
+		},
+	}
+
+	got := ReplicaSeedPeers(planPIndex, "c")
+	exp := []string{"b", "a", "d"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+
+	seeded, err := replicaSeed("/not/a/dir/idx_0123.pindex")
+	if seeded || err != nil {
+		t.Errorf("expected no seeding without ReplicaCatchUpStart")
+	}
+}
+
+func TestReplicaSeedBuilt(t *testing.T) {
+	if replicaSeedBuilt(nil) || replicaSeedBuilt(map[string]uint64{"0": 0}) {
+		t.Errorf("expected a new partition not to seed")
+	}
+	if !replicaSeedBuilt(map[string]uint64{"0": 0, "1": 10}) {
+		t.Errorf("expected a built partition to seed")
+	}
+}
+
+func TestReplicaSeedSources(t *testing.T) {
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, "b",
+		nil, "", 1, "", ":1000", "", "some-datasource", nil)
+
+	_, err := cbgt.CfgSetPlanPIndexes(cfg, &cbgt.PlanPIndexes{
+		PlanPIndexes: map[string]*cbgt.PlanPIndex{
+			"p": {
+				Name: "p",
+				Nodes: map[string]*cbgt.PlanPIndexNode{
+					"a": {CanRead: true, CanWrite: true, Priority: 0},
+					"b": {CanRead: true, CanWrite: true, Priority: 1},
+				},
+			},
+			"q": {
+				Name: "q",
+				Nodes: map[string]*cbgt.PlanPIndexNode{
+					"a": {CanRead: true, CanWrite: true, Priority: 1},
+					"b": {CanRead: true, CanWrite: true, Priority: 0},
+				},
+			},
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cbgt.CfgSetNodeDefs(cfg, cbgt.NODE_DEFS_KNOWN,
+		&cbgt.NodeDefs{NodeDefs: map[string]*cbgt.NodeDef{
+			"a": {UUID: "a", HostPort: "a:8094"},
+			"b": {UUID: "b", HostPort: "b:8094"},
+		}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, peers := replicaSeedSources(mgr, "p")
+	if !reflect.DeepEqual(peers, []string{"a"}) {
+		t.Errorf("expected a replica to be seeded from the primary,"+
+			" got: %v", peers)
+	}
+	_, peers = replicaSeedSources(mgr, "q")
+	if len(peers) != 0 {
+		t.Errorf("expected no seeding of a primary, got: %v", peers)
+	}
+	_, peers = replicaSeedSources(mgr, "missing")
+	if len(peers) != 0 {
+		t.Errorf("expected no seeding of an unplanned pindex")
+	}
+}
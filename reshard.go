@@ -0,0 +1,579 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// Re-sharding an index changes its maxPartitionsPerPIndex without
+// the index becoming unavailable during the rebuild.  Instead of
+// updating the index definition (which replaces its pindexes), a
+// shadow index with the new partition layout is built in the
+// background from the same source, while the original index keeps
+// serving queries.  Once the shadow index has caught up (its doc
+// count has reached the original's), the index definitions are
+// switched over in a single Cfg update, where the index name becomes
+// an alias of the shadow index and the original index is removed.
+//
+// A re-shard of an index that was already re-sharded re-shards its
+// shadow index, and the switch over re-targets the alias.  The
+// queries and counts of a re-sharded index name are served by its
+// shadow index with all the query features of a bleve index, rather
+// than as the queries of a user-defined alias.  The progress of a
+// re-shard is kept in the Cfg, and a running re-shard is resumed when
+// its node restarts, or is taken over by another node when its node
+// is no longer wanted.
+
+// The Cfg key where the re-shard tasks are kept.
+const RESHARD_TASKS_KEY = "reshardTasks"
+
+// How often a running re-shard checks the progress of its shadow
+// index.
+var ReshardPollInterval = 5 * time.Second
+
+// The max duration of a re-shard, after which it's failed and its
+// shadow index is removed.
+var ReshardMaxDuration = 24 * time.Hour
+
+const (
+	RESHARD_RUNNING  = "running"
+	RESHARD_DONE     = "done"
+	RESHARD_FAILED   = "failed"
+	RESHARD_CANCELED = "canceled"
+)
+
+// ReshardTasks is the Cfg entry of all re-shard tasks.
+type ReshardTasks struct {
+	UUID string `json:"uuid"`
+
+	// Keyed by index name.
+	Tasks map[string]*ReshardTask `json:"tasks"`
+}
+
+// ReshardTask tracks the progress of a re-shard.
+type ReshardTask struct {
+	IndexName string `json:"indexName"`
+
+	// The index that serves the queries of the index name until the
+	// switch over, and the shadow index that's being built.
+	SourceName string `json:"sourceName"`
+	TargetName string `json:"targetName"`
+
+	MaxPartitionsPerPIndex int `json:"maxPartitionsPerPIndex"`
+
+	NodeUUID string `json:"nodeUUID"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+
+	SourceDocs uint64  `json:"sourceDocs"`
+	TargetDocs uint64  `json:"targetDocs"`
+	Progress   float64 `json:"progress"` // From 0.0 to 1.0.
+
+	StartTime  string `json:"startTime"`
+	UpdateTime string `json:"updateTime"`
+}
+
+// ReshardRequest is the JSON request body of a re-shard.
+type ReshardRequest struct {
+	MaxPartitionsPerPIndex int `json:"maxPartitionsPerPIndex"`
+}
+
+// Reshard validates and starts an asynchronous re-shard of an index.
+func Reshard(mgr *cbgt.Manager, indexName string,
+	rreq *ReshardRequest) (*ReshardTask, error) {
+	if rreq.MaxPartitionsPerPIndex < 0 {
+		return nil, fmt.Errorf("reshard: maxPartitionsPerPIndex must"+
+			" be >= 0, indexName: %s", indexName)
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return nil, err
+	}
+
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil {
+		return nil, fmt.Errorf("reshard: no index, indexName: %s",
+			indexName)
+	}
+
+	sourceName := indexName
+	if indexDef.Type == "alias" {
+		sourceName = reshardAliasTarget(indexDef)
+		if sourceName == "" {
+			return nil, fmt.Errorf("reshard: not a re-sharded alias,"+
+				" indexName: %s", indexName)
+		}
+	}
+
+	sourceDef := indexDefsByName[sourceName]
+	if sourceDef == nil || sourceDef.Type != "bleve" {
+		return nil, fmt.Errorf("reshard: not a bleve index,"+
+			" indexName: %s", sourceName)
+	}
+
+	if sourceDef.PlanParams.MaxPartitionsPerPIndex ==
+		rreq.MaxPartitionsPerPIndex {
+		return nil, fmt.Errorf("reshard: maxPartitionsPerPIndex is"+
+			" unchanged, indexName: %s", indexName)
+	}
+
+	task := &ReshardTask{
+		IndexName:              indexName,
+		SourceName:             sourceName,
+		TargetName:             indexName + "_reshard_" + cbgt.NewUUID(),
+		MaxPartitionsPerPIndex: rreq.MaxPartitionsPerPIndex,
+		NodeUUID:               mgr.UUID(),
+		Status:                 RESHARD_RUNNING,
+		StartTime:              time.Now().Format(time.RFC3339Nano),
+	}
+
+	err = reshardUpdateTask(mgr.Cfg(), indexName,
+		func(prev *ReshardTask) (*ReshardTask, error) {
+			if prev != nil && prev.Status == RESHARD_RUNNING {
+				return nil, fmt.Errorf("reshard: already running,"+
+					" indexName: %s", indexName)
+			}
+			return task, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	planParams := sourceDef.PlanParams
+	planParams.MaxPartitionsPerPIndex = rreq.MaxPartitionsPerPIndex
+
+	err = CreateIndexChecked(mgr, sourceDef.SourceType,
+		sourceDef.SourceName, sourceDef.SourceUUID, sourceDef.SourceParams,
+		sourceDef.Type, task.TargetName, sourceDef.Params, planParams, "")
+	if err != nil {
+		task.Status = RESHARD_FAILED
+		task.Error = err.Error()
+		reshardCheckpoint(mgr.Cfg(), task)
+		return nil, err
+	}
+
+	go func() {
+		err := reshardRun(mgr, task)
+		if err != nil {
+			log.Printf("reshard: run, indexName: %s, target: %s,"+
+				" err: %v", task.IndexName, task.TargetName, err)
+		}
+	}()
+
+	return task, nil
+}
+
+// ReshardStart resumes the running re-shards of this node, such as
+// after a restart, and takes over the running re-shards of nodes that
+// are no longer wanted.
+func ReshardStart(mgr *cbgt.Manager) error {
+	rts := &ReshardTasks{}
+	_, _, err := CfgGetJSON(mgr.Cfg(), RESHARD_TASKS_KEY, rts)
+	if err != nil {
+		return err
+	}
+
+	nodeDefs, _, err := cbgt.CfgGetNodeDefs(mgr.Cfg(), cbgt.NODE_DEFS_WANTED)
+	if err != nil {
+		return err
+	}
+
+	for indexName, task := range rts.Tasks {
+		if task == nil || task.Status != RESHARD_RUNNING {
+			continue
+		}
+
+		if task.NodeUUID != mgr.UUID() {
+			if nodeDefs != nil && nodeDefs.NodeDefs[task.NodeUUID] != nil {
+				continue // The re-shard's node is still running it.
+			}
+
+			task, err = reshardClaim(mgr.Cfg(), indexName, task, mgr.UUID())
+			if err != nil {
+				log.Printf("reshard: claim, indexName: %s, err: %v",
+					indexName, err)
+				continue
+			}
+		}
+
+		log.Printf("reshard: resuming, indexName: %s, target: %s",
+			task.IndexName, task.TargetName)
+
+		go func(task *ReshardTask) {
+			err := reshardRun(mgr, task)
+			if err != nil {
+				log.Printf("reshard: run, indexName: %s, target: %s,"+
+					" err: %v", task.IndexName, task.TargetName, err)
+			}
+		}(task)
+	}
+
+	return nil
+}
+
+// reshardClaim takes over a running re-shard from another node, if
+// the re-shard wasn't changed or claimed by another node meanwhile.
+func reshardClaim(cfg cbgt.Cfg, indexName string, task *ReshardTask,
+	nodeUUID string) (*ReshardTask, error) {
+	var rv *ReshardTask
+
+	err := reshardUpdateTask(cfg, indexName,
+		func(prev *ReshardTask) (*ReshardTask, error) {
+			if prev == nil || prev.Status != RESHARD_RUNNING ||
+				prev.TargetName != task.TargetName ||
+				prev.NodeUUID != task.NodeUUID {
+				return nil, fmt.Errorf("reshard: task was changed,"+
+					" indexName: %s", indexName)
+			}
+			t := *prev
+			t.NodeUUID = nodeUUID
+			t.UpdateTime = time.Now().Format(time.RFC3339Nano)
+			rv = &t
+			return rv, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+// reshardRun waits for the shadow index of a re-shard to catch up
+// and then switches over to it.
+func reshardRun(mgr *cbgt.Manager, task *ReshardTask) error {
+	fail := func(err error) error {
+		mgr.DeleteIndex(task.TargetName)
+		task.Status = RESHARD_FAILED
+		task.Error = err.Error()
+		reshardCheckpoint(mgr.Cfg(), task)
+		return err
+	}
+
+	// A resumed re-shard keeps its original deadline.
+	startTime, err := time.Parse(time.RFC3339Nano, task.StartTime)
+	if err != nil {
+		startTime = time.Now()
+	}
+
+	for {
+		time.Sleep(ReshardPollInterval)
+
+		rts := &ReshardTasks{}
+		_, _, err := CfgGetJSON(mgr.Cfg(), RESHARD_TASKS_KEY, rts)
+		if err != nil {
+			return fail(err)
+		}
+
+		curr := rts.Tasks[task.IndexName]
+		if curr == nil || curr.TargetName != task.TargetName ||
+			curr.Status != RESHARD_RUNNING {
+			return nil // Canceled.
+		}
+
+		if time.Since(startTime) > ReshardMaxDuration {
+			return fail(fmt.Errorf("reshard: not caught up after %v",
+				ReshardMaxDuration))
+		}
+
+		// Counting fails until all of the shadow index's pindexes
+		// have been created, so that's not an error.
+		sourceDocs, err := CountBlevePIndexImpl(mgr, task.SourceName, "")
+		if err != nil {
+			continue
+		}
+		targetDocs, err := CountBlevePIndexImpl(mgr, task.TargetName, "")
+		if err != nil {
+			continue
+		}
+
+		task.SourceDocs = sourceDocs
+		task.TargetDocs = targetDocs
+		task.Progress = ReshardProgress(sourceDocs, targetDocs)
+
+		if targetDocs < sourceDocs {
+			err = reshardCheckpoint(mgr.Cfg(), task)
+			if err != nil {
+				return fail(err)
+			}
+			continue
+		}
+
+		err = reshardSwitch(mgr.Cfg(), task)
+		if err != nil {
+			return fail(err)
+		}
+
+		task.Status = RESHARD_DONE
+
+		return reshardCheckpoint(mgr.Cfg(), task)
+	}
+}
+
+// ReshardProgress returns the progress of a shadow index, from 0.0
+// to 1.0, from the doc counts of the source and shadow indexes.
+func ReshardProgress(sourceDocs, targetDocs uint64) float64 {
+	if targetDocs >= sourceDocs {
+		return 1.0
+	}
+	return float64(targetDocs) / float64(sourceDocs)
+}
+
+// reshardSwitch switches the index name of a re-shard over to its
+// shadow index, in a single Cfg update of the index definitions.
+func reshardSwitch(cfg cbgt.Cfg, task *ReshardTask) error {
+	return CfgUpdateJSON(cfg, cbgt.INDEX_DEFS_KEY,
+		func() interface{} { return &cbgt.IndexDefs{} },
+		func(v interface{}) error {
+			return ReshardSwitchIndexDefs(v.(*cbgt.IndexDefs), task)
+		})
+}
+
+// ReshardSwitchIndexDefs modifies the index definitions so that the
+// index name of a re-shard is an alias of the shadow index, removing
+// the re-shard's source index.
+func ReshardSwitchIndexDefs(indexDefs *cbgt.IndexDefs,
+	task *ReshardTask) error {
+	if indexDefs.IndexDefs == nil ||
+		indexDefs.IndexDefs[task.IndexName] == nil {
+		return fmt.Errorf("reshard: index was deleted, indexName: %s",
+			task.IndexName)
+	}
+	if indexDefs.IndexDefs[task.TargetName] == nil {
+		return fmt.Errorf("reshard: shadow index was deleted,"+
+			" indexName: %s", task.TargetName)
+	}
+
+	params, err := json.Marshal(&AliasParams{
+		Targets: map[string]*AliasParamsTarget{
+			task.TargetName: {},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if task.SourceName != task.IndexName {
+		delete(indexDefs.IndexDefs, task.SourceName)
+	}
+
+	indexDefs.IndexDefs[task.IndexName] = &cbgt.IndexDef{
+		Type:       "alias",
+		Name:       task.IndexName,
+		UUID:       cbgt.NewUUID(),
+		Params:     string(params),
+		SourceType: "nil",
+	}
+
+	indexDefs.UUID = cbgt.NewUUID()
+	indexDefs.ImplVersion = cbgt.VERSION
+
+	return nil
+}
+
+// reshardAliasTarget returns the shadow index of a re-sharded index,
+// whose definition is an alias of only its shadow index, or "".
+func reshardAliasTarget(indexDef *cbgt.IndexDef) string {
+	params := AliasParams{}
+	err := json.Unmarshal([]byte(indexDef.Params), &params)
+	if err != nil || len(params.Targets) != 1 {
+		return ""
+	}
+	for targetName := range params.Targets {
+		if strings.HasPrefix(targetName, indexDef.Name+"_reshard_") {
+			return targetName
+		}
+	}
+	return ""
+}
+
+func reshardCheckpoint(cfg cbgt.Cfg, task *ReshardTask) error {
+	task.UpdateTime = time.Now().Format(time.RFC3339Nano)
+
+	return reshardUpdateTask(cfg, task.IndexName,
+		func(prev *ReshardTask) (*ReshardTask, error) {
+			if prev != nil && prev.TargetName == task.TargetName &&
+				prev.Status == RESHARD_CANCELED {
+				return prev, nil
+			}
+			return task, nil
+		})
+}
+
+// reshardUpdateTask updates a task in the Cfg.
+func reshardUpdateTask(cfg cbgt.Cfg, indexName string,
+	f func(prev *ReshardTask) (*ReshardTask, error)) error {
+	return CfgUpdateJSON(cfg, RESHARD_TASKS_KEY,
+		func() interface{} { return &ReshardTasks{} },
+		func(v interface{}) error {
+			rts := v.(*ReshardTasks)
+			if rts.Tasks == nil {
+				rts.Tasks = map[string]*ReshardTask{}
+			}
+
+			task, err := f(rts.Tasks[indexName])
+			if err != nil {
+				return err
+			}
+
+			rts.UUID = cbgt.NewUUID()
+			rts.Tasks[indexName] = task
+
+			return nil
+		})
+}
+
+// ReshardCancel cancels a running re-shard, removing its shadow
+// index.
+func ReshardCancel(mgr *cbgt.Manager, indexName string) error {
+	var task *ReshardTask
+
+	err := reshardUpdateTask(mgr.Cfg(), indexName,
+		func(prev *ReshardTask) (*ReshardTask, error) {
+			if prev == nil || prev.Status != RESHARD_RUNNING {
+				return nil, fmt.Errorf("reshard: not running,"+
+					" indexName: %s", indexName)
+			}
+			t := *prev
+			t.Status = RESHARD_CANCELED
+			t.UpdateTime = time.Now().Format(time.RFC3339Nano)
+			task = &t
+			return task, nil
+		})
+	if err != nil {
+		return err
+	}
+
+	return mgr.DeleteIndex(task.TargetName)
+}
+
+// ---------------------------------------------------------
+
+// ReshardHandler is a REST handler that starts the re-shard of an
+// index.
+type ReshardHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewReshardHandler(mgr *cbgt.Manager) *ReshardHandler {
+	return &ReshardHandler{mgr: mgr}
+}
+
+func (h *ReshardHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("reshard: could not read"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	rreq := &ReshardRequest{}
+	err = json.Unmarshal(requestBody, rreq)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("reshard: could not parse"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	task, err := Reshard(h.mgr, indexName, rreq)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), IndexCreateErrorStatus(err, 400))
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string       `json:"status"`
+		Task   *ReshardTask `json:"task"`
+	}{
+		Status: "ok",
+		Task:   task,
+	})
+}
+
+// ReshardTaskHandler is a REST handler that returns the progress of
+// the latest re-shard of an index.
+type ReshardTaskHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewReshardTaskHandler(mgr *cbgt.Manager) *ReshardTaskHandler {
+	return &ReshardTaskHandler{mgr: mgr}
+}
+
+func (h *ReshardTaskHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	rts := &ReshardTasks{}
+	_, _, err := CfgGetJSON(h.mgr.Cfg(), RESHARD_TASKS_KEY, rts)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("reshard: could not"+
+			" retrieve tasks, err: %v", err), 500)
+		return
+	}
+
+	task := rts.Tasks[indexName]
+	if task == nil {
+		rest.ShowError(w, req, fmt.Sprintf("reshard: no task,"+
+			" indexName: %s", indexName), 404)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string       `json:"status"`
+		Task   *ReshardTask `json:"task"`
+	}{
+		Status: "ok",
+		Task:   task,
+	})
+}
+
+// ReshardCancelHandler is a REST handler that cancels the running
+// re-shard of an index.
+type ReshardCancelHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewReshardCancelHandler(mgr *cbgt.Manager) *ReshardCancelHandler {
+	return &ReshardCancelHandler{mgr: mgr}
+}
+
+func (h *ReshardCancelHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	err := ReshardCancel(h.mgr, indexName)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
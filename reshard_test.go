@@ -0,0 +1,220 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestReshardProgress(t *testing.T) {
+	tests := []struct {
+		sourceDocs, targetDocs uint64
+		exp                    float64
+	}{
+		{0, 0, 1.0},
+		{100, 0, 0.0},
+		{100, 25, 0.25},
+		{100, 100, 1.0},
+		{100, 120, 1.0},
+	}
+	for _, test := range tests {
+		got := ReshardProgress(test.sourceDocs, test.targetDocs)
+		if got != test.exp {
+			t.Errorf("expected %v for %#v, got: %v", test.exp, test, got)
+		}
+	}
+}
+
+func TestReshardSwitchIndexDefs(t *testing.T) {
+	indexDefs := cbgt.NewIndexDefs(cbgt.VERSION)
+	indexDefs.IndexDefs["idx"] = &cbgt.IndexDef{
+		Type: "bleve", Name: "idx", UUID: "u0",
+	}
+	indexDefs.IndexDefs["idx_reshard_a"] = &cbgt.IndexDef{
+		Type: "bleve", Name: "idx_reshard_a", UUID: "u1",
+	}
+
+	task := &ReshardTask{
+		IndexName:  "idx",
+		SourceName: "idx",
+		TargetName: "idx_reshard_a",
+	}
+
+	err := ReshardSwitchIndexDefs(indexDefs, task)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	aliasDef := indexDefs.IndexDefs["idx"]
+	if aliasDef.Type != "alias" || aliasDef.UUID == "u0" ||
+		reshardAliasTarget(aliasDef) != "idx_reshard_a" {
+		t.Errorf("expected an alias of the shadow index, got: %#v", aliasDef)
+	}
+
+	// A re-shard of the re-sharded index.
+	indexDefs.IndexDefs["idx_reshard_b"] = &cbgt.IndexDef{
+		Type: "bleve", Name: "idx_reshard_b", UUID: "u2",
+	}
+
+	err = ReshardSwitchIndexDefs(indexDefs, &ReshardTask{
+		IndexName:  "idx",
+		SourceName: "idx_reshard_a",
+		TargetName: "idx_reshard_b",
+	})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if indexDefs.IndexDefs["idx_reshard_a"] != nil {
+		t.Errorf("expected the previous shadow index to be removed")
+	}
+	if reshardAliasTarget(indexDefs.IndexDefs["idx"]) != "idx_reshard_b" {
+		t.Errorf("expected the alias to be re-targeted")
+	}
+
+	err = ReshardSwitchIndexDefs(indexDefs, &ReshardTask{
+		IndexName:  "idx",
+		SourceName: "idx_reshard_b",
+		TargetName: "idx_reshard_c",
+	})
+	if err == nil {
+		t.Errorf("expected err on a missing shadow index")
+	}
+}
+
+func TestReshardErrs(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	err := mgr.CreateIndex("nil", "", "", "",
+		"blackhole", "idx0", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+
+	for _, test := range []struct {
+		indexName string
+		rreq      *ReshardRequest
+		expErr    string
+	}{
+		{"not-an-index", &ReshardRequest{}, "no index"},
+		{"idx0", &ReshardRequest{MaxPartitionsPerPIndex: 4},
+			"not a bleve index"},
+		{"idx0", &ReshardRequest{MaxPartitionsPerPIndex: -1},
+			"must be >= 0"},
+	} {
+		_, err := Reshard(mgr, test.indexName, test.rreq)
+		if err == nil || !strings.Contains(err.Error(), test.expErr) {
+			t.Errorf("expected err: %q, got: %v", test.expErr, err)
+		}
+	}
+
+	err = ReshardCancel(mgr, "idx0")
+	if err == nil {
+		t.Errorf("expected err on canceling with no re-shard running")
+	}
+}
+
+func TestReshardClaim(t *testing.T) {
+	cfg := cbgt.NewCfgMem()
+
+	task := &ReshardTask{
+		IndexName:  "idx",
+		SourceName: "idx",
+		TargetName: "idx_reshard_a",
+		NodeUUID:   "gone",
+		Status:     RESHARD_RUNNING,
+	}
+	err := reshardUpdateTask(cfg, "idx",
+		func(prev *ReshardTask) (*ReshardTask, error) { return task, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, err := reshardClaim(cfg, "idx", task, "self")
+	if err != nil || claimed.NodeUUID != "self" ||
+		claimed.TargetName != task.TargetName {
+		t.Fatalf("expected a claimed task, got: %#v, err: %v", claimed, err)
+	}
+
+	rts := &ReshardTasks{}
+	CfgGetJSON(cfg, RESHARD_TASKS_KEY, rts)
+	if rts.Tasks["idx"].NodeUUID != "self" {
+		t.Errorf("expected the claim in the cfg, got: %#v", rts.Tasks["idx"])
+	}
+
+	// Another node's claim of the same task fails, as the task was
+	// claimed meanwhile.
+	_, err = reshardClaim(cfg, "idx", task, "other")
+	if err == nil {
+		t.Errorf("expected err on a changed task")
+	}
+}
+
+func TestReshardAliasQuery(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	err := mgr.CreateIndex("primary", "", "", "",
+		"bleve", "idx_reshard_a", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	err = mgr.CreateIndex("nil", "", "", "", "alias", "idx",
+		`{"targets":{"idx_reshard_a":{}}}`, cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	err = mgr.CreateIndex("nil", "", "", "", "alias", "other",
+		`{"targets":{"idx_reshard_a":{}}}`, cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	if target := aliasReshardTarget(mgr, "idx"); target != "idx_reshard_a" {
+		t.Errorf("expected the shadow index, got: %q", target)
+	}
+	if target := aliasReshardTarget(mgr, "other"); target != "" {
+		t.Errorf("expected a user-defined alias, got: %q", target)
+	}
+
+	// A re-sharded index supports the query params of a bleve index.
+	req := []byte(`{"query":{"match_all":{}},"ctl":{"allowPartial":true},` +
+		`"collapse":{"field":"type"}}`)
+
+	var res bytes.Buffer
+	err = QueryAlias(mgr, "idx", "", req, &res)
+	if err != nil {
+		t.Errorf("expected no err on a re-sharded index, got: %v", err)
+	}
+
+	err = QueryAlias(mgr, "other", "", req, &res)
+	if err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("expected err on an unsupported param of an alias,"+
+			" got: %v", err)
+	}
+}
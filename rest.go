@@ -13,6 +13,8 @@ package cbft
 
 import (
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/gorilla/mux"
 
@@ -73,7 +75,1253 @@ func myAsset(name string) ([]byte, error) {
 func NewRESTRouter(versionMain string, mgr *cbgt.Manager,
 	staticDir, staticETag string, mr *cbgt.MsgRing) (
 	*mux.Router, map[string]rest.RESTMeta, error) {
-	return rest.InitRESTRouter(InitStaticRouter(staticDir, staticETag),
+	r := InitStaticRouter(staticDir, staticETag)
+
+	InitRESTRouterOverrides(r, versionMain, mgr, mr)
+
+	r, meta, err := rest.InitRESTRouter(r,
 		versionMain, mgr, staticDir, staticETag, mr,
 		myAssetDir, myAsset)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	InitRESTRouterExtras(r, meta, versionMain, mgr, mr)
+
+	InitRESTRouterV1(r, meta)
+
+	return r, meta, nil
+}
+
+// The path prefix of the versioned REST API routes.
+const API_V1_PREFIX = "/api/v1"
+
+// The request and response header that's set on requests that were
+// made through the versioned REST API routes.
+const API_VERSION_HEADER = "X-Cbft-Api-Version"
+
+// InitRESTRouterV1 registers a versioned /api/v1/... route for every
+// documented (non-private) /api/... route in the meta, where the
+// versioned route is handled by the unversioned route.
+//
+// The compatibility guarantee of the /api/v1/... routes is that their
+// request parameters and response fields will not be removed or
+// change meaning, although new optional parameters and new response
+// fields may be added.  When an unversioned route needs to make an
+// incompatible change, its handler must use RequestAPIVersion() to
+// keep the previous behavior for /api/v1/... requests.
+func InitRESTRouterV1(r *mux.Router, meta map[string]rest.RESTMeta) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL.Path = "/api" + strings.TrimPrefix(req.URL.Path, API_V1_PREFIX)
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		req.Header.Set(API_VERSION_HEADER, "v1")
+		w.Header().Set(API_VERSION_HEADER, "v1")
+		r.ServeHTTP(w, req)
+	})
+
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		m := meta[key]
+		if !strings.HasPrefix(m.Path, "/api/") ||
+			strings.HasPrefix(m.Path, API_V1_PREFIX+"/") ||
+			(m.Opts != nil && m.Opts["_status"] == "private") {
+			continue
+		}
+
+		r.Handle(API_V1_PREFIX+strings.TrimPrefix(m.Path, "/api"), h).
+			Methods(m.Method)
+	}
+}
+
+// RequestAPIVersion returns the REST API version of a request, such
+// as "v1", or "" for a request made through an unversioned route.
+func RequestAPIVersion(req *http.Request) string {
+	return req.Header.Get(API_VERSION_HEADER)
+}
+
+// InitRESTRouterOverrides registers cbft-specific REST API routes
+// that take precedence over the same routes of the cbgt/rest
+// package, so it must be invoked before rest.InitRESTRouter.  The
+// overriding handlers usually wrap the cbgt/rest handlers.
+func InitRESTRouterOverrides(r *mux.Router, versionMain string,
+	mgr *cbgt.Manager, mr *cbgt.MsgRing) {
+	r.Handle("/api/index/{indexName}",
+		NewIndexETagGetHandler(mgr, rest.NewGetIndexHandler(mgr))).
+		Methods("GET")
+
+	r.Handle("/api/index/{indexName}",
+		NewIndexPreconditionHandler(mgr,
+			NewIndexTrashGuardHandler(mgr,
+				NewIndexFreezeGuardHandler(mgr,
+					NewIndexProfileHandler(mgr,
+						NewIndexTTLHandler(mgr,
+							NewIndexCreateGuardHandler(mgr,
+								NewIndexReplicasHandler(mgr,
+									rest.NewCreateIndexHandler(mgr))))))))).
+		Methods("PUT")
+
+	r.Handle("/api/index/{indexName}",
+		NewIndexTrashDeleteHandler(mgr, rest.NewDeleteIndexHandler(mgr))).
+		Methods("DELETE")
+
+	r.Handle("/api/index/{indexName}/ingestControl/{op}",
+		NewIndexTrashGuardHandler(mgr,
+			NewIndexFreezeGuardHandler(mgr,
+				rest.NewIndexControlHandler(mgr, "write", map[string]bool{
+					"pause":  true,
+					"resume": true,
+				})))).
+		Methods("POST")
+
+	r.Handle("/api/index/{indexName}/planFreezeControl/{op}",
+		NewIndexTrashGuardHandler(mgr,
+			NewIndexFreezeGuardHandler(mgr,
+				rest.NewIndexControlHandler(mgr, "planFreeze", map[string]bool{
+					"freeze":   true,
+					"unfreeze": true,
+				})))).
+		Methods("POST")
+
+	r.Handle("/api/index/{indexName}/queryControl/{op}",
+		NewIndexTrashGuardHandler(mgr,
+			rest.NewIndexControlHandler(mgr, "read", map[string]bool{
+				"allow":    true,
+				"disallow": true,
+			}))).
+		Methods("POST")
+
+	r.Handle("/api/log",
+		NewLogFilterHandler(mr, rest.NewLogGetHandler(mgr, mr))).
+		Methods("GET")
+
+	r.Handle("/api/runtime",
+		NewRuntimeSettingsGetHandler(
+			rest.NewRuntimeGetHandler(versionMain, mgr))).
+		Methods("GET")
+}
+
+// InitRESTRouterExtras registers the cbft-specific REST API routes
+// (ones that aren't provided by the generic cbgt/rest package) onto
+// a router, also recording their RESTMeta so that the routes are
+// documented alongside the cbgt routes.
+func InitRESTRouterExtras(r *mux.Router, meta map[string]rest.RESTMeta,
+	versionMain string, mgr *cbgt.Manager, mr *cbgt.MsgRing) {
+	handle := func(path string, method string, h http.Handler,
+		opts map[string]string) {
+		if meta != nil {
+			meta[path+" "+method] = rest.RESTMeta{
+				Path:   path,
+				Method: method,
+				Opts:   opts,
+			}
+		}
+		r.Handle(path, h).Methods(method)
+	}
+
+	handle("/api/spec", "GET", NewSpecHandler(versionMain, meta),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Returns a Swagger 2.0 (OpenAPI) document of the
+                       REST API as JSON, including the request and
+                       response schemas of index definitions and
+                       queries.`,
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/plan/impact", "GET", NewPlanImpactHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node management",
+			"_about": `Simulates the removal of a node from the cluster,
+                       without changing the cluster's configuration,
+                       and returns the indexes that would lose
+                       partition replicas, the estimated data movement
+                       and projected rebuild times as JSON.`,
+			"param: removeNode": "required, string, URL query parameter\n\n" +
+				"The UUID of the node whose removal is to be simulated.",
+			"param: rebuildBytesPerSec": "optional, integer, URL query parameter\n\n" +
+				"The rebuild throughput used for projecting rebuild times.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/plan/whatif", "POST", NewPlanWhatIfHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node management",
+			"_about": `Simulates hypothetical cluster changes, without
+                       applying them, and returns the pindex moves that
+                       the planner would make, with their estimated
+                       data movement and projected rebuild times as
+                       JSON.  The JSON request body has the optional
+                       addNodes (node definitions with a uuid, hostPort
+                       and optional weight and container), removeNodes
+                       (node UUIDs), planParams (new plan params keyed
+                       by index name) and rebuildBytesPerSec.`,
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/failover", "GET",
+		NewFailoverStatusHandler(),
+		map[string]string{
+			"_category": "Node|Node diagnostics",
+			"_about": `Returns this node's view of the health of the
+                       other wanted nodes, as used for automatic
+                       failover, and the recent failovers done by
+                       this node, as JSON.`,
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/health/live", "GET", NewHealthLiveHandler(),
+		map[string]string{
+			"_category": "Node|Node diagnostics",
+			"_about": `Returns a 200 status when this node's REST API is
+                       responsive, for liveness probes, and doesn't
+                       need auth.`,
+			"version introduced": "0.4.0",
+		})
+	handle("/api/health/ready", "GET", NewHealthReadyHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node diagnostics",
+			"_about": `Returns a 200 status when this node is ready to
+                       serve queries, for readiness probes, which is
+                       when its cfg is reachable, its manager has
+                       registered the node, and the pindexes that the
+                       plan assigns to the node are open, or else a
+                       503 status, with the checks as JSON.  It
+                       doesn't need auth.`,
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/clientTopology", "GET", NewClientTopologyHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index querying",
+			"_about": `Returns, per index, the ordered list of node URLs
+                       that can serve the index's queries, with each
+                       node's health (ok, unreachable or unknown) and
+                       role (active or replica), for smart clients to
+                       route queries directly to healthy nodes.  The
+                       response has a hash that changes whenever the
+                       topology changes, which is also the ETag, so
+                       If-None-Match requests are answered with a 304
+                       when nothing changed.`,
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/settings", "GET", NewClusterSettingsGetHandler(mgr),
+		map[string]string{
+			"_category":          "Node|Node configuration",
+			"_about":             `Returns the cluster-wide cbft settings as JSON.`,
+			"version introduced": "0.4.0",
+		})
+	handle("/api/settings", "PUT", NewClusterSettingsPutHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Merges the JSON request body into the
+                       cluster-wide cbft settings, so that the settings
+                       that aren't in the request body are kept, such
+                       as {"profile": "prod"},
+                       where profile is the default profile that
+                       selects the environment overlay of index
+                       definitions, for nodes that weren't started
+                       with a -profile.  An ingestErrorBudget (such
+                       as 0.05) is the max fraction of an index's
+                       mutations per hour that may fail to be indexed,
+                       after at least ingestErrorBudgetMinMutations
+                       mutations, before the index is quarantined.
+                       A slowQueryThresholdMS (default 1000) is the
+                       duration beyond which queries are logged as
+                       slow, and a queryLogExport (an absolute
+                       directory path or a
+                       couchbase://HOST:PORT/BUCKET URL) is where
+                       each node exports its daily query log.  The
+                       capacityPIndexesPerNode, capacityDiskBytesPerNode
+                       and capacityMemBytesPerNode enable the capacity
+                       guardrail, which checks index create/update
+                       requests against the cluster's capacity and
+                       either rejects (the default) or, with a
+                       capacityGuardrail of "warn", warns about index
+                       definitions that would exceed it.  A setting
+                       is cleared with its zero value, like "" or 0.
+                       Out of range values, like an ingestErrorBudget
+                       beyond 0 to 1 or a negative capacity, are
+                       rejected.`,
+			"version introduced": "0.4.0",
+		})
+
+	if m, exists := meta["/api/log GET"]; exists && m.Opts != nil {
+		m.Opts["param: level"] = "optional, string, URL query parameter\n\n" +
+			"Only returns the log messages of this level (debug, normal," +
+			" warn or error) or higher."
+		m.Opts["param: contains"] = "optional, string, URL query parameter\n\n" +
+			"Only returns the log messages that contain this substring."
+		m.Opts["param: since"] = "optional, string, URL query parameter\n\n" +
+			"Only returns the log messages since this RFC 3339 time or" +
+			" duration before now, like 15m."
+		m.Opts["param: until"] = "optional, string, URL query parameter\n\n" +
+			"Only returns the log messages until this RFC 3339 time or" +
+			" duration before now."
+		m.Opts["param: limit"] = "optional, integer, URL query parameter\n\n" +
+			"The max number of the most recent matching log messages."
+		m.Opts["param: follow"] = "optional, boolean, URL query parameter\n\n" +
+			"When true, the matching log messages are streamed as plain" +
+			" text, including new log messages as they're logged, until" +
+			" the client closes the connection."
+	}
+
+	handle("/api/logLevel", "GET", NewLogLevelGetHandler(),
+		map[string]string{
+			"_category": "Node|Node diagnostics",
+			"_about": `Returns this node's log level as JSON, with the
+                       global level and the levels of log categories.`,
+			"version introduced": "0.4.0",
+		})
+	handle("/api/logLevel", "PUT", NewLogLevelPutHandler(),
+		map[string]string{
+			"_category": "Node|Node diagnostics",
+			"_about": `Replaces this node's log level, without a
+                       restart, with the JSON request body, such as
+                       {"level": "normal", "categories": {"query":
+                       "debug"}}, where a level is one of debug,
+                       normal, warn or error, and the categories (feed,
+                       planner, query and rest) control the debug
+                       messages of those subsystems.  The log level
+                       isn't persisted, so a restarted node is back at
+                       the normal level.`,
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/runtime", "POST", NewRuntimeSettingsPostHandler(),
+		map[string]string{
+			"_category": "Node|Node management",
+			"_about": `Changes this node's Go runtime settings, without
+                       a restart, with the JSON request body, such as
+                       {"GOMAXPROCS": 4, "GOGC": 50, "freeOSMemory":
+                       true}, where every field is optional: GOGC is
+                       the GC target percentage (-1 turns off the GC),
+                       gc requests a GC, and freeOSMemory requests a GC
+                       that returns as much memory as possible to the
+                       OS.  Responds with the resulting settings and
+                       memory stats, which GET /api/runtime also
+                       includes.  The runtime settings aren't
+                       persisted.`,
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/diskWatermark", "GET", NewDiskWatermarkHandler(),
+		map[string]string{
+			"_category": "Node|Node diagnostics",
+			"_about": `Returns the last checked disk usage of this
+                       node's dataDir as JSON, with the low and high
+                       watermarks, and whether the usage is high, while
+                       ingest and index creation are paused.  The
+                       diskWatermark is null when the checks are
+                       disabled.`,
+			"version introduced": "0.4.0",
+		})
+
+	InitPprofRoutes(r, mgr)
+
+	handle("/api/runtime/profile", "GET",
+		NewProfilingGuardHandler(mgr, NewProfileHandler()),
+		map[string]string{
+			"_category": "Node|Node diagnostics",
+			"_about": `Captures a profile of this node on demand, as a
+                       downloadable pprof file, for go tool pprof.
+                       Only enabled when the node was started with the
+                       -pprof flag.`,
+			"param: type": "optional, string, URL query parameter\n\n" +
+				"The type of profile: cpu (the default), heap," +
+				" goroutine, threadcreate or block.",
+			"param: secs": "optional, integer, URL query parameter\n\n" +
+				"The duration of a cpu profile in seconds (default 30).",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/diag/bundle", "GET", NewDiagBundleHandler(mgr, mr, r),
+		map[string]string{
+			"_category": "Node|Node diagnostics",
+			"_about": `Returns a diagnostics bundle of this node as a
+                       tar.gz file, for attaching to support tickets,
+                       with the node's recent log messages, goroutine
+                       and heap profiles, a Cfg snapshot (node
+                       definitions, index definitions and plan) and
+                       the /api/diag and /api/stats responses.`,
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/cfgSnapshot", "GET", NewCfgSnapshotHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Returns a snapshot of the cluster's Cfg (node
+                       definitions, index definitions, plan and cbft
+                       settings) as a JSON file, for disaster recovery
+                       when the Cfg provider itself is lost.`,
+			"version introduced": "0.4.0",
+		})
+	handle("/api/cfgRestore", "POST", NewCfgRestoreHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Restores the Cfg entries of a snapshot, which is
+                       the request body, as returned by
+                       GET /api/cfgSnapshot.`,
+			"param: force": "optional, boolean, URL query parameter\n\n" +
+				"When true, a Cfg that already has index definitions is" +
+				" overwritten; otherwise the restore is refused.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/stats/history", "GET", NewStatsHistoryHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns this node's rolling history of the key
+                       stats of its indexes (query rate, query error
+                       rate, average query latency, ingest rate and
+                       doc count), as JSON samples that are taken
+                       every statsHistoryIntervalSecs (a node option,
+                       default 10).`,
+			"param: since": "optional, string, URL query parameter\n\n" +
+				"Only the samples after this time are returned, which is" +
+				" either an RFC 3339 time or a duration before now," +
+				" like 15m.",
+			"param: indexName": "optional, string, URL query parameter\n\n" +
+				"Only the stats of this index are returned.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/stats/cluster", "GET", NewClusterStatsHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns the per-index stats of the whole cluster
+                       as JSON, which are the sums of the /api/nsstats
+                       of every node.  The stats of every node are
+                       retrieved by the node that handles the request,
+                       where the nodes that couldn't be reached are
+                       marked as unreachable and left out of the sums.`,
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/queryLog", "GET", NewQueryLogHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns this node's query log of the current
+                       (UTC) day as JSON, with its slow queries,
+                       per-index query stats rollups and per-index
+                       advisor findings (counts of query warnings).
+                       Queries slower than the slowQueryThresholdMS of
+                       the cluster settings are slow queries.  After
+                       each day, the day's query log is exported to
+                       the queryLogExport of the cluster settings.`,
+			"version introduced": "0.4.0",
+		})
+	handle("/api/queryLog/export", "POST", NewQueryLogExportHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Exports this node's query log of the current day
+                       to the queryLogExport of the cluster settings
+                       right away, such as to test the export target.`,
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/query/active", "GET", NewQueryActiveHandler(),
+		map[string]string{
+			"_category": "Indexing|Index querying",
+			"_about": `Returns the queries that this node is running as
+                       JSON, from the oldest, with their queryId, index
+                       name, query request and elapsed time, along with
+                       the number of pindex searches that are still
+                       running after their queries were cancelled or
+                       timed out (orphanedSearches), and their total
+                       since the node started (orphanedSearchesTotal).`,
+			"param: indexName": "optional, string, URL query parameter\n\n" +
+				"Only the active queries of this index are returned.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/query/{queryId}", "DELETE", NewQueryCancelHandler(),
+		map[string]string{
+			"_category": "Indexing|Index querying",
+			"_about": `Cancels a query that this node is running, which
+                       then fails right away, as if it timed out.  The
+                       queryId of a query is its ctl queryId, such as
+                       {"ctl": {"queryId": "my-query-1"}}, or else a
+                       queryId that's assigned by the node, as listed
+                       by GET /api/query/active.`,
+			"param: queryId": "required, string, URL path parameter\n\n" +
+				"The queryId of the active query.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/quarantine", "GET", NewQuarantineListHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns the indexes that were quarantined, whose
+                       ingest was paused for exceeding the ingest error
+                       budget, as JSON.`,
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/freeze", "POST",
+		NewIndexTrashGuardHandler(mgr, NewIndexFreezeHandler(mgr)),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Freezes an index, making it read-only but still
+                       queryable: its ingest is paused, stopping its
+                       feeds, and its plan is frozen, which is
+                       persisted in the index definition's plan params.
+                       While frozen, requests that would change the
+                       index are rejected.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/freeze", "DELETE",
+		NewIndexTrashGuardHandler(mgr, NewIndexUnfreezeHandler(mgr)),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Unfreezes a frozen index, resuming its ingest
+                       (unless it's quarantined) and unfreezing its
+                       plan.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/index/{indexName}/restore", "POST",
+		NewIndexRestoreHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Restores a deleted index from the trash, with its
+                       definition, pindex files and previous ingest,
+                       query and plan freeze controls, before its grace
+                       period is over.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/trash", "GET", NewIndexTrashHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Returns the deleted indexes that are in the trash,
+                       with when each index will be purged, as JSON.`,
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/index/{indexName}/quarantine", "DELETE",
+		NewQuarantineReleaseHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Releases an index from quarantine and resumes
+                       the index's ingest.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/analysis", "GET", NewAnalysisHandler(),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Returns the names of the analyzers, tokenizers,
+                       token filters, char filters, token maps and
+                       datetime parsers that are available for index
+                       mappings, and the ones that aren't available in
+                       this cbft binary, along with the build tag that
+                       would register them.`,
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/composite", "GET", NewCompositeListHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Returns the composite index definitions as JSON,
+                       with the member index of each of their sources.`,
+			"version introduced": "0.4.0",
+		})
+	handle("/api/composite/{name}", "PUT", NewCompositePutHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Creates/updates a composite index, which is a
+                       single logical index over several data sources.
+                       The request body is JSON, such as {"sources":
+                       [{"sourceName": "beers", "params": {...},
+                       "planParams": {...}}, ...]}, where each source
+                       gets its own bleve member index, with its own
+                       index params and plan params, and where the
+                       composite index's name is an alias of the member
+                       indexes that's queried like any index.`,
+			"param: name": "required, string, URL path parameter\n\n" +
+				"The name of the composite index.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/composite/{name}", "DELETE", NewCompositeDeleteHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Deletes a composite index, along with its alias
+                       and member indexes.`,
+			"param: name": "required, string, URL path parameter\n\n" +
+				"The name of the composite index.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/template", "GET", NewIndexTemplateListHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Returns the index templates as JSON, with the
+                       indexes that each template was instantiated as.`,
+			"version introduced": "0.4.0",
+		})
+	handle("/api/template/{name}", "PUT", NewIndexTemplatePutHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Creates/updates an index template, which is an
+                       index definition pattern that's instantiated
+                       for many data sources.  The request body is
+                       JSON, such as {"sourcePattern": "customer-*",
+                       "indexName": "{sourceName}_fts", "params":
+                       {...}, "planParams": {...}}, where the
+                       optional sourcePattern is a glob of the names of
+                       the new buckets that the template is
+                       automatically instantiated for.`,
+			"param: name": "required, string, URL path parameter\n\n" +
+				"The name of the index template.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/template/{name}", "DELETE",
+		NewIndexTemplateDeleteHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Deletes an index template, but not the indexes
+                       that it was instantiated as.`,
+			"param: name": "required, string, URL path parameter\n\n" +
+				"The name of the index template.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/template/{name}/instantiate", "POST",
+		NewIndexTemplateInstantiateHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Creates the index of an index template for a data
+                       source, where the request body is JSON, such as
+                       {"sourceName": "customer-42"}, and returns the
+                       name of the created index.`,
+			"param: name": "required, string, URL path parameter\n\n" +
+				"The name of the index template.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/namespace", "GET", NewNamespaceListHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Returns the tenant namespaces, along with the
+                       indexes and the quota usage of each namespace,
+                       as JSON.`,
+			"version introduced": "0.4.0",
+		})
+	handle("/api/namespace/{namespace}", "PUT", NewNamespacePutHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Creates/updates a tenant namespace.  The request
+                       body is JSON, such as {"authKey": "secret",
+                       "maxIndexes": 10}, where the authKey is required
+                       by the namespace's /api/ns/{namespace}/...
+                       routes (as a bearer token or a basic auth
+                       password).  The optional quotas of maxIndexes,
+                       maxDiskBytes, maxPartitions and
+                       maxPartitionsPerIndex are checked on index
+                       create/update requests, where 0 means
+                       unlimited.  An omitted authKey keeps the
+                       namespace's current authKey.  The indexes of a
+                       namespace are named NAMESPACE__INDEXNAME.`,
+			"param: namespace": "required, string, URL path parameter\n\n" +
+				"The name of the namespace, which can't have underscores.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/namespace/{namespace}", "DELETE", NewNamespaceDeleteHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Deletes a tenant namespace, which must not have
+                       any indexes.`,
+			"param: namespace": "required, string, URL path parameter\n\n" +
+				"The name of the namespace.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/ns/{namespace}/index", "GET", NewNamespaceIndexListHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Returns the index definitions of a namespace,
+                       keyed by their local index names, as JSON.
+                       Requires the namespace's authKey.`,
+			"param: namespace": "required, string, URL path parameter\n\n" +
+				"The name of the namespace.",
+			"version introduced": "0.4.0",
+		})
+	for _, m := range []string{"GET", "PUT", "DELETE"} {
+		handle("/api/ns/{namespace}/index/{indexName}", m,
+			NewNamespaceIndexHandler(mgr, r),
+			map[string]string{
+				"_category": "Indexing|Index definition",
+				"_about": `Like ` + m + ` /api/index/{indexName}, for an
+                       index of a namespace.  Requires the namespace's
+                       authKey.  The targets of an alias are local to
+                       the namespace.`,
+				"param: namespace": "required, string, URL path parameter\n\n" +
+					"The name of the namespace.",
+				"param: indexName": "required, string, URL path parameter\n\n" +
+					"The name of the index, local to the namespace.",
+				"version introduced": "0.4.0",
+			})
+	}
+	handle("/api/ns/{namespace}/index/{indexName}/count", "GET",
+		NewNamespaceIndexHandler(mgr, r),
+		map[string]string{
+			"_category": "Indexing|Index querying",
+			"_about": `Like GET /api/index/{indexName}/count, for an
+                       index of a namespace.  Requires the namespace's
+                       authKey.`,
+			"param: namespace": "required, string, URL path parameter\n\n" +
+				"The name of the namespace.",
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index, local to the namespace.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/ns/{namespace}/index/{indexName}/query", "POST",
+		NewNamespaceIndexHandler(mgr, r),
+		map[string]string{
+			"_category": "Indexing|Index querying",
+			"_about": `Like POST /api/index/{indexName}/query, for an
+                       index of a namespace.  Requires the namespace's
+                       authKey.`,
+			"param: namespace": "required, string, URL path parameter\n\n" +
+				"The name of the namespace.",
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index, local to the namespace.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/webhooks", "GET", NewWebhookListHandler(mgr),
+		map[string]string{
+			"_category":          "Node|Node configuration",
+			"_about":             `Returns the registered webhooks as JSON.`,
+			"version introduced": "0.4.0",
+		})
+	handle("/api/webhooks/{webhookName}", "PUT", NewWebhookPutHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Creates/updates a webhook registration.  The request
+                       body is JSON, such as {"url": "http://HOST/hook",
+                       "events": ["indexCreated", "indexDeleted"]},
+                       where an empty events list means all events.
+                       Events are POST'ed to the url as JSON.  The
+                       events are indexCreated, indexUpdated,
+                       indexDeleted, pindexMove, pindexBuildComplete,
+                       feedRollback, indexQuarantined,
+                       diskHighWatermark, diskLowWatermark,
+                       indexExpiring and percolatorMatches.`,
+			"param: webhookName": "required, string, URL path parameter\n\n" +
+				"The name of the webhook.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/webhooks/{webhookName}", "DELETE", NewWebhookDeleteHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about":    `Deletes a webhook registration.`,
+			"param: webhookName": "required, string, URL path parameter\n\n" +
+				"The name of the webhook.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/indexDefsExport", "GET", NewIndexDefsExportHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Returns all index definitions as a single JSON
+                       bundle, without index UUIDs, which can be
+                       imported into another cluster.`,
+			"param: includeSourceUUIDs": "optional, boolean, URL query parameter\n\n" +
+				"When true, the bundle includes source UUIDs, which are" +
+				" usually specific to a cluster.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/indexDefsImport", "POST", NewIndexDefsImportHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Creates or updates the index definitions of a
+                       bundle, which is the request body, and returns
+                       the action for each index definition (create,
+                       update, skip, unchanged, conflict or failed).
+                       Aliases are imported after other indexes.  Any
+                       "profiles" overlay of an index definition for
+                       the active profile is applied.`,
+			"param: conflict": "optional, string, URL query parameter\n\n" +
+				"How existing index definitions that differ from the bundle" +
+				" are handled: fail (the default, where nothing is imported" +
+				" if there are any conflicts), skip or overwrite.",
+			"param: dryRun": "optional, boolean, URL query parameter\n\n" +
+				"When true, the actions are returned but not applied.",
+			"param: profile": "optional, string, URL query parameter\n\n" +
+				"The profile whose overlays are applied, instead of the" +
+				" active profile.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/index/{indexName}/count", "POST",
+		NewQueryCountHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index querying",
+			"_about": `Returns the number of documents that match a
+                       query, without collecting hits, highlighting or
+                       loading stored fields.  The request body is a
+                       JSON query request, like for the query
+                       endpoint, whose size, from, highlight, fields,
+                       facets and explain are ignored.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index to be queried.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/index/{indexName}/deleteByQuery", "POST",
+		NewIndexFreezeGuardHandler(mgr, NewDeleteByQueryHandler(mgr)),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Removes the documents that match a query from
+                       the index partitions on this node, for indexes
+                       whose data source isn't couchbase (such as
+                       file-fed indexes).  The request body is JSON,
+                       such as {"query": {...}, "dryRun": true}, where
+                       the query is a bleve query, and where a dryRun
+                       only returns the number of matching documents.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/index/{indexName}/docTypeCounts", "GET",
+		NewDocTypeCountsHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns the document counts per mapping type of
+                       an index that has docTypeStats enabled in its
+                       index params, based on the index partitions on
+                       this node, as JSON.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/index/{indexName}/ingestErrors", "GET",
+		NewIngestErrorsHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns the ingest errors of an index on this
+                       node, as JSON, which are the error counts per
+                       failed operation and the most recent failures,
+                       newest first, with their doc IDs and reasons,
+                       along with the path of the index's dead-letter
+                       file, if it has one.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/index/{indexName}/facetSuggestions", "GET",
+		NewFacetSuggestHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Analyzes the fields of an index, based on the index
+                       partitions on this node, and returns the fields
+                       that are good facet candidates (keyword like
+                       fields of low to medium cardinality), along with
+                       warnings about high cardinality or free text
+                       fields, as JSON.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/index/{indexName}/materialize", "POST",
+		NewMaterializeHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Starts copying the union of an alias's member
+                       indexes into a single target index, by reading
+                       the stored fields of every document and
+                       re-indexing them under the target's mapping.
+                       The request body is JSON, such as
+                       {"target": "myIndex", "resume": false,
+                       "consistency": {...}}, where the target must be
+                       a bleve index with a primary source type whose
+                       partitions are on this node, resume continues
+                       from the last checkpoint, and consistency is
+                       the seq's that the members must reach first.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the alias.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/materialize", "GET",
+		NewMaterializeTasksHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns the progress and checkpoints of the
+                       materializations of an alias, or of the samples
+                       of an index, as JSON.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the alias or index.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/index/{indexName}/reshard", "POST",
+		NewReshardHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Starts changing the maxPartitionsPerPIndex of a
+                       bleve index without downtime, by building a
+                       shadow index with the new partition layout in
+                       the background and then switching the index
+                       name over to it, as an alias of the shadow
+                       index.  The request body is JSON, such as
+                       {"maxPartitionsPerPIndex": 32}.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/reshard", "GET",
+		NewReshardTaskHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns the progress of the latest re-shard of
+                       an index, as JSON.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/reshard", "DELETE",
+		NewReshardCancelHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Cancels the running re-shard of an index,
+                       removing its shadow index.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/indexTTL", "GET", NewIndexTTLsHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns the indexes that have an expireAfter TTL
+                       as JSON, with when each index was last used and
+                       when it will be deleted if it stays unused.`,
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/pindex/{pindexName}/files", "GET",
+		NewPIndexFilesHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns the files of a local index partition,
+                       with their sizes and SHA-1 checksums, as JSON,
+                       for the pindex file transfer protocol.`,
+			"param: pindexName": "required, string, URL path parameter\n\n" +
+				"The name of the index partition.",
+			"param: snapshot": "optional, string, URL query parameter\n\n" +
+				"The ID of a snapshot of the index partition, whose files are used.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/pindex/{pindexName}/file/{path:.*}", "GET",
+		NewPIndexFileHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns a file of a local index partition, where
+                       range requests (Range, If-Range) and caching
+                       (ETag, If-None-Match) are supported, so that
+                       interrupted transfers can be resumed.`,
+			"param: pindexName": "required, string, URL path parameter\n\n" +
+				"The name of the index partition.",
+			"param: path": "required, string, URL path parameter\n\n" +
+				"The path of the file, relative to the index partition's directory.",
+			"param: snapshot": "optional, string, URL query parameter\n\n" +
+				"The ID of a snapshot of the index partition, whose files are used.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/pindex/{pindexName}/filesBulk", "GET",
+		NewPIndexFilesBulkHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns several files of a local index partition
+                       as a tar, in a single request.`,
+			"param: pindexName": "required, string, URL path parameter\n\n" +
+				"The name of the index partition.",
+			"param: path": "required, string, URL query parameter\n\n" +
+				"The path of a file, which may be repeated.",
+			"param: snapshot": "optional, string, URL query parameter\n\n" +
+				"The ID of a snapshot of the index partition, whose files are used.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/pindex/{pindexName}/docs", "GET",
+		NewPIndexDocsHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns the documents of a local index partition,
+                       with their stored fields, in doc ID order.`,
+			"param: pindexName": "required, string, URL path parameter\n\n" +
+				"The name of the index partition.",
+			"param: after": "optional, string, URL query parameter\n\n" +
+				"Only documents whose doc ID's are after this doc ID are returned.",
+			"param: limit": "optional, integer, URL query parameter\n\n" +
+				"The max number of documents that are returned.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/pindex/{pindexName}/snapshot", "POST",
+		NewPIndexSnapshotHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Copies the files of a local index partition into
+                       a snapshot while the partition's ingest is
+                       paused, returning the snapshot's ID and the seq
+                       of each source partition, so that its files can
+                       be transferred consistently.`,
+			"param: pindexName": "required, string, URL path parameter\n\n" +
+				"The name of the index partition.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/pindex/{pindexName}/snapshot/{snapshot}", "DELETE",
+		NewPIndexSnapshotReleaseHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about":    `Removes a snapshot of a local index partition.`,
+			"param: pindexName": "required, string, URL path parameter\n\n" +
+				"The name of the index partition.",
+			"param: snapshot": "required, string, URL path parameter\n\n" +
+				"The ID of the snapshot.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/stats/pindexTransfer", "GET",
+		NewPIndexTransferStatsHandler(),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns the node's pindex file transfer stats
+                       as JSON.`,
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/stats/encryption", "GET",
+		NewEncryptionStatsHandler(),
+		map[string]string{
+			"_category": "Node|Node diagnostics",
+			"_about": `Returns the node's encryption stats as JSON, which
+                       are the ID of the node's encryption key, or ""
+                       when the node doesn't encrypt, and the number
+                       of index values that couldn't be decrypted.`,
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/index/{indexName}/estimate", "POST",
+		NewIndexEstimateHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Estimates the disk and memory footprint and the
+                       build time of an index definition, before the
+                       index is created, by building a throwaway index
+                       of sample documents.  The request body is the
+                       JSON index definition, as for PUT
+                       /api/index/{indexName}, along with the "docs" to
+                       sample, as a JSON object keyed by doc ID, and
+                       the "docCount" of the data source, which the
+                       sample is scaled up to.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index definition to estimate, which" +
+				" doesn't need to exist yet.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/history", "GET",
+		NewIndexHistoryHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Returns the recorded versions of an index
+                       definition as JSON, from oldest to newest, which
+                       are kept even after the index is deleted.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/history/rollback", "POST",
+		NewIndexTrashGuardHandler(mgr,
+			NewIndexFreezeGuardHandler(mgr, NewIndexRollbackHandler(mgr))),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Rolls back an index definition to an earlier
+                       version, which updates the index, or recreates a
+                       deleted index.  The optional request body is
+                       JSON, such as {"version": 3}, where the default
+                       is the version before the latest one.  The
+                       index's ingest, query and plan freeze controls
+                       are kept as-is.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/clone", "POST",
+		NewIndexCloneHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Creates a new index with the same data source and
+                       plan params as a bleve index, but with a new
+                       mapping, and starts building it right away.  The
+                       request body is JSON, such as {"target":
+                       "beers-v2", "mapping": {...}}, where the mapping
+                       replaces the index's mapping, and where an
+                       optional "params" object is deep-merged over the
+                       index's other params.  Once the new index is
+                       built, an alias can be switched over to it.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index to clone.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/sample", "POST",
+		NewSampleHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Creates a new index with the same mapping as a
+                       bleve index, and starts copying a deterministic
+                       sample of the index's documents into the new
+                       index.  The request body is JSON, such as
+                       {"target": "mySample", "every": 10} or
+                       {"target": "mySample", "percent": 5.0}, where
+                       documents are sampled by the hash of their doc
+                       IDs.  The new index has a primary source type,
+                       so it can be exported as an archive.  Progress
+                       is tracked like a materialization.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index to sample.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/archive", "GET",
+		NewIndexArchiveGetHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Returns an archive (a gzip'ed tar) of the index
+                       definition and documents of a bleve index with
+                       a primary source type, such as a sample.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/archive", "PUT",
+		NewIndexArchiveRestoreHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Creates a new index from an archive, which is the
+                       request body, and loads the archive's documents
+                       into the new index.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the new index.",
+			"version introduced": "0.4.0",
+		})
+
+	handle("/api/index/{indexName}/percolator", "GET",
+		NewPercolatorListHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index querying",
+			"_about":    `Returns the stored percolator queries of an index as JSON.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/percolator/{queryName}", "PUT",
+		NewPercolatorPutHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index querying",
+			"_about": `Creates/updates a stored percolator query of an index.
+                       The request body is JSON, such as
+                       {"query": {...}, "onIngest": false}, where the
+                       query uses the bleve query JSON syntax and
+                       onIngest enables matching against incoming
+                       mutations, where the matches are delivered in
+                       batches as percolatorMatches webhook events.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"param: queryName": "required, string, URL path parameter\n\n" +
+				"The name of the stored query.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/percolator/{queryName}", "DELETE",
+		NewPercolatorDeleteHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index querying",
+			"_about":    `Deletes a stored percolator query of an index.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"param: queryName": "required, string, URL path parameter\n\n" +
+				"The name of the stored query.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/percolate", "POST",
+		NewPercolateHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index querying",
+			"_about": `Returns the names of the stored percolator queries
+                       of an index that match the JSON document
+                       in the request body.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"param: docID": "optional, string, URL query parameter\n\n" +
+				"The document ID to use for the document.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/relevance", "GET", NewRelevanceSetListHandler(mgr),
+		map[string]string{
+			"_category":          "Indexing|Index querying",
+			"_about":             `Returns the relevance judgment sets as JSON.`,
+			"version introduced": "0.4.0",
+		})
+	handle("/api/relevance/{name}", "PUT", NewRelevanceSetPutHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index querying",
+			"_about": `Uploads a relevance judgment set, which is a list
+                       of queries with graded relevance ratings of
+                       documents.  The request body is JSON, such as
+                       {"queries": [{"id": "q1", "query": {...},
+                       "ratings": {"doc-1": 3, "doc-2": 0}}]}.`,
+			"param: name": "required, string, URL path parameter\n\n" +
+				"The name of the relevance judgment set.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/relevance/{name}", "DELETE",
+		NewRelevanceSetDeleteHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index querying",
+			"_about":    `Deletes a relevance judgment set.`,
+			"param: name": "required, string, URL path parameter\n\n" +
+				"The name of the relevance judgment set.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/relevanceEval", "POST",
+		NewRelevanceEvalHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index querying",
+			"_about": `Runs the queries of a relevance judgment set
+                       against an index, and returns the precision@k,
+                       recall@k, NDCG@k, reciprocal rank and average
+                       precision of each query, and their means, as
+                       JSON.  The request body is JSON, such as {"set":
+                       "beer-judgments", "k": 10}, or has the "queries"
+                       of a set inline.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
+	handle("/api/index/{indexName}/percolatorMatches", "GET",
+		NewPercolatorMatchesHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns the recent matches of the onIngest stored
+                       percolator queries of an index, as seen by
+                       this node, as JSON, along with the number of
+                       mutations that weren't percolated as this
+                       node's percolator queue was full.`,
+			"param: indexName": "required, string, URL path parameter\n\n" +
+				"The name of the index.",
+			"version introduced": "0.4.0",
+		})
 }
@@ -2959,3 +2959,71 @@ func TestIndexDefWithJSON(t *testing.T) {
 
 	testRESTHandlers(t, tests, router)
 }
+
+func TestRESTRouterV1(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	mr, _ := cbgt.NewMsgRing(os.Stderr, 1000)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", mr)
+	if err != nil || router == nil {
+		t.Errorf("no mux router")
+	}
+
+	tests := []*RESTHandlerTest{
+		{
+			Desc:   "versioned create index",
+			Path:   "/api/v1/index/idx0",
+			Method: "PUT",
+			Params: url.Values{
+				"indexType":  []string{"bleve"},
+				"sourceType": []string{"nil"},
+			},
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`{"status":"ok"}`: true,
+			},
+		},
+		{
+			Desc:   "versioned list indexes",
+			Path:   "/api/v1/index",
+			Method: "GET",
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"idx0"`: true,
+			},
+		},
+		{
+			Desc:         "versioned cbft-specific route",
+			Path:         "/api/v1/settings",
+			Method:       "GET",
+			Status:       http.StatusOK,
+			ResponseBody: []byte(`{"status":"ok","settings":{}}`),
+		},
+		{
+			Desc:   "versioned route with wrong method",
+			Path:   "/api/v1/settings",
+			Method: "DELETE",
+			Status: 404,
+		},
+	}
+
+	testRESTHandlers(t, tests, router)
+
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/api/v1/index"},
+	}
+	record := httptest.NewRecorder()
+	router.ServeHTTP(record, req)
+	if record.Header().Get(API_VERSION_HEADER) != "v1" ||
+		RequestAPIVersion(req) != "v1" {
+		t.Errorf("expected v1 api version header")
+	}
+}
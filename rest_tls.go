@@ -0,0 +1,220 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// With the "restTLSCertFile" and "restTLSKeyFile" node options, a
+// node serves its REST API over https, and with the
+// "restTLSClientCAFile" node option, the node also verifies the
+// client certificates of requests (mutual TLS), where the
+// "restCertRoles" node option is the path of a JSON file that maps
+// the names of client certificates to roles (see auth.go)...
+//
+//   {
+//     "indexer.svc.internal": ["admin"],
+//     "*.search.svc.internal": ["search"]
+//   }
+//
+// The names of a certificate are its subject common name and its DNS
+// and email subject alternative names, where a "*." name matches any
+// DNS name with that suffix.  The nodes of a cluster call each other
+// over https, with their own certificate as their client certificate,
+// so the nodes' certificates need to map to the "admin" role.
+
+// NodeScheme is the scheme of the REST API of the cluster's nodes.
+var NodeScheme = "http"
+
+// NodeHTTPClient is the client of the requests between nodes.
+var NodeHTTPClient = &http.Client{}
+
+// NodeURL returns the base URL of the REST API of a node.
+func NodeURL(hostPort string) string {
+	return NodeScheme + "://" + hostPort
+}
+
+// RESTTLSStart returns the TLS config of the node's REST listener, or
+// nil when the node serves http, and configures the NodeHTTPClient to
+// call the other nodes over https.
+func RESTTLSStart(options map[string]string) (*tls.Config, error) {
+	certFile, keyFile := options["restTLSCertFile"], options["restTLSKeyFile"]
+	if certFile == "" && keyFile == "" {
+		if options["restTLSClientCAFile"] != "" {
+			return nil, fmt.Errorf("rest_tls: restTLSClientCAFile needs" +
+				" restTLSCertFile and restTLSKeyFile")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("rest_tls: restTLSCertFile/restTLSKeyFile,"+
+			" err: %v", err)
+	}
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if caFile := options["restTLSClientCAFile"]; caFile != "" {
+		serverConfig.ClientCAs, err = loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		switch options["restTLSClientAuth"] {
+		case "", "request":
+			serverConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		case "require":
+			serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		default:
+			return nil, fmt.Errorf("rest_tls: unknown restTLSClientAuth: %q",
+				options["restTLSClientAuth"])
+		}
+	}
+
+	clientConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	caFile := options["restTLSCAFile"]
+	if caFile == "" {
+		caFile = options["restTLSClientCAFile"]
+	}
+	if caFile != "" {
+		clientConfig.RootCAs, err = loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	NodeScheme = "https"
+	NodeHTTPClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     clientConfig,
+			MaxIdleConnsPerHost: 256,
+		},
+	}
+
+	return serverConfig, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("rest_tls: CA file, err: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("rest_tls: no certificates in CA file: %s",
+			caFile)
+	}
+
+	return pool, nil
+}
+
+// NewCertAuthenticator returns the Authenticator of the verified
+// client certificates of requests, or nil when the node doesn't
+// verify client certificates.
+func NewCertAuthenticator(options map[string]string) (Authenticator, error) {
+	if options["restTLSClientCAFile"] == "" {
+		return nil, nil
+	}
+
+	rolesFile := options["restCertRoles"]
+	if rolesFile == "" {
+		return nil, fmt.Errorf("rest_tls: restTLSClientCAFile needs" +
+			" restCertRoles")
+	}
+
+	buf, err := ioutil.ReadFile(rolesFile)
+	if err != nil {
+		return nil, fmt.Errorf("rest_tls: restCertRoles, err: %v", err)
+	}
+
+	certRoles := map[string][]string{}
+	err = json.Unmarshal(buf, &certRoles)
+	if err != nil {
+		return nil, fmt.Errorf("rest_tls: could not parse restCertRoles,"+
+			" err: %v", err)
+	}
+
+	for name, roles := range certRoles {
+		for _, role := range roles {
+			if _, exists := AuthRoles[role]; !exists {
+				return nil, fmt.Errorf("rest_tls: restCertRoles,"+
+					" name: %s, unknown role: %s", name, role)
+			}
+		}
+	}
+
+	return func(req *http.Request) (*AuthIdentity, error) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) <= 0 ||
+			len(req.TLS.VerifiedChains[0]) <= 0 {
+			return nil, nil
+		}
+
+		cert := req.TLS.VerifiedChains[0][0]
+
+		name, roles := certNameRoles(cert, certRoles)
+		if roles == nil {
+			return nil, fmt.Errorf("no roles for client certificate: %q",
+				cert.Subject.CommonName)
+		}
+
+		return &AuthIdentity{User: name, Roles: roles, Source: "cert"}, nil
+	}, nil
+}
+
+// certNameRoles returns the first name of a certificate that has
+// roles, and its roles, where exact names are preferred over "*."
+// names.
+func certNameRoles(cert *x509.Certificate,
+	certRoles map[string][]string) (string, []string) {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+
+	for _, name := range names {
+		if roles, exists := certRoles[name]; exists {
+			return name, roles
+		}
+	}
+
+	for _, name := range names {
+		for i := strings.Index(name, "."); i >= 0; {
+			if roles, exists := certRoles["*"+name[i:]]; exists {
+				return name, roles
+			}
+			j := strings.Index(name[i+1:], ".")
+			if j < 0 {
+				break
+			}
+			i += j + 1
+		}
+	}
+
+	return "", nil
+}
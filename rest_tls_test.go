@@ -0,0 +1,194 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert returns a PEM certificate and key signed by the parent, or
+// a self-signed CA when the parent is nil.
+func testCert(t *testing.T, cn string, dnsNames []string,
+	parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (
+	*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+		},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent,
+		&key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestRESTTLSClientCerts(t *testing.T) {
+	defer func(scheme string, client *http.Client) {
+		NodeScheme, NodeHTTPClient = scheme, client
+	}(NodeScheme, NodeHTTPClient)
+
+	dir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dir)
+
+	ca, caKey, caPEM, _ := testCert(t, "test-ca", nil, nil, nil)
+	_, _, nodePEM, nodeKeyPEM := testCert(t, "node", nil, ca, caKey)
+
+	ioutil.WriteFile(filepath.Join(dir, "ca.pem"), caPEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "node.pem"), nodePEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "node.key"), nodeKeyPEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "roles.json"), []byte(`{
+		"node": ["admin"],
+		"*.search.test": ["search"]
+	}`), 0600)
+
+	options := map[string]string{
+		"restTLSCertFile":     filepath.Join(dir, "node.pem"),
+		"restTLSKeyFile":      filepath.Join(dir, "node.key"),
+		"restTLSClientCAFile": filepath.Join(dir, "ca.pem"),
+		"restCertRoles":       filepath.Join(dir, "roles.json"),
+	}
+
+	serverConfig, err := RESTTLSStart(options)
+	if err != nil || serverConfig == nil {
+		t.Fatalf("expected a server tls config, err: %v", err)
+	}
+	if NodeURL("127.0.0.1:8095") != "https://127.0.0.1:8095" {
+		t.Errorf("expected https node URL's, got: %s",
+			NodeURL("127.0.0.1:8095"))
+	}
+
+	restAuth, err := NewRESTAuth(options)
+	if err != nil || !restAuth.Enabled() {
+		t.Fatalf("expected an enabled rest auth, err: %v", err)
+	}
+
+	s := httptest.NewUnstartedServer(restAuth.Handler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})))
+	s.TLS = serverConfig
+	s.StartTLS()
+	defer s.Close()
+
+	clientFor := func(cn string, dnsNames []string) *http.Client {
+		tlsConfig := &tls.Config{RootCAs: x509.NewCertPool()}
+		tlsConfig.RootCAs.AddCert(ca)
+		if cn != "" {
+			_, _, certPEM, keyPEM := testCert(t, cn, dnsNames, ca, caKey)
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		return &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+	}
+
+	searcher := clientFor("app", []string{"app1.search.test"})
+
+	tests := []struct {
+		client *http.Client
+		method string
+		path   string
+		exp    int
+	}{
+		{NodeHTTPClient, "GET", "/api/index", 200},
+		{NodeHTTPClient, "DELETE", "/api/index/x", 200},
+		{searcher, "POST", "/api/index/x/query", 200},
+		{searcher, "GET", "/api/index", 403},
+		{clientFor("stranger", nil), "GET", "/api/index", 401},
+		{clientFor("", nil), "GET", "/api/index", 401},
+	}
+
+	for i, test := range tests {
+		req, _ := http.NewRequest(test.method, s.URL+test.path, nil)
+		resp, err := test.client.Do(req)
+		if err != nil {
+			t.Fatalf("%d: expected no err, got: %v", i, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.exp {
+			t.Errorf("%d: %s %s, expected: %d, got: %d",
+				i, test.method, test.path, test.exp, resp.StatusCode)
+		}
+	}
+
+	for _, badOptions := range []map[string]string{
+		{"restTLSClientCAFile": filepath.Join(dir, "ca.pem")},
+		{"restTLSCertFile": filepath.Join(dir, "missing.pem")},
+		{
+			"restTLSCertFile":     filepath.Join(dir, "node.pem"),
+			"restTLSKeyFile":      filepath.Join(dir, "node.key"),
+			"restTLSClientCAFile": filepath.Join(dir, "ca.pem"),
+			"restTLSClientAuth":   "sometimes",
+		},
+	} {
+		_, err = RESTTLSStart(badOptions)
+		if err == nil {
+			t.Errorf("expected err, options: %v", badOptions)
+		}
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "roles.json"),
+		[]byte(`{"node": ["superuser"]}`), 0600)
+	_, err = NewCertAuthenticator(options)
+	if err == nil {
+		t.Errorf("expected err on unknown role")
+	}
+}
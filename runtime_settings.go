@@ -0,0 +1,233 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The Go runtime settings of a node, GOMAXPROCS and GOGC (the GC
+// target percentage), can be changed without a restart, by a POST to
+// /api/runtime, which can also trigger a GC or a GC that returns as
+// much memory as possible to the OS, for tuning the GC of nodes that
+// are tight on memory.  Like the log level, the runtime settings
+// aren't persisted, so a restarted node is back at the GOMAXPROCS and
+// GOGC of its environment.
+
+// RuntimeSettings are the changes of a POST to /api/runtime, where
+// nil fields are unchanged, and where a GOGC of -1 turns off the GC.
+type RuntimeSettings struct {
+	GOMAXPROCS   *int `json:"GOMAXPROCS,omitempty"`
+	GOGC         *int `json:"GOGC,omitempty"`
+	GC           bool `json:"gc,omitempty"`
+	FreeOSMemory bool `json:"freeOSMemory,omitempty"`
+}
+
+// RuntimeMemStats are the key memory stats of the Go runtime.
+type RuntimeMemStats struct {
+	Alloc         uint64  `json:"Alloc"`
+	TotalAlloc    uint64  `json:"TotalAlloc"`
+	Sys           uint64  `json:"Sys"`
+	HeapAlloc     uint64  `json:"HeapAlloc"`
+	HeapSys       uint64  `json:"HeapSys"`
+	HeapIdle      uint64  `json:"HeapIdle"`
+	HeapInuse     uint64  `json:"HeapInuse"`
+	HeapReleased  uint64  `json:"HeapReleased"`
+	HeapObjects   uint64  `json:"HeapObjects"`
+	NextGC        uint64  `json:"NextGC"`
+	LastGC        uint64  `json:"LastGC"`
+	NumGC         uint32  `json:"NumGC"`
+	PauseTotalNs  uint64  `json:"PauseTotalNs"`
+	GCCPUFraction float64 `json:"GCCPUFraction"`
+}
+
+// RuntimeState is the current runtime settings and memory stats.
+type RuntimeState struct {
+	GOMAXPROCS int             `json:"GOMAXPROCS"`
+	GOGC       int             `json:"GOGC"`
+	MemStats   RuntimeMemStats `json:"memStats"`
+}
+
+var runtimeM sync.Mutex // Protects runtimeGOGC.
+var runtimeGOGC = runtimeGOGCEnv(os.Getenv("GOGC"))
+
+// runtimeGOGCEnv returns the GC percentage of a GOGC environment
+// variable, as the Go runtime parses it.
+func runtimeGOGCEnv(s string) int {
+	if s == "off" {
+		return -1
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 100
+	}
+	return n
+}
+
+// CurrentRuntimeState returns the current runtime settings and
+// memory stats, which stops the world briefly.
+func CurrentRuntimeState() *RuntimeState {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	runtimeM.Lock()
+	gogc := runtimeGOGC
+	runtimeM.Unlock()
+
+	return &RuntimeState{
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		GOGC:       gogc,
+		MemStats: RuntimeMemStats{
+			Alloc:         ms.Alloc,
+			TotalAlloc:    ms.TotalAlloc,
+			Sys:           ms.Sys,
+			HeapAlloc:     ms.HeapAlloc,
+			HeapSys:       ms.HeapSys,
+			HeapIdle:      ms.HeapIdle,
+			HeapInuse:     ms.HeapInuse,
+			HeapReleased:  ms.HeapReleased,
+			HeapObjects:   ms.HeapObjects,
+			NextGC:        ms.NextGC,
+			LastGC:        ms.LastGC,
+			NumGC:         ms.NumGC,
+			PauseTotalNs:  ms.PauseTotalNs,
+			GCCPUFraction: ms.GCCPUFraction,
+		},
+	}
+}
+
+// SetRuntimeSettings applies runtime settings, after validating all
+// of them.
+func SetRuntimeSettings(s *RuntimeSettings) error {
+	if s.GOMAXPROCS != nil && *s.GOMAXPROCS < 1 {
+		return fmt.Errorf("runtime_settings: GOMAXPROCS must be >= 1,"+
+			" GOMAXPROCS: %d", *s.GOMAXPROCS)
+	}
+	if s.GOGC != nil && *s.GOGC < -1 {
+		return fmt.Errorf("runtime_settings: GOGC must be >= -1,"+
+			" GOGC: %d", *s.GOGC)
+	}
+
+	if s.GOMAXPROCS != nil {
+		runtime.GOMAXPROCS(*s.GOMAXPROCS)
+	}
+
+	if s.GOGC != nil {
+		runtimeM.Lock()
+		debug.SetGCPercent(*s.GOGC)
+		runtimeGOGC = *s.GOGC
+		runtimeM.Unlock()
+	}
+
+	if s.FreeOSMemory {
+		debug.FreeOSMemory() // Also does a GC.
+	} else if s.GC {
+		runtime.GC()
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------
+
+// RuntimeSettingsGetHandler is a REST handler that adds the GOGC and
+// the memory stats to the runtime info of the next handler.
+type RuntimeSettingsGetHandler struct {
+	next http.Handler
+}
+
+func NewRuntimeSettingsGetHandler(
+	next http.Handler) *RuntimeSettingsGetHandler {
+	return &RuntimeSettingsGetHandler{next: next}
+}
+
+func (h *RuntimeSettingsGetHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	rr := httptest.NewRecorder()
+	h.next.ServeHTTP(rr, req)
+
+	var m map[string]interface{}
+	if rr.Code != http.StatusOK ||
+		json.Unmarshal(rr.Body.Bytes(), &m) != nil || m == nil {
+		for k, v := range rr.HeaderMap {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rr.Code)
+		w.Write(rr.Body.Bytes())
+		return
+	}
+
+	state := CurrentRuntimeState()
+	if g, ok := m["go"].(map[string]interface{}); ok {
+		g["GOGC"] = state.GOGC
+	} else {
+		m["GOGC"] = state.GOGC
+	}
+	m["memStats"] = state.MemStats
+
+	rest.MustEncode(w, m)
+}
+
+// RuntimeSettingsPostHandler is a REST handler that changes the
+// runtime settings.
+type RuntimeSettingsPostHandler struct{}
+
+func NewRuntimeSettingsPostHandler() *RuntimeSettingsPostHandler {
+	return &RuntimeSettingsPostHandler{}
+}
+
+func (h *RuntimeSettingsPostHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("runtime_settings: could not"+
+			" read request body, err: %v", err), 400)
+		return
+	}
+
+	s := &RuntimeSettings{}
+	err = json.Unmarshal(requestBody, s)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("runtime_settings: could not"+
+			" parse request body, err: %v", err), 400)
+		return
+	}
+
+	err = SetRuntimeSettings(s)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	log.Printf("runtime_settings: set, settings: %s", requestBody)
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+		*RuntimeState
+	}{
+		Status:       "ok",
+		RuntimeState: CurrentRuntimeState(),
+	})
+}
@@ -0,0 +1,138 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestRuntimeGOGCEnv(t *testing.T) {
+	tests := map[string]int{
+		"":      100,
+		"off":   -1,
+		"50":    50,
+		"bogus": 100,
+	}
+	for s, exp := range tests {
+		if got := runtimeGOGCEnv(s); got != exp {
+			t.Errorf("GOGC: %q, expected: %d, got: %d", s, exp, got)
+		}
+	}
+}
+
+func TestSetRuntimeSettings(t *testing.T) {
+	prev := CurrentRuntimeState()
+	defer func() {
+		SetRuntimeSettings(&RuntimeSettings{
+			GOMAXPROCS: &prev.GOMAXPROCS,
+			GOGC:       &prev.GOGC,
+		})
+	}()
+
+	zero, bad := 0, -2
+	if SetRuntimeSettings(&RuntimeSettings{GOMAXPROCS: &zero}) == nil {
+		t.Errorf("expected err on GOMAXPROCS of 0")
+	}
+	if SetRuntimeSettings(&RuntimeSettings{GOGC: &bad}) == nil {
+		t.Errorf("expected err on GOGC of -2")
+	}
+
+	procs, gogc := 1, 50
+	err := SetRuntimeSettings(&RuntimeSettings{
+		GOMAXPROCS:   &procs,
+		GOGC:         &gogc,
+		FreeOSMemory: true,
+	})
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+
+	state := CurrentRuntimeState()
+	if state.GOMAXPROCS != 1 || state.GOGC != 50 {
+		t.Errorf("expected settings applied, got: %+v", state)
+	}
+	if runtime.GOMAXPROCS(0) != 1 {
+		t.Errorf("expected GOMAXPROCS of 1")
+	}
+	if state.MemStats.NumGC <= 0 || state.MemStats.Sys <= 0 {
+		t.Errorf("expected memStats, got: %+v", state.MemStats)
+	}
+}
+
+func TestRuntimeSettingsGetHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"arch":"amd64","go":{"GOMAXPROCS":1}}`))
+	})
+
+	req, _ := http.NewRequest("GET", "/api/runtime", nil)
+	rr := httptest.NewRecorder()
+	NewRuntimeSettingsGetHandler(next).ServeHTTP(rr, req)
+
+	var m map[string]interface{}
+	err := json.Unmarshal(rr.Body.Bytes(), &m)
+	if rr.Code != 200 || err != nil {
+		t.Fatalf("expected 200 JSON, got: %d, %s", rr.Code, rr.Body)
+	}
+	if m["arch"] != "amd64" || m["memStats"] == nil {
+		t.Errorf("expected wrapped runtime info, got: %s", rr.Body)
+	}
+	g, ok := m["go"].(map[string]interface{})
+	if !ok || g["GOGC"] == nil || g["GOMAXPROCS"] == nil {
+		t.Errorf("expected GOGC in go, got: %s", rr.Body)
+	}
+
+	next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", 500)
+	})
+	rr = httptest.NewRecorder()
+	NewRuntimeSettingsGetHandler(next).ServeHTTP(rr, req)
+	if rr.Code != 500 || !bytes.Contains(rr.Body.Bytes(), []byte("oops")) {
+		t.Errorf("expected passed-through err, got: %d, %s", rr.Code, rr.Body)
+	}
+}
+
+func TestRuntimeSettingsPostHandler(t *testing.T) {
+	prev := CurrentRuntimeState()
+	defer func() {
+		SetRuntimeSettings(&RuntimeSettings{GOGC: &prev.GOGC})
+	}()
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`not json`, 400},
+		{`{"GOGC": -5}`, 400},
+		{`{"GOGC": 200, "gc": true}`, 200},
+		{`{}`, 200},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "/api/runtime",
+			bytes.NewBufferString(test.body))
+		rr := httptest.NewRecorder()
+		NewRuntimeSettingsPostHandler().ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("body: %s, expected: %d, got: %d, %s",
+				test.body, test.status, rr.Code, rr.Body)
+		}
+	}
+
+	if CurrentRuntimeState().GOGC != 200 {
+		t.Errorf("expected GOGC of 200")
+	}
+}
@@ -0,0 +1,523 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/blevesearch/bleve"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// Sampling clones a bleve index into a new, smaller index with the
+// same mapping, which holds a deterministic sample of the source
+// index's documents, so that developers can work with a realistic
+// but small index on their laptops.  The sample is a materialization
+// (see materialize.go) whose target is created on the fly as a bleve
+// index with a "primary" source type.
+//
+// An index with a primary source type can be exported as an archive
+// (a gzip'ed tar of its index definition and documents), which can
+// be restored as a new index on another cbft cluster.
+
+// The max time to wait for the partitions of a newly created sample
+// or restored index to be assigned to this node.
+var SampleDestsTimeout = 30 * time.Second
+
+// The max number of documents in an index archive, as the archive is
+// built in memory and is intended for samples.
+var IndexArchiveMaxDocs = uint64(100000)
+
+// The names of the files within an index archive.
+const (
+	INDEX_ARCHIVE_INDEX_DEF = "indexDef.json"
+	INDEX_ARCHIVE_DOCS      = "docs.json"
+)
+
+// SampleParams selects a deterministic sample of documents, based on
+// the hash of their doc IDs.
+type SampleParams struct {
+	// When > 0, every Nth document (by doc ID hash) is sampled.
+	Every uint32 `json:"every,omitempty"`
+
+	// Otherwise, a percentage (0 to 100) of documents is sampled.
+	Percent float64 `json:"percent,omitempty"`
+}
+
+// Includes returns true if the document is part of the sample.
+func (p *SampleParams) Includes(docID string) bool {
+	// FNV rather than crc32, which places docs into partitions.
+	h := fnv.New32a()
+	h.Write([]byte(docID))
+	v := h.Sum32()
+
+	if p.Every > 0 {
+		return v%p.Every == 0
+	}
+
+	return float64(v%10000) < p.Percent*100
+}
+
+func (p *SampleParams) validate() error {
+	if p.Every <= 0 && (p.Percent <= 0 || p.Percent > 100) {
+		return fmt.Errorf("sample: either every (> 0) or" +
+			" percent (0 to 100) is required")
+	}
+	return nil
+}
+
+// SampleRequest is the JSON request body of a sample.
+type SampleRequest struct {
+	SampleParams
+
+	// The name of the new index, which defaults to the source index
+	// name with a "_sample" suffix.
+	Target string `json:"target"`
+
+	// The number of partitions of the new index, which defaults to 1.
+	NumPartitions int `json:"numPartitions"`
+
+	Consistency *cbgt.ConsistencyParams `json:"consistency"`
+}
+
+// Sample creates a new index with the same mapping as a bleve index,
+// and starts an asynchronous materialization of a sample of the
+// bleve index's documents into the new index.
+func Sample(mgr *cbgt.Manager, indexName string, sreq *SampleRequest) error {
+	err := sreq.SampleParams.validate()
+	if err != nil {
+		return err
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return err
+	}
+
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil || indexDef.Type != "bleve" {
+		return fmt.Errorf("sample: not a bleve index, indexName: %s",
+			indexName)
+	}
+
+	if sreq.Target == "" {
+		sreq.Target = indexName + "_sample"
+	}
+
+	err = sampleCreateIndex(mgr, sreq.Target, indexDef.Params,
+		sreq.NumPartitions)
+	if err != nil {
+		return err
+	}
+
+	sample := sreq.SampleParams
+
+	task := &MaterializeTask{
+		AliasName:   indexName,
+		TargetName:  sreq.Target,
+		NodeUUID:    mgr.UUID(),
+		Status:      MATERIALIZE_RUNNING,
+		Consistency: sreq.Consistency,
+		Sample:      &sample,
+		StartTime:   time.Now().Format(time.RFC3339Nano),
+	}
+
+	err = materializeUpdateTask(mgr.Cfg(), task.TargetName,
+		func(prev *MaterializeTask) (*MaterializeTask, error) {
+			if prev != nil && prev.Status == MATERIALIZE_RUNNING {
+				return nil, fmt.Errorf("sample: already running,"+
+					" target: %s", task.TargetName)
+			}
+			return task, nil
+		})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		_, err := sampleWaitDests(mgr, task.TargetName)
+		if err == nil {
+			err = materializeRun(mgr, task)
+		} else {
+			task.Status = MATERIALIZE_FAILED
+			task.Error = err.Error()
+			materializeCheckpoint(mgr.Cfg(), task)
+		}
+		if err != nil {
+			log.Printf("sample: run, indexName: %s, target: %s,"+
+				" err: %v", task.AliasName, task.TargetName, err)
+		}
+	}()
+
+	return nil
+}
+
+// sampleCreateIndex creates a bleve index with a primary source type.
+func sampleCreateIndex(mgr *cbgt.Manager, indexName, indexParams string,
+	numPartitions int) error {
+	if numPartitions <= 0 {
+		numPartitions = 1
+	}
+
+	return CreateIndexChecked(mgr, "primary", "", "",
+		fmt.Sprintf(`{"numPartitions":%d}`, numPartitions),
+		"bleve", indexName, indexParams, cbgt.PlanParams{}, "")
+}
+
+// sampleWaitDests waits for the partitions of a newly created index
+// to be assigned to this node, and returns their dests.
+func sampleWaitDests(mgr *cbgt.Manager,
+	indexName string) (map[string]cbgt.Dest, error) {
+	deadline := time.Now().Add(SampleDestsTimeout)
+	for {
+		dests, err := materializeDests(mgr, indexName)
+		if err == nil || time.Now().After(deadline) {
+			return dests, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// ---------------------------------------------------------
+
+// IndexArchiveDoc is an entry of the docs file of an index archive,
+// which has one JSON entry per line.
+type IndexArchiveDoc struct {
+	ID  string                 `json:"id"`
+	Doc map[string]interface{} `json:"doc"`
+}
+
+// WriteIndexArchive writes an archive of a bleve index with a primary
+// source type, which is a gzip'ed tar of the index definition and the
+// documents (as rebuilt from their stored fields) of the index, in
+// doc ID order.
+func WriteIndexArchive(mgr *cbgt.Manager, indexName string,
+	w io.Writer) error {
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return err
+	}
+
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil || indexDef.Type != "bleve" ||
+		indexDef.SourceType != "primary" {
+		return fmt.Errorf("sample: archive needs a bleve index with"+
+			" a primary source type, indexName: %s", indexName)
+	}
+
+	indexDefBuf, err := json.Marshal(indexDef)
+	if err != nil {
+		return err
+	}
+
+	targets, err := bleveIndexTargets(mgr, indexName, "", true, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	alias := bleve.NewIndexAlias(targets...)
+
+	docCount, err := alias.DocCount()
+	if err != nil {
+		return err
+	}
+	if docCount > IndexArchiveMaxDocs {
+		return fmt.Errorf("sample: too many docs for an archive,"+
+			" indexName: %s, docCount: %d", indexName, docCount)
+	}
+
+	var docsBuf bytes.Buffer
+
+	enc := json.NewEncoder(&docsBuf)
+
+	it := newBleveDocIter(targets, "", MaterializeBatchSize)
+	for {
+		doc, err := it.Next()
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			break
+		}
+
+		err = enc.Encode(&IndexArchiveDoc{
+			ID:  doc.ID,
+			Doc: MaterializeDoc(doc.Fields),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+
+	now := time.Now()
+
+	for _, f := range []struct {
+		name string
+		buf  []byte
+	}{
+		{INDEX_ARCHIVE_INDEX_DEF, indexDefBuf},
+		{INDEX_ARCHIVE_DOCS, docsBuf.Bytes()},
+	} {
+		err = tw.WriteHeader(&tar.Header{
+			Name:    f.name,
+			Mode:    0600,
+			Size:    int64(len(f.buf)),
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tw.Write(f.buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+
+	return gzw.Close()
+}
+
+// RestoreIndexArchive creates a new bleve index with a primary source
+// type from an index archive, and loads the archive's documents into
+// the new index, whose partitions must be assigned to this node.
+func RestoreIndexArchive(mgr *cbgt.Manager, indexName string,
+	r io.Reader) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("sample: could not read archive, err: %v", err)
+	}
+	defer gzr.Close()
+
+	var indexDef *cbgt.IndexDef
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("sample: could not read archive, err: %v",
+				err)
+		}
+
+		switch hdr.Name {
+		case INDEX_ARCHIVE_INDEX_DEF:
+			indexDef = &cbgt.IndexDef{}
+			err = json.NewDecoder(tr).Decode(indexDef)
+			if err != nil {
+				return fmt.Errorf("sample: could not parse archive"+
+					" index definition, err: %v", err)
+			}
+			if indexDef.Type != "bleve" {
+				return fmt.Errorf("sample: archive index definition"+
+					" is not a bleve index, type: %s", indexDef.Type)
+			}
+
+		case INDEX_ARCHIVE_DOCS:
+			if indexDef == nil {
+				return fmt.Errorf("sample: archive index definition" +
+					" must precede the archive docs")
+			}
+			return restoreIndexArchiveDocs(mgr, indexName,
+				indexDef.Params, tr)
+		}
+	}
+
+	return fmt.Errorf("sample: archive has no docs")
+}
+
+func restoreIndexArchiveDocs(mgr *cbgt.Manager, indexName,
+	indexParams string, r io.Reader) error {
+	err := sampleCreateIndex(mgr, indexName, indexParams, 1)
+	if err != nil {
+		return err
+	}
+
+	dests, err := sampleWaitDests(mgr, indexName)
+	if err != nil {
+		return err
+	}
+
+	partitions := materializePartitions(dests)
+
+	var seq uint64
+
+	muts := make([]*materializeMutation, 0, MaterializeBatchSize)
+
+	flush := func() error {
+		if len(muts) <= 0 {
+			return nil
+		}
+		err := materializeWrite(dests, partitions,
+			muts[0].seq, muts[len(muts)-1].seq, muts)
+		muts = muts[:0]
+		return err
+	}
+
+	dec := json.NewDecoder(r)
+	for {
+		var doc IndexArchiveDoc
+		err = dec.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("sample: could not parse archive doc,"+
+				" err: %v", err)
+		}
+
+		val, err := json.Marshal(doc.Doc)
+		if err != nil {
+			return err
+		}
+
+		seq++
+
+		muts = append(muts, &materializeMutation{
+			id:  doc.ID,
+			seq: seq,
+			val: val,
+		})
+
+		if len(muts) >= MaterializeBatchSize {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return flush()
+}
+
+// ---------------------------------------------------------
+
+// SampleHandler is a REST handler that creates a sample of an index.
+type SampleHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewSampleHandler(mgr *cbgt.Manager) *SampleHandler {
+	return &SampleHandler{mgr: mgr}
+}
+
+func (h *SampleHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("sample: could not read"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	sreq := &SampleRequest{}
+	err = json.Unmarshal(requestBody, sreq)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("sample: could not parse"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	err = Sample(h.mgr, indexName, sreq)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), IndexCreateErrorStatus(err, 400))
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+		Target string `json:"target"`
+	}{
+		Status: "ok",
+		Target: sreq.Target,
+	})
+}
+
+// IndexArchiveGetHandler is a REST handler that returns an archive
+// of an index.
+type IndexArchiveGetHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexArchiveGetHandler(mgr *cbgt.Manager) *IndexArchiveGetHandler {
+	return &IndexArchiveGetHandler{mgr: mgr}
+}
+
+func (h *IndexArchiveGetHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	var buf bytes.Buffer
+
+	err := WriteIndexArchive(h.mgr, indexName, &buf)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-gzip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", indexName+".tar.gz"))
+	w.Write(buf.Bytes())
+}
+
+// IndexArchiveRestoreHandler is a REST handler that creates an index
+// from an archive.
+type IndexArchiveRestoreHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexArchiveRestoreHandler(
+	mgr *cbgt.Manager) *IndexArchiveRestoreHandler {
+	return &IndexArchiveRestoreHandler{mgr: mgr}
+}
+
+func (h *IndexArchiveRestoreHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := mux.Vars(req)["indexName"]
+
+	err := RestoreIndexArchive(h.mgr, indexName, req.Body)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
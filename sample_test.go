@@ -0,0 +1,156 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestSampleParams(t *testing.T) {
+	for _, p := range []*SampleParams{
+		{Every: 4},
+		{Percent: 25},
+	} {
+		n := 0
+		for i := 0; i < 10000; i++ {
+			docID := fmt.Sprintf("doc-%d", i)
+			if p.Includes(docID) {
+				n++
+			}
+			if p.Includes(docID) != p.Includes(docID) {
+				t.Errorf("expected deterministic sample, docID: %s", docID)
+			}
+		}
+		if n < 2000 || n > 3000 {
+			t.Errorf("expected ~2500 sampled, got: %d, params: %#v", n, p)
+		}
+	}
+
+	for _, p := range []*SampleParams{
+		{},
+		{Percent: -1},
+		{Percent: 101},
+	} {
+		if p.validate() == nil {
+			t.Errorf("expected validate err, params: %#v", p)
+		}
+	}
+}
+
+func TestSampleAndArchive(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	err := mgr.CreateIndex("primary", "", "", `{"numPartitions":1}`,
+		"bleve", "src", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	sample := &SampleParams{Every: 3}
+	expected := uint64(0)
+
+	feeds, _ := mgr.CurrentMaps()
+	for _, feed := range feeds {
+		if feed.IndexName() != "src" {
+			continue
+		}
+		pf := feed.(*cbgt.PrimaryFeed)
+		pf.SnapshotStart("0", 1, 30)
+		for i := 1; i <= 30; i++ {
+			docID := fmt.Sprintf("doc-%d", i)
+			if sample.Includes(docID) {
+				expected++
+			}
+			pf.DataUpdate("0", []byte(docID), uint64(i),
+				[]byte(`{"name":"x","address":{"city":"sf"}}`),
+				0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+		}
+	}
+
+	err = Sample(mgr, "src", &SampleRequest{})
+	if err == nil {
+		t.Errorf("expected err on missing sample params")
+	}
+
+	err = Sample(mgr, "nope", &SampleRequest{SampleParams: *sample})
+	if err == nil {
+		t.Errorf("expected err on missing index")
+	}
+
+	sreq := &SampleRequest{SampleParams: *sample}
+
+	err = Sample(mgr, "src", sreq)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if sreq.Target != "src_sample" {
+		t.Errorf("expected default target, got: %s", sreq.Target)
+	}
+
+	var task *MaterializeTask
+	for i := 0; i < 100; i++ {
+		mts := &MaterializeTasks{}
+		CfgGetJSON(cfg, MATERIALIZE_TASKS_KEY, mts)
+		task = mts.Tasks["src_sample"]
+		if task != nil && task.Status != MATERIALIZE_RUNNING {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if task == nil || task.Status != MATERIALIZE_DONE ||
+		task.DocsCopied != 30 || task.DocsWritten != expected {
+		t.Fatalf("expected done task, got: %#v", task)
+	}
+
+	count, err := CountBlevePIndexImpl(mgr, "src_sample", "")
+	if err != nil || count != expected {
+		t.Errorf("expected %d docs in sample, got: %d, err: %v",
+			expected, count, err)
+	}
+
+	var buf bytes.Buffer
+
+	err = WriteIndexArchive(mgr, "src_sample", &buf)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	err = RestoreIndexArchive(mgr, "restored", bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	count, err = CountBlevePIndexImpl(mgr, "restored", "")
+	if err != nil || count != expected {
+		t.Errorf("expected %d docs restored, got: %d, err: %v",
+			expected, count, err)
+	}
+
+	err = RestoreIndexArchive(mgr, "bad", bytes.NewReader([]byte("x")))
+	if err == nil {
+		t.Errorf("expected err on a bad archive")
+	}
+}
@@ -0,0 +1,128 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/couchbase/clog"
+	"github.com/couchbase/go-couchbase"
+)
+
+// The default ports of a couchbase cluster manager, for server URL's
+// that don't have a port.
+var ServerURLDefaultPorts = map[string]string{
+	"http":  "8091",
+	"https": "18091",
+}
+
+// ServerURL normalizes the URL of a couchbase datasource server, where
+// a "couchbase://HOST" is "http://HOST:8091" and a "couchbases://HOST"
+// is "https://HOST:18091".  The "." server, meaning no datasource
+// server, is returned as is.
+func ServerURL(server string) (string, error) {
+	if server == "." {
+		return server, nil
+	}
+
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("server_tls: not a URL, server: %q", server)
+	}
+
+	switch u.Scheme {
+	case "couchbase":
+		u.Scheme = "http"
+	case "couchbases":
+		u.Scheme = "https"
+	case "http", "https":
+	default:
+		return "", fmt.Errorf("server_tls: unsupported scheme: %q,"+
+			" server: %q", u.Scheme, server)
+	}
+
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		u.Host = net.JoinHostPort(u.Host, ServerURLDefaultPorts[u.Scheme])
+	}
+
+	return u.String(), nil
+}
+
+// ServerTLSStart configures the TLS of the connections to an https
+// datasource server, which are the connections of the couchbase
+// client library, where server certificates are always verified.
+// The node options are "tlsCAFile", a PEM file of the CA's that are
+// trusted instead of the system's CA's, and "tlsCertFile" and
+// "tlsKeyFile", a PEM client certificate and key, for clusters that
+// require client certificates.
+func ServerTLSStart(server string, options map[string]string) error {
+	if !strings.HasPrefix(server, "https://") {
+		return nil
+	}
+
+	tlsConfig, err := ServerTLSConfig(options)
+	if err != nil {
+		return err
+	}
+
+	couchbase.HTTPClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: 256,
+		},
+	}
+
+	log.Printf("server_tls: enabled, tlsCAFile: %q, tlsCertFile: %q",
+		options["tlsCAFile"], options["tlsCertFile"])
+
+	return nil
+}
+
+// ServerTLSConfig returns the TLS config of the connections to the
+// datasource server, from the node options.
+func ServerTLSConfig(options map[string]string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if caFile := options["tlsCAFile"]; caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("server_tls: tlsCAFile, err: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("server_tls: no certificates in"+
+				" tlsCAFile: %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	certFile, keyFile := options["tlsCertFile"], options["tlsKeyFile"]
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("server_tls: tlsCertFile/tlsKeyFile,"+
+				" err: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,258 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The Cfg key where the cluster-wide cbft settings are kept.
+const CLUSTER_SETTINGS_KEY = "clusterSettings"
+
+// ClusterSettings holds cluster-wide cbft settings, which apply to
+// all nodes, as opposed to per-node cmd-line flags and options.
+type ClusterSettings struct {
+	// The default profile that selects an index definition's
+	// environment overlay, when the node has no profile option.
+	Profile string `json:"profile,omitempty"`
+
+	// The max fraction (0.0 to 1.0) of an index's mutations within
+	// the error budget window that may have ingest errors before the
+	// index is quarantined, where 0 means no quarantining.
+	IngestErrorBudget float64 `json:"ingestErrorBudget,omitempty"`
+
+	// The min number of mutations within the error budget window
+	// before the ingest error budget is enforced, where 0 means
+	// IngestErrorBudgetDefaultMinMutations.
+	IngestErrorBudgetMinMutations uint64 `json:"ingestErrorBudgetMinMutations,omitempty"`
+
+	// The duration beyond which a query is logged as slow, where 0
+	// means QueryLogDefaultSlowThreshold.
+	SlowQueryThresholdMS int64 `json:"slowQueryThresholdMS,omitempty"`
+
+	// Where each node exports its query log after each day, either an
+	// absolute directory path or a couchbase://HOST:PORT/BUCKET URL,
+	// where "" means no export.
+	QueryLogExport string `json:"queryLogExport,omitempty"`
+
+	// The capacity of each node, which the capacity guardrail checks
+	// index create/update requests against, where 0 means unlimited
+	// (see capacity.go).
+	CapacityPIndexesPerNode  int   `json:"capacityPIndexesPerNode,omitempty"`
+	CapacityDiskBytesPerNode int64 `json:"capacityDiskBytesPerNode,omitempty"`
+	CapacityMemBytesPerNode  int64 `json:"capacityMemBytesPerNode,omitempty"`
+
+	// Either CAPACITY_GUARDRAIL_REJECT or CAPACITY_GUARDRAIL_WARN,
+	// where "" means CAPACITY_GUARDRAIL_REJECT.
+	CapacityGuardrail string `json:"capacityGuardrail,omitempty"`
+}
+
+var clusterSettingsM sync.Mutex // Protects the fields that follow.
+
+// The node's cache of the cluster settings.
+var clusterSettings = &ClusterSettings{}
+
+// CfgGetClusterSettings returns the cluster settings, which will be
+// empty settings if they've never been set.
+func CfgGetClusterSettings(cfg cbgt.Cfg) (*ClusterSettings, uint64, error) {
+	rv := &ClusterSettings{}
+	cas, _, err := CfgGetJSON(cfg, CLUSTER_SETTINGS_KEY, rv)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rv, cas, nil
+}
+
+// ClusterSettingsWatchCfg loads the cluster settings and keeps the
+// node's cache of the cluster settings up to date with Cfg changes.
+func ClusterSettingsWatchCfg(cfg cbgt.Cfg) error {
+	ch := make(chan cbgt.CfgEvent, 1)
+
+	err := cfg.Subscribe(CLUSTER_SETTINGS_KEY, ch)
+	if err != nil {
+		return err
+	}
+
+	err = clusterSettingsRefresh(cfg)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for range ch {
+			err := clusterSettingsRefresh(cfg)
+			if err != nil {
+				log.Printf("settings: refresh, err: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func clusterSettingsRefresh(cfg cbgt.Cfg) error {
+	settings, _, err := CfgGetClusterSettings(cfg)
+	if err != nil {
+		return err
+	}
+
+	clusterSettingsM.Lock()
+	clusterSettings = settings
+	clusterSettingsM.Unlock()
+
+	return nil
+}
+
+// CurrentClusterSettings returns the node's cache of the cluster
+// settings, which callers must treat as immutable.
+func CurrentClusterSettings() *ClusterSettings {
+	clusterSettingsM.Lock()
+	rv := clusterSettings
+	clusterSettingsM.Unlock()
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// ClusterSettingsGetHandler is a REST handler that returns the
+// cluster settings.
+type ClusterSettingsGetHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewClusterSettingsGetHandler(
+	mgr *cbgt.Manager) *ClusterSettingsGetHandler {
+	return &ClusterSettingsGetHandler{mgr: mgr}
+}
+
+func (h *ClusterSettingsGetHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	settings, _, err := CfgGetClusterSettings(h.mgr.Cfg())
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("settings: could not"+
+			" retrieve cluster settings, err: %v", err), 500)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status   string           `json:"status"`
+		Settings *ClusterSettings `json:"settings"`
+	}{
+		Status:   "ok",
+		Settings: settings,
+	})
+}
+
+// validateClusterSettings checks the values of cluster settings.
+func validateClusterSettings(settings *ClusterSettings) error {
+	if settings.IngestErrorBudget < 0 || settings.IngestErrorBudget > 1 {
+		return fmt.Errorf("settings: ingestErrorBudget must be between"+
+			" 0 and 1, ingestErrorBudget: %v", settings.IngestErrorBudget)
+	}
+
+	if settings.SlowQueryThresholdMS < 0 {
+		return fmt.Errorf("settings: slowQueryThresholdMS must be >= 0")
+	}
+
+	if settings.QueryLogExport != "" {
+		_, _, err := parseQueryLogExport(settings.QueryLogExport)
+		if err != nil {
+			return err
+		}
+	}
+
+	if settings.CapacityPIndexesPerNode < 0 ||
+		settings.CapacityDiskBytesPerNode < 0 ||
+		settings.CapacityMemBytesPerNode < 0 {
+		return fmt.Errorf("settings: capacityPIndexesPerNode," +
+			" capacityDiskBytesPerNode and capacityMemBytesPerNode" +
+			" must be >= 0")
+	}
+
+	if settings.CapacityGuardrail != "" &&
+		settings.CapacityGuardrail != CAPACITY_GUARDRAIL_REJECT &&
+		settings.CapacityGuardrail != CAPACITY_GUARDRAIL_WARN {
+		return fmt.Errorf("settings: capacityGuardrail must be %q or %q",
+			CAPACITY_GUARDRAIL_REJECT, CAPACITY_GUARDRAIL_WARN)
+	}
+
+	return nil
+}
+
+// ClusterSettingsPutHandler is a REST handler that merges the JSON in
+// the request body into the cluster settings, so that the settings
+// that aren't in the request body keep their current values.
+type ClusterSettingsPutHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewClusterSettingsPutHandler(
+	mgr *cbgt.Manager) *ClusterSettingsPutHandler {
+	return &ClusterSettingsPutHandler{mgr: mgr}
+}
+
+func (h *ClusterSettingsPutHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("settings: could not read"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	// The request body is checked on its own first, so that a bad
+	// request doesn't need the Cfg.
+	err = json.Unmarshal(requestBody, &ClusterSettings{})
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("settings: could not parse"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	var errInvalid error
+
+	err = CfgUpdateJSON(h.mgr.Cfg(), CLUSTER_SETTINGS_KEY,
+		func() interface{} { return &ClusterSettings{} },
+		func(v interface{}) error {
+			settings := v.(*ClusterSettings)
+
+			err := json.Unmarshal(requestBody, settings)
+			if err == nil {
+				err = validateClusterSettings(settings)
+			}
+			errInvalid = err
+
+			return err
+		})
+	if errInvalid != nil {
+		rest.ShowError(w, req, errInvalid.Error(), 400)
+		return
+	}
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("settings: could not"+
+			" save cluster settings, err: %v", err), 500)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
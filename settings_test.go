@@ -0,0 +1,115 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestValidateClusterSettings(t *testing.T) {
+	tests := []struct {
+		settings *ClusterSettings
+		expErr   bool
+	}{
+		{&ClusterSettings{}, false},
+		{&ClusterSettings{IngestErrorBudget: 0.05}, false},
+		{&ClusterSettings{IngestErrorBudget: 1}, false},
+		{&ClusterSettings{IngestErrorBudget: -0.1}, true},
+		{&ClusterSettings{IngestErrorBudget: 1.5}, true},
+		{&ClusterSettings{SlowQueryThresholdMS: -1}, true},
+		{&ClusterSettings{CapacityPIndexesPerNode: -1}, true},
+		{&ClusterSettings{CapacityDiskBytesPerNode: -1}, true},
+		{&ClusterSettings{CapacityMemBytesPerNode: -1}, true},
+		{&ClusterSettings{CapacityGuardrail: "bogus"}, true},
+		{&ClusterSettings{CapacityGuardrail: CAPACITY_GUARDRAIL_WARN}, false},
+	}
+
+	for i, test := range tests {
+		err := validateClusterSettings(test.settings)
+		if (err != nil) != test.expErr {
+			t.Errorf("%d: expErr: %v, got err: %v", i, test.expErr, err)
+		}
+	}
+}
+
+func TestClusterSettingsPutHandler(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	mr, _ := cbgt.NewMsgRing(os.Stderr, 1000)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", mr)
+	if err != nil || router == nil {
+		t.Errorf("no mux router")
+	}
+
+	tests := []*RESTHandlerTest{
+		{
+			Desc:   "set the profile and ingest error budget",
+			Path:   "/api/settings",
+			Method: "PUT",
+			Body:   []byte(`{"profile":"dev","ingestErrorBudget":0.05}`),
+			Status: http.StatusOK,
+		},
+		{
+			Desc:   "set a capacity, keeping the other settings",
+			Path:   "/api/settings",
+			Method: "PUT",
+			Body:   []byte(`{"capacityPIndexesPerNode":100}`),
+			Status: http.StatusOK,
+		},
+		{
+			Desc:   "reject an out of range ingest error budget",
+			Path:   "/api/settings",
+			Method: "PUT",
+			Body:   []byte(`{"ingestErrorBudget":2}`),
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`ingestErrorBudget must be between 0 and 1`: true,
+			},
+		},
+		{
+			Desc:   "reject a negative capacity",
+			Path:   "/api/settings",
+			Method: "PUT",
+			Body:   []byte(`{"capacityMemBytesPerNode":-1}`),
+			Status: 400,
+		},
+		{
+			Desc:   "clear the profile",
+			Path:   "/api/settings",
+			Method: "PUT",
+			Body:   []byte(`{"profile":""}`),
+			Status: http.StatusOK,
+		},
+		{
+			Desc:   "get the merged cluster settings",
+			Path:   "/api/settings",
+			Method: "GET",
+			Status: http.StatusOK,
+			ResponseBody: []byte(`{"status":"ok","settings":` +
+				`{"ingestErrorBudget":0.05,"capacityPIndexesPerNode":100}}`),
+		},
+	}
+
+	testRESTHandlers(t, tests, router)
+}
@@ -0,0 +1,462 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The REST API is self-describing, where the RESTMeta of each route
+// is emitted as a Swagger 2.0 (OpenAPI) document, along with the
+// request/response schemas of index definitions and queries.
+
+// Schemas of the main request/response JSON documents, keyed by
+// "METHOD PATH", which are referenced from the spec's definitions.
+var SpecSchemaRefs = map[string]struct {
+	Request  string
+	Response string
+}{
+	"GET /api/index":                    {"", "IndexDefsResponse"},
+	"GET /api/index/{indexName}":        {"", "IndexDefResponse"},
+	"PUT /api/index/{indexName}":        {"IndexDefRequest", "StatusResponse"},
+	"DELETE /api/index/{indexName}":     {"", "StatusResponse"},
+	"POST /api/index/{indexName}/query": {"SearchRequest", "SearchResult"},
+	"GET /api/index/{indexName}/count":  {"", "CountResponse"},
+	"POST /api/index/{indexName}/count": {"SearchRequest", "CountResponse"},
+}
+
+// SpecDefinitions are the JSON schemas of the spec's definitions.
+var SpecDefinitions = map[string]interface{}{
+	"StatusResponse": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"status": specType("string"),
+		},
+	},
+	"CountResponse": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"status": specType("string"),
+			"count":  specType("integer"),
+		},
+	},
+	"PlanParams": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"maxPartitionsPerPIndex": specType("integer"),
+			"numReplicas":            specType("integer"),
+			"hierarchyRules":         specType("object"),
+			"nodePlanParams":         specType("object"),
+			"planFrozen":             specType("boolean"),
+		},
+	},
+	"IndexDef": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"type":         specType("string"),
+			"name":         specType("string"),
+			"uuid":         specType("string"),
+			"params":       specType("string"),
+			"sourceType":   specType("string"),
+			"sourceName":   specType("string"),
+			"sourceUUID":   specType("string"),
+			"sourceParams": specType("string"),
+			"planParams":   specRef("PlanParams"),
+		},
+	},
+	"IndexDefRequest": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"indexType":     specType("string"),
+			"indexParams":   specType("string"),
+			"sourceType":    specType("string"),
+			"sourceName":    specType("string"),
+			"sourceUUID":    specType("string"),
+			"sourceParams":  specType("string"),
+			"planParams":    specRef("PlanParams"),
+			"prevIndexUUID": specType("string"),
+			"profiles":      specType("object"),
+		},
+	},
+	"IndexDefResponse": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"status":   specType("string"),
+			"indexDef": specRef("IndexDef"),
+		},
+	},
+	"IndexDefsResponse": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"status": specType("string"),
+			"indexDefs": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"uuid":        specType("string"),
+					"implVersion": specType("string"),
+					"indexDefs": map[string]interface{}{
+						"type":                 "object",
+						"additionalProperties": specRef("IndexDef"),
+					},
+				},
+			},
+		},
+	},
+	"SearchRequest": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"ctl": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"timeout":            specType("integer"),
+					"consistency":        specType("object"),
+					"allowPartial":       specType("boolean"),
+					"globalScoring":      specType("boolean"),
+					"rescoreWindow":      specType("integer"),
+					"mergePolicy":        specType("string"),
+					"tieBreak":           specType("string"),
+					"queryStringDialect": specRef("QueryStringDialect"),
+					"analyzers":          specMap(specType("string")),
+					"rerank":             specType("boolean"),
+					"queryId":            specType("string"),
+				},
+			},
+			"query":     specType("object"),
+			"size":      specType("integer"),
+			"from":      specType("integer"),
+			"highlight": specType("object"),
+			"fields":    specArray(specType("string")),
+			"facets":    specMap(specRef("FacetRequest")),
+			"explain":   specType("boolean"),
+
+			"fetchFromKV":  specType("boolean"),
+			"aggregations": specMap(specRef("AggregationRequest")),
+			"collapse":     specRef("CollapseRequest"),
+			"group":        specRef("GroupRequest"),
+			"geoDistance":  specRef("GeoDistanceRequest"),
+		},
+		"required": []string{"query"},
+	},
+	"QueryStringDialect": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"defaultOperator": specType("string"),
+			"defaultFields":   specArray(specType("string")),
+			"disableFuzzy":    specType("boolean"),
+			"disableWildcard": specType("boolean"),
+			"disableRegexp":   specType("boolean"),
+		},
+	},
+	"FacetRequest": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"field":          specType("string"),
+			"size":           specType("integer"),
+			"terms":          specType("object"),
+			"numeric_ranges": specArray(specType("object")),
+			"date_ranges":    specArray(specType("object")),
+			"order":          specType("string"),
+			"offset":         specType("integer"),
+			"after":          specType("string"),
+			"cardinality":    specType("boolean"),
+			"missing":        specType("boolean"),
+			"missingTerm":    specType("string"),
+		},
+	},
+	"AggregationRequest": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"field": specType("string"),
+		},
+	},
+	"CollapseRequest": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"field":      specType("string"),
+			"window":     specType("integer"),
+			"groupCount": specType("boolean"),
+		},
+	},
+	"GroupRequest": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"field":  specType("string"),
+			"size":   specType("integer"),
+			"window": specType("integer"),
+		},
+	},
+	"GeoDistanceRequest": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"field":  specType("string"),
+			"origin": map[string]interface{}{},
+			"unit":   specType("string"),
+			"sort":   specType("string"),
+			"window": specType("integer"),
+		},
+	},
+	"SearchResult": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"request":    specRef("SearchRequest"),
+			"hits":       specArray(specType("object")),
+			"total_hits": specType("integer"),
+			"max_score":  specType("number"),
+			"took":       specType("integer"),
+			"facets":     specType("object"),
+			"warnings":   specArray(specType("string")),
+
+			"partial":        specType("boolean"),
+			"failedPIndexes": specMap(specType("string")),
+			"aggregations":   specMap(specType("object")),
+			"cardinalities":  specMap(specType("object")),
+			"facetPages":     specMap(specType("object")),
+			"collapse":       specType("object"),
+			"groups":         specType("object"),
+			"geoDistance":    specType("object"),
+		},
+	},
+}
+
+func specType(t string) map[string]interface{} {
+	return map[string]interface{}{"type": t}
+}
+
+func specRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/definitions/" + name}
+}
+
+func specArray(items interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+func specMap(values interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "object", "additionalProperties": values}
+}
+
+// OpenAPISpec returns a Swagger 2.0 document of the REST API routes
+// in the meta.
+func OpenAPISpec(versionMain string,
+	meta map[string]rest.RESTMeta) map[string]interface{} {
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	paths := map[string]interface{}{}
+
+	for _, key := range keys {
+		m := meta[key]
+		if m.Opts != nil && m.Opts["_status"] == "private" {
+			continue
+		}
+
+		op := map[string]interface{}{
+			"operationId": m.Method + " " + m.Path,
+			"produces":    []string{"application/json"},
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{"description": "success"},
+				"400": map[string]interface{}{"description": "bad request"},
+				"500": map[string]interface{}{"description": "server error"},
+			},
+		}
+
+		if m.Opts != nil {
+			if about := m.Opts["_about"]; about != "" {
+				about = strings.Join(strings.Fields(about), " ")
+				op["summary"] = about
+				if i := strings.Index(about, ". "); i > 0 {
+					op["summary"] = about[:i+1]
+				}
+				op["description"] = about
+			}
+
+			if category := m.Opts["_category"]; category != "" {
+				op["tags"] = []string{category}
+			}
+
+			if v := m.Opts["version introduced"]; v != "" {
+				op["x-version-introduced"] = v
+			}
+		}
+
+		params := specParams(m.Opts)
+
+		refs := SpecSchemaRefs[m.Method+" "+m.Path]
+		if refs.Request != "" {
+			params = append(params, map[string]interface{}{
+				"name":     "body",
+				"in":       "body",
+				"required": false,
+				"schema":   specRef(refs.Request),
+			})
+		}
+		if refs.Response != "" {
+			op["responses"].(map[string]interface{})["200"] =
+				map[string]interface{}{
+					"description": "success",
+					"schema":      specRef(refs.Response),
+				}
+		}
+
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		// Swagger path templates don't have mux's regexps, like
+		// "{path:.*}".
+		path := specPathVarRE.ReplaceAllString(m.Path, "{$1}")
+
+		pathItem, exists := paths[path].(map[string]interface{})
+		if !exists {
+			pathItem = map[string]interface{}{}
+			paths[path] = pathItem
+		}
+		pathItem[strings.ToLower(m.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"swagger": "2.0",
+		"info": map[string]interface{}{
+			"title": "cbft REST API",
+			"description": "The REST API of cbft, the couchbase full-text" +
+				" server.  Every path is also available with an" +
+				" " + API_V1_PREFIX + " prefix instead of /api.",
+			"version": versionMain,
+		},
+		"basePath":    "/",
+		"consumes":    []string{"application/json"},
+		"produces":    []string{"application/json"},
+		"paths":       paths,
+		"definitions": SpecDefinitions,
+	}
+}
+
+var specPathVarRE = regexp.MustCompile(`\{(\w+):[^}]*\}`)
+
+// specParams converts the "param: NAME" entries of a RESTMeta's
+// opts, whose values look like...
+//
+//	"required, string, URL path parameter\n\nDescription..."
+//
+// into Swagger parameters.
+func specParams(opts map[string]string) []interface{} {
+	var names []string
+	for k := range opts {
+		if strings.HasPrefix(k, "param: ") {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	var rv []interface{}
+
+	for _, k := range names {
+		v := opts[k]
+
+		desc := ""
+		if i := strings.Index(v, "\n\n"); i >= 0 {
+			v, desc = v[:i], strings.TrimSpace(v[i+2:])
+		}
+
+		parts := specSplitTopLevel(v)
+		if len(parts) < 3 {
+			continue
+		}
+
+		in := ""
+		location := strings.ToLower(parts[len(parts)-1])
+		switch {
+		case strings.Contains(location, "path"):
+			in = "path"
+		case strings.Contains(location, "query"):
+			in = "query"
+		case strings.Contains(location, "form"):
+			in = "formData"
+		case strings.Contains(location, "header"):
+			in = "header"
+		default:
+			continue
+		}
+
+		t := "string"
+		typeParts := strings.Fields(parts[1])
+		if len(typeParts) > 0 {
+			switch typeParts[0] {
+			case "integer", "number", "boolean":
+				t = typeParts[0]
+			}
+		}
+
+		p := map[string]interface{}{
+			"name": strings.TrimPrefix(k, "param: "),
+			"in":   in,
+			"type": t,
+			"required": in == "path" ||
+				strings.HasPrefix(parts[0], "required"),
+		}
+		if desc != "" {
+			p["description"] = desc
+		}
+
+		rv = append(rv, p)
+	}
+
+	return rv
+}
+
+// specSplitTopLevel splits a string by commas that aren't within
+// parentheses, trimming spaces.
+func specSplitTopLevel(s string) []string {
+	var rv []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				rv = append(rv, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(rv, strings.TrimSpace(s[start:]))
+}
+
+// ---------------------------------------------------------
+
+// SpecHandler is a REST handler that returns the Swagger 2.0
+// (OpenAPI) document of the REST API.
+type SpecHandler struct {
+	versionMain string
+	meta        map[string]rest.RESTMeta
+}
+
+func NewSpecHandler(versionMain string,
+	meta map[string]rest.RESTMeta) *SpecHandler {
+	return &SpecHandler{versionMain: versionMain, meta: meta}
+}
+
+func (h *SpecHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	rest.MustEncode(w, OpenAPISpec(h.versionMain, h.meta))
+}
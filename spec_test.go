@@ -0,0 +1,127 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+func TestSpecSplitTopLevel(t *testing.T) {
+	actual := specSplitTopLevel("optional (depends on a, b), string (JSON)," +
+		" form parameter")
+	expected := []string{"optional (depends on a, b)", "string (JSON)",
+		"form parameter"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected: %#v, got: %#v", expected, actual)
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	meta := map[string]rest.RESTMeta{
+		"/api/index/{indexName} PUT": {
+			Path:   "/api/index/{indexName}",
+			Method: "PUT",
+			Opts: map[string]string{
+				"_category": "Indexing|Index definition",
+				"_about":    "Creates an index.  More text.",
+				"param: indexName": "required, string, URL path parameter\n\n" +
+					"The name of the index.",
+				"param: planParams": "optional, string (JSON), form parameter",
+			},
+		},
+		"/api/secret GET": {
+			Path:   "/api/secret",
+			Method: "GET",
+			Opts:   map[string]string{"_status": "private"},
+		},
+	}
+
+	spec := OpenAPISpec("v0", meta)
+
+	paths := spec["paths"].(map[string]interface{})
+	if len(paths) != 1 {
+		t.Fatalf("expected only the public path, got: %#v", paths)
+	}
+
+	op := paths["/api/index/{indexName}"].(map[string]interface{})["put"].(map[string]interface{})
+	if op["summary"] != "Creates an index." {
+		t.Errorf("expected summary, got: %#v", op["summary"])
+	}
+
+	params := op["parameters"].([]interface{})
+	if len(params) != 3 {
+		t.Fatalf("expected 3 params, got: %#v", params)
+	}
+	p0 := params[0].(map[string]interface{})
+	if p0["name"] != "indexName" || p0["in"] != "path" ||
+		p0["required"] != true || p0["description"] != "The name of the index." {
+		t.Errorf("unexpected param: %#v", p0)
+	}
+	p1 := params[1].(map[string]interface{})
+	if p1["name"] != "planParams" || p1["in"] != "formData" ||
+		p1["required"] != false {
+		t.Errorf("unexpected param: %#v", p1)
+	}
+	p2 := params[2].(map[string]interface{})
+	if p2["in"] != "body" {
+		t.Errorf("expected body param, got: %#v", p2)
+	}
+}
+
+func TestSpecHandler(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+
+	mr, _ := cbgt.NewMsgRing(os.Stderr, 1000)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", mr)
+	if err != nil || router == nil {
+		t.Errorf("no mux router")
+	}
+
+	tests := []*RESTHandlerTest{
+		{
+			Desc:   "spec",
+			Path:   "/api/spec",
+			Method: "GET",
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"swagger":"2.0"`:                     true,
+				`"/api/index/{indexName}/query":{`:    true,
+				`"/api/spec":{`:                       true,
+				`"$ref":"#/definitions/SearchResult"`: true,
+			},
+		},
+	}
+
+	testRESTHandlers(t, tests, router)
+}
+
+func TestSpecSearchRequestFields(t *testing.T) {
+	props := SpecDefinitions["SearchRequest"].(map[string]interface{})["properties"].(map[string]interface{})
+	for name := range QueryRequestFields {
+		if props[name] == nil {
+			t.Errorf("expected the SearchRequest schema to have: %s", name)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The timeout for retrieving the stats of a node for the cluster
+// stats.
+var ClusterStatsTimeout = 5 * time.Second
+
+const CLUSTER_STATS_NODE_OK = "ok"
+const CLUSTER_STATS_NODE_UNREACHABLE = "unreachable"
+
+// ClusterStats represents the per-index stats of the whole cluster,
+// which are the sums of the /api/nsstats of every node.
+type ClusterStats struct {
+	Nodes map[string]*ClusterStatsNode `json:"nodes"` // Keyed by node UUID.
+
+	// Keyed by index name, then by stat name.
+	Indexes map[string]map[string]float64 `json:"indexes"`
+}
+
+type ClusterStatsNode struct {
+	HostPort string `json:"hostPort"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ClusterStatsFetchNode retrieves the /api/nsstats of a node, and is
+// a var so that tests can override it.
+var ClusterStatsFetchNode = func(hostPort string) (
+	map[string]interface{}, error) {
+	client := &http.Client{
+		Transport: NodeHTTPClient.Transport,
+		Timeout:   ClusterStatsTimeout,
+	}
+	resp, err := client.Get(NodeURL(hostPort) + "/api/nsstats")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("stats_cluster: node: %s,"+
+			" status code: %d", hostPort, resp.StatusCode)
+	}
+
+	var rv map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&rv)
+	if err != nil {
+		return nil, fmt.Errorf("stats_cluster: node: %s, could not"+
+			" parse stats, err: %v", hostPort, err)
+	}
+	return rv, nil
+}
+
+// addNsStats adds the numeric per-index stats of a node's
+// /api/nsstats, whose keys are like "SOURCE_NAME:INDEX_NAME:STAT", to
+// per-index sums.  Node-level stats (without an index name) aren't
+// summed.
+func addNsStats(sums map[string]map[string]float64,
+	nsStats map[string]interface{}) {
+	for k, v := range nsStats {
+		f, ok := v.(float64)
+		if !ok {
+			continue
+		}
+		parts := strings.Split(k, ":")
+		if len(parts) < 3 {
+			continue
+		}
+		indexName := parts[len(parts)-2]
+		stat := parts[len(parts)-1]
+
+		m := sums[indexName]
+		if m == nil {
+			m = map[string]float64{}
+			sums[indexName] = m
+		}
+		m[stat] += f
+	}
+}
+
+// CalcClusterStats retrieves the stats of every node in parallel and
+// aggregates them, marking the nodes whose stats couldn't be
+// retrieved as unreachable.
+func CalcClusterStats(nodeDefs *cbgt.NodeDefs) *ClusterStats {
+	rv := &ClusterStats{
+		Nodes:   map[string]*ClusterStatsNode{},
+		Indexes: map[string]map[string]float64{},
+	}
+	if nodeDefs == nil {
+		return rv
+	}
+
+	var m sync.Mutex
+	var wg sync.WaitGroup
+
+	for uuid, nodeDef := range nodeDefs.NodeDefs {
+		wg.Add(1)
+		go func(uuid, hostPort string) {
+			defer wg.Done()
+
+			nsStats, err := ClusterStatsFetchNode(hostPort)
+
+			m.Lock()
+			defer m.Unlock()
+
+			node := &ClusterStatsNode{
+				HostPort: hostPort,
+				Status:   CLUSTER_STATS_NODE_OK,
+			}
+			rv.Nodes[uuid] = node
+
+			if err != nil {
+				node.Status = CLUSTER_STATS_NODE_UNREACHABLE
+				node.Error = err.Error()
+				return
+			}
+
+			addNsStats(rv.Indexes, nsStats)
+		}(uuid, nodeDef.HostPort)
+	}
+
+	wg.Wait()
+
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// ClusterStatsHandler is a REST handler that returns the per-index
+// stats of the whole cluster.
+type ClusterStatsHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewClusterStatsHandler(mgr *cbgt.Manager) *ClusterStatsHandler {
+	return &ClusterStatsHandler{mgr: mgr}
+}
+
+func (h *ClusterStatsHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	nodeDefs, _, err := cbgt.CfgGetNodeDefs(h.mgr.Cfg(),
+		cbgt.NODE_DEFS_WANTED)
+	if err != nil {
+		rest.ShowError(w, req, "could not retrieve node defs (wanted)", 500)
+		return
+	}
+
+	stats := CalcClusterStats(nodeDefs)
+
+	numUnreachable := 0
+	for _, node := range stats.Nodes {
+		if node.Status != CLUSTER_STATS_NODE_OK {
+			numUnreachable++
+		}
+	}
+
+	rest.MustEncode(w, struct {
+		Status         string `json:"status"`
+		NumNodes       int    `json:"numNodes"`
+		NumUnreachable int    `json:"numUnreachable"`
+		*ClusterStats
+	}{
+		Status:         "ok",
+		NumNodes:       len(stats.Nodes),
+		NumUnreachable: numUnreachable,
+		ClusterStats:   stats,
+	})
+}
@@ -0,0 +1,64 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestCalcClusterStats(t *testing.T) {
+	prevFetch := ClusterStatsFetchNode
+	defer func() { ClusterStatsFetchNode = prevFetch }()
+
+	ClusterStatsFetchNode = func(hostPort string) (
+		map[string]interface{}, error) {
+		if hostPort == "down:8095" {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return map[string]interface{}{
+			"beer-sample:beers:doc_count":    float64(100),
+			"beer-sample:beers:num_pindexes": float64(2),
+			"default:other:doc_count":        float64(5),
+			"num_connections":                float64(0),
+			"needs_restart":                  false,
+		}, nil
+	}
+
+	stats := CalcClusterStats(&cbgt.NodeDefs{
+		NodeDefs: map[string]*cbgt.NodeDef{
+			"n0": {UUID: "n0", HostPort: "a:8095"},
+			"n1": {UUID: "n1", HostPort: "b:8095"},
+			"n2": {UUID: "n2", HostPort: "down:8095"},
+		},
+	})
+
+	if len(stats.Nodes) != 3 ||
+		stats.Nodes["n0"].Status != CLUSTER_STATS_NODE_OK ||
+		stats.Nodes["n2"].Status != CLUSTER_STATS_NODE_UNREACHABLE ||
+		stats.Nodes["n2"].Error == "" {
+		t.Errorf("unexpected nodes: %#v", stats.Nodes)
+	}
+	if len(stats.Indexes) != 2 ||
+		stats.Indexes["beers"]["doc_count"] != 200 ||
+		stats.Indexes["beers"]["num_pindexes"] != 4 ||
+		stats.Indexes["other"]["doc_count"] != 10 {
+		t.Errorf("unexpected index stats: %#v", stats.Indexes)
+	}
+
+	stats = CalcClusterStats(nil)
+	if len(stats.Nodes) != 0 || len(stats.Indexes) != 0 {
+		t.Errorf("expected empty stats without nodes")
+	}
+}
@@ -0,0 +1,363 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blevesearch/bleve"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// The stats history is a rolling, in-memory history of the key stats
+// of the indexes on a node, sampled periodically, so that charts can
+// be drawn without an external time-series database.  The sampling
+// is configured with node options (the -options command-line flag)...
+//
+//   statsHistoryIntervalSecs - seconds between samples (default 10).
+//   statsHistoryMaxSamples - samples that are kept (default 2160).
+//   statsHistoryPersist - "true" to also keep the history in the
+//     node's data directory, so it survives restarts.
+
+// The defaults of the stats history node options.
+var StatsHistoryDefaultInterval = 10 * time.Second
+var StatsHistoryDefaultMaxSamples = 2160 // 6 hours at 10 secs.
+
+// How often a persisted stats history is written to disk.
+var StatsHistoryPersistInterval = time.Minute
+
+// The file name of a persisted stats history, in the data directory.
+const STATS_HISTORY_FILE = "cbft-stats-history.json"
+
+// StatsSample is a sample of the key stats of the indexes on a node.
+type StatsSample struct {
+	Time    time.Time                    `json:"time"`
+	Indexes map[string]*StatsSampleIndex `json:"indexes"` // Keyed by index name.
+}
+
+// StatsSampleIndex is a sample of the key stats of an index, where
+// rates are per second over the interval since the previous sample.
+type StatsSampleIndex struct {
+	QueryRate         float64 `json:"queryRate"`
+	QueryErrorRate    float64 `json:"queryErrorRate"`
+	QueryAvgLatencyMS float64 `json:"queryAvgLatencyMS"`
+	IngestRate        float64 `json:"ingestRate"`
+	DocCount          uint64  `json:"docCount"`
+}
+
+// statsHistoryRaw holds the cumulative counters that samples are
+// computed from.
+type statsHistoryRaw struct {
+	Time      time.Time
+	QueryDate string
+	Queries   map[string]QueryRollup // Keyed by index name.
+	Mutations map[string]uint64      // Keyed by index name.
+	DocCounts map[string]uint64      // Keyed by index name.
+}
+
+var statsHistoryM sync.Mutex // Protects the fields that follow.
+
+var statsHistory []*StatsSample
+var statsHistoryMaxSamples = StatsHistoryDefaultMaxSamples
+
+// collectStatsHistoryRaw retrieves the cumulative counters of the
+// indexes on a node.
+func collectStatsHistoryRaw(mgr *cbgt.Manager, now time.Time) *statsHistoryRaw {
+	raw := &statsHistoryRaw{
+		Time:      now,
+		Mutations: map[string]uint64{},
+		DocCounts: map[string]uint64{},
+	}
+
+	raw.QueryDate, raw.Queries = CurrentQueryRollups(mgr.UUID())
+
+	_, pindexes := mgr.CurrentMaps()
+	for _, pindex := range pindexes {
+		if df, ok := pindex.Dest.(*cbgt.DestForwarder); ok {
+			if bdest, ok := df.DestProvider.(*BleveDest); ok {
+				raw.Mutations[pindex.IndexName] +=
+					atomic.LoadUint64(&bdest.mutations)
+			}
+		}
+
+		if bindex, ok := pindex.Impl.(bleve.Index); ok && bindex != nil {
+			n, err := bindex.DocCount()
+			if err == nil {
+				raw.DocCounts[pindex.IndexName] += n
+			}
+		}
+	}
+
+	return raw
+}
+
+// calcStatsSample computes a sample from the cumulative counters of
+// the previous and current sampling, where counters that went
+// backwards (such as after a pindex restart or at the end of a query
+// log day) are counted from zero.
+func calcStatsSample(prev, cur *statsHistoryRaw) *StatsSample {
+	secs := cur.Time.Sub(prev.Time).Seconds()
+	if secs <= 0 {
+		secs = 1
+	}
+
+	delta := func(prev, cur uint64) uint64 {
+		if cur < prev {
+			return cur
+		}
+		return cur - prev
+	}
+
+	sample := &StatsSample{
+		Time:    cur.Time,
+		Indexes: map[string]*StatsSampleIndex{},
+	}
+
+	get := func(indexName string) *StatsSampleIndex {
+		s := sample.Indexes[indexName]
+		if s == nil {
+			s = &StatsSampleIndex{}
+			sample.Indexes[indexName] = s
+		}
+		return s
+	}
+
+	for indexName, q := range cur.Queries {
+		p := QueryRollup{}
+		if prev.QueryDate == cur.QueryDate {
+			p = prev.Queries[indexName]
+		}
+
+		count := delta(p.Count, q.Count)
+		s := get(indexName)
+		s.QueryRate = float64(count) / secs
+		s.QueryErrorRate = float64(delta(p.Errors, q.Errors)) / secs
+		if count > 0 {
+			s.QueryAvgLatencyMS =
+				float64(delta(p.TotalMS, q.TotalMS)) / float64(count)
+		}
+	}
+
+	for indexName, n := range cur.Mutations {
+		get(indexName).IngestRate =
+			float64(delta(prev.Mutations[indexName], n)) / secs
+	}
+
+	for indexName, n := range cur.DocCounts {
+		get(indexName).DocCount = n
+	}
+
+	return sample
+}
+
+// statsHistoryAdd appends a sample to the stats history, dropping
+// the oldest samples beyond the max.
+func statsHistoryAdd(sample *StatsSample) {
+	statsHistoryM.Lock()
+	statsHistory = append(statsHistory, sample)
+	if len(statsHistory) > statsHistoryMaxSamples {
+		statsHistory = append([]*StatsSample(nil),
+			statsHistory[len(statsHistory)-statsHistoryMaxSamples:]...)
+	}
+	statsHistoryM.Unlock()
+}
+
+// StatsHistorySince returns the samples of the stats history that
+// are after a time, optionally only for a single index.
+func StatsHistorySince(since time.Time, indexName string) []*StatsSample {
+	statsHistoryM.Lock()
+	defer statsHistoryM.Unlock()
+
+	rv := []*StatsSample{}
+	for _, sample := range statsHistory {
+		if !sample.Time.After(since) {
+			continue
+		}
+		if indexName != "" {
+			s := sample.Indexes[indexName]
+			if s == nil {
+				continue
+			}
+			sample = &StatsSample{
+				Time:    sample.Time,
+				Indexes: map[string]*StatsSampleIndex{indexName: s},
+			}
+		}
+		rv = append(rv, sample)
+	}
+	return rv
+}
+
+// StatsHistoryStart starts the goroutine that samples the stats
+// history of a node, per the node's options.
+func StatsHistoryStart(mgr *cbgt.Manager) error {
+	options := mgr.Options()
+
+	interval := StatsHistoryDefaultInterval
+	if v := options["statsHistoryIntervalSecs"]; v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			return fmt.Errorf("stats_history: bad"+
+				" statsHistoryIntervalSecs: %q", v)
+		}
+		interval = time.Duration(secs) * time.Second
+	}
+
+	maxSamples := StatsHistoryDefaultMaxSamples
+	if v := options["statsHistoryMaxSamples"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("stats_history: bad"+
+				" statsHistoryMaxSamples: %q", v)
+		}
+		maxSamples = n
+	}
+
+	path := ""
+	if options["statsHistoryPersist"] == "true" {
+		path = filepath.Join(mgr.DataDir(), STATS_HISTORY_FILE)
+
+		err := statsHistoryLoad(path)
+		if err != nil {
+			log.Printf("stats_history: could not load, path: %s, err: %v",
+				path, err)
+		}
+	}
+
+	statsHistoryM.Lock()
+	statsHistoryMaxSamples = maxSamples
+	statsHistoryM.Unlock()
+
+	go func() {
+		prev := collectStatsHistoryRaw(mgr, time.Now())
+		lastPersist := time.Now()
+
+		for {
+			time.Sleep(interval)
+
+			cur := collectStatsHistoryRaw(mgr, time.Now())
+			statsHistoryAdd(calcStatsSample(prev, cur))
+			prev = cur
+
+			if path != "" && time.Since(lastPersist) >= StatsHistoryPersistInterval {
+				err := statsHistorySave(path)
+				if err != nil {
+					log.Printf("stats_history: could not save,"+
+						" path: %s, err: %v", path, err)
+				}
+				lastPersist = time.Now()
+			}
+		}
+	}()
+
+	return nil
+}
+
+func statsHistoryLoad(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var samples []*StatsSample
+	err = json.Unmarshal(buf, &samples)
+	if err != nil {
+		return err
+	}
+
+	statsHistoryM.Lock()
+	statsHistory = samples
+	statsHistoryM.Unlock()
+
+	return nil
+}
+
+func statsHistorySave(path string) error {
+	statsHistoryM.Lock()
+	buf, err := json.Marshal(statsHistory)
+	statsHistoryM.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path+".tmp", buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ---------------------------------------------------------
+
+// StatsHistoryHandler is a REST handler that returns the stats
+// history of a node.
+type StatsHistoryHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewStatsHistoryHandler(mgr *cbgt.Manager) *StatsHistoryHandler {
+	return &StatsHistoryHandler{mgr: mgr}
+}
+
+func (h *StatsHistoryHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	since := time.Time{}
+	if v := req.FormValue("since"); v != "" {
+		t, err := parseStatsHistorySince(v, time.Now())
+		if err != nil {
+			rest.ShowError(w, req, err.Error(), 400)
+			return
+		}
+		since = t
+	}
+
+	rest.MustEncode(w, struct {
+		Status  string         `json:"status"`
+		Samples []*StatsSample `json:"samples"`
+	}{
+		Status:  "ok",
+		Samples: StatsHistorySince(since, req.FormValue("indexName")),
+	})
+}
+
+// parseStatsHistorySince parses a since param, which is either an
+// RFC 3339 time or a duration before now, like "15m".
+func parseStatsHistorySince(v string, now time.Time) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err == nil {
+		return t, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+
+	return time.Time{}, fmt.Errorf("stats_history: bad since: %q, must be"+
+		" an RFC 3339 time or a duration, like \"15m\"", v)
+}
@@ -0,0 +1,129 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCalcStatsSample(t *testing.T) {
+	t0 := time.Date(2015, 6, 30, 12, 0, 0, 0, time.UTC)
+
+	prev := &statsHistoryRaw{
+		Time:      t0,
+		QueryDate: "2015-06-30",
+		Queries: map[string]QueryRollup{
+			"idx": {Count: 100, Errors: 1, TotalMS: 1000},
+		},
+		Mutations: map[string]uint64{"idx": 500},
+		DocCounts: map[string]uint64{"idx": 10},
+	}
+	cur := &statsHistoryRaw{
+		Time:      t0.Add(10 * time.Second),
+		QueryDate: "2015-06-30",
+		Queries: map[string]QueryRollup{
+			"idx": {Count: 120, Errors: 3, TotalMS: 1400},
+		},
+		Mutations: map[string]uint64{"idx": 600, "new": 50},
+		DocCounts: map[string]uint64{"idx": 20},
+	}
+
+	s := calcStatsSample(prev, cur)
+	idx := s.Indexes["idx"]
+	if idx == nil || idx.QueryRate != 2 || idx.QueryErrorRate != 0.2 ||
+		idx.QueryAvgLatencyMS != 20 || idx.IngestRate != 10 ||
+		idx.DocCount != 20 {
+		t.Errorf("unexpected sample: %#v", idx)
+	}
+	if s.Indexes["new"] == nil || s.Indexes["new"].IngestRate != 5 {
+		t.Errorf("expected a new index, got: %#v", s.Indexes["new"])
+	}
+
+	// A new query log day starts its counters from zero.
+	cur.QueryDate = "2015-07-01"
+	cur.Queries = map[string]QueryRollup{"idx": {Count: 10, TotalMS: 50}}
+	s = calcStatsSample(prev, cur)
+	if s.Indexes["idx"].QueryRate != 1 ||
+		s.Indexes["idx"].QueryAvgLatencyMS != 5 {
+		t.Errorf("unexpected sample after a new day: %#v", s.Indexes["idx"])
+	}
+}
+
+func TestStatsHistory(t *testing.T) {
+	prevHistory, prevMax := statsHistory, statsHistoryMaxSamples
+	defer func() {
+		statsHistory, statsHistoryMaxSamples = prevHistory, prevMax
+	}()
+
+	statsHistory = nil
+	statsHistoryMaxSamples = 2
+
+	t0 := time.Date(2015, 6, 30, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		statsHistoryAdd(&StatsSample{
+			Time: t0.Add(time.Duration(i) * time.Minute),
+			Indexes: map[string]*StatsSampleIndex{
+				"a": {DocCount: uint64(i)},
+				"b": {DocCount: uint64(i)},
+			},
+		})
+	}
+
+	samples := StatsHistorySince(time.Time{}, "")
+	if len(samples) != 2 || samples[0].Indexes["a"].DocCount != 1 {
+		t.Errorf("expected the 2 newest samples, got: %#v", samples)
+	}
+
+	samples = StatsHistorySince(t0.Add(time.Minute), "b")
+	if len(samples) != 1 || len(samples[0].Indexes) != 1 ||
+		samples[0].Indexes["b"].DocCount != 2 {
+		t.Errorf("expected 1 sample of index b, got: %#v", samples)
+	}
+
+	dir, _ := ioutil.TempDir("", "cbft-stats-history")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, STATS_HISTORY_FILE)
+
+	err := statsHistorySave(path)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	statsHistory = nil
+	err = statsHistoryLoad(path)
+	if err != nil || len(statsHistory) != 2 {
+		t.Errorf("expected a loaded history, got: %d, err: %v",
+			len(statsHistory), err)
+	}
+}
+
+func TestParseStatsHistorySince(t *testing.T) {
+	now := time.Date(2015, 6, 30, 12, 0, 0, 0, time.UTC)
+
+	since, err := parseStatsHistorySince("15m", now)
+	if err != nil || !since.Equal(now.Add(-15*time.Minute)) {
+		t.Errorf("expected a duration, got: %v, err: %v", since, err)
+	}
+
+	since, err = parseStatsHistorySince("2015-06-30T11:00:00Z", now)
+	if err != nil || !since.Equal(now.Add(-time.Hour)) {
+		t.Errorf("expected a time, got: %v, err: %v", since, err)
+	}
+
+	_, err = parseStatsHistorySince("yesterday", now)
+	if err == nil {
+		t.Errorf("expected err on a bad since")
+	}
+}
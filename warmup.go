@@ -0,0 +1,323 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// On startup, the manager opens the pindexes of its data directory
+// one after another, so a node with hundreds of pindexes takes
+// minutes to become queryable, and the first queries of each pindex
+// then pay for its cold caches.
+//
+// So, the bleve pindexes are instead pre-opened by a bounded pool of
+// "pindexLoadWorkers" (a node option), concurrently with the
+// manager's startup, where the pindexes of indexes with a
+// "loadPriority" of "high" in their params are opened first.  When
+// the manager opens a pindex, it claims the pre-opened pindex,
+// waiting for it if it's still being opened, or opens the pindex
+// itself if no worker has started on it yet.
+//
+// With the "warmup=true" node option, the "warmupQueries" of each
+// index's params are also run against each of its pindexes.
+
+// The load priorities of pindexes, from the "loadPriority" of the
+// index params, where lower values are opened first.
+var PIndexLoadPriorities = map[string]int{
+	"high": 0,
+	"":     1,
+	"low":  2,
+}
+
+const (
+	warmupPending = iota // Not yet started by a worker.
+	warmupOpening
+	warmupOpened
+	warmupTaken // Taken by the manager before a worker started on it.
+)
+
+// A warmedPIndex tracks a pindex that's pre-opened by the workers.
+type warmedPIndex struct {
+	path     string
+	priority int
+	params   *BleveParams
+	doneCh   chan struct{} // Closed when the opening is done.
+
+	// Protected by warmupM.
+	state  int
+	bindex bleve.Index
+	dest   *BleveDest
+	err    error
+}
+
+var warmupM sync.Mutex
+var warmupPIndexes = map[string]*warmedPIndex{} // Keyed by clean path.
+var warmupWG sync.WaitGroup
+
+// WarmupEnabled returns true when the node options ask for warmup.
+func WarmupEnabled(options map[string]string) bool {
+	return options["warmup"] == "true"
+}
+
+// PIndexLoadWorkers returns the number of workers that open the
+// pindexes at startup, from the "pindexLoadWorkers" node option,
+// which defaults to the number of CPU's.  A value of 1 or less means
+// the pindexes are opened serially by the manager, unless warmup is
+// enabled.
+func PIndexLoadWorkers(options map[string]string) int {
+	n, err := strconv.Atoi(options["pindexLoadWorkers"])
+	if err != nil {
+		return runtime.NumCPU()
+	}
+	return n
+}
+
+type warmedPIndexes []*warmedPIndex
+
+func (a warmedPIndexes) Len() int      { return len(a) }
+func (a warmedPIndexes) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a warmedPIndexes) Less(i, j int) bool {
+	if a[i].priority != a[j].priority {
+		return a[i].priority < a[j].priority
+	}
+	return a[i].path < a[j].path
+}
+
+// WarmupPIndexes starts pre-opening the bleve pindexes of a data
+// directory, in priority order, with a bounded pool of workers, and
+// optionally runs their warmup queries.  It must be invoked before
+// the manager is started, so that the pindexes aren't in use, and it
+// returns without waiting for the pindexes to be opened.
+func WarmupPIndexes(dataDir string, workers int, queries bool) error {
+	paths, err := filepath.Glob(filepath.Join(dataDir, "*.pindex"))
+	if err != nil {
+		return err
+	}
+
+	var todo warmedPIndexes
+
+	for _, path := range paths {
+		w, err := newWarmedPIndex(path)
+		if err != nil {
+			log.Printf("warmup: skipped pindex, path: %s, err: %v",
+				path, err)
+			continue
+		}
+		todo = append(todo, w)
+	}
+
+	sort.Sort(todo)
+
+	todoCh := make(chan *warmedPIndex, len(todo))
+
+	warmupM.Lock()
+	for _, w := range todo {
+		warmupPIndexes[w.path] = w
+		todoCh <- w
+	}
+	warmupM.Unlock()
+
+	close(todoCh)
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	startTime := time.Now()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		warmupWG.Add(1)
+		go func() {
+			defer warmupWG.Done()
+			defer wg.Done()
+
+			for w := range todoCh {
+				w.open(queries)
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		log.Printf("warmup: pre-opened pindexes, count: %d, workers: %d,"+
+			" took: %v", len(todo), workers, time.Since(startTime))
+	}()
+
+	return nil
+}
+
+// newWarmedPIndex reads the metadata of a bleve pindex.
+func newWarmedPIndex(path string) (*warmedPIndex, error) {
+	buf, err := ioutil.ReadFile(path + string(os.PathSeparator) +
+		cbgt.PINDEX_META_FILENAME)
+	if err != nil {
+		return nil, err
+	}
+
+	pindex := &cbgt.PIndex{}
+	err = json.Unmarshal(buf, pindex)
+	if err != nil {
+		return nil, err
+	}
+	if pindex.IndexType != "bleve" {
+		return nil, fmt.Errorf("not a bleve pindex, indexType: %s",
+			pindex.IndexType)
+	}
+
+	buf, err = ioutil.ReadFile(path +
+		string(os.PathSeparator) + "PINDEX_BLEVE_META")
+	if err != nil {
+		return nil, err
+	}
+
+	bleveParams := NewBleveParams()
+	err = json.Unmarshal(buf, bleveParams)
+	if err != nil {
+		return nil, err
+	}
+
+	priority, exists := PIndexLoadPriorities[bleveParams.LoadPriority]
+	if !exists {
+		priority = PIndexLoadPriorities[""]
+	}
+
+	return &warmedPIndex{
+		path:     filepath.Clean(path),
+		priority: priority,
+		params:   bleveParams,
+		doneCh:   make(chan struct{}),
+	}, nil
+}
+
+// open pre-opens a pindex, unless it was already taken by the
+// manager, and optionally runs its warmup queries.
+func (w *warmedPIndex) open(queries bool) {
+	warmupM.Lock()
+	if w.state != warmupPending {
+		warmupM.Unlock()
+		return
+	}
+	w.state = warmupOpening
+	warmupM.Unlock()
+
+	bindex, dest, err := openBleveDest(w.path, nil)
+	if err != nil {
+		log.Printf("warmup: could not open pindex, path: %s, err: %v",
+			w.path, err)
+	} else if queries {
+		runWarmupQueries(w.path, bindex, w.params.WarmupQueries)
+	}
+
+	warmupM.Lock()
+	w.state = warmupOpened
+	w.bindex, w.dest, w.err = bindex, dest, err
+	warmupM.Unlock()
+
+	close(w.doneCh)
+}
+
+// runWarmupQueries runs the warmup queries of a pindex, where failed
+// queries are only logged.
+func runWarmupQueries(path string, bindex bleve.Index,
+	queries []json.RawMessage) {
+	for i, q := range queries {
+		searchRequest := &bleve.SearchRequest{}
+		err := json.Unmarshal(q, searchRequest)
+		if err == nil {
+			_, err = bindex.Search(searchRequest)
+		}
+		if err != nil {
+			log.Printf("warmup: query failed, path: %s, query: %d,"+
+				" err: %v", path, i, err)
+		}
+	}
+}
+
+// warmupClaim returns the pre-opened pindex of a path, if any, which
+// is then owned by the caller, waiting for the pindex if it's being
+// opened.  When no worker has started on the pindex, it's taken away
+// from the workers, and the caller should open the pindex itself.
+func warmupClaim(path string, restart func()) (
+	bleve.Index, *BleveDest, bool) {
+	path = filepath.Clean(path)
+
+	warmupM.Lock()
+	w, exists := warmupPIndexes[path]
+	if !exists {
+		warmupM.Unlock()
+		return nil, nil, false
+	}
+	if w.state == warmupPending {
+		w.state = warmupTaken
+		delete(warmupPIndexes, path)
+		warmupM.Unlock()
+		return nil, nil, false
+	}
+	warmupM.Unlock()
+
+	<-w.doneCh
+
+	warmupM.Lock()
+	if warmupPIndexes[path] != w {
+		warmupM.Unlock()
+		return nil, nil, false // Already claimed.
+	}
+	delete(warmupPIndexes, path)
+	warmupM.Unlock()
+
+	if w.err != nil {
+		return nil, nil, false
+	}
+
+	w.dest.restart = restart
+
+	return w.bindex, w.dest, true
+}
+
+// WarmupRelease waits for the workers, and then closes any pre-opened
+// pindexes that weren't claimed by the manager, such as pindexes that
+// are no longer assigned to the node.  It should be invoked after the
+// manager is started.
+func WarmupRelease() {
+	warmupWG.Wait()
+
+	warmupM.Lock()
+	warmed := warmupPIndexes
+	warmupPIndexes = map[string]*warmedPIndex{}
+	warmupM.Unlock()
+
+	for path, w := range warmed {
+		if w.dest != nil {
+			log.Printf("warmup: closing unclaimed pindex, path: %s", path)
+			w.dest.Close()
+		}
+	}
+}
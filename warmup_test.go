@@ -0,0 +1,185 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestWarmupEnabled(t *testing.T) {
+	if WarmupEnabled(map[string]string{}) {
+		t.Errorf("expected no warmup by default")
+	}
+	if !WarmupEnabled(map[string]string{"warmup": "true"}) {
+		t.Errorf("expected warmup")
+	}
+}
+
+func TestPIndexLoadWorkers(t *testing.T) {
+	if PIndexLoadWorkers(map[string]string{}) < 1 {
+		t.Errorf("expected a default of at least 1 worker")
+	}
+	if PIndexLoadWorkers(map[string]string{"pindexLoadWorkers": "8"}) != 8 {
+		t.Errorf("expected 8 workers")
+	}
+}
+
+func TestWarmupPIndexes(t *testing.T) {
+	dataDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dataDir)
+
+	var paths []string
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("idx_1234_%d", i)
+		path := filepath.Join(dataDir, name+".pindex")
+
+		_, dest, err := NewBlevePIndexImpl("bleve",
+			`{"warmupQueries":[{"query":{"match_all":{}},"size":1},`+
+				`{"query":{"not-a-query":{}}}]}`, path, nil)
+		if err != nil {
+			t.Fatalf("expected no err, got: %v", err)
+		}
+		dest.Close()
+
+		meta, _ := json.Marshal(&cbgt.PIndex{
+			Name:      name,
+			IndexType: "bleve",
+			IndexName: "idx",
+		})
+		ioutil.WriteFile(filepath.Join(path, cbgt.PINDEX_META_FILENAME),
+			meta, 0600)
+
+		paths = append(paths, path)
+	}
+
+	// A pindex without a meta file isn't pre-opened.
+	os.MkdirAll(filepath.Join(dataDir, "bad_1234_0.pindex"), 0700)
+
+	err := WarmupPIndexes(dataDir, 2, true)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	warmupWG.Wait()
+
+	restarted := false
+	bindex, dest, ok := warmupClaim(paths[0]+string(os.PathSeparator),
+		func() { restarted = true })
+	if !ok || bindex == nil || dest == nil {
+		t.Fatalf("expected a pre-opened pindex")
+	}
+	dest.restart()
+	if !restarted {
+		t.Errorf("expected the claimed dest to have the restart func")
+	}
+	dest.Close()
+
+	_, _, ok = warmupClaim(paths[0], nil)
+	if ok {
+		t.Errorf("expected a pindex to be claimed only once")
+	}
+
+	impl, dest1, err := OpenBlevePIndexImpl("bleve", paths[1], nil)
+	if err != nil || impl == nil {
+		t.Fatalf("expected a claimed pindex, got err: %v", err)
+	}
+	dest1.Close()
+
+	WarmupRelease()
+
+	_, _, ok = warmupClaim(paths[2], nil)
+	if ok {
+		t.Errorf("expected the unclaimed pindexes to be released")
+	}
+	if len(warmupPIndexes) != 0 {
+		t.Errorf("expected no pre-opened pindexes, got: %v", warmupPIndexes)
+	}
+
+	// As the unclaimed pindex was closed, it can be opened again.
+	_, dest2, err := OpenBlevePIndexImpl("bleve", paths[2], nil)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	} else {
+		dest2.Close()
+	}
+}
+
+func TestWarmupPriorityAndTake(t *testing.T) {
+	dataDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dataDir)
+
+	var todo warmedPIndexes
+	for i, priority := range []string{"low", "", "high"} {
+		name := fmt.Sprintf("idx%d_1234_0", i)
+		path := filepath.Join(dataDir, name+".pindex")
+
+		_, dest, err := NewBlevePIndexImpl("bleve",
+			`{"loadPriority":"`+priority+`"}`, path, nil)
+		if err != nil {
+			t.Fatalf("expected no err, got: %v", err)
+		}
+		dest.Close()
+
+		meta, _ := json.Marshal(&cbgt.PIndex{
+			Name:      name,
+			IndexType: "bleve",
+			IndexName: fmt.Sprintf("idx%d", i),
+		})
+		ioutil.WriteFile(filepath.Join(path, cbgt.PINDEX_META_FILENAME),
+			meta, 0600)
+
+		w, err := newWarmedPIndex(path)
+		if err != nil {
+			t.Fatalf("expected no err, got: %v", err)
+		}
+		todo = append(todo, w)
+	}
+
+	sort.Sort(todo)
+	for i, exp := range []string{"idx2", "idx1", "idx0"} {
+		if !strings.Contains(todo[i].path, exp+"_") {
+			t.Errorf("%d: expected %s, got: %s", i, exp, todo[i].path)
+		}
+	}
+
+	// A pindex that no worker has started on is taken by the manager,
+	// and is then skipped by the workers.
+	w := todo[0]
+	warmupM.Lock()
+	warmupPIndexes[w.path] = w
+	warmupM.Unlock()
+
+	_, _, ok := warmupClaim(w.path, nil)
+	if ok || w.state != warmupTaken {
+		t.Errorf("expected a pending pindex to be taken, state: %d", w.state)
+	}
+
+	w.open(false)
+	if w.dest != nil {
+		t.Errorf("expected a taken pindex to not be opened")
+	}
+
+	err := ValidateBlevePIndexImpl("bleve", "idx",
+		`{"loadPriority":"urgent"}`)
+	if err == nil {
+		t.Errorf("expected err on an unknown loadPriority")
+	}
+}
@@ -0,0 +1,782 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbaselabs/cbgt"
+	"github.com/couchbaselabs/cbgt/rest"
+)
+
+// Webhooks are URL's that are POST'ed a JSON WebhookEvent when index
+// lifecycle events happen, so that orchestration tools don't need to
+// poll the REST API.
+//
+// Cluster-level events (like index creation) are detected by
+// watching the Cfg, which every node sees; so, to avoid duplicates,
+// they're only sent by a single "notifier" node, which is the wanted
+// node with the lowest UUID.  Node-level events (like a feed
+// rollback) are sent by the node where they happen.
+
+// The Cfg key where the webhook registrations are kept.
+const WEBHOOKS_KEY = "webhooks"
+
+const (
+	WEBHOOK_EVENT_INDEX_CREATED         = "indexCreated"
+	WEBHOOK_EVENT_INDEX_UPDATED         = "indexUpdated"
+	WEBHOOK_EVENT_INDEX_DELETED         = "indexDeleted"
+	WEBHOOK_EVENT_PINDEX_MOVE           = "pindexMove"
+	WEBHOOK_EVENT_PINDEX_BUILD_COMPLETE = "pindexBuildComplete"
+	WEBHOOK_EVENT_FEED_ROLLBACK         = "feedRollback"
+	WEBHOOK_EVENT_INDEX_QUARANTINED     = "indexQuarantined"
+	WEBHOOK_EVENT_DISK_HIGH_WATERMARK   = "diskHighWatermark"
+	WEBHOOK_EVENT_DISK_LOW_WATERMARK    = "diskLowWatermark"
+	WEBHOOK_EVENT_INDEX_EXPIRING        = "indexExpiring"
+	WEBHOOK_EVENT_PERCOLATOR_MATCHES    = "percolatorMatches"
+)
+
+// WebhookEvents is the set of event names that webhooks may
+// subscribe to.
+var WebhookEvents = map[string]bool{
+	WEBHOOK_EVENT_INDEX_CREATED:         true,
+	WEBHOOK_EVENT_INDEX_UPDATED:         true,
+	WEBHOOK_EVENT_INDEX_DELETED:         true,
+	WEBHOOK_EVENT_PINDEX_MOVE:           true,
+	WEBHOOK_EVENT_PINDEX_BUILD_COMPLETE: true,
+	WEBHOOK_EVENT_FEED_ROLLBACK:         true,
+	WEBHOOK_EVENT_INDEX_QUARANTINED:     true,
+	WEBHOOK_EVENT_DISK_HIGH_WATERMARK:   true,
+	WEBHOOK_EVENT_DISK_LOW_WATERMARK:    true,
+	WEBHOOK_EVENT_INDEX_EXPIRING:        true,
+	WEBHOOK_EVENT_PERCOLATOR_MATCHES:    true,
+}
+
+// The max number of attempts to deliver an event to a webhook.
+var WebhookMaxAttempts = 3
+
+// The backoff between webhook delivery attempts, which doubles
+// after each failed attempt.
+var WebhookRetryBackoff = 500 * time.Millisecond
+
+// The HTTP client used to deliver webhook events.
+var WebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Webhooks is the Cfg entry of all webhook registrations.
+type Webhooks struct {
+	UUID string `json:"uuid"`
+
+	// Keyed by webhook name.
+	Webhooks map[string]*Webhook `json:"webhooks"`
+}
+
+// Webhook is a registered webhook URL.
+type Webhook struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+
+	// The subscribed event names, where empty means all events.
+	Events []string `json:"events,omitempty"`
+}
+
+// WebhookEvent is the JSON that's POST'ed to a webhook URL.
+type WebhookEvent struct {
+	Event     string `json:"event"`
+	Time      string `json:"time"`
+	NodeUUID  string `json:"nodeUUID"`
+	IndexName string `json:"indexName,omitempty"`
+	IndexUUID string `json:"indexUUID,omitempty"`
+
+	PIndexName  string   `json:"pindexName,omitempty"`
+	Partition   string   `json:"partition,omitempty"`
+	RollbackSeq uint64   `json:"rollbackSeq,omitempty"`
+	FromNodes   []string `json:"fromNodes,omitempty"`
+	ToNodes     []string `json:"toNodes,omitempty"`
+	ExpireAt    string   `json:"expireAt,omitempty"`
+
+	Matches []*PercolatorMatch `json:"matches,omitempty"`
+}
+
+var webhookM sync.Mutex // Protects the fields that follow.
+
+var webhookMgr *cbgt.Manager
+
+// The cached webhook registrations.
+var webhookHooks map[string]*Webhook
+
+// The previously seen index definitions and plan, for detecting
+// cluster-level events.
+var webhookLoaded bool
+var webhookIndexDefs *cbgt.IndexDefs
+var webhookPlanPIndexes *cbgt.PlanPIndexes
+
+// A webhookPIndexBuild tracks the build of a local pindex, which is
+// complete once each of its source partitions has caught up with the
+// high seq # that the source partition had when the build started.
+type webhookPIndexBuild struct {
+	indexName string
+	fetching  bool
+	fetched   bool
+	highSeqs  map[string]uint64 // Keyed by partition, nil when unknown.
+	seqs      map[string]uint64 // Keyed by partition, the applied seq #.
+	snapEnds  map[string]uint64 // Keyed by partition, the first snapshot.
+	done      bool
+}
+
+// Keyed by pindex name, the builds of the local pindexes.
+var webhookPIndexBuilds = map[string]*webhookPIndexBuild{}
+
+// webhookSourceHighSeqs returns the current high seq #'s of the source
+// partitions of a pindex, keyed by partition, or nil when the source
+// type has no high seq #'s, in which case a partition has caught up
+// once it has applied its first snapshot.
+var webhookSourceHighSeqs = func(mgr *cbgt.Manager, pindex *cbgt.PIndex) (
+	map[string]uint64, error) {
+	if pindex.SourceType != "couchbase" {
+		return nil, nil
+	}
+
+	bucket, err := queryFetchBucket(mgr.Server(), &cbgt.IndexDef{
+		SourceType:   pindex.SourceType,
+		SourceName:   pindex.SourceName,
+		SourceParams: pindex.SourceParams,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]uint64{}
+
+	for _, stats := range bucket.GetStats("vbucket-seqno") {
+		for key, val := range stats {
+			if !strings.HasPrefix(key, "vb_") ||
+				!strings.HasSuffix(key, ":high_seqno") {
+				continue
+			}
+			seq, err := strconv.ParseUint(val, 10, 64)
+			if err != nil {
+				continue
+			}
+			partition := strings.TrimSuffix(key[len("vb_"):], ":high_seqno")
+			if rv[partition] < seq {
+				rv[partition] = seq // Replicas may lag the active vbucket.
+			}
+		}
+	}
+
+	if len(rv) <= 0 {
+		queryFetchBucketClose(bucket)
+
+		return nil, fmt.Errorf("webhooks: no high seqs,"+
+			" sourceName: %s", pindex.SourceName)
+	}
+
+	return rv, nil
+}
+
+// ---------------------------------------------------------
+
+// WebhooksStart loads the webhook registrations and starts watching
+// the Cfg for webhook changes and for cluster-level events.
+func WebhooksStart(mgr *cbgt.Manager) error {
+	cfg := mgr.Cfg()
+
+	ch := make(chan cbgt.CfgEvent, 10)
+
+	for _, key := range []string{WEBHOOKS_KEY,
+		cbgt.INDEX_DEFS_KEY, cbgt.PLAN_PINDEXES_KEY} {
+		err := cfg.Subscribe(key, ch)
+		if err != nil {
+			return err
+		}
+	}
+
+	webhookM.Lock()
+	webhookMgr = mgr
+	webhookM.Unlock()
+
+	err := webhooksRefresh(cfg)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for range ch {
+			err := webhooksRefresh(cfg)
+			if err != nil {
+				log.Printf("webhooks: refresh, err: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func webhooksRefresh(cfg cbgt.Cfg) error {
+	whs := &Webhooks{}
+	_, _, err := CfgGetJSON(cfg, WEBHOOKS_KEY, whs)
+	if err != nil {
+		return err
+	}
+
+	indexDefs, _, err := cbgt.CfgGetIndexDefs(cfg)
+	if err != nil {
+		return err
+	}
+
+	planPIndexes, _, err := cbgt.CfgGetPlanPIndexes(cfg)
+	if err != nil {
+		return err
+	}
+
+	notifier, err := webhookIsNotifier(cfg)
+	if err != nil {
+		return err
+	}
+
+	webhookM.Lock()
+	webhookHooks = whs.Webhooks
+
+	var events []*WebhookEvent
+	if notifier && webhookLoaded {
+		events = append(
+			WebhookIndexDefsEvents(webhookIndexDefs, indexDefs),
+			WebhookPlanPIndexesEvents(webhookPlanPIndexes, planPIndexes)...)
+	}
+
+	webhookLoaded = true
+	webhookIndexDefs = indexDefs
+	webhookPlanPIndexes = planPIndexes
+
+	// Forget the builds of the pindexes that were removed from this
+	// node.
+	for pindexName := range webhookPIndexBuilds {
+		var planPIndex *cbgt.PlanPIndex
+		if planPIndexes != nil {
+			planPIndex = planPIndexes.PlanPIndexes[pindexName]
+		}
+		if planPIndex == nil || webhookMgr == nil ||
+			planPIndex.Nodes[webhookMgr.UUID()] == nil {
+			delete(webhookPIndexBuilds, pindexName)
+		}
+	}
+	webhookM.Unlock()
+
+	for _, event := range events {
+		WebhookNotify(event)
+	}
+
+	return nil
+}
+
+// webhookIsNotifier returns true when this node is responsible for
+// sending cluster-level events.
+func webhookIsNotifier(cfg cbgt.Cfg) (bool, error) {
+	webhookM.Lock()
+	mgr := webhookMgr
+	webhookM.Unlock()
+
+	if mgr == nil {
+		return false, nil
+	}
+
+	nodeDefs, _, err := cbgt.CfgGetNodeDefs(cfg, cbgt.NODE_DEFS_WANTED)
+	if err != nil || nodeDefs == nil {
+		return false, err
+	}
+
+	lowest := ""
+	for uuid := range nodeDefs.NodeDefs {
+		if lowest == "" || uuid < lowest {
+			lowest = uuid
+		}
+	}
+
+	return lowest == mgr.UUID(), nil
+}
+
+// WebhookIndexDefsEvents returns the events for the changes between
+// two versions of the index definitions, where nil means no index
+// definitions.
+func WebhookIndexDefsEvents(prev, curr *cbgt.IndexDefs) []*WebhookEvent {
+	var rv []*WebhookEvent
+
+	if curr != nil {
+		for _, name := range sortedIndexDefNames(curr) {
+			indexDef := curr.IndexDefs[name]
+			var prevDef *cbgt.IndexDef
+			if prev != nil {
+				prevDef = prev.IndexDefs[name]
+			}
+			if prevDef == nil {
+				rv = append(rv, &WebhookEvent{
+					Event:     WEBHOOK_EVENT_INDEX_CREATED,
+					IndexName: name,
+					IndexUUID: indexDef.UUID,
+				})
+			} else if prevDef.UUID != indexDef.UUID {
+				rv = append(rv, &WebhookEvent{
+					Event:     WEBHOOK_EVENT_INDEX_UPDATED,
+					IndexName: name,
+					IndexUUID: indexDef.UUID,
+				})
+			}
+		}
+	}
+
+	if prev == nil {
+		return rv
+	}
+
+	for _, name := range sortedIndexDefNames(prev) {
+		if curr == nil || curr.IndexDefs[name] == nil {
+			rv = append(rv, &WebhookEvent{
+				Event:     WEBHOOK_EVENT_INDEX_DELETED,
+				IndexName: name,
+				IndexUUID: prev.IndexDefs[name].UUID,
+			})
+		}
+	}
+
+	return rv
+}
+
+func sortedIndexDefNames(indexDefs *cbgt.IndexDefs) []string {
+	rv := make([]string, 0, len(indexDefs.IndexDefs))
+	for name := range indexDefs.IndexDefs {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// WebhookPlanPIndexesEvents returns the pindex move events between
+// two versions of the plan, where a move is a change in the nodes
+// assigned to an existing plan pindex.
+func WebhookPlanPIndexesEvents(prev, curr *cbgt.PlanPIndexes) []*WebhookEvent {
+	if prev == nil || curr == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(curr.PlanPIndexes))
+	for name := range curr.PlanPIndexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rv []*WebhookEvent
+
+	for _, name := range names {
+		planPIndex := curr.PlanPIndexes[name]
+		prevPlanPIndex, exists := prev.PlanPIndexes[name]
+		if !exists || prevPlanPIndex == nil {
+			continue
+		}
+
+		fromNodes := planPIndexNodeUUIDs(prevPlanPIndex)
+		toNodes := planPIndexNodeUUIDs(planPIndex)
+		if strings.Join(fromNodes, ",") == strings.Join(toNodes, ",") {
+			continue
+		}
+
+		rv = append(rv, &WebhookEvent{
+			Event:      WEBHOOK_EVENT_PINDEX_MOVE,
+			IndexName:  planPIndex.IndexName,
+			IndexUUID:  planPIndex.IndexUUID,
+			PIndexName: name,
+			FromNodes:  fromNodes,
+			ToNodes:    toNodes,
+		})
+	}
+
+	return rv
+}
+
+func planPIndexNodeUUIDs(planPIndex *cbgt.PlanPIndex) []string {
+	rv := make([]string, 0, len(planPIndex.Nodes))
+	for uuid := range planPIndex.Nodes {
+		rv = append(rv, uuid)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// webhookPartitionApplied is invoked after a batch of a local
+// partition of a pindex is applied, up to the seq #, and returns true
+// once the partition has caught up with its source partition, after
+// which it needn't be invoked again for the partition.  It doesn't
+// block, so that it can be invoked on the ingest path.
+func webhookPartitionApplied(indexName, pindexName, partition string,
+	seq, snapEnd uint64) bool {
+	webhookM.Lock()
+	b := webhookPIndexBuilds[pindexName]
+	if b == nil {
+		b = &webhookPIndexBuild{
+			indexName: indexName,
+			seqs:      map[string]uint64{},
+			snapEnds:  map[string]uint64{},
+		}
+		webhookPIndexBuilds[pindexName] = b
+	}
+	b.seqs[partition] = seq
+	if _, exists := b.snapEnds[partition]; !exists {
+		b.snapEnds[partition] = snapEnd
+	}
+	fetch := !b.fetched && !b.fetching
+	if fetch {
+		b.fetching = true
+	}
+	caughtUp := b.fetched && b.caughtUp(partition)
+	webhookM.Unlock()
+
+	if fetch {
+		go webhookPIndexBuildFetch(pindexName)
+	}
+
+	if caughtUp {
+		go webhookPIndexBuildCheck(pindexName)
+	}
+
+	return caughtUp
+}
+
+func (b *webhookPIndexBuild) caughtUp(partition string) bool {
+	if b.highSeqs != nil {
+		return b.seqs[partition] >= b.highSeqs[partition]
+	}
+
+	snapEnd := b.snapEnds[partition]
+
+	return snapEnd > 0 && b.seqs[partition] >= snapEnd
+}
+
+// webhookPIndexBuildFetch retrieves the high seq #'s that the build of
+// a pindex needs to catch up with, where a failed retrieval is retried
+// on the pindex's next applied batch.
+func webhookPIndexBuildFetch(pindexName string) {
+	webhookM.Lock()
+	mgr := webhookMgr
+	webhookM.Unlock()
+
+	var highSeqs map[string]uint64
+	var err error
+
+	var pindex *cbgt.PIndex
+	if mgr != nil {
+		_, pindexes := mgr.CurrentMaps()
+		pindex = pindexes[pindexName]
+	}
+	if pindex != nil {
+		highSeqs, err = webhookSourceHighSeqs(mgr, pindex)
+		if err != nil {
+			log.Printf("webhooks: high seqs, pindexName: %s, err: %v",
+				pindexName, err)
+		}
+	}
+
+	webhookM.Lock()
+	b := webhookPIndexBuilds[pindexName]
+	if b != nil {
+		b.fetching = false
+		if pindex != nil && err == nil {
+			b.fetched = true
+			b.highSeqs = highSeqs
+		}
+	}
+	webhookM.Unlock()
+
+	webhookPIndexBuildCheck(pindexName)
+}
+
+// webhookPIndexBuildCheck sends a pindexBuildComplete event once all
+// of a pindex's source partitions have caught up.
+func webhookPIndexBuildCheck(pindexName string) {
+	webhookM.Lock()
+	mgr := webhookMgr
+	webhookM.Unlock()
+
+	if mgr == nil {
+		return
+	}
+
+	_, pindexes := mgr.CurrentMaps()
+	pindex := pindexes[pindexName]
+	if pindex == nil || pindex.SourcePartitions == "" {
+		return
+	}
+
+	webhookM.Lock()
+	b := webhookPIndexBuilds[pindexName]
+	if b == nil || !b.fetched || b.done {
+		webhookM.Unlock()
+		return
+	}
+	for _, partition := range strings.Split(pindex.SourcePartitions, ",") {
+		if !b.caughtUp(partition) {
+			webhookM.Unlock()
+			return
+		}
+	}
+	b.done = true
+	webhookM.Unlock()
+
+	WebhookNotify(&WebhookEvent{
+		Event:      WEBHOOK_EVENT_PINDEX_BUILD_COMPLETE,
+		IndexName:  b.indexName,
+		IndexUUID:  pindex.IndexUUID,
+		PIndexName: pindexName,
+	})
+}
+
+// WebhookNotify asynchronously delivers an event to the webhooks
+// that are subscribed to the event.
+func WebhookNotify(event *WebhookEvent) {
+	webhookM.Lock()
+	mgr := webhookMgr
+	var hooks []*Webhook
+	for _, hook := range webhookHooks {
+		if hook.Subscribed(event.Event) {
+			hooks = append(hooks, hook)
+		}
+	}
+	webhookM.Unlock()
+
+	if len(hooks) <= 0 {
+		return
+	}
+
+	if event.Time == "" {
+		event.Time = time.Now().Format(time.RFC3339Nano)
+	}
+	if event.NodeUUID == "" && mgr != nil {
+		event.NodeUUID = mgr.UUID()
+	}
+
+	buf, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("webhooks: marshal, event: %s, err: %v", event.Event, err)
+		return
+	}
+
+	for _, hook := range hooks {
+		go webhookDeliver(hook, buf)
+	}
+}
+
+func webhookDeliver(hook *Webhook, buf []byte) {
+	backoff := WebhookRetryBackoff
+
+	var err error
+	for attempt := 0; attempt < WebhookMaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff = backoff * 2
+		}
+
+		var resp *http.Response
+		resp, err = WebhookClient.Post(hook.URL, "application/json",
+			bytes.NewBuffer(buf))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status code: %d", resp.StatusCode)
+		}
+	}
+
+	log.Printf("webhooks: deliver failed, name: %s, url: %s, err: %v",
+		hook.Name, hook.URL, err)
+}
+
+// Subscribed returns true if the webhook is subscribed to an event.
+func (h *Webhook) Subscribed(event string) bool {
+	if len(h.Events) <= 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------------------------------------------------
+
+// WebhookListHandler is a REST handler that returns the webhook
+// registrations.
+type WebhookListHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewWebhookListHandler(mgr *cbgt.Manager) *WebhookListHandler {
+	return &WebhookListHandler{mgr: mgr}
+}
+
+func (h *WebhookListHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	whs := &Webhooks{}
+	_, _, err := CfgGetJSON(h.mgr.Cfg(), WEBHOOKS_KEY, whs)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("webhooks: could not"+
+			" retrieve webhooks, err: %v", err), 500)
+		return
+	}
+
+	webhooks := whs.Webhooks
+	if webhooks == nil {
+		webhooks = map[string]*Webhook{}
+	}
+
+	rest.MustEncode(w, struct {
+		Status   string              `json:"status"`
+		Webhooks map[string]*Webhook `json:"webhooks"`
+	}{
+		Status:   "ok",
+		Webhooks: webhooks,
+	})
+}
+
+// WebhookPutHandler is a REST handler that creates/updates a webhook
+// registration.
+type WebhookPutHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewWebhookPutHandler(mgr *cbgt.Manager) *WebhookPutHandler {
+	return &WebhookPutHandler{mgr: mgr}
+}
+
+func (h *WebhookPutHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["webhookName"]
+	if name == "" {
+		rest.ShowError(w, req, "webhooks: webhook name is required", 400)
+		return
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("webhooks: could not read"+
+			" request body, err: %v", err), 400)
+		return
+	}
+
+	hook := &Webhook{}
+	err = json.Unmarshal(requestBody, hook)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("webhooks: could not parse"+
+			" request body, err: %v", err), 400)
+		return
+	}
+	hook.Name = name
+
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		rest.ShowError(w, req, fmt.Sprintf("webhooks: invalid url,"+
+			" url: %s", hook.URL), 400)
+		return
+	}
+
+	for _, event := range hook.Events {
+		if !WebhookEvents[event] {
+			rest.ShowError(w, req, fmt.Sprintf("webhooks: unknown event,"+
+				" event: %s", event), 400)
+			return
+		}
+	}
+
+	cfg := h.mgr.Cfg()
+
+	whs := &Webhooks{}
+	cas, _, err := CfgGetJSON(cfg, WEBHOOKS_KEY, whs)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("webhooks: could not"+
+			" retrieve webhooks, err: %v", err), 500)
+		return
+	}
+	if whs.Webhooks == nil {
+		whs.Webhooks = map[string]*Webhook{}
+	}
+	whs.UUID = cbgt.NewUUID()
+	whs.Webhooks[name] = hook
+
+	_, err = CfgSetJSON(cfg, WEBHOOKS_KEY, whs, cas)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("webhooks: could not"+
+			" save webhooks, err: %v", err), 500)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// WebhookDeleteHandler is a REST handler that deletes a webhook
+// registration.
+type WebhookDeleteHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewWebhookDeleteHandler(mgr *cbgt.Manager) *WebhookDeleteHandler {
+	return &WebhookDeleteHandler{mgr: mgr}
+}
+
+func (h *WebhookDeleteHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["webhookName"]
+
+	cfg := h.mgr.Cfg()
+
+	whs := &Webhooks{}
+	cas, _, err := CfgGetJSON(cfg, WEBHOOKS_KEY, whs)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("webhooks: could not"+
+			" retrieve webhooks, err: %v", err), 500)
+		return
+	}
+	if whs.Webhooks[name] == nil {
+		rest.ShowError(w, req, fmt.Sprintf("webhooks: no such webhook,"+
+			" webhookName: %s", name), 400)
+		return
+	}
+	whs.UUID = cbgt.NewUUID()
+	delete(whs.Webhooks, name)
+
+	_, err = CfgSetJSON(cfg, WEBHOOKS_KEY, whs, cas)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("webhooks: could not"+
+			" save webhooks, err: %v", err), 500)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
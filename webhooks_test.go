@@ -0,0 +1,265 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestWebhookIndexDefsEvents(t *testing.T) {
+	prev := &cbgt.IndexDefs{IndexDefs: map[string]*cbgt.IndexDef{
+		"a": &cbgt.IndexDef{Name: "a", UUID: "a0"},
+		"b": &cbgt.IndexDef{Name: "b", UUID: "b0"},
+	}}
+	curr := &cbgt.IndexDefs{IndexDefs: map[string]*cbgt.IndexDef{
+		"b": &cbgt.IndexDef{Name: "b", UUID: "b1"},
+		"c": &cbgt.IndexDef{Name: "c", UUID: "c0"},
+	}}
+
+	var events []string
+	for _, e := range WebhookIndexDefsEvents(prev, curr) {
+		events = append(events, e.Event+":"+e.IndexName+":"+e.IndexUUID)
+	}
+	exp := []string{"indexUpdated:b:b1", "indexCreated:c:c0", "indexDeleted:a:a0"}
+	if !reflect.DeepEqual(events, exp) {
+		t.Errorf("expected: %#v, got: %#v", exp, events)
+	}
+
+	if len(WebhookIndexDefsEvents(nil, curr)) != 2 {
+		t.Errorf("expected created events when no prev")
+	}
+	if len(WebhookIndexDefsEvents(prev, nil)) != 2 {
+		t.Errorf("expected deleted events when no curr")
+	}
+}
+
+func TestWebhookPlanPIndexesEvents(t *testing.T) {
+	prev := &cbgt.PlanPIndexes{PlanPIndexes: map[string]*cbgt.PlanPIndex{
+		"p0": &cbgt.PlanPIndex{IndexName: "a", Nodes: map[string]*cbgt.PlanPIndexNode{
+			"n0": &cbgt.PlanPIndexNode{},
+		}},
+		"p1": &cbgt.PlanPIndex{IndexName: "a", Nodes: map[string]*cbgt.PlanPIndexNode{
+			"n1": &cbgt.PlanPIndexNode{},
+		}},
+	}}
+	curr := &cbgt.PlanPIndexes{PlanPIndexes: map[string]*cbgt.PlanPIndex{
+		"p0": &cbgt.PlanPIndex{IndexName: "a", Nodes: map[string]*cbgt.PlanPIndexNode{
+			"n0": &cbgt.PlanPIndexNode{},
+		}},
+		"p1": &cbgt.PlanPIndex{IndexName: "a", Nodes: map[string]*cbgt.PlanPIndexNode{
+			"n2": &cbgt.PlanPIndexNode{},
+		}},
+	}}
+
+	events := WebhookPlanPIndexesEvents(prev, curr)
+	if len(events) != 1 ||
+		events[0].PIndexName != "p1" ||
+		!reflect.DeepEqual(events[0].FromNodes, []string{"n1"}) ||
+		!reflect.DeepEqual(events[0].ToNodes, []string{"n2"}) {
+		t.Errorf("expected a p1 move, got: %#v", events)
+	}
+}
+
+func TestWebhookNotify(t *testing.T) {
+	eventCh := make(chan *WebhookEvent, 10)
+
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			event := &WebhookEvent{}
+			body, _ := ioutil.ReadAll(req.Body)
+			json.Unmarshal(body, event)
+			eventCh <- event
+		}))
+	defer s.Close()
+
+	webhookM.Lock()
+	webhookHooks = map[string]*Webhook{
+		"all": &Webhook{Name: "all", URL: s.URL},
+		"rollback": &Webhook{Name: "rollback", URL: s.URL,
+			Events: []string{WEBHOOK_EVENT_FEED_ROLLBACK}},
+	}
+	webhookM.Unlock()
+
+	defer func() {
+		webhookM.Lock()
+		webhookHooks = nil
+		webhookM.Unlock()
+	}()
+
+	WebhookNotify(&WebhookEvent{
+		Event:     WEBHOOK_EVENT_INDEX_CREATED,
+		IndexName: "idx0",
+	})
+
+	select {
+	case event := <-eventCh:
+		if event.Event != WEBHOOK_EVENT_INDEX_CREATED ||
+			event.IndexName != "idx0" || event.Time == "" {
+			t.Errorf("unexpected event: %#v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected webhook delivery")
+	}
+
+	select {
+	case event := <-eventCh:
+		t.Errorf("expected only 1 delivery, got: %#v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookHandlers(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.Start("wanted")
+
+	mr, _ := cbgt.NewMsgRing(os.Stderr, 1000)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", mr)
+	if err != nil || router == nil {
+		t.Errorf("no mux router")
+	}
+
+	tests := []*RESTHandlerTest{
+		{
+			Desc:         "list webhooks when none",
+			Path:         "/api/webhooks",
+			Method:       "GET",
+			Status:       http.StatusOK,
+			ResponseBody: []byte(`{"status":"ok","webhooks":{}}`),
+		},
+		{
+			Desc:   "put a webhook with a bad url",
+			Path:   "/api/webhooks/w0",
+			Method: "PUT",
+			Body:   []byte(`{"url":"not-a-url"}`),
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`invalid url`: true,
+			},
+		},
+		{
+			Desc:   "put a webhook with an unknown event",
+			Path:   "/api/webhooks/w0",
+			Method: "PUT",
+			Body:   []byte(`{"url":"http://localhost/hook","events":["x"]}`),
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`unknown event`: true,
+			},
+		},
+		{
+			Desc:   "put a webhook",
+			Path:   "/api/webhooks/w0",
+			Method: "PUT",
+			Body: []byte(`{"url":"http://localhost/hook",` +
+				`"events":["indexCreated"]}`),
+			Status: http.StatusOK,
+		},
+		{
+			Desc:   "list webhooks",
+			Path:   "/api/webhooks",
+			Method: "GET",
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"w0":{"name":"w0","url":"http://localhost/hook"`: true,
+			},
+		},
+		{
+			Desc:   "delete a webhook",
+			Path:   "/api/webhooks/w0",
+			Method: "DELETE",
+			Status: http.StatusOK,
+		},
+		{
+			Desc:   "delete a missing webhook",
+			Path:   "/api/webhooks/w0",
+			Method: "DELETE",
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`no such webhook`: true,
+			},
+		},
+	}
+
+	testRESTHandlers(t, tests, router)
+}
+
+func TestWebhookPartitionApplied(t *testing.T) {
+	defer func() {
+		webhookM.Lock()
+		webhookPIndexBuilds = map[string]*webhookPIndexBuild{}
+		webhookM.Unlock()
+	}()
+
+	if webhookPartitionApplied("idx0", "p0", "0", 10, 10) {
+		t.Errorf("expected not caught up before the high seqs are known")
+	}
+
+	webhookM.Lock()
+	b := webhookPIndexBuilds["p0"]
+	b.fetched = true
+	b.highSeqs = map[string]uint64{"0": 20, "1": 0}
+	webhookM.Unlock()
+
+	if webhookPartitionApplied("idx0", "p0", "0", 15, 10) {
+		t.Errorf("expected not caught up at the end of the first snapshot")
+	}
+	if !webhookPartitionApplied("idx0", "p0", "0", 20, 10) {
+		t.Errorf("expected caught up at the high seq")
+	}
+
+	webhookM.Lock()
+	if !b.caughtUp("1") {
+		t.Errorf("expected an empty source partition to be caught up")
+	}
+	b.highSeqs = nil
+	if b.caughtUp("1") || !b.caughtUp("0") {
+		t.Errorf("expected the first snapshot when there are no high seqs")
+	}
+	webhookM.Unlock()
+}
+
+func TestWebhookPIndexBuildsPruned(t *testing.T) {
+	webhookM.Lock()
+	webhookPIndexBuilds = map[string]*webhookPIndexBuild{
+		"p0": &webhookPIndexBuild{indexName: "idx0"},
+	}
+	webhookM.Unlock()
+
+	err := webhooksRefresh(cbgt.NewCfgMem())
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+
+	webhookM.Lock()
+	n := len(webhookPIndexBuilds)
+	webhookLoaded = false
+	webhookM.Unlock()
+
+	if n != 0 {
+		t.Errorf("expected the removed pindex's build to be pruned")
+	}
+}
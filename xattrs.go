@@ -0,0 +1,302 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbase/go-couchbase"
+	"github.com/couchbase/gomemcached"
+	memcached "github.com/couchbase/gomemcached/client"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+// The DCP feed of a couchbase data source streams the bodies of the
+// documents without their extended attributes (XATTRs).  So that the
+// XATTRs of documents, such as workflow state, can be searched, the
+// "xattrs" of a couchbase feed's sourceParams lists the XATTRs to
+// deliver...
+//
+//   {"xattrs": ["reviewState", "owner"]}
+//
+// where the feed looks up those XATTRs of each mutated document from
+// the bucket with a sub-document multi-lookup, and delivers them to
+// the index as the "$xattrs" sub-object of the document, so that
+// they're mappable like "$xattrs.reviewState".  The lookup costs a KV
+// round trip per mutation, and sees the XATTRs as of the lookup, which
+// might be newer than the mutation, where a later change of the XATTRs
+// is a mutation of its own, so the index still ends up current.
+
+// The source types whose feeds can deliver XATTRs.
+var FeedXattrsSourceTypes = []string{"couchbase"}
+
+// The document field under which the XATTRs of a document are
+// delivered.
+const XATTRS_FIELD = "$xattrs"
+
+// The max number of XATTRs of a feed, which is the max number of
+// paths of a sub-document multi-lookup.
+const XATTRS_MAX = 16
+
+// The sub-document protocol of the memcached binary protocol.
+const (
+	subdocMultiLookup      = gomemcached.CommandCode(0xd0)
+	subdocGet              = 0xc5
+	subdocFlagXattrPath    = 0x04
+	subdocMultiPathFailure = gomemcached.Status(0xcc)
+)
+
+// The number of XATTRs lookups that failed, where the documents were
+// delivered without their XATTRs.  Accessed via atomic.
+var feedXattrsLookupErrors uint64
+
+var feedXattrsM sync.Mutex
+
+// The unwrapped feed types, keyed by source type.
+var feedXattrsOrigs = map[string]*cbgt.FeedType{}
+
+// FeedXattrsStart wraps the registered couchbase feed types so that
+// their feeds deliver the XATTRs of their sourceParams.  It must be
+// invoked before the manager is started, and after
+// FeedFlowControlStart().
+func FeedXattrsStart() {
+	for _, sourceType := range FeedXattrsSourceTypes {
+		wrapFeedTypeXattrs(sourceType)
+	}
+}
+
+// FeedXattrsLookupErrors returns the number of XATTRs lookups that
+// failed.
+func FeedXattrsLookupErrors() uint64 {
+	return atomic.LoadUint64(&feedXattrsLookupErrors)
+}
+
+func wrapFeedTypeXattrs(sourceType string) {
+	feedXattrsM.Lock()
+	defer feedXattrsM.Unlock()
+
+	orig := feedXattrsOrigs[sourceType]
+	if orig == nil {
+		orig = cbgt.FeedTypes[sourceType]
+		if orig == nil || orig.Start == nil {
+			return
+		}
+		feedXattrsOrigs[sourceType] = orig
+	}
+
+	origStart := orig.Start
+
+	wrapped := *orig
+	wrapped.Start = func(mgr *cbgt.Manager, feedName, indexName,
+		indexUUID, sourceType, sourceName, sourceUUID, params string,
+		dests map[string]cbgt.Dest) error {
+		xattrs, err := feedXattrsParams(params)
+		if err != nil {
+			return fmt.Errorf("xattrs: feed: %s, err: %v", feedName, err)
+		}
+
+		if len(xattrs) > 0 {
+			indexDef := &cbgt.IndexDef{
+				SourceType:   sourceType,
+				SourceName:   sourceName,
+				SourceParams: params,
+			}
+
+			lookup := func(key string) (map[string]interface{}, error) {
+				bucket, err := queryFetchBucket(mgr.Server(), indexDef)
+				if err != nil {
+					return nil, err
+				}
+				rv, err := lookupXattrs(bucket, key, xattrs)
+				if err != nil {
+					queryFetchBucketClose(bucket)
+				}
+				return rv, err
+			}
+
+			xattrsDests := make(map[string]cbgt.Dest, len(dests))
+			for partition, dest := range dests {
+				xattrsDests[partition] = &xattrsDest{Dest: dest, lookup: lookup}
+			}
+			dests = xattrsDests
+		}
+
+		return origStart(mgr, feedName, indexName, indexUUID,
+			sourceType, sourceName, sourceUUID, params, dests)
+	}
+
+	cbgt.FeedTypes[sourceType] = &wrapped
+}
+
+// feedXattrsParams returns the XATTRs of a feed's sourceParams.
+func feedXattrsParams(params string) ([]string, error) {
+	if params == "" {
+		return nil, nil
+	}
+
+	p := struct {
+		Xattrs []string `json:"xattrs"`
+	}{}
+	err := json.Unmarshal([]byte(params), &p)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse sourceParams: %v", err)
+	}
+
+	if len(p.Xattrs) > XATTRS_MAX {
+		return nil, fmt.Errorf("too many xattrs, max: %d", XATTRS_MAX)
+	}
+	for _, xattr := range p.Xattrs {
+		if xattr == "" {
+			return nil, fmt.Errorf("xattrs can't be empty")
+		}
+	}
+
+	return p.Xattrs, nil
+}
+
+// lookupXattrs returns the XATTRs of a document that exist and are
+// JSON, or nil when the document doesn't exist.
+func lookupXattrs(bucket *couchbase.Bucket, key string,
+	xattrs []string) (map[string]interface{}, error) {
+	var rv map[string]interface{}
+
+	err := bucket.Do(key, func(mc *memcached.Client, vb uint16) error {
+		res, err := mc.Send(&gomemcached.MCRequest{
+			Opcode:  subdocMultiLookup,
+			VBucket: vb,
+			Key:     []byte(key),
+			Body:    subdocLookupBody(xattrs),
+		})
+		if res == nil {
+			return err
+		}
+		switch res.Status {
+		case gomemcached.SUCCESS, subdocMultiPathFailure:
+			rv, err = subdocLookupResults(xattrs, res.Body)
+			return err
+		case gomemcached.KEY_ENOENT:
+			return nil // Deleted since the mutation.
+		}
+		if err == nil {
+			err = res
+		}
+		return err
+	})
+
+	return rv, err
+}
+
+// subdocLookupBody returns the body of a sub-document multi-lookup of
+// XATTR paths.
+func subdocLookupBody(paths []string) []byte {
+	var rv []byte
+	for _, path := range paths {
+		spec := make([]byte, 4, 4+len(path))
+		spec[0] = subdocGet
+		spec[1] = subdocFlagXattrPath
+		binary.BigEndian.PutUint16(spec[2:4], uint16(len(path)))
+		rv = append(rv, append(spec, path...)...)
+	}
+	return rv
+}
+
+// subdocLookupResults parses the body of a sub-document multi-lookup
+// response, which has a result per path, where the paths that don't
+// exist or aren't JSON are left out.
+func subdocLookupResults(paths []string,
+	body []byte) (map[string]interface{}, error) {
+	rv := map[string]interface{}{}
+
+	for _, path := range paths {
+		if len(body) < 6 {
+			return nil, fmt.Errorf("xattrs: short lookup response")
+		}
+		status := binary.BigEndian.Uint16(body[0:2])
+		n := binary.BigEndian.Uint32(body[2:6])
+		if uint64(n) > uint64(len(body)-6) {
+			return nil, fmt.Errorf("xattrs: bad lookup response length")
+		}
+		val := body[6 : 6+n]
+		body = body[6+n:]
+
+		if status != uint16(gomemcached.SUCCESS) {
+			continue // A missing XATTR.
+		}
+
+		var v interface{}
+		if json.Unmarshal(val, &v) != nil {
+			continue
+		}
+		rv[path] = v
+	}
+
+	return rv, nil
+}
+
+// ---------------------------------------------------------
+
+// An xattrsDest delivers the document mutations of a feed to a dest
+// along with the documents' XATTRs.
+type xattrsDest struct {
+	cbgt.Dest
+	lookup func(key string) (map[string]interface{}, error)
+}
+
+func (d *xattrsDest) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType cbgt.DestExtrasType, extras []byte) error {
+	return d.Dest.DataUpdate(partition, key, seq,
+		xattrsValue(key, val, d.lookup), cas, extrasType, extras)
+}
+
+// xattrsValue returns a document value with the XATTRs of the
+// document under the XATTRS_FIELD, or the value as is when it isn't a
+// JSON object, or when the document has none of the XATTRs, or when
+// the XATTRs couldn't be looked up, which is logged and counted.
+func xattrsValue(key, val []byte,
+	lookup func(key string) (map[string]interface{}, error)) []byte {
+	var m map[string]json.RawMessage
+	if json.Unmarshal(val, &m) != nil || m == nil {
+		return val
+	}
+
+	xattrs, err := lookup(string(key))
+	if err != nil {
+		atomic.AddUint64(&feedXattrsLookupErrors, 1)
+		log.Printf("xattrs: lookup, key: %q, err: %v", key, err)
+		return val
+	}
+	if len(xattrs) <= 0 {
+		return val
+	}
+
+	buf, err := json.Marshal(xattrs)
+	if err != nil {
+		return val
+	}
+	m[XATTRS_FIELD] = buf
+
+	rv, err := json.Marshal(m)
+	if err != nil {
+		return val
+	}
+
+	return rv
+}
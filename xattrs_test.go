@@ -0,0 +1,192 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/couchbaselabs/cbgt"
+)
+
+func TestFeedXattrsParams(t *testing.T) {
+	for params, exp := range map[string][]string{
+		``:                                   nil,
+		`{}`:                                 nil,
+		`{"xattrs":["reviewState","owner"]}`: []string{"reviewState", "owner"},
+	} {
+		xattrs, err := feedXattrsParams(params)
+		if err != nil || !reflect.DeepEqual(xattrs, exp) {
+			t.Errorf("params: %s, expected: %v, got: %v, err: %v",
+				params, exp, xattrs, err)
+		}
+	}
+
+	for _, params := range []string{
+		`{`,
+		`{"xattrs":"reviewState"}`,
+		`{"xattrs":[""]}`,
+		`{"xattrs":["a","b","c","d","e","f","g","h","i",` +
+			`"j","k","l","m","n","o","p","q"]}`,
+	} {
+		_, err := feedXattrsParams(params)
+		if err == nil {
+			t.Errorf("expected err, params: %s", params)
+		}
+	}
+}
+
+func TestSubdocLookupBody(t *testing.T) {
+	body := subdocLookupBody([]string{"ab", "c"})
+	exp := []byte{subdocGet, subdocFlagXattrPath, 0, 2, 'a', 'b',
+		subdocGet, subdocFlagXattrPath, 0, 1, 'c'}
+	if !reflect.DeepEqual(body, exp) {
+		t.Errorf("expected: %v, got: %v", exp, body)
+	}
+}
+
+func testSubdocResult(status uint16, val string) []byte {
+	rv := make([]byte, 6, 6+len(val))
+	binary.BigEndian.PutUint16(rv[0:2], status)
+	binary.BigEndian.PutUint32(rv[2:6], uint32(len(val)))
+	return append(rv, val...)
+}
+
+func TestSubdocLookupResults(t *testing.T) {
+	paths := []string{"reviewState", "missing", "notJSON", "owner"}
+
+	var body []byte
+	body = append(body, testSubdocResult(0, `"approved"`)...)
+	body = append(body, testSubdocResult(0xc0, ``)...)
+	body = append(body, testSubdocResult(0, `{`)...)
+	body = append(body, testSubdocResult(0, `{"id":1}`)...)
+
+	rv, err := subdocLookupResults(paths, body)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	exp := map[string]interface{}{
+		"reviewState": "approved",
+		"owner":       map[string]interface{}{"id": float64(1)},
+	}
+	if !reflect.DeepEqual(rv, exp) {
+		t.Errorf("expected: %v, got: %v", exp, rv)
+	}
+
+	_, err = subdocLookupResults(paths, body[:len(body)-1])
+	if err == nil {
+		t.Errorf("expected err on a truncated response")
+	}
+	_, err = subdocLookupResults(paths, body[:3])
+	if err == nil {
+		t.Errorf("expected err on a short response")
+	}
+}
+
+type testXattrsDest struct {
+	cbgt.Dest
+	val []byte
+}
+
+func (d *testXattrsDest) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType cbgt.DestExtrasType, extras []byte) error {
+	d.val = val
+	return nil
+}
+
+func TestXattrsDest(t *testing.T) {
+	xattrs := map[string]map[string]interface{}{
+		"doc": {"reviewState": "approved"},
+	}
+	lookup := func(key string) (map[string]interface{}, error) {
+		if key == "err" {
+			return nil, fmt.Errorf("lookup err")
+		}
+		return xattrs[key], nil
+	}
+
+	dest := &testXattrsDest{}
+	d := &xattrsDest{Dest: dest, lookup: lookup}
+
+	err := d.DataUpdate("0", []byte("doc"), 1,
+		[]byte(`{"title":"x","n":12345678901234567890}`), 0, 0, nil)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	var m map[string]interface{}
+	if json.Unmarshal(dest.val, &m) != nil || m["title"] != "x" ||
+		!reflect.DeepEqual(m[XATTRS_FIELD],
+			map[string]interface{}{"reviewState": "approved"}) {
+		t.Errorf("expected the xattrs delivered, got: %s", dest.val)
+	}
+
+	errs := FeedXattrsLookupErrors()
+	for key, val := range map[string]string{
+		"none": `{"title":"x"}`,
+		"doc":  `not json`,
+		"err":  `{"title":"x"}`,
+	} {
+		d.DataUpdate("0", []byte(key), 1, []byte(val), 0, 0, nil)
+		if string(dest.val) != val {
+			t.Errorf("key: %s, expected the value as is, got: %s",
+				key, dest.val)
+		}
+	}
+	if FeedXattrsLookupErrors() != errs+1 {
+		t.Errorf("expected a lookup error to be counted")
+	}
+}
+
+func TestFeedXattrsStart(t *testing.T) {
+	var gotDests map[string]cbgt.Dest
+	cbgt.FeedTypes["testXattrs"] = &cbgt.FeedType{
+		Start: func(mgr *cbgt.Manager, feedName, indexName,
+			indexUUID, sourceType, sourceName, sourceUUID, params string,
+			dests map[string]cbgt.Dest) error {
+			gotDests = dests
+			return nil
+		},
+	}
+	defer delete(cbgt.FeedTypes, "testXattrs")
+	defer delete(feedXattrsOrigs, "testXattrs")
+
+	wrapFeedTypeXattrs("testXattrs")
+	wrapFeedTypeXattrs("testXattrs")
+
+	dests := map[string]cbgt.Dest{"0": &testXattrsDest{}}
+
+	err := cbgt.FeedTypes["testXattrs"].Start(nil, "f", "i", "u",
+		"testXattrs", "s", "", "", dests)
+	if err != nil || gotDests["0"] != dests["0"] {
+		t.Errorf("expected the dests as is without xattrs, err: %v", err)
+	}
+
+	err = cbgt.FeedTypes["testXattrs"].Start(nil, "f", "i", "u",
+		"testXattrs", "s", "", `{"xattrs":["reviewState"]}`, dests)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	if xd, ok := gotDests["0"].(*xattrsDest); !ok || xd.Dest != dests["0"] {
+		t.Errorf("expected wrapped dests, got: %#v", gotDests)
+	}
+
+	err = cbgt.FeedTypes["testXattrs"].Start(nil, "f", "i", "u",
+		"testXattrs", "s", "", `{"xattrs":[""]}`, dests)
+	if err == nil {
+		t.Errorf("expected err on bad sourceParams")
+	}
+}